@@ -23,6 +23,13 @@ import (
 	"github.com/e173-gateway/e173_go_gateway/pkg/repository" // Import repository package
 	"github.com/e173-gateway/e173_go_gateway/pkg/models" // Import models package
 	simhandler "github.com/e173-gateway/e173_go_gateway/pkg/api" // Import API handlers
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami"
+	"github.com/e173-gateway/e173_go_gateway/pkg/balance"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/recharge"
+	"github.com/e173-gateway/e173_go_gateway/pkg/secrets"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
 	
 	// Import enterprise modules
 	enterpriseRepo "github.com/e173-gateway/e173_go_gateway/internal/repository"
@@ -148,14 +155,201 @@ func main() {
 	}
 	defer adapter.CloseAdapter(sqlxDB) // Ensure adapter is closed on shutdown
 
+	// Stored SIM PIN/PUK codes are encrypted with SIM_SECRET_KEY; without
+	// it, SIM PINs can be neither stored nor used to unlock a SIM
+	var simSecrets *secrets.Box
+	if cfg.SIMSecretKey == "" {
+		logging.Logger.Warn("SIM_SECRET_KEY is not set; storing SIM PIN and PUK codes and unlocking SIMs are disabled. Generate one with \"openssl rand -base64 32\"")
+	} else {
+		simSecretKey, err := secrets.ParseKey(cfg.SIMSecretKey)
+		if err != nil {
+			logging.Logger.Fatalf("Invalid SIM_SECRET_KEY: %v", err)
+		}
+		if simSecrets, err = secrets.NewBox(simSecretKey); err != nil {
+			logging.Logger.Fatalf("Failed to set up SIM PIN encryption: %v", err)
+		}
+	}
+
 	// Initialize repositories
 	modemRepo := repository.NewPostgresModemRepository(dbPool)
-	simCardRepo := repository.NewPostgresSIMCardRepository(dbPool)
+	simCardRepo := repository.NewPostgresSIMCardRepository(dbPool, simSecrets)
+	alertRepo := repository.NewPostgresAlertRepository(dbPool)
+	radioRepo := repository.NewPostgresRadioRepository(dbPool)
+	smsRepo := repository.NewPostgresSMSRepository(dbPool)
+	ussdRepo := repository.NewPostgresUSSDRepository(dbPool)
 	cdrRepo := repository.NewPostgresCdrRepository(dbPool) // Initialize CDR Repository
 	gatewayRepo := repository.NewPostgresGatewayRepository(dbPool)
 	rechargeRepo := repository.NewRechargeRepository(sqlxDB)
 	blacklistRepo := repository.NewBlacklistRepository(sqlxDB)
 	prefixRepo := repository.NewPrefixRepository(sqlxDB)
+	sipAccountRepo := repository.NewSIPAccountRepository(sqlxDB)
+
+	if n, err := simCardRepo.EncryptStoredPINs(context.Background()); err != nil {
+		logging.Logger.WithError(err).Error("Failed to encrypt stored SIM PIN codes")
+	} else if n > 0 {
+		logging.Logger.Infof("Encrypted the PIN codes of %d SIM card(s)", n)
+	}
+	var simPINUnlocker *modem.PINUnlocker
+	if simSecrets != nil {
+		simPINUnlocker = modem.NewPINUnlocker(simCardRepo, alertRepo, cfg.SIMDefaultPINs, cfg.SIMDefaultPINLimit, logging.Logger)
+	}
+
+	// Spool CDRs the database rejects and replay them once it is back
+	var cdrOutbox *ami.CDROutbox
+	if cfg.CDROutboxDir != "" {
+		cdrOutbox, err = ami.NewCDROutbox(cfg.CDROutboxDir, cdrRepo, logging.Logger)
+		if err != nil {
+			logging.Logger.Fatalf("Failed to open CDR outbox: %v", err)
+		}
+		cdrOutbox.Start()
+		defer cdrOutbox.Stop()
+	}
+
+	// Start one AMI session per enabled gateway (CDRs, live gateway status)
+	amiManager := ami.NewGatewayManager(gatewayRepo, cdrRepo, modemRepo, simCardRepo, logging.Logger)
+	amiManager.SetRecordDir(cfg.AMIRecordDir)
+	amiManager.SetCDROutbox(cdrOutbox)
+
+	// Track each modem's health and recover failed ones: reset, restart,
+	// then power-cycle its USB port
+	var modemHealth *modem.HealthMonitor
+	if cfg.ModemHealth {
+		healthCfg := modem.DefaultHealthConfig()
+		healthCfg.WeakSignalDBM = cfg.WeakSignalDBM
+		healthCfg.CallFailureLimit = cfg.ModemCallFailureLimit
+		healthCfg.ATTimeoutLimit = cfg.ModemATTimeoutLimit
+		healthCfg.InitTimeout = cfg.ModemInitTimeout
+		healthCfg.DegradedFor = cfg.ModemDegradedFor
+		healthCfg.RecoveryWait = cfg.ModemRecoveryWait
+		healthCfg.MaxRecoveries = cfg.ModemMaxRecoveries
+		healthCfg.RecoveryWindow = cfg.ModemRecoveryWindow
+		var hub modem.HubController
+		switch cfg.USBHubController {
+		case "":
+		case "uhubctl":
+			hub = modem.NewUhubctl(cfg.UhubctlPath)
+		default:
+			logging.Logger.Warnf("Unknown USB_HUB_CONTROLLER %q; USB ports will not be power-cycled", cfg.USBHubController)
+		}
+		modemHealth = modem.NewHealthMonitor(healthCfg, modemRepo, alertRepo, ami.NewDongleRecoverer(amiManager), hub, logging.Logger)
+		amiManager.SetHealthMonitor(modemHealth)
+		modemHealth.Start()
+		defer modemHealth.Stop()
+	}
+
+	// Store the SMS the SIM cards receive and send through the best placed
+	// SIM: on the AT port of local modems, else through chan_dongle
+	smsTransport := sms.NewATTransport(modemRepo, "", ami.NewDongleSMSTransport(amiManager), logging.Logger)
+	smsService := sms.NewService(smsRepo, simCardRepo, smsTransport, logging.Logger)
+	amiManager.SetSMSService(smsService)
+
+	// USSD sessions on the SIM cards, through chan_dongle
+	ussdTemplates := ussd.DefaultTemplates()
+	if cfg.USSDTemplatesFile != "" {
+		if ussdTemplates, err = ussd.LoadTemplates(cfg.USSDTemplatesFile); err != nil {
+			logging.Logger.Fatalf("Failed to load USSD templates: %v", err)
+		}
+	}
+	ussdService := ussd.NewService(ussdRepo, simCardRepo, modemRepo, ami.NewDongleUSSDTransport(amiManager), ussdTemplates, logging.Logger)
+	amiManager.SetUSSDService(ussdService)
+	ussdService.Start()
+	defer ussdService.Stop()
+
+	// Check the balance of every SIM on a schedule, by USSD or by SMS to the
+	// operator, keep its history and alert when it runs low
+	var balanceChecks *balance.Checks
+	if cfg.BalanceChecksFile != "" {
+		if balanceChecks, err = balance.LoadChecks(cfg.BalanceChecksFile); err != nil {
+			logging.Logger.Fatalf("Failed to load balance checks: %v", err)
+		}
+	}
+	balanceOpts := balance.DefaultOptions()
+	balanceOpts.Interval = cfg.BalancePollInterval
+	balanceOpts.MaxConcurrent = cfg.BalancePollConcurrency
+	balanceOpts.Threshold = cfg.LowBalanceThreshold
+	balancePoller := balance.NewPoller(simCardRepo, alertRepo, ussdService, smsService, balanceChecks, balanceOpts, logging.Logger)
+	smsService.OnReceive(balancePoller.HandleSMS)
+
+	// Recharge SIM cards with vouchers from the stock, following the YAML
+	// scenario of their operator; low SIM cards are recharged automatically
+	var rechargeScenarios *recharge.Scenarios
+	if cfg.RechargeScenariosFile != "" {
+		if rechargeScenarios, err = recharge.LoadScenarios(cfg.RechargeScenariosFile); err != nil {
+			logging.Logger.Fatalf("Failed to load recharge scenarios: %v", err)
+		}
+	}
+	rechargeEngine := recharge.NewEngine(rechargeRepo, simCardRepo, ussdService, smsService, balancePoller, rechargeScenarios,
+		recharge.Options{AutoInterval: cfg.AutoRechargeInterval, Threshold: cfg.LowBalanceThreshold}, logging.Logger)
+	smsService.OnReceive(rechargeEngine.HandleSMS)
+	balancePoller.OnLow(func(ctx context.Context, sim *models.SIMCard, reading *models.SIMBalanceReading) {
+		rechargeEngine.Trigger()
+	})
+
+	smsService.Start()
+	defer smsService.Stop()
+	if cfg.BalancePollInterval > 0 {
+		balancePoller.Start()
+		defer balancePoller.Stop()
+	}
+	rechargeEngine.Start()
+	defer rechargeEngine.Stop()
+
+	// Keep the voucher stock: expire vouchers past their date and alert when
+	// an operator runs low
+	voucherInventory := recharge.NewInventory(rechargeRepo, alertRepo, rechargeScenarios, cfg.VoucherLowStock, logging.Logger)
+	voucherInventory.Start()
+	defer voucherInventory.Stop()
+
+	amiManager.Start()
+	defer amiManager.Stop()
+
+	// Poll signal and serving cell of every modem, raise weak-signal and
+	// registration-flap alarms
+	if cfg.RadioPollInterval > 0 {
+		radioOpts := ami.DefaultRadioOptions()
+		radioOpts.Interval = cfg.RadioPollInterval
+		radioOpts.WeakSignalDBM = cfg.WeakSignalDBM
+		radioOpts.WeakSignalFor = cfg.WeakSignalFor
+		radioOpts.FlapChanges = cfg.RegistrationFlapChanges
+		radioOpts.FlapWindow = cfg.RegistrationFlapWindow
+		radioOpts.Retention = time.Duration(cfg.RadioRetentionDays) * 24 * time.Hour
+		radioMonitor := ami.NewRadioMonitor(amiManager, radioRepo, modemRepo, simCardRepo, alertRepo, radioOpts, logging.Logger)
+		radioMonitor.SetHealthMonitor(modemHealth)
+		radioMonitor.Start()
+		defer radioMonitor.Stop()
+	}
+
+	// Track the USB modems plugged into this host across ttyUSB renumbering
+	var modemDiscovery *modem.Discovery
+	if cfg.ModemDiscovery {
+		var modemGatewayID *string
+		if cfg.ModemGatewayID != "" {
+			modemGatewayID = &cfg.ModemGatewayID
+		}
+		modemDiscovery = modem.NewDiscovery(modemGatewayID, modemRepo, logging.Logger)
+		modemDiscovery.SetDongleConf(cfg.DongleConfPath)
+		modemDiscovery.SetPINUnlocker(simPINUnlocker)
+		modemDiscovery.SetHealthMonitor(modemHealth)
+		if cfg.DongleConfPath != "" && modemGatewayID != nil {
+			modemDiscovery.SetChangeHandler(func(ctx context.Context, modems []modem.AttachedModem) {
+				session, ok := amiManager.Session(cfg.ModemGatewayID)
+				if !ok {
+					return
+				}
+				if err := session.DongleReload(ctx, "gracefully"); err != nil {
+					logging.Logger.WithError(err).Warn("Failed to reload chan_dongle after modem changes")
+				}
+			})
+		}
+		modemDiscovery.Start()
+		defer modemDiscovery.Stop()
+
+		if cfg.SMSReadModems {
+			smsInbox := sms.NewInbox(modemDiscovery, smsService, "", logging.Logger)
+			smsInbox.Start()
+			defer smsInbox.Stop()
+		}
+	}
 	
 	// Initialize JWT service
 	var jwtService *auth.JWTService
@@ -185,9 +379,18 @@ func main() {
 
 	// Initialize API Handlers
 	simAPIHandler := simhandler.NewSIMCardHandler(simCardRepo)
-	statsHandler := simhandler.NewStatsHandler(modemRepo, simCardRepo, cdrRepo, gatewayRepo, logging.Logger)
-	gatewayHandler := simhandler.NewGatewayHandler(gatewayRepo, logging.Logger)
-	rechargeHandler := simhandler.NewRechargeHandler(rechargeRepo, simCardRepo, logging.Logger.WithField("component", "recharge"))
+	statsHandler := simhandler.NewStatsHandler(modemRepo, simCardRepo, cdrRepo, gatewayRepo, cdrOutbox, logging.Logger)
+	gatewayHandler := simhandler.NewGatewayHandler(gatewayRepo, amiManager, logging.Logger)
+	callsHandler := simhandler.NewCallsHandler(amiManager, sipAccountRepo, logging.Logger)
+	modemHandler := simhandler.NewModemHandler(modemRepo, modemDiscovery, logging.Logger)
+	simPINHandler := simhandler.NewSIMPINHandler(simCardRepo, modemRepo, simPINUnlocker, logging.Logger)
+	alertHandler := simhandler.NewAlertHandler(alertRepo, logging.Logger)
+	radioHandler := simhandler.NewRadioHandler(radioRepo, modemRepo, cfg.WeakSignalDBM, logging.Logger)
+	modemHealthHandler := simhandler.NewModemHealthHandler(modemRepo, modemHealth, logging.Logger)
+	smsHandler := simhandler.NewSMSHandler(smsRepo, smsService, logging.Logger)
+	ussdHandler := simhandler.NewUSSDHandler(ussdRepo, ussdService, logging.Logger)
+	balanceHandler := simhandler.NewBalanceHandler(simCardRepo, balancePoller, logging.Logger)
+	rechargeHandler := simhandler.NewRechargeHandler(rechargeRepo, simCardRepo, rechargeEngine, voucherInventory, logging.Logger.WithField("component", "recharge"))
 	
 	// Initialize enterprise services
 	authService := service.NewPostgresAuthService(userRepo, systemRepo)
@@ -515,6 +718,11 @@ func main() {
 					No modems found
 				</div>`
 			} else {
+				// Signal over the last 24 hours, one point per 30 minutes
+				trends, err := radioRepo.GetSignalTrends(ctx, time.Now().Add(-24*time.Hour), 30*time.Minute)
+				if err != nil {
+					logging.Logger.WithError(err).Warn("Error fetching signal trends for modem status")
+				}
 				for _, modem := range modems {
 					statusColor := "green"
 					statusText := modem.Status
@@ -539,6 +747,7 @@ func main() {
 					if modem.SignalStrengthDBM != nil {
 						signalText = fmt.Sprintf("%.0f dBm", float64(*modem.SignalStrengthDBM))
 					}
+					signalTrend := simhandler.SignalSparkline(trends[modem.ID], cfg.WeakSignalDBM)
 					
 					// Build operator display
 					operatorText := "Unknown"
@@ -557,7 +766,7 @@ func main() {
 						<div class="flex justify-between items-start">
 							<div>
 								<h4 class="font-medium text-gray-900 dark:text-white">%s</h4>
-								<p class="text-sm text-gray-600 dark:text-gray-300">Signal: %s</p>
+								<p class="text-sm text-gray-600 dark:text-gray-300">Signal: %s %s</p>
 								<p class="text-sm text-gray-600 dark:text-gray-300">Operator: %s</p>
 								<p class="text-sm text-gray-600 dark:text-gray-300">Path: %s</p>
 							</div>
@@ -568,7 +777,7 @@ func main() {
 							</div>
 						</div>
 					</div>`, 
-					statusBg, statusColor, modemName, signalText, operatorText, modem.DevicePath, 
+					statusBg, statusColor, modemName, signalText, signalTrend, operatorText, modem.DevicePath, 
 					statusColor, statusColor, statusColor, statusColor, strings.ToUpper(statusText))
 				}
 			}
@@ -647,6 +856,34 @@ func main() {
 			c.JSON(http.StatusOK, modems)
 		})
 
+		v1.GET("/modems/attached", modemHandler.GetAttachedModems)
+		v1.GET("/modems/:id/moves", modemHandler.GetModemMoves)
+		v1.GET("/modems/signal-trends", radioHandler.GetSignalTrends)
+		v1.GET("/modems/:id/signal", radioHandler.GetSignalSeries)
+		v1.GET("/modems/:id/radio", radioHandler.GetRadioReadings)
+		v1.GET("/modems/health", modemHealthHandler.GetModemHealth)
+		v1.GET("/modems/:id/health", modemHealthHandler.GetHealthTransitions)
+		v1.POST("/modems/:id/quarantine",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			modemHealthHandler.QuarantineModem)
+		v1.POST("/modems/:id/release",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			modemHealthHandler.ReleaseModem)
+		v1.POST("/modems/discovery/scan",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			modemHandler.ScanModems)
+
+		// SMS API endpoints
+		v1.GET("/sms", smsHandler.ListMessages)
+		v1.GET("/sms/senders", smsHandler.ListSenders)
+		v1.GET("/sms/:id", smsHandler.GetMessage)
+		v1.POST("/sms",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			smsHandler.SendMessage)
+
 		// SIM Cards API endpoints
 		v1.POST("/simcards", simAPIHandler.CreateSIMCard)
 		v1.GET("/simcards/:id", simAPIHandler.GetSIMCardByID)
@@ -668,6 +905,18 @@ func main() {
 		})
 		v1.PUT("/simcards/:id", simAPIHandler.UpdateSIMCard) // New route for updating a SIM
 		v1.DELETE("/simcards/:id", simAPIHandler.DeleteSIMCard) // New route for deleting a SIM
+		v1.POST("/simcards/:id/unlock",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			simPINHandler.UnlockSIM)
+		v1.GET("/simcards/:id/pin-attempts", simPINHandler.GetPINAttempts)
+
+		// Alerts API endpoints
+		v1.GET("/alerts", alertHandler.ListAlerts)
+		v1.POST("/alerts/:id/resolve",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			alertHandler.ResolveAlert)
 		v1.GET("/simcards/:id/balance", func(c *gin.Context) {
 			idStr := c.Param("id")
 			id, err := strconv.ParseInt(idStr, 10, 64)
@@ -698,40 +947,47 @@ func main() {
 		v1.POST("/recharge/codes", rechargeHandler.CreateRechargeCode)
 		v1.POST("/sims/:id/recharge", rechargeHandler.RechargeSimCard)
 		v1.GET("/sims/:id/recharge/history", rechargeHandler.GetRechargeHistory)
+		v1.POST("/sims/:id/recharge/run",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			rechargeHandler.RunRecharge)
+		v1.POST("/recharge/auto",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			rechargeHandler.RunAutoRecharge)
+		v1.POST("/recharge/codes/import",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			rechargeHandler.ImportRechargeCodes)
+		v1.GET("/recharge/stock", rechargeHandler.GetVoucherStock)
+		v1.GET("/recharge/batches", rechargeHandler.ListBatches)
+		v1.GET("/recharge/batches/:id", rechargeHandler.GetBatch)
+		v1.POST("/recharge/batches",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			rechargeHandler.CreateBatch)
+		v1.POST("/recharge/batches/:id/cancel",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"),
+			rechargeHandler.CancelBatch)
+
+		// USSD API endpoints
+		v1.GET("/sims/:id/ussd", ussdHandler.GetUSSDLog)
+		v1.POST("/sims/:id/ussd",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			ussdHandler.SendUSSD)
+		v1.DELETE("/sims/:id/ussd",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			ussdHandler.CloseUSSDSession)
+
+		// SIM balance API endpoints
+		v1.GET("/sims/:id/balance/history", balanceHandler.GetBalanceHistory)
+		v1.POST("/sims/:id/balance/check",
+			handlers.WrapMiddleware(authHandlers.AuthMiddleware),
+			balanceHandler.CheckBalance)
 
 		// Active calls endpoint
-		v1.GET("/calls/active", func(c *gin.Context) {
-			// Return active calls HTML for HTMX
-			// In real implementation, this would query Asterisk for active channels
-			c.Header("Content-Type", "text/html")
-			c.String(http.StatusOK, `
-			<div class="space-y-2">
-				<div class="p-3 bg-red-50 dark:bg-red-900/20 rounded-lg border border-red-200 dark:border-red-800">
-					<div class="flex items-center justify-between">
-						<div>
-							<p class="text-sm font-medium text-gray-900 dark:text-white">+212612345678 → +212620987654</p>
-							<p class="text-xs text-gray-500 dark:text-gray-400">Duration: 02:45</p>
-						</div>
-						<div class="flex items-center space-x-1">
-							<div class="w-2 h-2 bg-red-500 rounded-full animate-pulse"></div>
-							<span class="text-xs text-red-600 dark:text-red-400">Active</span>
-						</div>
-					</div>
-				</div>
-				<div class="p-3 bg-red-50 dark:bg-red-900/20 rounded-lg border border-red-200 dark:border-red-800">
-					<div class="flex items-center justify-between">
-						<div>
-							<p class="text-sm font-medium text-gray-900 dark:text-white">+212700123456 → +212661234567</p>
-							<p class="text-xs text-gray-500 dark:text-gray-400">Duration: 00:15</p>
-						</div>
-						<div class="flex items-center space-x-1">
-							<div class="w-2 h-2 bg-red-500 rounded-full animate-pulse"></div>
-							<span class="text-xs text-red-600 dark:text-red-400">Active</span>
-						</div>
-					</div>
-				</div>
-			</div>`)
-		})
+		v1.GET("/calls/active", callsHandler.GetActiveCalls)
 
 		// Enterprise API endpoints
 		v1.POST("/enterprises", handlers.WrapHandler(customerHandlers.CreateCustomer))
@@ -760,6 +1016,22 @@ func main() {
 		v1.DELETE("/gateways/:id", gatewayHandler.DeleteGateway)
 		v1.POST("/gateways/heartbeat", gatewayHandler.Heartbeat)
 		v1.POST("/gateways/:id/test", gatewayHandler.TestGatewayConnection)
+
+		// Gateway AMI actions (admin only)
+		gatewayAdmin := v1.Group("/gateways/:id")
+		gatewayAdmin.Use(handlers.WrapMiddleware(authHandlers.AuthMiddleware))
+		gatewayAdmin.Use(handlers.WrapRoleMiddleware(authHandlers.RoleMiddleware, "admin"))
+		{
+			gatewayAdmin.GET("/channels", gatewayHandler.ListGatewayChannels)
+			gatewayAdmin.POST("/originate", gatewayHandler.OriginateCall)
+			gatewayAdmin.POST("/hangup", gatewayHandler.HangupChannel)
+			gatewayAdmin.POST("/calls/:linkedid/hangup", gatewayHandler.HangupActiveCall)
+			gatewayAdmin.GET("/dongles", gatewayHandler.ListGatewayDongles)
+			gatewayAdmin.POST("/dongles/:device/reset", gatewayHandler.ResetDongle)
+			gatewayAdmin.POST("/dongles/:device/restart", gatewayHandler.RestartDongle)
+			gatewayAdmin.POST("/dongles/:device/sms", gatewayHandler.SendDongleSMS)
+			gatewayAdmin.POST("/dongles/:device/ussd", gatewayHandler.SendDongleUSSD)
+		}
 		
 		// Stats endpoints (called by HTMX stats cards)
 		v1.GET("/stats/modems", statsHandler.GetModemStats)
@@ -767,6 +1039,8 @@ func main() {
 		v1.GET("/stats/calls", statsHandler.GetCallStats)
 		v1.GET("/stats/spam", statsHandler.GetSpamStats)
 		v1.GET("/stats/gateways", statsHandler.GetGatewayStats)
+		v1.GET("/stats/dispositions", statsHandler.GetDispositionStats)
+		v1.GET("/stats/cdr-outbox", statsHandler.GetCDROutboxStats)
 		v1.GET("/stats/cards", func(c *gin.Context) {
 			c.Header("Content-Type", "text/html")
 			c.String(http.StatusOK, `
@@ -1290,6 +1564,16 @@ func main() {
 		})
 	}
 
+	// SMS Frontend Routes
+	smsUIGroup := router.Group("/sms")
+	smsUIGroup.Use(authRedirect)
+	{
+		// SMS message log
+		smsUIGroup.GET("", func(c *gin.Context) {
+			c.HTML(http.StatusOK, "sms/list.tmpl", getTemplateData(c, "SMS Messages"))
+		})
+	}
+
 	// Settings Frontend Routes
 	// Add unprotected settings route directly to router
 	router.GET("/settings-new", authRedirect, func(c *gin.Context) {
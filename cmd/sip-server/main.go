@@ -5,7 +5,9 @@ import (
     "log"
     "os"
     "os/signal"
+    "strings"
     "syscall"
+    "time"
     
     "github.com/e173-gateway/e173_go_gateway/pkg/sip"
 )
@@ -13,6 +15,16 @@ import (
 func main() {
     port := flag.Int("port", 5060, "SIP server port")
     whatsappKey := flag.String("whatsapp-key", "", "WhatsApp Business API key")
+    gatewayList := flag.String("gateways", "", "Comma-separated host:port of the Asterisk gateways calls go to, in order of preference; append ;transport=tcp or ;transport=tls for stream transports")
+    strategy := flag.String("gateway-strategy", sip.StrategyWeighted, "How calls spread over gateways of the same priority: weighted, least-calls or priority")
+    probeInterval := flag.Duration("probe-interval", 3*time.Second, "Interval between SIP OPTIONS probes of each gateway")
+    tcp := flag.Bool("tcp", true, "Also listen for SIP over TCP on the SIP port")
+    tlsPort := flag.Int("tls-port", 5061, "SIP over TLS port")
+    tlsCert := flag.String("tls-cert", "", "TLS certificate file (PEM); enables SIP over TLS")
+    tlsKey := flag.String("tls-key", "", "TLS private key file (PEM)")
+    tlsCA := flag.String("tls-ca", "", "CA file (PEM) TLS peers are verified against, instead of the system CAs")
+    tlsVerifyClient := flag.Bool("tls-verify-client", false, "Require TLS clients to present a certificate signed by -tls-ca (mutual TLS)")
+    trusted := flag.String("trusted", "", "Comma-separated IPs allowed to place calls; calls from anywhere else are refused")
     flag.Parse()
 
     if *whatsappKey == "" {
@@ -23,6 +35,38 @@ func main() {
     
     // Create SIP server
     server := sip.NewBasicSIPServer(*port, *whatsappKey)
+    server.SetGatewayPool(sip.NewGatewayPool(nil, sip.GatewayPoolConfig{
+        ProbeInterval: *probeInterval,
+        Strategy:      *strategy,
+    }, log.New(log.Writer(), "[SIP] ", log.LstdFlags)))
+    gateways, err := sip.ParseGateways(*gatewayList)
+    if err != nil {
+        log.Fatalf("Invalid -gateways: %v", err)
+    }
+    if len(gateways) == 0 {
+        log.Println("Warning: No gateways given, approved calls will be refused")
+    }
+    server.SetGateways(gateways)
+    // This server has no SIP accounts to authenticate callers with
+    server.SetTrustedHosts(strings.Split(*trusted, ","))
+    if *trusted == "" {
+        log.Println("Warning: No trusted hosts given, all calls will be refused")
+    }
+    if *tcp {
+        server.EnableTCP()
+    }
+    if *tlsCert != "" {
+        tlsConfig, err := sip.LoadTLSConfig(sip.TLSOptions{
+            CertFile:      *tlsCert,
+            KeyFile:       *tlsKey,
+            CAFile:        *tlsCA,
+            VerifyClients: *tlsVerifyClient,
+        })
+        if err != nil {
+            log.Fatalf("Invalid TLS settings: %v", err)
+        }
+        server.EnableTLS(*tlsPort, tlsConfig)
+    }
     
     // Handle graceful shutdown
     sigChan := make(chan os.Signal, 1)
@@ -38,4 +82,5 @@ func main() {
     // Wait for shutdown signal
     <-sigChan
     log.Println("Shutting down SIP server...")
+    server.Stop()
 }
@@ -5,12 +5,16 @@ import (
     "log"
     "os"
     "os/signal"
+    "strings"
     "syscall"
+    "time"
     
     "github.com/joho/godotenv"
+    adapter "github.com/e173-gateway/e173_go_gateway/internal/database"
     "github.com/e173-gateway/e173_go_gateway/pkg/sip"
     "github.com/e173-gateway/e173_go_gateway/pkg/database"
     "github.com/e173-gateway/e173_go_gateway/pkg/config"
+    "github.com/e173-gateway/e173_go_gateway/pkg/repository"
 )
 
 func main() {
@@ -25,6 +29,17 @@ func main() {
     // Command line flags
     port := flag.Int("port", 5060, "SIP server port")
     whatsappKey := flag.String("whatsapp-key", "e42f7c9b-2a8e-4b86-a7e4-8f1de2c01f53", "WhatsApp API key")
+    gatewayList := flag.String("gateways", "", "Comma-separated host:port of Asterisk gateways calls go to besides those of the gateways table, in order of preference; append ;transport=tcp or ;transport=tls for stream transports")
+    strategy := flag.String("gateway-strategy", sip.StrategyWeighted, "How calls spread over gateways of the same priority: weighted, least-calls or priority")
+    probeInterval := flag.Duration("probe-interval", 3*time.Second, "Interval between SIP OPTIONS probes of each gateway")
+    tcp := flag.Bool("tcp", true, "Also listen for SIP over TCP on the SIP port")
+    tlsPort := flag.Int("tls-port", 5061, "SIP over TLS port")
+    tlsCert := flag.String("tls-cert", "", "TLS certificate file (PEM); enables SIP over TLS")
+    tlsKey := flag.String("tls-key", "", "TLS private key file (PEM)")
+    tlsCA := flag.String("tls-ca", "", "CA file (PEM) TLS peers are verified against, instead of the system CAs")
+    tlsVerifyClient := flag.Bool("tls-verify-client", false, "Require TLS clients to present a certificate signed by -tls-ca (mutual TLS)")
+    realm := flag.String("realm", "sip.e173gateway.com", "SIP digest authentication realm")
+    trusted := flag.String("trusted", "", "Comma-separated IPs whose calls need no SIP credentials (our gateways)")
     flag.Parse()
 
     if *whatsappKey == "" {
@@ -43,6 +58,44 @@ func main() {
     
     // Create SIP server with database support
     server := sip.NewBasicSIPServerWithDB(*port, *whatsappKey, dbPool)
+
+    // Calls go to the enabled gateways of the gateways table, probed with SIP OPTIONS
+    server.SetGatewayPool(sip.NewGatewayPool(repository.NewPostgresGatewayRepository(dbPool), sip.GatewayPoolConfig{
+        ProbeInterval: *probeInterval,
+        Strategy:      *strategy,
+    }, log.New(log.Writer(), "[SIP] ", log.LstdFlags)))
+    gateways, err := sip.ParseGateways(*gatewayList)
+    if err != nil {
+        log.Fatalf("Invalid -gateways: %v", err)
+    }
+    server.SetGateways(gateways)
+    if *tcp {
+        server.EnableTCP()
+    }
+    if *tlsCert != "" {
+        tlsConfig, err := sip.LoadTLSConfig(sip.TLSOptions{
+            CertFile:      *tlsCert,
+            KeyFile:       *tlsKey,
+            CAFile:        *tlsCA,
+            VerifyClients: *tlsVerifyClient,
+        })
+        if err != nil {
+            log.Fatalf("Invalid TLS settings: %v", err)
+        }
+        server.EnableTLS(*tlsPort, tlsConfig)
+    }
+
+    // Customers register and authenticate with their SIP accounts
+    sqlxDB, err := adapter.CreateSQLXAdapter(dbPool)
+    if err != nil {
+        log.Fatalf("Failed to create sqlx adapter: %v", err)
+    }
+    defer adapter.CloseAdapter(sqlxDB)
+    registrar := sip.NewRegistrar(repository.NewSIPAccountRepository(sqlxDB), sip.RegistrarConfig{
+        Realm:        *realm,
+        TrustedHosts: strings.Split(*trusted, ","),
+    }, log.New(log.Writer(), "[SIP] ", log.LstdFlags))
+    server.SetRegistrar(registrar)
     
     // Handle graceful shutdown
     sigChan := make(chan os.Signal, 1)
@@ -62,4 +115,5 @@ func main() {
     // Wait for shutdown signal
     <-sigChan
     log.Println("Shutting down SIP server...")
+    server.Stop()
 }
\ No newline at end of file
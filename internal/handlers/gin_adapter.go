@@ -13,8 +13,10 @@ func WrapHandler(h http.HandlerFunc) gin.HandlerFunc {
 // WrapMiddleware converts a standard HTTP middleware to Gin middleware
 func WrapMiddleware(middleware func(http.HandlerFunc) http.HandlerFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		passed := false
 		// Create a wrapped handler that calls c.Next()
 		wrappedHandler := middleware(func(w http.ResponseWriter, r *http.Request) {
+			passed = true
 			// Update the context with any modifications from middleware
 			c.Request = r
 			c.Next()
@@ -22,6 +24,12 @@ func WrapMiddleware(middleware func(http.HandlerFunc) http.HandlerFunc) gin.Hand
 		
 		// Call the middleware with our wrapped handler
 		wrappedHandler(c.Writer, c.Request)
+
+		// The middleware rejected the request and already wrote the response;
+		// stop gin from running the rest of the chain.
+		if !passed {
+			c.Abort()
+		}
 	}
 }
 
@@ -242,7 +242,7 @@ func (s *sipAccountService) RegisterSIPAccount(ctx context.Context, username, co
 		IsActive:       true,
 	}
 	
-	err = s.sipRepo.CreateRegistration(ctx, registration)
+	err = s.sipRepo.RefreshRegistration(ctx, registration)
 	if err != nil {
 		return fmt.Errorf("failed to create registration: %w", err)
 	}
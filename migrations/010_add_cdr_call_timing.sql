@@ -0,0 +1,12 @@
+-- Migration: Call-lifecycle timing for CDRs
+-- The AMI service now follows Newchannel/Dial/Newstate/Bridge/Hangup events and
+-- records post-dial delay (DialBegin to ringing or answer) alongside real
+-- start, answer and end times.
+
+ALTER TABLE call_detail_records
+ADD COLUMN IF NOT EXISTS post_dial_delay_ms INTEGER;
+
+-- CDRs whose direction cannot be determined were rejected by the original constraint
+ALTER TABLE call_detail_records DROP CONSTRAINT IF EXISTS call_detail_records_call_direction_check;
+ALTER TABLE call_detail_records
+ADD CONSTRAINT call_detail_records_call_direction_check CHECK (call_direction IN ('inbound', 'outbound', 'unknown'));
@@ -0,0 +1,8 @@
+-- Migration: Tag CDRs with the gateway that reported them
+-- Each enabled gateway now has its own AMI session, so every CDR knows which
+-- remote box the call went through.
+
+ALTER TABLE call_detail_records
+ADD COLUMN IF NOT EXISTS gateway_id UUID REFERENCES gateways(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_cdr_gateway_id ON call_detail_records(gateway_id);
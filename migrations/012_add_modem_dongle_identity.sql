@@ -0,0 +1,16 @@
+-- Migration: Identify modems by IMEI and chan_dongle device name per gateway
+-- Modems are now kept up to date from chan_dongle AMI events. A modem is keyed
+-- by its IMEI; the dongle name ("dongle0") and tty are only where it was last
+-- seen, and the same tty exists on every gateway.
+
+ALTER TABLE modems
+ADD COLUMN IF NOT EXISTS dongle_name VARCHAR(50);
+
+-- /dev/ttyUSB2 is only unique within one gateway
+ALTER TABLE modems DROP CONSTRAINT IF EXISTS modems_device_path_key;
+CREATE INDEX IF NOT EXISTS idx_modems_gateway_device_path ON modems(gateway_id, device_path);
+
+-- A dongle name belongs to at most one modem on a gateway
+CREATE UNIQUE INDEX IF NOT EXISTS idx_modems_gateway_dongle_name
+ON modems(gateway_id, dongle_name)
+WHERE dongle_name IS NOT NULL;
@@ -0,0 +1,18 @@
+-- Migration: Make CDR inserts idempotent on the gateway and Asterisk UniqueID
+-- CDRs that could not be written are spooled to disk and replayed later. The
+-- replay relies on ON CONFLICT, which needs a unique index. A UniqueID is
+-- only unique within one Asterisk, so two gateways may both send one: the
+-- key is the gateway and the UniqueID. CDRs of a service configured without
+-- a gateways row have no gateway_id, and NULLs never conflict, so those are
+-- kept unique on the UniqueID alone.
+
+ALTER TABLE call_detail_records
+DROP CONSTRAINT IF EXISTS call_detail_records_asterisk_unique_id_key;
+DROP INDEX IF EXISTS call_detail_records_asterisk_unique_id_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS call_detail_records_gateway_unique_id_key
+ON call_detail_records(gateway_id, asterisk_unique_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS call_detail_records_unique_id_no_gateway_key
+ON call_detail_records(asterisk_unique_id)
+WHERE gateway_id IS NULL;
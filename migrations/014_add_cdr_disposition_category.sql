@@ -0,0 +1,22 @@
+-- Migration: Normalized disposition category on CDRs
+-- disposition keeps the coarse ANSWERED / NO ANSWER / BUSY / FAILED value;
+-- disposition_category holds the outcome derived from the Q.850 cause,
+-- chan_dongle end cause or SIP response (busy, no-answer, sim-barred,
+-- no-credit, network-congestion, ...), so failure rates can be split between
+-- the destination, the network and our own SIMs.
+
+ALTER TABLE call_detail_records
+ADD COLUMN IF NOT EXISTS disposition_category VARCHAR(32);
+
+-- Older CDRs only have the coarse disposition to go on.
+UPDATE call_detail_records
+SET disposition_category = CASE disposition
+    WHEN 'ANSWERED' THEN 'answered'
+    WHEN 'BUSY' THEN 'busy'
+    WHEN 'NO ANSWER' THEN 'no-answer'
+    ELSE 'failed'
+END
+WHERE disposition_category IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_cdr_start_disposition_category
+ON call_detail_records(call_start_time, disposition_category);
@@ -0,0 +1,23 @@
+-- Migration: Track where modems are plugged in
+-- ttyUSB numbers are handed out in enumeration order and change whenever a
+-- hub is re-plugged or the gateway reboots. Modems stay keyed by IMEI; the
+-- USB port path ("1-1.4.2") is what is physically stable, and every time a
+-- modem turns up on another tty or port the move is recorded.
+
+ALTER TABLE modems
+ADD COLUMN IF NOT EXISTS audio_path VARCHAR(255),
+ADD COLUMN IF NOT EXISTS usb_path VARCHAR(100);
+
+CREATE INDEX IF NOT EXISTS idx_modems_gateway_usb_path ON modems(gateway_id, usb_path);
+
+CREATE TABLE IF NOT EXISTS modem_device_moves (
+    id BIGSERIAL PRIMARY KEY,
+    modem_id INTEGER NOT NULL REFERENCES modems(id) ON DELETE CASCADE,
+    old_device_path VARCHAR(255),
+    new_device_path VARCHAR(255) NOT NULL,
+    old_usb_path VARCHAR(100),
+    new_usb_path VARCHAR(100),
+    moved_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_modem_device_moves_modem ON modem_device_moves(modem_id, moved_at DESC);
@@ -0,0 +1,50 @@
+-- Migration: SIM PIN unlocking with attempt auditing, and alerts
+-- PIN and PUK codes are now stored encrypted ("enc:v1:..."), which does not
+-- fit the old VARCHAR(10) columns. Plain-text codes left from before are
+-- encrypted by the server on startup once SIM_SECRET_KEY is set.
+
+ALTER TABLE sim_cards
+ALTER COLUMN pin1 TYPE TEXT,
+ALTER COLUMN puk1 TYPE TEXT,
+ALTER COLUMN pin2 TYPE TEXT,
+ALTER COLUMN puk2 TYPE TEXT;
+
+-- Every PIN/PUK entered on a SIM. The codes themselves are not recorded.
+CREATE TABLE IF NOT EXISTS sim_pin_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    sim_card_id BIGINT REFERENCES sim_cards(id) ON DELETE SET NULL,
+    iccid VARCHAR(22),
+    modem_id INTEGER REFERENCES modems(id) ON DELETE SET NULL,
+    code_type VARCHAR(10) NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    success BOOLEAN NOT NULL,
+    retries_before INTEGER,
+    retries_after INTEGER,
+    error TEXT,
+    attempted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sim_pin_attempts_sim ON sim_pin_attempts(sim_card_id, attempted_at DESC);
+CREATE INDEX IF NOT EXISTS idx_sim_pin_attempts_iccid ON sim_pin_attempts(iccid, attempted_at DESC);
+
+-- Conditions that need an operator (SIM locked, modem down, low balance...)
+CREATE TABLE IF NOT EXISTS alerts (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(50) NOT NULL,
+    severity VARCHAR(20) NOT NULL DEFAULT 'warning',
+    entity_type VARCHAR(30) NOT NULL,
+    entity_id VARCHAR(100) NOT NULL,
+    message TEXT NOT NULL,
+    details JSONB,
+    count INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ
+);
+
+-- At most one open alert of a kind per entity
+CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_open
+ON alerts(kind, entity_type, entity_id)
+WHERE resolved_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_alerts_created_at ON alerts(created_at DESC);
@@ -0,0 +1,20 @@
+-- Migration: radio monitoring
+-- Signal and serving-cell readings taken by the radio poller, one row per
+-- modem per poll. Old readings are pruned by the server (RADIO_RETENTION_DAYS).
+
+CREATE TABLE IF NOT EXISTS modem_radio_readings (
+    id BIGSERIAL PRIMARY KEY,
+    modem_id INTEGER NOT NULL REFERENCES modems(id) ON DELETE CASCADE,
+    sim_card_id BIGINT REFERENCES sim_cards(id) ON DELETE SET NULL,
+    signal_dbm INTEGER,
+    registration VARCHAR(50),
+    registered BOOLEAN NOT NULL DEFAULT FALSE,
+    operator_name VARCHAR(100),
+    mode VARCHAR(30),
+    lac VARCHAR(10),
+    cell_id VARCHAR(20),
+    recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_modem_radio_readings_modem ON modem_radio_readings(modem_id, recorded_at DESC);
+CREATE INDEX IF NOT EXISTS idx_modem_radio_readings_recorded_at ON modem_radio_readings(recorded_at);
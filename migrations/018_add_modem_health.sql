@@ -0,0 +1,24 @@
+-- Migration: modem health lifecycle
+-- health_state is driven by the health monitor (discovered, initializing,
+-- ready, busy, degraded, failed, quarantined); status keeps reflecting what
+-- chan_dongle reports.
+
+ALTER TABLE modems
+ADD COLUMN IF NOT EXISTS health_state VARCHAR(20) NOT NULL DEFAULT 'discovered',
+ADD COLUMN IF NOT EXISTS health_changed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_modems_health_state ON modems(health_state);
+
+-- Every health state change and recovery action
+CREATE TABLE IF NOT EXISTS modem_health_transitions (
+    id BIGSERIAL PRIMARY KEY,
+    modem_id INTEGER NOT NULL REFERENCES modems(id) ON DELETE CASCADE,
+    from_state VARCHAR(20) NOT NULL,
+    to_state VARCHAR(20) NOT NULL,
+    reason TEXT NOT NULL,
+    action VARCHAR(20),
+    action_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_modem_health_transitions_modem ON modem_health_transitions(modem_id, created_at DESC);
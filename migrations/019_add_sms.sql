@@ -0,0 +1,48 @@
+-- Migration: SMS messages
+-- Inbound messages captured from chan_dongle (or read from the modems) and
+-- outbound messages sent through the API, with their delivery state.
+
+CREATE TABLE IF NOT EXISTS sms_messages (
+    id BIGSERIAL PRIMARY KEY,
+    direction VARCHAR(10) NOT NULL,        -- inbound, outbound
+    status VARCHAR(20) NOT NULL,           -- received, queued, sent, failed, delivered, undeliverable
+    modem_id INTEGER REFERENCES modems(id) ON DELETE SET NULL,
+    sim_card_id BIGINT REFERENCES sim_cards(id) ON DELETE SET NULL,
+    number VARCHAR(64) NOT NULL,           -- sender of inbound, recipient of outbound messages
+    body TEXT NOT NULL,
+    encoding VARCHAR(10) NOT NULL,         -- gsm7, ucs2, 8bit
+    parts INTEGER NOT NULL DEFAULT 1,
+    missing_parts INTEGER NOT NULL DEFAULT 0, -- parts of a long inbound message that never arrived
+    report_requested BOOLEAN NOT NULL DEFAULT FALSE,
+    task_id VARCHAR(64),                   -- chan_dongle's ID of a queued outbound message
+    reference INTEGER,                     -- TP-MR of the (last part of the) outbound message, when known
+    error TEXT,
+    sent_at TIMESTAMPTZ,
+    delivered_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), -- received or submitted
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sms_messages_created_at ON sms_messages(created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_sms_messages_modem ON sms_messages(modem_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_sms_messages_number ON sms_messages(number);
+CREATE INDEX IF NOT EXISTS idx_sms_messages_task ON sms_messages(modem_id, task_id) WHERE task_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_sms_messages_awaiting_report ON sms_messages(modem_id, number)
+    WHERE direction = 'outbound' AND status = 'sent' AND report_requested;
+
+-- Parts of long inbound messages waiting for the rest
+CREATE TABLE IF NOT EXISTS sms_message_parts (
+    id BIGSERIAL PRIMARY KEY,
+    modem_id INTEGER NOT NULL REFERENCES modems(id) ON DELETE CASCADE,
+    sim_card_id BIGINT REFERENCES sim_cards(id) ON DELETE SET NULL,
+    sender VARCHAR(64) NOT NULL,
+    concat_ref INTEGER NOT NULL,
+    total INTEGER NOT NULL,
+    seq INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    encoding VARCHAR(10) NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (modem_id, sender, concat_ref, total, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sms_message_parts_received_at ON sms_message_parts(received_at);
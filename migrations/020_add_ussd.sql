@@ -0,0 +1,34 @@
+-- Migration: USSD sessions
+-- Every USSD code sent on a SIM and the network's reply, grouped into the
+-- sessions of multi-step menus, with the values parsed from the replies.
+
+CREATE TABLE IF NOT EXISTS ussd_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    sim_card_id BIGINT NOT NULL REFERENCES sim_cards(id) ON DELETE CASCADE,
+    modem_id INTEGER REFERENCES modems(id) ON DELETE SET NULL,
+    operator_name VARCHAR(100),
+    status VARCHAR(20) NOT NULL DEFAULT 'open', -- open, closed, timeout, failed
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_activity_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ended_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_ussd_sessions_sim ON ussd_sessions(sim_card_id, started_at DESC);
+
+CREATE TABLE IF NOT EXISTS ussd_exchanges (
+    id BIGSERIAL PRIMARY KEY,
+    session_id BIGINT NOT NULL REFERENCES ussd_sessions(id) ON DELETE CASCADE,
+    sim_card_id BIGINT NOT NULL REFERENCES sim_cards(id) ON DELETE CASCADE,
+    modem_id INTEGER REFERENCES modems(id) ON DELETE SET NULL,
+    request VARCHAR(182) NOT NULL,  -- code or menu choice sent
+    task_id VARCHAR(64),            -- chan_dongle's ID of the queued request
+    response TEXT,
+    network_status INTEGER,         -- +CUSD status: 0 done, 1 reply expected, 2 ended by network, ...
+    parsed JSONB,                   -- balance, expiry, bundle remaining read from the response
+    error TEXT,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    responded_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_ussd_exchanges_sim ON ussd_exchanges(sim_card_id, requested_at DESC);
+CREATE INDEX IF NOT EXISTS idx_ussd_exchanges_session ON ussd_exchanges(session_id, requested_at);
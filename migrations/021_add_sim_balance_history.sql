@@ -0,0 +1,16 @@
+-- Migration: SIM balance history
+-- Every balance read from a SIM card, by the balance poller (USSD or an
+-- operator SMS) or entered by hand. sim_cards.balance keeps the latest one.
+
+CREATE TABLE IF NOT EXISTS sim_balance_history (
+    id BIGSERIAL PRIMARY KEY,
+    sim_card_id BIGINT NOT NULL REFERENCES sim_cards(id) ON DELETE CASCADE,
+    balance DECIMAL(10, 4) NOT NULL,
+    currency VARCHAR(10),
+    source VARCHAR(20) NOT NULL, -- ussd, sms, manual
+    raw_text TEXT,               -- the response the balance was read from
+    expires_at TIMESTAMPTZ,      -- validity of the credit, when the operator gives it
+    checked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_sim_balance_history_sim ON sim_balance_history(sim_card_id, checked_at DESC);
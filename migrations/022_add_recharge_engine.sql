@@ -0,0 +1,16 @@
+-- Migration: recharge engine
+-- Vouchers are stocked without a SIM and bound to one when the engine
+-- reserves them; a reserved or failed voucher is never used on another SIM.
+-- Automatic recharges have no user behind them.
+
+ALTER TABLE recharge_codes ALTER COLUMN sim_card_id DROP NOT NULL;
+ALTER TABLE recharge_codes
+ADD COLUMN IF NOT EXISTS reserved_at TIMESTAMP,
+ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_recharge_codes_stock ON recharge_codes(operator, status, amount);
+
+ALTER TABLE recharge_history ALTER COLUMN processed_by DROP NOT NULL;
+ALTER TABLE recharge_history
+ADD COLUMN IF NOT EXISTS scenario VARCHAR(50),
+ADD COLUMN IF NOT EXISTS response TEXT; -- the operator's last answer
@@ -0,0 +1,29 @@
+-- Migration: voucher inventory
+-- Vouchers go available -> reserved -> used or failed; available and
+-- never-entered reserved vouchers expire. Codes are unique per operator
+-- whatever the operator's case. A batch recharges a set of SIM cards, one
+-- item per SIM.
+
+UPDATE recharge_codes SET status = 'available' WHERE status IN ('pending', 'active');
+ALTER TABLE recharge_codes ALTER COLUMN status SET DEFAULT 'available';
+ALTER TABLE recharge_codes DROP CONSTRAINT IF EXISTS chk_recharge_codes_status;
+ALTER TABLE recharge_codes ADD CONSTRAINT chk_recharge_codes_status CHECK (status IN ('available', 'reserved', 'used', 'failed', 'expired'));
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_recharge_codes_operator_code ON recharge_codes(LOWER(operator), code);
+
+ALTER TABLE recharge_batches
+ADD COLUMN IF NOT EXISTS amount DECIMAL(10,2) NOT NULL DEFAULT 0, -- voucher amount per SIM; 0 takes any
+ADD COLUMN IF NOT EXISTS failed_codes INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recharge_batch_items (
+    id SERIAL PRIMARY KEY,
+    batch_id INTEGER NOT NULL REFERENCES recharge_batches(id) ON DELETE CASCADE,
+    sim_card_id INTEGER NOT NULL REFERENCES sim_cards(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, running, success, failed, skipped
+    recharge_history_id INTEGER REFERENCES recharge_history(id),
+    error_message TEXT,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT unique_recharge_batch_item UNIQUE (batch_id, sim_card_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_recharge_batch_items_batch ON recharge_batch_items(batch_id, status);
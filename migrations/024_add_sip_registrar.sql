@@ -0,0 +1,19 @@
+-- Migration: SIP registrar
+-- A contact has one active registration per SIP account, refreshed in place
+-- by each REGISTER, and is deactivated when it is removed or expires. The
+-- transport is kept so calls reach the contact the way it registered.
+
+UPDATE sip_registrations r SET is_active = false, unregistered_at = CURRENT_TIMESTAMP
+WHERE r.is_active AND EXISTS (
+    SELECT 1 FROM sip_registrations n
+    WHERE n.sip_account_id = r.sip_account_id AND n.contact_uri = r.contact_uri
+      AND n.is_active AND n.id > r.id
+);
+
+ALTER TABLE sip_registrations
+ADD COLUMN IF NOT EXISTS transport VARCHAR(10) NOT NULL DEFAULT 'UDP';
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sip_registrations_active_contact
+ON sip_registrations(sip_account_id, contact_uri) WHERE is_active;
+CREATE INDEX IF NOT EXISTS idx_sip_registrations_expired_at
+ON sip_registrations(expired_at) WHERE is_active;
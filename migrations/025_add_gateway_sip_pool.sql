@@ -0,0 +1,33 @@
+-- Migration: SIP gateway pool
+-- The SIP server sends calls to the Asterisk of each enabled gateway at
+-- sip_endpoint:sip_port (its AMI host when no endpoint is set) and probes it
+-- with SIP OPTIONS. health_status is what the probes say (up, down, unknown),
+-- sip_latency_ms the round trip of the last answered probe and
+-- uptime_percent the share of the last 24 hours it was up. The probes leave
+-- status and last_error alone: those belong to the AMI connection.
+-- Databases updated with DATABASE_UPDATES.sql have sip_endpoint, sip_port,
+-- health_status and health_last_check already.
+
+ALTER TABLE gateways
+ADD COLUMN IF NOT EXISTS sip_endpoint VARCHAR(255),
+ADD COLUMN IF NOT EXISTS sip_port INTEGER DEFAULT 5060,
+ADD COLUMN IF NOT EXISTS sip_transport VARCHAR(10) NOT NULL DEFAULT 'UDP',
+ADD COLUMN IF NOT EXISTS sip_weight INTEGER NOT NULL DEFAULT 1,
+ADD COLUMN IF NOT EXISTS sip_priority INTEGER NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS health_status VARCHAR(50),
+ADD COLUMN IF NOT EXISTS health_last_check TIMESTAMPTZ,
+ADD COLUMN IF NOT EXISTS sip_latency_ms INTEGER,
+ADD COLUMN IF NOT EXISTS uptime_percent NUMERIC(5,2) NOT NULL DEFAULT 0;
+
+UPDATE gateways SET sip_port = 5060 WHERE sip_port IS NULL;
+UPDATE gateways SET health_status = 'unknown' WHERE health_status IS NULL OR health_status NOT IN ('up', 'down');
+
+ALTER TABLE gateways
+ALTER COLUMN sip_port SET NOT NULL,
+ALTER COLUMN health_status SET DEFAULT 'unknown',
+ALTER COLUMN health_status SET NOT NULL;
+
+ALTER TABLE gateways DROP CONSTRAINT IF EXISTS chk_gateways_sip_transport;
+ALTER TABLE gateways ADD CONSTRAINT chk_gateways_sip_transport CHECK (sip_transport IN ('UDP', 'TCP', 'TLS'));
+ALTER TABLE gateways DROP CONSTRAINT IF EXISTS chk_gateways_sip_weight;
+ALTER TABLE gateways ADD CONSTRAINT chk_gateways_sip_weight CHECK (sip_weight > 0);
@@ -192,10 +192,8 @@ func (m *VoiceAgentManager) runConversation(ctx context.Context, callID string,
 
 // generateAgentResponse creates a response based on agent personality
 func (m *VoiceAgentManager) generateAgentResponse(ctx context.Context, agent *VoiceAgent, conversation []Message) (string, error) {
-    // Build prompt based on agent strategy
-    prompt := m.buildAgentPrompt(agent, conversation)
-    
-    // Generate response using LLM
+    // Generate response using LLM; the provider builds the prompt from the
+    // agent's personality and strategy
     response, err := m.llmProvider.GenerateResponse(ctx, conversation, *agent)
     if err != nil {
         // Fallback responses based on agent type
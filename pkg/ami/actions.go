@@ -0,0 +1,431 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goami2 "github.com/staskobzar/goami2"
+)
+
+const (
+	// actionTimeout bounds how long an action waits for its response when the
+	// caller's context has no deadline of its own.
+	actionTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNotConnected is returned when an action is sent while the service is
+	// not logged in to AMI.
+	ErrNotConnected = errors.New("ami: not connected")
+	// ErrConnectionLost is returned to actions still waiting for a response
+	// when the AMI connection drops.
+	ErrConnectionLost = errors.New("ami: connection lost before response")
+	// ErrCallNotFound is returned by HangupCall for a call that is not in
+	// progress on the gateway.
+	ErrCallNotFound = errors.New("ami: call not found")
+	// ErrLineBreak is returned for an action with a line break in a field.
+	// goami2 sends fields as they are, so it would end the action early and
+	// start another one.
+	ErrLineBreak = errors.New("ami: line break in action field")
+)
+
+// ActionError is returned when Asterisk answers an action with Response: Error.
+type ActionError struct {
+	Action  string
+	Message string
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("ami: %s failed: %s", e.Action, e.Message)
+}
+
+// ActionResponse is Asterisk's reply to an action: the Response message and,
+// for list actions, the events sent before the list completed.
+type ActionResponse struct {
+	Response *goami2.Message
+	Events   []*goami2.Message
+}
+
+// pendingAction is an action waiting for its reply.
+type pendingAction struct {
+	completeEvent string // event ending a list reply, "" for single responses
+	reply         ActionResponse
+	err           error
+	done          chan struct{}
+}
+
+// actionCorrelator matches incoming messages to sent actions by ActionID.
+type actionCorrelator struct {
+	mu      sync.Mutex
+	pending map[string]*pendingAction
+}
+
+func newActionCorrelator() *actionCorrelator {
+	return &actionCorrelator{pending: make(map[string]*pendingAction)}
+}
+
+func (c *actionCorrelator) register(actionID, completeEvent string) *pendingAction {
+	p := &pendingAction{completeEvent: completeEvent, done: make(chan struct{})}
+	c.mu.Lock()
+	c.pending[actionID] = p
+	c.mu.Unlock()
+	return p
+}
+
+func (c *actionCorrelator) forget(actionID string) {
+	c.mu.Lock()
+	delete(c.pending, actionID)
+	c.mu.Unlock()
+}
+
+// deliver hands msg to the action it answers. It reports whether the message
+// belonged to a pending action.
+func (c *actionCorrelator) deliver(msg *goami2.Message) bool {
+	actionID := msg.ActionID()
+	if actionID == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[actionID]
+	if !ok {
+		return false
+	}
+
+	finished := false
+	if msg.IsResponse() {
+		p.reply.Response = msg
+		finished = p.completeEvent == "" || !msg.IsSuccess()
+	} else if p.completeEvent != "" {
+		if msg.Field("Event") == p.completeEvent || strings.EqualFold(msg.Field("EventList"), "Complete") {
+			finished = true
+		} else {
+			p.reply.Events = append(p.reply.Events, msg)
+		}
+	}
+
+	if finished {
+		delete(c.pending, actionID)
+		close(p.done)
+	}
+	return true
+}
+
+// failAll aborts every pending action, e.g. when the connection is lost.
+func (c *actionCorrelator) failAll(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, p := range c.pending {
+		p.err = err
+		close(p.done)
+		delete(c.pending, id)
+	}
+}
+
+// SendAction sends an AMI action and waits for its reply. For actions whose
+// reply is an event list, completeEvent names the event that ends the list
+// (e.g. "CoreShowChannelsComplete"); pass "" for single responses. An ActionID
+// is added to the action if it has none.
+func (s *AMIService) SendAction(ctx context.Context, action *goami2.Message, completeEvent string) (*ActionResponse, error) {
+	client := s.client()
+	if client == nil {
+		return nil, ErrNotConnected
+	}
+	return sendAction(ctx, client, s.actions, action, completeEvent)
+}
+
+// sendAction sends action on client and waits for the reply to be delivered
+// to actions by whoever reads the client's messages.
+func sendAction(ctx context.Context, client *goami2.Client, actions *actionCorrelator, action *goami2.Message, completeEvent string) (*ActionResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, actionTimeout)
+		defer cancel()
+	}
+
+	name := action.Field("Action")
+	for _, h := range action.Headers() {
+		if strings.ContainsAny(h.Name, "\r\n") || strings.ContainsAny(h.Value, "\r\n") {
+			return nil, fmt.Errorf("%w: %s %s", ErrLineBreak, name, h.Name)
+		}
+	}
+	if action.ActionID() == "" {
+		action.AddActionID()
+	}
+	actionID := action.ActionID()
+	pending := actions.register(actionID, completeEvent)
+
+	if err := client.MustSend(action.Byte()); err != nil {
+		actions.forget(actionID)
+		return nil, fmt.Errorf("ami: sending %s: %w", name, err)
+	}
+
+	select {
+	case <-pending.done:
+	case <-ctx.Done():
+		actions.forget(actionID)
+		return nil, fmt.Errorf("ami: waiting for %s response: %w", name, ctx.Err())
+	}
+	if pending.err != nil {
+		return nil, pending.err
+	}
+	if !pending.reply.Response.IsSuccess() {
+		return &pending.reply, &ActionError{Action: name, Message: pending.reply.Response.Field("Message")}
+	}
+	return &pending.reply, nil
+}
+
+// OriginateRequest describes a call to place with Originate. Either Exten
+// (with Context and Priority) or Application must be set.
+type OriginateRequest struct {
+	Channel     string            `json:"channel" binding:"required"`
+	Exten       string            `json:"exten,omitempty"`
+	Context     string            `json:"context,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+	Application string            `json:"application,omitempty"`
+	Data        string            `json:"data,omitempty"`
+	CallerID    string            `json:"caller_id,omitempty"`
+	TimeoutMs   int               `json:"timeout_ms,omitempty"`
+	Variables   map[string]string `json:"variables,omitempty"`
+}
+
+// ChannelInfo is one channel reported by CoreShowChannels.
+type ChannelInfo struct {
+	Channel          string `json:"channel"`
+	UniqueID         string `json:"unique_id"`
+	LinkedID         string `json:"linked_id"`
+	State            string `json:"state"`
+	CallerIDNum      string `json:"caller_id_num"`
+	CallerIDName     string `json:"caller_id_name"`
+	ConnectedLineNum string `json:"connected_line_num"`
+	Context          string `json:"context"`
+	Exten            string `json:"exten"`
+	Application      string `json:"application"`
+	ApplicationData  string `json:"application_data"`
+	Duration         string `json:"duration"`
+	BridgeID         string `json:"bridge_id,omitempty"`
+	AccountCode      string `json:"account_code,omitempty"`
+}
+
+// DongleDevice is one chan_dongle device reported by DongleShowDevices.
+type DongleDevice struct {
+	Device           string `json:"device"`
+	State            string `json:"state"`
+	IMEI             string `json:"imei,omitempty"`
+	IMSI             string `json:"imsi,omitempty"`
+	ICCID            string `json:"iccid,omitempty"`
+	Manufacturer     string `json:"manufacturer,omitempty"`
+	Model            string `json:"model,omitempty"`
+	Firmware         string `json:"firmware,omitempty"`
+	Provider         string `json:"provider,omitempty"`
+	Registration     string `json:"registration,omitempty"`
+	SignalDBM        *int   `json:"signal_dbm,omitempty"`
+	Mode             string `json:"mode,omitempty"` // radio access technology, e.g. "WCDMA"
+	LAC              string `json:"lac,omitempty"`
+	CellID           string `json:"cell_id,omitempty"`
+	SubscriberNumber string `json:"subscriber_number,omitempty"`
+	DataPort         string `json:"data_port,omitempty"`
+	AudioPort        string `json:"audio_port,omitempty"`
+}
+
+// Originate places a call. The action is sent with Async so the response
+// arrives as soon as the call is queued rather than when it is answered.
+func (s *AMIService) Originate(ctx context.Context, req OriginateRequest) error {
+	action := goami2.NewAction("Originate")
+	action.AddField("Channel", req.Channel)
+	if req.Application != "" {
+		action.AddField("Application", req.Application)
+		if req.Data != "" {
+			action.AddField("Data", req.Data)
+		}
+	} else {
+		priority := req.Priority
+		if priority == 0 {
+			priority = 1
+		}
+		action.AddField("Exten", req.Exten)
+		action.AddField("Context", req.Context)
+		action.AddField("Priority", strconv.Itoa(priority))
+	}
+	if req.CallerID != "" {
+		action.AddField("CallerID", req.CallerID)
+	}
+	if req.TimeoutMs > 0 {
+		action.AddField("Timeout", strconv.Itoa(req.TimeoutMs))
+	}
+	for name, value := range req.Variables {
+		action.AddField("Variable", name+"="+value)
+	}
+	action.AddField("Async", "true")
+
+	_, err := s.SendAction(ctx, action, "")
+	return err
+}
+
+// Hangup hangs up a channel with the given Q.850 cause (0 lets Asterisk pick
+// the default, normal clearing).
+func (s *AMIService) Hangup(ctx context.Context, channel string, cause int) error {
+	action := goami2.NewAction("Hangup")
+	action.AddField("Channel", channel)
+	if cause > 0 {
+		action.AddField("Cause", strconv.Itoa(cause))
+	}
+	_, err := s.SendAction(ctx, action, "")
+	return err
+}
+
+// CoreShowChannels lists the channels currently up on the gateway.
+func (s *AMIService) CoreShowChannels(ctx context.Context) ([]ChannelInfo, error) {
+	reply, err := s.SendAction(ctx, goami2.NewAction("CoreShowChannels"), "CoreShowChannelsComplete")
+	if err != nil {
+		return nil, err
+	}
+	return parseChannels(reply), nil
+}
+
+func parseChannels(reply *ActionResponse) []ChannelInfo {
+	channels := make([]ChannelInfo, 0, len(reply.Events))
+	for _, msg := range reply.Events {
+		if getHeader(msg, "Event") != "CoreShowChannel" {
+			continue
+		}
+		channels = append(channels, ChannelInfo{
+			Channel:          getHeader(msg, "Channel"),
+			UniqueID:         getHeader(msg, "Uniqueid"),
+			LinkedID:         getHeader(msg, "Linkedid"),
+			State:            getHeader(msg, "ChannelStateDesc"),
+			CallerIDNum:      getHeader(msg, "CallerIDNum"),
+			CallerIDName:     getHeader(msg, "CallerIDName"),
+			ConnectedLineNum: getHeader(msg, "ConnectedLineNum"),
+			Context:          getHeader(msg, "Context"),
+			Exten:            getHeader(msg, "Exten"),
+			Application:      getHeader(msg, "Application"),
+			ApplicationData:  getHeader(msg, "ApplicationData"),
+			Duration:         getHeader(msg, "Duration"),
+			BridgeID:         getHeader(msg, "BridgeId"),
+			AccountCode:      getHeader(msg, "AccountCode"),
+		})
+	}
+	return channels
+}
+
+// DongleShowDevices lists the chan_dongle devices of the gateway, or only
+// device when it is not empty.
+func (s *AMIService) DongleShowDevices(ctx context.Context, device string) ([]DongleDevice, error) {
+	action := goami2.NewAction("DongleShowDevices")
+	if device != "" {
+		action.AddField("Device", device)
+	}
+	reply, err := s.SendAction(ctx, action, "DongleShowDevicesComplete")
+	if err != nil {
+		return nil, err
+	}
+	return parseDongleDevices(reply), nil
+}
+
+func parseDongleDevices(reply *ActionResponse) []DongleDevice {
+	devices := make([]DongleDevice, 0, len(reply.Events))
+	for _, msg := range reply.Events {
+		if getHeader(msg, "Event") != "DongleDeviceEntry" {
+			continue
+		}
+		devices = append(devices, DongleDevice{
+			Device:           getHeader(msg, "Device"),
+			State:            getHeader(msg, "State"),
+			IMEI:             firstNonEmpty(dongleValue(msg, "IMEIState"), dongleValue(msg, "IMEISetting")),
+			IMSI:             dongleValue(msg, "IMSIState"),
+			ICCID:            dongleValue(msg, "ICCID"),
+			Manufacturer:     dongleValue(msg, "Manufacturer"),
+			Model:            dongleValue(msg, "Model"),
+			Firmware:         dongleValue(msg, "Firmware"),
+			Provider:         dongleValue(msg, "ProviderName"),
+			Registration:     dongleValue(msg, "GSMRegistrationStatus"),
+			SignalDBM:        parseDongleRSSI(getHeader(msg, "RSSI")),
+			Mode:             firstNonEmpty(dongleValue(msg, "Submode"), dongleValue(msg, "Mode")),
+			LAC:              dongleValue(msg, "LocationAreaCode"),
+			CellID:           dongleValue(msg, "CellID"),
+			SubscriberNumber: dongleValue(msg, "SubscriberNumber"),
+			DataPort:         firstNonEmpty(dongleValue(msg, "DataState"), dongleValue(msg, "DataSetting")),
+			AudioPort:        firstNonEmpty(dongleValue(msg, "AudioState"), dongleValue(msg, "AudioSetting")),
+		})
+	}
+	return devices
+}
+
+// DongleReset power-cycles the modem behind a chan_dongle device (AT+CFUN=1,1).
+func (s *AMIService) DongleReset(ctx context.Context, device string) error {
+	action := goami2.NewAction("DongleReset")
+	action.AddField("Device", device)
+	_, err := s.SendAction(ctx, action, "")
+	return err
+}
+
+// DongleRestart restarts a chan_dongle device. when is "now", "gracefully"
+// (after the current calls end) or "when convenient"; empty means "now".
+func (s *AMIService) DongleRestart(ctx context.Context, device, when string) error {
+	if when == "" {
+		when = "now"
+	}
+	action := goami2.NewAction("DongleRestart")
+	action.AddField("Device", device)
+	action.AddField("When", when)
+	_, err := s.SendAction(ctx, action, "")
+	return err
+}
+
+// DongleReload makes chan_dongle reread dongle.conf. when is "now",
+// "gracefully" or "when convenient"; empty means "gracefully".
+func (s *AMIService) DongleReload(ctx context.Context, when string) error {
+	if when == "" {
+		when = "gracefully"
+	}
+	action := goami2.NewAction("DongleReload")
+	action.AddField("When", when)
+	_, err := s.SendAction(ctx, action, "")
+	return err
+}
+
+// DongleSendSMS queues an SMS on a chan_dongle device and returns the task ID
+// chan_dongle assigned to it. report asks the network for a delivery report.
+// Line breaks in message are sent escaped, as chan_dongle expects them.
+func (s *AMIService) DongleSendSMS(ctx context.Context, device, number, message string, report bool) (string, error) {
+	action := goami2.NewAction("DongleSendSMS")
+	action.AddField("Device", device)
+	action.AddField("Number", number)
+	action.AddField("Message", escapeSMSLines(message))
+	if report {
+		action.AddField("Report", "yes")
+	}
+	reply, err := s.SendAction(ctx, action, "")
+	if err != nil {
+		return "", err
+	}
+	return reply.Response.Field("ID"), nil
+}
+
+// escapeSMSLines writes the line breaks of an SMS as chan_dongle's \n, which
+// it turns back into line breaks.
+func escapeSMSLines(message string) string {
+	message = strings.ReplaceAll(message, "\r\n", "\n")
+	message = strings.ReplaceAll(message, "\r", "\n")
+	return strings.ReplaceAll(message, "\n", `\n`)
+}
+
+// DongleSendUSSD queues a USSD request on a chan_dongle device and returns the
+// task ID. The network's answer arrives later as a DongleNewUSSD event.
+func (s *AMIService) DongleSendUSSD(ctx context.Context, device, ussd string) (string, error) {
+	action := goami2.NewAction("DongleSendUSSD")
+	action.AddField("Device", device)
+	action.AddField("USSD", ussd)
+	reply, err := s.SendAction(ctx, action, "")
+	if err != nil {
+		return "", err
+	}
+	return reply.Response.Field("ID"), nil
+}
@@ -0,0 +1,88 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami/amitest"
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+func TestActionsRefuseLineBreaks(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Handle("DongleSendSMS", func(action *goami2.Message) []*goami2.Message {
+		return []*goami2.Message{amitest.NewResponse(true, "[dongle0] SMS queued for send", "ID", "0x55d1")}
+	})
+	s := startService(t, srv, "secret", &fakeCdrRepo{cdrs: make(chan *models.Cdr, 1)}, nil, nil)
+	s.Start()
+	waitConnected(t, s)
+	ctx := context.Background()
+
+	// An SMS may span lines; they are sent escaped.
+	if _, err := s.DongleSendSMS(ctx, "dongle0", "0612345678", "Bonjour\r\nA demain\nMerci", false); err != nil {
+		t.Fatalf("DongleSendSMS: %v", err)
+	}
+	var sent *goami2.Message
+	for _, action := range srv.Received() {
+		if action.Field("Action") == "DongleSendSMS" {
+			sent = action
+		}
+	}
+	if sent == nil {
+		t.Fatal("DongleSendSMS not received")
+	}
+	if got := sent.Field("Message"); got != `Bonjour\nA demain\nMerci` {
+		t.Errorf("Message = %q, want the line breaks escaped", got)
+	}
+
+	received := len(srv.Received())
+	attempts := map[string]func() error{
+		"SMS number": func() error {
+			_, err := s.DongleSendSMS(ctx, "dongle0", "0612345678\r\nAction: DongleReset", "hi", false)
+			return err
+		},
+		"USSD": func() error {
+			_, err := s.DongleSendUSSD(ctx, "dongle0", "*100#\r\n\r\nAction: DongleReset")
+			return err
+		},
+		"Originate caller ID": func() error {
+			return s.Originate(ctx, OriginateRequest{
+				Channel:  "Dongle/dongle0/0612345678",
+				Exten:    "100",
+				Context:  "from-internal",
+				CallerID: "\"Support\" <100>\nAction: Hangup",
+			})
+		},
+		"Originate variable": func() error {
+			return s.Originate(ctx, OriginateRequest{
+				Channel:     "Dongle/dongle0/0612345678",
+				Application: "Playback",
+				Variables:   map[string]string{"CAMPAIGN": "a\rb"},
+			})
+		},
+	}
+	for name, attempt := range attempts {
+		if err := attempt(); !errors.Is(err, ErrLineBreak) {
+			t.Errorf("%s with a line break: got %v, want ErrLineBreak", name, err)
+		}
+	}
+	if n := len(srv.Received()); n != received {
+		t.Errorf("%d actions sent with line breaks", n-received)
+	}
+}
+
+func TestEscapeSMSLines(t *testing.T) {
+	for in, want := range map[string]string{
+		"one line":       "one line",
+		"a\nb":           `a\nb`,
+		"a\r\nb":         `a\nb`,
+		"a\rb\n\nc":      `a\nb\n\nc`,
+		`already \n one`: `already \n one`,
+	} {
+		if got := escapeSMSLines(in); got != want {
+			t.Errorf("escapeSMSLines(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package ami
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// sipPeerRegex captures the peer name of a SIP channel,
+// e.g. "alice" from "PJSIP/alice-00000012" or "SIP/alice-0000a1b2".
+var sipPeerRegex = regexp.MustCompile(`^(?:PJSIP|SIP)/([^-]+)-[0-9a-f]+$`)
+
+// ActiveCall is a snapshot of a call in progress on a gateway.
+type ActiveCall struct {
+	GatewayID   string     `json:"gateway_id"`
+	GatewayName string     `json:"gateway_name"`
+	LinkedID    string     `json:"linked_id"`
+	Channel     string     `json:"channel"`  // originating channel
+	Channels    []string   `json:"channels"` // every leg still up
+	Caller      string     `json:"caller"`
+	CallerName  string     `json:"caller_name,omitempty"`
+	Callee      string     `json:"callee"`
+	Dongle      string     `json:"dongle,omitempty"`
+	ModemID     int        `json:"modem_id,omitempty"`
+	SIMCardID   int64      `json:"sim_card_id,omitempty"`
+	SIPPeer     string     `json:"sip_peer,omitempty"`
+	AccountCode string     `json:"account_code,omitempty"`
+	StartTime   time.Time  `json:"start_time"`
+	AnsweredAt  *time.Time `json:"answered_at,omitempty"`
+	Answered    bool       `json:"answered"`
+	Duration    int        `json:"duration_seconds"` // since start, at snapshot time
+}
+
+// Snapshot returns copies of the calls currently in progress.
+func (t *callTracker) Snapshot() []*trackedCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	calls := make([]*trackedCall, 0, len(t.calls))
+	for _, call := range t.calls {
+		c := *call
+		c.Legs = make(map[string]*callLeg, len(call.Legs))
+		for id, leg := range call.Legs {
+			l := *leg
+			c.Legs[id] = &l
+		}
+		c.legOrder = append([]string(nil), call.legOrder...)
+		calls = append(calls, &c)
+	}
+	return calls
+}
+
+// ActiveCalls returns the calls currently in progress on this gateway, oldest
+// first.
+func (s *AMIService) ActiveCalls() []ActiveCall {
+	now := time.Now().UTC()
+	calls := s.calls.Snapshot()
+	active := make([]ActiveCall, 0, len(calls))
+	for _, call := range calls {
+		origin := call.Originator()
+		if origin == nil {
+			continue
+		}
+		ac := ActiveCall{
+			GatewayID:   s.gatewayID,
+			GatewayName: s.gatewayName,
+			LinkedID:    call.LinkedID,
+			Channel:     origin.Channel,
+			Caller:      origin.CallerIDNum,
+			CallerName:  origin.CallerIDName,
+			Callee:      firstNonEmpty(call.Destination, origin.Exten),
+			AccountCode: origin.AccountCode,
+			StartTime:   call.StartTime,
+			AnsweredAt:  call.AnswerTime,
+			Answered:    call.AnswerTime != nil,
+			Duration:    int(now.Sub(call.StartTime).Seconds()),
+		}
+		for _, leg := range call.OrderedLegs() {
+			if leg.Hangup != nil {
+				continue
+			}
+			ac.Channels = append(ac.Channels, leg.Channel)
+			if matches := channelDeviceRegex.FindStringSubmatch(leg.Channel); ac.Dongle == "" && len(matches) > 1 {
+				ac.Dongle = matches[1]
+			}
+			if matches := sipPeerRegex.FindStringSubmatch(leg.Channel); ac.SIPPeer == "" && len(matches) > 1 {
+				ac.SIPPeer = matches[1]
+			}
+		}
+		if len(ac.Channels) == 0 {
+			continue
+		}
+		if ac.Dongle != "" && s.dongles != nil {
+			ac.ModemID, ac.SIMCardID = s.dongles.Lookup(ac.Dongle)
+		}
+		active = append(active, ac)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].StartTime.Before(active[j].StartTime) })
+	return active
+}
+
+// HangupCall hangs up every leg of a call still up. The legs are hung up even
+// if one of them fails; the first error is returned.
+func (s *AMIService) HangupCall(ctx context.Context, linkedID string) error {
+	var call *ActiveCall
+	for _, ac := range s.ActiveCalls() {
+		if ac.LinkedID == linkedID {
+			call = &ac
+			break
+		}
+	}
+	if call == nil {
+		return ErrCallNotFound
+	}
+
+	var firstErr error
+	for _, channel := range call.Channels {
+		if err := s.Hangup(ctx, channel, 0); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ActiveCalls returns the calls in progress on every gateway, oldest first.
+func (m *GatewayManager) ActiveCalls() []ActiveCall {
+	var active []ActiveCall
+	for _, service := range m.Sessions() {
+		active = append(active, service.ActiveCalls()...)
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].StartTime.Before(active[j].StartTime) })
+	return active
+}
@@ -0,0 +1,139 @@
+// Package amirecord reads and writes recordings of AMI message streams.
+//
+// A recording is a JSON Lines file with one received message per line. Each
+// line keeps the headers in their original order (repeated headers such as
+// ChanVariable included) together with the time the message was received, so
+// a stream can be replayed with its original pacing.
+package amirecord
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	goami2 "github.com/staskobzar/goami2"
+)
+
+// Entry is one recorded AMI message.
+type Entry struct {
+	At      time.Time   `json:"at"`
+	Headers [][2]string `json:"headers"` // name, value pairs in wire order
+}
+
+// NewEntry captures msg as received at at.
+func NewEntry(msg *goami2.Message, at time.Time) Entry {
+	headers := make([][2]string, 0, msg.Len())
+	for _, h := range msg.Headers() {
+		headers = append(headers, [2]string{h.Name, h.Value})
+	}
+	return Entry{At: at, Headers: headers}
+}
+
+// Message rebuilds the recorded AMI message.
+func (e Entry) Message() *goami2.Message {
+	msg := goami2.NewMessage()
+	for _, h := range e.Headers {
+		msg.AddField(h[0], h[1])
+	}
+	return msg
+}
+
+// Event returns the Event header of the entry, or "" for action responses.
+func (e Entry) Event() string {
+	for _, h := range e.Headers {
+		if strings.EqualFold(h[0], "Event") {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// Recorder appends messages to a recording. It is safe for concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	enc    *json.Encoder
+}
+
+// Create starts a new recording in dir named after prefix and the current
+// time, e.g. "gw1-20240102T150405.jsonl".
+func Create(dir, prefix string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("amirecord: create %s: %w", dir, err)
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", prefix, time.Now().UTC().Format("20060102T150405.000"))
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("amirecord: open recording: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	return &Recorder{file: file, writer: writer, enc: json.NewEncoder(writer)}, nil
+}
+
+// Path returns the file the recorder writes to.
+func (r *Recorder) Path() string {
+	return r.file.Name()
+}
+
+// Record appends msg, received at at, to the recording.
+func (r *Recorder) Record(msg *goami2.Message, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(NewEntry(msg, at)); err != nil {
+		return fmt.Errorf("amirecord: write entry: %w", err)
+	}
+	// Flush per message so a crash loses at most the message being written.
+	return r.writer.Flush()
+}
+
+// Close flushes and closes the recording.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// Read parses a recording.
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("amirecord: line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("amirecord: read: %w", err)
+	}
+	return entries, nil
+}
+
+// ReadFile parses the recording at path.
+func ReadFile(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("amirecord: open %s: %w", path, err)
+	}
+	defer file.Close()
+	return Read(file)
+}
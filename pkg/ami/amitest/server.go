@@ -0,0 +1,357 @@
+// Package amitest provides an in-process Asterisk Manager Interface server
+// for exercising AMI clients without a running Asterisk.
+//
+// The server speaks the AMI wire protocol: it sends the banner, checks Login
+// credentials, answers actions through scripted handlers and pushes events to
+// every logged-in client, either one by one with Emit or from a recording made
+// by AMIService's recorder with Play.
+//
+//	srv, _ := amitest.NewServer("admin", "secret")
+//	defer srv.Close()
+//	srv.Handle("CoreShowChannels", func(a *goami2.Message) []*goami2.Message {
+//		return []*goami2.Message{
+//			amitest.NewResponse(true, "Channels will follow", "EventList", "start"),
+//			amitest.NewEvent("CoreShowChannelsComplete", "EventList", "Complete"),
+//		}
+//	})
+//	entries, _ := amirecord.ReadFile("testdata/outbound_call.jsonl")
+//	srv.Play(entries, 0)
+package amitest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami/amirecord"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+// Banner is the greeting sent to every new connection.
+const Banner = "Asterisk Call Manager/5.0.0\r\n"
+
+// ActionFunc answers an action. Replies without an ActionID get the action's.
+type ActionFunc func(action *goami2.Message) []*goami2.Message
+
+// Server is a fake AMI server listening on a local TCP port.
+type Server struct {
+	Username string
+	Password string
+
+	listener net.Listener
+	mu       sync.Mutex
+	handlers map[string]ActionFunc // keyed by lower-case action name
+	clients  map[*client]struct{}
+	received []*goami2.Message
+	joined   chan struct{} // signalled whenever a client logs in
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+type client struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	loggedIn bool
+}
+
+func (c *client) send(msg *goami2.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(msg.Byte())
+	return err
+}
+
+// NewServer starts a server on 127.0.0.1 with a random port that accepts the
+// given credentials. Ping and Logoff are answered out of the box.
+func NewServer(username, password string) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("amitest: listen: %w", err)
+	}
+	s := &Server{
+		Username: username,
+		Password: password,
+		listener: listener,
+		handlers: make(map[string]ActionFunc),
+		clients:  make(map[*client]struct{}),
+		joined:   make(chan struct{}, 16),
+		closed:   make(chan struct{}),
+	}
+	s.Handle("Ping", func(*goami2.Message) []*goami2.Message {
+		return []*goami2.Message{NewResponse(true, "", "Ping", "Pong", "Timestamp", fmt.Sprintf("%.6f", float64(time.Now().UnixNano())/1e9))}
+	})
+
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// HostPort returns the host and port the server listens on separately, as
+// stored on a models.Gateway.
+func (s *Server) HostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(s.Addr())
+	return host, port
+}
+
+// Handle registers fn to answer actions named action (case-insensitive),
+// replacing any previous handler.
+func (s *Server) Handle(action string, fn ActionFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[strings.ToLower(action)] = fn
+}
+
+// Received returns every action received so far, Login included.
+func (s *Server) Received() []*goami2.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*goami2.Message(nil), s.received...)
+}
+
+// Clients returns the number of logged-in clients.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for c := range s.clients {
+		if c.loggedIn {
+			n++
+		}
+	}
+	return n
+}
+
+// WaitForClients waits until at least n clients are logged in. A client may
+// still be processing its login response when this returns; wait on the
+// client's own connected state before sending actions through it.
+func (s *Server) WaitForClients(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for s.Clients() < n {
+		select {
+		case <-s.joined:
+		case <-deadline:
+			return fmt.Errorf("amitest: %d of %d clients logged in after %s", s.Clients(), n, timeout)
+		case <-s.closed:
+			return errors.New("amitest: server closed")
+		}
+	}
+	return nil
+}
+
+// Emit sends msg to every logged-in client.
+func (s *Server) Emit(msg *goami2.Message) {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for c := range s.clients {
+		if c.loggedIn {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		if err := c.send(msg); err != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// Play emits the events of a recording in order. Action responses in the
+// recording are skipped, as they answered the recording client's own actions.
+// speed scales the original pacing (2 plays twice as fast); 0 or less sends
+// everything back to back. Play returns early if the server is closed.
+func (s *Server) Play(entries []amirecord.Entry, speed float64) {
+	var previous time.Time
+	for _, entry := range entries {
+		if entry.Event() == "" {
+			continue
+		}
+		if speed > 0 && !previous.IsZero() {
+			if gap := entry.At.Sub(previous); gap > 0 {
+				select {
+				case <-time.After(time.Duration(float64(gap) / speed)):
+				case <-s.closed:
+					return
+				}
+			}
+		}
+		previous = entry.At
+		s.Emit(entry.Message())
+	}
+}
+
+// DropClients closes every client connection, e.g. to exercise reconnects.
+func (s *Server) DropClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Close stops the server and disconnects every client.
+func (s *Server) Close() {
+	select {
+	case <-s.closed:
+		return
+	default:
+		close(s.closed)
+	}
+	s.listener.Close()
+	s.DropClients()
+	s.wg.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{conn: conn}
+		s.mu.Lock()
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+// serve reads the actions of one client until it disconnects.
+func (s *Server) serve(c *client) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	c.writeMu.Lock()
+	_, err := c.conn.Write([]byte(Banner))
+	c.writeMu.Unlock()
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(c.conn)
+	var packet strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		packet.WriteString(line)
+		if line != "\r\n" && line != "\n" {
+			continue
+		}
+		raw := packet.String()
+		packet.Reset()
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+
+		action, err := goami2.Parse(raw)
+		if err != nil {
+			continue
+		}
+		if !s.dispatch(c, action) {
+			return
+		}
+	}
+}
+
+// dispatch answers one action. It returns false when the client should be
+// disconnected.
+func (s *Server) dispatch(c *client, action *goami2.Message) bool {
+	s.mu.Lock()
+	s.received = append(s.received, action)
+	name := strings.ToLower(action.Field("Action"))
+	handler := s.handlers[name]
+	loggedIn := c.loggedIn
+	s.mu.Unlock()
+
+	reply := func(msgs ...*goami2.Message) bool {
+		for _, msg := range msgs {
+			if msg.ActionID() == "" && action.ActionID() != "" {
+				msg.AddField("ActionID", action.ActionID())
+			}
+			if err := c.send(msg); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case name == "login":
+		if action.Field("Username") != s.Username || action.Field("Secret") != s.Password {
+			reply(NewResponse(false, "Authentication failed"))
+			return false
+		}
+		s.mu.Lock()
+		c.loggedIn = true
+		s.mu.Unlock()
+		select {
+		case s.joined <- struct{}{}:
+		default:
+		}
+		return reply(NewResponse(true, "Authentication accepted"))
+	case !loggedIn:
+		reply(NewResponse(false, "Permission denied"))
+		return false
+	case name == "logoff":
+		reply(NewResponse(true, "Thanks for all the fish.", "Response", "Goodbye"))
+		return false
+	case handler != nil:
+		return reply(handler(action)...)
+	default:
+		return reply(NewResponse(false, "Invalid/unknown command"))
+	}
+}
+
+// NewResponse builds an action response. fields are name, value pairs added
+// after Response and Message; a "Response" pair overrides the status.
+func NewResponse(success bool, message string, fields ...string) *goami2.Message {
+	status := "Success"
+	if !success {
+		status = "Error"
+	}
+	msg := goami2.NewMessage()
+	msg.AddField("Response", status)
+	if message != "" {
+		msg.AddField("Message", message)
+	}
+	addFields(msg, fields)
+	return msg
+}
+
+// NewEvent builds an event. fields are name, value pairs.
+func NewEvent(name string, fields ...string) *goami2.Message {
+	msg := goami2.NewMessage()
+	msg.AddField("Event", name)
+	addFields(msg, fields)
+	return msg
+}
+
+func addFields(msg *goami2.Message, fields []string) {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if msg.Field(fields[i]) != "" && strings.EqualFold(fields[i], "Response") {
+			msg.SetField("Response", fields[i+1])
+			continue
+		}
+		msg.AddField(fields[i], fields[i+1])
+	}
+}
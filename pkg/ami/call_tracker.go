@@ -0,0 +1,294 @@
+package ami
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	goami2 "github.com/staskobzar/goami2"
+)
+
+const (
+	// maxCallAge bounds how long a call may stay in the tracker without a Hangup.
+	// Calls older than this are assumed to have lost their Hangup (e.g. during an
+	// AMI outage) and are evicted.
+	maxCallAge = 6 * time.Hour
+
+	// Asterisk channel states as reported in Newchannel/Newstate ChannelState.
+	channelStateRinging = "5"
+	channelStateUp      = "6"
+)
+
+// callLeg is a single Asterisk channel taking part in a call.
+type callLeg struct {
+	UniqueID     string
+	Channel      string
+	CallerIDNum  string
+	CallerIDName string
+	Exten        string
+	Context      string
+	AccountCode  string
+	CreatedAt    time.Time
+	AnsweredAt   *time.Time
+	Hangup       *goami2.Message // Hangup event of this leg, nil while the leg is up
+}
+
+// trackedCall groups every channel sharing an Asterisk Linkedid into one call.
+type trackedCall struct {
+	LinkedID     string
+	Legs         map[string]*callLeg
+	legOrder     []string // UniqueIDs in creation order, first is the originating leg
+	StartTime    time.Time
+	DialBeginAt  *time.Time
+	RingingAt    *time.Time
+	AnswerTime   *time.Time
+	EndTime      time.Time
+	DialStatus   string          // last DialEnd DialStatus (ANSWER, BUSY, NOANSWER, ...)
+	Destination  string          // number dialled by the originating leg
+	dialled      map[string]bool // UniqueIDs of the legs DialBegin created
+	lastActivity time.Time
+}
+
+// Originator returns the leg that created the call.
+func (c *trackedCall) Originator() *callLeg {
+	if len(c.legOrder) == 0 {
+		return nil
+	}
+	return c.Legs[c.legOrder[0]]
+}
+
+// OrderedLegs returns the legs of the call in creation order.
+func (c *trackedCall) OrderedLegs() []*callLeg {
+	legs := make([]*callLeg, 0, len(c.legOrder))
+	for _, id := range c.legOrder {
+		legs = append(legs, c.Legs[id])
+	}
+	return legs
+}
+
+// answers tells whether a leg going up answers the call: a dialled leg
+// does, and any leg while the call has not dialled, e.g. an originator
+// answered by the dialplan.
+func (c *trackedCall) answers(leg *callLeg) bool {
+	return c.DialBeginAt == nil || c.dialled[leg.UniqueID]
+}
+
+// PostDialDelay returns the time between DialBegin and the first ringing (or
+// answer when the far end never signalled ringing). It returns nil when the
+// call never dialled out.
+func (c *trackedCall) PostDialDelay() *time.Duration {
+	if c.DialBeginAt == nil {
+		return nil
+	}
+	var alerted *time.Time
+	switch {
+	case c.RingingAt != nil:
+		alerted = c.RingingAt
+	case c.AnswerTime != nil:
+		alerted = c.AnswerTime
+	default:
+		return nil
+	}
+	pdd := alerted.Sub(*c.DialBeginAt)
+	if pdd < 0 {
+		pdd = 0
+	}
+	return &pdd
+}
+
+// callTracker follows channel events and correlates them into calls by
+// Uniqueid/Linkedid. It is safe for concurrent use.
+type callTracker struct {
+	mu    sync.Mutex
+	calls map[string]*trackedCall // keyed by Linkedid
+	legs  map[string]string       // Uniqueid -> Linkedid
+}
+
+func newCallTracker() *callTracker {
+	return &callTracker{
+		calls: make(map[string]*trackedCall),
+		legs:  make(map[string]string),
+	}
+}
+
+// callFor returns the call that a message belongs to, creating it if needed.
+// Must be called with t.mu held.
+func (t *callTracker) callFor(msg *goami2.Message, at time.Time) *trackedCall {
+	linkedID := getHeader(msg, "Linkedid")
+	if linkedID == "" {
+		linkedID = t.legs[getHeader(msg, "Uniqueid")]
+	}
+	if linkedID == "" {
+		linkedID = getHeader(msg, "Uniqueid")
+	}
+	if linkedID == "" {
+		return nil
+	}
+	call, ok := t.calls[linkedID]
+	if !ok {
+		call = &trackedCall{
+			LinkedID:  linkedID,
+			Legs:      make(map[string]*callLeg),
+			StartTime: at,
+			dialled:   make(map[string]bool),
+		}
+		t.calls[linkedID] = call
+	}
+	call.lastActivity = at
+	return call
+}
+
+// addLeg registers a channel on the call if it is not already known.
+// Must be called with t.mu held.
+func (t *callTracker) addLeg(call *trackedCall, msg *goami2.Message, at time.Time) *callLeg {
+	uniqueID := getHeader(msg, "Uniqueid")
+	if leg, ok := call.Legs[uniqueID]; ok {
+		return leg
+	}
+	leg := &callLeg{
+		UniqueID:     uniqueID,
+		Channel:      getHeader(msg, "Channel"),
+		CallerIDNum:  getHeader(msg, "CallerIDNum"),
+		CallerIDName: getHeader(msg, "CallerIDName"),
+		Exten:        getHeader(msg, "Exten"),
+		Context:      getHeader(msg, "Context"),
+		AccountCode:  getHeader(msg, "AccountCode"),
+		CreatedAt:    at,
+	}
+	call.Legs[uniqueID] = leg
+	call.legOrder = append(call.legOrder, uniqueID)
+	t.legs[uniqueID] = call.LinkedID
+	if at.Before(call.StartTime) {
+		call.StartTime = at
+	}
+	return leg
+}
+
+// markAnswered records the answer time of a leg and, when callAnswered, of
+// the call.
+func markAnswered(call *trackedCall, leg *callLeg, at time.Time, callAnswered bool) {
+	if leg != nil && leg.AnsweredAt == nil {
+		answered := at
+		leg.AnsweredAt = &answered
+	}
+	if callAnswered && call.AnswerTime == nil {
+		answered := at
+		call.AnswerTime = &answered
+	}
+}
+
+// Handle applies a channel event to the tracker. When the event is the Hangup
+// of the last remaining leg, the completed call is removed from the tracker
+// and returned; otherwise Handle returns nil.
+func (t *callTracker) Handle(msg *goami2.Message, at time.Time) *trackedCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	eventName := getHeader(msg, "Event")
+	call := t.callFor(msg, at)
+	if call == nil {
+		return nil
+	}
+
+	switch eventName {
+	case "Newchannel":
+		leg := t.addLeg(call, msg, at)
+		if getHeader(msg, "ChannelState") == channelStateUp {
+			markAnswered(call, leg, at, call.answers(leg))
+		}
+
+	case "DialBegin":
+		t.addLeg(call, msg, at)
+		if call.DialBeginAt == nil {
+			dialAt := at
+			call.DialBeginAt = &dialAt
+			// An originator answered before dialling, e.g. to play a
+			// prompt, does not answer the call: the dialled leg does.
+			call.AnswerTime = nil
+		}
+		if dest := getHeader(msg, "DestUniqueid"); dest != "" {
+			call.dialled[dest] = true
+		}
+		if call.Destination == "" {
+			call.Destination = firstNonEmpty(getHeader(msg, "DestExten"), getHeader(msg, "DestCallerIDNum"), getHeader(msg, "DialString"))
+		}
+
+	case "DialEnd":
+		t.addLeg(call, msg, at)
+		call.DialStatus = getHeader(msg, "DialStatus")
+		if call.DialStatus == "ANSWER" {
+			markAnswered(call, nil, at, true)
+		}
+
+	case "Newstate":
+		leg := t.addLeg(call, msg, at)
+		switch getHeader(msg, "ChannelState") {
+		case channelStateRinging:
+			if call.RingingAt == nil {
+				ringAt := at
+				call.RingingAt = &ringAt
+			}
+		case channelStateUp:
+			markAnswered(call, leg, at, call.answers(leg))
+		}
+
+	case "BridgeEnter":
+		leg := t.addLeg(call, msg, at)
+		// Two or more legs in a bridge means the call is connected even if a
+		// Newstate was missed.
+		if n, err := strconv.Atoi(getHeader(msg, "BridgeNumChannels")); err == nil && n >= 2 {
+			markAnswered(call, leg, at, true)
+		}
+
+	case "Hangup":
+		leg := t.addLeg(call, msg, at)
+		leg.Hangup = msg
+		delete(t.legs, leg.UniqueID)
+		for _, l := range call.Legs {
+			if l.Hangup == nil {
+				return nil
+			}
+		}
+		call.EndTime = at
+		delete(t.calls, call.LinkedID)
+		return call
+	}
+
+	return nil
+}
+
+// EvictStale removes calls that have seen no activity for longer than maxAge
+// and returns them.
+func (t *callTracker) EvictStale(now time.Time, maxAge time.Duration) []*trackedCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stale []*trackedCall
+	for linkedID, call := range t.calls {
+		if now.Sub(call.lastActivity) < maxAge {
+			continue
+		}
+		for uniqueID := range call.Legs {
+			delete(t.legs, uniqueID)
+		}
+		delete(t.calls, linkedID)
+		stale = append(stale, call)
+	}
+	return stale
+}
+
+// Len returns the number of calls currently in progress.
+func (t *callTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.calls)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
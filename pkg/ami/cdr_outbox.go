@@ -0,0 +1,455 @@
+package ami
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outboxReplayInterval = 30 * time.Second
+	outboxMaxReplayDelay = 10 * time.Minute
+
+	outboxActiveFile    = "outbox.jsonl"
+	outboxSegmentPrefix = "replay-"
+	outboxDeadFile      = "dead.jsonl"
+)
+
+// outboxRecord is one spooled CDR, one JSON line in a spool file.
+type outboxRecord struct {
+	SpooledAt time.Time   `json:"spooled_at"`
+	Attempts  int         `json:"attempts"` // writes the database rejected the row itself in
+	LastError string      `json:"last_error,omitempty"`
+	Cdr       *models.Cdr `json:"cdr"`
+}
+
+// CDROutboxStats describes the backlog of a CDROutbox.
+type CDROutboxStats struct {
+	Dir             string     `json:"dir"`
+	Pending         int        `json:"pending"`
+	OldestSpooledAt *time.Time `json:"oldest_spooled_at,omitempty"`
+	Spooled         int64      `json:"spooled"`     // since start
+	Replayed        int64      `json:"replayed"`    // since start, duplicates included
+	Duplicates      int64      `json:"duplicates"`  // replays the database already had
+	DeadLettered    int64      `json:"dead_letter"` // since start
+	LastReplayAt    *time.Time `json:"last_replay_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+}
+
+// CDROutbox keeps CDRs that could not be written to the database in an
+// append-only spool on disk and replays them once the database is back.
+//
+// New records are appended to outbox.jsonl. A replay first renames that file
+// to a replay-<nanos>.jsonl segment so spooling never waits on the database,
+// then writes each segment's CDRs in order. Writes are idempotent on the
+// gateway and Asterisk UniqueID, so a CDR that reached the database before a
+// crash is skipped rather than duplicated. A CDR the database rejects as
+// invalid goes to dead.jsonl at once; any other failure, such as the
+// database being down, stops the replay until the next attempt.
+type CDROutbox struct {
+	dir     string
+	cdrRepo repository.CdrRepository
+	logger  *logrus.Logger
+
+	mu     sync.Mutex // guards the active file and stats
+	active *os.File
+	stats  CDROutboxStats
+
+	replayMu sync.Mutex // serialises replays
+	started  bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewCDROutbox opens the spool in dir, creating it if needed, and counts the
+// CDRs left over from a previous run.
+func NewCDROutbox(dir string, cdrRepo repository.CdrRepository, logger *logrus.Logger) (*CDROutbox, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create CDR outbox directory: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &CDROutbox{
+		dir:     dir,
+		cdrRepo: cdrRepo,
+		logger:  logger,
+		stats:   CDROutboxStats{Dir: dir},
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	files, err := o.spoolFiles(true)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for _, path := range files {
+		records, err := o.readFile(path)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		for _, rec := range records {
+			o.countSpooled(rec.SpooledAt)
+		}
+	}
+	if o.stats.Pending > 0 {
+		logger.Warnf("CDR outbox holds %d CDR(s) from a previous run; they will be replayed", o.stats.Pending)
+	}
+	return o, nil
+}
+
+// Spool appends cdr to the outbox. cause is the error the database write
+// failed with. The record is synced to disk before Spool returns.
+func (o *CDROutbox) Spool(cdr *models.Cdr, cause error) error {
+	rec := outboxRecord{SpooledAt: time.Now().UTC(), Cdr: cdr}
+	if cause != nil {
+		rec.LastError = cause.Error()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode CDR %s for the outbox: %w", cdr.UniqueID, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.active == nil {
+		o.active, err = os.OpenFile(filepath.Join(o.dir, outboxActiveFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return fmt.Errorf("failed to open CDR outbox: %w", err)
+		}
+	}
+	if _, err := o.active.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to spool CDR %s: %w", cdr.UniqueID, err)
+	}
+	if err := o.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync CDR outbox: %w", err)
+	}
+	o.countSpooled(rec.SpooledAt)
+	o.stats.Spooled++
+	return nil
+}
+
+// countSpooled adds one record to the backlog. o.mu must be held, or o not yet
+// shared.
+func (o *CDROutbox) countSpooled(at time.Time) {
+	o.stats.Pending++
+	if o.stats.OldestSpooledAt == nil || at.Before(*o.stats.OldestSpooledAt) {
+		at := at
+		o.stats.OldestSpooledAt = &at
+	}
+}
+
+// Stats returns the current backlog of the outbox.
+func (o *CDROutbox) Stats() CDROutboxStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stats := o.stats
+	if stats.OldestSpooledAt != nil {
+		oldest := *stats.OldestSpooledAt
+		stats.OldestSpooledAt = &oldest
+	}
+	if stats.LastReplayAt != nil {
+		last := *stats.LastReplayAt
+		stats.LastReplayAt = &last
+	}
+	return stats
+}
+
+// Start replays the spool in the background, backing off while the database
+// keeps failing.
+func (o *CDROutbox) Start() {
+	o.started = true
+	go func() {
+		defer close(o.done)
+		delay := outboxReplayInterval
+		for {
+			select {
+			case <-o.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if err := o.Replay(o.ctx); err != nil {
+				if o.ctx.Err() != nil {
+					return
+				}
+				o.logger.WithError(err).Warnf("CDR outbox replay failed, %d CDR(s) pending; retrying in %s", o.Stats().Pending, delay*2)
+				delay *= 2
+				if delay > outboxMaxReplayDelay {
+					delay = outboxMaxReplayDelay
+				}
+				continue
+			}
+			delay = outboxReplayInterval
+		}
+	}()
+}
+
+// Stop stops the replay worker and closes the spool. CDRs still pending stay
+// on disk for the next run.
+func (o *CDROutbox) Stop() {
+	o.cancel()
+	if o.started {
+		<-o.done
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.active != nil {
+		o.active.Close()
+		o.active = nil
+	}
+}
+
+// Replay writes every spooled CDR to the database, oldest first. CDRs the
+// database rejects are dead-lettered; at any other failure it stops, leaving
+// that CDR and the ones after it in the spool.
+func (o *CDROutbox) Replay(ctx context.Context) error {
+	o.replayMu.Lock()
+	defer o.replayMu.Unlock()
+
+	if err := o.rotate(); err != nil {
+		return err
+	}
+	segments, err := o.spoolFiles(false)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	replayed := 0
+	defer func() {
+		if replayed > 0 {
+			o.logger.Infof("Replayed %d CDR(s) from the outbox", replayed)
+		}
+	}()
+	for _, segment := range segments {
+		n, err := o.replaySegment(ctx, segment)
+		replayed += n
+		if err != nil {
+			o.mu.Lock()
+			o.stats.LastError = err.Error()
+			o.mu.Unlock()
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	o.mu.Lock()
+	o.stats.LastReplayAt = &now
+	o.stats.LastError = ""
+	if o.stats.Pending == 0 {
+		o.stats.OldestSpooledAt = nil
+	}
+	o.mu.Unlock()
+	return nil
+}
+
+// rotate turns the active file, if it holds anything, into a replay segment.
+func (o *CDROutbox) rotate() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.active != nil {
+		o.active.Close()
+		o.active = nil
+	}
+	path := filepath.Join(o.dir, outboxActiveFile)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() == 0) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat CDR outbox: %w", err)
+	}
+	segment := filepath.Join(o.dir, fmt.Sprintf("%s%019d.jsonl", outboxSegmentPrefix, time.Now().UnixNano()))
+	if err := os.Rename(path, segment); err != nil {
+		return fmt.Errorf("failed to rotate CDR outbox: %w", err)
+	}
+	return nil
+}
+
+// replaySegment writes the CDRs of one segment and removes it. When the
+// write fails for another reason than the CDR itself, the segment is
+// rewritten with the CDRs still to go.
+func (o *CDROutbox) replaySegment(ctx context.Context, segment string) (int, error) {
+	records, err := o.readFile(segment)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for i, rec := range records {
+		err := o.cdrRepo.CreateCdr(ctx, rec.Cdr)
+		switch {
+		case err == nil, errors.Is(err, repository.ErrDuplicate):
+			o.mu.Lock()
+			o.stats.Pending--
+			o.stats.Replayed++
+			if err != nil {
+				o.stats.Duplicates++
+			}
+			o.mu.Unlock()
+			written++
+			continue
+		case ctx.Err() != nil:
+			if rewriteErr := o.rewrite(segment, records[i:]); rewriteErr != nil {
+				return written, rewriteErr
+			}
+			return written, ctx.Err()
+		}
+
+		rec.LastError = err.Error()
+		if rowRejected(err) {
+			// Retrying cannot help, and it would hold up every CDR behind it.
+			rec.Attempts++
+			o.logger.WithError(err).Errorf("Database rejected CDR %s, moving it to %s", rec.Cdr.UniqueID, outboxDeadFile)
+			if deadErr := o.appendDead(rec); deadErr != nil {
+				if rewriteErr := o.rewrite(segment, records[i:]); rewriteErr != nil {
+					return written, rewriteErr
+				}
+				return written, deadErr
+			}
+			o.mu.Lock()
+			o.stats.Pending--
+			o.stats.DeadLettered++
+			o.mu.Unlock()
+			continue
+		}
+		if rewriteErr := o.rewrite(segment, records[i:]); rewriteErr != nil {
+			return written, rewriteErr
+		}
+		return written, fmt.Errorf("failed to replay CDR %s: %w", rec.Cdr.UniqueID, err)
+	}
+
+	if err := os.Remove(segment); err != nil {
+		return written, fmt.Errorf("failed to remove replayed CDR outbox segment: %w", err)
+	}
+	return written, nil
+}
+
+// rowRejected reports whether err says the row itself is bad: a data
+// exception (SQLSTATE class 22) or an integrity constraint violation (23),
+// as opposed to the database being unreachable or slow.
+func rowRejected(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+// spoolFiles lists the replay segments in replay order, followed by the
+// active file when withActive is set.
+func (o *CDROutbox) spoolFiles(withActive bool) ([]string, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CDR outbox: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, outboxSegmentPrefix) && strings.HasSuffix(name, ".jsonl") {
+			files = append(files, filepath.Join(o.dir, name))
+		}
+	}
+	sort.Strings(files)
+	if withActive {
+		active := filepath.Join(o.dir, outboxActiveFile)
+		if _, err := os.Stat(active); err == nil {
+			files = append(files, active)
+		}
+	}
+	return files, nil
+}
+
+// readFile reads the records of a spool file. A line that does not decode,
+// such as one cut short by a crash mid-write, is logged and skipped.
+func (o *CDROutbox) readFile(path string) ([]*outboxRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CDR outbox file: %w", err)
+	}
+	defer file.Close()
+
+	var records []*outboxRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var rec outboxRecord
+		if err := json.Unmarshal([]byte(text), &rec); err != nil || rec.Cdr == nil {
+			o.logger.Errorf("Skipping unreadable CDR outbox entry %s:%d: %v", filepath.Base(path), line, err)
+			continue
+		}
+		records = append(records, &rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read CDR outbox file: %w", err)
+	}
+	return records, nil
+}
+
+// rewrite atomically replaces a segment with records, removing it when there
+// are none left.
+func (o *CDROutbox) rewrite(segment string, records []*outboxRecord) error {
+	if len(records) == 0 {
+		return os.Remove(segment)
+	}
+	tmp := segment + ".tmp"
+	if err := writeRecords(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, records); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, segment); err != nil {
+		return fmt.Errorf("failed to update CDR outbox segment: %w", err)
+	}
+	return nil
+}
+
+// appendDead keeps a CDR the database would not take for manual inspection.
+func (o *CDROutbox) appendDead(rec *outboxRecord) error {
+	return writeRecords(filepath.Join(o.dir, outboxDeadFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, []*outboxRecord{rec})
+}
+
+func writeRecords(path string, flag int, records []*outboxRecord) error {
+	file, err := os.OpenFile(path, flag, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open CDR outbox file: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	enc := json.NewEncoder(writer)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write CDR outbox file: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write CDR outbox file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync CDR outbox file: %w", err)
+	}
+	return file.Close()
+}
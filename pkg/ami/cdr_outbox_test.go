@@ -0,0 +1,244 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var errDatabaseDown = errors.New("database down")
+
+// outboxCdrRepo stores CDRs by UniqueID, answering ErrDuplicate for one
+// stored already. CDRs fail with errDatabaseDown while down, and those
+// whose UniqueID is in reject always fail with a data exception.
+type outboxCdrRepo struct {
+	repository.CdrRepository
+
+	mu     sync.Mutex
+	down   bool
+	reject map[string]bool
+	stored []string
+}
+
+func (r *outboxCdrRepo) CreateCdr(ctx context.Context, cdr *models.Cdr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.down {
+		return errDatabaseDown
+	}
+	if r.reject[cdr.UniqueID] {
+		return fmt.Errorf("failed to insert CDR: %w", &pgconn.PgError{Code: "22001", Message: "value too long for type character varying(50)"})
+	}
+	for _, id := range r.stored {
+		if id == cdr.UniqueID {
+			return repository.ErrDuplicate
+		}
+	}
+	r.stored = append(r.stored, cdr.UniqueID)
+	return nil
+}
+
+func (r *outboxCdrRepo) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func (r *outboxCdrRepo) storedIDs() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.stored, " ")
+}
+
+func newTestOutbox(t *testing.T, dir string, repo *outboxCdrRepo) *CDROutbox {
+	t.Helper()
+	o, err := NewCDROutbox(dir, repo, testLogger())
+	if err != nil {
+		t.Fatalf("NewCDROutbox: %v", err)
+	}
+	t.Cleanup(o.Stop)
+	return o
+}
+
+func spool(t *testing.T, o *CDROutbox, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := o.Spool(&models.Cdr{UniqueID: id}, errDatabaseDown); err != nil {
+			t.Fatalf("Spool(%s): %v", id, err)
+		}
+	}
+}
+
+// spoolFileNames lists the files in an outbox directory, segments as
+// "replay-".
+func spoolFileNames(t *testing.T, dir string) string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, outboxSegmentPrefix) {
+			name = outboxSegmentPrefix
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestCDROutboxReplaysInOrder(t *testing.T) {
+	dir := t.TempDir()
+	repo := &outboxCdrRepo{down: true}
+	o := newTestOutbox(t, dir, repo)
+	ctx := context.Background()
+
+	spool(t, o, "1710513000.1", "1710513000.2")
+	if got := spoolFileNames(t, dir); got != outboxActiveFile {
+		t.Fatalf("files %q, want the CDRs in %s", got, outboxActiveFile)
+	}
+	if stats := o.Stats(); stats.Pending != 2 || stats.Spooled != 2 || stats.OldestSpooledAt == nil {
+		t.Errorf("stats after spooling %+v", stats)
+	}
+
+	// With the database down the spool is rotated into a segment, and no
+	// attempt is counted against the CDRs.
+	if err := o.Replay(ctx); !errors.Is(err, errDatabaseDown) {
+		t.Fatalf("Replay with the database down: %v", err)
+	}
+	if got := spoolFileNames(t, dir); got != outboxSegmentPrefix {
+		t.Fatalf("files %q after a failed replay, want one segment", got)
+	}
+	segments, _ := o.spoolFiles(false)
+	records, err := o.readFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Attempts != 0 || records[0].LastError != errDatabaseDown.Error() || records[1].Attempts != 0 {
+		t.Errorf("segment after a failed replay: %d records, first %+v", len(records), records[0])
+	}
+
+	// CDRs spooled meanwhile go to a new file, replayed after the segment.
+	spool(t, o, "1710513000.3")
+	if got := spoolFileNames(t, dir); got != outboxActiveFile+" "+outboxSegmentPrefix {
+		t.Fatalf("files %q, want a new %s beside the segment", got, outboxActiveFile)
+	}
+
+	// A restart finds them all, and skips a line cut short by a crash.
+	o.Stop()
+	active, err := os.OpenFile(filepath.Join(dir, outboxActiveFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active.WriteString(`{"spooled_at":"2024-03-15T14:30:00Z","cdr":{"uni`)
+	active.Close()
+	o = newTestOutbox(t, dir, repo)
+	if stats := o.Stats(); stats.Pending != 3 {
+		t.Errorf("%d CDRs pending after a restart, want 3", stats.Pending)
+	}
+
+	repo.setDown(false)
+	if err := o.Replay(ctx); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if got := repo.storedIDs(); got != "1710513000.1 1710513000.2 1710513000.3" {
+		t.Errorf("stored %q, want the CDRs in the order spooled", got)
+	}
+	if got := spoolFileNames(t, dir); got != "" {
+		t.Errorf("files %q left after the replay", got)
+	}
+	stats := o.Stats()
+	if stats.Pending != 0 || stats.Replayed != 3 || stats.OldestSpooledAt != nil || stats.LastReplayAt == nil || stats.LastError != "" {
+		t.Errorf("stats after the replay %+v", stats)
+	}
+}
+
+func TestCDROutboxSkipsCDRsAlreadyStored(t *testing.T) {
+	// The first CDR reached the database before the process died.
+	repo := &outboxCdrRepo{stored: []string{"1710513000.1"}}
+	o := newTestOutbox(t, t.TempDir(), repo)
+	spool(t, o, "1710513000.1", "1710513000.2")
+
+	if err := o.Replay(context.Background()); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if got := repo.storedIDs(); got != "1710513000.1 1710513000.2" {
+		t.Errorf("stored %q, want each CDR once", got)
+	}
+	if stats := o.Stats(); stats.Pending != 0 || stats.Replayed != 2 || stats.Duplicates != 1 {
+		t.Errorf("stats %+v, want 2 replayed of which 1 duplicate", stats)
+	}
+}
+
+func TestCDROutboxDeadLettersRejectedCDRs(t *testing.T) {
+	dir := t.TempDir()
+	repo := &outboxCdrRepo{reject: map[string]bool{"1710513000.1": true}}
+	o := newTestOutbox(t, dir, repo)
+	spool(t, o, "1710513000.1", "1710513000.2")
+
+	// The rejected CDR is set aside at once and does not hold up the one
+	// behind it.
+	if err := o.Replay(context.Background()); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if got := repo.storedIDs(); got != "1710513000.2" {
+		t.Errorf("stored %q, want the CDR behind the rejected one", got)
+	}
+	if stats := o.Stats(); stats.Pending != 0 || stats.Replayed != 1 || stats.DeadLettered != 1 {
+		t.Errorf("stats %+v, want 1 replayed and 1 dead-lettered", stats)
+	}
+	dead, err := o.readFile(filepath.Join(dir, outboxDeadFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Cdr.UniqueID != "1710513000.1" || dead[0].Attempts != 1 || dead[0].LastError == "" {
+		t.Errorf("dead letters %+v, want the rejected CDR after 1 attempt", dead)
+	}
+	if got := spoolFileNames(t, dir); got != outboxDeadFile {
+		t.Errorf("files %q, want only %s", got, outboxDeadFile)
+	}
+}
+
+func TestCDROutboxKeepsCDRsThroughOutages(t *testing.T) {
+	dir := t.TempDir()
+	repo := &outboxCdrRepo{down: true}
+	o := newTestOutbox(t, dir, repo)
+	spool(t, o, "1710513000.1", "1710513000.2")
+	ctx := context.Background()
+
+	// However long the database stays down, nothing is dead-lettered.
+	for i := 1; i <= 100; i++ {
+		if err := o.Replay(ctx); !errors.Is(err, errDatabaseDown) {
+			t.Fatalf("replay %d with the database down: %v", i, err)
+		}
+	}
+	if stats := o.Stats(); stats.Pending != 2 || stats.DeadLettered != 0 {
+		t.Errorf("stats %+v, want 2 pending and none dead-lettered", stats)
+	}
+	segments, _ := o.spoolFiles(false)
+	records, err := o.readFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Attempts != 0 {
+		t.Errorf("segment after the outage: %d records, first %+v", len(records), records[0])
+	}
+
+	repo.setDown(false)
+	if err := o.Replay(ctx); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if got := repo.storedIDs(); got != "1710513000.1 1710513000.2" {
+		t.Errorf("stored %q, want both CDRs", got)
+	}
+}
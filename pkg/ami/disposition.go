@@ -0,0 +1,227 @@
+package ami
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+// dongleEndWindow is how far apart a DongleCEND and the end of the call it
+// belongs to may be.
+const dongleEndWindow = 30 * time.Second
+
+// q850Dispositions maps Q.850 cause codes, as found in Hangup events, to
+// disposition categories. Causes that say nothing about the outcome (16
+// normal clearing, 31 normal unspecified) are left out so that the dial
+// status decides.
+var q850Dispositions = map[int]string{
+	1:   models.DispositionCategoryUnallocatedNumber, // unallocated (unassigned) number
+	2:   models.DispositionCategoryUnallocatedNumber, // no route to specified transit network
+	3:   models.DispositionCategoryUnallocatedNumber, // no route to destination
+	17:  models.DispositionCategoryBusy,              // user busy
+	18:  models.DispositionCategoryNoAnswer,          // no user responding
+	19:  models.DispositionCategoryNoAnswer,          // no answer from user (user alerted)
+	20:  models.DispositionCategorySubscriberAbsent,  // subscriber absent
+	21:  models.DispositionCategoryRejected,          // call rejected
+	22:  models.DispositionCategoryUnallocatedNumber, // number changed
+	27:  models.DispositionCategoryDestinationOutOfOrder,
+	28:  models.DispositionCategoryInvalidNumber, // invalid number format
+	29:  models.DispositionCategoryRejected,      // facility rejected
+	34:  models.DispositionCategoryNetworkCongestion,
+	38:  models.DispositionCategoryNetworkCongestion, // network out of order
+	41:  models.DispositionCategoryNetworkCongestion, // temporary failure
+	42:  models.DispositionCategoryNetworkCongestion, // switching equipment congestion
+	44:  models.DispositionCategoryNetworkCongestion, // requested channel not available
+	47:  models.DispositionCategoryNetworkCongestion, // resource unavailable
+	50:  models.DispositionCategorySIMBarred,         // requested facility not subscribed
+	52:  models.DispositionCategorySIMBarred,         // outgoing calls barred
+	53:  models.DispositionCategorySIMBarred,         // outgoing calls barred within CUG
+	54:  models.DispositionCategoryRejected,          // incoming calls barred
+	55:  models.DispositionCategoryRejected,          // incoming calls barred within CUG
+	57:  models.DispositionCategorySIMBarred,         // bearer capability not authorized
+	58:  models.DispositionCategoryNetworkCongestion, // bearer capability not presently available
+	102: models.DispositionCategoryNoAnswer,          // recovery on timer expiry
+}
+
+// gsmCauseDispositions holds the 3GPP TS 24.008 call control causes reported
+// by chan_dongle (DongleCEND CCCause) whose meaning differs from Q.850.
+var gsmCauseDispositions = map[int]string{
+	6:  models.DispositionCategoryNetworkCongestion, // channel unacceptable
+	8:  models.DispositionCategorySIMBarred,         // operator determined barring
+	68: models.DispositionCategoryNoCredit,          // ACM equal to or greater than ACMmax
+}
+
+// sipDispositions maps final SIP response codes to disposition categories.
+var sipDispositions = map[int]string{
+	402: models.DispositionCategoryNoCredit,
+	403: models.DispositionCategoryRejected,
+	404: models.DispositionCategoryUnallocatedNumber,
+	408: models.DispositionCategoryNoAnswer,
+	410: models.DispositionCategoryUnallocatedNumber,
+	480: models.DispositionCategorySubscriberAbsent,
+	484: models.DispositionCategoryInvalidNumber,
+	485: models.DispositionCategoryInvalidNumber,
+	486: models.DispositionCategoryBusy,
+	487: models.DispositionCategoryCancelled,
+	500: models.DispositionCategoryNetworkCongestion,
+	502: models.DispositionCategoryNetworkCongestion,
+	503: models.DispositionCategoryNetworkCongestion,
+	504: models.DispositionCategoryNetworkCongestion,
+	600: models.DispositionCategoryBusy,
+	603: models.DispositionCategoryRejected,
+	604: models.DispositionCategoryUnallocatedNumber,
+}
+
+// dialStatusDispositions maps the DIALSTATUS reported in DialEnd events.
+var dialStatusDispositions = map[string]string{
+	"ANSWER":      models.DispositionCategoryAnswered,
+	"BUSY":        models.DispositionCategoryBusy,
+	"NOANSWER":    models.DispositionCategoryNoAnswer,
+	"CANCEL":      models.DispositionCategoryCancelled,
+	"CONGESTION":  models.DispositionCategoryNetworkCongestion,
+	"CHANUNAVAIL": models.DispositionCategoryGatewayUnavailable,
+}
+
+// sipResponseRegex finds the response code in HANGUPCAUSE style values such
+// as "SIP 486 Busy Here", or in a bare "486".
+var sipResponseRegex = regexp.MustCompile(`^(?:SIP\s+)?([3-6]\d\d)\b`)
+
+// dispositionInput is everything known about how a call ended.
+type dispositionInput struct {
+	Answered    bool
+	DialStatus  string // last DialEnd DialStatus
+	Q850Causes  []int  // Hangup causes, most specific leg first
+	SIPResponse int    // final SIP response of a SIP leg, 0 if unknown
+	DongleCause int    // CCCause of the DongleCEND, 0 if unknown
+}
+
+// normalizeDisposition maps how a call ended to one of the
+// models.DispositionCategory* values. The most specific source wins: SIP
+// response, chan_dongle end cause, Q.850 cause, then the dial status.
+func normalizeDisposition(in dispositionInput) string {
+	if in.Answered {
+		return models.DispositionCategoryAnswered
+	}
+	if category, ok := sipDispositions[in.SIPResponse]; ok {
+		return category
+	}
+	if in.DongleCause != 0 {
+		if category, ok := gsmCauseDispositions[in.DongleCause]; ok {
+			return category
+		}
+		if category, ok := q850Dispositions[in.DongleCause]; ok {
+			return category
+		}
+	}
+	for _, cause := range in.Q850Causes {
+		if category, ok := q850Dispositions[cause]; ok {
+			return category
+		}
+	}
+	if category, ok := dialStatusDispositions[in.DialStatus]; ok && category != models.DispositionCategoryAnswered {
+		return category
+	}
+	if in.SIPResponse >= 400 {
+		return models.DispositionCategoryFailed
+	}
+	// A caller hanging up before anyone answered clears normally.
+	for _, cause := range in.Q850Causes {
+		if cause == 16 || cause == 31 {
+			return models.DispositionCategoryCancelled
+		}
+	}
+	return models.DispositionCategoryFailed
+}
+
+// parseSIPResponse extracts a SIP response code from a channel variable.
+func parseSIPResponse(value string) int {
+	matches := sipResponseRegex.FindStringSubmatch(strings.TrimSpace(value))
+	if len(matches) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(matches[1])
+	return code
+}
+
+// dongleCallEnd is the last DongleCEND seen for a device.
+type dongleCallEnd struct {
+	CCCause int
+	At      time.Time
+}
+
+// dongleCallEnds remembers the call end reasons chan_dongle reports so they
+// can be matched with the Hangup of the call.
+type dongleCallEnds struct {
+	mu    sync.Mutex
+	byDev map[string]dongleCallEnd
+}
+
+func newDongleCallEnds() *dongleCallEnds {
+	return &dongleCallEnds{byDev: make(map[string]dongleCallEnd)}
+}
+
+// Record stores a DongleCEND event.
+func (e *dongleCallEnds) Record(msg *goami2.Message, at time.Time) {
+	device := getHeader(msg, "Device")
+	cause, err := strconv.Atoi(strings.TrimSpace(getHeader(msg, "CCCause")))
+	if device == "" || err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.byDev[device] = dongleCallEnd{CCCause: cause, At: at}
+}
+
+// Take returns and forgets the end cause of a device's call ending around
+// endedAt, or 0.
+func (e *dongleCallEnds) Take(device string, endedAt time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	end, ok := e.byDev[device]
+	if !ok {
+		return 0
+	}
+	delete(e.byDev, device)
+	if gap := endedAt.Sub(end.At); gap > dongleEndWindow || gap < -dongleEndWindow {
+		return 0
+	}
+	return end.CCCause
+}
+
+// dispositionFor gathers the outcome of a completed call. device is the
+// chan_dongle device of the call, if any.
+func (s *AMIService) dispositionFor(call *trackedCall, device string) dispositionInput {
+	in := dispositionInput{
+		Answered:   call.AnswerTime != nil,
+		DialStatus: call.DialStatus,
+	}
+
+	// Dialled legs say more about the outcome than the originator, whose
+	// cause usually just echoes them.
+	legs := call.OrderedLegs()
+	for i := len(legs) - 1; i >= 0; i-- {
+		msg := legs[i].Hangup
+		if msg == nil {
+			continue
+		}
+		if cause, err := strconv.Atoi(getHeader(msg, "Cause")); err == nil && cause != 0 {
+			in.Q850Causes = append(in.Q850Causes, cause)
+		}
+		if in.SIPResponse == 0 {
+			in.SIPResponse = parseSIPResponse(firstNonEmpty(
+				getVariable(msg, "CDR(sip_response)"),
+				getVariable(msg, "SIP_RESPONSE"),
+				getVariable(msg, "HANGUPCAUSE"),
+			))
+		}
+	}
+	if device != "" {
+		in.DongleCause = s.dongleEnds.Take(device, call.EndTime)
+	}
+	return in
+}
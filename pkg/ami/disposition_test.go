@@ -0,0 +1,82 @@
+package ami
+
+import (
+	"testing"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+)
+
+func TestNormalizeDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		in   dispositionInput
+		want string
+	}{
+		{"answered", dispositionInput{Answered: true, Q850Causes: []int{16}, DialStatus: "ANSWER"}, models.DispositionCategoryAnswered},
+		{"answered despite a failure cause", dispositionInput{Answered: true, SIPResponse: 486}, models.DispositionCategoryAnswered},
+
+		// Q.850 causes of the Hangup.
+		{"Q.850 unallocated", dispositionInput{Q850Causes: []int{1}}, models.DispositionCategoryUnallocatedNumber},
+		{"Q.850 busy", dispositionInput{Q850Causes: []int{17}}, models.DispositionCategoryBusy},
+		{"Q.850 no answer", dispositionInput{Q850Causes: []int{19}}, models.DispositionCategoryNoAnswer},
+		{"Q.850 subscriber absent", dispositionInput{Q850Causes: []int{20}}, models.DispositionCategorySubscriberAbsent},
+		{"Q.850 invalid format", dispositionInput{Q850Causes: []int{28}}, models.DispositionCategoryInvalidNumber},
+		{"Q.850 congestion", dispositionInput{Q850Causes: []int{34}}, models.DispositionCategoryNetworkCongestion},
+		{"Q.850 outgoing calls barred", dispositionInput{Q850Causes: []int{52}}, models.DispositionCategorySIMBarred},
+		{"Q.850 most specific leg first", dispositionInput{Q850Causes: []int{17, 34}}, models.DispositionCategoryBusy},
+		{"Q.850 normal clearing skipped", dispositionInput{Q850Causes: []int{16, 21}}, models.DispositionCategoryRejected},
+
+		// chan_dongle end causes: GSM meanings first, then Q.850.
+		{"CEND operator barring", dispositionInput{DongleCause: 8, Q850Causes: []int{16}}, models.DispositionCategorySIMBarred},
+		{"CEND ACM max", dispositionInput{DongleCause: 68}, models.DispositionCategoryNoCredit},
+		{"CEND channel unacceptable", dispositionInput{DongleCause: 6}, models.DispositionCategoryNetworkCongestion},
+		{"CEND Q.850 busy", dispositionInput{DongleCause: 17, Q850Causes: []int{16}}, models.DispositionCategoryBusy},
+		{"CEND before Hangup cause", dispositionInput{DongleCause: 21, Q850Causes: []int{17}}, models.DispositionCategoryRejected},
+		{"CEND unknown", dispositionInput{DongleCause: 127, Q850Causes: []int{17}}, models.DispositionCategoryBusy},
+
+		// SIP responses win over everything but an answer.
+		{"SIP 402", dispositionInput{SIPResponse: 402}, models.DispositionCategoryNoCredit},
+		{"SIP 404", dispositionInput{SIPResponse: 404, Q850Causes: []int{17}}, models.DispositionCategoryUnallocatedNumber},
+		{"SIP 480", dispositionInput{SIPResponse: 480}, models.DispositionCategorySubscriberAbsent},
+		{"SIP 486", dispositionInput{SIPResponse: 486, DongleCause: 8}, models.DispositionCategoryBusy},
+		{"SIP 487", dispositionInput{SIPResponse: 487}, models.DispositionCategoryCancelled},
+		{"SIP 503", dispositionInput{SIPResponse: 503}, models.DispositionCategoryNetworkCongestion},
+		{"SIP 603", dispositionInput{SIPResponse: 603}, models.DispositionCategoryRejected},
+		{"SIP unmapped", dispositionInput{SIPResponse: 488, DialStatus: "BUSY"}, models.DispositionCategoryBusy},
+		{"SIP unmapped alone", dispositionInput{SIPResponse: 488}, models.DispositionCategoryFailed},
+
+		// The dial status when no cause says more.
+		{"dial busy", dispositionInput{DialStatus: "BUSY", Q850Causes: []int{16}}, models.DispositionCategoryBusy},
+		{"dial no answer", dispositionInput{DialStatus: "NOANSWER"}, models.DispositionCategoryNoAnswer},
+		{"dial cancel", dispositionInput{DialStatus: "CANCEL"}, models.DispositionCategoryCancelled},
+		{"dial congestion", dispositionInput{DialStatus: "CONGESTION"}, models.DispositionCategoryNetworkCongestion},
+		{"dial channel unavailable", dispositionInput{DialStatus: "CHANUNAVAIL"}, models.DispositionCategoryGatewayUnavailable},
+		{"dial answer but not answered", dispositionInput{DialStatus: "ANSWER", Q850Causes: []int{16}}, models.DispositionCategoryCancelled},
+
+		// Nothing specific.
+		{"caller hung up before answer", dispositionInput{Q850Causes: []int{16}}, models.DispositionCategoryCancelled},
+		{"normal unspecified", dispositionInput{Q850Causes: []int{31}}, models.DispositionCategoryCancelled},
+		{"unknown cause", dispositionInput{Q850Causes: []int{127}}, models.DispositionCategoryFailed},
+		{"nothing known", dispositionInput{}, models.DispositionCategoryFailed},
+	}
+	for _, tt := range tests {
+		if got := normalizeDisposition(tt.in); got != tt.want {
+			t.Errorf("%s: %+v -> %s, want %s", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSIPResponse(t *testing.T) {
+	for in, want := range map[string]int{
+		"SIP 486 Busy Here": 486,
+		"486":               486,
+		" SIP 503 ":         503,
+		"200 OK":            0,
+		"17":                0,
+		"":                  0,
+	} {
+		if got := parseSIPResponse(in); got != want {
+			t.Errorf("parseSIPResponse(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
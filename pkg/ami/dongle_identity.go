@@ -0,0 +1,165 @@
+package ami
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// identityTTL is how long an identity loaded from the database is trusted
+// before being re-read. Identities set from DongleDeviceEntry events are
+// refreshed with every inventory pass anyway.
+const identityTTL = 10 * time.Minute
+
+// dongleIdentity is what a chan_dongle device name of a gateway stands for:
+// the modem, by IMEI, and the SIM card, by ICCID, currently behind it. Zero
+// values mean unknown.
+type dongleIdentity struct {
+	IMEI      string
+	ModemID   int
+	ICCID     string
+	SIMCardID int64
+	loadedAt  time.Time
+}
+
+// identityMap resolves the device names found in channel names
+// ("Dongle/dongle0-0100000001") to modems.id and sim_cards.id. Device names
+// are only meaningful per gateway and move between modems when dongles are
+// re-plugged, so the map is kept current by the dongle inventory and falls
+// back to the database for names it has not seen.
+type identityMap struct {
+	gatewayID   *string
+	modemRepo   repository.ModemRepository
+	simCardRepo repository.SIMCardRepository
+	logger      *logrus.Entry
+	mu          sync.Mutex
+	byDongle    map[string]dongleIdentity
+}
+
+func newIdentityMap(gatewayID *string, modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository, logger *logrus.Entry) *identityMap {
+	return &identityMap{
+		gatewayID:   gatewayID,
+		modemRepo:   modemRepo,
+		simCardRepo: simCardRepo,
+		logger:      logger,
+		byDongle:    make(map[string]dongleIdentity),
+	}
+}
+
+// Lookup returns the cached identity of a device without touching the
+// database.
+func (m *identityMap) Lookup(device string) (dongleIdentity, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.byDongle[device]
+	return id, ok
+}
+
+// Set records the identity reported for a device.
+func (m *identityMap) Set(device string, id dongleIdentity) {
+	id.loadedAt = time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byDongle[device] = id
+}
+
+// SetModem records the modem behind a device, keeping the SIM if the modem is
+// unchanged.
+func (m *identityMap) SetModem(device, imei string, modemID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.byDongle[device]
+	if id.ModemID != modemID {
+		id = dongleIdentity{}
+	}
+	id.IMEI, id.ModemID, id.loadedAt = imei, modemID, time.Now()
+	m.byDongle[device] = id
+}
+
+// ClearSIM forgets the SIM of a device, e.g. when it has been removed.
+func (m *identityMap) ClearSIM(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, ok := m.byDongle[device]; ok {
+		id.ICCID, id.SIMCardID = "", 0
+		m.byDongle[device] = id
+	}
+}
+
+// Forget drops a device, e.g. when its modem row has been deleted.
+func (m *identityMap) Forget(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.byDongle, device)
+}
+
+// Resolve returns the modem and SIM card IDs of a device. iccid, when the
+// dialplan exposes it, identifies the SIM directly and is used when the
+// device is unknown or its SIM is. Either result is nil when unresolved.
+func (m *identityMap) Resolve(ctx context.Context, device, iccid string) (modemID *int, simCardID *int) {
+	var id dongleIdentity
+	if device != "" {
+		id = m.load(ctx, device)
+	}
+
+	if iccid != "" && iccid != id.ICCID {
+		sim, err := m.simCardRepo.GetSIMCardByICCID(ctx, iccid)
+		switch {
+		case err == nil:
+			id.ICCID, id.SIMCardID = sim.ICCID, sim.ID
+			if id.ModemID == 0 && sim.ModemID.Valid {
+				id.ModemID = int(sim.ModemID.Int64)
+			}
+		case err != repository.ErrNotFound:
+			m.logger.WithError(err).WithField("iccid", iccid).Warn("Failed to look up SIM card by ICCID")
+		}
+	}
+
+	if id.ModemID != 0 {
+		modemID = &id.ModemID
+	}
+	if id.SIMCardID != 0 {
+		simID := int(id.SIMCardID)
+		simCardID = &simID
+	}
+	return modemID, simCardID
+}
+
+// load returns the identity of a device, reading it from the database when it
+// is not cached or has gone stale.
+func (m *identityMap) load(ctx context.Context, device string) dongleIdentity {
+	m.mu.Lock()
+	cached, ok := m.byDongle[device]
+	m.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < identityTTL {
+		return cached
+	}
+
+	logger := m.logger.WithField("dongle", device)
+	modem, err := m.modemRepo.GetModemByDongleName(ctx, m.gatewayID, device)
+	if err != nil {
+		if err == repository.ErrNotFound {
+			m.Forget(device)
+			return dongleIdentity{}
+		}
+		logger.WithError(err).Warn("Failed to look up modem by dongle name")
+		return cached // better stale than nothing while the database is down
+	}
+
+	id := dongleIdentity{ModemID: modem.ID}
+	if modem.IMEI != nil {
+		id.IMEI = *modem.IMEI
+	}
+	sim, err := m.simCardRepo.GetSIMCardByModemID(ctx, int64(modem.ID))
+	switch {
+	case err == nil:
+		id.ICCID, id.SIMCardID = sim.ICCID, sim.ID
+	case err != repository.ErrNotFound:
+		logger.WithError(err).Warn("Failed to look up SIM card of modem")
+	}
+	m.Set(device, id)
+	return id
+}
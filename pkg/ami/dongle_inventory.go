@@ -0,0 +1,337 @@
+package ami
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+const (
+	// inventoryInterval is how often the full chan_dongle device list is
+	// requested to catch changes that raise no event (RSSI, cell, operator).
+	inventoryInterval = 5 * time.Minute
+
+	// refreshCooldown limits how often a single device is re-read because of
+	// its events.
+	refreshCooldown = 30 * time.Second
+)
+
+// dongleInventory keeps the modems and sim_cards tables in line with the
+// chan_dongle devices of one gateway. DongleDeviceEntry events (the reply to
+// DongleShowDevices) carry the full device state and are upserted; the other
+// Dongle* events only update the status or mark the modem as seen.
+type dongleInventory struct {
+	gatewayID   *string
+	modemRepo   repository.ModemRepository
+	simCardRepo repository.SIMCardRepository
+	logger      *logrus.Entry
+	identities  *identityMap
+	health      *modem.HealthMonitor // nil if modem health is not tracked
+	mu          sync.Mutex
+	refreshedAt map[string]time.Time // dongle name -> last refresh requested by Handle
+}
+
+func newDongleInventory(gatewayID string, modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository, logger *logrus.Entry) *dongleInventory {
+	gwID := getOptionalString(gatewayID)
+	return &dongleInventory{
+		gatewayID:   gwID,
+		modemRepo:   modemRepo,
+		simCardRepo: simCardRepo,
+		logger:      logger,
+		identities:  newIdentityMap(gwID, modemRepo, simCardRepo, logger),
+		refreshedAt: make(map[string]time.Time),
+	}
+}
+
+// isDongleEvent reports whether an event is emitted by chan_dongle.
+func isDongleEvent(eventName string) bool {
+	return strings.HasPrefix(eventName, "Dongle")
+}
+
+// Handle applies a chan_dongle event. It returns the name of a device whose
+// full state should be re-read with DongleShowDevices, or "" if none.
+func (d *dongleInventory) Handle(ctx context.Context, msg *goami2.Message, at time.Time) string {
+	device := d.handle(ctx, msg, at)
+	if device == "" {
+		return ""
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if last, ok := d.refreshedAt[device]; ok && at.Sub(last) < refreshCooldown {
+		return ""
+	}
+	d.refreshedAt[device] = at
+	return device
+}
+
+func (d *dongleInventory) handle(ctx context.Context, msg *goami2.Message, at time.Time) string {
+	device := getHeader(msg, "Device")
+	if device == "" {
+		return ""
+	}
+
+	switch getHeader(msg, "Event") {
+	case "DongleDeviceEntry":
+		d.upsertDevice(ctx, msg, at)
+
+	case "DongleStatus":
+		status := getHeader(msg, "Status")
+		d.updateStatus(ctx, device, dongleEventStatus(status), at)
+		if kind := dongleEventHealth(status); kind != "" {
+			d.observe(ctx, device, modem.HealthEvent{Kind: kind, Detail: "chan_dongle " + status, At: at})
+		}
+		// Free/Used flip on every call; anything else may come with a new
+		// SIM, operator or registration state.
+		if status != "Free" && status != "Used" {
+			return device
+		}
+
+	case "DonglePortFail":
+		d.logger.Warnf("Dongle %s port failure: %s", device, getHeader(msg, "Message"))
+		d.updateStatus(ctx, device, models.ModemStatusError, at)
+		d.observe(ctx, device, modem.HealthEvent{Kind: modem.HealthEventPortFailed, Detail: getHeader(msg, "Message"), At: at})
+
+	case "DongleShowDevicesComplete":
+
+	default:
+		// DongleNewCUSD, DongleNewUSSD, DongleCEND, DongleNewSMS,
+		// DongleCallStateChange, ... all prove the device is alive.
+		if !d.updateStatus(ctx, device, "", at) {
+			return device
+		}
+	}
+	return ""
+}
+
+// upsertDevice stores the state reported in a DongleDeviceEntry event.
+func (d *dongleInventory) upsertDevice(ctx context.Context, msg *goami2.Message, at time.Time) {
+	device := getHeader(msg, "Device")
+	logger := d.logger.WithField("dongle", device)
+
+	imei := firstNonEmpty(dongleValue(msg, "IMEIState"), dongleValue(msg, "IMEISetting"))
+	if imei == "" {
+		// Nothing to key the modem on until the device has been initialised.
+		logger.Debug("Skipping dongle without IMEI")
+		return
+	}
+
+	seenAt := at
+	modem := &models.Modem{
+		GatewayID:                 d.gatewayID,
+		DongleName:                models.StringPtr(device),
+		DevicePath:                firstNonEmpty(dongleValue(msg, "DataState"), dongleValue(msg, "DataSetting"), "dongle:"+device),
+		IMEI:                      models.StringPtr(imei),
+		IMSI:                      getOptionalString(dongleValue(msg, "IMSIState")),
+		Model:                     getOptionalString(dongleValue(msg, "Model")),
+		Manufacturer:              getOptionalString(dongleValue(msg, "Manufacturer")),
+		FirmwareVersion:           getOptionalString(dongleValue(msg, "Firmware")),
+		SignalStrengthDBM:         parseDongleRSSI(getHeader(msg, "RSSI")),
+		NetworkOperatorName:       getOptionalString(dongleValue(msg, "ProviderName")),
+		NetworkRegistrationStatus: getOptionalString(dongleValue(msg, "GSMRegistrationStatus")),
+		Status:                    dongleStateStatus(getHeader(msg, "State")),
+		LastSeenAt:                &seenAt,
+	}
+	if err := d.modemRepo.UpsertModemByIMEI(ctx, modem); err != nil {
+		logger.WithError(err).Error("Failed to upsert modem from dongle entry")
+		return
+	}
+
+	d.identities.SetModem(device, imei, modem.ID)
+	d.observeEntry(modem.ID, getHeader(msg, "State"), at)
+
+	iccid := dongleValue(msg, "ICCID")
+	imsi := dongleValue(msg, "IMSIState")
+	if iccid == "" && imsi == "" {
+		d.identities.ClearSIM(device)
+		return
+	}
+	sim := &models.SIMCard{
+		ModemID:      sql.NullInt64{Int64: int64(modem.ID), Valid: true},
+		ICCID:        iccid,
+		IMSI:         nullString(imsi),
+		MSISDN:       nullString(dongleValue(msg, "SubscriberNumber")),
+		OperatorName: nullString(dongleValue(msg, "ProviderName")),
+		CellID:       nullString(dongleValue(msg, "CellID")),
+		LAC:          nullString(dongleValue(msg, "LocationAreaCode")),
+	}
+	if err := d.simCardRepo.UpsertSIMCardFromModem(ctx, sim); err != nil {
+		if err == repository.ErrNotFound {
+			d.identities.ClearSIM(device)
+			logger.Infof("SIM with IMSI %s is not registered and chan_dongle reports no ICCID; add it on the SIMs page", imsi)
+			return
+		}
+		logger.WithError(err).Error("Failed to update SIM card from dongle entry")
+		return
+	}
+
+	d.identities.Set(device, dongleIdentity{IMEI: imei, ModemID: modem.ID, ICCID: sim.ICCID, SIMCardID: sim.ID})
+}
+
+// Lookup returns the modem and SIM IDs last seen for a dongle name. Zero
+// means unknown.
+func (d *dongleInventory) Lookup(device string) (modemID int, simID int64) {
+	id, _ := d.identities.Lookup(device)
+	return id.ModemID, id.SIMCardID
+}
+
+// updateStatus sets the status of a known dongle (or only its last seen time
+// when status is empty). It returns false if the dongle has no modem row yet.
+func (d *dongleInventory) updateStatus(ctx context.Context, device, status string, at time.Time) bool {
+	modemID, ok := d.modemID(ctx, device)
+	if !ok {
+		return false
+	}
+	err := d.modemRepo.UpdateModemStatus(ctx, modemID, status, at)
+	if err == repository.ErrNotFound {
+		// The row was deleted behind our back; the next entry recreates it.
+		d.identities.Forget(device)
+		return false
+	}
+	if err != nil {
+		d.logger.WithError(err).WithField("dongle", device).Warn("Failed to update modem status")
+	}
+	return true
+}
+
+// observeEntry feeds the state of a DongleDeviceEntry to the health monitor.
+func (d *dongleInventory) observeEntry(modemID int, state string, at time.Time) {
+	if d.health == nil {
+		return
+	}
+	d.health.Observe(modem.HealthEvent{ModemID: modemID, Kind: modem.HealthEventDetected, At: at})
+	if kind := dongleStateHealth(state); kind != "" {
+		d.health.Observe(modem.HealthEvent{ModemID: modemID, Kind: kind, Detail: "chan_dongle " + state, At: at})
+	}
+}
+
+// observe feeds an event about a dongle to the health monitor.
+func (d *dongleInventory) observe(ctx context.Context, device string, ev modem.HealthEvent) {
+	if d.health == nil {
+		return
+	}
+	if modemID, ok := d.modemID(ctx, device); ok {
+		ev.ModemID = modemID
+		d.health.Observe(ev)
+	}
+}
+
+// modemID resolves a dongle name to its modems.id.
+func (d *dongleInventory) modemID(ctx context.Context, device string) (int, bool) {
+	id := d.identities.load(ctx, device)
+	return id.ModemID, id.ModemID != 0
+}
+
+// dongleValue returns a DongleDeviceEntry field, treating chan_dongle's
+// placeholders for "not known yet" as empty.
+func dongleValue(msg *goami2.Message, key string) string {
+	value := strings.TrimSpace(getHeader(msg, key))
+	switch strings.ToLower(value) {
+	case "unknown", "none", "n/a", "":
+		return ""
+	}
+	return value
+}
+
+// parseDongleRSSI converts chan_dongle's RSSI field to dBm. Depending on the
+// version it is "17, -79 dBm", "-79 dBm" or the raw AT+CSQ value "17".
+func parseDongleRSSI(value string) *int {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if i := strings.LastIndex(value, ","); i >= 0 {
+		value = strings.TrimSpace(value[i+1:])
+	}
+	if strings.HasSuffix(value, "dBm") {
+		dbm, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(value, "dBm")))
+		if err != nil {
+			return nil
+		}
+		return &dbm
+	}
+	csq, err := strconv.Atoi(value)
+	if err != nil || csq < 0 || csq > 31 { // 99 means not detectable
+		return nil
+	}
+	dbm := -113 + 2*csq
+	return &dbm
+}
+
+// dongleStateStatus maps the State of a DongleDeviceEntry to a modem status.
+func dongleStateStatus(state string) string {
+	switch state {
+	case "Free":
+		return models.ModemStatusOnline
+	case "Not connected":
+		return models.ModemStatusOffline
+	case "Not initialized", "GSM not registered", "":
+		return models.ModemStatusWarning
+	default: // Ring, Dialing, Incoming, Active, Held, SMS, ...
+		return models.ModemStatusBusy
+	}
+}
+
+// dongleEventStatus maps the Status of a DongleStatus event to a modem status.
+func dongleEventStatus(status string) string {
+	switch status {
+	case "Free", "Register":
+		return models.ModemStatusOnline
+	case "Used":
+		return models.ModemStatusBusy
+	case "Disconnect":
+		return models.ModemStatusOffline
+	default: // Connect, Initialize, Unregister
+		return models.ModemStatusWarning
+	}
+}
+
+// dongleStateHealth maps the State of a DongleDeviceEntry to a health
+// event, "" if it says nothing about the modem's health.
+func dongleStateHealth(state string) modem.HealthEventKind {
+	switch state {
+	case "Free":
+		return modem.HealthEventIdle
+	case "Not initialized":
+		return modem.HealthEventInitializing
+	case "GSM not registered":
+		return modem.HealthEventUnregistered
+	case "Not connected", "":
+		return ""
+	default: // Ring, Dialing, Incoming, Active, Held, SMS, ...
+		return modem.HealthEventBusy
+	}
+}
+
+// dongleEventHealth maps the Status of a DongleStatus event to a health
+// event.
+func dongleEventHealth(status string) modem.HealthEventKind {
+	switch status {
+	case "Free":
+		return modem.HealthEventIdle
+	case "Used":
+		return modem.HealthEventBusy
+	case "Register":
+		return modem.HealthEventRegistered
+	case "Unregister":
+		return modem.HealthEventUnregistered
+	case "Connect", "Initialize", "Disconnect":
+		// A disconnect is also how a reload or restart starts; a modem that
+		// does not come back times out of initializing.
+		return modem.HealthEventInitializing
+	}
+	return ""
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
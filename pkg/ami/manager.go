@@ -0,0 +1,278 @@
+package ami
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// resyncInterval is how often the manager re-reads the gateways table to
+	// pick up changes made outside the API (e.g. directly in the database).
+	resyncInterval = time.Minute
+)
+
+// gatewaySession is a running AMIService and the endpoint it was started with.
+type gatewaySession struct {
+	service  *AMIService
+	endpoint amiEndpoint
+}
+
+// GatewayManager supervises one AMIService per enabled gateway and keeps the
+// set of sessions in line with the gateways table.
+type GatewayManager struct {
+	gatewayRepo repository.GatewayRepository
+	cdrRepo     repository.CdrRepository
+	modemRepo   repository.ModemRepository
+	simCardRepo repository.SIMCardRepository
+	logger      *logrus.Logger
+	recordDir   string
+	cdrOutbox   *CDROutbox
+	health      *modem.HealthMonitor
+	smsService  *sms.Service
+	ussdService *ussd.Service
+	mu          sync.Mutex
+	sessions    map[string]*gatewaySession
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// NewGatewayManager creates a new GatewayManager. modemRepo and simCardRepo may
+// be nil to leave the modems and sim_cards tables alone.
+func NewGatewayManager(gatewayRepo repository.GatewayRepository, cdrRepo repository.CdrRepository, modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository, logger *logrus.Logger) *GatewayManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &GatewayManager{
+		gatewayRepo: gatewayRepo,
+		cdrRepo:     cdrRepo,
+		modemRepo:   modemRepo,
+		simCardRepo: simCardRepo,
+		logger:      logger,
+		sessions:    make(map[string]*gatewaySession),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// SetRecordDir makes every session record its AMI messages to dir; see
+// AMIService.SetRecordDir. It must be called before Start.
+func (m *GatewayManager) SetRecordDir(dir string) {
+	m.recordDir = dir
+}
+
+// SetCDROutbox makes every session spool CDRs it fails to write to outbox.
+// It must be called before Start.
+func (m *GatewayManager) SetCDROutbox(outbox *CDROutbox) {
+	m.cdrOutbox = outbox
+}
+
+// SetHealthMonitor makes every session feed modem health events to health.
+// It must be called before Start.
+func (m *GatewayManager) SetHealthMonitor(health *modem.HealthMonitor) {
+	m.health = health
+}
+
+// SetSMSService makes every session hand text messages to service. It must
+// be called before Start.
+func (m *GatewayManager) SetSMSService(service *sms.Service) {
+	m.smsService = service
+}
+
+// SetUSSDService makes every session hand USSD responses to service. It
+// must be called before Start.
+func (m *GatewayManager) SetUSSDService(service *ussd.Service) {
+	m.ussdService = service
+}
+
+// Start opens a session for every enabled gateway and periodically resyncs
+// with the gateways table.
+func (m *GatewayManager) Start() {
+	m.logger.Info("Starting AMI gateway manager...")
+	if err := m.Reload(m.ctx); err != nil {
+		m.logger.WithError(err).Error("Failed to load gateways for AMI sessions")
+	}
+
+	go func() {
+		ticker := time.NewTicker(resyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := m.Reload(m.ctx); err != nil {
+					m.logger.WithError(err).Warn("Failed to resync AMI gateway sessions")
+				}
+			}
+		}
+	}()
+}
+
+// Stop closes every AMI session.
+func (m *GatewayManager) Stop() {
+	m.logger.Info("Stopping AMI gateway manager...")
+	m.cancel()
+
+	m.mu.Lock()
+	sessions := m.sessions
+	m.sessions = make(map[string]*gatewaySession)
+	m.mu.Unlock()
+
+	// Stopping a service waits for its CDRs; the sessions are stopped
+	// outside m.mu so that Session callers do not wait with them.
+	var wg sync.WaitGroup
+	for _, session := range sessions {
+		wg.Add(1)
+		go func(service *AMIService) {
+			defer wg.Done()
+			service.Stop()
+		}(session.service)
+	}
+	wg.Wait()
+}
+
+// Reload reconciles the running sessions with the gateways table: new or
+// re-enabled gateways are connected, edited ones reconnected and disabled or
+// deleted ones dropped.
+func (m *GatewayManager) Reload(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	gateways, err := m.gatewayRepo.ListGateways(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(gateways))
+	for _, gateway := range gateways {
+		seen[gateway.ID] = true
+		m.SyncGateway(gateway)
+	}
+
+	m.mu.Lock()
+	var removed []string
+	for id := range m.sessions {
+		if !seen[id] {
+			removed = append(removed, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range removed {
+		m.RemoveGateway(id)
+	}
+	return nil
+}
+
+// SyncGateway starts, restarts or stops the session of a single gateway so it
+// matches the gateway's current settings.
+func (m *GatewayManager) SyncGateway(gateway *models.Gateway) {
+	m.mu.Lock()
+	// Checked under m.mu: once Stop has taken the sessions, none is added.
+	if m.ctx.Err() != nil {
+		m.mu.Unlock()
+		return
+	}
+	session, running := m.sessions[gateway.ID]
+	if !gateway.Enabled {
+		if running {
+			delete(m.sessions, gateway.ID)
+		}
+		m.mu.Unlock()
+		if running {
+			m.logger.WithField("gateway_id", gateway.ID).Info("Gateway disabled, closing AMI session")
+			session.service.Stop()
+			m.updateStatus(gateway.ID, models.GatewayStatusOffline, nil)
+		}
+		return
+	}
+
+	endpoint := endpointFor(gateway)
+	if running && session.endpoint == endpoint {
+		m.mu.Unlock()
+		return
+	}
+	if running {
+		m.logger.WithField("gateway_id", gateway.ID).Info("Gateway AMI settings changed, reconnecting")
+		// The old session is stopped once m.mu is released.
+		defer session.service.Stop()
+	}
+	defer m.mu.Unlock()
+
+	service := NewGatewayAMIService(gateway, m.cdrRepo, m.modemRepo, m.simCardRepo, m.logger)
+	service.SetStatusHandler(m.updateStatus)
+	service.SetRecordDir(m.recordDir)
+	service.SetCDROutbox(m.cdrOutbox)
+	if m.health != nil {
+		service.SetHealthMonitor(m.health)
+	}
+	if m.smsService != nil {
+		service.SetSMSService(m.smsService)
+	}
+	if m.ussdService != nil {
+		service.SetUSSDService(m.ussdService)
+	}
+	service.Start()
+	m.sessions[gateway.ID] = &gatewaySession{service: service, endpoint: endpoint}
+}
+
+// RemoveGateway closes the session of a gateway, e.g. after it was deleted.
+func (m *GatewayManager) RemoveGateway(id string) {
+	m.mu.Lock()
+	session, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+
+	if ok {
+		m.logger.WithField("gateway_id", id).Info("Closing AMI session for removed gateway")
+		session.service.Stop()
+	}
+}
+
+// Session returns the running AMIService of a gateway.
+func (m *GatewayManager) Session(id string) (*AMIService, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	return session.service, true
+}
+
+// Sessions returns all running AMIServices keyed by gateway ID.
+func (m *GatewayManager) Sessions() map[string]*AMIService {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	services := make(map[string]*AMIService, len(m.sessions))
+	for id, session := range m.sessions {
+		services[id] = session.service
+	}
+	return services
+}
+
+// updateStatus persists a connection state change to the gateways table.
+func (m *GatewayManager) updateStatus(gatewayID, status string, err error) {
+	if gatewayID == "" {
+		return
+	}
+	var lastError *string
+	if err != nil {
+		lastError = models.StringPtr(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if updateErr := m.gatewayRepo.UpdateGatewayStatus(ctx, gatewayID, status, lastError); updateErr != nil && updateErr != repository.ErrNotFound {
+		m.logger.WithError(updateErr).WithField("gateway_id", gatewayID).Warn("Failed to update gateway status")
+	}
+}
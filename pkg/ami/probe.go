@@ -0,0 +1,253 @@
+package ami
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+const (
+	// probePings is how many Ping actions are averaged for the round-trip time.
+	probePings = 3
+	// probeDialTimeout bounds the TCP connect of a connection test.
+	probeDialTimeout = 5 * time.Second
+)
+
+// Probe step names.
+const (
+	ProbeStepConnect  = "connect"
+	ProbeStepLogin    = "login"
+	ProbeStepPing     = "ping"
+	ProbeStepVersion  = "version"
+	ProbeStepUptime   = "uptime"
+	ProbeStepChannels = "channels"
+	ProbeStepDongles  = "dongles"
+)
+
+// ProbeStep is the outcome of one step of a connection test.
+type ProbeStep struct {
+	Name       string `json:"name"`
+	Success    bool   `json:"success"`
+	Message    string `json:"message"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// ProbeResult is the outcome of a connection test against a gateway's AMI.
+type ProbeResult struct {
+	Success         bool           `json:"success"` // connected, logged in and answered a Ping
+	Steps           []ProbeStep    `json:"steps"`
+	ConnectMs       int64          `json:"connect_ms"`
+	LoginMs         int64          `json:"login_ms"`
+	RoundTripMs     float64        `json:"round_trip_ms"`
+	AsteriskVersion string         `json:"asterisk_version,omitempty"`
+	AMIVersion      string         `json:"ami_version,omitempty"`
+	UptimeSeconds   int64          `json:"uptime_seconds,omitempty"`
+	CurrentCalls    int            `json:"current_calls"`
+	Channels        int            `json:"channels"`
+	Dongles         []DongleDevice `json:"dongles"`
+}
+
+// Step returns the step with the given name, or nil if it did not run.
+func (r *ProbeResult) Step(name string) *ProbeStep {
+	for i := range r.Steps {
+		if r.Steps[i].Name == name {
+			return &r.Steps[i]
+		}
+	}
+	return nil
+}
+
+func (r *ProbeResult) addStep(name string, started time.Time, message string, err error) *ProbeStep {
+	step := ProbeStep{
+		Name:       name,
+		Success:    err == nil,
+		Message:    message,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	r.Steps = append(r.Steps, step)
+	return &r.Steps[len(r.Steps)-1]
+}
+
+// TestConnection opens a separate, short-lived AMI session to a gateway and
+// checks each stage of it: TCP connect, login, Ping round trip, Asterisk
+// version, uptime, channels and chan_dongle devices. It does not touch the
+// gateway's long-running session, so it also works for disabled gateways.
+// Steps after a failed connect or login are skipped.
+func TestConnection(ctx context.Context, gateway *models.Gateway) *ProbeResult {
+	result := &ProbeResult{Dongles: []DongleDevice{}}
+	endpoint := endpointFor(gateway)
+	address := net.JoinHostPort(endpoint.Host, endpoint.Port)
+
+	// TCP connect
+	started := time.Now()
+	dialer := net.Dialer{Timeout: probeDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	result.ConnectMs = time.Since(started).Milliseconds()
+	if err != nil {
+		result.addStep(ProbeStepConnect, started, fmt.Sprintf("Cannot reach %s", address), err)
+		return result
+	}
+	result.addStep(ProbeStepConnect, started, fmt.Sprintf("Connected to %s in %dms", address, result.ConnectMs), nil)
+
+	// Login
+	started = time.Now()
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	client, err := goami2.NewClientWithContext(sessionCtx, conn, endpoint.Username, endpoint.Password)
+	result.LoginMs = time.Since(started).Milliseconds()
+	if err != nil {
+		conn.Close()
+		message := "Login failed"
+		if errors.Is(err, goami2.ErrAMI) {
+			message = "Login rejected; check the AMI user and password"
+		}
+		result.addStep(ProbeStepLogin, started, message, err)
+		return result
+	}
+	defer client.Close()
+	result.addStep(ProbeStepLogin, started, fmt.Sprintf("Logged in as %s in %dms", endpoint.Username, result.LoginMs), nil)
+
+	actions := newActionCorrelator()
+	go func() {
+		for {
+			select {
+			case <-sessionCtx.Done():
+				return
+			case msg, ok := <-client.AllMessages():
+				if !ok {
+					actions.failAll(ErrConnectionLost)
+					return
+				}
+				actions.deliver(msg)
+			}
+		}
+	}()
+	send := func(action *goami2.Message, completeEvent string) (*ActionResponse, error) {
+		return sendAction(ctx, client, actions, action, completeEvent)
+	}
+
+	// Round trip
+	started = time.Now()
+	var total time.Duration
+	for i := 0; i < probePings && err == nil; i++ {
+		sent := time.Now()
+		if _, err = send(goami2.NewAction("Ping"), ""); err == nil {
+			total += time.Since(sent)
+		}
+	}
+	if err != nil {
+		result.addStep(ProbeStepPing, started, "Gateway did not answer Ping", err)
+	} else {
+		result.RoundTripMs = float64(total.Microseconds()) / 1000 / probePings
+		result.addStep(ProbeStepPing, started, fmt.Sprintf("Average round trip %.1fms over %d pings", result.RoundTripMs, probePings), nil)
+		result.Success = true
+	}
+
+	// Version
+	started = time.Now()
+	if reply, err := send(goami2.NewAction("CoreSettings"), ""); err != nil {
+		result.addStep(ProbeStepVersion, started, "Cannot read Asterisk version", err)
+	} else {
+		result.AsteriskVersion = reply.Response.Field("AsteriskVersion")
+		result.AMIVersion = reply.Response.Field("AMIversion")
+		result.addStep(ProbeStepVersion, started, fmt.Sprintf("Asterisk %s (AMI %s)", result.AsteriskVersion, result.AMIVersion), nil)
+	}
+
+	// Uptime and current calls
+	started = time.Now()
+	if reply, err := send(goami2.NewAction("CoreStatus"), ""); err != nil {
+		result.addStep(ProbeStepUptime, started, "Cannot read Asterisk status", err)
+	} else {
+		result.CurrentCalls, _ = strconv.Atoi(reply.Response.Field("CoreCurrentCalls"))
+		if startup, ok := parseCoreStartup(reply.Response); ok {
+			result.UptimeSeconds = int64(time.Since(startup).Seconds())
+		}
+		result.addStep(ProbeStepUptime, started, fmt.Sprintf("Up %s, %d call(s) in progress",
+			formatUptime(time.Duration(result.UptimeSeconds)*time.Second), result.CurrentCalls), nil)
+	}
+
+	// Channels
+	started = time.Now()
+	if reply, err := send(goami2.NewAction("CoreShowChannels"), "CoreShowChannelsComplete"); err != nil {
+		result.addStep(ProbeStepChannels, started, "Cannot list channels", err)
+	} else {
+		result.Channels = len(parseChannels(reply))
+		result.addStep(ProbeStepChannels, started, fmt.Sprintf("%d active channel(s)", result.Channels), nil)
+	}
+
+	// Dongles
+	started = time.Now()
+	if reply, err := send(goami2.NewAction("DongleShowDevices"), "DongleShowDevicesComplete"); err != nil {
+		result.addStep(ProbeStepDongles, started, "Cannot list dongles; is chan_dongle loaded?", err)
+	} else {
+		result.Dongles = parseDongleDevices(reply)
+		free := 0
+		for _, dongle := range result.Dongles {
+			if dongle.State == "Free" {
+				free++
+			}
+		}
+		step := result.addStep(ProbeStepDongles, started, fmt.Sprintf("Detected %d dongle(s), %d free", len(result.Dongles), free), nil)
+		if len(result.Dongles) == 0 {
+			step.Success = false
+			step.Error = "chan_dongle reports no devices"
+		}
+	}
+
+	return result
+}
+
+// parseCoreStartup returns the startup time from a CoreStatus response. The
+// date and time are in the gateway's local time zone, which is assumed to
+// match ours.
+func parseCoreStartup(msg *goami2.Message) (time.Time, bool) {
+	date, clock := msg.Field("CoreStartupDate"), msg.Field("CoreStartupTime")
+	if date == "" || clock == "" {
+		return time.Time{}, false
+	}
+	startup, err := time.ParseInLocation("2006-01-02 15:04:05", date+" "+clock, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return startup, true
+}
+
+// formatUptime renders a duration as "3 days, 4 hours, 5 minutes".
+func formatUptime(d time.Duration) string {
+	if d <= 0 {
+		return "unknown"
+	}
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+
+	var parts []string
+	if days > 0 {
+		parts = append(parts, plural(days, "day"))
+	}
+	if hours > 0 {
+		parts = append(parts, plural(hours, "hour"))
+	}
+	if minutes > 0 || len(parts) == 0 {
+		parts = append(parts, plural(minutes, "minute"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,469 @@
+package ami
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// weakSignalHysteresis is how far above the threshold the signal must
+	// climb before a weak-signal alarm clears, so a modem hovering around
+	// the threshold does not raise and clear alarms on every poll.
+	weakSignalHysteresis = 3
+
+	// maxBTSHistory caps the entries kept in a SIM card's BTS history.
+	maxBTSHistory = 100
+
+	// btsFlushInterval is how often the BTS history of a SIM staying on the
+	// same cell is written back; a cell change is written at once.
+	btsFlushInterval = 10 * time.Minute
+
+	// pruneInterval is how often readings past the retention are deleted.
+	pruneInterval = time.Hour
+)
+
+// RadioOptions configures a RadioMonitor.
+type RadioOptions struct {
+	Interval      time.Duration // time between polls
+	WeakSignalDBM int           // signal below this is weak
+	WeakSignalFor time.Duration // how long the signal must stay weak to raise an alarm
+	FlapChanges   int           // registration changes within FlapWindow that count as flapping
+	FlapWindow    time.Duration
+	Retention     time.Duration // readings older than this are deleted; 0 keeps them
+}
+
+// DefaultRadioOptions returns the thresholds from the PRD: an alarm after
+// five minutes below -95 dBm, or after four registration changes within
+// fifteen minutes.
+func DefaultRadioOptions() RadioOptions {
+	return RadioOptions{
+		Interval:      time.Minute,
+		WeakSignalDBM: -95,
+		WeakSignalFor: 5 * time.Minute,
+		FlapChanges:   4,
+		FlapWindow:    15 * time.Minute,
+		Retention:     30 * 24 * time.Hour,
+	}
+}
+
+// alarmState is the state of one alarm of a modem.
+type alarmState int
+
+const (
+	alarmUnknown alarmState = iota // may have been left open before a restart
+	alarmClear
+	alarmRaised
+)
+
+// radioState is what the monitor remembers about a modem between polls.
+type radioState struct {
+	weakSince time.Time // when the signal dropped below the threshold; zero if it is not weak
+	weakAlarm alarmState
+
+	seen       bool
+	registered bool
+	changes    []time.Time // registration changes within the flap window
+	flapAlarm  alarmState
+
+	simID     int64 // SIM the history belongs to
+	history   []models.BTSHistoryEntry
+	flushedAt time.Time
+}
+
+// RadioMonitor polls the chan_dongle devices of every gateway for their
+// signal and serving cell. Each poll is stored as a reading, the modem row
+// gets the latest values and the SIM's BTS history is extended. An alarm is
+// raised when a modem's signal stays below the threshold or its network
+// registration keeps coming and going, and cleared once it recovers.
+type RadioMonitor struct {
+	manager     *GatewayManager
+	radioRepo   repository.RadioRepository
+	modemRepo   repository.ModemRepository
+	simCardRepo repository.SIMCardRepository
+	alertRepo   repository.AlertRepository
+	health      *modem.HealthMonitor // nil if modem health is not tracked
+	opts        RadioOptions
+	logger      *logrus.Logger
+
+	pollMu   sync.Mutex
+	states   map[int]*radioState // by modem ID
+	prunedAt time.Time
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewRadioMonitor creates a RadioMonitor for the gateways of manager.
+func NewRadioMonitor(manager *GatewayManager, radioRepo repository.RadioRepository, modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository, alertRepo repository.AlertRepository, opts RadioOptions, logger *logrus.Logger) *RadioMonitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RadioMonitor{
+		manager:     manager,
+		radioRepo:   radioRepo,
+		modemRepo:   modemRepo,
+		simCardRepo: simCardRepo,
+		alertRepo:   alertRepo,
+		opts:        opts,
+		logger:      logger,
+		states:      make(map[int]*radioState),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+}
+
+// SetHealthMonitor makes the monitor feed every reading's signal and
+// registration to health. Call before Start.
+func (m *RadioMonitor) SetHealthMonitor(health *modem.HealthMonitor) {
+	m.health = health
+}
+
+// Start polls every opts.Interval in the background.
+func (m *RadioMonitor) Start() {
+	m.started = true
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+				m.Poll(m.ctx)
+				m.prune(m.ctx)
+			}
+		}
+	}()
+}
+
+// Stop ends polling.
+func (m *RadioMonitor) Stop() {
+	m.cancel()
+	if m.started {
+		<-m.done
+	}
+}
+
+// Poll reads the devices of every connected gateway once.
+func (m *RadioMonitor) Poll(ctx context.Context) {
+	m.pollMu.Lock()
+	defer m.pollMu.Unlock()
+
+	for gatewayID, service := range m.manager.Sessions() {
+		if !service.Connected() {
+			continue
+		}
+		logger := m.logger.WithField("gateway_id", gatewayID)
+		pollCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		devices, err := service.DongleShowDevices(pollCtx, "")
+		if err != nil {
+			cancel()
+			if ctx.Err() == nil {
+				logger.WithError(err).Warn("Failed to poll dongle radio state")
+			}
+			continue
+		}
+		now := time.Now()
+		for _, dev := range devices {
+			if dev.IMEI == "" {
+				continue
+			}
+			m.record(pollCtx, logger.WithField("dongle", dev.Device), dev, now)
+		}
+		cancel()
+	}
+}
+
+// record stores one device's reading and evaluates its alarms.
+func (m *RadioMonitor) record(ctx context.Context, logger *logrus.Entry, dev DongleDevice, at time.Time) {
+	modem, err := m.modemRepo.GetModemByIMEI(ctx, dev.IMEI)
+	if err != nil {
+		if !errors.Is(err, repository.ErrNotFound) {
+			logger.WithError(err).Warn("Failed to look up modem for radio reading")
+		}
+		// The inventory creates the row from the same device entry.
+		return
+	}
+
+	sim := m.lookupSIM(ctx, logger, modem.ID, dev.ICCID)
+	reading := &models.RadioReading{
+		ModemID:      modem.ID,
+		SignalDBM:    dev.SignalDBM,
+		Registration: dev.Registration,
+		Registered:   isRegistered(dev.Registration),
+		OperatorName: nullString(dev.Provider),
+		Mode:         nullString(dev.Mode),
+		LAC:          nullString(dev.LAC),
+		CellID:       nullString(dev.CellID),
+		RecordedAt:   at,
+	}
+	if sim != nil {
+		reading.SIMCardID = sql.NullInt64{Int64: sim.ID, Valid: true}
+	}
+	if err := m.radioRepo.RecordReading(ctx, reading); err != nil {
+		logger.WithError(err).Warn("Failed to store radio reading")
+	}
+	if err := m.modemRepo.UpdateModemRadio(ctx, modem.ID, dev.SignalDBM, getOptionalString(dev.Registration), getOptionalString(dev.Provider), at); err != nil {
+		logger.WithError(err).Warn("Failed to update modem radio state")
+	}
+
+	state, ok := m.states[modem.ID]
+	if !ok {
+		state = &radioState{}
+		m.states[modem.ID] = state
+	}
+	if sim != nil && reading.CellID.Valid {
+		m.updateBTSHistory(ctx, logger, state, sim, reading)
+	}
+
+	name := modem.DevicePath
+	if modem.DongleName != nil {
+		name = *modem.DongleName
+	}
+	m.checkSignal(ctx, logger, state, modem.ID, name, reading)
+	m.checkRegistration(ctx, logger, state, modem.ID, name, reading)
+	m.observeHealth(reading)
+}
+
+// observeHealth feeds a reading's registration and signal to the health
+// monitor.
+func (m *RadioMonitor) observeHealth(reading *models.RadioReading) {
+	if m.health == nil {
+		return
+	}
+	kind := modem.HealthEventUnregistered
+	if reading.Registered {
+		kind = modem.HealthEventRegistered
+	}
+	m.health.Observe(modem.HealthEvent{ModemID: reading.ModemID, Kind: kind, Detail: reading.Registration, At: reading.RecordedAt})
+	if reading.SignalDBM != nil {
+		m.health.Observe(modem.HealthEvent{ModemID: reading.ModemID, Kind: modem.HealthEventSignal, SignalDBM: *reading.SignalDBM, At: reading.RecordedAt})
+	}
+}
+
+// lookupSIM finds the SIM in a modem, by ICCID if chan_dongle reported it.
+func (m *RadioMonitor) lookupSIM(ctx context.Context, logger *logrus.Entry, modemID int, iccid string) *models.SIMCard {
+	var sim *models.SIMCard
+	var err error
+	if iccid != "" {
+		sim, err = m.simCardRepo.GetSIMCardByICCID(ctx, iccid)
+	} else {
+		sim, err = m.simCardRepo.GetSIMCardByModemID(ctx, int64(modemID))
+	}
+	if err != nil {
+		if !errors.Is(err, repository.ErrNotFound) {
+			logger.WithError(err).Warn("Failed to look up SIM for radio reading")
+		}
+		return nil
+	}
+	return sim
+}
+
+// updateBTSHistory extends the SIM's BTS history with a reading and writes
+// it back when the cell changed or it was last written a while ago.
+func (m *RadioMonitor) updateBTSHistory(ctx context.Context, logger *logrus.Entry, state *radioState, sim *models.SIMCard, reading *models.RadioReading) {
+	if state.simID != sim.ID {
+		state.simID = sim.ID
+		state.history = nil
+		state.flushedAt = time.Time{}
+		if len(sim.BTSInfoHistory) > 0 && string(sim.BTSInfoHistory) != "null" {
+			if err := json.Unmarshal(sim.BTSInfoHistory, &state.history); err != nil {
+				logger.WithError(err).Warn("Discarding unreadable BTS history")
+				state.history = nil
+			}
+		}
+	}
+
+	var changed bool
+	state.history, changed = appendBTSHistory(state.history, reading, maxBTSHistory)
+	if !changed && reading.RecordedAt.Sub(state.flushedAt) < btsFlushInterval {
+		return
+	}
+	history, err := json.Marshal(state.history)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode BTS history")
+		return
+	}
+	if err := m.simCardRepo.UpdateSIMCardCell(ctx, sim.ID, reading.LAC, reading.CellID, history); err != nil {
+		logger.WithError(err).Warn("Failed to store BTS history")
+		return
+	}
+	state.flushedAt = reading.RecordedAt
+}
+
+// appendBTSHistory adds a reading to a BTS history, merging it into the last
+// entry when the SIM is still on the same cell, and keeps at most max
+// entries. It reports whether a new entry was started.
+func appendBTSHistory(history []models.BTSHistoryEntry, reading *models.RadioReading, max int) ([]models.BTSHistoryEntry, bool) {
+	if n := len(history); n > 0 {
+		last := &history[n-1]
+		if last.CellID == reading.CellID.String && last.LAC == reading.LAC.String && last.Operator == reading.OperatorName.String {
+			last.LastSeen = reading.RecordedAt
+			if reading.Mode.Valid {
+				last.Mode = reading.Mode.String
+			}
+			addBTSSample(last, reading.SignalDBM)
+			return history, false
+		}
+	}
+
+	entry := models.BTSHistoryEntry{
+		Operator:  reading.OperatorName.String,
+		Mode:      reading.Mode.String,
+		LAC:       reading.LAC.String,
+		CellID:    reading.CellID.String,
+		FirstSeen: reading.RecordedAt,
+		LastSeen:  reading.RecordedAt,
+	}
+	addBTSSample(&entry, reading.SignalDBM)
+	history = append(history, entry)
+	if len(history) > max {
+		history = append([]models.BTSHistoryEntry(nil), history[len(history)-max:]...)
+	}
+	return history, true
+}
+
+// addBTSSample counts a reading and folds its signal into the entry's
+// minimum, maximum and running average.
+func addBTSSample(entry *models.BTSHistoryEntry, dbm *int) {
+	entry.Samples++
+	if dbm == nil {
+		return
+	}
+	v := *dbm
+	if entry.MinDBM == nil || v < *entry.MinDBM {
+		entry.MinDBM = &v
+	}
+	if entry.MaxDBM == nil || v > *entry.MaxDBM {
+		entry.MaxDBM = &v
+	}
+	if entry.AvgDBM == nil {
+		avg := float64(v)
+		entry.AvgDBM = &avg
+		return
+	}
+	// Samples includes readings without a signal, so this slightly
+	// under-weights new values on cells that lost the signal at times.
+	*entry.AvgDBM += (float64(v) - *entry.AvgDBM) / float64(entry.Samples)
+}
+
+// checkSignal raises a weak-signal alarm once the signal stayed below the
+// threshold long enough and clears it when the signal recovers.
+func (m *RadioMonitor) checkSignal(ctx context.Context, logger *logrus.Entry, state *radioState, modemID int, name string, reading *models.RadioReading) {
+	if reading.SignalDBM == nil {
+		// Not detectable; registration flapping covers a lost network.
+		return
+	}
+	dbm := *reading.SignalDBM
+	switch {
+	case dbm < m.opts.WeakSignalDBM:
+		if state.weakSince.IsZero() {
+			state.weakSince = reading.RecordedAt
+		}
+		weakFor := reading.RecordedAt.Sub(state.weakSince)
+		if weakFor < m.opts.WeakSignalFor || state.weakAlarm == alarmRaised {
+			return
+		}
+		state.weakAlarm = alarmRaised
+		m.raise(ctx, logger, modemID, models.AlertKindModemSignalWeak,
+			fmt.Sprintf("Signal of %s has been below %d dBm for %s (now %d dBm)", name, m.opts.WeakSignalDBM, weakFor.Round(time.Minute), dbm),
+			map[string]interface{}{"dongle": name, "signal_dbm": dbm, "threshold_dbm": m.opts.WeakSignalDBM, "weak_since": state.weakSince})
+
+	case dbm >= m.opts.WeakSignalDBM+weakSignalHysteresis:
+		state.weakSince = time.Time{}
+		if state.weakAlarm != alarmClear {
+			state.weakAlarm = alarmClear
+			m.resolve(ctx, logger, modemID, models.AlertKindModemSignalWeak)
+		}
+	}
+}
+
+// checkRegistration raises a flapping alarm when the registration changed
+// too often within the flap window and clears it after a quiet window.
+func (m *RadioMonitor) checkRegistration(ctx context.Context, logger *logrus.Entry, state *radioState, modemID int, name string, reading *models.RadioReading) {
+	at := reading.RecordedAt
+	if state.seen && state.registered != reading.Registered {
+		state.changes = append(state.changes, at)
+		logger.WithField("registration", reading.Registration).Info("Modem registration changed")
+	}
+	state.seen = true
+	state.registered = reading.Registered
+
+	recent := state.changes[:0]
+	for _, t := range state.changes {
+		if at.Sub(t) < m.opts.FlapWindow {
+			recent = append(recent, t)
+		}
+	}
+	state.changes = recent
+
+	switch {
+	case len(state.changes) >= m.opts.FlapChanges && state.flapAlarm != alarmRaised:
+		state.flapAlarm = alarmRaised
+		m.raise(ctx, logger, modemID, models.AlertKindModemRegistrationFlap,
+			fmt.Sprintf("%s changed network registration %d times in %s", name, len(state.changes), m.opts.FlapWindow),
+			map[string]interface{}{"dongle": name, "changes": len(state.changes), "registration": reading.Registration})
+	case len(state.changes) == 0 && state.flapAlarm != alarmClear:
+		state.flapAlarm = alarmClear
+		m.resolve(ctx, logger, modemID, models.AlertKindModemRegistrationFlap)
+	}
+}
+
+func (m *RadioMonitor) raise(ctx context.Context, logger *logrus.Entry, modemID int, kind, message string, details map[string]interface{}) {
+	logger.WithField("alert", kind).Warn(message)
+	encoded, _ := json.Marshal(details)
+	alert := &models.Alert{
+		Kind:       kind,
+		Severity:   models.AlertSeverityWarning,
+		EntityType: models.AlertEntityModem,
+		EntityID:   strconv.Itoa(modemID),
+		Message:    message,
+		Details:    encoded,
+	}
+	if err := m.alertRepo.RaiseAlert(ctx, alert); err != nil {
+		logger.WithError(err).Error("Failed to raise alert")
+	}
+}
+
+func (m *RadioMonitor) resolve(ctx context.Context, logger *logrus.Entry, modemID int, kind string) {
+	if err := m.alertRepo.ResolveAlerts(ctx, kind, models.AlertEntityModem, strconv.Itoa(modemID)); err != nil {
+		logger.WithError(err).Error("Failed to resolve alert")
+	}
+}
+
+// prune deletes readings past the retention, at most once per pruneInterval.
+func (m *RadioMonitor) prune(ctx context.Context) {
+	if m.opts.Retention <= 0 || time.Since(m.prunedAt) < pruneInterval {
+		return
+	}
+	m.prunedAt = time.Now()
+	deleted, err := m.radioRepo.DeleteReadingsBefore(ctx, time.Now().Add(-m.opts.Retention))
+	if err != nil {
+		m.logger.WithError(err).Warn("Failed to prune radio readings")
+		return
+	}
+	if deleted > 0 {
+		m.logger.Infof("Pruned %d radio reading(s)", deleted)
+	}
+}
+
+// isRegistered reports whether a chan_dongle GSMRegistrationStatus means
+// the modem is on the network ("Registered, home network", "Registered,
+// roaming").
+func isRegistered(status string) bool {
+	return strings.HasPrefix(strings.ToLower(status), "registered")
+}
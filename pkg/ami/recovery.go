@@ -0,0 +1,50 @@
+package ami
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+)
+
+// DongleRecoverer resets and restarts modems through the chan_dongle of
+// their gateway. It implements modem.Recoverer.
+type DongleRecoverer struct {
+	manager *GatewayManager
+}
+
+// NewDongleRecoverer creates a DongleRecoverer for the gateways of manager.
+func NewDongleRecoverer(manager *GatewayManager) *DongleRecoverer {
+	return &DongleRecoverer{manager: manager}
+}
+
+// ResetModem makes chan_dongle reset the modem (AT+CFUN=1,1).
+func (r *DongleRecoverer) ResetModem(ctx context.Context, m *models.Modem) error {
+	session, device, err := r.session(m)
+	if err != nil {
+		return err
+	}
+	return session.DongleReset(ctx, device)
+}
+
+// RestartModem makes chan_dongle close and reopen the modem's ports.
+func (r *DongleRecoverer) RestartModem(ctx context.Context, m *models.Modem) error {
+	session, device, err := r.session(m)
+	if err != nil {
+		return err
+	}
+	return session.DongleRestart(ctx, device, "now")
+}
+
+// session returns the connected AMI session driving a modem and the modem's
+// chan_dongle device name.
+func (r *DongleRecoverer) session(m *models.Modem) (*AMIService, string, error) {
+	if m.GatewayID == nil || m.DongleName == nil {
+		return nil, "", fmt.Errorf("modem %d has no gateway or dongle name", m.ID)
+	}
+	session, ok := r.manager.Session(*m.GatewayID)
+	if !ok || !session.Connected() {
+		return nil, "", fmt.Errorf("gateway %s of modem %d is not connected", *m.GatewayID, m.ID)
+	}
+	return session, *m.DongleName, nil
+}
@@ -3,26 +3,42 @@ package ami
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net" // Added import
+	"net"    // Added import
 	"regexp" // Added import
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami/amirecord"
 	cfg "github.com/e173-gateway/e173_go_gateway/pkg/config"
 	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
 	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
 	"github.com/sirupsen/logrus"
 	goami2 "github.com/staskobzar/goami2"
 )
 
-const (
-	reconnectDelay = 5 * time.Second
-)
+const heartbeatInterval = 30 * time.Second
+
+// eventQueueSize is how many dongle, SMS and USSD events, or CDRs, may wait
+// for the database before the read loop waits too. A DongleShowDevices reply
+// on a full rack stays well below it.
+const eventQueueSize = 512
 
 var (
+	// Backoff between reconnect attempts; variables so tests can shorten it.
+	reconnectDelay    = 5 * time.Second
+	maxReconnectDelay = 2 * time.Minute
+
+	// drainTimeout is how long Stop lets the queued database work run. CDRs
+	// still queued after it are spooled to the outbox without a write.
+	drainTimeout = 10 * time.Second
+
 	// Example: Dongle/dongle0-0100000000 or DAHDI/i1/12345-1
 	// This regex attempts to capture the device name (e.g., "dongle0", "i1")
 	channelDeviceRegex = regexp.MustCompile(`^(?:Dongle|DAHDI)/([^/-]+)`)
@@ -50,89 +66,336 @@ func parseOptionalInt64(valStr string) *int64 {
 	return nil
 }
 
+// StatusFunc is called whenever the AMI connection of a service changes state.
+// status is one of the models.GatewayStatus* values; err is the reason for an
+// error status and nil otherwise.
+type StatusFunc func(gatewayID, status string, err error)
+
+// amiEndpoint is the address and credentials of one Asterisk Manager Interface.
+type amiEndpoint struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
 // AMIService handles the connection to Asterisk Manager Interface
-// and processes events to generate Call Detail Records (CDRs).
+// and processes events to generate Call Detail Records (CDRs) and keep the
+// gateway's chan_dongle modems and SIM cards up to date.
 type AMIService struct {
-	config         *cfg.AppConfig
+	gatewayID      string // empty when connected from AppConfig rather than a gateways row
+	gatewayName    string
+	endpoint       amiEndpoint
 	amiClient      *goami2.Client // Changed AMIClient to Client
 	cdrRepo        repository.CdrRepository
-	logger         *logrus.Logger
+	cdrOutbox      *CDROutbox // nil loses CDRs the database rejects
+	calls          *callTracker
+	actions        *actionCorrelator
+	dongles        *dongleInventory // nil when modem/SIM tracking is disabled
+	dongleEnds     *dongleCallEnds
+	health         *modem.HealthMonitor // nil if modem health is not tracked
+	smsService     *sms.Service         // nil ignores text messages
+	ussdService    *ussd.Service        // nil ignores USSD responses
+	ussdStatus     map[string]int       // +CUSD status of the USSD response being received, by dongle
+	work           chan func()          // database work of dongle, SMS and USSD events, done in order by runWork
+	cdrWork        chan func()          // CDRs to write, apart so that slow modem writes do not hold them up
+	workCtx        context.Context      // of the queued work; outlives ctx so Stop can drain the queues
+	workCancel     context.CancelFunc
+	listening      sync.WaitGroup // the connect and read loop
+	working        sync.WaitGroup // the runWork of both queues
+	stopOnce       sync.Once
+	logger         *logrus.Entry
+	onStatus       StatusFunc
+	recordDir      string // empty disables recording
 	mu             sync.Mutex
 	connected      bool
+	connectedAt    time.Time
 	lastEventTime  time.Time
 	reconnectMutex sync.Mutex
 	ctx            context.Context
 	cancel         context.CancelFunc
 }
 
-// NewAMIService creates a new AMIService.
+// NewAMIService creates a new AMIService for the Asterisk configured in AppConfig.
 func NewAMIService(appConfig *cfg.AppConfig, cdrRepo repository.CdrRepository, logger *logrus.Logger) (*AMIService, error) {
+	endpoint := amiEndpoint{
+		Host:     appConfig.AsteriskAMIHost,
+		Port:     appConfig.AsteriskAMIPort,
+		Username: appConfig.AsteriskAMIUser,
+		Password: appConfig.AsteriskAMIPass,
+	}
+	return newAMIService("", endpoint, cdrRepo, logrus.NewEntry(logger)), nil
+}
+
+// NewGatewayAMIService creates an AMIService for a remote gateway. CDRs it
+// writes are tagged with the gateway's ID, and when modemRepo and simCardRepo
+// are given its chan_dongle devices are kept up to date in the database.
+func NewGatewayAMIService(gateway *models.Gateway, cdrRepo repository.CdrRepository, modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository, logger *logrus.Logger) *AMIService {
+	s := newAMIService(gateway.ID, endpointFor(gateway), cdrRepo, logger.WithFields(logrus.Fields{
+		"gateway_id":   gateway.ID,
+		"gateway_name": gateway.Name,
+	}))
+	s.gatewayName = gateway.Name
+	if modemRepo != nil && simCardRepo != nil {
+		s.dongles = newDongleInventory(gateway.ID, modemRepo, simCardRepo, s.logger)
+	}
+	return s
+}
+
+func newAMIService(gatewayID string, endpoint amiEndpoint, cdrRepo repository.CdrRepository, logger *logrus.Entry) *AMIService {
 	ctx, cancel := context.WithCancel(context.Background())
+	workCtx, workCancel := context.WithCancel(context.Background())
 	return &AMIService{
-		config:  appConfig,
-		cdrRepo: cdrRepo,
-		logger:  logger,
-		ctx:     ctx,
-		cancel:  cancel,
-	}, nil
+		gatewayID:  gatewayID,
+		endpoint:   endpoint,
+		cdrRepo:    cdrRepo,
+		calls:      newCallTracker(),
+		dongleEnds: newDongleCallEnds(),
+		actions:    newActionCorrelator(),
+		work:       make(chan func(), eventQueueSize),
+		cdrWork:    make(chan func(), eventQueueSize),
+		logger:     logger,
+		ctx:        ctx,
+		cancel:     cancel,
+		workCtx:    workCtx,
+		workCancel: workCancel,
+	}
+}
+
+// endpointFor returns the AMI endpoint of a gateway, defaulting the port.
+func endpointFor(gateway *models.Gateway) amiEndpoint {
+	port := gateway.AMIPort
+	if port == "" {
+		port = "5038"
+	}
+	return amiEndpoint{
+		Host:     gateway.AMIHost,
+		Port:     port,
+		Username: gateway.AMIUser,
+		Password: gateway.AMIPass,
+	}
+}
+
+// SetStatusHandler registers fn to be called on connection state changes.
+// It must be called before Start.
+func (s *AMIService) SetStatusHandler(fn StatusFunc) {
+	s.onStatus = fn
+}
+
+// SetRecordDir makes the service record every AMI message it receives to a
+// new amirecord file in dir per connection, for replay through amitest.
+// It must be called before Start.
+func (s *AMIService) SetRecordDir(dir string) {
+	s.recordDir = dir
+}
+
+// SetCDROutbox makes the service spool CDRs it fails to write to outbox
+// instead of dropping them. It must be called before Start.
+func (s *AMIService) SetCDROutbox(outbox *CDROutbox) {
+	s.cdrOutbox = outbox
+}
+
+// SetHealthMonitor makes the service feed chan_dongle state changes and the
+// outcome of calls through its modems to health. It must be called before
+// Start.
+func (s *AMIService) SetHealthMonitor(health *modem.HealthMonitor) {
+	s.health = health
+	if s.dongles != nil {
+		s.dongles.health = health
+	}
+}
+
+// SetSMSService makes the service hand the text messages its dongles
+// receive, and the status of those they send, to service. It must be called
+// before Start.
+func (s *AMIService) SetSMSService(service *sms.Service) {
+	s.smsService = service
+}
+
+// SetUSSDService makes the service hand the USSD responses its dongles
+// receive to service. It must be called before Start.
+func (s *AMIService) SetUSSDService(service *ussd.Service) {
+	s.ussdService = service
+}
+
+// GatewayID returns the ID of the gateway this service is connected to.
+func (s *AMIService) GatewayID() string {
+	return s.gatewayID
+}
+
+// Connected reports whether the service is currently logged in to AMI.
+func (s *AMIService) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// LastEventTime returns when the last AMI message was received.
+func (s *AMIService) LastEventTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastEventTime
+}
+
+// client returns the current AMI client, or nil while disconnected.
+func (s *AMIService) client() *goami2.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.amiClient
+}
+
+// setConnected records a connection state change and reports it to the
+// status handler. Nothing is reported once the service has been stopped.
+func (s *AMIService) setConnected(connected bool, err error) {
+	s.mu.Lock()
+	s.connected = connected
+	if connected {
+		s.connectedAt = time.Now()
+	}
+	s.mu.Unlock()
+
+	if s.onStatus == nil || s.ctx.Err() != nil {
+		return
+	}
+	status := models.GatewayStatusOnline
+	if !connected {
+		status = models.GatewayStatusError
+	}
+	s.onStatus(s.gatewayID, status, err)
 }
 
 // Start initiates the AMI connection and event processing loop.
+// Lost connections are retried with exponential backoff.
 func (s *AMIService) Start() {
 	s.logger.Info("Starting AMIService...")
+	s.working.Add(2)
+	go s.runWork(s.work)
+	go s.runWork(s.cdrWork)
+	s.listening.Add(1)
 	go func() {
+		defer s.listening.Done()
+		delay := reconnectDelay
 		for {
+			if s.ctx.Err() != nil {
+				s.logger.Info("AMIService shutting down.")
+				return
+			}
+
+			attemptAt := time.Now()
+			err := s.connectAndListen()
+			s.mu.Lock()
+			if s.amiClient != nil {
+				s.amiClient.Close()
+				s.amiClient = nil
+			}
+			s.mu.Unlock()
+			s.actions.failAll(ErrConnectionLost)
+			if s.ctx.Err() != nil {
+				s.logger.Info("AMIService shutting down.")
+				return
+			}
+			s.setConnected(false, err)
+
+			// A session that got as far as logging in resets the backoff.
+			s.mu.Lock()
+			if s.connectedAt.After(attemptAt) {
+				delay = reconnectDelay
+			}
+			s.mu.Unlock()
+
+			s.logger.Errorf("AMI connection or listener error: %v. Reconnecting in %s...", err, delay)
 			select {
 			case <-s.ctx.Done():
 				s.logger.Info("AMIService shutting down.")
-				if s.amiClient != nil {
-					s.amiClient.Close()
-				}
 				return
-			default:
-				err := s.connectAndListen()
-				if err != nil {
-					s.logger.Errorf("AMI connection or listener error: %v. Reconnecting in %s...", err, reconnectDelay)
-					if s.amiClient != nil {
-						s.amiClient.Close()
-						s.amiClient = nil
-					}
-					time.Sleep(reconnectDelay)
-				} else {
-					s.logger.Info("connectAndListen returned without error (likely due to context cancellation), AMIService stopping.")
-					return
-				}
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
 			}
 		}
 	}()
 }
 
-// Stop gracefully shuts down the AMIService.
+// Stop gracefully shuts down the AMIService. It stops reading events, then
+// waits for the queued database work; CDRs that cannot be written within
+// drainTimeout are spooled to the outbox. Calling Stop again does nothing.
 func (s *AMIService) Stop() {
-	s.logger.Info("Stopping AMIService...")
-	s.cancel()
+	s.stopOnce.Do(func() {
+		s.logger.Info("Stopping AMIService...")
+		s.cancel()
+		// Nothing is queued once the read loop has returned.
+		s.listening.Wait()
+		close(s.work)
+		close(s.cdrWork)
+
+		drained := make(chan struct{})
+		go func() {
+			s.working.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(drainTimeout):
+			s.logger.Warnf("Queued AMI work not done within %s, giving up on the database", drainTimeout)
+			s.workCancel()
+			<-drained
+		}
+		s.workCancel()
+	})
 }
 
 func (s *AMIService) connectAndListen() error {
-	amiAddress := fmt.Sprintf("%s:%s", s.config.AsteriskAMIHost, s.config.AsteriskAMIPort)
+	amiAddress := net.JoinHostPort(s.endpoint.Host, s.endpoint.Port)
 	s.logger.Infof("Attempting to connect to AMI at %s", amiAddress)
 
-	conn, err := net.DialTimeout("tcp", amiAddress, 10*time.Second)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(s.ctx, "tcp", amiAddress)
 	if err != nil {
 		return fmt.Errorf("failed to dial AMI: %w", err)
 	}
 
 	// Pass s.ctx to NewClientWithContext for graceful shutdown propagation
-	client, err := goami2.NewClientWithContext(s.ctx, conn, s.config.AsteriskAMIUser, s.config.AsteriskAMIPass)
+	client, err := goami2.NewClientWithContext(s.ctx, conn, s.endpoint.Username, s.endpoint.Password)
 	if err != nil {
 		conn.Close() // Ensure connection is closed on client creation failure
 		return fmt.Errorf("failed to create AMI client or login: %w", err)
 	}
+	s.mu.Lock()
 	s.amiClient = client
+	s.mu.Unlock()
 	s.logger.Info("Successfully connected and logged in to AMI.")
+	s.setConnected(true, nil)
+	recorder := s.openRecorder()
+	defer func() {
+		// recorder is nil once a failed write has closed it.
+		if recorder != nil {
+			recorder.Close()
+		}
+	}()
+	s.requestDongleDevices("")
+
+	inventoryTicker := time.NewTicker(inventoryInterval)
+	defer inventoryTicker.Stop()
+	sweepTicker := time.NewTicker(time.Minute)
+	defer sweepTicker.Stop()
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
 
 	for {
 		select {
+		case <-sweepTicker.C:
+			s.evictStaleCalls()
+		case <-inventoryTicker.C:
+			s.requestDongleDevices("")
+		case <-heartbeatTicker.C:
+			// A Ping both keeps NAT/firewall state alive and surfaces a dead
+			// TCP session as a write error; success refreshes LastSeen.
+			if err := s.amiClient.MustSend(goami2.NewAction("Ping").Byte()); err != nil {
+				return fmt.Errorf("AMI heartbeat failed: %w", err)
+			}
+			s.setConnected(true, nil)
 		case <-s.ctx.Done():
 			s.logger.Info("Context cancelled during listen, closing AMI client.")
 			s.amiClient.Close() // Close client on context cancellation
@@ -142,6 +405,22 @@ func (s *AMIService) connectAndListen() error {
 				s.logger.Warn("AMI AllMessages channel closed. Connection likely lost.")
 				return fmt.Errorf("AllMessages channel closed")
 			}
+			receivedAt := time.Now()
+			s.mu.Lock()
+			s.lastEventTime = receivedAt
+			s.mu.Unlock()
+			if recorder != nil {
+				if err := recorder.Record(msg, receivedAt); err != nil {
+					s.logger.WithError(err).Warn("Failed to record AMI message, recording stopped")
+					recorder.Close()
+					recorder = nil
+				}
+			}
+			// Responses to our own actions are not events; list replies are
+			// both, so their events still go through handleEvent.
+			if s.actions.deliver(msg) && msg.IsResponse() {
+				continue
+			}
 			s.handleEvent(msg)
 		case err, ok := <-s.amiClient.Err():
 			if !ok {
@@ -162,149 +441,304 @@ func (s *AMIService) connectAndListen() error {
 	}
 }
 
+// openRecorder starts a recording of the current connection, or returns nil
+// when recording is disabled or the file cannot be created.
+func (s *AMIService) openRecorder() *amirecord.Recorder {
+	if s.recordDir == "" {
+		return nil
+	}
+	prefix := s.gatewayID
+	if prefix == "" {
+		prefix = "default"
+	}
+	recorder, err := amirecord.Create(s.recordDir, prefix)
+	if err != nil {
+		s.logger.WithError(err).Warn("Failed to start AMI recording")
+		return nil
+	}
+	s.logger.Infof("Recording AMI messages to %s", recorder.Path())
+	return recorder
+}
+
 func (s *AMIService) handleEvent(msg *goami2.Message) {
 	eventName := getHeader(msg, "Event")
 	// Log relevant events, but can be noisy. Consider DEBUG level for all.
-	if eventName == "Hangup" || eventName == "Newchannel" || eventName == "Cdr" {
+	if eventName == "Hangup" || eventName == "Newchannel" {
 		s.logger.Infof("Received AMI Event: %s, UniqueID: %s, LinkedID: %s, Channel: %s",
 			eventName, getHeader(msg, "Uniqueid"), getHeader(msg, "Linkedid"), getHeader(msg, "Channel"))
 		s.logger.Debugf("Full Event Data for %s (%s): %v", eventName, getHeader(msg, "Uniqueid"), getAllHeadersAsMap(msg))
 	}
 
 	switch eventName {
-	case "Hangup":
-		s.processHangupEvent(msg)
-	// Future:
-	// case "Newchannel":
-	// s.processNewChannelEvent(msg) // To capture CallStartTime accurately
-	// case "Cdr":
-	// s.processCdrEvent(msg) // If Asterisk is configured to send full Cdr events
+	case "Newchannel", "DialBegin", "DialEnd", "Newstate", "BridgeEnter", "Hangup":
+		if call := s.calls.Handle(msg, s.eventTime(msg)); call != nil {
+			// The dongle's end cause is taken now, before a next call on the
+			// same dongle replaces it; the CDR is written by the worker.
+			_, device := callDongle(call)
+			outcome := s.dispositionFor(call, device)
+			s.enqueue(s.cdrWork, func() { s.processCompletedCall(call, outcome) })
+		}
 	default:
+		at := s.eventTime(msg)
+		if eventName == "DongleCEND" {
+			s.dongleEnds.Record(msg, at)
+		}
+		if s.smsService != nil && isSMSEvent(eventName) {
+			s.enqueue(s.work, func() {
+				ctx, cancel := context.WithTimeout(s.workCtx, 5*time.Second)
+				s.handleSMSEvent(ctx, msg, at)
+				cancel()
+			})
+		}
+		if s.ussdService != nil && isUSSDEvent(eventName) {
+			s.enqueue(s.work, func() {
+				ctx, cancel := context.WithTimeout(s.workCtx, 5*time.Second)
+				s.handleUSSDEvent(ctx, msg)
+				cancel()
+			})
+		}
+		if s.dongles != nil && isDongleEvent(eventName) {
+			s.enqueue(s.work, func() {
+				ctx, cancel := context.WithTimeout(s.workCtx, 5*time.Second)
+				device := s.dongles.Handle(ctx, msg, at)
+				cancel()
+				if device != "" {
+					s.requestDongleDevices(device)
+				}
+			})
+			return
+		}
 		// s.logger.Debugf("Unhandled AMI Event: %s, Data: %v", eventName, msg.Headers)
 	}
 }
 
-func (s *AMIService) processHangupEvent(msg *goami2.Message) {
-	uniqueID := getHeader(msg, "Uniqueid") 
-	if uniqueID == "" {
-		s.logger.Infof("Hangup event received: %+v", getAllHeadersAsMap(msg)) 
+// enqueue hands the database work of an event to the runWork of queue. When
+// the queue is full the read loop waits rather than losing the event.
+func (s *AMIService) enqueue(queue chan func(), job func()) {
+	select {
+	case queue <- job:
+		return
+	default:
+	}
+	s.logger.Warn("AMI event queue is full, waiting for the database")
+	select {
+	case queue <- job:
+	case <-s.ctx.Done():
+	}
+}
+
+// runWork does the database work queued on queue in the order it arrived,
+// so that the read loop only dispatches and a slow query does not make
+// goami2 drop messages. It returns once Stop has closed queue and the work
+// left on it is done.
+func (s *AMIService) runWork(queue chan func()) {
+	defer s.working.Done()
+	for job := range queue {
+		job()
+	}
+}
+
+// requestDongleDevices asks chan_dongle to report the state of one device, or
+// of all devices when device is empty. The replies arrive as DongleDeviceEntry
+// events. Nothing is sent while logged out.
+func (s *AMIService) requestDongleDevices(device string) {
+	client := s.client()
+	if s.dongles == nil || client == nil {
 		return
 	}
-	s.logger.Infof("Processing Hangup event for UniqueID: %s", uniqueID)
+	action := goami2.NewAction("DongleShowDevices")
+	action.AddActionID()
+	if device != "" {
+		action.AddField("Device", device)
+	}
+	if err := client.MustSend(action.Byte()); err != nil {
+		s.logger.WithError(err).Warn("Failed to request chan_dongle device list")
+	}
+}
 
-	// --- Critical Identifiers (often need dialplan setup) ---
-	var modemIDForCdr, simCardIDForCdr *int
+// evictStaleCalls drops calls whose Hangup was never seen so the tracker does
+// not grow without bound across AMI reconnects.
+func (s *AMIService) evictStaleCalls() {
+	for _, call := range s.calls.EvictStale(time.Now().UTC(), maxCallAge) {
+		s.logger.Warnf("Evicting call %s with %d leg(s) started at %s: no Hangup received within %s",
+			call.LinkedID, len(call.Legs), call.StartTime.Format(time.RFC3339), maxCallAge)
+	}
+}
 
-	// ModemID: Can be inferred from channel or set as a variable e.g., CDR(modem_id) or DONGLE_NAME
-	rawModemIDStr := getHeader(msg, "CDR(modem_id)") 
-	if rawModemIDStr == "" {
-		rawModemIDStr = getHeader(msg, "DONGLE_NAME") 
+// callDongle returns the Hangup event of a call's chan_dongle leg and the
+// dongle's name. Without a dongle leg it returns the originator's Hangup
+// and a name only if the dialplan set one.
+func callDongle(call *trackedCall) (*goami2.Message, string) {
+	var deviceMsg *goami2.Message
+	if origin := call.Originator(); origin != nil {
+		deviceMsg = origin.Hangup
 	}
-	if rawModemIDStr == "" { // Fallback: try to parse from channel string
-		channel := getHeader(msg, "Channel") 
-		matches := channelDeviceRegex.FindStringSubmatch(channel)
-		if len(matches) > 1 {
-			rawModemIDStr = matches[1] // Get the string value
-			s.logger.Debugf("CDR for %s: Inferred ModemID string '%s' from Channel '%s'", uniqueID, rawModemIDStr, channel)
+	device := ""
+	// The dongle may be on either leg: the originator for inbound GSM calls,
+	// the dialled channel for outbound ones.
+	for _, leg := range call.OrderedLegs() {
+		if matches := channelDeviceRegex.FindStringSubmatch(leg.Channel); leg.Hangup != nil && len(matches) > 1 {
+			deviceMsg = leg.Hangup
+			device = matches[1]
+			break
 		}
 	}
-	modemIDForCdr = parseOptionalInt(rawModemIDStr)
-	if modemIDForCdr == nil && rawModemIDStr != "" { 
-		s.logger.Warnf("CDR for %s: Failed to parse ModemID string '%s' as int64.", uniqueID, rawModemIDStr)
-	} else if modemIDForCdr == nil {
-		s.logger.Warnf("CDR for %s: ModemID is missing or unparsable. Ensure 'CDR(modem_id)', 'DONGLE_NAME', or channel name part is a valid int64 string.", uniqueID)
+	if deviceMsg == nil {
+		return nil, device
 	}
+	// The dialplan may name the dongle and SIM explicitly, e.g. for calls
+	// bridged through Local channels.
+	return deviceMsg, firstNonEmpty(getVariable(deviceMsg, "DONGLE_NAME"), device)
+}
 
-	// SIMCardID: Best sourced from a channel variable set in dialplan e.g., CDR(sim_iccid) or SIM_ICCID
-	rawSimCardIDStr := getHeader(msg, "CDR(sim_iccid)") 
-	if rawSimCardIDStr == "" {
-		rawSimCardIDStr = getHeader(msg, "SIM_ICCID") 
+// processCompletedCall turns a fully hung-up call into a single CDR. outcome
+// is what dispositionFor gathered when the call ended.
+func (s *AMIService) processCompletedCall(call *trackedCall, outcome dispositionInput) {
+	origin := call.Originator()
+	if origin == nil || origin.Hangup == nil {
+		s.logger.Warnf("Completed call %s has no originating Hangup event, skipping CDR", call.LinkedID)
+		return
 	}
-	simCardIDForCdr = parseOptionalInt(rawSimCardIDStr)
-	if simCardIDForCdr == nil && rawSimCardIDStr != "" { 
-		s.logger.Warnf("CDR for %s: Failed to parse SimCardID string '%s' as int64.", uniqueID, rawSimCardIDStr)
-	} else if simCardIDForCdr == nil {
-		s.logger.Warnf("CDR for %s: SIMCardID is missing or unparsable. Ensure 'CDR(sim_iccid)' or 'SIM_ICCID' is a valid int64 string.", uniqueID)
+	msg := origin.Hangup
+	uniqueID := origin.UniqueID
+	s.logger.Infof("Processing completed call for UniqueID: %s (%d leg(s))", uniqueID, len(call.Legs))
+
+	// --- Modem and SIM ---
+	deviceMsg, device := callDongle(call)
+	iccid := firstNonEmpty(getVariable(deviceMsg, "CDR(sim_iccid)"), getVariable(deviceMsg, "SIM_ICCID"))
+	modemIDForCdr, simCardIDForCdr := s.resolveDongle(device, iccid)
+	// An explicit numeric CDR(modem_id) set in the dialplan wins.
+	if id := parseOptionalInt(getVariable(deviceMsg, "CDR(modem_id)")); id != nil {
+		modemIDForCdr = id
+	}
+	if (device != "" || iccid != "") && (modemIDForCdr == nil || simCardIDForCdr == nil) {
+		s.logger.Warnf("CDR for %s: could not fully resolve dongle %q / ICCID %q (modem found: %t, SIM found: %t)",
+			uniqueID, device, iccid, modemIDForCdr != nil, simCardIDForCdr != nil)
 	}
 
 	// --- Call Timings ---
-	callStartTimeStr := getHeader(msg, "CDR(start)") 
-	callStartTime := parseAMITime(callStartTimeStr, s.logger)
-	if callStartTime.IsZero() {
-		s.logger.Warnf("CDR for %s: CallStartTime is MISSING or invalid from CDR(start). This CDR will be inaccurate. Event Timestamp (Hangup Time): %s", uniqueID, getHeader(msg, "Timestamp")) 
-	}
-	callEndTime := parseAMITime(getHeader(msg, "Timestamp"), s.logger) 
+	// Taken from the tracked channel events rather than dialplan variables.
+	callStartTime := call.StartTime
+	callEndTime := call.EndTime
 
 	// --- Durations ---
-	var durationSeconds, billableDurationSeconds *int
-	if priorityStr := getHeader(msg, "Priority"); priorityStr != "" { 
-		if val, err := strconv.ParseInt(priorityStr, 10, 0); err == nil { 
-			parsedVal := int(val)
-			durationSeconds = &parsedVal
-		} else {
-			s.logger.Warnf("CDR for %s: Failed to parse Priority (duration) '%s': %v", uniqueID, priorityStr, err)
-		}
+	durationSeconds := int(callEndTime.Sub(callStartTime).Seconds())
+	if durationSeconds < 0 {
+		durationSeconds = 0
 	}
-	if billableSecondsStr := getHeader(msg, "BillableSeconds"); billableSecondsStr != "" { 
-		if val, err := strconv.ParseInt(billableSecondsStr, 10, 0); err == nil { 
-			parsedVal := int(val)
-			billableDurationSeconds = &parsedVal
-		} else {
-			s.logger.Warnf("CDR for %s: Failed to parse BillableSeconds '%s': %v", uniqueID, billableSecondsStr, err)
+	billableDurationSeconds := 0
+	if call.AnswerTime != nil {
+		billableDurationSeconds = int(callEndTime.Sub(*call.AnswerTime).Seconds())
+		if billableDurationSeconds < 0 {
+			billableDurationSeconds = 0
 		}
 	}
 
+	var postDialDelayMs *int
+	if pdd := call.PostDialDelay(); pdd != nil {
+		postDialDelayMs = models.IntPtr(int(pdd.Milliseconds()))
+	}
+
 	// --- Disposition ---
-	disposition := determineDisposition(msg) 
+	category := normalizeDisposition(outcome)
+	disposition := legacyDisposition(category)
+	if s.health != nil && modemIDForCdr != nil && category != models.DispositionCategoryCancelled {
+		s.health.Observe(modem.HealthEvent{
+			ModemID: *modemIDForCdr,
+			Kind:    modem.HealthEventCallResult,
+			Failed:  modemCallFailure(category),
+			Detail:  category,
+			At:      call.EndTime,
+		})
+	}
+
+	destination := firstNonEmpty(call.Destination, origin.Exten, getHeader(msg, "ConnectedLineNum"))
 
 	// Marshal all event fields to JSON for RawEventData
 	var rawEventDataJSON []byte
 	rawEventFields := getAllHeadersAsMap(msg)
-	if len(rawEventFields) > 0 { 
+	if len(rawEventFields) > 0 {
 		var err error
 		rawEventDataJSON, err = json.Marshal(rawEventFields)
 		if err != nil {
 			s.logger.Warnf("CDR for %s: Failed to marshal raw event data to JSON: %v", uniqueID, err)
 		}
-	} // Corrected brace placement
+	}
 
 	cdr := &models.Cdr{
 		UniqueID:            uniqueID,
-		Channel:             models.StringPtr(getHeader(msg, "Channel")), 
-		CallerIDNum:         models.StringPtr(getHeader(msg, "CallerIDNum")), 
-		CallerIDName:        models.StringPtr(getHeader(msg, "CallerIDName")), 
-		ConnectedLineNum:    models.StringPtr(getHeader(msg, "ConnectedLineNum")), 
-		ConnectedLineName:   models.StringPtr(getHeader(msg, "ConnectedLineName")), 
-		AccountCode:         models.StringPtr(getHeader(msg, "AccountCode")), 
-		Cause:               models.StringPtr(getHeader(msg, "Cause")), 
-		CauseTxt:            models.StringPtr(getHeader(msg, "CauseTxt")), 
+		Channel:             models.StringPtr(origin.Channel),
+		CallerIDNum:         models.StringPtr(origin.CallerIDNum),
+		CallerIDName:        models.StringPtr(origin.CallerIDName),
+		ConnectedLineNum:    models.StringPtr(destination),
+		ConnectedLineName:   models.StringPtr(getHeader(msg, "ConnectedLineName")),
+		AccountCode:         models.StringPtr(origin.AccountCode),
+		Cause:               models.StringPtr(getHeader(msg, "Cause")),
+		CauseTxt:            models.StringPtr(getHeader(msg, "Cause-txt")),
 		Disposition:         getOptionalString(disposition),
+		DispositionCategory: models.StringPtr(category),
 		StartTime:           &callStartTime,
-		AnswerTime:          nil,
+		AnswerTime:          call.AnswerTime,
 		EndTime:             &callEndTime,
-		Duration:            durationSeconds,
-		BillableSeconds:     billableDurationSeconds,
+		Duration:            &durationSeconds,
+		BillableSeconds:     &billableDurationSeconds,
+		PostDialDelayMs:     postDialDelayMs,
+		GatewayID:           models.StringPtr(s.gatewayID),
 		ModemID:             modemIDForCdr,
 		SimCardID:           simCardIDForCdr,
-		CallDirection:       getOptionalString(determineCallDirection(msg, s.logger)), 
+		CallDirection:       getOptionalString(determineCallDirection(msg, call, s.logger)),
 		IsSpam:              new(bool),
-		Context:             models.StringPtr(getHeader(msg, "Context")), 
-		Extension:           models.StringPtr(getHeader(msg, "Exten")), 
-		Priority:            parseOptionalInt(getHeader(msg, "Priority")), 
+		Context:             models.StringPtr(origin.Context),
+		Extension:           models.StringPtr(origin.Exten),
+		Priority:            parseOptionalInt(getHeader(msg, "Priority")),
 		RawEventData:        rawEventDataJSON,
 	}
 
 	// Log the populated CDR before saving
 	s.logger.Debugf("Populated CDR for %s: %+v", uniqueID, cdr)
 
-	err := s.cdrRepo.CreateCdr(s.ctx, cdr)
+	ctx, cancel := context.WithTimeout(s.workCtx, 5*time.Second)
+	err := s.cdrRepo.CreateCdr(ctx, cdr)
+	cancel()
+	if errors.Is(err, repository.ErrDuplicate) {
+		s.logger.Warnf("CDR for UniqueID %s was already recorded, skipping", uniqueID)
+		return
+	}
 	if err != nil {
-		s.logger.Errorf("Failed to create CDR for UniqueID %s: %v", uniqueID, err)
+		if s.cdrOutbox == nil {
+			s.logger.Errorf("Failed to create CDR for UniqueID %s: %v", uniqueID, err)
+			return
+		}
+		if spoolErr := s.cdrOutbox.Spool(cdr, err); spoolErr != nil {
+			s.logger.Errorf("Failed to create CDR for UniqueID %s: %v; spooling it failed too, CDR lost: %v", uniqueID, err, spoolErr)
+			return
+		}
+		s.logger.Warnf("Failed to create CDR for UniqueID %s, spooled to the outbox for replay: %v", uniqueID, err)
 		return
 	}
 	s.logger.Infof("Successfully created CDR for UniqueID %s (DB ID: %s)", uniqueID, cdr.ID)
 }
 
+// resolveDongle maps a chan_dongle device name and/or ICCID to modems.id and
+// sim_cards.id. Both are nil when modem tracking is disabled.
+func (s *AMIService) resolveDongle(device, iccid string) (*int, *int) {
+	if s.dongles == nil || (device == "" && iccid == "") {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(s.workCtx, 5*time.Second)
+	defer cancel()
+	return s.dongles.identities.Resolve(ctx, device, iccid)
+}
+
+// eventTime returns the event's Timestamp header (present when manager.conf
+// has timestampevents=yes), or the local receive time otherwise.
+func (s *AMIService) eventTime(msg *goami2.Message) time.Time {
+	if ts := parseAMITime(getHeader(msg, "Timestamp"), s.logger); !ts.IsZero() {
+		return ts
+	}
+	return time.Now().UTC()
+}
+
 func getOptionalString(value string) *string {
 	if value == "" {
 		return nil
@@ -312,7 +746,7 @@ func getOptionalString(value string) *string {
 	return &value
 }
 
-func parseAMITime(timestampStr string, logger *logrus.Logger) time.Time { // Changed logger type
+func parseAMITime(timestampStr string, logger logrus.FieldLogger) time.Time { // Changed logger type
 	if timestampStr == "" {
 		return time.Time{}
 	}
@@ -325,45 +759,49 @@ func parseAMITime(timestampStr string, logger *logrus.Logger) time.Time { // Cha
 	return time.Time{}
 }
 
-func determineCallDirection(msg *goami2.Message, logger *logrus.Logger) string { // Changed logger type
+func determineCallDirection(msg *goami2.Message, call *trackedCall, logger logrus.FieldLogger) string { // Changed logger type
 	// This is highly dependent on your dialplan.
-	// Examples:
-	// - Check if CDR(direction) variable is set.
-	// - Check channel name patterns (e.g., if Channel starts with "SIP/your_trunk_provider" it's likely Inbound).
-	// - Check dialplan context (e.g., Context "from-pstn" vs "from-internal").
 	// CDR(direction) is the most reliable if set consistently.
-	if direction := getHeader(msg, "CDR(direction)"); direction != "" {
+	if direction := getVariable(msg, "CDR(direction)"); direction != "" {
 		return strings.ToLower(direction) // e.g., "inbound", "outbound"
 	}
+	// Otherwise infer it from where the dongle sits in the call: a dongle
+	// originating the call is a GSM call coming in, a dialled dongle is going out.
+	for i, leg := range call.OrderedLegs() {
+		if channelDeviceRegex.MatchString(leg.Channel) {
+			if i == 0 {
+				return models.CallDirectionInbound
+			}
+			return models.CallDirectionOutbound
+		}
+	}
 	logger.Warnf("Call direction for UniqueID %s is 'unknown'. Set CDR(direction) in dialplan for accuracy.", getHeader(msg, "Uniqueid"))
 	return models.CallDirectionUnknown // Default from models
 }
 
-func determineDisposition(msg *goami2.Message) string {
-	// AMAFlags: 0 = UNKNOWN, 1 = ANSWERED, 2 = NOANSWER, 3 = BUSY
-	// (Note: Some docs say DOCUMENTATION instead of UNKNOWN for 0)
-	amaFlagsStr := getHeader(msg, "AMAFlags")
-	if amaFlagsStr != "" {
-		switch amaFlagsStr {
-		case "1":
-			return models.CallDispositionAnswered
-		case "2":
-			return models.CallDispositionNoAnswer
-		case "3":
-			return models.CallDispositionBusy
-		default:
-			// Use Cause-txt if AMAFlags is UNKNOWN or not one of the main ones
-			if causeTxt := getHeader(msg, "Cause-txt"); causeTxt != "" { // Will be replaced by getHeader
-				return causeTxt
-			}
-			return models.CallDispositionFailed // A general fallback
-		}
+// modemCallFailure reports whether a call outcome points at the modem
+// rather than the callee, the SIM or its credit.
+func modemCallFailure(category string) bool {
+	switch category {
+	case models.DispositionCategoryNetworkCongestion, models.DispositionCategoryGatewayUnavailable, models.DispositionCategoryFailed:
+		return true
 	}
-	// Fallback to Cause-txt if AMAFlags is not present
-	if causeTxt := getHeader(msg, "Cause-txt"); causeTxt != "" { // Will be replaced by getHeader
-		return causeTxt
+	return false
+}
+
+// legacyDisposition maps a disposition category to the coarse ANSWERED /
+// NO ANSWER / BUSY / FAILED values of the disposition column.
+func legacyDisposition(category string) string {
+	switch category {
+	case models.DispositionCategoryAnswered:
+		return models.CallDispositionAnswered
+	case models.DispositionCategoryBusy:
+		return models.CallDispositionBusy
+	case models.DispositionCategoryNoAnswer, models.DispositionCategoryCancelled:
+		return models.CallDispositionNoAnswer
+	default:
+		return models.CallDispositionFailed
 	}
-	return models.CallDispositionFailed // General fallback
 }
 
 // getHeader retrieves a specific header value from an AMI message.
@@ -377,6 +815,16 @@ func getHeader(msg *goami2.Message, key string) string {
 	return ""
 }
 
+// getVariable retrieves a channel variable from an AMI message. Variables are
+// sent as "ChanVariable: NAME=value" headers when listed in manager.conf
+// channelvars; a plain header of the same name is accepted as a fallback.
+func getVariable(msg *goami2.Message, name string) string {
+	if val, ok := msg.Var(name); ok {
+		return val
+	}
+	return getHeader(msg, name)
+}
+
 // getAllHeadersAsMap converts all headers from an AMI message into a map[string]string.
 func getAllHeadersAsMap(msg *goami2.Message) map[string]string {
 	headersMap := make(map[string]string)
@@ -385,4 +833,3 @@ func getAllHeadersAsMap(msg *goami2.Message) map[string]string {
 	}
 	return headersMap
 }
-
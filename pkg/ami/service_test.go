@@ -0,0 +1,596 @@
+package ami
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami/amirecord"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami/amitest"
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+// fakeCdrRepo hands every CDR written to it to a channel.
+type fakeCdrRepo struct {
+	repository.CdrRepository
+	cdrs chan *models.Cdr
+}
+
+func (r *fakeCdrRepo) CreateCdr(ctx context.Context, cdr *models.Cdr) error {
+	r.cdrs <- cdr
+	return nil
+}
+
+// fakeModemRepo keeps modems in memory, keyed by IMEI.
+type fakeModemRepo struct {
+	repository.ModemRepository
+	mu       sync.Mutex
+	byIMEI   map[string]*models.Modem
+	statuses chan string // statuses set through UpdateModemStatus
+}
+
+func newFakeModemRepo() *fakeModemRepo {
+	return &fakeModemRepo{byIMEI: make(map[string]*models.Modem), statuses: make(chan string, 16)}
+}
+
+func (r *fakeModemRepo) UpsertModemByIMEI(ctx context.Context, modem *models.Modem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.byIMEI[*modem.IMEI]; ok {
+		modem.ID = existing.ID
+	} else {
+		modem.ID = len(r.byIMEI) + 1
+	}
+	stored := *modem
+	r.byIMEI[*modem.IMEI] = &stored
+	return nil
+}
+
+func (r *fakeModemRepo) GetModemByDongleName(ctx context.Context, gatewayID *string, dongleName string) (*models.Modem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.byIMEI {
+		if m.DongleName != nil && *m.DongleName == dongleName {
+			stored := *m
+			return &stored, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (r *fakeModemRepo) UpdateModemStatus(ctx context.Context, id int, status string, lastSeenAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.byIMEI {
+		if m.ID == id {
+			if status != "" {
+				m.Status = status
+				r.statuses <- status
+			}
+			m.LastSeenAt = &lastSeenAt
+			return nil
+		}
+	}
+	return repository.ErrNotFound
+}
+
+func (r *fakeModemRepo) modem(imei string) *models.Modem {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.byIMEI[imei]; ok {
+		stored := *m
+		return &stored
+	}
+	return nil
+}
+
+// fakeSIMCardRepo keeps SIM cards in memory, keyed by ICCID.
+type fakeSIMCardRepo struct {
+	repository.SIMCardRepository
+	mu      sync.Mutex
+	byICCID map[string]*models.SIMCard
+}
+
+func (r *fakeSIMCardRepo) UpsertSIMCardFromModem(ctx context.Context, sim *models.SIMCard) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.byICCID[sim.ICCID]; ok {
+		sim.ID = existing.ID
+	} else {
+		sim.ID = int64(len(r.byICCID) + 1)
+	}
+	stored := *sim
+	r.byICCID[sim.ICCID] = &stored
+	return nil
+}
+
+func (r *fakeSIMCardRepo) GetSIMCardByModemID(ctx context.Context, modemID int64) (*models.SIMCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sim := range r.byICCID {
+		if sim.ModemID.Valid && sim.ModemID.Int64 == modemID {
+			stored := *sim
+			return &stored, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// startService connects a gateway AMIService to srv with the given password
+// and stops it when the test ends.
+func startService(t *testing.T, srv *amitest.Server, password string, cdrRepo repository.CdrRepository, modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository) *AMIService {
+	t.Helper()
+	host, port := srv.HostPort()
+	gateway := &models.Gateway{ID: "gw1", Name: "Test gateway", AMIHost: host, AMIPort: port, AMIUser: srv.Username, AMIPass: password}
+	s := NewGatewayAMIService(gateway, cdrRepo, modemRepo, simCardRepo, testLogger())
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// waitConnected waits until s has logged in, so events emitted afterwards
+// reach its listen loop rather than its login.
+func waitConnected(t *testing.T, s *AMIService) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("AMIService did not log in")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestServer(t *testing.T) *amitest.Server {
+	t.Helper()
+	srv, err := amitest.NewServer("admin", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRecordedOutboundCallGivesOneCDR(t *testing.T) {
+	srv := newTestServer(t)
+	cdrRepo := &fakeCdrRepo{cdrs: make(chan *models.Cdr, 4)}
+	s := startService(t, srv, "secret", cdrRepo, nil, nil)
+	s.Start()
+	waitConnected(t, s)
+
+	entries, err := amirecord.ReadFile("testdata/outbound_call.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Play(entries, 0)
+
+	var cdr *models.Cdr
+	select {
+	case cdr = <-cdrRepo.cdrs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no CDR written")
+	}
+	select {
+	case extra := <-cdrRepo.cdrs:
+		t.Fatalf("second CDR written for %s", extra.UniqueID)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if cdr.UniqueID != "1700000000.1" {
+		t.Errorf("UniqueID = %q, want the originating channel's", cdr.UniqueID)
+	}
+	wantAnswer := time.Unix(1700000005, 0).UTC()
+	if cdr.AnswerTime == nil || !cdr.AnswerTime.Equal(wantAnswer) {
+		t.Errorf("AnswerTime = %v, want %v", cdr.AnswerTime, wantAnswer)
+	}
+	if cdr.PostDialDelayMs == nil || *cdr.PostDialDelayMs != 2000 {
+		t.Errorf("PostDialDelayMs = %v, want 2000", cdr.PostDialDelayMs)
+	}
+	if cdr.Duration == nil || *cdr.Duration != 65 {
+		t.Errorf("Duration = %v, want 65", cdr.Duration)
+	}
+	if cdr.BillableSeconds == nil || *cdr.BillableSeconds != 60 {
+		t.Errorf("BillableSeconds = %v, want 60", cdr.BillableSeconds)
+	}
+	if cdr.DispositionCategory == nil || *cdr.DispositionCategory != models.DispositionCategoryAnswered {
+		t.Errorf("DispositionCategory = %v, want %s", cdr.DispositionCategory, models.DispositionCategoryAnswered)
+	}
+	if cdr.CallDirection == nil || *cdr.CallDirection != models.CallDirectionOutbound {
+		t.Errorf("CallDirection = %v, want %s", cdr.CallDirection, models.CallDirectionOutbound)
+	}
+	if cdr.GatewayID == nil || *cdr.GatewayID != "gw1" {
+		t.Errorf("GatewayID = %v, want gw1", cdr.GatewayID)
+	}
+}
+
+func TestRecordedAnswerBeforeBusyIsNotAnswered(t *testing.T) {
+	srv := newTestServer(t)
+	cdrRepo := &fakeCdrRepo{cdrs: make(chan *models.Cdr, 4)}
+	s := startService(t, srv, "secret", cdrRepo, nil, nil)
+	s.Start()
+	waitConnected(t, s)
+
+	// The dialplan answers the originator, e.g. for a prompt, then dials
+	// a busy number.
+	entries, err := amirecord.ReadFile("testdata/answer_before_busy.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Play(entries, 0)
+
+	var cdr *models.Cdr
+	select {
+	case cdr = <-cdrRepo.cdrs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no CDR written")
+	}
+
+	if cdr.AnswerTime != nil {
+		t.Errorf("AnswerTime = %v, want none", cdr.AnswerTime)
+	}
+	if cdr.BillableSeconds == nil || *cdr.BillableSeconds != 0 {
+		t.Errorf("BillableSeconds = %v, want 0", cdr.BillableSeconds)
+	}
+	if cdr.DispositionCategory == nil || *cdr.DispositionCategory != models.DispositionCategoryBusy {
+		t.Errorf("DispositionCategory = %v, want %s", cdr.DispositionCategory, models.DispositionCategoryBusy)
+	}
+}
+
+// statusRecorder collects the connection states reported by a service.
+type statusRecorder struct {
+	mu      sync.Mutex
+	changes []statusChange
+	notify  chan struct{}
+}
+
+type statusChange struct {
+	status string
+	at     time.Time
+}
+
+func newStatusRecorder() *statusRecorder {
+	return &statusRecorder{notify: make(chan struct{}, 64)}
+}
+
+func (r *statusRecorder) handle(gatewayID, status string, err error) {
+	r.mu.Lock()
+	r.changes = append(r.changes, statusChange{status: status, at: time.Now()})
+	r.mu.Unlock()
+	r.notify <- struct{}{}
+}
+
+// waitFor waits until n changes to status have been reported and returns
+// them.
+func (r *statusRecorder) waitFor(t *testing.T, status string, n int) []statusChange {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		r.mu.Lock()
+		var matching []statusChange
+		for _, c := range r.changes {
+			if c.status == status {
+				matching = append(matching, c)
+			}
+		}
+		r.mu.Unlock()
+		if len(matching) >= n {
+			return matching
+		}
+		select {
+		case <-r.notify:
+		case <-deadline:
+			t.Fatalf("%d of %d %s statuses reported", len(matching), n, status)
+		}
+	}
+}
+
+func shortenReconnectDelay(t *testing.T, delay, max time.Duration) {
+	savedDelay, savedMax := reconnectDelay, maxReconnectDelay
+	reconnectDelay, maxReconnectDelay = delay, max
+	t.Cleanup(func() { reconnectDelay, maxReconnectDelay = savedDelay, savedMax })
+}
+
+func TestDroppedConnectionReconnects(t *testing.T) {
+	shortenReconnectDelay(t, 50*time.Millisecond, 200*time.Millisecond)
+	srv := newTestServer(t)
+	statuses := newStatusRecorder()
+	s := startService(t, srv, "secret", &fakeCdrRepo{cdrs: make(chan *models.Cdr, 1)}, nil, nil)
+	s.SetStatusHandler(statuses.handle)
+	s.Start()
+	statuses.waitFor(t, models.GatewayStatusOnline, 1)
+
+	srv.DropClients()
+	errs := statuses.waitFor(t, models.GatewayStatusError, 1)
+	online := statuses.waitFor(t, models.GatewayStatusOnline, 2)
+	if gap := online[1].at.Sub(errs[0].at); gap < reconnectDelay {
+		t.Errorf("reconnected %s after the drop, want at least %s", gap, reconnectDelay)
+	}
+	if err := srv.WaitForClients(1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, s)
+
+	// The session got as far as logging in, so a second drop starts the
+	// backoff over rather than doubling it.
+	srv.DropClients()
+	errs = statuses.waitFor(t, models.GatewayStatusError, 2)
+	online = statuses.waitFor(t, models.GatewayStatusOnline, 3)
+	if gap := online[2].at.Sub(errs[1].at); gap >= 2*reconnectDelay+100*time.Millisecond {
+		t.Errorf("reconnected %s after the second drop, want the initial %s backoff", gap, reconnectDelay)
+	}
+	waitListening(t, srv, s)
+}
+
+// waitListening waits until s receives events on its current connection.
+// goami2 clients must not be closed, as stopping the service does, before
+// their read loop has started.
+func waitListening(t *testing.T, srv *amitest.Server, s *AMIService) {
+	t.Helper()
+	since := time.Now()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.LastEventTime().After(since) {
+		if time.Now().After(deadline) {
+			t.Fatal("AMIService receives no events")
+		}
+		srv.Emit(amitest.NewEvent("FullyBooted", "Status", "Fully Booted"))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailedLoginBacksOff(t *testing.T) {
+	shortenReconnectDelay(t, 50*time.Millisecond, 100*time.Millisecond)
+	srv := newTestServer(t)
+	statuses := newStatusRecorder()
+	s := startService(t, srv, "wrong", &fakeCdrRepo{cdrs: make(chan *models.Cdr, 1)}, nil, nil)
+	s.SetStatusHandler(statuses.handle)
+	s.Start()
+
+	errs := statuses.waitFor(t, models.GatewayStatusError, 5)
+	want := []time.Duration{50, 100, 100, 100} // doubling, capped at the maximum
+	for i, w := range want {
+		gap := errs[i+1].at.Sub(errs[i].at)
+		if gap < w*time.Millisecond {
+			t.Errorf("attempt %d came %s after the previous one, want at least %s", i+2, gap, w*time.Millisecond)
+		}
+	}
+	if gap := errs[4].at.Sub(errs[3].at); gap >= 400*time.Millisecond {
+		t.Errorf("backoff grew to %s past the %s maximum", gap, maxReconnectDelay)
+	}
+	if s.Connected() {
+		t.Error("Connected() = true after failed logins")
+	}
+}
+
+func TestDongleEventsUpsertModems(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Handle("DongleShowDevices", func(action *goami2.Message) []*goami2.Message {
+		return []*goami2.Message{
+			amitest.NewResponse(true, "Device status list will follow", "EventList", "start"),
+			amitest.NewEvent("DongleDeviceEntry",
+				"Device", "dongle0",
+				"State", "Free",
+				"RSSI", "17, -79 dBm",
+				"Manufacturer", "huawei",
+				"Model", "E173",
+				"Firmware", "11.126.85.00.209",
+				"IMEISetting", "",
+				"IMEIState", "351234567890123",
+				"IMSIState", "604001234567890",
+				"ICCID", "8921201234567890123",
+				"ProviderName", "IAM",
+				"GSMRegistrationStatus", "Registered, home network",
+				"SubscriberNumber", "+212612345678",
+				"CellID", "1A2B",
+				"LocationAreaCode", "03E8",
+			),
+			amitest.NewEvent("DongleShowDevicesComplete", "EventList", "Complete", "ListItems", "1"),
+		}
+	})
+	modems := newFakeModemRepo()
+	sims := &fakeSIMCardRepo{byICCID: make(map[string]*models.SIMCard)}
+	s := startService(t, srv, "secret", &fakeCdrRepo{cdrs: make(chan *models.Cdr, 1)}, modems, sims)
+	s.Start()
+	waitConnected(t, s)
+
+	// Logging in requests the device list.
+	deadline := time.Now().Add(5 * time.Second)
+	for modems.modem("351234567890123") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("DongleDeviceEntry did not upsert the modem")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m := modems.modem("351234567890123")
+	if m.DongleName == nil || *m.DongleName != "dongle0" {
+		t.Errorf("DongleName = %v, want dongle0", m.DongleName)
+	}
+	if m.GatewayID == nil || *m.GatewayID != "gw1" {
+		t.Errorf("GatewayID = %v, want gw1", m.GatewayID)
+	}
+	if m.Status != models.ModemStatusOnline {
+		t.Errorf("Status = %q, want %q", m.Status, models.ModemStatusOnline)
+	}
+	if m.SignalStrengthDBM == nil || *m.SignalStrengthDBM != -79 {
+		t.Errorf("SignalStrengthDBM = %v, want -79", m.SignalStrengthDBM)
+	}
+	sims.mu.Lock()
+	sim := sims.byICCID["8921201234567890123"]
+	sims.mu.Unlock()
+	if sim == nil {
+		t.Fatal("DongleDeviceEntry did not upsert the SIM card")
+	}
+	if sim.ModemID != (sql.NullInt64{Int64: int64(m.ID), Valid: true}) || sim.MSISDN.String != "+212612345678" {
+		t.Errorf("SIM card = modem %v, MSISDN %v", sim.ModemID, sim.MSISDN)
+	}
+
+	srv.Emit(amitest.NewEvent("DongleStatus", "Device", "dongle0", "Status", "Disconnect"))
+	select {
+	case status := <-modems.statuses:
+		if status != models.ModemStatusOffline {
+			t.Errorf("DongleStatus Disconnect set status %q, want %q", status, models.ModemStatusOffline)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DongleStatus did not update the modem")
+	}
+}
+
+// slowModemRepo holds every modem upsert until released, like a locked
+// modems table.
+type slowModemRepo struct {
+	*fakeModemRepo
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (r *slowModemRepo) UpsertModemByIMEI(ctx context.Context, modem *models.Modem) error {
+	select {
+	case r.entered <- struct{}{}:
+	default:
+	}
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return r.fakeModemRepo.UpsertModemByIMEI(ctx, modem)
+}
+
+func TestSlowDongleWritesDoNotHoldUpCalls(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Handle("DongleShowDevices", func(action *goami2.Message) []*goami2.Message {
+		replies := []*goami2.Message{amitest.NewResponse(true, "Device status list will follow", "EventList", "start")}
+		for i := 0; i < 40; i++ {
+			replies = append(replies, amitest.NewEvent("DongleDeviceEntry",
+				"Device", fmt.Sprintf("dongle%d", i),
+				"State", "Free",
+				"IMEIState", fmt.Sprintf("3512345678901%02d", i),
+			))
+		}
+		return append(replies, amitest.NewEvent("DongleShowDevicesComplete", "EventList", "Complete", "ListItems", "40"))
+	})
+	modems := &slowModemRepo{fakeModemRepo: newFakeModemRepo(), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	sims := &fakeSIMCardRepo{byICCID: make(map[string]*models.SIMCard)}
+	cdrRepo := &fakeCdrRepo{cdrs: make(chan *models.Cdr, 4)}
+	s := startService(t, srv, "secret", cdrRepo, modems, sims)
+	t.Cleanup(func() { close(modems.release) })
+	s.Start()
+	waitConnected(t, s)
+
+	select {
+	case <-modems.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the device list was not stored")
+	}
+	entries, err := amirecord.ReadFile("testdata/outbound_call.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Play(entries, 0)
+	select {
+	case <-cdrRepo.cdrs:
+	case <-time.After(3 * time.Second):
+		t.Fatal("no CDR while the modems table is slow")
+	}
+}
+
+// slowCdrRepo holds every CDR until the write times out.
+type slowCdrRepo struct {
+	repository.CdrRepository
+	deadlines chan time.Duration // time left to each write
+}
+
+func (r *slowCdrRepo) CreateCdr(ctx context.Context, cdr *models.Cdr) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		r.deadlines <- 0
+		return nil
+	}
+	r.deadlines <- time.Until(deadline)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSlowCDRWritesDoNotHoldUpEvents(t *testing.T) {
+	srv := newTestServer(t)
+	cdrRepo := &slowCdrRepo{deadlines: make(chan time.Duration, 4)}
+	s := startService(t, srv, "secret", cdrRepo, nil, nil)
+	s.Start()
+	waitConnected(t, s)
+
+	entries, err := amirecord.ReadFile("testdata/outbound_call.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Play(entries, 0)
+	select {
+	case left := <-cdrRepo.deadlines:
+		if left <= 0 || left > 5*time.Second {
+			t.Errorf("CDR written with %s left, want a timeout of at most 5s", left)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no CDR written")
+	}
+	// The write is still waiting; events keep being read.
+	waitListening(t, srv, s)
+}
+
+// emitCall plays a single-leg call with the given unique ID on srv.
+func emitCall(srv *amitest.Server, uniqueID string) {
+	srv.Emit(amitest.NewEvent("Newchannel", "Channel", "SIP/1001-"+uniqueID, "Uniqueid", uniqueID, "Linkedid", uniqueID,
+		"CallerIDNum", "1001", "Exten", "0612345678", "ChannelState", "4"))
+	srv.Emit(amitest.NewEvent("Hangup", "Channel", "SIP/1001-"+uniqueID, "Uniqueid", uniqueID, "Linkedid", uniqueID,
+		"Cause", "16", "Cause-txt", "Normal Clearing"))
+}
+
+func TestStopSpoolsQueuedCDRs(t *testing.T) {
+	saved := drainTimeout
+	drainTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { drainTimeout = saved })
+
+	srv := newTestServer(t)
+	cdrRepo := &slowCdrRepo{deadlines: make(chan time.Duration, 4)}
+	outbox := newTestOutbox(t, t.TempDir(), &outboxCdrRepo{down: true})
+	s := startService(t, srv, "secret", cdrRepo, nil, nil)
+	s.SetCDROutbox(outbox)
+	s.Start()
+	waitConnected(t, s)
+
+	for _, id := range []string{"1700000100.1", "1700000200.1", "1700000300.1"} {
+		emitCall(srv, id)
+	}
+	select {
+	case <-cdrRepo.deadlines:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no CDR written")
+	}
+	// The first write waits on the database; the other two are queued.
+	waitListening(t, srv, s)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+	if stats := outbox.Stats(); stats.Pending != 3 {
+		t.Errorf("%d CDRs spooled after Stop, want 3", stats.Pending)
+	}
+	// Stopping again is harmless.
+	s.Stop()
+}
@@ -0,0 +1,173 @@
+package ami
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+// DongleSMSTransport sends messages through the chan_dongle of the sending
+// SIM's gateway. It implements sms.Transport.
+type DongleSMSTransport struct {
+	manager *GatewayManager
+}
+
+// NewDongleSMSTransport creates a DongleSMSTransport for the gateways of
+// manager.
+func NewDongleSMSTransport(manager *GatewayManager) *DongleSMSTransport {
+	return &DongleSMSTransport{manager: manager}
+}
+
+// SendSMS queues a message on the sender's dongle. chan_dongle reports the
+// outcome later in a DongleSMSStatus event carrying the returned task ID.
+func (t *DongleSMSTransport) SendSMS(ctx context.Context, sender models.SMSSender, number, text string, statusReport bool) (string, *int, error) {
+	if sender.GatewayID == nil || sender.DongleName == "" {
+		return "", nil, fmt.Errorf("%w: modem %d has no gateway or dongle name", sms.ErrNoTransport, sender.ModemID)
+	}
+	session, ok := t.manager.Session(*sender.GatewayID)
+	if !ok || !session.Connected() {
+		return "", nil, fmt.Errorf("%w: gateway %s of modem %d is not connected", sms.ErrNoTransport, *sender.GatewayID, sender.ModemID)
+	}
+	taskID, err := session.DongleSendSMS(ctx, sender.DongleName, number, text, statusReport)
+	if err != nil {
+		return "", nil, err
+	}
+	return taskID, nil, nil
+}
+
+// isSMSEvent reports whether an event is about a text message.
+func isSMSEvent(eventName string) bool {
+	switch eventName {
+	case "DongleNewSMS", "DongleNewSMSBase64", "DongleSMSStatus", "DongleStatusReport":
+		return true
+	}
+	return false
+}
+
+// handleSMSEvent passes a chan_dongle message event to the SMS service:
+//
+//	DongleNewSMS        Device, From, LineCount, MessageLine0..N
+//	DongleNewSMSBase64  Device, From, Message (base64)
+//	DongleSMSStatus     Device, ID, Status (Sent or NotSent)
+//	DongleStatusReport  Device, and the report as a PDU or as fields
+func (s *AMIService) handleSMSEvent(ctx context.Context, msg *goami2.Message, at time.Time) {
+	device := getHeader(msg, "Device")
+	modemID, simID := s.dongleIDs(ctx, device)
+	logger := s.logger.WithField("dongle", device)
+
+	var err error
+	switch eventName := getHeader(msg, "Event"); eventName {
+	case "DongleNewSMS", "DongleNewSMSBase64":
+		text, ok := dongleEventText(msg, eventName == "DongleNewSMSBase64")
+		if !ok {
+			logger.Warnf("Dropping %s with undecodable text from %s", eventName, getHeader(msg, "From"))
+			return
+		}
+		encoding := modem.EncodingGSM7
+		if !modem.IsGSM7(text) {
+			encoding = modem.EncodingUCS2
+		}
+		_, err = s.smsService.Receive(ctx, sms.Inbound{
+			ModemID:    modemID,
+			SIMCardID:  simID,
+			From:       getHeader(msg, "From"),
+			Text:       text,
+			Encoding:   encoding,
+			ReceivedAt: at,
+		})
+
+	case "DongleSMSStatus":
+		status := getHeader(msg, "Status")
+		err = s.smsService.SendStatus(ctx, modemID, getHeader(msg, "ID"), status == "Sent", "chan_dongle: "+status, at)
+
+	case "DongleStatusReport":
+		report, ok := smsEventReport(msg)
+		if !ok {
+			logger.Debugf("Ignoring unparsable delivery report: %v", getAllHeadersAsMap(msg))
+			return
+		}
+		report.ModemID = modemID
+		err = s.smsService.HandleReport(ctx, report)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to process SMS event")
+	}
+}
+
+// dongleIDs returns the modem and SIM of a dongle, zero if unknown.
+func (s *AMIService) dongleIDs(ctx context.Context, device string) (int, int64) {
+	if s.dongles == nil || device == "" {
+		return 0, 0
+	}
+	id := s.dongles.identities.load(ctx, device)
+	return id.ModemID, id.SIMCardID
+}
+
+// dongleEventText returns the text of a DongleNewSMS or DongleNewUSSD
+// event, which split it into numbered lines, or of their Base64 variants.
+func dongleEventText(msg *goami2.Message, encoded bool) (string, bool) {
+	if encoded {
+		text, err := base64.StdEncoding.DecodeString(getHeader(msg, "Message"))
+		return string(text), err == nil
+	}
+	count, err := strconv.Atoi(getHeader(msg, "LineCount"))
+	if err != nil {
+		return getHeader(msg, "Message"), true
+	}
+	lines := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		lines = append(lines, getHeader(msg, "MessageLine"+strconv.Itoa(i)))
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+// smsEventReport reads a delivery report event. Builds of chan_dongle pass
+// the report either as the raw status-report PDU or already split up.
+func smsEventReport(msg *goami2.Message) (sms.DeliveryReport, bool) {
+	if pdu := firstNonEmpty(getHeader(msg, "PDU"), getHeader(msg, "Payload")); pdu != "" {
+		p, err := modem.DecodePDU(pdu)
+		if err != nil || p.Type != modem.PDUStatusReport {
+			return sms.DeliveryReport{}, false
+		}
+		ref := p.Reference
+		return sms.DeliveryReport{
+			Number:    p.Number,
+			Reference: &ref,
+			Delivered: p.Delivered(),
+			Pending:   p.Pending(),
+			Detail:    "status " + strconv.Itoa(p.Status),
+			At:        p.DischargeTime,
+		}, true
+	}
+
+	number := firstNonEmpty(getHeader(msg, "Number"), getHeader(msg, "Recipient"))
+	status := getHeader(msg, "Status")
+	if number == "" || status == "" {
+		return sms.DeliveryReport{}, false
+	}
+	report := sms.DeliveryReport{
+		Number:    number,
+		Reference: parseOptionalInt(firstNonEmpty(getHeader(msg, "Reference"), getHeader(msg, "MR"))),
+		Detail:    status,
+	}
+	if code, err := strconv.Atoi(status); err == nil {
+		report.Delivered = code < 0x20
+		report.Pending = code >= 0x20 && code < 0x40
+	} else {
+		switch strings.ToLower(status) {
+		case "delivered", "success", "ok":
+			report.Delivered = true
+		case "pending", "enroute", "en route":
+			report.Pending = true
+		}
+	}
+	return report, true
+}
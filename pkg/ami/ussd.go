@@ -0,0 +1,99 @@
+package ami
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	goami2 "github.com/staskobzar/goami2"
+)
+
+// DongleUSSDTransport sends USSD requests through the chan_dongle of the
+// modem's gateway. It implements ussd.Transport.
+type DongleUSSDTransport struct {
+	manager *GatewayManager
+}
+
+// NewDongleUSSDTransport creates a DongleUSSDTransport for the gateways of
+// manager.
+func NewDongleUSSDTransport(manager *GatewayManager) *DongleUSSDTransport {
+	return &DongleUSSDTransport{manager: manager}
+}
+
+// SendUSSD queues a request on the modem's dongle. The response arrives as
+// a DongleNewUSSD event.
+func (t *DongleUSSDTransport) SendUSSD(ctx context.Context, m *models.Modem, code string) (string, error) {
+	if m.GatewayID == nil || m.DongleName == nil {
+		return "", fmt.Errorf("modem %d has no gateway or dongle name", m.ID)
+	}
+	session, ok := t.manager.Session(*m.GatewayID)
+	if !ok || !session.Connected() {
+		return "", fmt.Errorf("gateway %s of modem %d is not connected", *m.GatewayID, m.ID)
+	}
+	return session.DongleSendUSSD(ctx, *m.DongleName, code)
+}
+
+// isUSSDEvent reports whether an event is about a USSD request.
+func isUSSDEvent(eventName string) bool {
+	switch eventName {
+	case "DongleNewCUSD", "DongleNewUSSD", "DongleNewUSSDBase64", "DongleUSSDStatus":
+		return true
+	}
+	return false
+}
+
+// handleUSSDEvent passes a chan_dongle USSD event to the USSD service:
+//
+//	DongleNewCUSD        Device, Message (the raw +CUSD value)
+//	DongleNewUSSD        Device, LineCount, MessageLine0..N
+//	DongleNewUSSDBase64  Device, Message (base64)
+//	DongleUSSDStatus     Device, ID, Status (Sent or NotSent)
+//
+// The decoded text comes from DongleNewUSSD; DongleNewCUSD, sent first,
+// tells whether the network waits for a reply.
+func (s *AMIService) handleUSSDEvent(ctx context.Context, msg *goami2.Message) {
+	device := getHeader(msg, "Device")
+	modemID, _ := s.dongleIDs(ctx, device)
+	if modemID == 0 {
+		s.logger.WithField("dongle", device).Debugf("Ignoring %s from unknown dongle", getHeader(msg, "Event"))
+		return
+	}
+
+	switch eventName := getHeader(msg, "Event"); eventName {
+	case "DongleNewCUSD":
+		if reply, err := modem.ParseCUSD(getHeader(msg, "Message")); err == nil {
+			s.mu.Lock()
+			if s.ussdStatus == nil {
+				s.ussdStatus = make(map[string]int)
+			}
+			s.ussdStatus[device] = reply.Status
+			s.mu.Unlock()
+		}
+
+	case "DongleNewUSSD", "DongleNewUSSDBase64":
+		text, ok := dongleEventText(msg, eventName == "DongleNewUSSDBase64")
+		if !ok {
+			s.logger.WithField("dongle", device).Warnf("Dropping %s with undecodable text", eventName)
+			return
+		}
+		status := ussd.StatusUnknown
+		s.mu.Lock()
+		if st, ok := s.ussdStatus[device]; ok {
+			status = st
+			delete(s.ussdStatus, device)
+		}
+		s.mu.Unlock()
+		if st, err := strconv.Atoi(getHeader(msg, "TypeInt")); err == nil {
+			status = st
+		}
+		s.ussdService.HandleReply(modemID, ussd.Reply{Status: status, Text: text})
+
+	case "DongleUSSDStatus":
+		if status := getHeader(msg, "Status"); status != "Sent" {
+			s.ussdService.HandleSendFailure(modemID, "chan_dongle: "+status)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// AlertHandler handles API requests for operator alerts.
+type AlertHandler struct {
+	alertRepo repository.AlertRepository
+	logger    *logrus.Logger
+}
+
+// NewAlertHandler creates a new instance of AlertHandler.
+func NewAlertHandler(alertRepo repository.AlertRepository, logger *logrus.Logger) *AlertHandler {
+	return &AlertHandler{
+		alertRepo: alertRepo,
+		logger:    logger,
+	}
+}
+
+// ListAlerts handles GET /api/v1/alerts. Only open alerts are returned
+// unless ?all=true.
+func (h *AlertHandler) ListAlerts(c *gin.Context) {
+	openOnly := c.Query("all") != "true"
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	alerts, err := h.alertRepo.ListAlerts(ctx, openOnly, limit)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to fetch alerts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch alerts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts, "count": len(alerts)})
+}
+
+// ResolveAlert handles POST /api/v1/alerts/:id/resolve
+func (h *AlertHandler) ResolveAlert(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := h.alertRepo.ResolveAlertByID(ctx, id); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to resolve alert %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve alert"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Alert resolved"})
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/balance"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// BalanceHandler handles API requests for the balance history of SIM cards
+// and for checking a balance on demand.
+type BalanceHandler struct {
+	simRepo repository.SIMCardRepository
+	poller  *balance.Poller
+	logger  *logrus.Logger
+}
+
+// NewBalanceHandler creates a new instance of BalanceHandler.
+func NewBalanceHandler(simRepo repository.SIMCardRepository, poller *balance.Poller, logger *logrus.Logger) *BalanceHandler {
+	return &BalanceHandler{
+		simRepo: simRepo,
+		poller:  poller,
+		logger:  logger,
+	}
+}
+
+// GetBalanceHistory handles GET /api/v1/sims/:id/balance/history
+func (h *BalanceHandler) GetBalanceHistory(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	history, err := h.simRepo.GetBalanceHistory(ctx, id, limit)
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch balance history of SIM card %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch balance history"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"sim_card_id": id,
+		"history":     history,
+		"count":       len(history),
+	})
+}
+
+// CheckBalance handles POST /api/v1/sims/:id/balance/check. A USSD check
+// returns the balance read; a check by SMS returns 202 and the balance is
+// recorded when the operator replies.
+func (h *BalanceHandler) CheckBalance(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), ussdRequestTimeout)
+	defer cancel()
+
+	reading, err := h.poller.CheckNow(ctx, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "SIM card not found"})
+		case errors.Is(err, balance.ErrNoCheck):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case errors.Is(err, balance.ErrNoModem), errors.Is(err, balance.ErrBusy), errors.Is(err, ussd.ErrNoModem):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ussd.ErrNoReply):
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+		case errors.Is(err, balance.ErrNoBalance), errors.Is(err, ussd.ErrNotSent):
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		default:
+			h.logger.WithError(err).Errorf("Failed to check balance of SIM card %d", id)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check balance"})
+		}
+		return
+	}
+	if reading == nil {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Balance requested from the operator"})
+		return
+	}
+	c.JSON(http.StatusOK, reading)
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// activeCallView is an active call with the customer it is billed to.
+type activeCallView struct {
+	ami.ActiveCall
+	CustomerID  *int64 `json:"customer_id,omitempty"`
+	SIPAccount  string `json:"sip_account,omitempty"`
+	DurationStr string `json:"duration"`
+}
+
+// CallsHandler serves the live view of calls in progress on all gateways.
+type CallsHandler struct {
+	amiManager     *ami.GatewayManager
+	sipAccountRepo repository.SIPAccountRepository
+	logger         *logrus.Logger
+}
+
+// NewCallsHandler creates a new CallsHandler. sipAccountRepo may be nil, in
+// which case calls are not matched to customers.
+func NewCallsHandler(amiManager *ami.GatewayManager, sipAccountRepo repository.SIPAccountRepository, logger *logrus.Logger) *CallsHandler {
+	return &CallsHandler{
+		amiManager:     amiManager,
+		sipAccountRepo: sipAccountRepo,
+		logger:         logger,
+	}
+}
+
+// GetActiveCalls handles GET /api/v1/calls/active
+// HTMX requests get the dashboard partial, everything else JSON.
+func (h *CallsHandler) GetActiveCalls(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	var calls []activeCallView
+	if h.amiManager != nil {
+		for _, call := range h.amiManager.ActiveCalls() {
+			calls = append(calls, h.view(ctx, call))
+		}
+	}
+
+	if c.GetHeader("HX-Request") != "true" {
+		if calls == nil {
+			calls = []activeCallView{}
+		}
+		c.JSON(http.StatusOK, gin.H{"calls": calls, "count": len(calls)})
+		return
+	}
+
+	c.Header("Content-Type", "text/html")
+	if len(calls) == 0 {
+		c.String(http.StatusOK, `
+		<div class="text-center py-8 text-gray-500 dark:text-gray-400">
+			<p class="text-sm">No active calls</p>
+		</div>`)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(`<div class="space-y-2">`)
+	for _, call := range calls {
+		writeActiveCallRow(&b, call)
+	}
+	b.WriteString(`</div>`)
+	c.String(http.StatusOK, b.String())
+}
+
+// view resolves the customer of a call: the account code set in the dialplan
+// wins, otherwise the SIP account the call came in on.
+func (h *CallsHandler) view(ctx context.Context, call ami.ActiveCall) activeCallView {
+	v := activeCallView{ActiveCall: call, DurationStr: formatCallDuration(call.Duration)}
+	if call.SIPPeer == "" || h.sipAccountRepo == nil {
+		return v
+	}
+	account, err := h.sipAccountRepo.GetSIPAccountByUsername(ctx, call.SIPPeer)
+	if err != nil {
+		if err != repository.ErrNotFound {
+			h.logger.WithError(err).WithField("sip_peer", call.SIPPeer).Debug("Failed to resolve SIP account of active call")
+		}
+		return v
+	}
+	v.CustomerID = &account.CustomerID
+	v.SIPAccount = account.AccountName
+	return v
+}
+
+func writeActiveCallRow(b *strings.Builder, call activeCallView) {
+	color, state := "amber", "Ringing"
+	if call.Answered {
+		color, state = "red", "Active"
+	}
+
+	var details []string
+	details = append(details, "Duration: "+call.DurationStr)
+	if call.GatewayName != "" {
+		details = append(details, "Gateway: "+call.GatewayName)
+	}
+	if call.Dongle != "" {
+		dongle := "Dongle: " + call.Dongle
+		if call.SIMCardID != 0 {
+			dongle += fmt.Sprintf(" (SIM #%d)", call.SIMCardID)
+		}
+		details = append(details, dongle)
+	}
+	switch {
+	case call.AccountCode != "":
+		details = append(details, "Account: "+call.AccountCode)
+	case call.CustomerID != nil:
+		details = append(details, fmt.Sprintf("Customer #%d (%s)", *call.CustomerID, call.SIPAccount))
+	}
+
+	fmt.Fprintf(b, `
+	<div class="p-3 bg-%[1]s-50 dark:bg-%[1]s-900/20 rounded-lg border border-%[1]s-200 dark:border-%[1]s-800">
+		<div class="flex items-center justify-between">
+			<div>
+				<p class="text-sm font-medium text-gray-900 dark:text-white">%[2]s → %[3]s</p>
+				<p class="text-xs text-gray-500 dark:text-gray-400">%[4]s</p>
+			</div>
+			<div class="flex items-center space-x-2">
+				<div class="w-2 h-2 bg-%[1]s-500 rounded-full animate-pulse"></div>
+				<span class="text-xs text-%[1]s-600 dark:text-%[1]s-400">%[5]s</span>
+				<button class="text-xs text-gray-500 hover:text-red-600"
+					hx-post="/api/v1/gateways/%[6]s/calls/%[7]s/hangup"
+					hx-confirm="Hang up this call?"
+					hx-swap="none">Hang up</button>
+			</div>
+		</div>
+	</div>`,
+		color,
+		html.EscapeString(orDash(call.Caller)),
+		html.EscapeString(orDash(call.Callee)),
+		html.EscapeString(strings.Join(details, " · ")),
+		state,
+		html.EscapeString(call.GatewayID),
+		html.EscapeString(call.LinkedID),
+	)
+}
+
+// formatCallDuration renders seconds as MM:SS, or H:MM:SS past an hour.
+func formatCallDuration(seconds int) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami"
+	"github.com/gin-gonic/gin"
+)
+
+// amiActionTimeout bounds admin AMI actions. List actions on a gateway with
+// many dongles take a while, so it is longer than the usual 5s.
+const amiActionTimeout = 15 * time.Second
+
+// amiSession returns the live AMI session of the gateway in the :id path
+// parameter, writing an error response when there is none.
+func (h *GatewayHandler) amiSession(c *gin.Context) (*ami.AMIService, bool) {
+	if h.amiManager == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AMI sessions are not enabled on this server"})
+		return nil, false
+	}
+	id := c.Param("id")
+	session, ok := h.amiManager.Session(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No AMI session for this gateway; it may be disabled or unknown"})
+		return nil, false
+	}
+	return session, true
+}
+
+// writeAMIError maps an AMI action error to an HTTP response.
+func (h *GatewayHandler) writeAMIError(c *gin.Context, action string, err error) {
+	h.logger.WithError(err).WithField("gateway_id", c.Param("id")).Warnf("AMI %s failed", action)
+
+	var actionErr *ami.ActionError
+	switch {
+	case errors.Is(err, ami.ErrCallNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Call is no longer active"})
+	case errors.Is(err, ami.ErrNotConnected), errors.Is(err, ami.ErrConnectionLost):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Timed out waiting for Asterisk to answer " + action})
+	case errors.As(err, &actionErr):
+		c.JSON(http.StatusBadGateway, gin.H{"error": actionErr.Message, "action": actionErr.Action})
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	}
+}
+
+// ListGatewayChannels handles GET /api/v1/gateways/:id/channels
+func (h *GatewayHandler) ListGatewayChannels(c *gin.Context) {
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	channels, err := session.CoreShowChannels(ctx)
+	if err != nil {
+		h.writeAMIError(c, "CoreShowChannels", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"channels": channels, "count": len(channels)})
+}
+
+// OriginateCall handles POST /api/v1/gateways/:id/originate
+func (h *GatewayHandler) OriginateCall(c *gin.Context) {
+	var req ami.OriginateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Application == "" && (req.Exten == "" || req.Context == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either application or exten and context are required"})
+		return
+	}
+
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	if err := session.Originate(ctx, req); err != nil {
+		h.writeAMIError(c, "Originate", err)
+		return
+	}
+	h.logger.WithField("gateway_id", c.Param("id")).Infof("Originated call on %s", req.Channel)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Call queued"})
+}
+
+// HangupChannel handles POST /api/v1/gateways/:id/hangup
+func (h *GatewayHandler) HangupChannel(c *gin.Context) {
+	var req struct {
+		Channel string `json:"channel" binding:"required"`
+		Cause   int    `json:"cause"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	if err := session.Hangup(ctx, req.Channel, req.Cause); err != nil {
+		h.writeAMIError(c, "Hangup", err)
+		return
+	}
+	h.logger.WithField("gateway_id", c.Param("id")).Infof("Hung up channel %s", req.Channel)
+	c.JSON(http.StatusOK, gin.H{"message": "Channel hung up"})
+}
+
+// ListGatewayDongles handles GET /api/v1/gateways/:id/dongles
+func (h *GatewayHandler) ListGatewayDongles(c *gin.Context) {
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	devices, err := session.DongleShowDevices(ctx, c.Query("device"))
+	if err != nil {
+		h.writeAMIError(c, "DongleShowDevices", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dongles": devices, "count": len(devices)})
+}
+
+// ResetDongle handles POST /api/v1/gateways/:id/dongles/:device/reset
+func (h *GatewayHandler) ResetDongle(c *gin.Context) {
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	device := c.Param("device")
+	if err := session.DongleReset(ctx, device); err != nil {
+		h.writeAMIError(c, "DongleReset", err)
+		return
+	}
+	h.logger.WithField("gateway_id", c.Param("id")).Infof("Reset dongle %s", device)
+	c.JSON(http.StatusOK, gin.H{"message": "Dongle reset requested"})
+}
+
+// RestartDongle handles POST /api/v1/gateways/:id/dongles/:device/restart
+func (h *GatewayHandler) RestartDongle(c *gin.Context) {
+	var req struct {
+		When string `json:"when"` // now, gracefully or "when convenient"
+	}
+	// The body is optional; an empty one restarts now.
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	switch req.When {
+	case "", "now", "gracefully", "when convenient":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "when must be one of: now, gracefully, when convenient"})
+		return
+	}
+
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	device := c.Param("device")
+	if err := session.DongleRestart(ctx, device, req.When); err != nil {
+		h.writeAMIError(c, "DongleRestart", err)
+		return
+	}
+	h.logger.WithField("gateway_id", c.Param("id")).Infof("Restart of dongle %s requested (%s)", device, req.When)
+	c.JSON(http.StatusOK, gin.H{"message": "Dongle restart requested"})
+}
+
+// SendDongleSMS handles POST /api/v1/gateways/:id/dongles/:device/sms
+func (h *GatewayHandler) SendDongleSMS(c *gin.Context) {
+	var req struct {
+		Number  string `json:"number" binding:"required"`
+		Message string `json:"message" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	taskID, err := session.DongleSendSMS(ctx, c.Param("device"), req.Number, req.Message, false)
+	if err != nil {
+		h.writeAMIError(c, "DongleSendSMS", err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "SMS queued", "task_id": taskID})
+}
+
+// SendDongleUSSD handles POST /api/v1/gateways/:id/dongles/:device/ussd
+func (h *GatewayHandler) SendDongleUSSD(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"` // e.g. *100#
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	taskID, err := session.DongleSendUSSD(ctx, c.Param("device"), req.Code)
+	if err != nil {
+		h.writeAMIError(c, "DongleSendUSSD", err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "USSD queued", "task_id": taskID})
+}
+
+// HangupActiveCall handles POST /api/v1/gateways/:id/calls/:linkedid/hangup
+func (h *GatewayHandler) HangupActiveCall(c *gin.Context) {
+	session, ok := h.amiSession(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), amiActionTimeout)
+	defer cancel()
+
+	linkedID := c.Param("linkedid")
+	if err := session.HangupCall(ctx, linkedID); err != nil {
+		h.writeAMIError(c, "Hangup", err)
+		return
+	}
+	h.logger.WithField("gateway_id", c.Param("id")).Infof("Hung up call %s", linkedID)
+	c.JSON(http.StatusOK, gin.H{"message": "Call hung up"})
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami"
 	"github.com/e173-gateway/e173_go_gateway/pkg/models"
 	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
 	"github.com/gin-gonic/gin"
@@ -16,13 +18,16 @@ import (
 // GatewayHandler handles gateway-related HTTP requests.
 type GatewayHandler struct {
 	gatewayRepo repository.GatewayRepository
+	amiManager  *ami.GatewayManager
 	logger      *logrus.Logger
 }
 
 // NewGatewayHandler creates a new instance of GatewayHandler.
-func NewGatewayHandler(gatewayRepo repository.GatewayRepository, logger *logrus.Logger) *GatewayHandler {
+// amiManager may be nil, in which case gateway changes are not pushed to live AMI sessions.
+func NewGatewayHandler(gatewayRepo repository.GatewayRepository, amiManager *ami.GatewayManager, logger *logrus.Logger) *GatewayHandler {
 	return &GatewayHandler{
 		gatewayRepo: gatewayRepo,
+		amiManager:  amiManager,
 		logger:      logger,
 	}
 }
@@ -30,13 +35,18 @@ func NewGatewayHandler(gatewayRepo repository.GatewayRepository, logger *logrus.
 // CreateGateway handles POST /api/v1/gateways
 func (h *GatewayHandler) CreateGateway(c *gin.Context) {
 	var req struct {
-		Name        string `json:"name" binding:"required"`
-		Description string `json:"description"`
-		Location    string `json:"location"`
-		AMIHost     string `json:"ami_host" binding:"required"`
-		AMIPort     string `json:"ami_port"`
-		AMIUser     string `json:"ami_user" binding:"required"`
-		AMIPass     string `json:"ami_pass" binding:"required"`
+		Name         string `json:"name" binding:"required"`
+		Description  string `json:"description"`
+		Location     string `json:"location"`
+		AMIHost      string `json:"ami_host" binding:"required"`
+		AMIPort      string `json:"ami_port"`
+		AMIUser      string `json:"ami_user" binding:"required"`
+		AMIPass      string `json:"ami_pass" binding:"required"`
+		SIPEndpoint  string `json:"sip_endpoint"`
+		SIPPort      int    `json:"sip_port"`
+		SIPTransport string `json:"sip_transport"`
+		SIPWeight    int    `json:"sip_weight"`
+		SIPPriority  int    `json:"sip_priority"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -48,20 +58,31 @@ func (h *GatewayHandler) CreateGateway(c *gin.Context) {
 	if req.AMIPort == "" {
 		req.AMIPort = "5038"
 	}
+	if err := validateGatewaySIP(req.SIPTransport, req.SIPPort, req.SIPWeight); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	gateway := &models.Gateway{
-		ID:          uuid.New().String(),
-		Name:        req.Name,
-		Description: req.Description,
-		Location:    req.Location,
-		AMIHost:     req.AMIHost,
-		AMIPort:     req.AMIPort,
-		AMIUser:     req.AMIUser,
-		AMIPass:     req.AMIPass,
-		Status:      models.GatewayStatusOffline,
-		Enabled:     true,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		ID:           uuid.New().String(),
+		Name:         req.Name,
+		Description:  req.Description,
+		Location:     req.Location,
+		AMIHost:      req.AMIHost,
+		AMIPort:      req.AMIPort,
+		AMIUser:      req.AMIUser,
+		AMIPass:      req.AMIPass,
+		Status:       models.GatewayStatusOffline,
+		Enabled:      true,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		SIPPort:      req.SIPPort,
+		SIPTransport: strings.ToUpper(req.SIPTransport),
+		SIPWeight:    req.SIPWeight,
+		SIPPriority:  req.SIPPriority,
+	}
+	if req.SIPEndpoint != "" {
+		gateway.SIPEndpoint = &req.SIPEndpoint
 	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
@@ -73,6 +94,10 @@ func (h *GatewayHandler) CreateGateway(c *gin.Context) {
 		return
 	}
 
+	if h.amiManager != nil {
+		h.amiManager.SyncGateway(gateway)
+	}
+
 	c.JSON(http.StatusCreated, gateway)
 }
 
@@ -125,19 +150,29 @@ func (h *GatewayHandler) UpdateGateway(c *gin.Context) {
 	}
 
 	var req struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Location    string `json:"location"`
-		AMIHost     string `json:"ami_host"`
-		AMIPort     string `json:"ami_port"`
-		AMIUser     string `json:"ami_user"`
-		AMIPass     string `json:"ami_pass"`
+		Name         string  `json:"name"`
+		Description  string  `json:"description"`
+		Location     string  `json:"location"`
+		AMIHost      string  `json:"ami_host"`
+		AMIPort      string  `json:"ami_port"`
+		AMIUser      string  `json:"ami_user"`
+		AMIPass      string  `json:"ami_pass"`
+		Enabled      *bool   `json:"enabled"`
+		SIPEndpoint  *string `json:"sip_endpoint"`
+		SIPPort      int     `json:"sip_port"`
+		SIPTransport string  `json:"sip_transport"`
+		SIPWeight    int     `json:"sip_weight"`
+		SIPPriority  *int    `json:"sip_priority"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := validateGatewaySIP(req.SIPTransport, req.SIPPort, req.SIPWeight); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
@@ -176,6 +211,32 @@ func (h *GatewayHandler) UpdateGateway(c *gin.Context) {
 	if req.AMIPass != "" {
 		gateway.AMIPass = req.AMIPass
 	}
+	if req.Enabled != nil {
+		gateway.Enabled = *req.Enabled
+		if !gateway.Enabled {
+			gateway.Status = models.GatewayStatusOffline
+		}
+	}
+	if req.SIPEndpoint != nil {
+		// An empty endpoint goes back to the AMI host
+		if *req.SIPEndpoint == "" {
+			gateway.SIPEndpoint = nil
+		} else {
+			gateway.SIPEndpoint = req.SIPEndpoint
+		}
+	}
+	if req.SIPPort != 0 {
+		gateway.SIPPort = req.SIPPort
+	}
+	if req.SIPTransport != "" {
+		gateway.SIPTransport = strings.ToUpper(req.SIPTransport)
+	}
+	if req.SIPWeight != 0 {
+		gateway.SIPWeight = req.SIPWeight
+	}
+	if req.SIPPriority != nil {
+		gateway.SIPPriority = *req.SIPPriority
+	}
 
 	// Save updates
 	if err := h.gatewayRepo.UpdateGateway(ctx, gateway); err != nil {
@@ -184,6 +245,10 @@ func (h *GatewayHandler) UpdateGateway(c *gin.Context) {
 		return
 	}
 
+	if h.amiManager != nil {
+		h.amiManager.SyncGateway(gateway)
+	}
+
 	c.JSON(http.StatusOK, gateway)
 }
 
@@ -208,6 +273,10 @@ func (h *GatewayHandler) DeleteGateway(c *gin.Context) {
 		return
 	}
 
+	if h.amiManager != nil {
+		h.amiManager.RemoveGateway(id)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Gateway deleted successfully"})
 }
 
@@ -414,7 +483,7 @@ func (h *GatewayHandler) TestGatewayConnection(c *gin.Context) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
 
 	// Get gateway details
@@ -429,72 +498,99 @@ func (h *GatewayHandler) TestGatewayConnection(c *gin.Context) {
 		return
 	}
 
-	// Test results
+	probe := ami.TestConnection(ctx, gateway)
+
+	// The UI renders one card per test; each carries the step's own error.
+	tests := gin.H{}
+	for _, step := range probe.Steps {
+		test := probeTest(probe, step.Name, "")
+		test["duration_ms"] = step.DurationMs
+		tests[step.Name] = test
+	}
+	tests["connection"] = probeTest(probe, ami.ProbeStepConnect, "Not attempted")
+	tests["modems"] = probeTest(probe, ami.ProbeStepDongles, "Skipped: not logged in")
+	if ping := probe.Step(ami.ProbeStepPing); ping != nil && ping.Success {
+		tests["latency"] = gin.H{
+			"success": probe.RoundTripMs < 1000,
+			"message": fmt.Sprintf("Login %dms, round trip %.1fms", probe.LoginMs, probe.RoundTripMs),
+		}
+	} else {
+		tests["latency"] = probeTest(probe, ami.ProbeStepPing, "Skipped: not logged in")
+	}
+	if login := probe.Step(ami.ProbeStepLogin); login != nil && !login.Success {
+		// Fold a login failure into the connection card, which the UI always shows.
+		tests["connection"] = probeTest(probe, ami.ProbeStepLogin, "")
+	}
+
 	result := gin.H{
-		"success": false,
+		"success": probe.Success,
 		"gateway": gin.H{
 			"id":   gateway.ID,
 			"name": gateway.Name,
 		},
-		"tests": gin.H{
-			"connection": gin.H{
-				"success": false,
-				"message": "AMI connection failed",
-			},
-			"modems": gin.H{
-				"success": false,
-				"message": "Unable to detect modems",
-			},
-			"latency": gin.H{
-				"success": false,
-				"message": "Response time test failed",
-			},
+		"tests": tests,
+		"steps": probe.Steps,
+		"raw": gin.H{
+			"ami_version":      probe.AMIVersion,
+			"asterisk_version": probe.AsteriskVersion,
+			"uptime_seconds":   probe.UptimeSeconds,
+			"connect_ms":       probe.ConnectMs,
+			"login_ms":         probe.LoginMs,
+			"round_trip_ms":    probe.RoundTripMs,
+			"channels":         probe.Channels,
+			"calls":            probe.CurrentCalls,
+			"dongles":          probe.Dongles,
 		},
-		"raw": gin.H{},
 	}
 
-	// TODO: Implement actual AMI connection test
-	// For now, simulate the test
-	startTime := time.Now()
-	modemCount := int64(0)
-	
-	// Simulate connection test
-	if gateway.AMIHost != "" && gateway.AMIPort != "" {
-		result["tests"].(gin.H)["connection"] = gin.H{
-			"success": true,
-			"message": fmt.Sprintf("Successfully connected to %s:%s", gateway.AMIHost, gateway.AMIPort),
+	// Record the outcome unless a live session already owns the status. A
+	// disabled gateway keeps its status: no session would ever correct it.
+	live := false
+	if h.amiManager != nil {
+		if session, ok := h.amiManager.Session(gateway.ID); ok && session.Connected() {
+			live = true
 		}
-		
-		// Simulate modem detection
-		modemCount = 45 + (time.Now().Unix() % 5) // Random 45-50
-		result["tests"].(gin.H)["modems"] = gin.H{
-			"success": true,
-			"message": fmt.Sprintf("Detected %d modems", modemCount),
+	}
+	if gateway.Enabled && !live {
+		status := models.GatewayStatusOnline
+		var lastError *string
+		if !probe.Success {
+			status = models.GatewayStatusError
+			if failed := firstFailedStep(probe); failed != nil {
+				lastError = models.StringPtr(failed.Error)
+			}
 		}
-		
-		// Calculate latency
-		latency := time.Since(startTime).Milliseconds()
-		result["tests"].(gin.H)["latency"] = gin.H{
-			"success": latency < 1000,
-			"message": fmt.Sprintf("Response time: %dms", latency),
+		if err := h.gatewayRepo.UpdateGatewayStatus(ctx, gateway.ID, status, lastError); err != nil {
+			h.logger.WithError(err).Warn("Failed to update gateway status after connection test")
 		}
-		
-		result["success"] = true
-		
-		// Update gateway status
-		gateway.Status = models.GatewayStatusOnline
-		gateway.LastSeen = &startTime
-		h.gatewayRepo.UpdateGateway(ctx, gateway)
 	}
 
-	result["raw"] = gin.H{
-		"ami_version": "Asterisk 18.0.0",
-		"uptime":      "2 days, 4 hours",
-		"channels":    modemCount,
-		"calls":       5,
+	c.JSON(http.StatusOK, result)
+}
+
+// probeTest renders a probe step as a test result for the test page, or a
+// failed placeholder when the step did not run.
+func probeTest(probe *ami.ProbeResult, name, skipped string) gin.H {
+	step := probe.Step(name)
+	if step == nil {
+		return gin.H{"success": false, "message": skipped}
+	}
+	test := gin.H{"success": step.Success, "message": step.Message}
+	if step.Error != "" {
+		test["error"] = step.Error
+		test["message"] = step.Message + ": " + step.Error
 	}
+	return test
+}
 
-	c.JSON(http.StatusOK, result)
+// firstFailedStep returns the first failed step of a probe, or nil.
+func firstFailedStep(probe *ami.ProbeResult) *ami.ProbeStep {
+	for i := range probe.Steps {
+		if !probe.Steps[i].Success {
+			return &probe.Steps[i]
+		}
+	}
+	return nil
 }
 
 // GetGatewayTestUI handles GET /gateways/:id/test
@@ -547,3 +643,20 @@ func (h *GatewayHandler) GetGatewayTestUI(c *gin.Context) {
 
 	c.HTML(http.StatusOK, "gateways/test_connection.html", templateData)
 }
+
+// validateGatewaySIP checks the SIP routing settings of a gateway request;
+// zero values are left to their defaults.
+func validateGatewaySIP(transport string, port, weight int) error {
+	switch strings.ToUpper(transport) {
+	case "", "UDP", "TCP", "TLS":
+	default:
+		return fmt.Errorf("sip_transport must be UDP, TCP or TLS")
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("sip_port must be between 1 and 65535")
+	}
+	if weight < 0 {
+		return fmt.Errorf("sip_weight must be positive")
+	}
+	return nil
+}
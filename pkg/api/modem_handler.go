@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// modemScanTimeout bounds a manual discovery scan, which probes every newly
+// plugged modem over its AT port.
+const modemScanTimeout = 2 * time.Minute
+
+// ModemHandler handles API requests about the modems attached to this host.
+type ModemHandler struct {
+	modemRepo repository.ModemRepository
+	discovery *modem.Discovery
+	logger    *logrus.Logger
+}
+
+// NewModemHandler creates a new instance of ModemHandler. discovery may be
+// nil when USB discovery is disabled on this server.
+func NewModemHandler(modemRepo repository.ModemRepository, discovery *modem.Discovery, logger *logrus.Logger) *ModemHandler {
+	return &ModemHandler{
+		modemRepo: modemRepo,
+		discovery: discovery,
+		logger:    logger,
+	}
+}
+
+// GetAttachedModems handles GET /api/v1/modems/attached
+func (h *ModemHandler) GetAttachedModems(c *gin.Context) {
+	if h.discovery == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Modem discovery is not enabled on this server"})
+		return
+	}
+	modems := h.discovery.Attached()
+	c.JSON(http.StatusOK, gin.H{"modems": modems, "count": len(modems)})
+}
+
+// ScanModems handles POST /api/v1/modems/discovery/scan
+func (h *ModemHandler) ScanModems(c *gin.Context) {
+	if h.discovery == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Modem discovery is not enabled on this server"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), modemScanTimeout)
+	defer cancel()
+
+	if err := h.discovery.Scan(ctx); err != nil {
+		h.logger.WithError(err).Error("Manual modem discovery scan failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan for modems"})
+		return
+	}
+	modems := h.discovery.Attached()
+	c.JSON(http.StatusOK, gin.H{"modems": modems, "count": len(modems)})
+}
+
+// GetModemMoves handles GET /api/v1/modems/:id/moves
+func (h *ModemHandler) GetModemMoves(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modem ID"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := h.modemRepo.GetModemByID(ctx, id); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Modem not found"})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to fetch modem %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch modem"})
+		return
+	}
+
+	moves, err := h.modemRepo.GetModemMoves(ctx, id, limit)
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch moves of modem %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch modem moves"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"moves": moves, "count": len(moves)})
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// ModemHealthHandler handles API requests about modem health and recovery.
+type ModemHealthHandler struct {
+	modemRepo repository.ModemRepository
+	health    *modem.HealthMonitor
+	logger    *logrus.Logger
+}
+
+// NewModemHealthHandler creates a new instance of ModemHealthHandler. health
+// may be nil when the health monitor is disabled; transitions recorded
+// earlier can still be read.
+func NewModemHealthHandler(modemRepo repository.ModemRepository, health *modem.HealthMonitor, logger *logrus.Logger) *ModemHealthHandler {
+	return &ModemHealthHandler{
+		modemRepo: modemRepo,
+		health:    health,
+		logger:    logger,
+	}
+}
+
+// ModemHealthActionRequest is the body of the quarantine and release
+// endpoints.
+type ModemHealthActionRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+// GetModemHealth handles GET /api/v1/modems/health
+func (h *ModemHealthHandler) GetModemHealth(c *gin.Context) {
+	if h.health == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Modem health monitoring is not enabled on this server"})
+		return
+	}
+	states := h.health.States()
+	c.JSON(http.StatusOK, gin.H{"modems": states, "count": len(states)})
+}
+
+// GetHealthTransitions handles GET /api/v1/modems/:id/health
+func (h *ModemHealthHandler) GetHealthTransitions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modem ID"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	m, err := h.modemRepo.GetModemByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Modem not found"})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to fetch modem %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch modem"})
+		return
+	}
+	transitions, err := h.modemRepo.GetHealthTransitions(ctx, id, limit)
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch health transitions of modem %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch health transitions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"modem_id":     id,
+		"health_state": m.HealthState,
+		"since":        m.HealthChangedAt,
+		"transitions":  transitions,
+		"count":        len(transitions),
+	})
+}
+
+// QuarantineModem handles POST /api/v1/modems/:id/quarantine
+func (h *ModemHealthHandler) QuarantineModem(c *gin.Context) {
+	h.healthAction(c, "quarantine", h.health.Quarantine)
+}
+
+// ReleaseModem handles POST /api/v1/modems/:id/release
+func (h *ModemHealthHandler) ReleaseModem(c *gin.Context) {
+	h.healthAction(c, "release", h.health.Release)
+}
+
+// healthAction runs an operator action on a modem's health.
+func (h *ModemHealthHandler) healthAction(c *gin.Context, name string, action func(ctx context.Context, modemID int, reason string) error) {
+	if h.health == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Modem health monitoring is not enabled on this server"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modem ID"})
+		return
+	}
+	var req ModemHealthActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := action(ctx, id, req.Reason); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Modem not found"})
+			return
+		}
+		if errors.Is(err, modem.ErrNotQuarantined) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Modem is not quarantined"})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to %s modem %d", name, id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + name + " modem"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Modem " + name + "d"})
+}
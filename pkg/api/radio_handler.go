@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// RadioHandler handles API requests for modem signal and cell readings.
+type RadioHandler struct {
+	radioRepo     repository.RadioRepository
+	modemRepo     repository.ModemRepository
+	weakSignalDBM int
+	logger        *logrus.Logger
+}
+
+// NewRadioHandler creates a new instance of RadioHandler. weakSignalDBM is
+// the alarm threshold drawn on signal charts.
+func NewRadioHandler(radioRepo repository.RadioRepository, modemRepo repository.ModemRepository, weakSignalDBM int, logger *logrus.Logger) *RadioHandler {
+	return &RadioHandler{
+		radioRepo:     radioRepo,
+		modemRepo:     modemRepo,
+		weakSignalDBM: weakSignalDBM,
+		logger:        logger,
+	}
+}
+
+// signalWindow reads the ?hours= and ?bucket= parameters of signal queries:
+// by default the last 24 hours in 15-minute buckets.
+func signalWindow(c *gin.Context) (time.Time, time.Duration) {
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours <= 0 || hours > 24*30 {
+		hours = 24
+	}
+	bucket, err := time.ParseDuration(c.DefaultQuery("bucket", "15m"))
+	if err != nil || bucket < time.Minute {
+		bucket = 15 * time.Minute
+	}
+	return time.Now().Add(-time.Duration(hours) * time.Hour), bucket
+}
+
+// GetSignalSeries handles GET /api/v1/modems/:id/signal
+func (h *RadioHandler) GetSignalSeries(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modem ID"})
+		return
+	}
+	since, bucket := signalWindow(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	modem, err := h.modemRepo.GetModemByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Modem not found"})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to fetch modem %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch modem"})
+		return
+	}
+
+	points, err := h.radioRepo.GetSignalSeries(ctx, id, since, bucket)
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch signal series of modem %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch signal series"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"modem_id":      id,
+		"signal_dbm":    modem.SignalStrengthDBM,
+		"threshold_dbm": h.weakSignalDBM,
+		"bucket":        bucket.String(),
+		"points":        points,
+	})
+}
+
+// GetRadioReadings handles GET /api/v1/modems/:id/radio
+func (h *RadioHandler) GetRadioReadings(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modem ID"})
+		return
+	}
+	since, _ := signalWindow(c)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	readings, err := h.radioRepo.GetReadings(ctx, id, since, limit)
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch radio readings of modem %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch radio readings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"readings": readings, "count": len(readings)})
+}
+
+// GetSignalTrends handles GET /api/v1/modems/signal-trends
+func (h *RadioHandler) GetSignalTrends(c *gin.Context) {
+	since, bucket := signalWindow(c)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	trends, err := h.radioRepo.GetSignalTrends(ctx, since, bucket)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to fetch signal trends")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch signal trends"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"threshold_dbm": h.weakSignalDBM, "bucket": bucket.String(), "modems": trends})
+}
+
+// SignalSparkline renders a signal series as a small inline SVG chart for
+// the dashboard, with the alarm threshold as a dashed line. It returns ""
+// when there are fewer than two points.
+func SignalSparkline(points []models.SignalPoint, thresholdDBM int) string {
+	if len(points) < 2 {
+		return ""
+	}
+	const width, height = 120.0, 28.0
+	// -113 dBm is CSQ 0, -51 dBm CSQ 31.
+	const floor, ceil = -113.0, -51.0
+	y := func(dbm float64) float64 {
+		if dbm < floor {
+			dbm = floor
+		}
+		if dbm > ceil {
+			dbm = ceil
+		}
+		return height - (dbm-floor)/(ceil-floor)*height
+	}
+
+	first, last := points[0].At, points[len(points)-1].At
+	span := last.Sub(first).Seconds()
+	coords := make([]string, len(points))
+	for i, p := range points {
+		x := 0.0
+		if span > 0 {
+			x = p.At.Sub(first).Seconds() / span * width
+		}
+		coords[i] = fmt.Sprintf("%.1f,%.1f", x, y(p.AvgDBM))
+	}
+
+	color := "#16a34a" // green-600
+	if points[len(points)-1].AvgDBM < float64(thresholdDBM) {
+		color = "#dc2626" // red-600
+	}
+	ty := y(float64(thresholdDBM))
+	return fmt.Sprintf(`<svg width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" class="inline-block" role="img" aria-label="Signal trend">`+
+		`<line x1="0" y1="%.1f" x2="%.0f" y2="%.1f" stroke="#9ca3af" stroke-width="1" stroke-dasharray="3,3"/>`+
+		`<polyline fill="none" stroke="%s" stroke-width="1.5" points="%s"/></svg>`,
+		width, height, width, height, ty, width, ty, color, strings.Join(coords, " "))
+}
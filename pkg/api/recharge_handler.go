@@ -2,12 +2,14 @@ package api
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/recharge"
 	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -16,17 +18,31 @@ import (
 type RechargeHandler struct {
 	rechargeRepo repository.RechargeRepository
 	simCardRepo  repository.SIMCardRepository
+	engine       *recharge.Engine
+	inventory    *recharge.Inventory
 	logger       *logrus.Entry
 }
 
-func NewRechargeHandler(rechargeRepo repository.RechargeRepository, simCardRepo repository.SIMCardRepository, logger *logrus.Entry) *RechargeHandler {
+func NewRechargeHandler(rechargeRepo repository.RechargeRepository, simCardRepo repository.SIMCardRepository, engine *recharge.Engine, inventory *recharge.Inventory, logger *logrus.Entry) *RechargeHandler {
 	return &RechargeHandler{
 		rechargeRepo: rechargeRepo,
 		simCardRepo:  simCardRepo,
+		engine:       engine,
+		inventory:    inventory,
 		logger:       logger,
 	}
 }
 
+// currentUserID returns the ID of the logged-in user, nil if none.
+func currentUserID(c *gin.Context) *int64 {
+	if v, ok := c.Get("user_id"); ok {
+		if id, ok := v.(int64); ok {
+			return &id
+		}
+	}
+	return nil
+}
+
 // CreateRechargeCode handles POST /api/v1/recharge/codes
 func (h *RechargeHandler) CreateRechargeCode(c *gin.Context) {
 	var code models.RechargeCode
@@ -35,15 +51,23 @@ func (h *RechargeHandler) CreateRechargeCode(c *gin.Context) {
 		return
 	}
 
+	if userID := currentUserID(c); userID != nil {
+		code.CreatedBy = *userID
+	}
+
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
 	defer cancel()
 
-	code.Status = "active"
-	code.CreatedAt = time.Now()
-
-	if err := h.rechargeRepo.CreateRechargeCode(ctx, &code); err != nil {
-		h.logger.WithError(err).Error("Failed to create recharge code")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recharge code"})
+	if err := h.inventory.Add(ctx, &code); err != nil {
+		switch {
+		case errors.Is(err, recharge.ErrBadVoucher):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, recharge.ErrDuplicateVoucher):
+			c.JSON(http.StatusConflict, gin.H{"error": "Recharge code already exists for this operator"})
+		default:
+			h.logger.WithError(err).Error("Failed to create recharge code")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recharge code"})
+		}
 		return
 	}
 
@@ -86,13 +110,16 @@ func (h *RechargeHandler) RechargeSimCard(c *gin.Context) {
 	}
 
 	// If code is provided, validate it
-	var operator string
-	if simCard.OperatorName.Valid {
+	operator := req.Operator
+	if operator == "" && simCard.OperatorName.Valid {
 		operator = simCard.OperatorName.String
 	}
 	
+	var rechargeCode *models.RechargeCode
 	if req.Code != "" {
-		rechargeCode, err := h.rechargeRepo.GetRechargeCodeByCode(ctx, req.Code, operator)
+		voucher := models.RechargeCode{Code: req.Code, Operator: operator}
+		recharge.Normalize(&voucher)
+		rechargeCode, err = h.rechargeRepo.GetRechargeCodeByCode(ctx, voucher.Code, voucher.Operator)
 		if err != nil {
 			if err == repository.ErrNotFound {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recharge code"})
@@ -103,52 +130,36 @@ func (h *RechargeHandler) RechargeSimCard(c *gin.Context) {
 			return
 		}
 
-		if rechargeCode.Status != "active" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Recharge code is not active"})
-			return
-		}
-
 		req.Amount = rechargeCode.Amount
 	}
 
-	// Update SIM card balance
-	currentBalance := 0.0
-	if simCard.Balance.Valid {
-		currentBalance = simCard.Balance.Float64
-	}
-	newBalance := currentBalance + req.Amount
-	simCard.Balance = sql.NullFloat64{Float64: newBalance, Valid: true}
-	
-	if err := h.simCardRepo.UpdateSIMCard(ctx, simCard); err != nil {
-		h.logger.WithError(err).Error("Failed to update SIM card balance")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update balance"})
-		return
-	}
-
 	// Get phone number from SIM card
 	phoneNumber := ""
 	if simCard.MSISDN.Valid {
 		phoneNumber = simCard.MSISDN.String
 	}
-	
-	// Create recharge history
+
+	// The voucher is claimed, the balance credited and the history written
+	// in one transaction
 	history := &models.RechargeHistory{
-		SimCardID:     simCard.ID,
-		PhoneNumber:   phoneNumber,
-		Amount:        req.Amount,
-		BalanceBefore: sql.NullFloat64{Float64: currentBalance, Valid: true},
-		BalanceAfter:  sql.NullFloat64{Float64: newBalance, Valid: true},
-		Method:        "api",
-		Status:        "completed",
-		Attempts:      1,
-		ProcessedBy:   1, // TODO: Get from current user
-		ProcessedAt:   time.Now(),
+		SimCardID:   simCard.ID,
+		PhoneNumber: phoneNumber,
+		Amount:      req.Amount,
+		Method:      models.RechargeMethodAPI,
+		Status:      models.RechargeResultSuccess,
+		Attempts:    1,
+		ProcessedBy: currentUserID(c),
 	}
-
-	if err := h.rechargeRepo.CreateRechargeHistory(ctx, history); err != nil {
-		h.logger.WithError(err).Error("Failed to create recharge history")
-		// Don't fail the request, history is not critical
+	if err := h.rechargeRepo.RedeemRechargeCode(ctx, rechargeCode, history); err != nil {
+		if errors.Is(err, repository.ErrCodeUnavailable) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Recharge code is not available"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to record recharge")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update balance"})
+		return
 	}
+	newBalance := history.BalanceAfter.Float64
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -158,6 +169,48 @@ func (h *RechargeHandler) RechargeSimCard(c *gin.Context) {
 	})
 }
 
+// RunRecharge handles POST /api/v1/sims/:id/recharge/run. It takes a
+// voucher from the stock, enters it on the SIM following its operator's
+// scenario and returns the recharge record.
+func (h *RechargeHandler) RunRecharge(c *gin.Context) {
+	simID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+	var req recharge.Request
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	req.ProcessedBy = currentUserID(c)
+
+	// Retries and balance checks can take several minutes.
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Minute)
+	defer cancel()
+
+	history, err := h.engine.Recharge(ctx, simID, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "SIM card not found"})
+		case errors.Is(err, recharge.ErrNoScenario), errors.Is(err, recharge.ErrNoVoucher):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case errors.Is(err, recharge.ErrNoModem), errors.Is(err, recharge.ErrBusy):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case history != nil:
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "history": history})
+		default:
+			h.logger.WithError(err).Errorf("Failed to recharge SIM card %d", simID)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to recharge SIM card"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
 // GetRechargeHistory handles GET /api/v1/sims/:id/recharge/history
 func (h *RechargeHandler) GetRechargeHistory(c *gin.Context) {
 	simIDStr := c.Param("id")
@@ -231,29 +284,214 @@ func (h *RechargeHandler) GetRechargeUI(c *gin.Context) {
 	c.HTML(http.StatusOK, "sims/recharge.html", templateData)
 }
 
-// AutoRecharge handles automatic recharge for low balance SIMs
+// AutoRecharge handles automatic recharge for low balance SIMs: each SIM
+// with auto-recharge enabled and a balance below its threshold, or below
+// threshold if it has none, gets a voucher of its configured amount.
 func (h *RechargeHandler) AutoRecharge(threshold float64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
 	defer cancel()
 
-	// Get SIM cards with low balance
-	sims, err := h.rechargeRepo.GetSimCardsForAutoRecharge(ctx, threshold)
+	recharged, err := h.engine.AutoRecharge(ctx, threshold)
 	if err != nil {
 		return err
 	}
+	h.logger.Infof("Auto-recharged %d SIM card(s)", recharged)
+	return nil
+}
+
+// RunAutoRecharge handles POST /api/v1/recharge/auto. The recharges run in
+// the background.
+func (h *RechargeHandler) RunAutoRecharge(c *gin.Context) {
+	h.engine.Trigger()
+	c.JSON(http.StatusAccepted, gin.H{"message": "Auto-recharge started"})
+}
+// maxImportSize bounds an uploaded voucher file.
+const maxImportSize = 10 << 20
+
+// ImportRechargeCodes handles POST /api/v1/recharge/codes/import. The CSV
+// file is the "file" form field or the request body; the operator, amount
+// and expiry_date query or form values fill in the columns it lacks.
+func (h *RechargeHandler) ImportRechargeCodes(c *gin.Context) {
+	userID := currentUserID(c)
+	if userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
 
-	h.logger.Infof("Found %d SIM cards for auto-recharge", len(sims))
+	value := func(name string) string {
+		if v := c.Query(name); v != "" {
+			return v
+		}
+		return c.PostForm(name)
+	}
+	opts := recharge.ImportOptions{Operator: value("operator"), CreatedBy: *userID}
+	if v := value("amount"); v != "" {
+		amount, err := strconv.ParseFloat(v, 64)
+		if err != nil || amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+			return
+		}
+		opts.Amount = amount
+	}
+	if v := value("expiry_date"); v != "" {
+		expiry, err := recharge.ParseExpiry(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		opts.ExpiryDate = &expiry
+	}
 
-	for _, sim := range sims {
-		// TODO: Implement auto-recharge logic
-		// This could involve:
-		// 1. Checking if auto-recharge is enabled for the SIM
-		// 2. Getting the configured recharge amount
-		// 3. Processing the recharge
-		// 4. Sending notifications
-		
-		h.logger.Infof("Auto-recharge needed for SIM %s (balance: %.2f)", sim.ICCID, sim.Balance)
+	var file io.Reader = c.Request.Body
+	if header, err := c.FormFile("file"); err == nil {
+		f, err := header.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read uploaded file"})
+			return
+		}
+		defer f.Close()
+		file = f
 	}
 
-	return nil
-}
\ No newline at end of file
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Minute)
+	defer cancel()
+
+	result, err := h.inventory.Import(ctx, file, opts)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooBig):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Voucher file too large"})
+		case errors.Is(err, recharge.ErrBadImport):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			h.logger.WithError(err).Error("Failed to import recharge codes")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import recharge codes"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetVoucherStock handles GET /api/v1/recharge/stock
+func (h *RechargeHandler) GetVoucherStock(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	stock, err := h.inventory.Stock(ctx)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to count vouchers")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count vouchers"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stock": stock})
+}
+
+// CreateBatch handles POST /api/v1/recharge/batches. The SIM cards are
+// recharged in the background; the batch is returned at once.
+func (h *RechargeHandler) CreateBatch(c *gin.Context) {
+	var req recharge.BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := currentUserID(c)
+	if userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return
+	}
+	req.CreatedBy = *userID
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	batch, err := h.engine.StartBatch(ctx, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, recharge.ErrEmptyBatch):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		default:
+			h.logger.WithError(err).Error("Failed to start recharge batch")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start recharge batch"})
+		}
+		return
+	}
+	c.JSON(http.StatusAccepted, batch)
+}
+
+// ListBatches handles GET /api/v1/recharge/batches
+func (h *RechargeHandler) ListBatches(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	batches, err := h.rechargeRepo.ListBatches(ctx, c.Query("status"))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list recharge batches")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list recharge batches"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"batches": batches, "count": len(batches)})
+}
+
+// GetBatch handles GET /api/v1/recharge/batches/:id. It returns the batch,
+// its items and how many are in each status.
+func (h *RechargeHandler) GetBatch(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	batch, err := h.rechargeRepo.GetBatchByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+			return
+		}
+		h.logger.WithError(err).Error("Failed to get recharge batch")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get recharge batch"})
+		return
+	}
+	items, err := h.rechargeRepo.ListBatchItems(ctx, id)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list batch items")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list batch items"})
+		return
+	}
+
+	progress := map[string]int{
+		models.BatchItemPending: 0,
+		models.BatchItemRunning: 0,
+		models.BatchItemSuccess: 0,
+		models.BatchItemFailed:  0,
+		models.BatchItemSkipped: 0,
+	}
+	for _, item := range items {
+		progress[item.Status]++
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"batch":    batch,
+		"items":    items,
+		"progress": progress,
+	})
+}
+
+// CancelBatch handles POST /api/v1/recharge/batches/:id/cancel
+func (h *RechargeHandler) CancelBatch(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+		return
+	}
+	if !h.engine.CancelBatch(id) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Batch is not running"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Batch cancelled; running recharges finish first"})
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"database/sql"
 	"net/http"
 
 	"github.com/e173-gateway/e173_go_gateway/pkg/models"
@@ -24,6 +25,30 @@ func NewSIMCardHandler(repo repository.SIMCardRepository) *SIMCardHandler {
 	return &SIMCardHandler{repo: repo}
 }
 
+// simCardRequest is a SIM card as a client writes it. The PIN and PUK codes
+// are accepted here but never sent back.
+type simCardRequest struct {
+	models.SIMCard
+	PIN1 *string `json:"pin1"`
+	PUK1 *string `json:"puk1"`
+	PIN2 *string `json:"pin2"`
+	PUK2 *string `json:"puk2"`
+}
+
+// card returns the SIM card with the codes given; codes left out stay unset.
+func (r *simCardRequest) card() models.SIMCard {
+	sim := r.SIMCard
+	for _, code := range []struct {
+		from *string
+		to   *sql.NullString
+	}{{r.PIN1, &sim.PIN1}, {r.PUK1, &sim.PUK1}, {r.PIN2, &sim.PIN2}, {r.PUK2, &sim.PUK2}} {
+		if code.from != nil {
+			*code.to = sql.NullString{String: *code.from, Valid: true}
+		}
+	}
+	return sim
+}
+
 // CreateSIMCard godoc
 // @Summary Create a new SIM card
 // @Description Add a new SIM card to the system
@@ -34,17 +59,19 @@ func NewSIMCardHandler(repo repository.SIMCardRepository) *SIMCardHandler {
 // @Success 201 {object} models.SIMCard "Successfully created SIM card"
 // @Failure 400 {object} ErrorResponse "Invalid request payload"
 // @Failure 500 {object} ErrorResponse "Internal server error"
+// @Failure 503 {object} ErrorResponse "PIN codes given but no SIM secret key configured"
 // @Router /simcards [post]
 func (h *SIMCardHandler) CreateSIMCard(c *gin.Context) {
 	ctx := c.Request.Context()
 	logger := logging.Logger.WithContext(ctx)
-	var sim models.SIMCard
+	var req simCardRequest
 
-	if err := c.ShouldBindJSON(&sim); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil {
 		logger.WithError(err).Error("Failed to bind SIM card JSON")
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload: " + err.Error()})
 		return
 	}
+	sim := req.card()
 
 	// Basic validation (can be expanded)
 	if sim.ICCID == "" {
@@ -60,6 +87,10 @@ func (h *SIMCardHandler) CreateSIMCard(c *gin.Context) {
 
 
 	id, err := h.repo.CreateSIMCard(ctx, &sim)
+	if errors.Is(err, repository.ErrNoSecretKey) {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Storing SIM PIN and PUK codes is disabled: SIM_SECRET_KEY is not set"})
+		return
+	}
 	if err != nil {
 		logger.WithError(err).Error("Failed to create SIM card in repository")
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create SIM card"})
@@ -152,6 +183,7 @@ func (h *SIMCardHandler) GetAllSIMCards(c *gin.Context) {
 // @Failure 400 {object} ErrorResponse "Invalid request payload or SIM Card ID format"
 // @Failure 404 {object} ErrorResponse "SIM Card not found"
 // @Failure 500 {object} ErrorResponse "Internal server error"
+// @Failure 503 {object} ErrorResponse "PIN codes given but no SIM secret key configured"
 // @Router /simcards/{id} [put]
 func (h *SIMCardHandler) UpdateSIMCard(c *gin.Context) {
 	ctx := c.Request.Context()
@@ -165,12 +197,13 @@ func (h *SIMCardHandler) UpdateSIMCard(c *gin.Context) {
 		return
 	}
 
-	var simUpdates models.SIMCard
-	if err := c.ShouldBindJSON(&simUpdates); err != nil {
+	var req simCardRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		logger.WithError(err).Error("Failed to bind SIM card JSON for update")
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request payload: " + err.Error()})
 		return
 	}
+	simUpdates := req.card() // codes left out are kept as stored
 
 	// Ensure the ID in the path matches the ID in the body if provided, or set it
 	// For a PUT, the ID in the path is authoritative.
@@ -189,6 +222,8 @@ func (h *SIMCardHandler) UpdateSIMCard(c *gin.Context) {
 		if errors.Is(err, repository.ErrNotFound) {
 			logger.WithField("sim_id", id).Warn("SIM card not found for update")
 			c.JSON(http.StatusNotFound, ErrorResponse{Error: "SIM Card not found"})
+		} else if errors.Is(err, repository.ErrNoSecretKey) {
+			c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Storing SIM PIN and PUK codes is disabled: SIM_SECRET_KEY is not set"})
 		} else {
 			logger.WithError(err).WithField("sim_id", id).Error("Failed to update SIM card in repository")
 			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update SIM card"})
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// simUnlockTimeout bounds opening a modem and entering a PIN.
+const simUnlockTimeout = 30 * time.Second
+
+// SIMPINHandler handles API requests for unlocking SIM cards.
+type SIMPINHandler struct {
+	simRepo   repository.SIMCardRepository
+	modemRepo repository.ModemRepository
+	unlocker  *modem.PINUnlocker // nil while no SIM secret key is configured
+	lockDir   string
+	logger    *logrus.Logger
+}
+
+// NewSIMPINHandler creates a new instance of SIMPINHandler. With a nil
+// unlocker, unlocking answers 503 Service Unavailable.
+func NewSIMPINHandler(simRepo repository.SIMCardRepository, modemRepo repository.ModemRepository, unlocker *modem.PINUnlocker, logger *logrus.Logger) *SIMPINHandler {
+	return &SIMPINHandler{
+		simRepo:   simRepo,
+		modemRepo: modemRepo,
+		unlocker:  unlocker,
+		lockDir:   "/var/lock",
+		logger:    logger,
+	}
+}
+
+// UnlockSIMRequest is the body of POST /api/v1/simcards/:id/unlock.
+type UnlockSIMRequest struct {
+	PIN   string `json:"pin" binding:"required"`
+	Force bool   `json:"force"` // allow using the last PIN attempt
+}
+
+// UnlockSIM handles POST /api/v1/simcards/:id/unlock
+func (h *SIMPINHandler) UnlockSIM(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+	if h.unlocker == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SIM unlocking is disabled: SIM_SECRET_KEY is not set"})
+		return
+	}
+	var req UnlockSIMRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), simUnlockTimeout)
+	defer cancel()
+
+	sim, err := h.simRepo.GetSIMCardByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "SIM card not found"})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to fetch SIM card %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch SIM card"})
+		return
+	}
+	if !sim.ModemID.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "SIM card is not in a modem"})
+		return
+	}
+	m, err := h.modemRepo.GetModemByID(ctx, int(sim.ModemID.Int64))
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch modem of SIM card %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch modem"})
+		return
+	}
+	if locked, _ := modem.PortLocked(h.lockDir, m.DevicePath); locked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Modem port is in use by another process (chan_dongle)"})
+		return
+	}
+
+	dev, err := modem.Open(ctx, m.DevicePath, modem.Options{Logger: h.logger.WithField("modem_id", m.ID)})
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to open modem %d on %s", m.ID, m.DevicePath)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to open modem"})
+		return
+	}
+	defer dev.Close()
+
+	result, err := h.unlocker.UnlockWithPIN(ctx, dev, sim.ICCID, m.ID, req.PIN, req.Force)
+	if err != nil {
+		if errors.Is(err, modem.ErrPINAttemptsLow) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Too few PIN attempts left; retry with force to use the last one", "result": result})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to unlock SIM card %d", id)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to unlock SIM card", "result": result})
+		return
+	}
+	if !result.Unlocked {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "SIM card rejected the PIN", "result": result})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetPINAttempts handles GET /api/v1/simcards/:id/pin-attempts
+func (h *SIMPINHandler) GetPINAttempts(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	attempts, err := h.simRepo.GetPINAttempts(ctx, id, limit)
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch PIN attempts of SIM card %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch PIN attempts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"attempts": attempts, "count": len(attempts)})
+}
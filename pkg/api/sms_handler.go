@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// smsSendTimeout bounds sending a message, which may wait for the modem
+// to take every part of a long one.
+const smsSendTimeout = 2 * time.Minute
+
+// SMSHandler handles API requests for the SMS message log and for sending
+// messages.
+type SMSHandler struct {
+	smsRepo repository.SMSRepository
+	service *sms.Service
+	logger  *logrus.Logger
+}
+
+// NewSMSHandler creates a new instance of SMSHandler.
+func NewSMSHandler(smsRepo repository.SMSRepository, service *sms.Service, logger *logrus.Logger) *SMSHandler {
+	return &SMSHandler{
+		smsRepo: smsRepo,
+		service: service,
+		logger:  logger,
+	}
+}
+
+// ListMessages handles GET /api/v1/sms. It filters on direction, status,
+// modem_id, sim_card_id and number, and pages with limit and offset. HTMX
+// requests get the rows of the message log page.
+func (h *SMSHandler) ListMessages(c *gin.Context) {
+	filter := models.SMSFilter{
+		Direction: c.Query("direction"),
+		Status:    c.Query("status"),
+		Number:    c.Query("number"),
+	}
+	filter.ModemID, _ = strconv.Atoi(c.Query("modem_id"))
+	filter.SIMCardID, _ = strconv.ParseInt(c.Query("sim_card_id"), 10, 64)
+	filter.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if filter.Limit <= 0 || filter.Limit > 500 {
+		filter.Limit = 50
+	}
+	filter.Offset, _ = strconv.Atoi(c.Query("offset"))
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	messages, total, err := h.smsRepo.ListMessages(ctx, filter)
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list SMS messages")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+	if c.GetHeader("HX-Request") == "true" {
+		c.HTML(http.StatusOK, "partials/sms_list.tmpl", messages)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"messages": messages,
+		"count":    len(messages),
+		"total":    total,
+		"limit":    filter.Limit,
+		"offset":   filter.Offset,
+	})
+}
+
+// GetMessage handles GET /api/v1/sms/:id
+func (h *SMSHandler) GetMessage(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	msg, err := h.smsRepo.GetMessageByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+		h.logger.WithError(err).Errorf("Failed to fetch SMS message %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message"})
+		return
+	}
+	c.JSON(http.StatusOK, msg)
+}
+
+// ListSenders handles GET /api/v1/sms/senders: the SIM cards a message to
+// the given operator would be sent from, best first.
+func (h *SMSHandler) ListSenders(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	senders, err := h.smsRepo.ListSenders(ctx, c.Query("operator"))
+	if err != nil {
+		h.logger.WithError(err).Error("Failed to list SMS senders")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch senders"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"senders": senders, "count": len(senders)})
+}
+
+// SendMessage handles POST /api/v1/sms
+func (h *SMSHandler) SendMessage(c *gin.Context) {
+	var req sms.SendRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), smsSendTimeout)
+	defer cancel()
+
+	msg, err := h.service.Send(ctx, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, sms.ErrInvalidMessage):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, sms.ErrNoSender):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case msg != nil:
+			// Stored, but the modem did not take it.
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send message", "message": msg})
+		default:
+			h.logger.WithError(err).Error("Failed to send SMS")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		}
+		return
+	}
+	c.JSON(http.StatusAccepted, msg)
+}
@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/e173-gateway/e173_go_gateway/pkg/ami"
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
 	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -16,15 +18,17 @@ type StatsHandler struct {
 	simCardRepo repository.SIMCardRepository
 	cdrRepo     repository.CdrRepository
 	gatewayRepo repository.GatewayRepository
+	cdrOutbox   *ami.CDROutbox
 	logger      *logrus.Logger
 }
 
-func NewStatsHandler(modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository, cdrRepo repository.CdrRepository, gatewayRepo repository.GatewayRepository, logger *logrus.Logger) *StatsHandler {
+func NewStatsHandler(modemRepo repository.ModemRepository, simCardRepo repository.SIMCardRepository, cdrRepo repository.CdrRepository, gatewayRepo repository.GatewayRepository, cdrOutbox *ami.CDROutbox, logger *logrus.Logger) *StatsHandler {
 	return &StatsHandler{
 		modemRepo:   modemRepo,
 		simCardRepo: simCardRepo,
 		cdrRepo:     cdrRepo,
 		gatewayRepo: gatewayRepo,
+		cdrOutbox:   cdrOutbox,
 		logger:      logger,
 	}
 }
@@ -275,11 +279,6 @@ func (h *StatsHandler) GetSpamStats(c *gin.Context) {
 				shortCallCount++
 			}
 		}
-		
-		// Check if call was marked as FAILED or BUSY (potential spam indicators)
-		if cdr.Disposition != nil && (*cdr.Disposition == "FAILED" || *cdr.Disposition == "BUSY") {
-			// Additional spam indicator
-		}
 	}
 	
 	// Count potential spam based on frequency (more than 10 calls from same number today)
@@ -374,3 +373,65 @@ func (h *StatsHandler) GetGatewayStats(c *gin.Context) {
 		<p class="text-xs text-`+statusColor+`-600 dark:text-`+statusColor+`-400 mt-1">Online</p>
 	</div>`)
 }
+
+// GetDispositionStats handles GET /api/v1/stats/dispositions?hours=24
+// It breaks the calls of the period down by disposition category and by who
+// the failures are attributed to, so that destination-side failures (busy,
+// no answer) are not mistaken for problems with our SIMs.
+func (h *StatsHandler) GetDispositionStats(c *gin.Context) {
+	hours := 24
+	if v := c.Query("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 24*90 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "hours must be between 1 and 2160"})
+			return
+		}
+		hours = n
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	categories, err := h.cdrRepo.GetDispositionCounts(ctx, since)
+	if err != nil {
+		h.logger.Errorf("Error fetching disposition counts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load disposition stats"})
+		return
+	}
+
+	total := 0
+	faults := make(map[string]int)
+	for category, count := range categories {
+		total += count
+		faults[models.DispositionFault(category)] += count
+	}
+	rate := func(n int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(total)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"since":                    since,
+		"total":                    total,
+		"categories":               categories,
+		"faults":                   faults,
+		"answer_seizure_ratio":     rate(categories[models.DispositionCategoryAnswered]),
+		"gateway_failure_rate":     rate(faults[models.DispositionFaultGateway]),
+		"network_failure_rate":     rate(faults[models.DispositionFaultNetwork]),
+		"destination_failure_rate": rate(faults[models.DispositionFaultDestination]),
+	})
+}
+
+// GetCDROutboxStats handles GET /api/v1/stats/cdr-outbox
+// It reports how many CDRs are waiting on disk to be written to the database.
+func (h *StatsHandler) GetCDROutboxStats(c *gin.Context) {
+	if h.cdrOutbox == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false, "pending": 0})
+		return
+	}
+	stats := h.cdrOutbox.Stats()
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "pending": stats.Pending, "outbox": stats})
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// ussdRequestTimeout bounds a USSD request; the service gives the network
+// 30 seconds to answer.
+const ussdRequestTimeout = 45 * time.Second
+
+// USSDHandler handles API requests for USSD sessions on SIM cards.
+type USSDHandler struct {
+	ussdRepo repository.USSDRepository
+	service  *ussd.Service
+	logger   *logrus.Logger
+}
+
+// NewUSSDHandler creates a new instance of USSDHandler.
+func NewUSSDHandler(ussdRepo repository.USSDRepository, service *ussd.Service, logger *logrus.Logger) *USSDHandler {
+	return &USSDHandler{
+		ussdRepo: ussdRepo,
+		service:  service,
+		logger:   logger,
+	}
+}
+
+// SendUSSD handles POST /api/v1/sims/:id/ussd. It sends a code, or a
+// choice in the SIM's open menu, and returns the network's response with
+// the values read from it.
+func (h *USSDHandler) SendUSSD(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+	var req ussd.Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), ussdRequestTimeout)
+	defer cancel()
+
+	result, err := h.service.Send(ctx, id, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "SIM card not found"})
+		case errors.Is(err, ussd.ErrInvalidCode):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ussd.ErrNoModem), errors.Is(err, ussd.ErrBusy), errors.Is(err, ussd.ErrSessionClosed):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ussd.ErrNoReply):
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error(), "result": result})
+		case errors.Is(err, ussd.ErrNotSent):
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "result": result})
+		default:
+			h.logger.WithError(err).Errorf("Failed to send USSD on SIM card %d", id)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send USSD"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetUSSDLog handles GET /api/v1/sims/:id/ussd: the latest exchanges of a
+// SIM card and its open session, if any.
+func (h *USSDHandler) GetUSSDLog(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	exchanges, err := h.ussdRepo.ListExchanges(ctx, id, limit)
+	if err != nil {
+		h.logger.WithError(err).Errorf("Failed to fetch USSD exchanges of SIM card %d", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch USSD exchanges"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"sim_card_id":  id,
+		"open_session": h.service.OpenSession(id),
+		"exchanges":    exchanges,
+		"count":        len(exchanges),
+	})
+}
+
+// CloseUSSDSession handles DELETE /api/v1/sims/:id/ussd
+func (h *USSDHandler) CloseUSSDSession(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SIM card ID"})
+		return
+	}
+	if err := h.service.CloseSession(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SIM card has no open USSD session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "USSD session closed"})
+}
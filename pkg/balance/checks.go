@@ -0,0 +1,113 @@
+package balance
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Check is how the balance of an operator's SIM cards is asked for: a USSD
+// code, or a message to the operator whose reply carries the balance. The
+// response is read with the operator's USSD template.
+type Check struct {
+	Name      string   `json:"name"`
+	Operators []string `json:"operators"`            // matched case-insensitively against the SIM's operator name; none matches any operator
+	USSD      string   `json:"ussd,omitempty"`       // balance code, e.g. "*580#"
+	SMSNumber string   `json:"sms_number,omitempty"` // or a message to this number...
+	SMSText   string   `json:"sms_text,omitempty"`   // ...with this text
+	Senders   []string `json:"senders,omitempty"`    // numbers or names the operator sends balance notices from, besides SMSNumber
+	Interval  string   `json:"interval,omitempty"`   // time between checks, e.g. "6h"; the poller's interval when empty
+
+	interval time.Duration
+}
+
+// usesSMS reports whether the balance is asked for by message.
+func (c *Check) usesSMS() bool {
+	return c.USSD == "" && c.SMSNumber != ""
+}
+
+// fromOperator reports whether a message sender is the number balance
+// requests go to or one of the check's balance notice senders.
+func (c *Check) fromOperator(sender string) bool {
+	sender = strings.TrimPrefix(sender, "+")
+	if sender == "" {
+		return false
+	}
+	if c.SMSNumber != "" && strings.EqualFold(strings.TrimPrefix(c.SMSNumber, "+"), sender) {
+		return true
+	}
+	for _, s := range c.Senders {
+		if strings.EqualFold(strings.TrimPrefix(s, "+"), sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks picks the check for a SIM's operator.
+type Checks struct {
+	list []*Check
+}
+
+// LoadChecks reads checks from a JSON file holding an array of Check.
+// Codes differ between operators and change over time, so none are built
+// in.
+func LoadChecks(path string) (*Checks, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read balance checks: %w", err)
+	}
+	var list []Check
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse balance checks %s: %w", path, err)
+	}
+	return NewChecks(list)
+}
+
+// NewChecks validates a list of checks.
+func NewChecks(list []Check) (*Checks, error) {
+	c := &Checks{}
+	for i := range list {
+		check := list[i]
+		if check.USSD == "" && (check.SMSNumber == "" || check.SMSText == "") {
+			return nil, fmt.Errorf("balance check %q: needs a USSD code or an SMS number and text", check.Name)
+		}
+		if check.Interval != "" {
+			d, err := time.ParseDuration(check.Interval)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("balance check %q: bad interval %q", check.Name, check.Interval)
+			}
+			check.interval = d
+		}
+		c.list = append(c.list, &check)
+	}
+	return c, nil
+}
+
+// Len returns the number of checks.
+func (c *Checks) Len() int {
+	return len(c.list)
+}
+
+// For returns the check of an operator: the first whose operator names it
+// contains, else the first without operator names, nil if none.
+func (c *Checks) For(operator string) *Check {
+	operator = strings.ToLower(operator)
+	var fallback *Check
+	for _, check := range c.list {
+		if len(check.Operators) == 0 {
+			if fallback == nil {
+				fallback = check
+			}
+			continue
+		}
+		for _, name := range check.Operators {
+			if operator != "" && strings.Contains(operator, strings.ToLower(name)) {
+				return check
+			}
+		}
+	}
+	return fallback
+}
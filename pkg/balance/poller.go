@@ -0,0 +1,459 @@
+// Package balance keeps the balance of the gateway's SIM cards up to date:
+// it asks each operator for the credit of its SIMs on a schedule, through a
+// USSD code or an SMS, records every balance read and raises an alert when
+// one runs low.
+package balance
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// scheduleInterval is how often due SIM cards are looked for.
+	scheduleInterval = time.Minute
+	// checkTimeout bounds a USSD check, which waits up to 30 seconds for
+	// the network.
+	checkTimeout = 45 * time.Second
+	// smsReplyTimeout is how long the operator gets to answer a balance
+	// request sent by SMS.
+	smsReplyTimeout = 10 * time.Minute
+)
+
+var (
+	// ErrNoCheck is returned for a SIM card whose operator has no balance
+	// check.
+	ErrNoCheck = errors.New("balance: no balance check for the SIM's operator")
+	// ErrNoBalance is returned when the response holds no balance.
+	ErrNoBalance = errors.New("balance: no balance in the response")
+	// ErrBusy is returned while the SIM's modem is being checked.
+	ErrBusy = errors.New("balance: a check is running on the SIM's modem")
+	// ErrNoModem is returned for a SIM card that is not in a modem.
+	ErrNoModem = errors.New("balance: SIM card is not in a modem")
+)
+
+// Options configures a Poller.
+type Options struct {
+	Interval      time.Duration // time between checks of a SIM, unless its check sets one
+	Threshold     float64       // a balance below this raises an alert; 0 disables the alert
+	RetryAfter    time.Duration // wait before checking again after a failed check
+	MaxConcurrent int           // checks running at once, each on its own modem
+}
+
+// DefaultOptions returns a check every six hours, two at a time, and an
+// alert below 5 units of credit.
+func DefaultOptions() Options {
+	return Options{
+		Interval:      6 * time.Hour,
+		Threshold:     5,
+		RetryAfter:    30 * time.Minute,
+		MaxConcurrent: 2,
+	}
+}
+
+// USSDService enters USSD codes on SIM cards. *ussd.Service implements it.
+type USSDService interface {
+	Send(ctx context.Context, simID int64, req ussd.Request) (*ussd.Result, error)
+	CloseSession(simID int64) error
+	Templates() *ussd.Templates
+}
+
+// SMSService sends SMS from SIM cards. *sms.Service implements it.
+type SMSService interface {
+	Send(ctx context.Context, req sms.SendRequest) (*models.SMSMessage, error)
+}
+
+// LowFunc is called when a SIM card's balance falls below the threshold.
+type LowFunc func(ctx context.Context, sim *models.SIMCard, reading *models.SIMBalanceReading)
+
+// Poller checks the balance of every active SIM card in a modem. Checks
+// run one per modem and at most opts.MaxConcurrent at once; SIM cards never
+// checked before are spread over the interval instead of all being due at
+// start.
+type Poller struct {
+	simRepo   repository.SIMCardRepository
+	alertRepo repository.AlertRepository
+	ussd      USSDService
+	sms       SMSService
+	checks    *Checks
+	opts      Options
+	logger    *logrus.Logger
+	onLow     []LowFunc
+
+	mu       sync.Mutex
+	running  map[int64]bool      // modems being checked, by modem ID
+	retryAt  map[int64]time.Time // SIM cards whose last check failed, by SIM ID
+	awaiting map[int64]time.Time // SIM cards waiting for an SMS reply, until the deadline
+	low      map[int64]bool      // whether a SIM's low-balance alert is raised; absent if unknown
+	firstAt  time.Time           // start of the spread of never-checked SIM cards
+
+	started bool
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewPoller creates a Poller asking for balances through the USSD and SMS
+// services. checks may be nil when none are configured.
+func NewPoller(simRepo repository.SIMCardRepository, alertRepo repository.AlertRepository, ussdService USSDService, smsService SMSService, checks *Checks, opts Options, logger *logrus.Logger) *Poller {
+	if checks == nil {
+		checks = &Checks{}
+	}
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Poller{
+		simRepo:   simRepo,
+		alertRepo: alertRepo,
+		ussd:      ussdService,
+		sms:       smsService,
+		checks:    checks,
+		opts:      opts,
+		logger:    logger,
+		running:   make(map[int64]bool),
+		retryAt:   make(map[int64]time.Time),
+		awaiting:  make(map[int64]time.Time),
+		low:       make(map[int64]bool),
+		firstAt:   time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// OnLow registers fn to be called when a balance falls below the
+// threshold, e.g. to recharge the SIM. Call before Start.
+func (p *Poller) OnLow(fn LowFunc) {
+	p.onLow = append(p.onLow, fn)
+}
+
+// Start checks due SIM cards in the background.
+func (p *Poller) Start() {
+	if p.checks.Len() == 0 {
+		p.logger.Warn("No balance checks configured; SIM balances are not polled")
+	}
+	p.firstAt = time.Now()
+	p.started = true
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(scheduleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				p.schedule(p.ctx, now)
+			case <-p.ctx.Done():
+				p.wg.Wait()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops scheduling checks and waits for the running ones.
+func (p *Poller) Stop() {
+	p.cancel()
+	if p.started {
+		<-p.done
+	}
+}
+
+// dueSIM is a SIM card whose balance is due to be checked.
+type dueSIM struct {
+	sim   models.SIMCard
+	check *Check
+	due   time.Time
+}
+
+// schedule starts the checks of the SIM cards that are due, most overdue
+// first, as far as free modems and opts.MaxConcurrent allow.
+func (p *Poller) schedule(ctx context.Context, now time.Time) {
+	if p.checks.Len() == 0 {
+		return
+	}
+	sims, err := p.simRepo.GetAllSIMCards(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			p.logger.WithError(err).Warn("Failed to list SIM cards for balance checks")
+		}
+		return
+	}
+
+	p.mu.Lock()
+	for simID, deadline := range p.awaiting {
+		if now.After(deadline) {
+			delete(p.awaiting, simID)
+			p.retryAt[simID] = now.Add(p.opts.RetryAfter)
+			p.logger.WithField("sim_card_id", simID).Warn("No balance reply from the operator")
+		}
+	}
+	var due []dueSIM
+	for _, sim := range sims {
+		if sim.Status != models.SIMStatusActive || !sim.ModemID.Valid {
+			continue
+		}
+		check := p.checks.For(sim.OperatorName.String)
+		if check == nil || p.running[sim.ModemID.Int64] {
+			continue
+		}
+		if _, waiting := p.awaiting[sim.ID]; waiting {
+			continue
+		}
+		next := p.nextCheck(&sim, check)
+		if retry, ok := p.retryAt[sim.ID]; ok && retry.After(next) {
+			next = retry
+		}
+		if !next.After(now) {
+			due = append(due, dueSIM{sim: sim, check: check, due: next})
+		}
+	}
+	p.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].due.Before(due[j].due) })
+	for _, d := range due {
+		if !p.reserve(d.sim.ModemID.Int64) {
+			continue
+		}
+		p.wg.Add(1)
+		go func(d dueSIM) {
+			defer p.wg.Done()
+			defer p.release(d.sim.ModemID.Int64)
+			if _, err := p.run(ctx, &d.sim, d.check); err != nil && !errors.Is(err, ErrBusy) && ctx.Err() == nil {
+				p.logger.WithError(err).WithField("sim_card_id", d.sim.ID).Warn("Balance check failed")
+			}
+		}(d)
+	}
+}
+
+// nextCheck returns when a SIM card's balance is next due. A SIM never
+// checked gets a fixed place within the first interval, so a fresh start
+// does not check them all at once.
+func (p *Poller) nextCheck(sim *models.SIMCard, check *Check) time.Time {
+	interval := p.opts.Interval
+	if check.interval > 0 {
+		interval = check.interval
+	}
+	if sim.BalanceLastCheckedAt.Valid {
+		return sim.BalanceLastCheckedAt.Time.Add(interval)
+	}
+	// Fibonacci hashing scatters consecutive IDs across the interval.
+	frac := float64(uint64(sim.ID)*0x9E3779B97F4A7C15>>11) / (1 << 53)
+	return p.firstAt.Add(time.Duration(frac * float64(interval)))
+}
+
+// reserve claims a modem for a check, if it is free and a check slot is
+// left.
+func (p *Poller) reserve(modemID int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running[modemID] || len(p.running) >= p.opts.MaxConcurrent {
+		return false
+	}
+	p.running[modemID] = true
+	return true
+}
+
+func (p *Poller) release(modemID int64) {
+	p.mu.Lock()
+	delete(p.running, modemID)
+	p.mu.Unlock()
+}
+
+// CheckNow checks the balance of a SIM card at once. For a check by SMS the
+// request is sent and a nil reading returned; the balance is recorded when
+// the operator replies.
+func (p *Poller) CheckNow(ctx context.Context, simID int64) (*models.SIMBalanceReading, error) {
+	sim, err := p.simRepo.GetSIMCardByID(ctx, simID)
+	if err != nil {
+		return nil, err
+	}
+	if !sim.ModemID.Valid {
+		return nil, ErrNoModem
+	}
+	check := p.checks.For(sim.OperatorName.String)
+	if check == nil {
+		return nil, ErrNoCheck
+	}
+	if !p.reserve(sim.ModemID.Int64) {
+		return nil, ErrBusy
+	}
+	defer p.release(sim.ModemID.Int64)
+	return p.run(ctx, sim, check)
+}
+
+// run checks one SIM card. A failed check is retried after
+// opts.RetryAfter.
+func (p *Poller) run(ctx context.Context, sim *models.SIMCard, check *Check) (*models.SIMBalanceReading, error) {
+	logger := p.logger.WithFields(logrus.Fields{"sim_card_id": sim.ID, "balance_check": check.Name})
+	if check.usesSMS() {
+		_, err := p.sms.Send(ctx, sms.SendRequest{To: check.SMSNumber, Text: check.SMSText, SIMCardID: sim.ID})
+		p.mu.Lock()
+		if err != nil {
+			p.retryAt[sim.ID] = time.Now().Add(p.opts.RetryAfter)
+		} else {
+			p.awaiting[sim.ID] = time.Now().Add(smsReplyTimeout)
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("balance request to %s: %w", check.SMSNumber, err)
+		}
+		logger.Debugf("Balance requested from %s", check.SMSNumber)
+		return nil, nil
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	result, err := p.ussd.Send(checkCtx, sim.ID, ussd.Request{Code: check.USSD})
+	if result != nil && result.MenuOpen {
+		// Balance codes answer at once; leave no menu hanging.
+		p.ussd.CloseSession(sim.ID)
+	}
+	if errors.Is(err, ussd.ErrBusy) {
+		// Someone else is using the modem; try again next round.
+		return nil, ErrBusy
+	}
+	if err == nil && (result.Parsed == nil || result.Parsed.Balance == nil) {
+		err = fmt.Errorf("%w: %q", ErrNoBalance, result.Exchange.Response.String)
+	}
+	if err != nil {
+		p.mu.Lock()
+		p.retryAt[sim.ID] = time.Now().Add(p.opts.RetryAfter)
+		p.mu.Unlock()
+		return nil, err
+	}
+
+	reading := &models.SIMBalanceReading{
+		SIMCardID: sim.ID,
+		Balance:   *result.Parsed.Balance,
+		Currency:  sql.NullString{String: result.Parsed.Currency, Valid: result.Parsed.Currency != ""},
+		Source:    models.SIMBalanceSourceUSSD,
+		RawText:   result.Exchange.Response,
+		CheckedAt: result.Exchange.RespondedAt.Time,
+	}
+	if result.Parsed.ExpiresAt != nil {
+		reading.ExpiresAt = sql.NullTime{Time: *result.Parsed.ExpiresAt, Valid: true}
+	}
+	if err := p.record(ctx, sim, reading); err != nil {
+		return nil, err
+	}
+	return reading, nil
+}
+
+// HandleSMS reads the balance from a message sent to a SIM card by its
+// operator: the reply to a balance request, from the check's SMS number,
+// or a notice from one of the check's senders, as operators send after
+// calls and recharges. Messages from anyone else are ignored, even while a
+// reply is awaited. Register it with sms.Service.OnReceive.
+func (p *Poller) HandleSMS(ctx context.Context, msg *models.SMSMessage) {
+	if msg.Direction != models.SMSDirectionInbound || !msg.SIMCardID.Valid {
+		return
+	}
+	simID := msg.SIMCardID.Int64
+	sim, err := p.simRepo.GetSIMCardByID(ctx, simID)
+	if err != nil {
+		p.logger.WithError(err).WithField("sim_card_id", simID).Warn("Failed to look up SIM card of SMS")
+		return
+	}
+	check := p.checks.For(sim.OperatorName.String)
+	if check == nil || !check.fromOperator(msg.Number) {
+		return
+	}
+	parsed := p.ussd.Templates().For(sim.OperatorName.String).Parse(msg.Body)
+	if parsed.Balance == nil {
+		// Not every operator message is about the balance; keep waiting
+		// for the reply until the deadline.
+		return
+	}
+
+	p.mu.Lock()
+	delete(p.awaiting, simID)
+	p.mu.Unlock()
+	reading := &models.SIMBalanceReading{
+		SIMCardID: simID,
+		Balance:   *parsed.Balance,
+		Currency:  sql.NullString{String: parsed.Currency, Valid: parsed.Currency != ""},
+		Source:    models.SIMBalanceSourceSMS,
+		RawText:   sql.NullString{String: msg.Body, Valid: true},
+		CheckedAt: msg.CreatedAt,
+	}
+	if reading.CheckedAt.IsZero() {
+		reading.CheckedAt = time.Now()
+	}
+	if parsed.ExpiresAt != nil {
+		reading.ExpiresAt = sql.NullTime{Time: *parsed.ExpiresAt, Valid: true}
+	}
+	if err := p.record(ctx, sim, reading); err != nil {
+		p.logger.WithError(err).WithField("sim_card_id", simID).Error("Failed to record balance from SMS")
+	}
+}
+
+// record stores a balance and raises or resolves the SIM's low-balance
+// alert.
+func (p *Poller) record(ctx context.Context, sim *models.SIMCard, reading *models.SIMBalanceReading) error {
+	if err := p.simRepo.RecordBalance(ctx, reading); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.retryAt, sim.ID)
+	p.mu.Unlock()
+
+	logger := p.logger.WithFields(logrus.Fields{"sim_card_id": sim.ID, "iccid": sim.ICCID})
+	logger.Infof("Balance %.2f %s (%s)", reading.Balance, reading.Currency.String, reading.Source)
+	if p.opts.Threshold <= 0 {
+		return nil
+	}
+
+	entityID := strconv.FormatInt(sim.ID, 10)
+	p.mu.Lock()
+	wasLow, known := p.low[sim.ID]
+	isLow := reading.Balance < p.opts.Threshold
+	p.low[sim.ID] = isLow
+	p.mu.Unlock()
+
+	switch {
+	case isLow && (!known || !wasLow):
+		message := fmt.Sprintf("Balance of SIM %s is %.2f %s, below %.2f", sim.ICCID, reading.Balance, reading.Currency.String, p.opts.Threshold)
+		logger.WithField("alert", models.AlertKindSIMBalanceLow).Warn(message)
+		details, _ := json.Marshal(map[string]interface{}{
+			"iccid":     sim.ICCID,
+			"operator":  sim.OperatorName.String,
+			"balance":   reading.Balance,
+			"currency":  reading.Currency.String,
+			"threshold": p.opts.Threshold,
+		})
+		alert := &models.Alert{
+			Kind:       models.AlertKindSIMBalanceLow,
+			Severity:   models.AlertSeverityWarning,
+			EntityType: models.AlertEntitySIMCard,
+			EntityID:   entityID,
+			Message:    message,
+			Details:    details,
+		}
+		if err := p.alertRepo.RaiseAlert(ctx, alert); err != nil {
+			logger.WithError(err).Error("Failed to raise alert")
+		}
+		for _, fn := range p.onLow {
+			fn(ctx, sim, reading)
+		}
+	case !isLow && (!known || wasLow):
+		if err := p.alertRepo.ResolveAlerts(ctx, models.AlertKindSIMBalanceLow, models.AlertEntitySIMCard, entityID); err != nil {
+			logger.WithError(err).Error("Failed to resolve alert")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package balance
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeSIMRepo holds SIM cards and the balances recorded for them; a
+// recorded balance marks its card checked, as the database does.
+type fakeSIMRepo struct {
+	repository.SIMCardRepository
+
+	mu       sync.Mutex
+	sims     []*models.SIMCard
+	readings []*models.SIMBalanceReading
+}
+
+func (r *fakeSIMRepo) GetAllSIMCards(ctx context.Context) ([]models.SIMCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sims []models.SIMCard
+	for _, sim := range r.sims {
+		sims = append(sims, *sim)
+	}
+	return sims, nil
+}
+
+func (r *fakeSIMRepo) GetSIMCardByID(ctx context.Context, id int64) (*models.SIMCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sim := range r.sims {
+		if sim.ID == id {
+			card := *sim
+			return &card, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (r *fakeSIMRepo) RecordBalance(ctx context.Context, reading *models.SIMBalanceReading) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readings = append(r.readings, reading)
+	for _, sim := range r.sims {
+		if sim.ID == reading.SIMCardID {
+			sim.Balance = sql.NullFloat64{Float64: reading.Balance, Valid: true}
+			sim.BalanceLastCheckedAt = sql.NullTime{Time: reading.CheckedAt, Valid: true}
+		}
+	}
+	return nil
+}
+
+func (r *fakeSIMRepo) recorded() []*models.SIMBalanceReading {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*models.SIMBalanceReading(nil), r.readings...)
+}
+
+// fakeAlertRepo counts the low-balance alerts raised and resolved.
+type fakeAlertRepo struct {
+	repository.AlertRepository
+
+	mu               sync.Mutex
+	raised, resolved int
+}
+
+func (r *fakeAlertRepo) RaiseAlert(ctx context.Context, alert *models.Alert) error {
+	r.mu.Lock()
+	r.raised++
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *fakeAlertRepo) ResolveAlerts(ctx context.Context, kind, entityType, entityID string) error {
+	r.mu.Lock()
+	r.resolved++
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *fakeAlertRepo) counts() (raised, resolved int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.raised, r.resolved
+}
+
+// fakeUSSD answers every code with reply, read with the Maroc Telecom
+// template. While hold is set, answers wait for it to be closed.
+type fakeUSSD struct {
+	mu    sync.Mutex
+	reply string
+	hold  chan struct{}
+	sent  []int64 // SIM card IDs
+}
+
+func (u *fakeUSSD) Send(ctx context.Context, simID int64, req ussd.Request) (*ussd.Result, error) {
+	u.mu.Lock()
+	u.sent = append(u.sent, simID)
+	reply, hold := u.reply, u.hold
+	u.mu.Unlock()
+	if hold != nil {
+		select {
+		case <-hold:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	parsed := ussd.DefaultTemplates().For("IAM").Parse(reply)
+	return &ussd.Result{
+		Session: &models.USSDSession{ID: 1, SIMCardID: simID},
+		Exchange: &models.USSDExchange{
+			SIMCardID:   simID,
+			Request:     req.Code,
+			Response:    sql.NullString{String: reply, Valid: true},
+			RespondedAt: sql.NullTime{Time: time.Now(), Valid: true},
+		},
+		Parsed: &parsed,
+	}, nil
+}
+
+func (u *fakeUSSD) CloseSession(simID int64) error { return nil }
+
+func (u *fakeUSSD) Templates() *ussd.Templates { return ussd.DefaultTemplates() }
+
+func (u *fakeUSSD) answer(reply string) {
+	u.mu.Lock()
+	u.reply = reply
+	u.mu.Unlock()
+}
+
+func (u *fakeUSSD) sentTo() []int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]int64(nil), u.sent...)
+}
+
+// fakeSMS records the balance requests sent; the operator's replies are
+// handed to the poller by the tests.
+type fakeSMS struct {
+	mu   sync.Mutex
+	sent []sms.SendRequest
+}
+
+func (s *fakeSMS) Send(ctx context.Context, req sms.SendRequest) (*models.SMSMessage, error) {
+	s.mu.Lock()
+	s.sent = append(s.sent, req)
+	s.mu.Unlock()
+	return &models.SMSMessage{}, nil
+}
+
+func (s *fakeSMS) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+var (
+	iamCheck    = Check{Name: "iam", Operators: []string{"iam"}, USSD: "*580#"}
+	orangeCheck = Check{Name: "orange", Operators: []string{"orange"}, SMSNumber: "555", SMSText: "SOLDE", Senders: []string{"Orange"}}
+)
+
+type pollerTest struct {
+	poller *Poller
+	sims   *fakeSIMRepo
+	alerts *fakeAlertRepo
+	ussd   *fakeUSSD
+	sms    *fakeSMS
+}
+
+// newPollerTest polls sims with the IAM and Orange checks every six hours,
+// two at a time, retrying after half an hour and alerting below 5.
+func newPollerTest(t *testing.T, sims ...*models.SIMCard) *pollerTest {
+	t.Helper()
+	checks, err := NewChecks([]Check{iamCheck, orangeCheck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	pt := &pollerTest{
+		sims:   &fakeSIMRepo{sims: sims},
+		alerts: &fakeAlertRepo{},
+		ussd:   &fakeUSSD{reply: "Votre solde est de 20,00 DH"},
+		sms:    &fakeSMS{},
+	}
+	pt.poller = NewPoller(pt.sims, pt.alerts, pt.ussd, pt.sms, checks, DefaultOptions(), logger)
+	return pt
+}
+
+// simCard returns an active SIM card of operator in modem, last checked
+// ago, never when ago is 0.
+func simCard(id, modem int64, operator string, ago time.Duration) *models.SIMCard {
+	sim := &models.SIMCard{
+		ID:           id,
+		ModemID:      sql.NullInt64{Int64: modem, Valid: true},
+		ICCID:        "8921200000000000000",
+		OperatorName: sql.NullString{String: operator, Valid: true},
+		Status:       models.SIMStatusActive,
+	}
+	if ago != 0 {
+		sim.BalanceLastCheckedAt = sql.NullTime{Time: time.Now().Add(-ago), Valid: true}
+	}
+	return sim
+}
+
+// scheduleAt runs a scheduling round at now and waits for its checks.
+func (pt *pollerTest) scheduleAt(now time.Time) {
+	pt.poller.schedule(context.Background(), now)
+	pt.poller.wg.Wait()
+}
+
+// waitSent waits until n USSD checks have been sent.
+func waitSent(t *testing.T, u *fakeUSSD, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(u.sentTo()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d checks sent, want %d", len(u.sentTo()), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNextCheckStaggersNeverCheckedSIMs(t *testing.T) {
+	pt := newPollerTest(t)
+	p := pt.poller
+	check := p.checks.For("IAM")
+	interval := p.opts.Interval
+
+	const slices = 12
+	var filled [slices]int
+	for id := int64(1); id <= 120; id++ {
+		next := p.nextCheck(&models.SIMCard{ID: id}, check)
+		offset := next.Sub(p.firstAt)
+		if offset < 0 || offset >= interval {
+			t.Fatalf("SIM %d due %v after start, want within %v", id, offset, interval)
+		}
+		if again := p.nextCheck(&models.SIMCard{ID: id}, check); !again.Equal(next) {
+			t.Fatalf("SIM %d due at %v, then at %v", id, next, again)
+		}
+		filled[offset*slices/interval]++
+	}
+	for i, n := range filled {
+		if n == 0 {
+			t.Errorf("no SIM due in slice %d of the interval: %v", i, filled)
+		}
+	}
+
+	checked := time.Now().Add(-time.Hour)
+	sim := &models.SIMCard{ID: 1, BalanceLastCheckedAt: sql.NullTime{Time: checked, Valid: true}}
+	if next := p.nextCheck(sim, check); !next.Equal(checked.Add(interval)) {
+		t.Errorf("checked SIM due at %v, want the interval after its check", next)
+	}
+	hourly := &Check{Name: "hourly", USSD: "*580#", interval: time.Hour}
+	if next := p.nextCheck(sim, hourly); !next.Equal(checked.Add(time.Hour)) {
+		t.Errorf("checked SIM due at %v, want the check's interval after its check", next)
+	}
+}
+
+func TestScheduleChecksOneSIMPerModem(t *testing.T) {
+	pt := newPollerTest(t,
+		simCard(1, 10, "IAM", 9*time.Hour),
+		simCard(2, 10, "IAM", 8*time.Hour),
+		simCard(3, 11, "IAM", 7*time.Hour),
+		simCard(4, 12, "IAM", 7*time.Hour),
+		simCard(5, 13, "Unknown", 7*time.Hour), // no check
+	)
+	hold := make(chan struct{})
+	pt.ussd.hold = hold
+	now := time.Now()
+
+	pt.poller.schedule(context.Background(), now)
+	waitSent(t, pt.ussd, 2)
+	// A round while the checks run starts none on their modems, nor
+	// beyond the two allowed at once.
+	pt.poller.schedule(context.Background(), now)
+	time.Sleep(20 * time.Millisecond)
+	if sent := pt.ussd.sentTo(); len(sent) != 2 || sent[0]+sent[1] != 4 {
+		t.Fatalf("checked SIMs %v, want 1 and 3: the most overdue, one per modem", sent)
+	}
+	close(hold)
+	pt.poller.wg.Wait()
+
+	pt.scheduleAt(now)
+	if sent := pt.ussd.sentTo(); len(sent) != 4 || sent[2]+sent[3] != 6 {
+		t.Errorf("checked SIMs %v, want 2 and 4 next", sent)
+	}
+	if n := len(pt.sims.recorded()); n != 4 {
+		t.Errorf("%d balances recorded, want 4", n)
+	}
+	pt.scheduleAt(now.Add(time.Hour))
+	if sent := pt.ussd.sentTo(); len(sent) != 4 {
+		t.Errorf("checked SIMs %v, want none again before the interval", sent)
+	}
+}
+
+func TestScheduleRetriesFailedCheck(t *testing.T) {
+	pt := newPollerTest(t, simCard(1, 10, "IAM", 7*time.Hour))
+	pt.ussd.answer("Service momentanement indisponible")
+	now := time.Now()
+
+	pt.scheduleAt(now)
+	pt.scheduleAt(now.Add(time.Minute))
+	if sent := pt.ussd.sentTo(); len(sent) != 1 {
+		t.Fatalf("%d checks sent, want 1 until the retry", len(sent))
+	}
+	pt.ussd.answer("Votre solde est de 20,00 DH")
+	pt.scheduleAt(now.Add(pt.poller.opts.RetryAfter + time.Minute))
+	if sent := pt.ussd.sentTo(); len(sent) != 2 {
+		t.Fatalf("%d checks sent, want a retry after RetryAfter", len(sent))
+	}
+	if readings := pt.sims.recorded(); len(readings) != 1 || readings[0].Balance != 20 {
+		t.Errorf("recorded %d balances, want the retry's 20", len(readings))
+	}
+}
+
+func TestScheduleWaitsForSMSReplyUntilDeadline(t *testing.T) {
+	pt := newPollerTest(t, simCard(1, 10, "Orange", 7*time.Hour))
+	now := time.Now()
+
+	pt.scheduleAt(now)
+	if n := pt.sms.count(); n != 1 {
+		t.Fatalf("%d balance requests sent, want 1", n)
+	}
+	pt.scheduleAt(now.Add(time.Minute))
+	if n := pt.sms.count(); n != 1 {
+		t.Fatalf("%d balance requests sent while the reply is awaited, want 1", n)
+	}
+	// No reply by the deadline: the check failed and is retried later.
+	late := now.Add(smsReplyTimeout + time.Minute)
+	pt.scheduleAt(late)
+	if n := pt.sms.count(); n != 1 {
+		t.Fatalf("%d balance requests sent at the deadline, want 1", n)
+	}
+	pt.scheduleAt(late.Add(pt.poller.opts.RetryAfter + time.Minute))
+	if n := pt.sms.count(); n != 2 {
+		t.Fatalf("%d balance requests sent, want a retry after RetryAfter", n)
+	}
+}
+
+func TestHandleSMSReadsOnlyOperatorMessages(t *testing.T) {
+	pt := newPollerTest(t, simCard(1, 10, "Orange", 7*time.Hour))
+	ctx := context.Background()
+	inbound := func(from, body string) {
+		pt.poller.HandleSMS(ctx, &models.SMSMessage{
+			Direction: models.SMSDirectionInbound,
+			SIMCardID: sql.NullInt64{Int64: 1, Valid: true},
+			Number:    from,
+			Body:      body,
+		})
+	}
+
+	if reading, err := pt.poller.CheckNow(ctx, 1); err != nil || reading != nil {
+		t.Fatalf("CheckNow by SMS = %v, %v; want the request sent", reading, err)
+	}
+	inbound("+212612345678", "Votre solde est de 1,00 DH")
+	inbound("555", "Bienvenue chez Orange")
+	if n := len(pt.sims.recorded()); n != 0 {
+		t.Fatalf("%d balances recorded from a stranger's or a balance-less message", n)
+	}
+	pt.poller.mu.Lock()
+	_, awaited := pt.poller.awaiting[1]
+	pt.poller.mu.Unlock()
+	if !awaited {
+		t.Fatal("reply no longer awaited after messages without a balance from the operator")
+	}
+
+	inbound("555", "Votre solde est de 12,50 DH valable jusqu'au 15/11/2026")
+	readings := pt.sims.recorded()
+	if len(readings) != 1 || readings[0].Balance != 12.5 || readings[0].Currency.String != "MAD" || readings[0].Source != models.SIMBalanceSourceSMS {
+		t.Fatalf("recorded %d balances, want 12.50 MAD from the reply", len(readings))
+	}
+	if !readings[0].ExpiresAt.Valid || readings[0].ExpiresAt.Time.Day() != 15 {
+		t.Errorf("ExpiresAt = %v, want 15/11/2026", readings[0].ExpiresAt)
+	}
+	pt.poller.mu.Lock()
+	_, awaited = pt.poller.awaiting[1]
+	pt.poller.mu.Unlock()
+	if awaited {
+		t.Error("reply still awaited after it came")
+	}
+
+	// Notices from the operator are read unasked; others are not.
+	inbound("orange", "Votre nouveau solde est de 30,00 DH")
+	inbound("0699999999", "Votre solde est de 2,00 DH")
+	pt.poller.HandleSMS(ctx, &models.SMSMessage{
+		Direction: models.SMSDirectionOutbound,
+		SIMCardID: sql.NullInt64{Int64: 1, Valid: true},
+		Number:    "555",
+		Body:      "Votre solde est de 3,00 DH",
+	})
+	if readings := pt.sims.recorded(); len(readings) != 2 || readings[1].Balance != 30 {
+		t.Errorf("recorded %d balances, want the operator's notice only", len(readings))
+	}
+}
+
+func TestLowBalanceAlertIsEdgeTriggered(t *testing.T) {
+	pt := newPollerTest(t, simCard(1, 10, "IAM", time.Hour))
+	var low []float64
+	pt.poller.OnLow(func(ctx context.Context, sim *models.SIMCard, reading *models.SIMBalanceReading) {
+		if sim.ID != 1 {
+			t.Errorf("OnLow for SIM %d", sim.ID)
+		}
+		low = append(low, reading.Balance)
+	})
+
+	steps := []struct {
+		reply            string
+		raised, resolved int
+	}{
+		{"Votre solde est de 3,00 DH", 1, 0},
+		{"Votre solde est de 2,00 DH", 1, 0}, // still low: no new alert
+		{"Votre solde est de 10,00 DH", 1, 1},
+		{"Votre solde est de 12,00 DH", 1, 1}, // still fine: nothing to resolve
+		{"Votre solde est de 4,00 DH", 2, 1},
+	}
+	for i, step := range steps {
+		pt.ussd.answer(step.reply)
+		if _, err := pt.poller.CheckNow(context.Background(), 1); err != nil {
+			t.Fatalf("check %d: %v", i, err)
+		}
+		if raised, resolved := pt.alerts.counts(); raised != step.raised || resolved != step.resolved {
+			t.Errorf("after %q: %d raised, %d resolved; want %d and %d", step.reply, raised, resolved, step.raised, step.resolved)
+		}
+	}
+	if len(low) != 2 || low[0] != 3 || low[1] != 4 {
+		t.Errorf("OnLow called with %v, want 3 then 4", low)
+	}
+}
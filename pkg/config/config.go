@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/e173-gateway/e173_go_gateway/pkg/logging" // Import structured logger
 )
@@ -17,6 +19,39 @@ type AppConfig struct {
 	AsteriskAMIPort string
 	AsteriskAMIUser string
 	AsteriskAMIPass string
+	AMIRecordDir   string // when set, raw AMI message streams are recorded here
+	CDROutboxDir   string // spool for CDRs the database rejected; empty disables it
+	ModemDiscovery bool   // scan this host's USB bus for modems
+	ModemGatewayID string // gateway the modems of this host belong to
+	DongleConfPath string // dongle.conf to rewrite as modems come and go; empty leaves it alone
+	SIMSecretKey   string   // 32-byte key, base64 or hex, encrypting stored SIM PIN/PUK codes
+	SIMDefaultPINs []string // PINs tried on SIMs whose own PIN is missing or wrong
+	SIMDefaultPINLimit int  // at most this many default PINs are tried per SIM
+	RadioPollInterval  time.Duration // how often modem signal and cell are polled; 0 disables
+	WeakSignalDBM      int           // signal below this raises an alarm...
+	WeakSignalFor      time.Duration // ...once it stayed there this long
+	RegistrationFlapChanges int           // registration changes within the window that raise an alarm
+	RegistrationFlapWindow  time.Duration
+	RadioRetentionDays int // radio readings are kept this many days
+	ModemHealth           bool          // run the modem health state machine and its recovery actions
+	ModemCallFailureLimit int           // consecutive failed calls that degrade a modem; twice as many fail it
+	ModemATTimeoutLimit   int           // consecutive AT timeouts that fail a modem
+	ModemInitTimeout      time.Duration // a modem not registered this long after initializing is failed
+	ModemDegradedFor      time.Duration // a modem unregistered or failing calls this long is failed
+	ModemRecoveryWait     time.Duration // time each recovery action gets to bring a modem back
+	ModemMaxRecoveries    int           // recoveries within the window before a modem is quarantined
+	ModemRecoveryWindow   time.Duration
+	USBHubController      string // "uhubctl" to power-cycle USB ports as the last recovery step; empty disables
+	UhubctlPath           string
+	SMSReadModems bool // read (and delete) the messages stored on local modems chan_dongle does not hold
+	USSDTemplatesFile string // JSON file of per-operator USSD response templates; empty uses the built-in ones
+	BalanceChecksFile      string        // JSON file of per-operator balance checks (USSD code or SMS)
+	BalancePollInterval    time.Duration // time between balance checks of a SIM; 0 disables polling
+	BalancePollConcurrency int           // balance checks running at once
+	LowBalanceThreshold    float64       // a SIM balance below this raises an alert; 0 disables it
+	RechargeScenariosFile string        // YAML file of per-operator recharge scenarios
+	AutoRechargeInterval  time.Duration // how often SIMs with auto-recharge enabled are checked; 0 only on low-balance events
+	VoucherLowStock       int           // fewer available vouchers of an operator raise an alert; 0 disables it
 	GinMode        string // "debug" or "release"
 	LogLevel       string // e.g., "debug", "info", "warn", "error"
 	LogFormat      string // "json" or "text"
@@ -34,6 +69,39 @@ func LoadConfig() *AppConfig {
 		AsteriskAMIPort: getEnv("ASTERISK_AMI_PORT", "5038"),
 		AsteriskAMIUser: getEnv("ASTERISK_AMI_USER", "admin"),
 		AsteriskAMIPass: getEnv("ASTERISK_AMI_PASS", "adminpass"), // Example, use secrets management in production
+		AMIRecordDir:   getEnv("AMI_RECORD_DIR", ""),
+		CDROutboxDir:   getEnv("CDR_OUTBOX_DIR", "data/cdr-outbox"),
+		ModemDiscovery: getEnvAsBool("MODEM_DISCOVERY", false),
+		ModemGatewayID: getEnv("MODEM_GATEWAY_ID", ""),
+		DongleConfPath: getEnv("DONGLE_CONF_PATH", ""),
+		SIMSecretKey:   getEnv("SIM_SECRET_KEY", ""),
+		SIMDefaultPINs: getEnvAsList("SIM_DEFAULT_PINS", nil),
+		SIMDefaultPINLimit: getEnvAsInt("SIM_DEFAULT_PIN_LIMIT", 1),
+		RadioPollInterval:  getEnvAsDuration("RADIO_POLL_INTERVAL", time.Minute),
+		WeakSignalDBM:      getEnvAsInt("WEAK_SIGNAL_DBM", -95),
+		WeakSignalFor:      getEnvAsDuration("WEAK_SIGNAL_FOR", 5*time.Minute),
+		RegistrationFlapChanges: getEnvAsInt("REGISTRATION_FLAP_CHANGES", 4),
+		RegistrationFlapWindow:  getEnvAsDuration("REGISTRATION_FLAP_WINDOW", 15*time.Minute),
+		RadioRetentionDays: getEnvAsInt("RADIO_RETENTION_DAYS", 30),
+		ModemHealth:           getEnvAsBool("MODEM_HEALTH", true),
+		ModemCallFailureLimit: getEnvAsInt("MODEM_CALL_FAILURE_LIMIT", 3),
+		ModemATTimeoutLimit:   getEnvAsInt("MODEM_AT_TIMEOUT_LIMIT", 3),
+		ModemInitTimeout:      getEnvAsDuration("MODEM_INIT_TIMEOUT", 3*time.Minute),
+		ModemDegradedFor:      getEnvAsDuration("MODEM_DEGRADED_FOR", 5*time.Minute),
+		ModemRecoveryWait:     getEnvAsDuration("MODEM_RECOVERY_WAIT", 2*time.Minute),
+		ModemMaxRecoveries:    getEnvAsInt("MODEM_MAX_RECOVERIES", 3),
+		ModemRecoveryWindow:   getEnvAsDuration("MODEM_RECOVERY_WINDOW", 24*time.Hour),
+		USBHubController:      getEnv("USB_HUB_CONTROLLER", ""),
+		UhubctlPath:           getEnv("UHUBCTL_PATH", "uhubctl"),
+		SMSReadModems: getEnvAsBool("SMS_READ_MODEMS", true),
+		USSDTemplatesFile: getEnv("USSD_TEMPLATES_FILE", ""),
+		BalanceChecksFile:      getEnv("BALANCE_CHECKS_FILE", ""),
+		BalancePollInterval:    getEnvAsDuration("BALANCE_POLL_INTERVAL", 6*time.Hour),
+		BalancePollConcurrency: getEnvAsInt("BALANCE_POLL_CONCURRENCY", 2),
+		LowBalanceThreshold:    getEnvAsFloat("LOW_BALANCE_THRESHOLD", 5),
+		RechargeScenariosFile: getEnv("RECHARGE_SCENARIOS_FILE", ""),
+		AutoRechargeInterval:  getEnvAsDuration("AUTO_RECHARGE_INTERVAL", 30*time.Minute),
+		VoucherLowStock:       getEnvAsInt("VOUCHER_LOW_STOCK", 10),
 		GinMode:        getEnv("GIN_MODE", "debug"),
 		LogLevel:       getEnv("LOG_LEVEL", "info"),
 		LogFormat:      getEnv("LOG_FORMAT", "text"),
@@ -68,6 +136,51 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvAsBool retrieves an environment variable as a bool or returns a default value.
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if valueStr, exists := os.LookupEnv(key); exists {
+		if value, err := strconv.ParseBool(valueStr); err == nil {
+			return value
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsDuration retrieves an environment variable as a duration (e.g. "90s", "5m") or returns a default value.
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if valueStr, exists := os.LookupEnv(key); exists {
+		if value, err := time.ParseDuration(valueStr); err == nil {
+			return value
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsFloat retrieves an environment variable as a float or returns a default value.
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if valueStr, exists := os.LookupEnv(key); exists {
+		if value, err := strconv.ParseFloat(valueStr, 64); err == nil {
+			return value
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsList retrieves a comma-separated environment variable as a list or returns a default value.
+func getEnvAsList(key string, defaultValue []string) []string {
+	valueStr, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	var values []string
+	for _, v := range strings.Split(valueStr, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 // scrubbedConfigForLog returns a copy of the config with sensitive fields redacted for logging.
 func scrubbedConfigForLog(cfg *AppConfig) AppConfig {
 	safeCfg := *cfg
@@ -80,5 +193,11 @@ func scrubbedConfigForLog(cfg *AppConfig) AppConfig {
 	if safeCfg.JWTSecret != "" {
 		safeCfg.JWTSecret = "****"
 	}
+	if safeCfg.SIMSecretKey != "" {
+		safeCfg.SIMSecretKey = "****"
+	}
+	if len(safeCfg.SIMDefaultPINs) > 0 {
+		safeCfg.SIMDefaultPINs = []string{"****"}
+	}
 	return safeCfg
 }
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Alert is a condition on a SIM card, modem, gateway or the vouchers of a
+// mobile operator that needs attention. An alert stays open until it is
+// resolved; raising the same kind of alert on the same entity again
+// refreshes the open one.
+type Alert struct {
+	ID         int64           `json:"id" db:"id"`
+	Kind       string          `json:"kind" db:"kind"`               // AlertKind*
+	Severity   string          `json:"severity" db:"severity"`       // AlertSeverity*
+	EntityType string          `json:"entity_type" db:"entity_type"` // AlertEntity*
+	EntityID   string          `json:"entity_id" db:"entity_id"`
+	Message    string          `json:"message" db:"message"`
+	Details    json.RawMessage `json:"details,omitempty" db:"details"`
+	Count      int             `json:"count" db:"count"` // times raised while open
+	CreatedAt  time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at" db:"updated_at"`
+	ResolvedAt *time.Time      `json:"resolved_at,omitempty" db:"resolved_at"`
+}
+
+// Alert severities
+const (
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+)
+
+// Alert entity types
+const (
+	AlertEntitySIMCard  = "sim_card"
+	AlertEntityModem    = "modem"
+	AlertEntityGateway  = "gateway"
+	AlertEntityOperator = "operator"
+)
+
+// Alert kinds
+const (
+	AlertKindSIMPINAttemptsLow = "sim-pin-attempts-low" // unlocking stopped to keep the SIM from PUK-locking
+	AlertKindSIMPINRejected    = "sim-pin-rejected"     // the stored and default PINs were all wrong
+	AlertKindSIMPINMissing     = "sim-pin-missing"      // a SIM wants a PIN and none is known
+	AlertKindSIMPUKLocked      = "sim-puk-locked"       // the SIM needs its PUK
+	AlertKindSIMBalanceLow     = "sim-balance-low"      // the balance fell below the threshold
+
+	AlertKindModemSignalWeak       = "modem-signal-weak"       // signal stayed below the threshold
+	AlertKindModemRegistrationFlap = "modem-registration-flap" // the modem keeps losing the network
+	AlertKindModemFailed           = "modem-failed"            // the modem stopped working; recovery is running
+	AlertKindModemQuarantined      = "modem-quarantined"       // recovery gave up on the modem
+
+	AlertKindVoucherStockLow = "voucher-stock-low" // few vouchers of an operator are left
+)
@@ -26,6 +26,8 @@ type Cdr struct {
 	EndTime              *time.Time `json:"end_time,omitempty"`
 	Duration             *int       `json:"duration,omitempty"`          // Total call duration in seconds
 	BillableSeconds      *int       `json:"billable_seconds,omitempty"` // Billable duration in seconds
+	PostDialDelayMs      *int       `json:"post_dial_delay_ms,omitempty"` // DialBegin to ringing/answer in milliseconds
+	GatewayID            *string    `json:"gateway_id,omitempty"` // Gateway whose AMI reported the call
 	ModemID              *int       `json:"modem_id,omitempty"`
 	SimCardID            *int       `json:"sim_card_id,omitempty"`
 	CallDirection        *string    `json:"call_direction,omitempty"` // "inbound", "outbound"
@@ -39,6 +41,7 @@ type Cdr struct {
 	Priority             *int       `json:"priority,omitempty"`
 	RawEventData         []byte     `json:"raw_event_data,omitempty"` // Storing as JSONB, so []byte for raw JSON
 	Disposition          *string    `json:"disposition,omitempty"`    // Added based on AMIService logic
+	DispositionCategory  *string    `json:"disposition_category,omitempty"` // Normalized outcome, one of the DispositionCategory* values
 }
 
 // Constants for CallDirection (can be moved or kept here)
@@ -55,3 +58,54 @@ const (
 	CallDispositionBusy     = "BUSY"
 	CallDispositionFailed   = "FAILED"
 )
+
+// Normalized call outcomes stored in DispositionCategory. They are derived
+// from Q.850 hangup causes, chan_dongle call end reasons and SIP response
+// codes, so that e.g. a busy destination can be told apart from a barred SIM.
+const (
+	DispositionCategoryAnswered              = "answered"
+	DispositionCategoryBusy                  = "busy"
+	DispositionCategoryNoAnswer              = "no-answer"
+	DispositionCategoryCancelled             = "cancelled"
+	DispositionCategoryRejected              = "rejected"
+	DispositionCategoryUnallocatedNumber     = "unallocated-number"
+	DispositionCategoryInvalidNumber         = "invalid-number"
+	DispositionCategorySubscriberAbsent      = "subscriber-absent"
+	DispositionCategoryDestinationOutOfOrder = "destination-out-of-order"
+	DispositionCategoryNetworkCongestion     = "network-congestion"
+	DispositionCategoryGatewayUnavailable    = "gateway-unavailable"
+	DispositionCategorySIMBarred             = "sim-barred"
+	DispositionCategoryNoCredit              = "no-credit"
+	DispositionCategoryFailed                = "failed"
+)
+
+// Parties a call failure is attributed to, see DispositionFault.
+const (
+	DispositionFaultNone        = "none"        // the call was answered
+	DispositionFaultCaller      = "caller"      // the caller gave up
+	DispositionFaultDestination = "destination" // the called party or number
+	DispositionFaultNetwork     = "network"     // the mobile or SIP network
+	DispositionFaultGateway     = "gateway"     // our dongles or SIM cards
+	DispositionFaultUnknown     = "unknown"
+)
+
+// DispositionFault returns who a disposition category is attributed to.
+// Failure rates that matter for the gateway are those with DispositionFaultGateway.
+func DispositionFault(category string) string {
+	switch category {
+	case DispositionCategoryAnswered:
+		return DispositionFaultNone
+	case DispositionCategoryCancelled:
+		return DispositionFaultCaller
+	case DispositionCategoryBusy, DispositionCategoryNoAnswer, DispositionCategoryRejected,
+		DispositionCategoryUnallocatedNumber, DispositionCategoryInvalidNumber,
+		DispositionCategorySubscriberAbsent, DispositionCategoryDestinationOutOfOrder:
+		return DispositionFaultDestination
+	case DispositionCategoryNetworkCongestion:
+		return DispositionFaultNetwork
+	case DispositionCategoryGatewayUnavailable, DispositionCategorySIMBarred, DispositionCategoryNoCredit:
+		return DispositionFaultGateway
+	default:
+		return DispositionFaultUnknown
+	}
+}
@@ -20,12 +20,22 @@ type Gateway struct {
 	LastError   *string    `json:"last_error" db:"last_error"`
 	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+
+	// SIP routing: where the SIP server sends calls and what its OPTIONS probes found
+	SIPEndpoint     *string    `json:"sip_endpoint" db:"sip_endpoint"`   // Asterisk SIP host, AMIHost when nil
+	SIPPort         int        `json:"sip_port" db:"sip_port"`
+	SIPTransport    string     `json:"sip_transport" db:"sip_transport"` // UDP, TCP, TLS
+	SIPWeight       int        `json:"sip_weight" db:"sip_weight"`       // share of calls among gateways of the same priority
+	SIPPriority     int        `json:"sip_priority" db:"sip_priority"`   // lower first; higher ones take calls when those are down
+	HealthStatus    string     `json:"health_status" db:"health_status"` // up, down, unknown
+	HealthLastCheck *time.Time `json:"health_last_check" db:"health_last_check"`
+	SIPLatencyMs    *int       `json:"sip_latency_ms" db:"sip_latency_ms"`
+	UptimePercent   float64    `json:"uptime_percent" db:"uptime_percent"` // over the last 24 hours
 	
 	// Runtime stats (not stored in DB)
 	ActiveCalls    int     `json:"active_calls" db:"-"`
 	OnlineModems   int     `json:"online_modems" db:"-"`
 	TotalModems    int     `json:"total_modems" db:"-"`
-	UptimePercent  float64 `json:"uptime_percent" db:"-"`
 }
 
 // Gateway statuses
@@ -34,3 +44,10 @@ const (
 	GatewayStatusOffline = "offline"
 	GatewayStatusError   = "error"
 )
+
+// Gateway SIP health, from the SIP server's OPTIONS probes
+const (
+	GatewayHealthUp      = "up"
+	GatewayHealthDown    = "down"
+	GatewayHealthUnknown = "unknown"
+)
@@ -7,7 +7,11 @@ import (
 // Modem represents the structure of our 'modems' table.
 type Modem struct {
 	ID                          int        `json:"id" db:"id"`
-	DevicePath                  string     `json:"device_path" db:"device_path"`
+	GatewayID                   *string    `json:"gateway_id,omitempty" db:"gateway_id"`
+	DongleName                  *string    `json:"dongle_name,omitempty" db:"dongle_name"` // chan_dongle device name, e.g. "dongle0"
+	DevicePath                  string     `json:"device_path" db:"device_path"` // AT command (data) tty
+	AudioPath                   *string    `json:"audio_path,omitempty" db:"audio_path"`
+	USBPath                     *string    `json:"usb_path,omitempty" db:"usb_path"` // physical USB port, e.g. "1-1.4.2"
 	IMEI                        *string    `json:"imei,omitempty" db:"imei"` // Use pointer for nullable fields
 	IMSI                        *string    `json:"imsi,omitempty" db:"imsi"`
 	Model                       *string    `json:"model,omitempty" db:"model"`
@@ -17,7 +21,55 @@ type Modem struct {
 	NetworkOperatorName         *string    `json:"network_operator_name,omitempty" db:"network_operator_name"`
 	NetworkRegistrationStatus   *string    `json:"network_registration_status,omitempty" db:"network_registration_status"`
 	Status                      string     `json:"status" db:"status"`
+	HealthState                 string     `json:"health_state" db:"health_state"` // ModemHealth*, set by the health monitor
+	HealthChangedAt             *time.Time `json:"health_changed_at,omitempty" db:"health_changed_at"`
 	LastSeenAt                  *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`
 	CreatedAt                   time.Time  `json:"created_at" db:"created_at"`
 	UpdatedAt                   time.Time  `json:"updated_at" db:"updated_at"`
 }
+
+// Modem statuses
+const (
+	ModemStatusOnline  = "online"  // registered and idle
+	ModemStatusBusy    = "busy"    // a call or SMS/USSD is in progress
+	ModemStatusWarning = "warning" // attached but initialising or not registered to the network
+	ModemStatusOffline = "offline" // not connected to the gateway
+	ModemStatusError   = "error"   // the port failed
+)
+
+// Modem health states. Unlike Status, which mirrors chan_dongle, these form
+// a lifecycle driven by the health monitor.
+const (
+	ModemHealthDiscovered   = "discovered"   // known, not heard from yet
+	ModemHealthInitializing = "initializing" // starting up or registering
+	ModemHealthReady        = "ready"        // registered and idle
+	ModemHealthBusy         = "busy"         // in a call
+	ModemHealthDegraded     = "degraded"     // working poorly: weak signal, failing calls, lost registration
+	ModemHealthFailed       = "failed"       // not working; recovery in progress
+	ModemHealthQuarantined  = "quarantined"  // recovery gave up; needs an operator
+)
+
+// ModemHealthTransition records a health state change of a modem, or a
+// recovery action taken on it (then FromState and ToState are equal).
+type ModemHealthTransition struct {
+	ID          int64      `json:"id" db:"id"`
+	ModemID     int        `json:"modem_id" db:"modem_id"`
+	FromState   string     `json:"from_state" db:"from_state"`
+	ToState     string     `json:"to_state" db:"to_state"`
+	Reason      string     `json:"reason" db:"reason"`
+	Action      *string    `json:"action,omitempty" db:"action"` // "reset", "restart" or "power-cycle"
+	ActionError *string    `json:"action_error,omitempty" db:"action_error"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// ModemDeviceMove records a modem found on another tty or USB port than
+// where it was last seen.
+type ModemDeviceMove struct {
+	ID            int64      `json:"id" db:"id"`
+	ModemID       int        `json:"modem_id" db:"modem_id"`
+	OldDevicePath *string    `json:"old_device_path,omitempty" db:"old_device_path"`
+	NewDevicePath string     `json:"new_device_path" db:"new_device_path"`
+	OldUSBPath    *string    `json:"old_usb_path,omitempty" db:"old_usb_path"`
+	NewUSBPath    *string    `json:"new_usb_path,omitempty" db:"new_usb_path"`
+	MovedAt       time.Time  `json:"moved_at" db:"moved_at"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RadioReading is one signal and serving-cell sample of a modem.
+type RadioReading struct {
+	ID           int64          `json:"id" db:"id"`
+	ModemID      int            `json:"modem_id" db:"modem_id"`
+	SIMCardID    sql.NullInt64  `json:"sim_card_id,omitempty" db:"sim_card_id"`
+	SignalDBM    *int           `json:"signal_dbm,omitempty" db:"signal_dbm"` // nil when not detectable
+	Registration string         `json:"registration,omitempty" db:"registration"`
+	Registered   bool           `json:"registered" db:"registered"`
+	OperatorName sql.NullString `json:"operator_name,omitempty" db:"operator_name"`
+	Mode         sql.NullString `json:"mode,omitempty" db:"mode"` // e.g. "WCDMA"
+	LAC          sql.NullString `json:"lac,omitempty" db:"lac"`
+	CellID       sql.NullString `json:"cell_id,omitempty" db:"cell_id"`
+	RecordedAt   time.Time      `json:"recorded_at" db:"recorded_at"`
+}
+
+// SignalPoint summarises the signal readings of a modem over one time bucket.
+type SignalPoint struct {
+	At      time.Time `json:"at"` // start of the bucket
+	AvgDBM  float64   `json:"avg_dbm"`
+	MinDBM  int       `json:"min_dbm"`
+	MaxDBM  int       `json:"max_dbm"`
+	Samples int       `json:"samples"`
+}
+
+// BTSHistoryEntry is one element of SIMCard.BTSInfoHistory: a stretch of
+// time the SIM spent on one cell. Consecutive readings on the same cell are
+// merged into a single entry.
+type BTSHistoryEntry struct {
+	Operator  string    `json:"operator,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	LAC       string    `json:"lac"`
+	CellID    string    `json:"cell_id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Samples   int       `json:"samples"`
+	MinDBM    *int      `json:"min_dbm,omitempty"`
+	MaxDBM    *int      `json:"max_dbm,omitempty"`
+	AvgDBM    *float64  `json:"avg_dbm,omitempty"`
+}
@@ -8,14 +8,16 @@ import (
 // RechargeCode represents a recharge voucher code
 type RechargeCode struct {
 	ID              int64          `json:"id" db:"id"`
-	SimCardID       int64          `json:"sim_card_id" db:"sim_card_id"`
+	SimCardID       *int64         `json:"sim_card_id" db:"sim_card_id"` // set once the code is reserved for a SIM
 	Code            string         `json:"code" db:"code"`
 	Amount          float64        `json:"amount" db:"amount"`
 	Operator        string         `json:"operator" db:"operator"`
-	Status          string         `json:"status" db:"status"` // pending, used, failed, expired
+	Status          string         `json:"status" db:"status"` // available, reserved, used, failed, expired
 	UsedAt          *time.Time     `json:"used_at" db:"used_at"`
 	ExpiryDate      *time.Time     `json:"expiry_date" db:"expiry_date"`
 	ResponseMessage sql.NullString `json:"response_message" db:"response_message"`
+	ReservedAt      *time.Time     `json:"reserved_at" db:"reserved_at"`
+	Attempts        int            `json:"attempts" db:"attempts"` // times the code was entered
 	CreatedBy       int64          `json:"created_by" db:"created_by"`
 	CreatedAt       time.Time      `json:"created_at" db:"created_at"`
 	UpdatedAt       time.Time      `json:"updated_at" db:"updated_at"`
@@ -26,10 +28,12 @@ type RechargeBatch struct {
 	ID          int64     `json:"id" db:"id"`
 	Name        string    `json:"name" db:"name"`
 	Description string    `json:"description" db:"description"`
-	TotalCodes  int       `json:"total_codes" db:"total_codes"`
-	UsedCodes   int       `json:"used_codes" db:"used_codes"`
-	TotalAmount float64   `json:"total_amount" db:"total_amount"`
-	Status      string    `json:"status" db:"status"` // draft, processing, completed, failed
+	Amount      float64   `json:"amount" db:"amount"`           // voucher amount per SIM; 0 takes any
+	TotalCodes  int       `json:"total_codes" db:"total_codes"` // SIM cards to recharge
+	UsedCodes   int       `json:"used_codes" db:"used_codes"`   // SIM cards recharged
+	FailedCodes int       `json:"failed_codes" db:"failed_codes"`
+	TotalAmount float64   `json:"total_amount" db:"total_amount"` // amount recharged
+	Status      string    `json:"status" db:"status"` // draft, processing, completed, failed, cancelled
 	CreatedBy   int64     `json:"created_by" db:"created_by"`
 	StartedAt   *time.Time `json:"started_at" db:"started_at"`
 	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
@@ -37,6 +41,17 @@ type RechargeBatch struct {
 	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
 }
 
+// RechargeBatchItem is a SIM card of a batch and how its recharge went.
+type RechargeBatchItem struct {
+	ID                int64          `json:"id" db:"id"`
+	BatchID           int64          `json:"batch_id" db:"batch_id"`
+	SimCardID         int64          `json:"sim_card_id" db:"sim_card_id"`
+	Status            string         `json:"status" db:"status"` // pending, running, success, failed, skipped
+	RechargeHistoryID *int64         `json:"recharge_history_id" db:"recharge_history_id"`
+	ErrorMessage      sql.NullString `json:"error_message" db:"error_message"`
+	UpdatedAt         time.Time      `json:"updated_at" db:"updated_at"`
+}
+
 // RechargeHistory tracks all recharge attempts
 type RechargeHistory struct {
 	ID             int64          `json:"id" db:"id"`
@@ -51,14 +66,17 @@ type RechargeHistory struct {
 	Status         string         `json:"status" db:"status"` // success, failed, pending
 	ErrorMessage   sql.NullString `json:"error_message" db:"error_message"`
 	Attempts       int            `json:"attempts" db:"attempts"`
-	ProcessedBy    int64          `json:"processed_by" db:"processed_by"`
+	Scenario       sql.NullString `json:"scenario" db:"scenario"` // recharge scenario run, if any
+	Response       sql.NullString `json:"response" db:"response"` // the operator's last answer
+	ProcessedBy    *int64         `json:"processed_by" db:"processed_by"` // nil for automatic recharges
 	ProcessedAt    time.Time      `json:"processed_at" db:"processed_at"`
 }
 
 // Recharge status constants
 const (
-	RechargeStatusPending = "pending"
-	RechargeStatusUsed    = "used"
+	RechargeStatusAvailable = "available"
+	RechargeStatusReserved  = "reserved"
+	RechargeStatusUsed     = "used"
 	RechargeStatusFailed  = "failed"
 	RechargeStatusExpired = "expired"
 	
@@ -66,8 +84,40 @@ const (
 	BatchStatusProcessing = "processing"
 	BatchStatusCompleted  = "completed"
 	BatchStatusFailed     = "failed"
+	BatchStatusCancelled  = "cancelled"
+
+	BatchItemPending = "pending"
+	BatchItemRunning = "running"
+	BatchItemSuccess = "success"
+	BatchItemFailed  = "failed"
+	BatchItemSkipped = "skipped"
 	
 	RechargeMethodUSSD = "ussd"
 	RechargeMethodSMS  = "sms"
 	RechargeMethodAPI  = "api"
-)
\ No newline at end of file
+
+	RechargeResultSuccess = "success"
+	RechargeResultFailed  = "failed"
+	RechargeResultPending = "pending"
+)
+
+// AutoRechargeSIM is a SIM card whose balance fell below its auto-recharge
+// threshold.
+type AutoRechargeSIM struct {
+	SimCardID int64   `json:"sim_card_id" db:"id"`
+	Balance   float64 `json:"balance" db:"balance"`
+	Threshold float64 `json:"threshold" db:"threshold"`
+	Amount    float64 `json:"amount" db:"amount"` // recharge amount configured for the SIM
+}
+
+// VoucherStock counts an operator's vouchers by status.
+type VoucherStock struct {
+	Operator        string  `json:"operator" db:"operator"`
+	Available       int     `json:"available" db:"available"`
+	AvailableAmount float64 `json:"available_amount" db:"available_amount"`
+	ExpiringSoon    int     `json:"expiring_soon" db:"expiring_soon"` // available vouchers expiring within a week
+	Reserved        int     `json:"reserved" db:"reserved"`
+	Used            int     `json:"used" db:"used"`
+	Failed          int     `json:"failed" db:"failed"`
+	Expired         int     `json:"expired" db:"expired"`
+}
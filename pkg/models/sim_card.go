@@ -20,10 +20,10 @@ type SIMCard struct {
 	DataAllowanceMB         sql.NullInt32    `json:"data_allowance_mb,omitempty"`
 	DataUsedMB              sql.NullInt32    `json:"data_used_mb,omitempty"`
 	Status                  string           `json:"status"` // NOT NULL DEFAULT 'unknown'
-	PIN1                    sql.NullString   `json:"pin1,omitempty"`
-	PUK1                    sql.NullString   `json:"puk1,omitempty"`
-	PIN2                    sql.NullString   `json:"pin2,omitempty"`
-	PUK2                    sql.NullString   `json:"puk2,omitempty"`
+	PIN1                    sql.NullString   `json:"-"` // never sent to clients; only read for unlocking
+	PUK1                    sql.NullString   `json:"-"`
+	PIN2                    sql.NullString   `json:"-"`
+	PUK2                    sql.NullString   `json:"-"`
 	ActivationDate          sql.NullTime     `json:"activation_date,omitempty"` // DATE
 	ExpiryDate              sql.NullTime     `json:"expiry_date,omitempty"`   // DATE
 	RechargeHistory         json.RawMessage  `json:"recharge_history,omitempty"` // JSONB
@@ -37,3 +37,52 @@ type SIMCard struct {
 	CreatedAt               time.Time        `json:"created_at"`
 	UpdatedAt               time.Time        `json:"updated_at"`
 }
+
+// SIM card statuses set by the gateway. Other values are entered by hand.
+const (
+	SIMStatusActive      = "active"       // in use
+	SIMStatusPINRequired = "pin-required" // waiting for its PIN; not unlocked automatically
+	SIMStatusPUKLocked   = "puk-locked"   // PIN attempts used up; needs the PUK
+)
+
+// SIMPINAttempt records one PIN or PUK entered on a SIM card. The code
+// itself is never stored, only where it came from.
+type SIMPINAttempt struct {
+	ID            int64          `json:"id"`
+	SIMCardID     sql.NullInt64  `json:"sim_card_id,omitempty"`
+	ICCID         sql.NullString `json:"iccid,omitempty"`
+	ModemID       sql.NullInt64  `json:"modem_id,omitempty"`
+	CodeType      string         `json:"code_type"` // "pin" or "puk"
+	Source        string         `json:"source"`    // SIMPINSource*
+	Success       bool           `json:"success"`
+	RetriesBefore sql.NullInt32  `json:"retries_before,omitempty"` // remaining attempts before, if the modem reports them
+	RetriesAfter  sql.NullInt32  `json:"retries_after,omitempty"`
+	Error         sql.NullString `json:"error,omitempty"`
+	AttemptedAt   time.Time      `json:"attempted_at"`
+}
+
+// Where a PIN tried on a SIM card came from.
+const (
+	SIMPINSourceStored  = "stored"  // the PIN stored for the card
+	SIMPINSourceDefault = "default" // one of the configured default PINs
+	SIMPINSourceManual  = "manual"  // entered by an operator
+)
+
+// SIMBalanceReading is a balance read from a SIM card.
+type SIMBalanceReading struct {
+	ID        int64          `json:"id"`
+	SIMCardID int64          `json:"sim_card_id"`
+	Balance   float64        `json:"balance"`
+	Currency  sql.NullString `json:"currency,omitempty"`
+	Source    string         `json:"source"` // SIMBalanceSource*
+	RawText   sql.NullString `json:"raw_text,omitempty"`
+	ExpiresAt sql.NullTime   `json:"expires_at,omitempty"`
+	CheckedAt time.Time      `json:"checked_at"`
+}
+
+// Where a SIM card's balance was read from.
+const (
+	SIMBalanceSourceUSSD   = "ussd"   // a balance code sent by the poller
+	SIMBalanceSourceSMS    = "sms"    // an operator message
+	SIMBalanceSourceManual = "manual" // entered by an operator
+)
@@ -119,6 +119,7 @@ type SIPRegistration struct {
 	ContactURI       string    `json:"contact_uri" db:"contact_uri"`
 	SourceIP         string    `json:"source_ip" db:"source_ip"`
 	SourcePort       int       `json:"source_port" db:"source_port"`
+	Transport        string    `json:"transport" db:"transport"` // UDP, TCP, TLS
 	UserAgent        *string   `json:"user_agent" db:"user_agent"`
 	ExpiresSeconds   int       `json:"expires_seconds" db:"expires_seconds"`
 	RegisteredAt     time.Time `json:"registered_at" db:"registered_at"`
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SMSMessage is a text message received by or sent from a SIM card.
+type SMSMessage struct {
+	ID              int64          `json:"id"`
+	Direction       string         `json:"direction"` // SMSDirection*
+	Status          string         `json:"status"`    // SMSStatus*
+	ModemID         sql.NullInt64  `json:"modem_id,omitempty"`
+	SIMCardID       sql.NullInt64  `json:"sim_card_id,omitempty"`
+	Number          string         `json:"number"` // sender of inbound, recipient of outbound messages
+	Body            string         `json:"body"`
+	Encoding        string         `json:"encoding"` // "gsm7", "ucs2" or "8bit"
+	Parts           int            `json:"parts"`
+	MissingParts    int            `json:"missing_parts"`
+	ReportRequested bool           `json:"report_requested"`
+	TaskID          sql.NullString `json:"task_id,omitempty"`   // chan_dongle's ID of a queued message
+	Reference       sql.NullInt32  `json:"reference,omitempty"` // TP-MR, when known
+	Error           sql.NullString `json:"error,omitempty"`
+	SentAt          sql.NullTime   `json:"sent_at,omitempty"`
+	DeliveredAt     sql.NullTime   `json:"delivered_at,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"` // received or submitted
+	UpdatedAt       time.Time      `json:"updated_at"`
+}
+
+// SMS directions
+const (
+	SMSDirectionInbound  = "inbound"
+	SMSDirectionOutbound = "outbound"
+)
+
+// SMS statuses. Inbound messages are always received; outbound ones go
+// from queued to sent or failed, and to delivered or undeliverable when a
+// delivery report arrives.
+const (
+	SMSStatusReceived      = "received"
+	SMSStatusQueued        = "queued"
+	SMSStatusSent          = "sent"
+	SMSStatusFailed        = "failed"
+	SMSStatusDelivered     = "delivered"
+	SMSStatusUndeliverable = "undeliverable"
+)
+
+// SMSPart is a part of a long inbound message waiting for the rest.
+type SMSPart struct {
+	ID         int64         `json:"id"`
+	ModemID    int           `json:"modem_id"`
+	SIMCardID  sql.NullInt64 `json:"sim_card_id,omitempty"`
+	Sender     string        `json:"sender"`
+	ConcatRef  int           `json:"concat_ref"`
+	Total      int           `json:"total"`
+	Seq        int           `json:"seq"`
+	Body       string        `json:"body"`
+	Encoding   string        `json:"encoding"`
+	ReceivedAt time.Time     `json:"received_at"`
+}
+
+// SMSFilter selects messages for the message log. Zero values match all.
+type SMSFilter struct {
+	Direction string
+	Status    string
+	ModemID   int
+	SIMCardID int64
+	Number    string // substring of the number
+	Limit     int
+	Offset    int
+}
+
+// SMSSender is a SIM card that can send messages, with the modem it is in.
+type SMSSender struct {
+	SIMCardID    int64   `json:"sim_card_id"`
+	ModemID      int     `json:"modem_id"`
+	GatewayID    *string `json:"gateway_id,omitempty"`
+	DongleName   string  `json:"dongle_name"`
+	OperatorName string  `json:"operator_name"`
+	HealthState  string  `json:"health_state"`
+	SignalDBM    *int    `json:"signal_dbm,omitempty"`
+	SentLastHour int     `json:"sent_last_hour"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// USSDSession is a USSD dialogue with the network on one SIM card: a code
+// and, for menus, the choices sent in reply to each screen.
+type USSDSession struct {
+	ID             int64          `json:"id"`
+	SIMCardID      int64          `json:"sim_card_id"`
+	ModemID        sql.NullInt64  `json:"modem_id,omitempty"`
+	OperatorName   sql.NullString `json:"operator_name,omitempty"`
+	Status         string         `json:"status"` // USSDSession*
+	StartedAt      time.Time      `json:"started_at"`
+	LastActivityAt time.Time      `json:"last_activity_at"`
+	EndedAt        sql.NullTime   `json:"ended_at,omitempty"`
+}
+
+// USSD session statuses.
+const (
+	USSDSessionOpen    = "open"    // the network waits for a reply
+	USSDSessionClosed  = "closed"  // the network answered and ended the dialogue
+	USSDSessionTimeout = "timeout" // no reply or no further choice in time
+	USSDSessionFailed  = "failed"
+)
+
+// USSDExchange is one request sent in a USSD session and the network's
+// response.
+type USSDExchange struct {
+	ID            int64           `json:"id"`
+	SessionID     int64           `json:"session_id"`
+	SIMCardID     int64           `json:"sim_card_id"`
+	ModemID       sql.NullInt64   `json:"modem_id,omitempty"`
+	Request       string          `json:"request"`
+	TaskID        sql.NullString  `json:"task_id,omitempty"`
+	Response      sql.NullString  `json:"response,omitempty"`
+	NetworkStatus sql.NullInt32   `json:"network_status,omitempty"` // +CUSD <m>
+	Parsed        json.RawMessage `json:"parsed,omitempty"`         // USSDParsed
+	Error         sql.NullString  `json:"error,omitempty"`
+	RequestedAt   time.Time       `json:"requested_at"`
+	RespondedAt   sql.NullTime    `json:"responded_at,omitempty"`
+}
+
+// USSDParsed holds the values read from a USSD response by the operator's
+// templates. Fields the response does not carry are left empty.
+type USSDParsed struct {
+	Template        string     `json:"template,omitempty"` // operator template that matched
+	Balance         *float64   `json:"balance,omitempty"`
+	Currency        string     `json:"currency,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	BundleRemaining string     `json:"bundle_remaining,omitempty"` // as shown, e.g. "1.5 Go"
+	BundleMB        *float64   `json:"bundle_mb,omitempty"`
+}
+
+// Empty reports whether nothing was read from the response.
+func (p *USSDParsed) Empty() bool {
+	return p.Balance == nil && p.ExpiresAt == nil && p.BundleRemaining == ""
+}
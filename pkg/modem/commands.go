@@ -0,0 +1,285 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultUSSDTimeout is how long SendUSSD waits for the network's reply.
+const DefaultUSSDTimeout = 30 * time.Second
+
+// ErrNoReply is returned when a command that should have an information line
+// finished without one.
+var ErrNoReply = errors.New("modem: no reply")
+
+// single runs a command and returns its information line with prefix.
+func (d *Device) single(ctx context.Context, command, prefix string) (string, error) {
+	lines, err := d.Command(ctx, command)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range lines {
+		if prefix == "" || strings.HasPrefix(line, prefix) {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("%w to %s", ErrNoReply, command)
+}
+
+// bare returns the value of a command answered with a bare line, such as
+// AT+CGSN, stripping the prefix some firmware adds anyway.
+func (d *Device) bare(ctx context.Context, command string) (string, error) {
+	line, err := d.single(ctx, command, "")
+	if err != nil {
+		return "", err
+	}
+	if prefix := infoPrefix(command); prefix != "" {
+		line = strings.TrimPrefix(line, prefix)
+	}
+	return strings.Trim(strings.TrimSpace(line), `"`), nil
+}
+
+// Manufacturer returns the reply to AT+CGMI, e.g. "huawei".
+func (d *Device) Manufacturer(ctx context.Context) (string, error) {
+	return d.bare(ctx, "AT+CGMI")
+}
+
+// Model returns the reply to AT+CGMM, e.g. "E173".
+func (d *Device) Model(ctx context.Context) (string, error) {
+	return d.bare(ctx, "AT+CGMM")
+}
+
+// Firmware returns the reply to AT+CGMR, e.g. "11.126.85.00.209".
+func (d *Device) Firmware(ctx context.Context) (string, error) {
+	return d.bare(ctx, "AT+CGMR")
+}
+
+// IMEI returns the modem's IMEI (AT+CGSN).
+func (d *Device) IMEI(ctx context.Context) (string, error) {
+	return d.bare(ctx, "AT+CGSN")
+}
+
+// IMSI returns the SIM's IMSI (AT+CIMI).
+func (d *Device) IMSI(ctx context.Context) (string, error) {
+	return d.bare(ctx, "AT+CIMI")
+}
+
+// ICCID returns the SIM's ICCID. The E173 answers AT^ICCID?; other modems
+// AT+CCID.
+func (d *Device) ICCID(ctx context.Context) (string, error) {
+	line, err := d.single(ctx, "AT^ICCID?", "^ICCID:")
+	if err != nil {
+		if line, err = d.single(ctx, "AT+CCID", ""); err != nil {
+			return "", err
+		}
+	}
+	return ParseCCID(line)
+}
+
+// SignalQuality returns the received signal strength (AT+CSQ).
+func (d *Device) SignalQuality(ctx context.Context) (SignalQuality, error) {
+	line, err := d.single(ctx, "AT+CSQ", "+CSQ:")
+	if err != nil {
+		return SignalQuality{}, err
+	}
+	return ParseCSQ(line)
+}
+
+// Registration returns the network registration state (AT+CREG?). Call
+// EnableRegistrationURCs first to get the location area and cell.
+func (d *Device) Registration(ctx context.Context) (Registration, error) {
+	line, err := d.single(ctx, "AT+CREG?", "+CREG:")
+	if err != nil {
+		return Registration{}, err
+	}
+	return ParseCREG(line)
+}
+
+// EnableRegistrationURCs makes the modem report registration changes, with
+// location area and cell, as +CREG URCs (AT+CREG=2).
+func (d *Device) EnableRegistrationURCs(ctx context.Context) error {
+	_, err := d.Command(ctx, "AT+CREG=2")
+	return err
+}
+
+// Operator returns the network the modem is on (AT+COPS?) by name.
+func (d *Device) Operator(ctx context.Context) (Operator, error) {
+	if _, err := d.Command(ctx, "AT+COPS=3,0"); err != nil {
+		return Operator{}, err
+	}
+	line, err := d.single(ctx, "AT+COPS?", "+COPS:")
+	if err != nil {
+		return Operator{}, err
+	}
+	return ParseCOPS(line)
+}
+
+// PINStatus returns what the SIM is waiting for (AT+CPIN?). A missing SIM
+// is a +CME ERROR 10.
+func (d *Device) PINStatus(ctx context.Context) (PINStatus, error) {
+	line, err := d.single(ctx, "AT+CPIN?", "+CPIN:")
+	if err != nil {
+		return "", err
+	}
+	return ParseCPIN(line)
+}
+
+// PINRetries returns the remaining PIN and PUK attempts (AT^CPIN?), as
+// reported by Huawei modems.
+func (d *Device) PINRetries(ctx context.Context) (pin, puk int, err error) {
+	line, err := d.single(ctx, "AT^CPIN?", "^CPIN:")
+	if err != nil {
+		return 0, 0, err
+	}
+	// ^CPIN: <code>,[<times>],<puk_times>,<pin_times>,<puk2_times>,<pin2_times>
+	f := fields(strings.TrimSpace(strings.TrimPrefix(line, "^CPIN:")))
+	if len(f) < 4 {
+		return 0, 0, fmt.Errorf("modem: malformed ^CPIN %q", line)
+	}
+	puk, err1 := strconv.Atoi(f[2])
+	pin, err2 := strconv.Atoi(f[3])
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("modem: malformed ^CPIN %q", line)
+	}
+	return pin, puk, nil
+}
+
+// EnterPIN unlocks the SIM with its PIN.
+func (d *Device) EnterPIN(ctx context.Context, pin string) error {
+	_, err := d.Command(ctx, fmt.Sprintf(`AT+CPIN="%s"`, pin))
+	return err
+}
+
+// EnterPUK unblocks the SIM with its PUK and sets a new PIN.
+func (d *Device) EnterPUK(ctx context.Context, puk, newPIN string) error {
+	_, err := d.Command(ctx, fmt.Sprintf(`AT+CPIN="%s","%s"`, puk, newPIN))
+	return err
+}
+
+// ListSMS returns the stored messages with the given status ("ALL",
+// "REC UNREAD", ...). Listing unread messages marks them read.
+func (d *Device) ListSMS(ctx context.Context, status string) ([]SMS, error) {
+	if status == "" {
+		status = "ALL"
+	}
+	lines, err := d.Command(ctx, fmt.Sprintf(`AT+CMGL="%s"`, status))
+	if err != nil {
+		return nil, err
+	}
+	return ParseCMGL(lines)
+}
+
+// DeleteSMS deletes the stored message at index.
+func (d *Device) DeleteSMS(ctx context.Context, index int) error {
+	_, err := d.Command(ctx, fmt.Sprintf("AT+CMGD=%d", index))
+	return err
+}
+
+// SendSMS sends a text message and returns its message reference.
+func (d *Device) SendSMS(ctx context.Context, number, text string) (int, error) {
+	lines, err := d.CommandWithInput(ctx, fmt.Sprintf(`AT+CMGS="%s"`, number), text)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		if value, err := infoValue(line, "+CMGS:"); err == nil {
+			ref, _ := strconv.Atoi(value)
+			return ref, nil
+		}
+	}
+	return 0, nil
+}
+
+// concatRef numbers the concatenated messages sent by this process.
+var concatRef uint32
+
+// ListSMSPDU returns all stored messages undecoded, in PDU mode, so that
+// parts of concatenated messages and delivery reports can be told apart.
+// The modem is left in text mode.
+func (d *Device) ListSMSPDU(ctx context.Context) ([]RawSMS, error) {
+	if _, err := d.Command(ctx, "AT+CMGF=0"); err != nil {
+		return nil, err
+	}
+	defer d.Command(ctx, "AT+CMGF=1")
+	lines, err := d.Command(ctx, "AT+CMGL=4")
+	if err != nil {
+		return nil, err
+	}
+	return ParseCMGLPDU(lines)
+}
+
+// SendSMSPDU sends a message in PDU mode, as a concatenated message if it
+// does not fit one, in GSM 7-bit or UCS2 as the text requires. It returns
+// the message reference of each part. statusReport asks for delivery
+// reports. The modem is left in text mode.
+func (d *Device) SendSMSPDU(ctx context.Context, number, text string, statusReport bool) ([]int, error) {
+	pdus, err := EncodeSubmit(number, text, byte(atomic.AddUint32(&concatRef, 1)), statusReport)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.Command(ctx, "AT+CMGF=0"); err != nil {
+		return nil, err
+	}
+	defer d.Command(ctx, "AT+CMGF=1")
+
+	refs := make([]int, 0, len(pdus))
+	for i, pdu := range pdus {
+		lines, err := d.CommandWithInput(ctx, fmt.Sprintf("AT+CMGS=%d", pdu.Length), pdu.Hex)
+		if err != nil {
+			return refs, fmt.Errorf("part %d of %d: %w", i+1, len(pdus), err)
+		}
+		ref := 0
+		for _, line := range lines {
+			if value, err := infoValue(line, "+CMGS:"); err == nil {
+				ref, _ = strconv.Atoi(value)
+			}
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// SendUSSD sends a USSD code such as "*100#" and waits for the network's
+// reply. A context without deadline waits DefaultUSSDTimeout.
+func (d *Device) SendUSSD(ctx context.Context, code string) (USSDReply, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultUSSDTimeout)
+		defer cancel()
+	}
+
+	replies := d.WaitURC("+CUSD")
+	defer d.StopWaiting("+CUSD", replies)
+
+	command := fmt.Sprintf(`AT+CUSD=1,"%s",15`, encodeUSSD(code))
+	lines, err := d.Command(ctx, command)
+	if err != nil {
+		return USSDReply{}, err
+	}
+	// Some firmware answers before the OK, as an information line.
+	for _, line := range lines {
+		if strings.HasPrefix(line, "+CUSD:") {
+			return ParseCUSD(line)
+		}
+	}
+
+	select {
+	case urc := <-replies:
+		return ParseCUSD(urc.Value)
+	case <-ctx.Done():
+		return USSDReply{}, d.timeoutErr(ctx, command)
+	case <-d.done:
+		return USSDReply{}, d.Err()
+	}
+}
+
+// CancelUSSD ends an open USSD session (AT+CUSD=2).
+func (d *Device) CancelUSSD(ctx context.Context) error {
+	_, err := d.Command(ctx, "AT+CUSD=2")
+	return err
+}
@@ -0,0 +1,608 @@
+// Package modem drives Huawei E173 (and compatible) USB modems directly over
+// their AT command port, without chan_dongle or Asterisk.
+//
+// A Device owns one Port. Commands are serialised: each waits for the modem's
+// final result code (OK, ERROR, +CME ERROR, ...) before the next is written,
+// and returns the information lines that came with it. Unsolicited result
+// codes (URCs) such as +CMTI, +CUSD, ^RSSI or RING can arrive at any time,
+// also in the middle of a command's reply; they are separated out and
+// delivered on the URCs channel.
+//
+//	port, err := modem.OpenSerial("/dev/ttyUSB2", 0)
+//	dev := modem.New(port, modem.Options{Name: "dongle0"})
+//	defer dev.Close()
+//	if err := dev.Init(ctx); err != nil { ... }
+//	imsi, err := dev.IMSI(ctx)
+//
+// Tests drive a Device through a FakePort instead of a tty.
+package modem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultCommandTimeout bounds a command whose context has no deadline.
+const DefaultCommandTimeout = 10 * time.Second
+
+// resyncQuiet is how long the modem must stay silent after a resync's AT
+// before the next command is sent.
+const resyncQuiet = 200 * time.Millisecond
+
+var (
+	// ErrClosed is returned for commands on a closed Device.
+	ErrClosed = errors.New("modem: device closed")
+	// ErrTimeout is returned when the modem does not finish a command in time.
+	ErrTimeout = errors.New("modem: command timed out")
+)
+
+// CommandError is a command the modem answered with an error result code.
+type CommandError struct {
+	Command string
+	Result  string // e.g. "ERROR", "+CME ERROR: 16"
+	Code    int    // CME/CMS error code, -1 for a plain ERROR
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("modem: %s failed: %s", e.Command, e.Result)
+}
+
+// IsCME reports whether err is a +CME ERROR with the given code, e.g. 16
+// (incorrect password) or 12 (SIM PUK required).
+func IsCME(err error, code int) bool {
+	var cmdErr *CommandError
+	return errors.As(err, &cmdErr) && strings.HasPrefix(cmdErr.Result, "+CME ERROR") && cmdErr.Code == code
+}
+
+// URC is an unsolicited result code.
+type URC struct {
+	Name  string    // e.g. "+CMTI", "^RSSI", "RING"
+	Value string    // everything after "Name: ", "" if none
+	Lines []string  // continuation lines, e.g. the text of a +CMT
+	At    time.Time // when it was read
+}
+
+// Options configure a Device.
+type Options struct {
+	Name    string        // shown in logs, e.g. the dongle name or tty
+	Timeout time.Duration // DefaultCommandTimeout if 0
+	Logger  *logrus.Entry // discards logs if nil
+}
+
+// urcPrefixes are the unsolicited result codes an E173 emits. Information
+// lines of a command in flight that share a prefix with a URC (+CREG, +CUSD)
+// are told apart by the command's own prefix.
+var urcPrefixes = []string{
+	"+CMTI:", "+CMT:", "+CDSI:", "+CDS:", "+CBM:", "+CUSD:", "+CREG:", "+CGREG:", "+CLIP:", "+CRING:", "+CSSI:", "+CSSU:",
+	"^RSSI:", "^HCSQ:", "^MODE:", "^SRVST:", "^SIMST:", "^BOOT:", "^ORIG:", "^CONF:", "^CONN:", "^CEND:", "^DSFLOWRPT:",
+	"^STIN:", "^SMMEMFULL:", "^NWTIME:", "RING", "NO CARRIER",
+}
+
+// urcContinuations are URCs followed by one more line, the message text.
+var urcContinuations = map[string]bool{"+CMT": true, "+CDS": true, "+CBM": true}
+
+// finalResults end a command. Matched as whole lines or prefixes.
+var finalResults = []string{"OK", "ERROR", "+CME ERROR:", "+CMS ERROR:", "NO CARRIER", "BUSY", "NO ANSWER", "NO DIALTONE", "COMMAND NOT SUPPORT", "TOO MANY PARAMETERS"}
+
+// pendingCommand is the command in flight.
+type pendingCommand struct {
+	command string
+	prefix  string // information-line prefix, e.g. "+CSQ:"
+	lines   []string
+	prompt  chan struct{} // signalled when the modem asks for input with "> "
+	done    chan error
+}
+
+// Device is a modem reached over a Port. It is safe for concurrent use.
+type Device struct {
+	port    Port
+	name    string
+	timeout time.Duration
+	logger  *logrus.Entry
+
+	cmdMu sync.Mutex // serialises commands
+
+	mu       sync.Mutex // guards the fields below
+	pending  *pendingCommand
+	waiters  map[string][]chan URC // one-shot URC waiters by name
+	lastURC  *URC                  // a URC waiting for its continuation line
+	resync   bool                  // a command timed out; its result may still come
+	closed   bool
+	closeErr error
+
+	urcs chan URC
+	done chan struct{}
+}
+
+// New starts reading from port. The Device takes ownership of the port.
+func New(port Port, opts Options) *Device {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultCommandTimeout
+	}
+	if opts.Logger == nil {
+		discard := logrus.New()
+		discard.SetOutput(nopWriter{})
+		opts.Logger = logrus.NewEntry(discard)
+	}
+	d := &Device{
+		port:    port,
+		name:    opts.Name,
+		timeout: opts.Timeout,
+		logger:  opts.Logger.WithField("modem", opts.Name),
+		waiters: make(map[string][]chan URC),
+		urcs:    make(chan URC, 64),
+		done:    make(chan struct{}),
+	}
+	go d.readLoop()
+	return d
+}
+
+// Open opens the AT port at path and initialises the modem.
+func Open(ctx context.Context, path string, opts Options) (*Device, error) {
+	port, err := OpenSerial(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = path
+	}
+	d := New(port, opts)
+	if err := d.Init(ctx); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Name returns the name the Device was created with.
+func (d *Device) Name() string {
+	return d.name
+}
+
+// URCs returns the channel unsolicited result codes are delivered on. URCs
+// are dropped, with a warning, when nobody keeps up with the channel. It is
+// closed when the Device is.
+func (d *Device) URCs() <-chan URC {
+	return d.urcs
+}
+
+// Done is closed once the Device has stopped reading, after Close or when
+// the port fails (e.g. the dongle was unplugged).
+func (d *Device) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns why the Device stopped, or nil while it is running.
+func (d *Device) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closeErr
+}
+
+// Close stops the Device and closes its port.
+func (d *Device) Close() error {
+	d.shutdown(ErrClosed)
+	err := d.port.Close()
+	<-d.done
+	return err
+}
+
+// Init puts the modem in the state the other methods expect: no command
+// echo, numeric +CME errors and text mode SMS.
+func (d *Device) Init(ctx context.Context) error {
+	// The first AT after opening is sometimes eaten by a half-sent command
+	// from the previous owner of the port.
+	_, _ = d.Command(ctx, "AT")
+	for _, cmd := range []string{"ATE0", "AT+CMEE=1", "AT+CMGF=1"} {
+		if _, err := d.Command(ctx, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Command sends an AT command and returns its information lines, without the
+// final result code. The command prefix (e.g. "+CSQ:") is kept on the lines.
+func (d *Device) Command(ctx context.Context, command string) ([]string, error) {
+	return d.run(ctx, command, "")
+}
+
+// CommandWithInput sends a command that prompts for more input with "> ",
+// such as AT+CMGS, then sends input terminated with Ctrl-Z.
+func (d *Device) CommandWithInput(ctx context.Context, command, input string) ([]string, error) {
+	return d.run(ctx, command, input+"\x1a")
+}
+
+func (d *Device) run(ctx context.Context, command, input string) ([]string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	d.cmdMu.Lock()
+	defer d.cmdMu.Unlock()
+
+	d.mu.Lock()
+	resync := d.resync
+	d.mu.Unlock()
+	if resync {
+		if err := d.resynchronise(ctx); err != nil {
+			return nil, fmt.Errorf("modem: resynchronising before %s: %w", redactCommand(command), err)
+		}
+	}
+	return d.exec(ctx, command, input)
+}
+
+// exec sends a command and waits for its result. d.cmdMu must be held.
+func (d *Device) exec(ctx context.Context, command, input string) ([]string, error) {
+	pc := &pendingCommand{
+		command: command,
+		prefix:  infoPrefix(command),
+		prompt:  make(chan struct{}, 1),
+		done:    make(chan error, 1),
+	}
+	d.mu.Lock()
+	if d.closed {
+		err := d.closeErr
+		d.mu.Unlock()
+		return nil, err
+	}
+	d.pending = pc
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		if d.pending == pc {
+			d.pending = nil
+		}
+		d.mu.Unlock()
+	}()
+
+	d.logger.Debugf("> %s", redactCommand(command))
+	if _, err := d.port.Write([]byte(command + "\r")); err != nil {
+		return nil, err
+	}
+
+	if input != "" {
+		select {
+		case <-pc.prompt:
+		case err := <-pc.done:
+			if err == nil {
+				err = fmt.Errorf("modem: %s finished without asking for input", command)
+			}
+			return nil, err
+		case <-ctx.Done():
+			d.abort()
+			d.setResync()
+			return nil, d.timeoutErr(ctx, command)
+		}
+		if _, err := d.port.Write([]byte(input)); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case err := <-pc.done:
+		d.mu.Lock()
+		lines := pc.lines
+		d.mu.Unlock()
+		return lines, err
+	case <-ctx.Done():
+		if input != "" {
+			d.abort()
+		}
+		d.setResync()
+		return nil, d.timeoutErr(ctx, command)
+	}
+}
+
+func (d *Device) setResync() {
+	d.mu.Lock()
+	d.resync = true
+	d.mu.Unlock()
+}
+
+// resynchronise gets the modem back in step after a command it did not
+// finish in time. That command's result may still come, and would otherwise
+// end the next command early and hand it the wrong lines. An AT is sent,
+// then results are drained until the modem has been quiet for resyncQuiet.
+// A modem that does not answer stays out of step; health monitoring reopens
+// it after repeated timeouts. d.cmdMu must be held.
+func (d *Device) resynchronise(ctx context.Context) error {
+	d.logger.Debug("Resynchronising after a timed-out command")
+	if _, err := d.exec(ctx, "AT", ""); err != nil {
+		// An error result may be the late one of the timed-out command.
+		var cmdErr *CommandError
+		if !errors.As(err, &cmdErr) {
+			return err
+		}
+	}
+	for {
+		pc := &pendingCommand{command: "AT", prompt: make(chan struct{}, 1), done: make(chan error, 1)}
+		d.mu.Lock()
+		if d.closed {
+			err := d.closeErr
+			d.mu.Unlock()
+			return err
+		}
+		d.pending = pc
+		d.mu.Unlock()
+
+		quiet := time.NewTimer(resyncQuiet)
+		select {
+		case err := <-pc.done:
+			quiet.Stop()
+			var cmdErr *CommandError
+			if err != nil && !errors.As(err, &cmdErr) {
+				return err // the device was closed
+			}
+			// A result left over: keep draining.
+		case <-quiet.C:
+			d.mu.Lock()
+			if d.pending == pc {
+				d.pending = nil
+			}
+			d.resync = false
+			d.mu.Unlock()
+			return nil
+		case <-ctx.Done():
+			quiet.Stop()
+			d.mu.Lock()
+			if d.pending == pc {
+				d.pending = nil
+			}
+			d.mu.Unlock()
+			return d.timeoutErr(ctx, "AT")
+		}
+	}
+}
+
+// abort cancels a pending input prompt so the modem accepts commands again.
+func (d *Device) abort() {
+	_, _ = d.port.Write([]byte{0x1b})
+}
+
+// secretCommands are the commands whose arguments are PINs or passwords.
+var secretCommands = []string{"AT+CPIN=", "AT+CPWD=", "AT+CLCK="}
+
+// redactCommand hides the arguments of commands carrying PINs or passwords,
+// so they end up in neither logs nor errors.
+func redactCommand(command string) string {
+	upper := strings.ToUpper(command)
+	for _, prefix := range secretCommands {
+		if strings.HasPrefix(upper, prefix) {
+			return command[:len(prefix)] + "***"
+		}
+	}
+	return command
+}
+
+func (d *Device) timeoutErr(ctx context.Context, command string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrTimeout, redactCommand(command))
+	}
+	return ctx.Err()
+}
+
+// WaitURC waits for the next URC with the given name (e.g. "+CUSD"). Call it
+// before triggering the URC so it cannot be missed, and read the returned
+// channel with a timeout. The URC is still delivered on URCs as well.
+func (d *Device) WaitURC(name string) <-chan URC {
+	ch := make(chan URC, 1)
+	d.mu.Lock()
+	d.waiters[name] = append(d.waiters[name], ch)
+	d.mu.Unlock()
+	return ch
+}
+
+// StopWaiting drops a waiter registered with WaitURC that is no longer needed.
+func (d *Device) StopWaiting(name string, ch <-chan URC) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	waiters := d.waiters[name]
+	for i, w := range waiters {
+		if w == ch {
+			d.waiters[name] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+}
+
+// readLoop splits the port's output into lines and dispatches them.
+func (d *Device) readLoop() {
+	defer close(d.done)
+	defer close(d.urcs)
+
+	buf := make([]byte, 512)
+	var partial []byte
+	for {
+		n, err := d.port.Read(buf)
+		if err != nil {
+			if errors.Is(err, ErrPortClosed) {
+				d.shutdown(ErrClosed)
+			} else {
+				d.shutdown(err)
+			}
+			return
+		}
+		partial = append(partial, buf[:n]...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				break
+			}
+			line := strings.TrimSpace(string(partial[:i]))
+			partial = partial[i+1:]
+			if line != "" {
+				d.dispatch(line)
+			}
+		}
+		// The input prompt of AT+CMGS is not followed by a newline.
+		if p := strings.TrimSpace(string(partial)); p == ">" {
+			partial = partial[:0]
+			d.promptReceived()
+		}
+	}
+}
+
+// shutdown fails the command in flight and refuses new ones.
+func (d *Device) shutdown(reason error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.closed = true
+	d.closeErr = reason
+	if d.pending != nil {
+		d.pending.done <- reason
+		d.pending = nil
+	}
+}
+
+func (d *Device) promptReceived() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending != nil {
+		select {
+		case d.pending.prompt <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dispatch routes one line to the command in flight or to the URC consumers.
+func (d *Device) dispatch(line string) {
+	d.logger.Debugf("< %s", redactCommand(line)) // the echo of a command, if echo is on
+	d.mu.Lock()
+	pc := d.pending
+
+	// The line after +CMT and friends is their text.
+	if d.lastURC != nil {
+		urc := *d.lastURC
+		d.lastURC = nil
+		urc.Lines = append(urc.Lines, line)
+		d.mu.Unlock()
+		d.deliver(urc)
+		return
+	}
+
+	switch {
+	case pc != nil && isFinalResult(line) && (line != "NO CARRIER" || strings.HasPrefix(strings.ToUpper(pc.command), "ATD")):
+		// NO CARRIER only ends a dial; otherwise it reports a dropped call.
+		d.pending = nil
+		pc.done <- resultError(pc.command, line)
+		d.mu.Unlock()
+		return
+	case pc != nil && line == pc.command:
+		// Command echo before ATE0 took effect.
+		d.mu.Unlock()
+		return
+	case pc != nil && pc.prefix != "" && strings.HasPrefix(line, pc.prefix):
+		pc.lines = append(pc.lines, line)
+		d.mu.Unlock()
+		return
+	}
+
+	if urc, ok := parseURC(line); ok {
+		if urcContinuations[urc.Name] {
+			d.lastURC = &urc
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+		d.deliver(urc)
+		return
+	}
+
+	if pc != nil {
+		pc.lines = append(pc.lines, line)
+	} else {
+		d.logger.Debugf("Ignoring unexpected line %q", line)
+	}
+	d.mu.Unlock()
+}
+
+// deliver hands a URC to its waiters and to the URCs channel.
+func (d *Device) deliver(urc URC) {
+	d.mu.Lock()
+	waiters := d.waiters[urc.Name]
+	delete(d.waiters, urc.Name)
+	d.mu.Unlock()
+	for _, w := range waiters {
+		w <- urc
+	}
+
+	select {
+	case d.urcs <- urc:
+	default:
+		d.logger.Warnf("URC buffer full, dropping %s", urc.Name)
+	}
+}
+
+// parseURC recognises an unsolicited result code.
+func parseURC(line string) (URC, bool) {
+	for _, prefix := range urcPrefixes {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		name := strings.TrimSuffix(prefix, ":")
+		value := strings.TrimSpace(strings.TrimPrefix(line, prefix))
+		return URC{Name: name, Value: value, At: time.Now()}, true
+	}
+	return URC{}, false
+}
+
+func isFinalResult(line string) bool {
+	for _, final := range finalResults {
+		if line == final || (strings.HasSuffix(final, ":") && strings.HasPrefix(line, final)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resultError turns a final result code into the command's error.
+func resultError(command, line string) error {
+	if line == "OK" {
+		return nil
+	}
+	code := -1
+	for _, prefix := range []string{"+CME ERROR:", "+CMS ERROR:"} {
+		if strings.HasPrefix(line, prefix) {
+			fmt.Sscanf(strings.TrimSpace(strings.TrimPrefix(line, prefix)), "%d", &code)
+		}
+	}
+	return &CommandError{Command: redactCommand(command), Result: line, Code: code}
+}
+
+// infoPrefix returns the prefix of the information lines a command answers
+// with: "AT+CSQ" -> "+CSQ:", "AT^SYSINFO" -> "^SYSINFO:", "AT+CPIN=1234" ->
+// "+CPIN:". Basic commands such as ATI or AT+CGSN on some firmware answer
+// without a prefix; their lines are collected all the same.
+func infoPrefix(command string) string {
+	upper := strings.ToUpper(command)
+	if !strings.HasPrefix(upper, "AT") || len(upper) < 3 {
+		return ""
+	}
+	rest := command[2:]
+	if rest[0] != '+' && rest[0] != '^' {
+		return ""
+	}
+	end := strings.IndexAny(rest, "=?")
+	if end < 0 {
+		end = len(rest)
+	}
+	return strings.ToUpper(rest[:end]) + ":"
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
@@ -0,0 +1,45 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLateResultDoesNotEndNextCommand(t *testing.T) {
+	for _, late := range [][]string{
+		{"+CSQ: 20,99", "OK"},
+		{"+CME ERROR: 10"},
+	} {
+		d, port := fakeDevice(t)
+		port.Delay("AT+CSQ", late...)
+		port.Respond("AT+CGMI", "huawei")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := d.Command(ctx, "AT+CSQ")
+		cancel()
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("%v: got %v, want ErrTimeout", late, err)
+		}
+
+		// The late result arrives as the next command is sent.
+		lines, err := d.Command(context.Background(), "AT+CGMI")
+		if err != nil || !reflect.DeepEqual(lines, []string{"huawei"}) {
+			t.Errorf("%v: next command got %q, %v, want its own reply", late, lines, err)
+		}
+		if got := strings.Join(port.Written(), " "); got != "AT+CSQ AT AT+CGMI" {
+			t.Errorf("%v: wrote %q, want an AT to resynchronise", late, got)
+		}
+
+		// Back in step: no more AT before each command.
+		if _, err := d.Command(context.Background(), "AT+CGMI"); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(port.Written()); got != 4 {
+			t.Errorf("%v: %d commands written, want no second resync", late, got)
+		}
+	}
+}
@@ -0,0 +1,541 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// discoveryInterval is how often sysfs is rescanned for hot-plugged and
+	// removed modems.
+	discoveryInterval = 5 * time.Second
+	// probeTimeout bounds reading the IMEI of a newly plugged modem, which
+	// may still be booting.
+	probeTimeout = 8 * time.Second
+	// unlockTimeout bounds unlocking the SIM of a newly plugged modem.
+	unlockTimeout = 30 * time.Second
+	// dongleNamePrefix is the prefix of the chan_dongle names handed out to
+	// new modems: dongle0, dongle1, ...
+	dongleNamePrefix = "dongle"
+)
+
+// AttachedModem is a modem plugged into this host.
+type AttachedModem struct {
+	USBModem
+	ModemID    int       `json:"modem_id"`
+	IMEI       string    `json:"imei"`
+	DongleName string    `json:"dongle_name"`
+	AttachedAt time.Time `json:"attached_at"`
+}
+
+// ChangeFunc is called after the set of attached modems changed.
+type ChangeFunc func(ctx context.Context, modems []AttachedModem)
+
+// Discovery keeps the modems table in step with the modems plugged into
+// this host. It scans sysfs for Huawei modems, reads each new one's IMEI on
+// its AT port and stores where it is found: a modem keeps its row and
+// chan_dongle name across ttyUSB renumbering, and each move is recorded.
+// Optionally it writes chan_dongle's dongle.conf to match.
+//
+// A port locked by another process (chan_dongle holds its ports) is not
+// probed; the modem is recognised from where it was seen before instead.
+type Discovery struct {
+	gatewayID *string
+	modemRepo repository.ModemRepository
+	logger    *logrus.Logger
+
+	sysfsRoot string
+	devDir    string
+	lockDir   string
+
+	dongleConfPath string
+	onChange       ChangeFunc
+	unlocker       *PINUnlocker
+	health         *HealthMonitor
+
+	scanMu   sync.Mutex                // serialises scans
+	mu       sync.Mutex                // guards attached and failures
+	attached map[string]*AttachedModem // by USB path
+	failures map[string]int            // failed probes by USB path
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewDiscovery creates a Discovery for the modems of a gateway. gatewayID is
+// the gateway the modems of this host belong to, nil if none.
+func NewDiscovery(gatewayID *string, modemRepo repository.ModemRepository, logger *logrus.Logger) *Discovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Discovery{
+		gatewayID: gatewayID,
+		modemRepo: modemRepo,
+		logger:    logger,
+		sysfsRoot: "/sys",
+		devDir:    "/dev",
+		lockDir:   "/var/lock",
+		attached:  make(map[string]*AttachedModem),
+		failures:  make(map[string]int),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// SetRoots changes where sysfs, the tty device nodes and the UUCP lock files
+// are looked for. Call before Start.
+func (d *Discovery) SetRoots(sysfsRoot, devDir, lockDir string) {
+	d.sysfsRoot, d.devDir, d.lockDir = sysfsRoot, devDir, lockDir
+}
+
+// SetDongleConf makes Discovery rewrite the dongle.conf at path whenever the
+// attached modems change. Empty disables it.
+func (d *Discovery) SetDongleConf(path string) {
+	d.dongleConfPath = path
+}
+
+// SetChangeHandler registers fn to be called after modems were plugged in or
+// removed, e.g. to reload chan_dongle.
+func (d *Discovery) SetChangeHandler(fn ChangeFunc) {
+	d.onChange = fn
+}
+
+// SetPINUnlocker makes Discovery unlock the SIM of each newly plugged modem
+// that asks for its PIN, before chan_dongle takes over the modem.
+func (d *Discovery) SetPINUnlocker(u *PINUnlocker) {
+	d.unlocker = u
+}
+
+// SetHealthMonitor makes Discovery report attached modems, and AT timeouts
+// of modems it knew, to health.
+func (d *Discovery) SetHealthMonitor(h *HealthMonitor) {
+	d.health = h
+}
+
+// Start scans now and then every few seconds in the background.
+func (d *Discovery) Start() {
+	d.started = true
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(discoveryInterval)
+		defer ticker.Stop()
+		for {
+			if err := d.Scan(d.ctx); err != nil && d.ctx.Err() == nil {
+				d.logger.WithError(err).Warn("Modem discovery scan failed")
+			}
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends background scanning.
+func (d *Discovery) Stop() {
+	d.cancel()
+	if d.started {
+		<-d.done
+	}
+}
+
+// Attached returns the modems currently plugged in, by USB path.
+func (d *Discovery) Attached() []AttachedModem {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	modems := make([]AttachedModem, 0, len(d.attached))
+	for _, a := range d.attached {
+		modems = append(modems, *a)
+	}
+	sort.Slice(modems, func(i, j int) bool { return lessUSBPath(modems[i].USBPath, modems[j].USBPath) })
+	return modems
+}
+
+// Scan compares sysfs with the modems known to be attached, then attaches
+// new and moved modems and detaches removed ones.
+func (d *Discovery) Scan(ctx context.Context) error {
+	d.scanMu.Lock()
+	defer d.scanMu.Unlock()
+
+	found, err := ScanUSB(d.sysfsRoot, d.devDir)
+	if err != nil {
+		return fmt.Errorf("failed to scan USB devices: %w", err)
+	}
+
+	changed := false
+	present := make(map[string]bool, len(found))
+	for _, dev := range found {
+		present[dev.USBPath] = true
+		if dev.DataPort == "" {
+			// Still enumerating, or not switched to modem mode yet.
+			continue
+		}
+		d.mu.Lock()
+		prev := d.attached[dev.USBPath]
+		d.mu.Unlock()
+		if prev != nil && prev.DataPort == dev.DataPort && prev.AudioPort == dev.AudioPort {
+			continue
+		}
+
+		attached, err := d.attach(ctx, dev)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			d.probeFailed(dev, err)
+			continue
+		}
+		d.mu.Lock()
+		d.attached[dev.USBPath] = attached
+		delete(d.failures, dev.USBPath)
+		d.mu.Unlock()
+		if d.health != nil {
+			d.health.Observe(HealthEvent{ModemID: attached.ModemID, Kind: HealthEventDetected})
+		}
+		changed = true
+	}
+
+	d.mu.Lock()
+	var removed []*AttachedModem
+	for usbPath, a := range d.attached {
+		if !present[usbPath] {
+			removed = append(removed, a)
+			delete(d.attached, usbPath)
+		}
+	}
+	for usbPath := range d.failures {
+		if !present[usbPath] {
+			delete(d.failures, usbPath)
+		}
+	}
+	d.mu.Unlock()
+	for _, a := range removed {
+		d.detach(ctx, a)
+		changed = true
+	}
+
+	if changed {
+		d.attachedChanged(ctx)
+	}
+	return nil
+}
+
+// probeFailed logs a modem that could not be identified. A freshly plugged
+// modem takes a few scans to answer, so only repeated failures are warned
+// about.
+func (d *Discovery) probeFailed(dev USBModem, err error) {
+	d.mu.Lock()
+	d.failures[dev.USBPath]++
+	count := d.failures[dev.USBPath]
+	prev := d.attached[dev.USBPath]
+	d.mu.Unlock()
+
+	if d.health != nil && prev != nil && errors.Is(err, ErrTimeout) {
+		d.health.Observe(HealthEvent{ModemID: prev.ModemID, Kind: HealthEventATTimeout, Detail: dev.DataPort})
+	}
+
+	logger := d.logger.WithError(err).WithFields(logrus.Fields{"usb_path": dev.USBPath, "data_port": dev.DataPort})
+	switch {
+	case count == 3:
+		logger.Warn("Cannot identify modem; will keep trying")
+	case count < 3:
+		logger.Debug("Modem not identified yet")
+	}
+}
+
+// attach identifies a modem and records where it is plugged in.
+func (d *Discovery) attach(ctx context.Context, dev USBModem) (*AttachedModem, error) {
+	imei, info, err := d.identify(ctx, dev)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := d.modemRepo.GetModemByIMEI(ctx, imei)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return nil, fmt.Errorf("failed to look up modem %s: %w", imei, err)
+	}
+
+	now := time.Now()
+	modem := &models.Modem{IMEI: models.StringPtr(imei), Status: models.ModemStatusWarning}
+	if existing != nil {
+		// Keep what chan_dongle reported (IMSI, signal, ...); only the
+		// location changes.
+		*modem = *existing
+		if modem.Status == models.ModemStatusOffline || modem.Status == models.ModemStatusError {
+			modem.Status = models.ModemStatusWarning
+		}
+	}
+	modem.GatewayID = d.gatewayID
+	modem.DevicePath = dev.DataPort
+	modem.AudioPath = optionalString(dev.AudioPort)
+	modem.USBPath = models.StringPtr(dev.USBPath)
+	modem.LastSeenAt = &now
+	if info.Manufacturer != "" {
+		modem.Manufacturer = models.StringPtr(info.Manufacturer)
+	}
+	if info.Model != "" {
+		modem.Model = models.StringPtr(info.Model)
+	}
+	if info.Firmware != "" {
+		modem.FirmwareVersion = models.StringPtr(info.Firmware)
+	}
+	if existing == nil || existing.DongleName == nil || !sameGateway(existing.GatewayID, d.gatewayID) {
+		name, err := d.allocateName(ctx, imei)
+		if err != nil {
+			return nil, err
+		}
+		modem.DongleName = models.StringPtr(name)
+	}
+
+	if err := d.modemRepo.UpsertModemByIMEI(ctx, modem); err != nil {
+		return nil, fmt.Errorf("failed to store modem %s: %w", imei, err)
+	}
+
+	logger := d.logger.WithFields(logrus.Fields{
+		"imei":        imei,
+		"dongle_name": *modem.DongleName,
+		"usb_path":    dev.USBPath,
+		"data_port":   dev.DataPort,
+	})
+	if existing != nil && moved(existing, dev) {
+		move := &models.ModemDeviceMove{
+			ModemID:       modem.ID,
+			NewDevicePath: dev.DataPort,
+			NewUSBPath:    models.StringPtr(dev.USBPath),
+			MovedAt:       now,
+		}
+		if existing.DevicePath != "" {
+			move.OldDevicePath = models.StringPtr(existing.DevicePath)
+		}
+		move.OldUSBPath = existing.USBPath
+		if err := d.modemRepo.RecordModemMove(ctx, move); err != nil {
+			logger.WithError(err).Error("Failed to record modem move")
+		}
+		logger.Infof("Modem moved from %s (USB %s)", existing.DevicePath, stringValue(existing.USBPath))
+	} else {
+		logger.Info("Modem attached")
+	}
+
+	return &AttachedModem{
+		USBModem:   dev,
+		ModemID:    modem.ID,
+		IMEI:       imei,
+		DongleName: *modem.DongleName,
+		AttachedAt: now,
+	}, nil
+}
+
+// detach marks a removed modem offline.
+func (d *Discovery) detach(ctx context.Context, a *AttachedModem) {
+	logger := d.logger.WithFields(logrus.Fields{"imei": a.IMEI, "dongle_name": a.DongleName, "usb_path": a.USBPath})
+	logger.Info("Modem removed")
+	if err := d.modemRepo.UpdateModemStatus(ctx, a.ModemID, models.ModemStatusOffline, time.Now()); err != nil {
+		logger.WithError(err).Error("Failed to mark removed modem offline")
+	}
+}
+
+// attachedChanged rewrites dongle.conf and notifies the change handler.
+func (d *Discovery) attachedChanged(ctx context.Context) {
+	modems := d.Attached()
+	if d.dongleConfPath != "" {
+		entries := make([]DongleConfEntry, 0, len(modems))
+		for _, m := range modems {
+			entries = append(entries, DongleConfEntry{
+				Name:      m.DongleName,
+				IMEI:      m.IMEI,
+				DataPort:  m.DataPort,
+				AudioPort: m.AudioPort,
+				USBPath:   m.USBPath,
+			})
+		}
+		written, err := WriteDongleConf(d.dongleConfPath, entries)
+		if err != nil {
+			d.logger.WithError(err).Error("Failed to write dongle.conf")
+		} else if written {
+			d.logger.Infof("Wrote %s with %d modem(s)", d.dongleConfPath, len(entries))
+		}
+	}
+	if d.onChange != nil {
+		d.onChange(ctx, modems)
+	}
+}
+
+// probeInfo is what was read from a modem while identifying it.
+type probeInfo struct {
+	Manufacturer string
+	Model        string
+	Firmware     string
+}
+
+// identify returns the IMEI of a modem, reading it from the AT port unless
+// another process holds the port.
+func (d *Discovery) identify(ctx context.Context, dev USBModem) (string, probeInfo, error) {
+	locked, err := PortLocked(d.lockDir, dev.DataPort)
+	if err != nil {
+		d.logger.WithError(err).Debugf("Ignoring lock file of %s", dev.DataPort)
+	}
+	if locked {
+		imei, err := d.knownIMEI(ctx, dev)
+		return imei, probeInfo{}, err
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	conn, err := Open(probeCtx, dev.DataPort, Options{Name: dev.USBPath, Timeout: 3 * time.Second, Logger: logrus.NewEntry(d.logger)})
+	if err != nil {
+		return "", probeInfo{}, err
+	}
+	defer conn.Close()
+
+	imei, err := conn.IMEI(probeCtx)
+	if err != nil {
+		return "", probeInfo{}, err
+	}
+	if !validIMEI(imei) {
+		return "", probeInfo{}, fmt.Errorf("modem on %s returned invalid IMEI %q", dev.DataPort, imei)
+	}
+	var info probeInfo
+	info.Manufacturer, _ = conn.Manufacturer(probeCtx)
+	info.Model, _ = conn.Model(probeCtx)
+	info.Firmware, _ = conn.Firmware(probeCtx)
+
+	if d.unlocker != nil {
+		d.unlockSIM(ctx, conn, imei)
+	}
+	return imei, info, nil
+}
+
+// unlockSIM unlocks the SIM of a newly plugged modem if it asks for its PIN.
+// Failures are logged and alerted on by the unlocker; the modem is attached
+// either way.
+func (d *Discovery) unlockSIM(ctx context.Context, conn *Device, imei string) {
+	ctx, cancel := context.WithTimeout(ctx, unlockTimeout)
+	defer cancel()
+
+	logger := d.logger.WithField("imei", imei)
+	status, err := conn.PINStatus(ctx)
+	if err != nil || status == PINReady {
+		return
+	}
+	iccid, _ := conn.ICCID(ctx)
+	modemID := 0
+	if m, err := d.modemRepo.GetModemByIMEI(ctx, imei); err == nil {
+		modemID = m.ID
+	}
+	result, err := d.unlocker.Unlock(ctx, conn, iccid, modemID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to unlock SIM")
+		return
+	}
+	if !result.Unlocked {
+		logger.Warnf("SIM left locked (%s)", result.Status)
+	}
+}
+
+// knownIMEI finds the modem last seen on the same USB port, or on the same
+// tty as chan_dongle reported it.
+func (d *Discovery) knownIMEI(ctx context.Context, dev USBModem) (string, error) {
+	modems, err := d.modemRepo.GetAllModems(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load modems: %w", err)
+	}
+	var byPort *models.Modem
+	for i := range modems {
+		m := &modems[i]
+		if m.IMEI == nil || !sameGateway(m.GatewayID, d.gatewayID) {
+			continue
+		}
+		if m.USBPath != nil && *m.USBPath == dev.USBPath {
+			return *m.IMEI, nil
+		}
+		if m.DevicePath == dev.DataPort && byPort == nil {
+			byPort = m
+		}
+	}
+	if byPort != nil {
+		return *byPort.IMEI, nil
+	}
+	return "", fmt.Errorf("%s is in use by another process and the modem is not known yet", dev.DataPort)
+}
+
+// allocateName returns the lowest free dongle name on the gateway.
+func (d *Discovery) allocateName(ctx context.Context, imei string) (string, error) {
+	modems, err := d.modemRepo.GetAllModems(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to load modems: %w", err)
+	}
+	used := make(map[string]bool)
+	for _, m := range modems {
+		if m.DongleName != nil && sameGateway(m.GatewayID, d.gatewayID) && (m.IMEI == nil || *m.IMEI != imei) {
+			used[*m.DongleName] = true
+		}
+	}
+	d.mu.Lock()
+	for _, a := range d.attached {
+		if a.IMEI != imei {
+			used[a.DongleName] = true
+		}
+	}
+	d.mu.Unlock()
+	for i := 0; ; i++ {
+		name := dongleNamePrefix + strconv.Itoa(i)
+		if !used[name] {
+			return name, nil
+		}
+	}
+}
+
+// moved reports whether a modem was last seen somewhere else.
+func moved(existing *models.Modem, dev USBModem) bool {
+	if existing.USBPath != nil && *existing.USBPath != dev.USBPath {
+		return true
+	}
+	// Rows created from chan_dongle events use "dongle:<name>" when the tty
+	// was not reported.
+	return existing.DevicePath != "" && !strings.HasPrefix(existing.DevicePath, "dongle:") && existing.DevicePath != dev.DataPort
+}
+
+func sameGateway(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func validIMEI(imei string) bool {
+	if len(imei) != 15 {
+		return false
+	}
+	for _, r := range imei {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
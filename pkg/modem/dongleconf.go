@@ -0,0 +1,106 @@
+package modem
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// dongleConfHeader holds the [general] and [defaults] sections written ahead
+// of the devices. They match what auto_configure_dongles.py used to write.
+const dongleConfHeader = `; Generated by the E173 gateway from the modems it discovered.
+; Manual edits are overwritten whenever a modem is plugged in or removed.
+
+[general]
+
+interval=15
+
+[defaults]
+context=from-dongle
+group=0
+rxgain=0
+txgain=0
+autodeletesms=yes
+resetdongle=yes
+u2diag=-1
+usecallingpres=yes
+callingpres=allowed_passed_screen
+disablesms=no
+language=en
+smsaspdu=yes
+mindtmfgap=45
+mindtmfduration=80
+mindtmfinterval=200
+callwaiting=auto
+disable=no
+dtmf=relax
+init_watchdog=0
+notreg_watchdog=0
+sms_watchdog=0
+dialing_watchdog=0
+roaming_watchdog=0
+readsms=yes
+read_full_sm=no
+`
+
+// DongleConfEntry is one device section of chan_dongle's dongle.conf.
+type DongleConfEntry struct {
+	Name      string // section name, the chan_dongle device, e.g. "dongle0"
+	IMEI      string
+	DataPort  string
+	AudioPort string
+	USBPath   string // written as a comment
+}
+
+// RenderDongleConf returns a dongle.conf with one section per entry, sorted
+// by name. chan_dongle prefers imei= over the tty settings, so a modem keeps
+// its name even if it moves before the file is rewritten.
+func RenderDongleConf(entries []DongleConfEntry) []byte {
+	sorted := append([]DongleConfEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var buf bytes.Buffer
+	buf.WriteString(dongleConfHeader)
+	for _, e := range sorted {
+		fmt.Fprintf(&buf, "\n; USB port %s\n[%s]\nimei=%s\n", e.USBPath, e.Name, e.IMEI)
+		if e.AudioPort != "" {
+			fmt.Fprintf(&buf, "audio=%s\n", e.AudioPort)
+		}
+		if e.DataPort != "" {
+			fmt.Fprintf(&buf, "data=%s\n", e.DataPort)
+		}
+	}
+	return buf.Bytes()
+}
+
+// WriteDongleConf writes the dongle.conf for entries to path, atomically,
+// and reports whether its content changed.
+func WriteDongleConf(path string, entries []DongleConfEntry) (bool, error) {
+	content := RenderDongleConf(entries)
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".dongle.conf-*")
+	if err != nil {
+		return false, fmt.Errorf("modem: write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("modem: write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(0o640); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("modem: write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("modem: write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, fmt.Errorf("modem: write %s: %w", path, err)
+	}
+	return true, nil
+}
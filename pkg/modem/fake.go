@@ -0,0 +1,153 @@
+package modem
+
+import (
+	"strings"
+	"sync"
+)
+
+// FakePort is a Port that plays a scripted modem, for tests and for running
+// the gateway without dongles attached. Commands without a scripted reply
+// are answered with OK; commands prompting for input (AT+CMGS) get the "> "
+// prompt and are answered once the input's Ctrl-Z arrives.
+type FakePort struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	responses map[string][]string
+	delayed   map[string][]string
+	late      []string // reply of a delayed command, sent with the next one
+	written   []string
+	pending   []byte // modem output not yet read
+	input     string // command waiting for its Ctrl-Z, "" if none
+	inbuf     []byte // bytes written and not yet terminated
+	closed    bool
+}
+
+// NewFakePort returns a FakePort with no scripted replies.
+func NewFakePort() *FakePort {
+	p := &FakePort{responses: make(map[string][]string), delayed: make(map[string][]string)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Respond scripts the reply to a command, matched exactly as written
+// without the trailing carriage return. The lines are sent as given, so they
+// should end with a final result code; OK is appended when they do not.
+func (p *FakePort) Respond(command string, lines ...string) {
+	if len(lines) == 0 || !isFinalResult(lines[len(lines)-1]) {
+		lines = append(lines, "OK")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.responses[command] = lines
+}
+
+// Delay scripts a reply that comes too late: it is sent when the next
+// command is written, ahead of that command's own reply.
+func (p *FakePort) Delay(command string, lines ...string) {
+	if len(lines) == 0 || !isFinalResult(lines[len(lines)-1]) {
+		lines = append(lines, "OK")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.delayed[command] = lines
+}
+
+// Inject makes the modem send lines unprompted, e.g. a "+CMTI: \"SM\",3" URC.
+func (p *FakePort) Inject(lines ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.emit(lines)
+}
+
+// Written returns the commands written so far, without line endings.
+func (p *FakePort) Written() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.written...)
+}
+
+func (p *FakePort) emit(lines []string) {
+	for _, line := range lines {
+		p.pending = append(p.pending, "\r\n"+line+"\r\n"...)
+	}
+	p.cond.Broadcast()
+}
+
+// Read blocks until the modem has output or the port is closed.
+func (p *FakePort) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.pending) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return 0, ErrPortClosed
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// Write accepts commands terminated by a carriage return and message input
+// terminated by Ctrl-Z (or cancelled with Esc).
+func (p *FakePort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, ErrPortClosed
+	}
+	for _, c := range b {
+		switch {
+		case p.input != "" && (c == 0x1a || c == 0x1b):
+			command := p.input
+			p.written = append(p.written, string(p.inbuf))
+			p.input, p.inbuf = "", nil
+			if c == 0x1b {
+				p.emit([]string{"OK"})
+			} else {
+				p.reply(command)
+			}
+		case p.input == "" && c == '\r':
+			command := strings.TrimSpace(string(p.inbuf))
+			p.inbuf = nil
+			if command == "" {
+				continue
+			}
+			p.written = append(p.written, command)
+			if strings.HasPrefix(strings.ToUpper(command), "AT+CMGS=") {
+				p.input = command
+				p.pending = append(p.pending, "\r\n> "...)
+				p.cond.Broadcast()
+				continue
+			}
+			p.reply(command)
+		default:
+			p.inbuf = append(p.inbuf, c)
+		}
+	}
+	return len(b), nil
+}
+
+func (p *FakePort) reply(command string) {
+	late := p.late
+	p.late = nil
+	p.emit(late)
+	if lines, ok := p.delayed[command]; ok {
+		p.late = lines
+		return
+	}
+	if lines, ok := p.responses[command]; ok {
+		p.emit(lines)
+		return
+	}
+	p.emit([]string{"OK"})
+}
+
+// Close makes pending and future reads return ErrPortClosed.
+func (p *FakePort) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,161 @@
+package modem
+
+import (
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+)
+
+// gsmAlphabet is the GSM 03.38 default alphabet.
+var gsmAlphabet = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// gsmExtension holds the characters reached through the escape (0x1b).
+var gsmExtension = map[byte]rune{
+	0x0a: '\f', 0x14: '^', 0x28: '{', 0x29: '}', 0x2f: '\\',
+	0x3c: '[', 0x3d: '~', 0x3e: ']', 0x40: '|', 0x65: '€',
+}
+
+var gsmReverse, gsmExtensionReverse = func() (map[rune]byte, map[rune]byte) {
+	plain := make(map[rune]byte, len(gsmAlphabet))
+	for i, r := range gsmAlphabet {
+		plain[r] = byte(i)
+	}
+	ext := make(map[rune]byte, len(gsmExtension))
+	for b, r := range gsmExtension {
+		ext[r] = b
+	}
+	return plain, ext
+}()
+
+// encodeGSM7 maps text to GSM septets. Characters outside the alphabet
+// become '?'.
+func encodeGSM7(text string) []byte {
+	septets := make([]byte, 0, len(text))
+	for _, r := range text {
+		if b, ok := gsmReverse[r]; ok {
+			septets = append(septets, b)
+		} else if b, ok := gsmExtensionReverse[r]; ok {
+			septets = append(septets, 0x1b, b)
+		} else {
+			septets = append(septets, '?')
+		}
+	}
+	return septets
+}
+
+// decodeGSM7 maps GSM septets to text.
+func decodeGSM7(septets []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(septets); i++ {
+		s := septets[i] & 0x7f
+		if s == 0x1b && i+1 < len(septets) {
+			i++
+			if r, ok := gsmExtension[septets[i]&0x7f]; ok {
+				sb.WriteRune(r)
+			}
+			continue
+		}
+		sb.WriteRune(gsmAlphabet[s])
+	}
+	return sb.String()
+}
+
+// packSeptets packs septets into octets, 8 septets to 7 octets.
+func packSeptets(septets []byte) []byte {
+	packed := make([]byte, 0, (len(septets)*7+7)/8)
+	var acc uint32
+	bits := 0
+	for _, s := range septets {
+		acc |= uint32(s&0x7f) << bits
+		bits += 7
+		for bits >= 8 {
+			packed = append(packed, byte(acc))
+			acc >>= 8
+			bits -= 8
+		}
+	}
+	if bits > 0 {
+		// Fill the last octet with a carriage return rather than a
+		// spurious '@' when 7 bits are left over (3GPP TS 23.038).
+		if bits == 1 {
+			acc |= 0x0d << 1
+		}
+		packed = append(packed, byte(acc))
+	}
+	return packed
+}
+
+// unpackSeptets reverses packSeptets.
+func unpackSeptets(packed []byte) []byte {
+	septets := make([]byte, 0, len(packed)*8/7)
+	var acc uint32
+	bits := 0
+	for _, b := range packed {
+		acc |= uint32(b) << bits
+		bits += 8
+		for bits >= 7 {
+			septets = append(septets, byte(acc&0x7f))
+			acc >>= 7
+			bits -= 7
+		}
+	}
+	// A trailing carriage return in the last septet is padding.
+	if len(packed)%7 == 0 && len(septets) > 0 && septets[len(septets)-1] == 0x0d {
+		septets = septets[:len(septets)-1]
+	}
+	return septets
+}
+
+// encodeUSSD encodes a USSD string the way the E173 wants it with DCS 15:
+// GSM 7-bit packed, as upper-case hex.
+func encodeUSSD(code string) string {
+	return strings.ToUpper(hex.EncodeToString(packSeptets(encodeGSM7(code))))
+}
+
+// decodeUSSD decodes the <str> of a +CUSD. DCS 72 (and other UCS2 schemes)
+// is UTF-16BE hex; otherwise the E173 sends packed GSM 7-bit hex. Text that
+// is not hex at all is passed through, as modems in text mode send it.
+func decodeUSSD(str string, dcs int) string {
+	raw, err := hex.DecodeString(str)
+	if err != nil || str == "" {
+		return str
+	}
+	if dcs&0x0c == 0x08 {
+		return decodeUCS2(raw)
+	}
+	return decodeGSM7(unpackSeptets(raw))
+}
+
+// decodeUCS2 decodes UTF-16BE bytes.
+func decodeUCS2(raw []byte) string {
+	units := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// decodeMaybeUCS2 decodes text the modem sent as UCS2 hex (AT+CSCS="UCS2",
+// or messages it could not show in the GSM character set) and returns any
+// other text unchanged. Only strings made of whole UTF-16 units of hex that
+// decode to printable text are treated as UCS2.
+func decodeMaybeUCS2(text string) string {
+	if len(text) < 4 || len(text)%4 != 0 {
+		return text
+	}
+	raw, err := hex.DecodeString(text)
+	if err != nil {
+		return text
+	}
+	decoded := decodeUCS2(raw)
+	for _, r := range decoded {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+			return text
+		}
+		if r == 0xfffd {
+			return text
+		}
+	}
+	return decoded
+}
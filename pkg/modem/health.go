@@ -0,0 +1,708 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// healthTickInterval is how often health timers and recovery are checked.
+	healthTickInterval = 10 * time.Second
+	// recoveryActionTimeout bounds a single recovery action.
+	recoveryActionTimeout = 60 * time.Second
+	// signalHysteresisDB is how far above the weak threshold the signal must
+	// come back before it no longer counts as weak.
+	signalHysteresisDB = 3
+)
+
+// RecoveryAction is a step of the recovery ladder of a failed modem.
+type RecoveryAction string
+
+// Recovery actions, tried in this order.
+const (
+	RecoveryReset      RecoveryAction = "reset"       // chan_dongle resets the modem
+	RecoveryRestart    RecoveryAction = "restart"     // chan_dongle closes and reopens the device
+	RecoveryPowerCycle RecoveryAction = "power-cycle" // the USB port is switched off and on
+)
+
+var recoveryLadder = []RecoveryAction{RecoveryReset, RecoveryRestart, RecoveryPowerCycle}
+
+// ErrNoHubController is the error of a power-cycle that cannot be done
+// because no hub controller is configured or the modem's USB port is unknown.
+var ErrNoHubController = errors.New("modem: no USB hub controller for the modem's port")
+
+// ErrNotQuarantined is returned when releasing a modem that is not
+// quarantined.
+var ErrNotQuarantined = errors.New("modem: not quarantined")
+
+// Recoverer resets and restarts modems through whatever drives them,
+// normally chan_dongle.
+type Recoverer interface {
+	ResetModem(ctx context.Context, m *models.Modem) error
+	RestartModem(ctx context.Context, m *models.Modem) error
+}
+
+// HubController switches the power of USB ports, given as the USB path of
+// the device plugged into them (e.g. "1-1.4.2").
+type HubController interface {
+	PowerCycle(ctx context.Context, usbPath string) error
+}
+
+// HealthStore is where HealthMonitor keeps health states and its audit
+// trail. repository.ModemRepository implements it.
+type HealthStore interface {
+	GetModemByID(ctx context.Context, id int) (*models.Modem, error)
+	UpdateModemHealth(ctx context.Context, id int, state string, changedAt time.Time) error
+	RecordHealthTransition(ctx context.Context, transition *models.ModemHealthTransition) error
+}
+
+// HealthConfig holds the thresholds of the modem health state machine.
+type HealthConfig struct {
+	WeakSignalDBM    int           // a registered modem below this is degraded
+	CallFailureLimit int           // consecutive failed calls that degrade a modem; twice as many fail it
+	ATTimeoutLimit   int           // consecutive AT timeouts that fail a modem
+	InitTimeout      time.Duration // an initializing modem that has not registered by then is failed
+	DegradedFor      time.Duration // a degraded modem that is unregistered or failing calls this long is failed
+	RecoveryWait     time.Duration // time a recovery action gets to bring the modem back
+	MaxRecoveries    int           // recovery episodes within RecoveryWindow before the modem is quarantined
+	RecoveryWindow   time.Duration
+}
+
+// DefaultHealthConfig returns the thresholds used unless configured
+// otherwise.
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		WeakSignalDBM:    -95,
+		CallFailureLimit: 3,
+		ATTimeoutLimit:   3,
+		InitTimeout:      3 * time.Minute,
+		DegradedFor:      5 * time.Minute,
+		RecoveryWait:     2 * time.Minute,
+		MaxRecoveries:    3,
+		RecoveryWindow:   24 * time.Hour,
+	}
+}
+
+// HealthEventKind is what happened to a modem.
+type HealthEventKind string
+
+// Health events.
+const (
+	HealthEventDetected     HealthEventKind = "detected"     // plugged in or first reported
+	HealthEventInitializing HealthEventKind = "initializing" // chan_dongle is (re)initializing it
+	HealthEventRegistered   HealthEventKind = "registered"   // registered on the network
+	HealthEventUnregistered HealthEventKind = "unregistered" // lost or has no registration
+	HealthEventBusy         HealthEventKind = "busy"         // a call started
+	HealthEventIdle         HealthEventKind = "idle"         // free for calls
+	HealthEventCallResult   HealthEventKind = "call-result"  // a call ended; Failed if the modem failed it
+	HealthEventSignal       HealthEventKind = "signal"       // a signal reading, in SignalDBM
+	HealthEventATTimeout    HealthEventKind = "at-timeout"   // the modem did not answer an AT command
+	HealthEventPortFailed   HealthEventKind = "port-failed"  // its serial port failed
+)
+
+// HealthEvent is an observation about a modem fed to HealthMonitor.
+type HealthEvent struct {
+	ModemID   int
+	Kind      HealthEventKind
+	Failed    bool      // HealthEventCallResult: the call failed because of the modem
+	SignalDBM int       // HealthEventSignal
+	Detail    string    // free text for the audit trail
+	At        time.Time // zero means now
+}
+
+// ModemHealthStatus is the health of a modem as HealthMonitor sees it.
+type ModemHealthStatus struct {
+	ModemID       int            `json:"modem_id"`
+	State         string         `json:"state"`
+	Since         time.Time      `json:"since"`
+	Reason        string         `json:"reason"`
+	Registered    bool           `json:"registered"`
+	WeakSignal    bool           `json:"weak_signal"`
+	CallFailures  int            `json:"call_failures"`
+	ATTimeouts    int            `json:"at_timeouts"`
+	RecoveryStep  int            `json:"recovery_step"` // actions taken in the current recovery
+	LastAction    RecoveryAction `json:"last_action,omitempty"`
+	RecentFailure int            `json:"recent_failures"` // recovery episodes within the window
+}
+
+// modemHealth is the state machine of one modem.
+type modemHealth struct {
+	id           int
+	state        string
+	since        time.Time
+	reason       string
+	registered   bool
+	weak         bool
+	busy         bool
+	callFailures int
+	atTimeouts   int
+
+	step       int            // recovery actions taken since the modem failed
+	stepAt     time.Time      // when the last one was taken
+	lastAction RecoveryAction // the last one
+	episodes   []time.Time    // times the modem failed, within the recovery window
+}
+
+// healthy reports whether nothing keeps the modem from being ready.
+func (h *modemHealth) healthy(cfg HealthConfig) bool {
+	return h.registered && !h.weak && h.callFailures < cfg.CallFailureLimit
+}
+
+// problem describes why the modem is not healthy.
+func (h *modemHealth) problem(cfg HealthConfig) string {
+	switch {
+	case !h.registered:
+		return "not registered on the network"
+	case h.callFailures >= cfg.CallFailureLimit:
+		return fmt.Sprintf("%d consecutive calls failed", h.callFailures)
+	case h.weak:
+		return "weak signal"
+	}
+	return ""
+}
+
+// settle returns the state a working modem should be in: ready, busy or
+// degraded.
+func (h *modemHealth) settle(cfg HealthConfig, why string) (string, string) {
+	if !h.healthy(cfg) {
+		return models.ModemHealthDegraded, h.problem(cfg)
+	}
+	if h.busy {
+		return models.ModemHealthBusy, why
+	}
+	return models.ModemHealthReady, why
+}
+
+// apply updates the modem with an event and returns the state it should
+// move to and why, or "" to stay.
+func (h *modemHealth) apply(ev HealthEvent, cfg HealthConfig) (string, string) {
+	if h.state == models.ModemHealthQuarantined {
+		// Only an operator brings a modem out of quarantine.
+		return "", ""
+	}
+	failed := h.state == models.ModemHealthFailed
+	working := h.state == models.ModemHealthReady || h.state == models.ModemHealthBusy || h.state == models.ModemHealthDegraded
+
+	switch ev.Kind {
+	case HealthEventDetected:
+		if h.state == models.ModemHealthDiscovered {
+			return models.ModemHealthInitializing, "modem detected"
+		}
+
+	case HealthEventInitializing:
+		h.registered = false
+		// A failed modem reinitializes as part of its recovery; it stays
+		// failed until it registers.
+		if !failed && h.state != models.ModemHealthInitializing {
+			return models.ModemHealthInitializing, "modem initializing"
+		}
+
+	case HealthEventRegistered, HealthEventIdle:
+		h.registered = true
+		h.atTimeouts = 0
+		if ev.Kind == HealthEventIdle {
+			h.busy = false
+		}
+		switch {
+		case failed:
+			h.callFailures = 0
+			if h.lastAction == "" {
+				return h.settle(cfg, "registered again")
+			}
+			return h.settle(cfg, fmt.Sprintf("recovered after %s", h.lastAction))
+		case h.state != models.ModemHealthReady:
+			if to, why := h.settle(cfg, "registered on the network"); to != h.state {
+				return to, why
+			}
+		}
+
+	case HealthEventUnregistered:
+		h.registered = false
+		if h.state == models.ModemHealthReady || h.state == models.ModemHealthBusy {
+			return models.ModemHealthDegraded, "lost network registration"
+		}
+
+	case HealthEventBusy:
+		h.busy = true
+		h.registered = true
+		if h.state == models.ModemHealthReady {
+			return models.ModemHealthBusy, "call started"
+		}
+
+	case HealthEventCallResult:
+		if !ev.Failed {
+			h.callFailures = 0
+			if h.state == models.ModemHealthDegraded && h.healthy(cfg) {
+				return h.settle(cfg, "calls succeeding again")
+			}
+			break
+		}
+		h.callFailures++
+		switch {
+		case working && h.callFailures >= 2*cfg.CallFailureLimit:
+			return models.ModemHealthFailed, fmt.Sprintf("%d consecutive calls failed", h.callFailures)
+		case (h.state == models.ModemHealthReady || h.state == models.ModemHealthBusy) && h.callFailures >= cfg.CallFailureLimit:
+			return models.ModemHealthDegraded, fmt.Sprintf("%d consecutive calls failed", h.callFailures)
+		}
+
+	case HealthEventSignal:
+		switch {
+		case ev.SignalDBM < cfg.WeakSignalDBM:
+			h.weak = true
+		case ev.SignalDBM >= cfg.WeakSignalDBM+signalHysteresisDB:
+			h.weak = false
+		}
+		if h.weak && (h.state == models.ModemHealthReady || h.state == models.ModemHealthBusy) {
+			return models.ModemHealthDegraded, fmt.Sprintf("weak signal (%d dBm)", ev.SignalDBM)
+		}
+		if !h.weak && h.state == models.ModemHealthDegraded && h.healthy(cfg) {
+			return h.settle(cfg, fmt.Sprintf("signal recovered (%d dBm)", ev.SignalDBM))
+		}
+
+	case HealthEventATTimeout:
+		h.atTimeouts++
+		if !failed && h.atTimeouts >= cfg.ATTimeoutLimit {
+			return models.ModemHealthFailed, fmt.Sprintf("%d consecutive AT timeouts", h.atTimeouts)
+		}
+		if h.state == models.ModemHealthReady || h.state == models.ModemHealthBusy {
+			return models.ModemHealthDegraded, "AT command timed out"
+		}
+
+	case HealthEventPortFailed:
+		h.registered = false
+		if !failed {
+			return models.ModemHealthFailed, "serial port failed"
+		}
+	}
+	return "", ""
+}
+
+// expire returns the state a modem should move to because it has been in
+// its current one too long, or "".
+func (h *modemHealth) expire(cfg HealthConfig, now time.Time) (string, string) {
+	in := now.Sub(h.since)
+	switch h.state {
+	case models.ModemHealthInitializing:
+		if in >= cfg.InitTimeout {
+			return models.ModemHealthFailed, fmt.Sprintf("not registered after %s", cfg.InitTimeout)
+		}
+	case models.ModemHealthDegraded:
+		// Weak signal alone is the antenna's or the site's problem, which no
+		// reset fixes; it stays degraded.
+		if in >= cfg.DegradedFor && (!h.registered || h.callFailures >= cfg.CallFailureLimit) {
+			return models.ModemHealthFailed, fmt.Sprintf("degraded for %s: %s", cfg.DegradedFor, h.problem(cfg))
+		}
+	}
+	return "", ""
+}
+
+// nextRecovery returns the recovery action due for a failed modem, or
+// exhausted when the ladder has been climbed without success.
+func (h *modemHealth) nextRecovery(cfg HealthConfig, now time.Time) (action RecoveryAction, exhausted bool) {
+	if h.step > 0 && now.Sub(h.stepAt) < cfg.RecoveryWait {
+		return "", false
+	}
+	if h.step >= len(recoveryLadder) {
+		return "", true
+	}
+	return recoveryLadder[h.step], false
+}
+
+// enterFailed starts a recovery episode and reports whether the modem has
+// failed too often to keep trying.
+func (h *modemHealth) enterFailed(cfg HealthConfig, now time.Time) bool {
+	h.busy = false
+	h.step = 0
+	h.stepAt = time.Time{}
+	h.lastAction = ""
+	kept := h.episodes[:0]
+	for _, t := range h.episodes {
+		if now.Sub(t) < cfg.RecoveryWindow {
+			kept = append(kept, t)
+		}
+	}
+	h.episodes = append(kept, now)
+	return len(h.episodes) > cfg.MaxRecoveries
+}
+
+// HealthMonitor runs the health state machine of every modem:
+//
+//	discovered -> initializing -> ready <-> busy
+//	                                 \       /
+//	                                 degraded -> failed -> quarantined
+//
+// It is fed HealthEvents (registration, calls, signal, AT timeouts) and
+// checks its timers every few seconds. A failed modem is recovered by
+// climbing a ladder of actions, each given RecoveryWait to work: a reset,
+// a restart, then a power-cycle of its USB port. A modem whose ladder runs
+// out, or which fails more than MaxRecoveries times within RecoveryWindow,
+// is quarantined until an operator releases it. Every transition and action
+// is recorded, and failed and quarantined modems raise alerts.
+type HealthMonitor struct {
+	cfg       HealthConfig
+	store     HealthStore
+	alertRepo repository.AlertRepository
+	recoverer Recoverer
+	hub       HubController
+	logger    *logrus.Logger
+	now       func() time.Time
+
+	mu     sync.Mutex
+	modems map[int]*modemHealth
+	events chan HealthEvent
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewHealthMonitor creates a HealthMonitor. alertRepo, recoverer and hub may
+// be nil: no alerts are raised and the missing recovery actions count as
+// failed.
+func NewHealthMonitor(cfg HealthConfig, store HealthStore, alertRepo repository.AlertRepository, recoverer Recoverer, hub HubController, logger *logrus.Logger) *HealthMonitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &HealthMonitor{
+		cfg:       cfg,
+		store:     store,
+		alertRepo: alertRepo,
+		recoverer: recoverer,
+		hub:       hub,
+		logger:    logger,
+		now:       time.Now,
+		modems:    make(map[int]*modemHealth),
+		events:    make(chan HealthEvent, 256),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// SetClock replaces the clock, for driving the timers in simulations. Call
+// before Start.
+func (m *HealthMonitor) SetClock(now func() time.Time) {
+	m.now = now
+}
+
+// Start processes observed events and checks the timers in the background.
+func (m *HealthMonitor) Start() {
+	m.started = true
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(healthTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case ev := <-m.events:
+				m.Process(m.ctx, ev)
+			case <-ticker.C:
+				m.Tick(m.ctx)
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background processing and waits for it to finish.
+func (m *HealthMonitor) Stop() {
+	m.cancel()
+	if m.started {
+		<-m.done
+	}
+}
+
+// Observe queues an event for the background processing. It never blocks;
+// events are dropped when the queue is full.
+func (m *HealthMonitor) Observe(ev HealthEvent) {
+	if ev.At.IsZero() {
+		ev.At = m.now()
+	}
+	select {
+	case m.events <- ev:
+	default:
+		m.logger.WithFields(logrus.Fields{"modem_id": ev.ModemID, "event": ev.Kind}).Warn("Modem health event queue full; event dropped")
+	}
+}
+
+// Process applies an event right away.
+func (m *HealthMonitor) Process(ctx context.Context, ev HealthEvent) {
+	if ev.ModemID == 0 {
+		return
+	}
+	if ev.At.IsZero() {
+		ev.At = m.now()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.modem(ctx, ev.ModemID)
+	if h == nil {
+		return
+	}
+	if to, reason := h.apply(ev, m.cfg); to != "" {
+		if ev.Detail != "" {
+			reason += ": " + ev.Detail
+		}
+		m.transition(ctx, h, to, reason, ev.At)
+	}
+}
+
+// pendingRecovery is a recovery action decided under the lock and taken
+// outside it.
+type pendingRecovery struct {
+	modemID int
+	action  RecoveryAction
+	step    int
+	state   string
+}
+
+// Tick moves modems that stayed too long in a state and takes the recovery
+// actions that are due.
+func (m *HealthMonitor) Tick(ctx context.Context) {
+	now := m.now()
+	var due []pendingRecovery
+
+	m.mu.Lock()
+	for _, h := range m.modems {
+		if to, reason := h.expire(m.cfg, now); to != "" {
+			m.transition(ctx, h, to, reason, now)
+		}
+		if h.state != models.ModemHealthFailed {
+			continue
+		}
+		action, exhausted := h.nextRecovery(m.cfg, now)
+		switch {
+		case exhausted:
+			m.transition(ctx, h, models.ModemHealthQuarantined,
+				fmt.Sprintf("not recovered by %s", h.lastAction), now)
+		case action != "":
+			h.step++
+			h.stepAt = now
+			h.lastAction = action
+			due = append(due, pendingRecovery{modemID: h.id, action: action, step: h.step, state: h.state})
+		}
+	}
+	m.mu.Unlock()
+
+	for _, p := range due {
+		m.recover(ctx, p, now)
+	}
+}
+
+// recover takes a recovery action and records it. A failed action does not
+// use up RecoveryWait; the next one is due on the next tick.
+func (m *HealthMonitor) recover(ctx context.Context, p pendingRecovery, now time.Time) {
+	logger := m.logger.WithFields(logrus.Fields{"modem_id": p.modemID, "action": p.action})
+	modem, err := m.store.GetModemByID(ctx, p.modemID)
+	if err == nil {
+		actionCtx, cancel := context.WithTimeout(ctx, recoveryActionTimeout)
+		err = m.runAction(actionCtx, p.action, modem)
+		cancel()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	action := string(p.action)
+	t := &models.ModemHealthTransition{
+		ModemID:   p.modemID,
+		FromState: p.state,
+		ToState:   p.state,
+		Reason:    fmt.Sprintf("recovery step %d of %d", p.step, len(recoveryLadder)),
+		Action:    &action,
+		CreatedAt: now,
+	}
+	if err != nil {
+		msg := err.Error()
+		t.ActionError = &msg
+		if h := m.modems[p.modemID]; h.state == models.ModemHealthFailed && h.step == p.step {
+			h.stepAt = time.Time{}
+		}
+		logger.WithError(err).Warn("Modem recovery action failed")
+	} else {
+		logger.Info("Modem recovery action taken")
+	}
+	if err := m.store.RecordHealthTransition(ctx, t); err != nil {
+		logger.WithError(err).Error("Failed to record modem recovery action")
+	}
+}
+
+// runAction carries out one recovery action on a modem.
+func (m *HealthMonitor) runAction(ctx context.Context, action RecoveryAction, modem *models.Modem) error {
+	switch action {
+	case RecoveryReset, RecoveryRestart:
+		if m.recoverer == nil {
+			return errors.New("modem: no recoverer configured")
+		}
+		if action == RecoveryReset {
+			return m.recoverer.ResetModem(ctx, modem)
+		}
+		return m.recoverer.RestartModem(ctx, modem)
+	case RecoveryPowerCycle:
+		if m.hub == nil || modem.USBPath == nil || *modem.USBPath == "" {
+			return ErrNoHubController
+		}
+		return m.hub.PowerCycle(ctx, *modem.USBPath)
+	}
+	return fmt.Errorf("modem: unknown recovery action %q", action)
+}
+
+// Quarantine takes a modem out of service until Release.
+func (m *HealthMonitor) Quarantine(ctx context.Context, modemID int, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.modem(ctx, modemID)
+	if h == nil {
+		return repository.ErrNotFound
+	}
+	if h.state != models.ModemHealthQuarantined {
+		m.transition(ctx, h, models.ModemHealthQuarantined, "quarantined by operator: "+reason, m.now())
+	}
+	return nil
+}
+
+// Release returns a quarantined modem to service. It starts over as
+// initializing, with its failure history cleared.
+func (m *HealthMonitor) Release(ctx context.Context, modemID int, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.modem(ctx, modemID)
+	if h == nil {
+		return repository.ErrNotFound
+	}
+	if h.state != models.ModemHealthQuarantined {
+		return fmt.Errorf("%w: modem %d is %s", ErrNotQuarantined, modemID, h.state)
+	}
+	h.episodes = nil
+	h.registered, h.weak, h.busy = false, false, false
+	h.callFailures = 0
+	h.atTimeouts = 0
+	m.transition(ctx, h, models.ModemHealthInitializing, "released by operator: "+reason, m.now())
+	return nil
+}
+
+// States returns the health of every modem seen so far, by modem ID.
+func (m *HealthMonitor) States() []ModemHealthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make([]ModemHealthStatus, 0, len(m.modems))
+	for _, h := range m.modems {
+		states = append(states, ModemHealthStatus{
+			ModemID:       h.id,
+			State:         h.state,
+			Since:         h.since,
+			Reason:        h.reason,
+			Registered:    h.registered,
+			WeakSignal:    h.weak,
+			CallFailures:  h.callFailures,
+			ATTimeouts:    h.atTimeouts,
+			RecoveryStep:  h.step,
+			LastAction:    h.lastAction,
+			RecentFailure: len(h.episodes),
+		})
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ModemID < states[j].ModemID })
+	return states
+}
+
+// modem returns the state machine of a modem, starting it from the stored
+// health state the first time. Called with mu held.
+func (m *HealthMonitor) modem(ctx context.Context, id int) *modemHealth {
+	if h, ok := m.modems[id]; ok {
+		return h
+	}
+	stored, err := m.store.GetModemByID(ctx, id)
+	if err != nil {
+		if !errors.Is(err, repository.ErrNotFound) {
+			m.logger.WithError(err).WithField("modem_id", id).Error("Failed to load modem health")
+		}
+		return nil
+	}
+	h := &modemHealth{id: id, state: stored.HealthState, since: m.now()}
+	if h.state == "" {
+		h.state = models.ModemHealthDiscovered
+	}
+	if stored.HealthChangedAt != nil {
+		h.since = *stored.HealthChangedAt
+	}
+	m.modems[id] = h
+	return h
+}
+
+// transition moves a modem to a new state, records it and raises or
+// resolves alerts. Called with mu held.
+func (m *HealthMonitor) transition(ctx context.Context, h *modemHealth, to, reason string, at time.Time) {
+	from := h.state
+	h.state, h.since, h.reason = to, at, reason
+
+	logger := m.logger.WithFields(logrus.Fields{"modem_id": h.id, "from": from, "to": to})
+	logger.Infof("Modem health changed: %s", reason)
+	if err := m.store.UpdateModemHealth(ctx, h.id, to, at); err != nil {
+		logger.WithError(err).Error("Failed to store modem health")
+	}
+	if err := m.store.RecordHealthTransition(ctx, &models.ModemHealthTransition{
+		ModemID:   h.id,
+		FromState: from,
+		ToState:   to,
+		Reason:    reason,
+		CreatedAt: at,
+	}); err != nil {
+		logger.WithError(err).Error("Failed to record modem health transition")
+	}
+
+	switch to {
+	case models.ModemHealthFailed:
+		m.raise(ctx, h.id, models.AlertKindModemFailed, models.AlertSeverityWarning, "Modem failed: "+reason)
+		if h.enterFailed(m.cfg, at) {
+			m.transition(ctx, h, models.ModemHealthQuarantined,
+				fmt.Sprintf("failed %d times within %s", len(h.episodes), m.cfg.RecoveryWindow), at)
+		}
+	case models.ModemHealthQuarantined:
+		h.step = 0
+		m.resolve(ctx, h.id, models.AlertKindModemFailed)
+		m.raise(ctx, h.id, models.AlertKindModemQuarantined, models.AlertSeverityCritical, "Modem quarantined: "+reason)
+	case models.ModemHealthReady, models.ModemHealthBusy:
+		h.step = 0
+		m.resolve(ctx, h.id, models.AlertKindModemFailed)
+	case models.ModemHealthInitializing:
+		if from == models.ModemHealthQuarantined {
+			m.resolve(ctx, h.id, models.AlertKindModemQuarantined)
+		}
+	}
+}
+
+// raise opens or refreshes an alert on a modem.
+func (m *HealthMonitor) raise(ctx context.Context, modemID int, kind, severity, message string) {
+	if m.alertRepo == nil {
+		return
+	}
+	alert := &models.Alert{
+		Kind:       kind,
+		Severity:   severity,
+		EntityType: models.AlertEntityModem,
+		EntityID:   strconv.Itoa(modemID),
+		Message:    message,
+	}
+	if err := m.alertRepo.RaiseAlert(ctx, alert); err != nil {
+		m.logger.WithError(err).WithField("modem_id", modemID).Errorf("Failed to raise %s alert", kind)
+	}
+}
+
+// resolve closes an alert on a modem.
+func (m *HealthMonitor) resolve(ctx context.Context, modemID int, kind string) {
+	if m.alertRepo == nil {
+		return
+	}
+	if err := m.alertRepo.ResolveAlerts(ctx, kind, models.AlertEntityModem, strconv.Itoa(modemID)); err != nil {
+		m.logger.WithError(err).WithField("modem_id", modemID).Errorf("Failed to resolve %s alert", kind)
+	}
+}
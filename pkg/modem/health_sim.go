@@ -0,0 +1,157 @@
+package modem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+)
+
+// SimulatedModems stands in for the modems table, chan_dongle and a USB hub
+// so HealthMonitor can be exercised without hardware: it is the monitor's
+// HealthStore, Recoverer and HubController at once. Recovery actions are
+// recorded per modem; the one a modem is set up to be fixed by is answered
+// with the events a real modem sends once it is back, initializing and then
+// registered with a good signal.
+type SimulatedModems struct {
+	mu          sync.Mutex
+	monitor     *HealthMonitor
+	modems      map[int]*SimulatedModem
+	transitions []models.ModemHealthTransition
+}
+
+// SimulatedModem is a modem of SimulatedModems.
+type SimulatedModem struct {
+	Modem   models.Modem
+	FixedBy RecoveryAction   // the action that brings it back, "" for none
+	Fail    error            // returned by every recovery action, if set
+	Actions []RecoveryAction // actions taken, in order
+}
+
+// NewSimulatedModems returns an empty simulation.
+func NewSimulatedModems() *SimulatedModems {
+	return &SimulatedModems{modems: make(map[int]*SimulatedModem)}
+}
+
+// Attach sets the monitor that recovered modems report back to.
+func (s *SimulatedModems) Attach(monitor *HealthMonitor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.monitor = monitor
+}
+
+// Add adds a modem plugged into usbPath that recovers by fixedBy.
+func (s *SimulatedModems) Add(id int, usbPath string, fixedBy RecoveryAction) *SimulatedModem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := &SimulatedModem{
+		Modem: models.Modem{
+			ID:          id,
+			USBPath:     models.StringPtr(usbPath),
+			Status:      models.ModemStatusOnline,
+			HealthState: models.ModemHealthDiscovered,
+		},
+		FixedBy: fixedBy,
+	}
+	s.modems[id] = m
+	return m
+}
+
+// Transitions returns the transitions recorded for a modem, oldest first.
+func (s *SimulatedModems) Transitions(modemID int) []models.ModemHealthTransition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []models.ModemHealthTransition
+	for _, t := range s.transitions {
+		if t.ModemID == modemID {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// GetModemByID implements HealthStore.
+func (s *SimulatedModems) GetModemByID(ctx context.Context, id int) (*models.Modem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.modems[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	modem := m.Modem
+	return &modem, nil
+}
+
+// UpdateModemHealth implements HealthStore.
+func (s *SimulatedModems) UpdateModemHealth(ctx context.Context, id int, state string, changedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.modems[id]
+	if !ok {
+		return repository.ErrNotFound
+	}
+	m.Modem.HealthState = state
+	m.Modem.HealthChangedAt = &changedAt
+	return nil
+}
+
+// RecordHealthTransition implements HealthStore.
+func (s *SimulatedModems) RecordHealthTransition(ctx context.Context, t *models.ModemHealthTransition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.ID = int64(len(s.transitions) + 1)
+	s.transitions = append(s.transitions, *t)
+	return nil
+}
+
+// ResetModem implements Recoverer.
+func (s *SimulatedModems) ResetModem(ctx context.Context, m *models.Modem) error {
+	return s.act(ctx, m.ID, RecoveryReset)
+}
+
+// RestartModem implements Recoverer.
+func (s *SimulatedModems) RestartModem(ctx context.Context, m *models.Modem) error {
+	return s.act(ctx, m.ID, RecoveryRestart)
+}
+
+// PowerCycle implements HubController.
+func (s *SimulatedModems) PowerCycle(ctx context.Context, usbPath string) error {
+	s.mu.Lock()
+	id := 0
+	for _, m := range s.modems {
+		if m.Modem.USBPath != nil && *m.Modem.USBPath == usbPath {
+			id = m.Modem.ID
+		}
+	}
+	s.mu.Unlock()
+	if id == 0 {
+		return ErrNoHubController
+	}
+	return s.act(ctx, id, RecoveryPowerCycle)
+}
+
+// act records a recovery action and, if it fixes the modem, reports the
+// modem back.
+func (s *SimulatedModems) act(ctx context.Context, id int, action RecoveryAction) error {
+	s.mu.Lock()
+	m, ok := s.modems[id]
+	if !ok {
+		s.mu.Unlock()
+		return repository.ErrNotFound
+	}
+	m.Actions = append(m.Actions, action)
+	fail, fixed, monitor := m.Fail, m.FixedBy == action, s.monitor
+	s.mu.Unlock()
+
+	if fail != nil {
+		return fail
+	}
+	if fixed && monitor != nil {
+		monitor.Process(ctx, HealthEvent{ModemID: id, Kind: HealthEventInitializing})
+		monitor.Process(ctx, HealthEvent{ModemID: id, Kind: HealthEventRegistered})
+		monitor.Process(ctx, HealthEvent{ModemID: id, Kind: HealthEventSignal, SignalDBM: -70})
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+// testClock is a clock the tests move by hand.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// simulatedMonitor returns a HealthMonitor on a simulation with modem 1 on
+// USB path 1-1.2, recovering by fixedBy, and a clock to drive its timers.
+func simulatedMonitor(t *testing.T, fixedBy RecoveryAction) (*HealthMonitor, *SimulatedModems, *testClock) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	sim := NewSimulatedModems()
+	sim.Add(1, "1-1.2", fixedBy)
+	m := NewHealthMonitor(DefaultHealthConfig(), sim, nil, sim, sim, logger)
+	sim.Attach(m)
+	clock := &testClock{now: time.Date(2024, 3, 15, 14, 30, 0, 0, time.UTC)}
+	m.SetClock(clock.Now)
+	return m, sim, clock
+}
+
+func state(t *testing.T, m *HealthMonitor, modemID int) ModemHealthStatus {
+	t.Helper()
+	for _, s := range m.States() {
+		if s.ModemID == modemID {
+			return s
+		}
+	}
+	t.Fatalf("modem %d has no health state", modemID)
+	return ModemHealthStatus{}
+}
+
+// bringUp takes modem 1 from discovered to ready.
+func bringUp(ctx context.Context, m *HealthMonitor) {
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventDetected})
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventRegistered})
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventSignal, SignalDBM: -70})
+}
+
+func TestHealthTransitions(t *testing.T) {
+	failedCall := HealthEvent{Kind: HealthEventCallResult, Failed: true}
+	tests := []struct {
+		name   string
+		events []HealthEvent
+		want   []string // states after bringUp, in order
+	}{
+		{
+			name:   "call",
+			events: []HealthEvent{{Kind: HealthEventBusy}, {Kind: HealthEventIdle}},
+			want:   []string{models.ModemHealthBusy, models.ModemHealthReady},
+		},
+		{
+			name:   "lost registration",
+			events: []HealthEvent{{Kind: HealthEventUnregistered}, {Kind: HealthEventRegistered}},
+			want:   []string{models.ModemHealthDegraded, models.ModemHealthReady},
+		},
+		{
+			name: "weak signal with hysteresis",
+			events: []HealthEvent{
+				{Kind: HealthEventSignal, SignalDBM: -100},
+				{Kind: HealthEventSignal, SignalDBM: -94}, // above the threshold, within the hysteresis
+				{Kind: HealthEventSignal, SignalDBM: -92},
+			},
+			want: []string{models.ModemHealthDegraded, models.ModemHealthReady},
+		},
+		{
+			name:   "failing calls",
+			events: []HealthEvent{failedCall, failedCall, failedCall, failedCall, failedCall, failedCall},
+			want:   []string{models.ModemHealthDegraded, models.ModemHealthFailed},
+		},
+		{
+			name:   "failing calls then a good one",
+			events: []HealthEvent{failedCall, failedCall, failedCall, {Kind: HealthEventCallResult}},
+			want:   []string{models.ModemHealthDegraded, models.ModemHealthReady},
+		},
+		{
+			name:   "AT timeouts",
+			events: []HealthEvent{{Kind: HealthEventATTimeout}, {Kind: HealthEventATTimeout}, {Kind: HealthEventATTimeout}},
+			want:   []string{models.ModemHealthDegraded, models.ModemHealthFailed},
+		},
+		{
+			name:   "port failure",
+			events: []HealthEvent{{Kind: HealthEventPortFailed}},
+			want:   []string{models.ModemHealthFailed},
+		},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		m, sim, _ := simulatedMonitor(t, "")
+		bringUp(ctx, m)
+		for _, ev := range tt.events {
+			ev.ModemID = 1
+			m.Process(ctx, ev)
+		}
+		var got []string
+		for _, tr := range sim.Transitions(1)[2:] {
+			got = append(got, tr.ToState)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: went through %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHealthBringUp(t *testing.T) {
+	ctx := context.Background()
+	m, sim, _ := simulatedMonitor(t, "")
+	bringUp(ctx, m)
+	var got []string
+	for _, tr := range sim.Transitions(1) {
+		got = append(got, tr.FromState+"->"+tr.ToState)
+	}
+	want := []string{"discovered->initializing", "initializing->ready"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("went through %v, want %v", got, want)
+	}
+	if modem, _ := sim.GetModemByID(ctx, 1); modem.HealthState != models.ModemHealthReady {
+		t.Errorf("stored health state %q, want ready", modem.HealthState)
+	}
+}
+
+func TestHealthInitTimeout(t *testing.T) {
+	ctx := context.Background()
+	m, _, clock := simulatedMonitor(t, "")
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventDetected})
+	clock.Advance(DefaultHealthConfig().InitTimeout - time.Second)
+	m.Tick(ctx)
+	if s := state(t, m, 1); s.State != models.ModemHealthInitializing {
+		t.Fatalf("state %s before the init timeout, want initializing", s.State)
+	}
+	clock.Advance(time.Second)
+	m.Tick(ctx)
+	if s := state(t, m, 1); s.State != models.ModemHealthFailed {
+		t.Errorf("state %s after the init timeout, want failed", s.State)
+	}
+}
+
+func TestWeakSignalAloneStaysDegraded(t *testing.T) {
+	ctx := context.Background()
+	m, sim, clock := simulatedMonitor(t, RecoveryReset)
+	bringUp(ctx, m)
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventSignal, SignalDBM: -105})
+	clock.Advance(time.Hour)
+	m.Tick(ctx)
+	if s := state(t, m, 1); s.State != models.ModemHealthDegraded {
+		t.Errorf("state %s, want degraded", s.State)
+	}
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	if actions := sim.modems[1].Actions; len(actions) != 0 {
+		t.Errorf("recovery actions %v taken for a weak signal", actions)
+	}
+}
+
+// failAndRecover fails modem 1 and ticks through RecoveryWait steps until the
+// modem leaves the failed state or ticks run out.
+func failAndRecover(ctx context.Context, m *HealthMonitor, clock *testClock, ticks int) {
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventPortFailed})
+	for i := 0; i < ticks; i++ {
+		m.Tick(ctx)
+		clock.Advance(DefaultHealthConfig().RecoveryWait)
+	}
+}
+
+func TestRecoveryLadder(t *testing.T) {
+	tests := []struct {
+		fixedBy RecoveryAction
+		actions []RecoveryAction
+		state   string
+		reason  string
+	}{
+		{RecoveryReset, []RecoveryAction{RecoveryReset}, models.ModemHealthReady, "recovered after reset"},
+		{RecoveryRestart, []RecoveryAction{RecoveryReset, RecoveryRestart}, models.ModemHealthReady, "recovered after restart"},
+		{RecoveryPowerCycle, []RecoveryAction{RecoveryReset, RecoveryRestart, RecoveryPowerCycle}, models.ModemHealthReady, "recovered after power-cycle"},
+		{"", []RecoveryAction{RecoveryReset, RecoveryRestart, RecoveryPowerCycle}, models.ModemHealthQuarantined, "not recovered by power-cycle"},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		m, sim, clock := simulatedMonitor(t, tt.fixedBy)
+		bringUp(ctx, m)
+		// More ticks than the ladder has steps: it must stop at its top.
+		failAndRecover(ctx, m, clock, 10)
+
+		sim.mu.Lock()
+		actions := sim.modems[1].Actions
+		sim.mu.Unlock()
+		if !reflect.DeepEqual(actions, tt.actions) {
+			t.Errorf("fixed by %q: actions %v, want %v", tt.fixedBy, actions, tt.actions)
+		}
+		if s := state(t, m, 1); s.State != tt.state || s.Reason != tt.reason {
+			t.Errorf("fixed by %q: %s (%s), want %s (%s)", tt.fixedBy, s.State, s.Reason, tt.state, tt.reason)
+		}
+	}
+}
+
+func TestRecoveryWaitsBetweenSteps(t *testing.T) {
+	ctx := context.Background()
+	m, sim, clock := simulatedMonitor(t, "")
+	bringUp(ctx, m)
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventPortFailed})
+
+	m.Tick(ctx)
+	clock.Advance(DefaultHealthConfig().RecoveryWait - time.Second)
+	m.Tick(ctx)
+	sim.mu.Lock()
+	actions := append([]RecoveryAction(nil), sim.modems[1].Actions...)
+	sim.mu.Unlock()
+	if !reflect.DeepEqual(actions, []RecoveryAction{RecoveryReset}) {
+		t.Fatalf("actions %v within RecoveryWait of the reset, want only the reset", actions)
+	}
+
+	clock.Advance(time.Second)
+	m.Tick(ctx)
+	sim.mu.Lock()
+	actions = sim.modems[1].Actions
+	sim.mu.Unlock()
+	if !reflect.DeepEqual(actions, []RecoveryAction{RecoveryReset, RecoveryRestart}) {
+		t.Errorf("actions %v after RecoveryWait, want a restart next", actions)
+	}
+	var recorded []string
+	for _, tr := range sim.Transitions(1) {
+		if tr.Action != nil {
+			recorded = append(recorded, *tr.Action+": "+tr.Reason)
+		}
+	}
+	want := []string{"reset: recovery step 1 of 3", "restart: recovery step 2 of 3"}
+	if !reflect.DeepEqual(recorded, want) {
+		t.Errorf("recorded actions %v, want %v", recorded, want)
+	}
+}
+
+func TestFailedRecoveryActionMovesOn(t *testing.T) {
+	ctx := context.Background()
+	m, sim, _ := simulatedMonitor(t, "")
+	sim.mu.Lock()
+	sim.modems[1].Fail = errors.New("device not found")
+	sim.mu.Unlock()
+	bringUp(ctx, m)
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventPortFailed})
+
+	// A failed action does not wait out RecoveryWait.
+	for i := 0; i < 4; i++ {
+		m.Tick(ctx)
+	}
+	sim.mu.Lock()
+	actions := sim.modems[1].Actions
+	sim.mu.Unlock()
+	if want := []RecoveryAction{RecoveryReset, RecoveryRestart, RecoveryPowerCycle}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("actions %v, want %v", actions, want)
+	}
+	if s := state(t, m, 1); s.State != models.ModemHealthQuarantined {
+		t.Errorf("state %s, want quarantined", s.State)
+	}
+	for _, tr := range sim.Transitions(1) {
+		if tr.Action != nil && (tr.ActionError == nil || *tr.ActionError != "device not found") {
+			t.Errorf("%s recorded with error %v", *tr.Action, tr.ActionError)
+		}
+	}
+}
+
+func TestRepeatedFailuresQuarantine(t *testing.T) {
+	ctx := context.Background()
+	m, sim, clock := simulatedMonitor(t, RecoveryReset)
+	bringUp(ctx, m)
+	max := DefaultHealthConfig().MaxRecoveries
+	for i := 0; i < max; i++ {
+		failAndRecover(ctx, m, clock, 1)
+		if s := state(t, m, 1); s.State != models.ModemHealthReady {
+			t.Fatalf("failure %d: state %s, want ready", i+1, s.State)
+		}
+	}
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventPortFailed})
+	s := state(t, m, 1)
+	if s.State != models.ModemHealthQuarantined {
+		t.Fatalf("failure %d: state %s, want quarantined", max+1, s.State)
+	}
+	m.Tick(ctx)
+	sim.mu.Lock()
+	n := len(sim.modems[1].Actions)
+	sim.mu.Unlock()
+	if n != max {
+		t.Errorf("%d recovery actions, want %d: none for a quarantined modem", n, max)
+	}
+
+	// Only an operator brings it back, with its history cleared.
+	m.Process(ctx, HealthEvent{ModemID: 1, Kind: HealthEventRegistered})
+	if s := state(t, m, 1); s.State != models.ModemHealthQuarantined {
+		t.Errorf("state %s after registering, want quarantined", s.State)
+	}
+	if err := m.Release(ctx, 1, "replaced SIM"); err != nil {
+		t.Fatal(err)
+	}
+	s = state(t, m, 1)
+	if s.State != models.ModemHealthInitializing || s.RecentFailure != 0 {
+		t.Errorf("after release: %s with %d recent failures, want initializing with none", s.State, s.RecentFailure)
+	}
+	if err := m.Release(ctx, 1, "again"); !errors.Is(err, ErrNotQuarantined) {
+		t.Errorf("releasing twice: got %v, want ErrNotQuarantined", err)
+	}
+}
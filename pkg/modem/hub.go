@@ -0,0 +1,51 @@
+package modem
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Uhubctl is a HubController that switches USB port power with uhubctl.
+// Only hubs with per-port power switching support it; on others uhubctl
+// fails and the power-cycle is recorded as failed.
+type Uhubctl struct {
+	path string
+}
+
+// NewUhubctl returns a Uhubctl running the uhubctl binary at path, looked up
+// in PATH when it has no slash.
+func NewUhubctl(path string) *Uhubctl {
+	if path == "" {
+		path = "uhubctl"
+	}
+	return &Uhubctl{path: path}
+}
+
+// PowerCycle switches off and on the hub port a USB device is plugged into.
+func (u *Uhubctl) PowerCycle(ctx context.Context, usbPath string) error {
+	hub, port, err := splitUSBPath(usbPath)
+	if err != nil {
+		return err
+	}
+	out, err := exec.CommandContext(ctx, u.path, "-l", hub, "-p", port, "-a", "cycle").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("modem: uhubctl -l %s -p %s: %w: %s", hub, port, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// splitUSBPath splits a USB device path into the location of the hub it is
+// plugged into and the port on that hub, as uhubctl names them: "1-1.4.2"
+// is port 2 of hub "1-1.4", and "1-3" port 3 of root hub "1".
+func splitUSBPath(usbPath string) (hub, port string, err error) {
+	i := strings.LastIndexByte(usbPath, '.')
+	if i < 0 {
+		i = strings.LastIndexByte(usbPath, '-')
+	}
+	if i <= 0 || i == len(usbPath)-1 {
+		return "", "", fmt.Errorf("modem: malformed USB path %q", usbPath)
+	}
+	return usbPath[:i], usbPath[i+1:], nil
+}
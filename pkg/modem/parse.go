@@ -0,0 +1,328 @@
+package modem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SignalQuality is the reply to AT+CSQ.
+type SignalQuality struct {
+	RSSI    int // 0-31, 99 if unknown
+	BER     int // 0-7, 99 if unknown
+	DBM     int // -113..-51, 0 if unknown
+	Unknown bool
+}
+
+// RegistrationStatus is the <stat> of +CREG.
+type RegistrationStatus int
+
+const (
+	RegNotSearching RegistrationStatus = 0
+	RegHome         RegistrationStatus = 1
+	RegSearching    RegistrationStatus = 2
+	RegDenied       RegistrationStatus = 3
+	RegUnknown      RegistrationStatus = 4
+	RegRoaming      RegistrationStatus = 5
+)
+
+func (s RegistrationStatus) String() string {
+	switch s {
+	case RegNotSearching:
+		return "not-registered"
+	case RegHome:
+		return "home"
+	case RegSearching:
+		return "searching"
+	case RegDenied:
+		return "denied"
+	case RegRoaming:
+		return "roaming"
+	default:
+		return "unknown"
+	}
+}
+
+// Registered reports whether the modem is on a network.
+func (s RegistrationStatus) Registered() bool {
+	return s == RegHome || s == RegRoaming
+}
+
+// Registration is a +CREG reply or URC. LAC and CellID are set when the modem
+// reports location (AT+CREG=2).
+type Registration struct {
+	Status RegistrationStatus
+	LAC    string // hex, e.g. "1A2B"
+	CellID string // hex
+}
+
+// Operator is the reply to AT+COPS?.
+type Operator struct {
+	Mode   int
+	Format int    // 0 long alphanumeric, 1 short, 2 numeric
+	Name   string // in Format; empty when not registered
+	AcT    int    // access technology, -1 if not reported (0 GSM, 2 UTRAN)
+}
+
+// PINStatus is the reply to AT+CPIN?, e.g. "READY", "SIM PIN", "SIM PUK".
+type PINStatus string
+
+const (
+	PINReady   PINStatus = "READY"
+	PINNeeded  PINStatus = "SIM PIN"
+	PUKNeeded  PINStatus = "SIM PUK"
+	PIN2Needed PINStatus = "SIM PIN2"
+	PUK2Needed PINStatus = "SIM PUK2"
+)
+
+// SMS is a stored message listed by AT+CMGL in text mode.
+type SMS struct {
+	Index  int
+	Status string // "REC UNREAD", "REC READ", "STO UNSENT", "STO SENT"
+	Sender string
+	Time   string // service centre timestamp as sent, "yy/MM/dd,hh:mm:ss+zz"
+	Text   string // decoded when the modem delivered UCS2 hex
+}
+
+// RawSMS is a stored message listed by AT+CMGL in PDU mode; see DecodePDU.
+type RawSMS struct {
+	Index  int
+	Status int // 0 received unread, 1 received read, 2 stored unsent, 3 stored sent
+	PDU    string
+}
+
+// USSDReply is a +CUSD URC.
+type USSDReply struct {
+	Status int    // 0 done, 1 further action required, 2 terminated by network, 4 not supported, 5 timeout
+	Text   string // decoded
+	DCS    int
+}
+
+// fields splits the value of an information line on commas that are not
+// inside quotes, and strips the quotes.
+func fields(value string) []string {
+	var out []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			out = append(out, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	return append(out, strings.TrimSpace(cur.String()))
+}
+
+// infoValue strips prefix (e.g. "+CSQ:") from an information line.
+func infoValue(line, prefix string) (string, error) {
+	if !strings.HasPrefix(line, prefix) {
+		return "", fmt.Errorf("modem: expected %s, got %q", prefix, line)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, prefix)), nil
+}
+
+// ParseCSQ parses "+CSQ: <rssi>,<ber>".
+func ParseCSQ(line string) (SignalQuality, error) {
+	value, err := infoValue(line, "+CSQ:")
+	if err != nil {
+		return SignalQuality{}, err
+	}
+	f := fields(value)
+	if len(f) != 2 {
+		return SignalQuality{}, fmt.Errorf("modem: malformed +CSQ %q", line)
+	}
+	rssi, err1 := strconv.Atoi(f[0])
+	ber, err2 := strconv.Atoi(f[1])
+	if err1 != nil || err2 != nil {
+		return SignalQuality{}, fmt.Errorf("modem: malformed +CSQ %q", line)
+	}
+	sq := SignalQuality{RSSI: rssi, BER: ber}
+	if rssi == 99 || rssi < 0 || rssi > 31 {
+		sq.Unknown = true
+	} else {
+		sq.DBM = -113 + 2*rssi
+	}
+	return sq, nil
+}
+
+// ParseCREG parses a +CREG reply ("+CREG: <n>,<stat>[,<lac>,<ci>]") or URC
+// ("+CREG: <stat>[,<lac>,<ci>]").
+func ParseCREG(line string) (Registration, error) {
+	value, err := infoValue(line, "+CREG:")
+	if err != nil {
+		return Registration{}, err
+	}
+	f := fields(value)
+	// The reply leads with <n>, giving it two or four fields; a URC has one
+	// or three.
+	if len(f) == 2 || len(f) == 4 {
+		f = f[1:]
+	}
+	stat, err := strconv.Atoi(f[0])
+	if err != nil {
+		return Registration{}, fmt.Errorf("modem: malformed +CREG %q", line)
+	}
+	reg := Registration{Status: RegistrationStatus(stat)}
+	if len(f) >= 3 {
+		reg.LAC, reg.CellID = strings.ToUpper(f[1]), strings.ToUpper(f[2])
+	}
+	return reg, nil
+}
+
+// ParseCOPS parses "+COPS: <mode>[,<format>,<oper>[,<AcT>]]".
+func ParseCOPS(line string) (Operator, error) {
+	value, err := infoValue(line, "+COPS:")
+	if err != nil {
+		return Operator{}, err
+	}
+	f := fields(value)
+	op := Operator{AcT: -1}
+	if op.Mode, err = strconv.Atoi(f[0]); err != nil {
+		return Operator{}, fmt.Errorf("modem: malformed +COPS %q", line)
+	}
+	if len(f) >= 3 {
+		op.Format, _ = strconv.Atoi(f[1])
+		op.Name = f[2]
+	}
+	if len(f) >= 4 {
+		if act, err := strconv.Atoi(f[3]); err == nil {
+			op.AcT = act
+		}
+	}
+	return op, nil
+}
+
+// ParseCPIN parses "+CPIN: <code>".
+func ParseCPIN(line string) (PINStatus, error) {
+	value, err := infoValue(line, "+CPIN:")
+	if err != nil {
+		return "", err
+	}
+	return PINStatus(strings.ToUpper(value)), nil
+}
+
+// ParseCCID parses the ICCID reply of AT+CCID ("+CCID: 8944..."), AT^ICCID
+// ("^ICCID: 9844...", nibble-swapped) or a bare number line.
+func ParseCCID(line string) (string, error) {
+	value := line
+	swapped := false
+	switch {
+	case strings.HasPrefix(line, "+CCID:"):
+		value = strings.TrimPrefix(line, "+CCID:")
+	case strings.HasPrefix(line, "^ICCID:"):
+		value = strings.TrimPrefix(line, "^ICCID:")
+		swapped = true
+	}
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if swapped {
+		b := []byte(value)
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+		value = string(b)
+	}
+	// Padding nibble of 19-digit ICCIDs.
+	value = strings.TrimRight(value, "Ff")
+	if len(value) < 18 || len(value) > 22 {
+		return "", fmt.Errorf("modem: malformed ICCID %q", line)
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("modem: malformed ICCID %q", line)
+		}
+	}
+	return value, nil
+}
+
+// ParseCMGL parses the lines of an AT+CMGL reply in text mode: each
+// "+CMGL: <index>,<stat>,<oa>,[<alpha>],<scts>" header is followed by the
+// message text, which may span several lines.
+func ParseCMGL(lines []string) ([]SMS, error) {
+	var messages []SMS
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "+CMGL:") {
+			if len(messages) == 0 {
+				return nil, fmt.Errorf("modem: text before +CMGL header: %q", line)
+			}
+			last := &messages[len(messages)-1]
+			if last.Text != "" {
+				last.Text += "\n"
+			}
+			last.Text += line
+			continue
+		}
+		value, _ := infoValue(line, "+CMGL:")
+		f := fields(value)
+		if len(f) < 3 {
+			return nil, fmt.Errorf("modem: malformed +CMGL %q", line)
+		}
+		index, err := strconv.Atoi(f[0])
+		if err != nil {
+			return nil, fmt.Errorf("modem: malformed +CMGL %q", line)
+		}
+		sms := SMS{Index: index, Status: f[1], Sender: decodeMaybeUCS2(f[2])}
+		if len(f) >= 5 {
+			sms.Time = f[4]
+		}
+		messages = append(messages, sms)
+	}
+	for i := range messages {
+		messages[i].Text = decodeMaybeUCS2(messages[i].Text)
+	}
+	return messages, nil
+}
+
+// ParseCMGLPDU parses the lines of an AT+CMGL reply in PDU mode: each
+// "+CMGL: <index>,<stat>,[<alpha>],<length>" header is followed by the PDU
+// in hex.
+func ParseCMGLPDU(lines []string) ([]RawSMS, error) {
+	var messages []RawSMS
+	expectPDU := false
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "+CMGL:") {
+			if !expectPDU {
+				return nil, fmt.Errorf("modem: text before +CMGL header: %q", line)
+			}
+			messages[len(messages)-1].PDU = strings.TrimSpace(line)
+			expectPDU = false
+			continue
+		}
+		value, _ := infoValue(line, "+CMGL:")
+		f := fields(value)
+		if len(f) < 2 {
+			return nil, fmt.Errorf("modem: malformed +CMGL %q", line)
+		}
+		index, err := strconv.Atoi(f[0])
+		if err != nil {
+			return nil, fmt.Errorf("modem: malformed +CMGL %q", line)
+		}
+		status, _ := strconv.Atoi(f[1])
+		messages = append(messages, RawSMS{Index: index, Status: status})
+		expectPDU = true
+	}
+	return messages, nil
+}
+
+// ParseCUSD parses the value of a +CUSD URC: <m>[,<str>,<dcs>]. The E173
+// sends <str> as hex: GSM 7-bit packed for DCS 15, UCS2 for DCS 72.
+func ParseCUSD(value string) (USSDReply, error) {
+	value = strings.TrimSpace(strings.TrimPrefix(value, "+CUSD:"))
+	f := fields(value)
+	status, err := strconv.Atoi(f[0])
+	if err != nil {
+		return USSDReply{}, fmt.Errorf("modem: malformed +CUSD %q", value)
+	}
+	reply := USSDReply{Status: status}
+	if len(f) >= 3 {
+		reply.DCS, _ = strconv.Atoi(f[2])
+	}
+	if len(f) >= 2 {
+		reply.Text = decodeUSSD(f[1], reply.DCS)
+	}
+	return reply, nil
+}
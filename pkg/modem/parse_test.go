@@ -0,0 +1,261 @@
+package modem
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeDevice returns a Device on a FakePort, closed when the test ends.
+func fakeDevice(t *testing.T) (*Device, *FakePort) {
+	t.Helper()
+	port := NewFakePort()
+	d := New(port, Options{Name: "fake", Timeout: 2 * time.Second})
+	t.Cleanup(func() { d.Close() })
+	return d, port
+}
+
+func TestSignalQuality(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  SignalQuality
+	}{
+		{"+CSQ: 17,99", SignalQuality{RSSI: 17, BER: 99, DBM: -79}},
+		{"+CSQ: 0,0", SignalQuality{RSSI: 0, BER: 0, DBM: -113}},
+		{"+CSQ: 31,7", SignalQuality{RSSI: 31, BER: 7, DBM: -51}},
+		{"+CSQ: 99,99", SignalQuality{RSSI: 99, BER: 99, Unknown: true}},
+	}
+	for _, tt := range tests {
+		d, port := fakeDevice(t)
+		port.Respond("AT+CSQ", tt.reply)
+		got, err := d.SignalQuality(context.Background())
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestParseCSQMalformed(t *testing.T) {
+	for _, line := range []string{"+CSQ: 17", "+CSQ: a,b", "+CREG: 0,1"} {
+		if _, err := ParseCSQ(line); err == nil {
+			t.Errorf("ParseCSQ(%q) succeeded", line)
+		}
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  Registration
+	}{
+		{"+CREG: 0,1", Registration{Status: RegHome}},
+		{"+CREG: 0,5", Registration{Status: RegRoaming}},
+		{"+CREG: 0,3", Registration{Status: RegDenied}},
+		{`+CREG: 2,1,"1a2b","00c3"`, Registration{Status: RegHome, LAC: "1A2B", CellID: "00C3"}},
+	}
+	for _, tt := range tests {
+		d, port := fakeDevice(t)
+		port.Respond("AT+CREG?", tt.reply)
+		got, err := d.Registration(context.Background())
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestParseCREGURC(t *testing.T) {
+	tests := []struct {
+		line string
+		want Registration
+	}{
+		{"+CREG: 2", Registration{Status: RegSearching}},
+		{`+CREG: 1,"03E8","4F2A"`, Registration{Status: RegHome, LAC: "03E8", CellID: "4F2A"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCREG(tt.line)
+		if err != nil {
+			t.Errorf("ParseCREG(%q): %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseCREG(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestOperator(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  Operator
+	}{
+		{`+COPS: 0,0,"IAM",2`, Operator{Mode: 0, Format: 0, Name: "IAM", AcT: 2}},
+		{`+COPS: 0,0,"Orange MA"`, Operator{Mode: 0, Format: 0, Name: "Orange MA", AcT: -1}},
+		{`+COPS: 0,2,"60400",0`, Operator{Mode: 0, Format: 2, Name: "60400", AcT: 0}},
+		{"+COPS: 0", Operator{Mode: 0, AcT: -1}},
+	}
+	for _, tt := range tests {
+		d, port := fakeDevice(t)
+		port.Respond("AT+COPS?", tt.reply)
+		got, err := d.Operator(context.Background())
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestPINStatus(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  PINStatus
+	}{
+		{"+CPIN: READY", PINReady},
+		{"+CPIN: SIM PIN", PINNeeded},
+		{"+CPIN: SIM PUK", PUKNeeded},
+		{"+CPIN: sim pin2", PIN2Needed},
+	}
+	for _, tt := range tests {
+		d, port := fakeDevice(t)
+		port.Respond("AT+CPIN?", tt.reply)
+		got, err := d.PINStatus(context.Background())
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestPINStatusNoSIM(t *testing.T) {
+	d, port := fakeDevice(t)
+	port.Respond("AT+CPIN?", "+CME ERROR: 10")
+	if _, err := d.PINStatus(context.Background()); !IsCME(err, 10) {
+		t.Errorf("got %v, want +CME ERROR 10", err)
+	}
+}
+
+func TestListSMS(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []string
+		want  []SMS
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "text",
+			reply: []string{
+				`+CMGL: 1,"REC UNREAD","+212612345678",,"24/03/15,14:30:00+00"`,
+				"Votre solde est de 10.50 DH",
+				`+CMGL: 2,"REC READ","IAM",,"24/03/15,14:31:00+00"`,
+				"Line one",
+				"Line two",
+			},
+			want: []SMS{
+				{Index: 1, Status: "REC UNREAD", Sender: "+212612345678", Time: "24/03/15,14:30:00+00", Text: "Votre solde est de 10.50 DH"},
+				{Index: 2, Status: "REC READ", Sender: "IAM", Time: "24/03/15,14:31:00+00", Text: "Line one\nLine two"},
+			},
+		},
+		{
+			name: "ucs2",
+			reply: []string{
+				`+CMGL: 3,"REC UNREAD","002B003200310032003600310032003300340035003600370038",,"24/03/15,14:30:00+00"`,
+				"0633064406270645",
+			},
+			want: []SMS{
+				{Index: 3, Status: "REC UNREAD", Sender: "+212612345678", Time: "24/03/15,14:30:00+00", Text: "سلام"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		d, port := fakeDevice(t)
+		port.Respond(`AT+CMGL="ALL"`, tt.reply...)
+		got, err := d.ListSMS(context.Background(), "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseCMGLPDU(t *testing.T) {
+	got, err := ParseCMGLPDU([]string{
+		"+CMGL: 0,1,,28",
+		"00040C91126221436587000842305141030000080633064406270645",
+		"+CMGL: 4,0,,26",
+		"00062A0C91126221436587423051410300004230514103000000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RawSMS{
+		{Index: 0, Status: 1, PDU: "00040C91126221436587000842305141030000080633064406270645"},
+		{Index: 4, Status: 0, PDU: "00062A0C91126221436587423051410300004230514103000000"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := ParseCMGLPDU([]string{"0011"}); err == nil {
+		t.Error("PDU without header accepted")
+	}
+}
+
+func TestSendUSSD(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  USSDReply
+	}{
+		{`+CUSD: 0,"C8329BFD06",15`, USSDReply{Status: 0, Text: "Hello", DCS: 15}},
+		{`+CUSD: 1,"0053006F006C00640065",72`, USSDReply{Status: 1, Text: "Solde", DCS: 72}},
+		{`+CUSD: 0,"Solde 10 DH",15`, USSDReply{Status: 0, Text: "Solde 10 DH", DCS: 15}},
+		{"+CUSD: 4", USSDReply{Status: 4}},
+	}
+	for _, tt := range tests {
+		d, port := fakeDevice(t)
+		// *100# packed as GSM 7-bit.
+		port.Respond(`AT+CUSD=1,"AA180C3602",15`, tt.reply)
+		got, err := d.SendUSSD(context.Background(), "*100#")
+		if err != nil {
+			t.Errorf("%q: %v", tt.reply, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestSendUSSDWaitsForURC(t *testing.T) {
+	d, port := fakeDevice(t)
+	go func() {
+		for len(port.Written()) == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		port.Inject(`+CUSD: 2,"00420061006C",72`)
+	}()
+	got, err := d.SendUSSD(context.Background(), "*100#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (USSDReply{Status: 2, Text: "Bal", DCS: 72}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
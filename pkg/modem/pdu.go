@@ -0,0 +1,446 @@
+package modem
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// SMS encodings.
+const (
+	EncodingGSM7 = "gsm7"
+	EncodingUCS2 = "ucs2"
+	Encoding8Bit = "8bit"
+)
+
+// Single-part and per-part limits of the two text encodings; each part of
+// a concatenated message loses room to its user data header.
+const (
+	gsm7SingleLimit = 160 // septets
+	gsm7PartLimit   = 153
+	ucs2SingleLimit = 70 // UTF-16 units
+	ucs2PartLimit   = 67
+)
+
+// ErrMalformedPDU is returned for PDUs that cannot be decoded.
+var ErrMalformedPDU = errors.New("modem: malformed PDU")
+
+// PDU types of SMSPDU.
+const (
+	PDUDeliver      = "deliver"       // an incoming message
+	PDUStatusReport = "status-report" // a delivery report for a sent message
+)
+
+// Concat identifies one part of a concatenated message.
+type Concat struct {
+	Ref   int // same for all parts of a message from one sender
+	Total int
+	Seq   int // 1-based
+}
+
+// SMSPDU is a decoded SMS-DELIVER or SMS-STATUS-REPORT.
+type SMSPDU struct {
+	Type     string
+	Number   string    // sender of a message, recipient of the reported one
+	Time     time.Time // service centre timestamp
+	Encoding string
+	Text     string
+	Concat   *Concat // nil unless part of a concatenated message
+
+	// Status reports only.
+	Reference     int       // TP-MR of the reported message
+	Status        int       // TP-ST: below 0x20 delivered, 0x20-0x3f still trying, above failed
+	DischargeTime time.Time // when it was delivered or given up
+}
+
+// Delivered reports whether a status report says the message arrived.
+func (p *SMSPDU) Delivered() bool {
+	return p.Status < 0x20
+}
+
+// Pending reports whether a status report says the service centre is still
+// trying.
+func (p *SMSPDU) Pending() bool {
+	return p.Status >= 0x20 && p.Status < 0x40
+}
+
+// SubmitPDU is an encoded SMS-SUBMIT ready for AT+CMGS in PDU mode.
+type SubmitPDU struct {
+	Hex    string // with an empty service centre address
+	Length int    // TPDU octets, the argument of AT+CMGS
+}
+
+// IsGSM7 reports whether text can be sent in the GSM 7-bit alphabet.
+func IsGSM7(text string) bool {
+	for _, r := range text {
+		if _, ok := gsmReverse[r]; ok {
+			continue
+		}
+		if _, ok := gsmExtensionReverse[r]; ok {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// SplitSMS picks the encoding for text and splits it into the parts it is
+// sent as: one if it fits a single message, otherwise as many as the
+// concatenation headers leave room for. GSM escape sequences and UTF-16
+// surrogate pairs are never split.
+func SplitSMS(text string) (encoding string, parts []string) {
+	if IsGSM7(text) {
+		if len(encodeGSM7(text)) <= gsm7SingleLimit {
+			return EncodingGSM7, []string{text}
+		}
+		return EncodingGSM7, splitByCost(text, gsm7PartLimit, func(r rune) int {
+			if _, ok := gsmReverse[r]; ok {
+				return 1
+			}
+			return 2
+		})
+	}
+	if len(utf16.Encode([]rune(text))) <= ucs2SingleLimit {
+		return EncodingUCS2, []string{text}
+	}
+	return EncodingUCS2, splitByCost(text, ucs2PartLimit, func(r rune) int {
+		if r >= 0x10000 {
+			return 2
+		}
+		return 1
+	})
+}
+
+// splitByCost cuts text into chunks whose runes cost at most limit each.
+func splitByCost(text string, limit int, cost func(rune) int) []string {
+	var parts []string
+	var cur strings.Builder
+	used := 0
+	for _, r := range text {
+		c := cost(r)
+		if used+c > limit {
+			parts = append(parts, cur.String())
+			cur.Reset()
+			used = 0
+		}
+		cur.WriteRune(r)
+		used += c
+	}
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+	return parts
+}
+
+// EncodeSubmit encodes text to number as SMS-SUBMIT PDUs, concatenated
+// under ref when it needs more than one part. statusReport asks the service
+// centre for a delivery report.
+func EncodeSubmit(number, text string, ref byte, statusReport bool) ([]SubmitPDU, error) {
+	da, err := encodeAddress(number)
+	if err != nil {
+		return nil, err
+	}
+	encoding, parts := SplitSMS(text)
+	pdus := make([]SubmitPDU, 0, len(parts))
+	for i, part := range parts {
+		var udh []byte
+		if len(parts) > 1 {
+			udh = []byte{0x05, 0x00, 0x03, ref, byte(len(parts)), byte(i + 1)}
+		}
+
+		first := byte(0x01 | 0x10) // SMS-SUBMIT, relative validity period
+		if statusReport {
+			first |= 0x20
+		}
+		if udh != nil {
+			first |= 0x40
+		}
+		tpdu := []byte{first, 0x00} // the modem fills in TP-MR
+		tpdu = append(tpdu, da...)
+		tpdu = append(tpdu, 0x00) // TP-PID
+
+		var ud []byte
+		var udl int
+		if encoding == EncodingGSM7 {
+			tpdu = append(tpdu, 0x00)
+			septets := encodeGSM7(part)
+			if udh != nil {
+				// The header takes 7 septets: 6 octets and a fill bit.
+				septets = append(make([]byte, 7), septets...)
+			}
+			ud = packSeptets(septets)
+			copy(ud, udh)
+			udl = len(septets)
+		} else {
+			tpdu = append(tpdu, 0x08)
+			ud = append(ud, udh...)
+			for _, u := range utf16.Encode([]rune(part)) {
+				ud = append(ud, byte(u>>8), byte(u))
+			}
+			udl = len(ud)
+		}
+		tpdu = append(tpdu, 0xa7) // validity: 24 hours
+		tpdu = append(tpdu, byte(udl))
+		tpdu = append(tpdu, ud...)
+
+		pdus = append(pdus, SubmitPDU{
+			Hex:    "00" + strings.ToUpper(hex.EncodeToString(tpdu)),
+			Length: len(tpdu),
+		})
+	}
+	return pdus, nil
+}
+
+// encodeAddress encodes a phone number as a TP-DA.
+func encodeAddress(number string) ([]byte, error) {
+	toa := byte(0x81) // unknown numbering plan
+	digits := number
+	if strings.HasPrefix(digits, "+") {
+		toa = 0x91 // international
+		digits = digits[1:]
+	}
+	if digits == "" || len(digits) > 20 {
+		return nil, fmt.Errorf("modem: invalid number %q", number)
+	}
+	for _, r := range digits {
+		if (r < '0' || r > '9') && r != '*' && r != '#' {
+			return nil, fmt.Errorf("modem: invalid number %q", number)
+		}
+	}
+	out := []byte{byte(len(digits)), toa}
+	for i := 0; i < len(digits); i += 2 {
+		lo := semiOctet(digits[i])
+		hi := byte(0x0f)
+		if i+1 < len(digits) {
+			hi = semiOctet(digits[i+1])
+		}
+		out = append(out, hi<<4|lo)
+	}
+	return out, nil
+}
+
+func semiOctet(c byte) byte {
+	switch c {
+	case '*':
+		return 0x0a
+	case '#':
+		return 0x0b
+	}
+	return c - '0'
+}
+
+// pduReader walks the octets of a PDU.
+type pduReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *pduReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.b) {
+		r.err = ErrMalformedPDU
+		return nil
+	}
+	out := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return out
+}
+
+func (r *pduReader) octet() byte {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// DecodePDU decodes an SMS-DELIVER or SMS-STATUS-REPORT as listed by
+// AT+CMGL or pushed in +CMT/+CDS in PDU mode, service centre address
+// included.
+func DecodePDU(pdu string) (*SMSPDU, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(pdu))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPDU, err)
+	}
+	r := &pduReader{b: raw}
+	r.take(int(r.octet())) // service centre address
+
+	first := r.octet()
+	var p *SMSPDU
+	switch first & 0x03 {
+	case 0x00:
+		p = decodeDeliver(r, first)
+	case 0x02:
+		p = decodeStatusReport(r)
+	default:
+		if r.err == nil {
+			return nil, fmt.Errorf("%w: unsupported message type %d", ErrMalformedPDU, first&0x03)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return p, nil
+}
+
+func decodeDeliver(r *pduReader, first byte) *SMSPDU {
+	p := &SMSPDU{Type: PDUDeliver}
+	p.Number = readAddress(r)
+	r.octet() // TP-PID
+	dcs := r.octet()
+	p.Time = readTimestamp(r)
+	udl := int(r.octet())
+	p.Encoding = dcsEncoding(dcs)
+	p.Text, p.Concat = readUserData(r, p.Encoding, udl, first&0x40 != 0)
+	return p
+}
+
+func decodeStatusReport(r *pduReader) *SMSPDU {
+	p := &SMSPDU{Type: PDUStatusReport}
+	p.Reference = int(r.octet())
+	p.Number = readAddress(r)
+	p.Time = readTimestamp(r)
+	p.DischargeTime = readTimestamp(r)
+	p.Status = int(r.octet())
+	return p
+}
+
+// readAddress reads a TP-OA/TP-RA: digits, or GSM text for alphanumeric
+// senders such as operator names.
+func readAddress(r *pduReader) string {
+	length := int(r.octet()) // semi-octets
+	toa := r.octet()
+	octets := r.take((length + 1) / 2)
+	if r.err != nil {
+		return ""
+	}
+	if toa&0x70 == 0x50 {
+		septets := unpackSeptets(octets)
+		if n := length * 4 / 7; n < len(septets) {
+			septets = septets[:n]
+		}
+		return decodeGSM7(septets)
+	}
+	var sb strings.Builder
+	if toa&0x70 == 0x10 {
+		sb.WriteByte('+')
+	}
+	for i, b := range octets {
+		for j, d := range []byte{b & 0x0f, b >> 4} {
+			if i*2+j >= length {
+				break
+			}
+			sb.WriteByte("0123456789*#abc"[d%15])
+		}
+	}
+	return sb.String()
+}
+
+// readTimestamp reads a TP-SCTS: swapped BCD and a zone in quarter hours.
+func readTimestamp(r *pduReader) time.Time {
+	b := r.take(7)
+	if r.err != nil {
+		return time.Time{}
+	}
+	bcd := func(o byte) int { return int(o&0x0f)*10 + int(o>>4) }
+	quarters := int(b[6]&0x07)*10 + int(b[6]>>4)
+	if b[6]&0x08 != 0 {
+		quarters = -quarters
+	}
+	zone := time.FixedZone("", quarters*15*60)
+	return time.Date(2000+bcd(b[0]), time.Month(bcd(b[1])), bcd(b[2]), bcd(b[3]), bcd(b[4]), bcd(b[5]), 0, zone)
+}
+
+// dcsEncoding returns the alphabet of a TP-DCS (3GPP TS 23.038).
+func dcsEncoding(dcs byte) string {
+	switch {
+	case dcs&0xc0 == 0x00 || dcs&0xc0 == 0x40: // general data coding
+		switch (dcs >> 2) & 0x03 {
+		case 0x01:
+			return Encoding8Bit
+		case 0x02:
+			return EncodingUCS2
+		}
+	case dcs&0xf0 == 0xe0:
+		return EncodingUCS2
+	case dcs&0xf0 == 0xf0:
+		if dcs&0x04 != 0 {
+			return Encoding8Bit
+		}
+	}
+	return EncodingGSM7
+}
+
+// readUserData decodes the TP-UD, splitting off a user data header.
+func readUserData(r *pduReader, encoding string, udl int, hasUDH bool) (string, *Concat) {
+	if encoding == EncodingGSM7 {
+		packed := r.take((udl*7 + 7) / 8)
+		if r.err != nil {
+			return "", nil
+		}
+		septets := unpackSeptets(packed)
+		if udl < len(septets) {
+			septets = septets[:udl]
+		}
+		var concat *Concat
+		if hasUDH && len(packed) > 0 {
+			udhl := int(packed[0])
+			if udhl+1 > len(packed) {
+				r.err = ErrMalformedPDU
+				return "", nil
+			}
+			concat = parseUDH(packed[1 : udhl+1])
+			skip := ((udhl+1)*8 + 6) / 7
+			if skip > len(septets) {
+				skip = len(septets)
+			}
+			septets = septets[skip:]
+		}
+		return decodeGSM7(septets), concat
+	}
+
+	ud := r.take(udl)
+	if r.err != nil {
+		return "", nil
+	}
+	var concat *Concat
+	if hasUDH && len(ud) > 0 {
+		udhl := int(ud[0])
+		if udhl+1 > len(ud) {
+			r.err = ErrMalformedPDU
+			return "", nil
+		}
+		concat = parseUDH(ud[1 : udhl+1])
+		ud = ud[udhl+1:]
+	}
+	if encoding == EncodingUCS2 {
+		return decodeUCS2(ud), concat
+	}
+	return strings.ToUpper(hex.EncodeToString(ud)), concat
+}
+
+// parseUDH finds the concatenation element of a user data header.
+func parseUDH(udh []byte) *Concat {
+	for i := 0; i+1 < len(udh); {
+		iei, length := udh[i], int(udh[i+1])
+		data := udh[i+2:]
+		if length > len(data) {
+			return nil
+		}
+		data = data[:length]
+		switch {
+		case iei == 0x00 && length == 3 && data[1] > 0:
+			return &Concat{Ref: int(data[0]), Total: int(data[1]), Seq: int(data[2])}
+		case iei == 0x08 && length == 4 && data[2] > 0:
+			return &Concat{Ref: int(data[0])<<8 | int(data[1]), Total: int(data[2]), Seq: int(data[3])}
+		}
+		i += 2 + length
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package modem
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeSubmit(t *testing.T) {
+	tests := []struct {
+		name         string
+		number       string
+		text         string
+		statusReport bool
+		want         []SubmitPDU
+	}{
+		{
+			name:   "gsm7",
+			number: "+46708251358",
+			text:   "hellohello",
+			want:   []SubmitPDU{{Hex: "0011000B916407281553F80000A70AE8329BFD4697D9EC37", Length: 23}},
+		},
+		{
+			name:         "status report",
+			number:       "0612345678",
+			text:         "hi",
+			statusReport: true,
+			want:         []SubmitPDU{{Hex: "0031000A8160214365870000A702E834", Length: 15}},
+		},
+		{
+			name:   "ucs2",
+			number: "+212612345678",
+			text:   "سلام",
+			want:   []SubmitPDU{{Hex: "0011000C911262214365870008A7080633064406270645", Length: 22}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := EncodeSubmit(tt.number, tt.text, 1, tt.statusReport)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeSubmitConcatenated(t *testing.T) {
+	pdus, err := EncodeSubmit("+212612345678", strings.Repeat("a", 200), 7, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pdus) != 2 {
+		t.Fatalf("got %d parts, want 2", len(pdus))
+	}
+	for i, pdu := range pdus {
+		// First octet with TP-UDHI, then the header: IEI 0, length 3, ref 7,
+		// 2 parts, part i+1.
+		if !strings.HasPrefix(pdu.Hex, "0051") {
+			t.Errorf("part %d: first octet of %s lacks TP-UDHI", i+1, pdu.Hex)
+		}
+		udh := fmt.Sprintf("0500030702%02X", i+1)
+		if !strings.Contains(pdu.Hex, udh) {
+			t.Errorf("part %d: %s lacks header %s", i+1, pdu.Hex, udh)
+		}
+	}
+}
+
+func TestEncodeSubmitInvalidNumber(t *testing.T) {
+	for _, number := range []string{"", "+", "06-12", "+2126123456789012345678"} {
+		if _, err := EncodeSubmit(number, "hi", 1, false); err == nil {
+			t.Errorf("EncodeSubmit(%q) succeeded", number)
+		}
+	}
+}
+
+func TestSplitSMS(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		encoding string
+		parts    []int // runes per part
+	}{
+		{"gsm7 single", strings.Repeat("a", 160), EncodingGSM7, []int{160}},
+		{"gsm7 two parts", strings.Repeat("a", 161), EncodingGSM7, []int{153, 8}},
+		{"gsm7 escapes", strings.Repeat("€", 80), EncodingGSM7, []int{80}},
+		{"gsm7 escape not split", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 10), EncodingGSM7, []int{152, 11}},
+		{"ucs2 single", strings.Repeat("ب", 70), EncodingUCS2, []int{70}},
+		{"ucs2 two parts", strings.Repeat("ب", 71), EncodingUCS2, []int{67, 4}},
+		{"ucs2 surrogate not split", strings.Repeat("ب", 66) + "😀" + strings.Repeat("ب", 5), EncodingUCS2, []int{66, 6}},
+	}
+	for _, tt := range tests {
+		encoding, parts := SplitSMS(tt.text)
+		if encoding != tt.encoding {
+			t.Errorf("%s: encoding %s, want %s", tt.name, encoding, tt.encoding)
+		}
+		var got []int
+		for _, p := range parts {
+			got = append(got, len([]rune(p)))
+		}
+		if !reflect.DeepEqual(got, tt.parts) {
+			t.Errorf("%s: parts of %v runes, want %v", tt.name, got, tt.parts)
+		}
+		if strings.Join(parts, "") != tt.text {
+			t.Errorf("%s: parts do not join back to the text", tt.name)
+		}
+	}
+}
+
+func TestDecodePDU(t *testing.T) {
+	plus2 := time.FixedZone("", 2*3600)
+	utc := time.FixedZone("", 0)
+	tests := []struct {
+		name string
+		pdu  string
+		want *SMSPDU
+	}{
+		{
+			name: "gsm7 deliver",
+			pdu:  "07911326040000F0040B911346610089F60000208062917314800CC8F71D14969741F977FD07",
+			want: &SMSPDU{
+				Type:     PDUDeliver,
+				Number:   "+31641600986",
+				Time:     time.Date(2002, 8, 26, 19, 37, 41, 0, plus2),
+				Encoding: EncodingGSM7,
+				Text:     "How are you?",
+			},
+		},
+		{
+			name: "ucs2 deliver",
+			pdu:  "00040C91126221436587000842305141030000080633064406270645",
+			want: &SMSPDU{
+				Type:     PDUDeliver,
+				Number:   "+212612345678",
+				Time:     time.Date(2024, 3, 15, 14, 30, 0, 0, utc),
+				Encoding: EncodingUCS2,
+				Text:     "سلام",
+			},
+		},
+		{
+			name: "concatenated ucs2 part",
+			pdu:  "00440C911262214365870008423051410300000C0500030A0201063306440627",
+			want: &SMSPDU{
+				Type:     PDUDeliver,
+				Number:   "+212612345678",
+				Time:     time.Date(2024, 3, 15, 14, 30, 0, 0, utc),
+				Encoding: EncodingUCS2,
+				Text:     "سلا",
+				Concat:   &Concat{Ref: 10, Total: 2, Seq: 1},
+			},
+		},
+		{
+			name: "alphanumeric sender",
+			pdu:  "000407D049E735090000423051410300000549F73D1D02",
+			want: &SMSPDU{
+				Type:     PDUDeliver,
+				Number:   "INWI",
+				Time:     time.Date(2024, 3, 15, 14, 30, 0, 0, utc),
+				Encoding: EncodingGSM7,
+				Text:     "Inwi!",
+			},
+		},
+		{
+			name: "status report",
+			pdu:  "00062A0C91126221436587423051410300004230514103000000",
+			want: &SMSPDU{
+				Type:          PDUStatusReport,
+				Number:        "+212612345678",
+				Time:          time.Date(2024, 3, 15, 14, 30, 0, 0, utc),
+				Reference:     42,
+				DischargeTime: time.Date(2024, 3, 15, 14, 30, 0, 0, utc),
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := DecodePDU(tt.pdu)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecodePDUMalformed(t *testing.T) {
+	for _, pdu := range []string{
+		"",
+		"zz",
+		"00040C9112622143",               // cut in the sender
+		"00040C911262214365870008423051", // cut in the timestamp
+		"00040C9112622143658700084230514103000008063306", // user data shorter than its length
+		"0001000C91126221436587",                         // SMS-SUBMIT
+	} {
+		if _, err := DecodePDU(pdu); err == nil {
+			t.Errorf("DecodePDU(%q) succeeded", pdu)
+		}
+	}
+}
+
+func TestStatusReportOutcome(t *testing.T) {
+	tests := []struct {
+		status             int
+		delivered, pending bool
+	}{
+		{0x00, true, false},
+		{0x20, false, true},
+		{0x3f, false, true},
+		{0x40, false, false},
+		{0x60, false, false},
+	}
+	for _, tt := range tests {
+		p := &SMSPDU{Type: PDUStatusReport, Status: tt.status}
+		if p.Delivered() != tt.delivered || p.Pending() != tt.pending {
+			t.Errorf("status %#x: delivered %v, pending %v", tt.status, p.Delivered(), p.Pending())
+		}
+	}
+}
+
+func TestUCS2(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"0633064406270645", "سلام"},
+		{"00480069", "Hi"},
+		{"D83DDE00", "😀"},
+		{"0001", "0001"},       // decodes to a control character
+		{"Hello", "Hello"},     // not hex
+		{"0048006", "0048006"}, // not whole units
+		{"+212612345678", "+212612345678"},
+	}
+	for _, tt := range tests {
+		if got := decodeMaybeUCS2(tt.in); got != tt.want {
+			t.Errorf("decodeMaybeUCS2(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUSSDEncoding(t *testing.T) {
+	if got := encodeUSSD("*100#"); got != "AA180C3602" {
+		t.Errorf("encodeUSSD(*100#) = %s, want AA180C3602", got)
+	}
+	for _, code := range []string{"*100#", "*555*1#", "1", "*123*4567890123#"} {
+		if got := decodeUSSD(encodeUSSD(code), 15); got != code {
+			t.Errorf("USSD %q came back as %q", code, got)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package modem
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// pinAttemptsReserve is how many PIN attempts are always left for an
+// operator: no PIN is entered automatically unless more than this many
+// remain, so the gateway can never PUK-lock a SIM by itself.
+const pinAttemptsReserve = 1
+
+// ErrPINAttemptsLow is returned when a PIN is not entered because too few
+// attempts remain.
+var ErrPINAttemptsLow = errors.New("modem: too few PIN attempts left")
+
+// PINDevice is what PINUnlocker needs from a modem. *Device implements it.
+type PINDevice interface {
+	PINStatus(ctx context.Context) (PINStatus, error)
+	PINRetries(ctx context.Context) (pin, puk int, err error)
+	EnterPIN(ctx context.Context, pin string) error
+}
+
+// UnlockResult describes what PINUnlocker did with a SIM.
+type UnlockResult struct {
+	Status     PINStatus `json:"status"`           // SIM state when done
+	Unlocked   bool      `json:"unlocked"`         // the SIM is ready
+	Source     string    `json:"source,omitempty"` // models.SIMPINSource* of the PIN that worked
+	Attempts   int       `json:"attempts"`         // PINs entered
+	PINRetries int       `json:"pin_retries"`      // remaining PIN attempts, -1 if unknown
+	Alert      string    `json:"alert,omitempty"`  // kind of alert raised, if any
+}
+
+// PINUnlocker unlocks SIM cards that ask for their PIN without risking a PUK
+// lock. It reads the remaining attempts before every try, enters only the
+// PIN stored for the card and, if configured, a few default PINs, and keeps
+// pinAttemptsReserve attempts for an operator. Every attempt is recorded.
+// When it has to stop, it raises an alert rather than guessing on, and it
+// never enters a PUK.
+type PINUnlocker struct {
+	simRepo   repository.SIMCardRepository
+	alertRepo repository.AlertRepository
+	defaults  []string
+	logger    *logrus.Logger
+}
+
+// NewPINUnlocker creates a PINUnlocker. At most defaultLimit of defaults are
+// tried on a SIM whose stored PIN is missing or wrong.
+func NewPINUnlocker(simRepo repository.SIMCardRepository, alertRepo repository.AlertRepository, defaults []string, defaultLimit int, logger *logrus.Logger) *PINUnlocker {
+	if defaultLimit < 0 {
+		defaultLimit = 0
+	}
+	if defaultLimit > len(defaults) {
+		defaultLimit = len(defaults)
+	}
+	return &PINUnlocker{
+		simRepo:   simRepo,
+		alertRepo: alertRepo,
+		defaults:  defaults[:defaultLimit],
+		logger:    logger,
+	}
+}
+
+// pinCandidate is a PIN to try and where it came from.
+type pinCandidate struct {
+	pin    string
+	source string
+}
+
+// unlockTarget is the SIM being unlocked, as far as it is known.
+type unlockTarget struct {
+	sim     *models.SIMCard // nil if the SIM is not in the database
+	iccid   string
+	modemID int
+	logger  *logrus.Entry
+}
+
+// Unlock unlocks the SIM in dev if it asks for its PIN. iccid and modemID
+// identify the card in the database; either may be empty or zero. A SIM
+// whose automatic unlock failed before is left alone until an operator
+// unlocks it with UnlockWithPIN.
+func (u *PINUnlocker) Unlock(ctx context.Context, dev PINDevice, iccid string, modemID int) (UnlockResult, error) {
+	result := UnlockResult{PINRetries: -1}
+	status, err := dev.PINStatus(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.Status = status
+	if status == PINReady {
+		result.Unlocked = true
+		return result, nil
+	}
+
+	t := u.target(ctx, iccid, modemID)
+	if status == PUKNeeded {
+		return u.pukLocked(ctx, t, result)
+	}
+	if status != PINNeeded {
+		return result, fmt.Errorf("modem: SIM is waiting for %s", status)
+	}
+
+	var candidates []pinCandidate
+	if t.sim != nil {
+		if t.sim.Status == models.SIMStatusPINRequired {
+			t.logger.Info("SIM asks for its PIN; automatic unlock failed before, waiting for an operator")
+			return result, nil
+		}
+		pins, err := u.simRepo.GetSIMCardPINs(ctx, t.sim.ID)
+		if err != nil {
+			t.logger.WithError(err).Error("Failed to read the stored PIN")
+		} else if pins.PIN1.Valid && pins.PIN1.String != "" {
+			candidates = append(candidates, pinCandidate{pins.PIN1.String, models.SIMPINSourceStored})
+		}
+	}
+	for _, pin := range u.defaults {
+		if len(candidates) > 0 && candidates[0].pin == pin {
+			continue
+		}
+		candidates = append(candidates, pinCandidate{pin, models.SIMPINSourceDefault})
+	}
+	if len(candidates) == 0 {
+		result.Alert = models.AlertKindSIMPINMissing
+		u.setStatus(ctx, t, models.SIMStatusPINRequired)
+		u.raise(ctx, t, models.AlertKindSIMPINMissing, models.AlertSeverityWarning,
+			"SIM asks for a PIN and none is stored", result)
+		return result, nil
+	}
+
+	for _, c := range candidates {
+		ok, err := u.try(ctx, dev, t, c, &result, pinAttemptsReserve)
+		if ok {
+			return result, nil
+		}
+		if errors.Is(err, ErrPINAttemptsLow) {
+			u.setStatus(ctx, t, models.SIMStatusPINRequired)
+			result.Alert = models.AlertKindSIMPINAttemptsLow
+			message := fmt.Sprintf("SIM PIN not entered: %d attempt(s) left", result.PINRetries)
+			if result.PINRetries < 0 {
+				message = "SIM PIN not entered: remaining attempts unknown"
+			}
+			u.raise(ctx, t, models.AlertKindSIMPINAttemptsLow, models.AlertSeverityCritical, message, result)
+			return result, nil
+		}
+		if err != nil && !IsCME(err, 16) {
+			// Not a wrong PIN: the modem is in trouble, try again later.
+			return result, err
+		}
+		if result.Status == PUKNeeded {
+			return u.pukLocked(ctx, t, result)
+		}
+	}
+
+	u.setStatus(ctx, t, models.SIMStatusPINRequired)
+	result.Alert = models.AlertKindSIMPINRejected
+	u.raise(ctx, t, models.AlertKindSIMPINRejected, models.AlertSeverityCritical,
+		fmt.Sprintf("SIM rejected %d PIN(s); %d attempt(s) left", result.Attempts, result.PINRetries), result)
+	return result, nil
+}
+
+// UnlockWithPIN enters a PIN given by an operator. Unless force is set it
+// keeps the same reserve of attempts as Unlock. A PIN that works is stored
+// for the card.
+func (u *PINUnlocker) UnlockWithPIN(ctx context.Context, dev PINDevice, iccid string, modemID int, pin string, force bool) (UnlockResult, error) {
+	result := UnlockResult{PINRetries: -1}
+	status, err := dev.PINStatus(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.Status = status
+	if status == PINReady {
+		result.Unlocked = true
+		return result, nil
+	}
+
+	t := u.target(ctx, iccid, modemID)
+	if status == PUKNeeded {
+		return u.pukLocked(ctx, t, result)
+	}
+	if status != PINNeeded {
+		return result, fmt.Errorf("modem: SIM is waiting for %s", status)
+	}
+
+	reserve := pinAttemptsReserve
+	if force {
+		reserve = 0
+	}
+	ok, err := u.try(ctx, dev, t, pinCandidate{pin, models.SIMPINSourceManual}, &result, reserve)
+	if ok {
+		return result, nil
+	}
+	if result.Status == PUKNeeded {
+		return u.pukLocked(ctx, t, result)
+	}
+	if err != nil && !IsCME(err, 16) {
+		return result, err
+	}
+	return result, nil
+}
+
+// try enters one PIN if more than reserve attempts remain and records the
+// attempt. It reports whether the SIM is now unlocked; a wrong PIN is returned as +CME ERROR 16, too few attempts as ErrPINAttemptsLow.
+func (u *PINUnlocker) try(ctx context.Context, dev PINDevice, t unlockTarget, c pinCandidate, result *UnlockResult, reserve int) (bool, error) {
+	before, _, err := dev.PINRetries(ctx)
+	if err != nil {
+		// Without the counter there is no telling how close the SIM is to
+		// locking up, so nothing is entered.
+		t.logger.WithError(err).Warn("Cannot read remaining PIN attempts")
+		return false, ErrPINAttemptsLow
+	}
+	result.PINRetries = before
+	if before <= reserve {
+		return false, ErrPINAttemptsLow
+	}
+
+	attempt := &models.SIMPINAttempt{
+		ICCID:         sql.NullString{String: t.iccid, Valid: t.iccid != ""},
+		ModemID:       sql.NullInt64{Int64: int64(t.modemID), Valid: t.modemID != 0},
+		CodeType:      "pin",
+		Source:        c.source,
+		RetriesBefore: sql.NullInt32{Int32: int32(before), Valid: true},
+		AttemptedAt:   time.Now(),
+	}
+	if t.sim != nil {
+		attempt.SIMCardID = sql.NullInt64{Int64: t.sim.ID, Valid: true}
+	}
+
+	enterErr := dev.EnterPIN(ctx, c.pin)
+	result.Attempts++
+	attempt.Success = enterErr == nil
+	if enterErr != nil {
+		attempt.Error = sql.NullString{String: enterErr.Error(), Valid: true}
+	}
+	if after, _, err := dev.PINRetries(ctx); err == nil {
+		result.PINRetries = after
+		attempt.RetriesAfter = sql.NullInt32{Int32: int32(after), Valid: true}
+	}
+	if status, err := dev.PINStatus(ctx); err == nil {
+		result.Status = status
+	}
+	if err := u.simRepo.RecordPINAttempt(ctx, attempt); err != nil {
+		t.logger.WithError(err).Error("Failed to record PIN attempt")
+	}
+
+	logger := t.logger.WithFields(logrus.Fields{"source": c.source, "retries_before": before, "retries_after": result.PINRetries})
+	if enterErr != nil {
+		logger.WithError(enterErr).Warn("SIM rejected PIN")
+		return false, enterErr
+	}
+	logger.Info("SIM unlocked")
+	result.Unlocked = true
+	result.Status = PINReady
+	result.Source = c.source
+	u.unlocked(ctx, t, c)
+	return true, nil
+}
+
+// unlocked stores the PIN that worked and clears the PIN alerts of the SIM.
+func (u *PINUnlocker) unlocked(ctx context.Context, t unlockTarget, c pinCandidate) {
+	if t.sim != nil {
+		if c.source != models.SIMPINSourceStored {
+			if err := u.simRepo.UpdateSIMCardPIN1(ctx, t.sim.ID, c.pin); err != nil {
+				t.logger.WithError(err).Error("Failed to store SIM PIN")
+			}
+		}
+		if t.sim.Status == models.SIMStatusPINRequired || t.sim.Status == models.SIMStatusPUKLocked {
+			u.setStatus(ctx, t, models.SIMStatusActive)
+		}
+	}
+	entityType, entityID := t.entity()
+	for _, kind := range []string{models.AlertKindSIMPINAttemptsLow, models.AlertKindSIMPINRejected, models.AlertKindSIMPINMissing, models.AlertKindSIMPUKLocked} {
+		if err := u.alertRepo.ResolveAlerts(ctx, kind, entityType, entityID); err != nil {
+			t.logger.WithError(err).Error("Failed to resolve SIM PIN alert")
+		}
+	}
+}
+
+// pukLocked marks a SIM that needs its PUK. The PUK is never entered
+// automatically.
+func (u *PINUnlocker) pukLocked(ctx context.Context, t unlockTarget, result UnlockResult) (UnlockResult, error) {
+	result.Status = PUKNeeded
+	result.PINRetries = 0
+	result.Alert = models.AlertKindSIMPUKLocked
+	u.setStatus(ctx, t, models.SIMStatusPUKLocked)
+	u.raise(ctx, t, models.AlertKindSIMPUKLocked, models.AlertSeverityCritical, "SIM is PUK-locked and needs its PUK", result)
+	return result, nil
+}
+
+// target looks up the SIM card by ICCID, or else by the modem it is in.
+func (u *PINUnlocker) target(ctx context.Context, iccid string, modemID int) unlockTarget {
+	t := unlockTarget{iccid: iccid, modemID: modemID}
+	var err error
+	if iccid != "" {
+		t.sim, err = u.simRepo.GetSIMCardByICCID(ctx, iccid)
+	} else if modemID != 0 {
+		t.sim, err = u.simRepo.GetSIMCardByModemID(ctx, int64(modemID))
+	}
+	fields := logrus.Fields{"iccid": iccid, "modem_id": modemID}
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		u.logger.WithError(err).WithFields(fields).Error("Failed to look up SIM card")
+	}
+	if t.sim != nil {
+		fields["sim_id"] = t.sim.ID
+		if t.iccid == "" {
+			t.iccid = t.sim.ICCID
+		}
+	}
+	t.logger = u.logger.WithFields(fields)
+	return t
+}
+
+// entity returns what SIM alerts are raised on: the card, or the modem if
+// the card is not in the database.
+func (t unlockTarget) entity() (string, string) {
+	if t.sim == nil && t.modemID != 0 {
+		return models.AlertEntityModem, strconv.Itoa(t.modemID)
+	}
+	if t.sim == nil {
+		return models.AlertEntitySIMCard, t.iccid
+	}
+	return models.AlertEntitySIMCard, strconv.FormatInt(t.sim.ID, 10)
+}
+
+func (u *PINUnlocker) setStatus(ctx context.Context, t unlockTarget, status string) {
+	if t.sim == nil || t.sim.Status == status {
+		return
+	}
+	if err := u.simRepo.UpdateSIMCardStatus(ctx, t.sim.ID, status); err != nil {
+		t.logger.WithError(err).Error("Failed to update SIM card status")
+		return
+	}
+	t.sim.Status = status
+}
+
+func (u *PINUnlocker) raise(ctx context.Context, t unlockTarget, kind, severity, message string, result UnlockResult) {
+	t.logger.WithField("alert", kind).Warn(message)
+	entityType, entityID := t.entity()
+	details, _ := json.Marshal(map[string]interface{}{
+		"iccid":       t.iccid,
+		"modem_id":    t.modemID,
+		"pin_retries": result.PINRetries,
+		"attempts":    result.Attempts,
+	})
+	alert := &models.Alert{
+		Kind:       kind,
+		Severity:   severity,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Message:    message,
+		Details:    details,
+	}
+	if err := u.alertRepo.RaiseAlert(ctx, alert); err != nil {
+		t.logger.WithError(err).Error("Failed to raise alert")
+	}
+}
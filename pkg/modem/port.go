@@ -0,0 +1,25 @@
+package modem
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrPortClosed is returned by a Port once it has been closed.
+var ErrPortClosed = errors.New("modem: port closed")
+
+// Port is a byte stream to the AT command interface of a modem, the third
+// tty of an E173 (the first is the PPP port, the second carries voice). See
+// ScanUSB for finding it.
+//
+// Read may return 0 bytes with a nil error when no data arrived for a while,
+// so readers can notice Close promptly. After Close, Read and Write return
+// ErrPortClosed.
+type Port interface {
+	io.ReadWriteCloser
+}
+
+// DefaultBaudRate is the speed E173 AT ports are opened at. The ports are USB
+// CDC, so the rate is nominal, but chan_dongle and the modem's Windows driver
+// both use it.
+const DefaultBaudRate = 115200
@@ -0,0 +1,119 @@
+//go:build linux
+
+package modem
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// serialPort is a tty opened in raw mode.
+type serialPort struct {
+	fd     int
+	path   string
+	closed atomic.Bool
+}
+
+var baudRates = map[int]uint32{
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+	921600: unix.B921600,
+}
+
+// OpenSerial opens a tty such as /dev/ttyUSB2 in raw 8N1 mode at the given
+// baud rate (DefaultBaudRate if 0).
+func OpenSerial(path string, baud int) (Port, error) {
+	if baud == 0 {
+		baud = DefaultBaudRate
+	}
+	speed, ok := baudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("modem: unsupported baud rate %d", baud)
+	}
+
+	// O_NONBLOCK keeps open from waiting for carrier detect; it is cleared
+	// once CLOCAL is set.
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("modem: open %s: %w", path, err)
+	}
+
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("modem: %s is not a tty: %w", path, err)
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.IXANY
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+	t.Ispeed, t.Ospeed = speed, speed
+	// Return from read after 100ms without data so Close is noticed.
+	t.Cc[unix.VMIN] = 0
+	t.Cc[unix.VTIME] = 1
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("modem: configure %s: %w", path, err)
+	}
+	if err := unix.SetNonblock(fd, false); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("modem: configure %s: %w", path, err)
+	}
+	// Drop whatever the modem said before we were listening.
+	_ = unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH)
+
+	return &serialPort{fd: fd, path: path}, nil
+}
+
+func (p *serialPort) Read(b []byte) (int, error) {
+	if p.closed.Load() {
+		return 0, ErrPortClosed
+	}
+	n, err := unix.Read(p.fd, b)
+	if err == unix.EINTR || err == unix.EAGAIN {
+		return 0, nil
+	}
+	if err != nil {
+		if p.closed.Load() {
+			return 0, ErrPortClosed
+		}
+		return 0, fmt.Errorf("modem: read %s: %w", p.path, err)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, nil
+}
+
+func (p *serialPort) Write(b []byte) (int, error) {
+	if p.closed.Load() {
+		return 0, ErrPortClosed
+	}
+	written := 0
+	for written < len(b) {
+		n, err := unix.Write(p.fd, b[written:])
+		if err == unix.EINTR || err == unix.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return written, fmt.Errorf("modem: write %s: %w", p.path, err)
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (p *serialPort) Close() error {
+	if p.closed.Swap(true) {
+		return nil
+	}
+	return unix.Close(p.fd)
+}
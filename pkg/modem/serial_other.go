@@ -0,0 +1,13 @@
+//go:build !linux
+
+package modem
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// OpenSerial is only implemented on Linux, where the gateway's dongles live.
+func OpenSerial(path string, baud int) (Port, error) {
+	return nil, fmt.Errorf("modem: serial ports are not supported on %s", runtime.GOOS)
+}
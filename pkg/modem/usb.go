@@ -0,0 +1,155 @@
+package modem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// HuaweiVendorID is the USB vendor ID of Huawei modems.
+const HuaweiVendorID = "12d1"
+
+// portLayout says which USB interfaces of a modem carry the voice stream and
+// the AT commands chan_dongle needs.
+type portLayout struct {
+	Audio int
+	Data  int
+}
+
+// huaweiPortLayouts holds the layouts of modems in modem mode (after
+// usb_modeswitch). The E173 exposes the PPP port on interface 0, voice on 1
+// and the AT command port on 2; unknown products are assumed to match.
+var huaweiPortLayouts = map[string]portLayout{
+	"1436": {Audio: 1, Data: 2}, // E173
+	"1001": {Audio: 1, Data: 2}, // E169, E1550
+}
+
+var defaultPortLayout = portLayout{Audio: 1, Data: 2}
+
+// USBModem is a modem found in sysfs: one USB device and its ttys.
+type USBModem struct {
+	USBPath   string         // sysfs name of the USB device, i.e. its physical port, e.g. "1-1.4.2"
+	VendorID  string         // e.g. "12d1"
+	ProductID string         // e.g. "1436"
+	Serial    string         // USB serial number, usually empty on E173s
+	Ports     map[int]string // tty device path by interface number
+	DataPort  string         // AT command port, "" if the modem has not exposed it (yet)
+	AudioPort string         // voice port, "" if missing
+}
+
+// ScanUSB lists the Huawei modems in sysfs (normally "/sys") whose ttys
+// have appeared. devDir is where the tty device nodes live, normally "/dev".
+// The result is sorted by USB path, so by physical port.
+func ScanUSB(sysfsRoot, devDir string) ([]USBModem, error) {
+	ttys, err := filepath.Glob(filepath.Join(sysfsRoot, "bus", "usb-serial", "devices", "ttyUSB*"))
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]*USBModem)
+	for _, tty := range ttys {
+		// .../usb1/1-1/1-1.4/1-1.4:1.2/ttyUSB2
+		resolved, err := filepath.EvalSymlinks(tty)
+		if err != nil {
+			// Unplugged between the glob and now.
+			continue
+		}
+		ifaceDir := filepath.Dir(resolved)
+		usbDir := filepath.Dir(ifaceDir)
+
+		vendor := readSysfs(usbDir, "idVendor")
+		if vendor != HuaweiVendorID {
+			continue
+		}
+		iface, err := strconv.ParseInt(readSysfs(ifaceDir, "bInterfaceNumber"), 16, 32)
+		if err != nil {
+			continue
+		}
+
+		usbPath := filepath.Base(usbDir)
+		m, ok := byPath[usbPath]
+		if !ok {
+			m = &USBModem{
+				USBPath:   usbPath,
+				VendorID:  vendor,
+				ProductID: readSysfs(usbDir, "idProduct"),
+				Serial:    readSysfs(usbDir, "serial"),
+				Ports:     make(map[int]string),
+			}
+			byPath[usbPath] = m
+		}
+		m.Ports[int(iface)] = filepath.Join(devDir, filepath.Base(tty))
+	}
+
+	modems := make([]USBModem, 0, len(byPath))
+	for _, m := range byPath {
+		layout, ok := huaweiPortLayouts[m.ProductID]
+		if !ok {
+			layout = defaultPortLayout
+		}
+		m.DataPort = m.Ports[layout.Data]
+		m.AudioPort = m.Ports[layout.Audio]
+		modems = append(modems, *m)
+	}
+	sort.Slice(modems, func(i, j int) bool { return lessUSBPath(modems[i].USBPath, modems[j].USBPath) })
+	return modems, nil
+}
+
+// readSysfs returns the trimmed content of a sysfs attribute, "" if missing.
+func readSysfs(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// lessUSBPath orders USB paths numerically, so "1-1.10" follows "1-1.9".
+func lessUSBPath(a, b string) bool {
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool { return r == '-' || r == '.' })
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		if aErr == nil && bErr == nil && an != bn {
+			return an < bn
+		}
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// PortLocked reports whether another process, such as Asterisk's
+// chan_dongle, holds the UUCP lock file of a tty in lockDir (normally
+// "/var/lock"). Stale locks of dead processes do not count.
+func PortLocked(lockDir, port string) (bool, error) {
+	b, err := os.ReadFile(filepath.Join(lockDir, "LCK.."+filepath.Base(port)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return false, fmt.Errorf("modem: malformed lock file for %s", port)
+	}
+	if pid == os.Getpid() {
+		return false, nil
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false, nil
+	}
+	err = process.Signal(syscall.Signal(0))
+	// EPERM: the process exists but belongs to someone else.
+	return err == nil || err == syscall.EPERM, nil
+}
@@ -0,0 +1,262 @@
+package recharge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// batchWorkers is how many SIM cards of a batch are recharged at once;
+	// each is in a modem of its own.
+	batchWorkers = 4
+	// busyRetryDelay is how long a batch waits for a SIM card that is being
+	// recharged otherwise, at most busyRetries times.
+	busyRetryDelay = time.Minute
+	busyRetries    = 5
+)
+
+// ErrEmptyBatch is returned for a batch without SIM cards.
+var ErrEmptyBatch = errors.New("recharge: no SIM card to recharge")
+
+// BatchRequest is a set of SIM cards to recharge together.
+type BatchRequest struct {
+	Name        string  `json:"name" binding:"required"`
+	Description string  `json:"description"`
+	SIMCardIDs  []int64 `json:"sim_card_ids"` // the SIM cards to recharge...
+	Operator    string  `json:"operator"`     // ...or every active SIM card in a modem on this operator
+	Amount      float64 `json:"amount"`       // voucher amount per SIM; 0, or none of it in stock, takes the smallest
+	CreatedBy   int64   `json:"-"`
+}
+
+// StartBatch creates a batch and recharges its SIM cards in the background,
+// a few at a time. Its progress is kept in the batch and its items.
+func (e *Engine) StartBatch(ctx context.Context, req BatchRequest) (*models.RechargeBatch, error) {
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, id := range req.SIMCardIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, err := e.simRepo.GetSIMCardByID(ctx, id); err != nil {
+			return nil, fmt.Errorf("SIM card %d: %w", id, err)
+		}
+		ids = append(ids, id)
+	}
+	if len(req.SIMCardIDs) == 0 && req.Operator != "" {
+		var err error
+		if ids, err = e.simsOf(ctx, req.Operator); err != nil {
+			return nil, err
+		}
+	}
+	if len(ids) == 0 {
+		return nil, ErrEmptyBatch
+	}
+
+	now := time.Now()
+	batch := &models.RechargeBatch{
+		Name:        req.Name,
+		Description: req.Description,
+		Amount:      req.Amount,
+		TotalCodes:  len(ids),
+		Status:      models.BatchStatusProcessing,
+		CreatedBy:   req.CreatedBy,
+		StartedAt:   &now,
+	}
+	if err := e.repo.CreateBatchWithItems(ctx, batch, ids); err != nil {
+		return nil, fmt.Errorf("failed to create batch: %w", err)
+	}
+	items, err := e.repo.ListBatchItems(ctx, batch.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list batch items: %w", err)
+	}
+	e.runBatch(batch, items)
+	return batch, nil
+}
+
+// CancelBatch stops a running batch: the SIM cards being recharged finish,
+// the others are skipped. It reports whether the batch was running.
+func (e *Engine) CancelBatch(id int64) bool {
+	e.mu.Lock()
+	cancel := e.batches[id]
+	e.mu.Unlock()
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// simsOf returns the active SIM cards in a modem whose operator name
+// contains operator.
+func (e *Engine) simsOf(ctx context.Context, operator string) ([]int64, error) {
+	sims, err := e.simRepo.GetAllSIMCards(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list SIM cards: %w", err)
+	}
+	operator = strings.ToLower(operator)
+	var ids []int64
+	for _, sim := range sims {
+		if sim.Status == models.SIMStatusActive && sim.ModemID.Valid &&
+			strings.Contains(strings.ToLower(sim.OperatorName.String), operator) {
+			ids = append(ids, sim.ID)
+		}
+	}
+	return ids, nil
+}
+
+// resumeBatches runs again the items a stop left pending in the batches
+// still processing.
+func (e *Engine) resumeBatches() {
+	batches, err := e.repo.ListBatches(e.ctx, models.BatchStatusProcessing)
+	if err != nil {
+		e.logger.WithError(err).Error("Failed to list recharge batches to resume")
+		return
+	}
+	for _, batch := range batches {
+		items, err := e.repo.ListBatchItems(e.ctx, batch.ID)
+		if err != nil {
+			e.logger.WithError(err).WithField("recharge_batch_id", batch.ID).Error("Failed to list batch items")
+			continue
+		}
+		e.logger.WithField("recharge_batch_id", batch.ID).Info("Resuming recharge batch")
+		e.runBatch(batch, items)
+	}
+}
+
+// runBatch recharges the pending items of a batch in the background.
+func (e *Engine) runBatch(batch *models.RechargeBatch, items []*models.RechargeBatchItem) {
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.mu.Lock()
+	e.batches[batch.ID] = cancel
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer func() {
+			e.mu.Lock()
+			delete(e.batches, batch.ID)
+			e.mu.Unlock()
+			cancel()
+		}()
+		logger := e.logger.WithField("recharge_batch_id", batch.ID)
+		logger.Infof("Running recharge batch %q on %d SIM card(s)", batch.Name, batch.TotalCodes)
+
+		var mu sync.Mutex // guards the batch's counters
+		queue := make(chan *models.RechargeBatchItem)
+		var workers sync.WaitGroup
+		for i := 0; i < batchWorkers; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for item := range queue {
+					e.runItem(ctx, batch, item, &mu, logger)
+				}
+			}()
+		}
+	feed:
+		for _, item := range items {
+			if item.Status != models.BatchItemPending && item.Status != models.BatchItemRunning {
+				continue
+			}
+			select {
+			case queue <- item:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(queue)
+		workers.Wait()
+
+		saveCtx, cancelSave := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelSave()
+		switch {
+		case e.ctx.Err() != nil:
+			// Stopping: the batch resumes on the next start.
+			logger.Info("Recharge batch interrupted")
+			return
+		case ctx.Err() != nil:
+			if _, err := e.repo.SkipBatchItems(saveCtx, batch.ID); err != nil {
+				logger.WithError(err).Error("Failed to skip batch items")
+			}
+			batch.Status = models.BatchStatusCancelled
+		case batch.UsedCodes == 0 && batch.FailedCodes > 0:
+			batch.Status = models.BatchStatusFailed
+		default:
+			batch.Status = models.BatchStatusCompleted
+		}
+		now := time.Now()
+		batch.CompletedAt = &now
+		if err := e.repo.UpdateBatch(saveCtx, batch); err != nil {
+			logger.WithError(err).Error("Failed to update recharge batch")
+		}
+		logger.Infof("Recharge batch %s: %d recharged, %d failed of %d", batch.Status, batch.UsedCodes, batch.FailedCodes, batch.TotalCodes)
+	}()
+}
+
+// runItem recharges one SIM card of a batch and counts the outcome.
+func (e *Engine) runItem(ctx context.Context, batch *models.RechargeBatch, item *models.RechargeBatchItem, mu *sync.Mutex, logger *logrus.Entry) {
+	saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	item.Status = models.BatchItemRunning
+	if err := e.repo.UpdateBatchItem(saveCtx, item); err != nil {
+		logger.WithError(err).Error("Failed to update batch item")
+	}
+
+	req := Request{Amount: batch.Amount, BatchID: &batch.ID, ProcessedBy: &batch.CreatedBy}
+	var history *models.RechargeHistory
+	var err error
+	for try := 0; ; try++ {
+		history, err = e.Recharge(ctx, item.SimCardID, req)
+		if !errors.Is(err, ErrBusy) || try == busyRetries || !sleep(ctx, busyRetryDelay) {
+			break
+		}
+	}
+
+	saveCtx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if ctx.Err() != nil && err != nil && (history == nil || history.Attempts == 0) {
+		// Stopping before the voucher was entered: run it again on resume.
+		// Cancelled: skipped like the rest of the batch, nothing failed.
+		item.Status = models.BatchItemSkipped
+		if e.ctx.Err() != nil {
+			item.Status = models.BatchItemPending
+		}
+		if err := e.repo.UpdateBatchItem(saveCtx, item); err != nil {
+			logger.WithError(err).Error("Failed to update batch item")
+		}
+		return
+	}
+	if history != nil && history.ID != 0 {
+		item.RechargeHistoryID = &history.ID
+	}
+	item.Status = models.BatchItemSuccess
+	if err != nil {
+		item.Status = models.BatchItemFailed
+		item.ErrorMessage = sql.NullString{String: err.Error(), Valid: true}
+	}
+	if err := e.repo.UpdateBatchItem(saveCtx, item); err != nil {
+		logger.WithError(err).Error("Failed to update batch item")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err == nil {
+		batch.UsedCodes++
+		batch.TotalAmount += history.Amount
+	} else {
+		batch.FailedCodes++
+	}
+	if err := e.repo.UpdateBatch(saveCtx, batch); err != nil {
+		logger.WithError(err).Error("Failed to update recharge batch")
+	}
+}
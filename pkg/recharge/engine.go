@@ -0,0 +1,527 @@
+// Package recharge enters vouchers from the stock on the gateway's SIM
+// cards, following a per-operator scenario, and recharges the SIM cards
+// whose balance runs low.
+package recharge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// balanceFresh is how old a stored balance may be to serve as the
+	// balance before a recharge; an older one is read again first.
+	balanceFresh = 15 * time.Minute
+	// settleDelay gives the operator time to credit a voucher before the
+	// balance is read.
+	settleDelay = 10 * time.Second
+	// stepTimeout bounds one USSD step; the network gets 30 seconds.
+	stepTimeout = 45 * time.Second
+	// creditedShare is how much of a voucher's amount the balance must have
+	// grown by for an unanswered attempt to count as accepted.
+	creditedShare = 0.5
+)
+
+var (
+	// ErrNoScenario is returned for a SIM card whose operator has no
+	// recharge scenario.
+	ErrNoScenario = errors.New("recharge: no scenario for the SIM's operator")
+	// ErrNoVoucher is returned when the stock holds no usable voucher for
+	// the SIM's operator.
+	ErrNoVoucher = errors.New("recharge: no voucher available")
+	// ErrBusy is returned while the SIM card is being recharged.
+	ErrBusy = errors.New("recharge: SIM card is being recharged")
+	// ErrNoModem is returned for a SIM card that is not in a modem.
+	ErrNoModem = errors.New("recharge: SIM card is not in a modem")
+	// ErrRejected is returned when the operator refused the voucher.
+	ErrRejected = errors.New("recharge: voucher rejected by the operator")
+	// ErrUnclear is returned when the operator's answer said neither.
+	ErrUnclear = errors.New("recharge: no clear answer from the operator")
+)
+
+// Options configures an Engine.
+type Options struct {
+	AutoInterval time.Duration // how often low SIM cards are recharged; 0 only recharges on demand
+	Threshold    float64       // balance below which SIM cards without a threshold of their own are recharged
+}
+
+// Request is a recharge to run on a SIM card.
+type Request struct {
+	Amount      float64 `json:"amount"`             // voucher amount; 0, or none of it in stock, takes the smallest
+	BatchID     *int64  `json:"batch_id,omitempty"` // batch the recharge belongs to
+	ProcessedBy *int64  `json:"-"`                  // user asking for it; nil for automatic recharges
+}
+
+// USSDService enters USSD codes on SIM cards. *ussd.Service implements it.
+type USSDService interface {
+	Send(ctx context.Context, simID int64, req ussd.Request) (*ussd.Result, error)
+	CloseSession(simID int64) error
+	Templates() *ussd.Templates
+}
+
+// SMSService sends SMS from SIM cards. *sms.Service implements it.
+type SMSService interface {
+	Send(ctx context.Context, req sms.SendRequest) (*models.SMSMessage, error)
+}
+
+// BalanceChecker reads a SIM card's balance on demand. *balance.Poller
+// implements it.
+type BalanceChecker interface {
+	CheckNow(ctx context.Context, simID int64) (*models.SIMBalanceReading, error)
+}
+
+// Engine recharges SIM cards with vouchers from the stock. A voucher is
+// reserved for one SIM card before it is entered and stays bound to it:
+// once the operator has seen it, it is used or failed, never tried on
+// another SIM.
+type Engine struct {
+	repo      repository.RechargeRepository
+	simRepo   repository.SIMCardRepository
+	ussd      USSDService
+	sms       SMSService
+	poller    BalanceChecker
+	scenarios *Scenarios
+	opts      Options
+	logger    *logrus.Logger
+	settle    time.Duration // settleDelay, shorter in tests
+
+	mu      sync.Mutex
+	running map[int64]bool               // SIM cards being recharged
+	replies map[int64]chan string        // SMS answers awaited, by SIM ID
+	batches map[int64]context.CancelFunc // batches being run
+	kick    chan struct{}
+	wg      sync.WaitGroup // batch runs
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewEngine creates an Engine entering vouchers through the USSD and SMS
+// services and reading balances with poller. scenarios may be nil when none
+// are configured.
+func NewEngine(repo repository.RechargeRepository, simRepo repository.SIMCardRepository, ussdService USSDService, smsService SMSService, poller BalanceChecker, scenarios *Scenarios, opts Options, logger *logrus.Logger) *Engine {
+	if scenarios == nil {
+		scenarios = &Scenarios{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Engine{
+		repo:      repo,
+		simRepo:   simRepo,
+		ussd:      ussdService,
+		sms:       smsService,
+		poller:    poller,
+		scenarios: scenarios,
+		opts:      opts,
+		logger:    logger,
+		settle:    settleDelay,
+		running:   make(map[int64]bool),
+		replies:   make(map[int64]chan string),
+		batches:   make(map[int64]context.CancelFunc),
+		kick:      make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start recharges low SIM cards every opts.AutoInterval, and whenever
+// Trigger is called, in the background. Batches a restart interrupted are
+// resumed.
+func (e *Engine) Start() {
+	if e.scenarios.Len() == 0 {
+		e.logger.Warn("No recharge scenarios configured; SIM cards are not recharged automatically")
+	}
+	e.started = true
+	e.resumeBatches()
+	go func() {
+		defer close(e.done)
+		var tick <-chan time.Time
+		if e.opts.AutoInterval > 0 {
+			ticker := time.NewTicker(e.opts.AutoInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-tick:
+			case <-e.kick:
+			case <-e.ctx.Done():
+				return
+			}
+			if _, err := e.AutoRecharge(e.ctx, e.opts.Threshold); err != nil && e.ctx.Err() == nil {
+				e.logger.WithError(err).Error("Automatic recharge failed")
+			}
+		}
+	}()
+}
+
+// Stop stops automatic recharges and batches, and waits for the running
+// recharges.
+func (e *Engine) Stop() {
+	e.cancel()
+	if e.started {
+		<-e.done
+	}
+	e.wg.Wait()
+}
+
+// Trigger asks the background loop to look for low SIM cards now, e.g.
+// when the balance poller finds one.
+func (e *Engine) Trigger() {
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+}
+
+// AutoRecharge recharges, one after the other, the SIM cards with
+// auto-recharge enabled whose balance is below their threshold, or below
+// threshold when they have none. It returns how many were recharged.
+func (e *Engine) AutoRecharge(ctx context.Context, threshold float64) (int, error) {
+	if e.scenarios.Len() == 0 {
+		return 0, nil
+	}
+	sims, err := e.repo.GetSimCardsForAutoRecharge(ctx, threshold)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find SIM cards to recharge: %w", err)
+	}
+	if len(sims) > 0 {
+		e.logger.Infof("Found %d SIM card(s) for auto-recharge", len(sims))
+	}
+
+	recharged := 0
+	for _, sim := range sims {
+		if ctx.Err() != nil {
+			break
+		}
+		logger := e.logger.WithField("sim_card_id", sim.SimCardID)
+		if _, err := e.Recharge(ctx, sim.SimCardID, Request{Amount: sim.Amount}); err != nil {
+			logger.WithError(err).Warnf("Auto-recharge failed (balance %.2f, threshold %.2f)", sim.Balance, sim.Threshold)
+			continue
+		}
+		recharged++
+	}
+	return recharged, nil
+}
+
+// Recharge reserves a voucher for a SIM card, runs its operator's scenario
+// and records the outcome with the balance before and after. An answer
+// that neither accepts nor rejects the voucher is retried as the scenario
+// allows, unless the balance shows it was credited meanwhile. The history
+// is returned with the error of a failed recharge too.
+func (e *Engine) Recharge(ctx context.Context, simID int64, req Request) (*models.RechargeHistory, error) {
+	sim, err := e.simRepo.GetSIMCardByID(ctx, simID)
+	if err != nil {
+		return nil, err
+	}
+	if !sim.ModemID.Valid {
+		return nil, ErrNoModem
+	}
+	sc := e.scenarios.For(sim.OperatorName.String)
+	if sc == nil {
+		return nil, ErrNoScenario
+	}
+	if !e.claim(simID) {
+		return nil, ErrBusy
+	}
+	defer e.release(simID)
+
+	code, err := e.repo.ReserveRechargeCode(ctx, simID, sc.VoucherOperator, req.Amount)
+	if errors.Is(err, repository.ErrNotFound) && req.Amount > 0 {
+		code, err = e.repo.ReserveRechargeCode(ctx, simID, sc.VoucherOperator, 0)
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, fmt.Errorf("%w for %s", ErrNoVoucher, sc.VoucherOperator)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve a voucher: %w", err)
+	}
+
+	logger := e.logger.WithFields(logrus.Fields{"sim_card_id": sim.ID, "recharge_code_id": code.ID, "recharge_scenario": sc.Name})
+	logger.Infof("Recharging with a %.2f voucher", code.Amount)
+
+	before := e.balanceBefore(ctx, sim)
+	method := models.RechargeMethodUSSD
+	if sc.SMS != nil {
+		method = models.RechargeMethodSMS
+	}
+	history := &models.RechargeHistory{
+		SimCardID:      sim.ID,
+		RechargeCodeID: &code.ID,
+		BatchID:        req.BatchID,
+		PhoneNumber:    sim.MSISDN.String,
+		Amount:         code.Amount,
+		Method:         method,
+		Scenario:       sql.NullString{String: sc.Name, Valid: true},
+		ProcessedBy:    req.ProcessedBy,
+	}
+	if before != nil {
+		history.BalanceBefore = sql.NullFloat64{Float64: *before, Valid: true}
+	}
+	data := StepData{Code: code.Code, Amount: code.Amount, MSISDN: sim.MSISDN.String, ICCID: sim.ICCID}
+
+	result := verdictUnclear
+	var answer string
+	var runErr error
+	for attempt := 0; attempt <= sc.Retries; attempt++ {
+		if attempt > 0 {
+			if !sleep(ctx, sc.RetryDelay) {
+				runErr = ctx.Err()
+				break
+			}
+			if code.Attempts > 0 && e.credited(ctx, sim, before, code.Amount) {
+				result = verdictAccepted
+				break
+			}
+		}
+		var entered bool
+		answer, entered, runErr = e.run(ctx, sim, sc, data)
+		if entered {
+			code.Attempts++
+			if result = sc.judge(answer); result != verdictUnclear {
+				break
+			}
+		}
+		logger.WithError(runErr).Warnf("Recharge attempt %d got no clear answer: %q", attempt+1, answer)
+	}
+	if result == verdictUnclear && code.Attempts > 0 && sleep(ctx, e.settle) && e.credited(ctx, sim, before, code.Amount) {
+		result = verdictAccepted
+	}
+	history.Attempts = code.Attempts
+	history.Response = sql.NullString{String: answer, Valid: answer != ""}
+	code.ResponseMessage = history.Response
+
+	switch {
+	case result == verdictAccepted:
+		now := time.Now()
+		code.Status = models.RechargeStatusUsed
+		code.UsedAt = &now
+		history.Status = models.RechargeResultSuccess
+		if after := e.balanceAfter(ctx, sim, answer); after != nil {
+			history.BalanceAfter = sql.NullFloat64{Float64: *after, Valid: true}
+		}
+		err = nil
+	case result == verdictRejected:
+		code.Status = models.RechargeStatusFailed
+		history.Status = models.RechargeResultFailed
+		err = ErrRejected
+	case code.Attempts > 0:
+		// The operator saw the voucher and may have used it; it must not
+		// end up on another SIM.
+		code.Status = models.RechargeStatusFailed
+		history.Status = models.RechargeResultFailed
+		err = ErrUnclear
+	default:
+		// Never entered: the voucher stays reserved for this SIM.
+		history.Status = models.RechargeResultFailed
+		err = fmt.Errorf("%w: %v", ErrUnclear, runErr)
+	}
+	if err != nil {
+		msg := err.Error()
+		if runErr != nil && !errors.Is(err, runErr) {
+			msg += ": " + runErr.Error()
+		}
+		history.ErrorMessage = sql.NullString{String: msg, Valid: true}
+	}
+
+	// Record the outcome even when the caller gave up waiting.
+	saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if serr := e.repo.FinishRecharge(saveCtx, code, history); serr != nil {
+		logger.WithError(serr).Error("Failed to record recharge")
+		if err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Warnf("Recharge failed after %d attempt(s)", code.Attempts)
+	} else {
+		logger.Infof("Recharged %.2f after %d attempt(s)", code.Amount, code.Attempts)
+	}
+	return history, err
+}
+
+// run enters a voucher once. entered reports whether the step carrying the
+// code reached the operator, so the voucher may have been used.
+func (e *Engine) run(ctx context.Context, sim *models.SIMCard, sc *Scenario, data StepData) (answer string, entered bool, err error) {
+	if sc.SMS != nil {
+		return e.runSMS(ctx, sim, sc, data)
+	}
+
+	var sessionID int64
+	for i, step := range sc.steps {
+		text, err := render(step, data)
+		if err != nil {
+			return answer, entered, err
+		}
+		withCode := strings.Contains(sc.USSD[i], ".Code")
+		stepCtx, cancel := context.WithTimeout(ctx, stepTimeout)
+		result, err := e.ussd.Send(stepCtx, sim.ID, ussd.Request{Code: text, SessionID: sessionID})
+		cancel()
+		// ErrNoReply also covers ctx ending after the code went out.
+		if withCode && (err == nil || errors.Is(err, ussd.ErrNoReply)) {
+			entered = true
+		}
+		if err != nil {
+			return answer, entered, fmt.Errorf("step %d: %w", i+1, err)
+		}
+		answer = result.Exchange.Response.String
+		// Steps after the code, such as a confirmation, are skipped once
+		// the answer tells the outcome.
+		if i == len(sc.steps)-1 || (entered && sc.judge(answer) != verdictUnclear) {
+			if result.MenuOpen {
+				e.ussd.CloseSession(sim.ID)
+			}
+			return answer, entered, nil
+		}
+		if !result.MenuOpen {
+			return answer, entered, fmt.Errorf("step %d: the menu closed: %q", i+1, answer)
+		}
+		sessionID = result.Session.ID
+	}
+	return answer, entered, nil
+}
+
+// runSMS sends the voucher by SMS and waits for an answer that accepts or
+// rejects it.
+func (e *Engine) runSMS(ctx context.Context, sim *models.SIMCard, sc *Scenario, data StepData) (string, bool, error) {
+	text, err := render(sc.smsText, data)
+	if err != nil {
+		return "", false, err
+	}
+	replies := make(chan string, 4)
+	e.mu.Lock()
+	e.replies[sim.ID] = replies
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.replies, sim.ID)
+		e.mu.Unlock()
+	}()
+
+	if _, err := e.sms.Send(ctx, sms.SendRequest{To: sc.SMS.To, Text: text, SIMCardID: sim.ID}); err != nil {
+		return "", false, err
+	}
+	timer := time.NewTimer(sc.ReplyTimeout)
+	defer timer.Stop()
+	var answer string
+	for {
+		select {
+		case answer = <-replies:
+			if sc.judge(answer) != verdictUnclear {
+				return answer, true, nil
+			}
+		case <-timer.C:
+			return answer, true, fmt.Errorf("no answer to the SMS within %s", sc.ReplyTimeout)
+		case <-ctx.Done():
+			return answer, true, ctx.Err()
+		}
+	}
+}
+
+// HandleSMS passes a message received by a SIM card to the SMS recharge
+// waiting on it. Register it with sms.Service.OnReceive.
+func (e *Engine) HandleSMS(ctx context.Context, msg *models.SMSMessage) {
+	if msg.Direction != models.SMSDirectionInbound || !msg.SIMCardID.Valid {
+		return
+	}
+	e.mu.Lock()
+	replies := e.replies[msg.SIMCardID.Int64]
+	e.mu.Unlock()
+	if replies == nil {
+		return
+	}
+	select {
+	case replies <- msg.Body:
+	default:
+	}
+}
+
+// balanceBefore returns the SIM's balance before a recharge: the stored one
+// if recent, else a fresh reading; nil if unknown.
+func (e *Engine) balanceBefore(ctx context.Context, sim *models.SIMCard) *float64 {
+	if sim.Balance.Valid && sim.BalanceLastCheckedAt.Valid && time.Since(sim.BalanceLastCheckedAt.Time) < balanceFresh {
+		v := sim.Balance.Float64
+		return &v
+	}
+	return e.readBalance(ctx, sim)
+}
+
+// balanceAfter returns the SIM's balance after an accepted voucher: from
+// the operator's answer if it gives one, else a fresh reading.
+func (e *Engine) balanceAfter(ctx context.Context, sim *models.SIMCard, answer string) *float64 {
+	if parsed := e.ussd.Templates().For(sim.OperatorName.String).Parse(answer); parsed.Balance != nil {
+		return parsed.Balance
+	}
+	if !sleep(ctx, e.settle) {
+		return nil
+	}
+	return e.readBalance(ctx, sim)
+}
+
+// credited reports whether the SIM's balance grew enough since before for
+// a voucher of amount to have been credited.
+func (e *Engine) credited(ctx context.Context, sim *models.SIMCard, before *float64, amount float64) bool {
+	if before == nil {
+		return false
+	}
+	now := e.readBalance(ctx, sim)
+	return now != nil && *now-*before >= amount*creditedShare
+}
+
+func (e *Engine) readBalance(ctx context.Context, sim *models.SIMCard) *float64 {
+	reading, err := e.poller.CheckNow(ctx, sim.ID)
+	if err != nil {
+		e.logger.WithError(err).WithField("sim_card_id", sim.ID).Debug("Balance not read for recharge")
+		return nil
+	}
+	if reading == nil {
+		// Asked by SMS; the answer comes too late to use here.
+		return nil
+	}
+	return &reading.Balance
+}
+
+func (e *Engine) claim(simID int64) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running[simID] {
+		return false
+	}
+	e.running[simID] = true
+	return true
+}
+
+func (e *Engine) release(simID int64) {
+	e.mu.Lock()
+	delete(e.running, simID)
+	e.mu.Unlock()
+}
+
+// sleep waits for d, or returns false when ctx ends first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,386 @@
+package recharge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/e173-gateway/e173_go_gateway/pkg/sms"
+	"github.com/e173-gateway/e173_go_gateway/pkg/ussd"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeRechargeRepo hands out vouchers from a stock, a SIM's reserved one
+// first as the database does, and keeps what FinishRecharge stores.
+type fakeRechargeRepo struct {
+	repository.RechargeRepository
+
+	mu       sync.Mutex
+	codes    []*models.RechargeCode
+	finished []*models.RechargeHistory
+}
+
+func (r *fakeRechargeRepo) ReserveRechargeCode(ctx context.Context, simCardID int64, operator string, amount float64) (*models.RechargeCode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.codes {
+		if c.Status == models.RechargeStatusReserved && *c.SimCardID == simCardID {
+			code := *c
+			return &code, nil
+		}
+	}
+	for _, c := range r.codes {
+		if c.Status == models.RechargeStatusAvailable && c.Operator == operator && (amount == 0 || c.Amount == amount) {
+			c.Status = models.RechargeStatusReserved
+			c.SimCardID = &simCardID
+			code := *c
+			return &code, nil
+		}
+	}
+	return nil, repository.ErrNotFound
+}
+
+func (r *fakeRechargeRepo) FinishRecharge(ctx context.Context, code *models.RechargeCode, history *models.RechargeHistory) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range r.codes {
+		if c.ID == code.ID {
+			stored := *code
+			r.codes[i] = &stored
+		}
+	}
+	r.finished = append(r.finished, history)
+	return nil
+}
+
+// code returns the stored state of a voucher.
+func (r *fakeRechargeRepo) code(id int64) models.RechargeCode {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.codes {
+		if c.ID == id {
+			return *c
+		}
+	}
+	return models.RechargeCode{}
+}
+
+type fakeSIMRepo struct {
+	repository.SIMCardRepository
+	sims map[int64]*models.SIMCard
+}
+
+func (r *fakeSIMRepo) GetSIMCardByID(ctx context.Context, id int64) (*models.SIMCard, error) {
+	sim, ok := r.sims[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	card := *sim
+	return &card, nil
+}
+
+// ussdReply is how the fake network answers a USSD code.
+type ussdReply struct {
+	text string
+	menu bool
+	err  error
+}
+
+// fakeUSSD answers codes from a script and records them.
+type fakeUSSD struct {
+	mu      sync.Mutex
+	replies map[string]ussdReply
+	sent    []string
+}
+
+func (u *fakeUSSD) Send(ctx context.Context, simID int64, req ussd.Request) (*ussd.Result, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sent = append(u.sent, req.Code)
+	reply := u.replies[req.Code]
+	return &ussd.Result{
+		Session:  &models.USSDSession{ID: 1, SIMCardID: simID},
+		Exchange: &models.USSDExchange{SIMCardID: simID, Request: req.Code, Response: sql.NullString{String: reply.text, Valid: reply.text != ""}},
+		MenuOpen: reply.menu,
+	}, reply.err
+}
+
+func (u *fakeUSSD) CloseSession(simID int64) error { return nil }
+
+func (u *fakeUSSD) Templates() *ussd.Templates { return ussd.DefaultTemplates() }
+
+func (u *fakeUSSD) script(code string, reply ussdReply) {
+	u.mu.Lock()
+	u.replies[code] = reply
+	u.mu.Unlock()
+}
+
+func (u *fakeUSSD) sentCodes() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return strings.Join(u.sent, " ")
+}
+
+// fakeSMS has the operator answer every message with reply.
+type fakeSMS struct {
+	engine *Engine
+	reply  string
+	sent   []sms.SendRequest
+}
+
+func (s *fakeSMS) Send(ctx context.Context, req sms.SendRequest) (*models.SMSMessage, error) {
+	s.sent = append(s.sent, req)
+	s.engine.HandleSMS(ctx, &models.SMSMessage{
+		Direction: models.SMSDirectionInbound,
+		SIMCardID: sql.NullInt64{Int64: req.SIMCardID, Valid: true},
+		Body:      s.reply,
+	})
+	return &models.SMSMessage{}, nil
+}
+
+// fakeBalance reads the same balance every time; none when unset.
+type fakeBalance struct {
+	mu      sync.Mutex
+	balance *float64
+	reads   int
+}
+
+func (b *fakeBalance) CheckNow(ctx context.Context, simID int64) (*models.SIMBalanceReading, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reads++
+	if b.balance == nil {
+		return nil, errors.New("no answer to the balance check")
+	}
+	return &models.SIMBalanceReading{SIMCardID: simID, Balance: *b.balance}, nil
+}
+
+func (b *fakeBalance) set(v float64) {
+	b.mu.Lock()
+	b.balance = &v
+	b.mu.Unlock()
+}
+
+const (
+	voucher1 = "11112222333344"
+	voucher2 = "55556666777788"
+)
+
+var inwiUSSD = Scenario{
+	Name:      "inwi",
+	Operators: []string{"inwi"},
+	USSD:      []string{"*120#", "{{.Code}}"},
+	Success:   []string{"(?i)recharge effectu"},
+	Failure:   []string{"(?i)code invalide"},
+}
+
+type engineTest struct {
+	engine  *Engine
+	repo    *fakeRechargeRepo
+	ussd    *fakeUSSD
+	sms     *fakeSMS
+	balance *fakeBalance
+}
+
+// newEngineTest runs sc on Inwi SIM cards 7 and 8, whose balance of 5 was
+// read a minute ago, with two 20 vouchers in stock. The operator's menu
+// opens on *120#.
+func newEngineTest(t *testing.T, sc Scenario) *engineTest {
+	t.Helper()
+	scenarios, err := NewScenarios([]Scenario{sc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sims := make(map[int64]*models.SIMCard)
+	for _, id := range []int64{7, 8} {
+		sims[id] = &models.SIMCard{
+			ID:                   id,
+			ModemID:              sql.NullInt64{Int64: id, Valid: true},
+			OperatorName:         sql.NullString{String: "INWI", Valid: true},
+			MSISDN:               sql.NullString{String: "0612345678", Valid: true},
+			Balance:              sql.NullFloat64{Float64: 5, Valid: true},
+			BalanceLastCheckedAt: sql.NullTime{Time: time.Now().Add(-time.Minute), Valid: true},
+		}
+	}
+	et := &engineTest{
+		repo: &fakeRechargeRepo{codes: []*models.RechargeCode{
+			{ID: 1, Code: voucher1, Amount: 20, Operator: "inwi", Status: models.RechargeStatusAvailable},
+			{ID: 2, Code: voucher2, Amount: 20, Operator: "inwi", Status: models.RechargeStatusAvailable},
+		}},
+		ussd:    &fakeUSSD{replies: map[string]ussdReply{"*120#": {text: "1 Recharger", menu: true}}},
+		sms:     &fakeSMS{},
+		balance: &fakeBalance{},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	et.engine = NewEngine(et.repo, &fakeSIMRepo{sims: sims}, et.ussd, et.sms, et.balance, scenarios, Options{}, logger)
+	et.engine.settle = time.Millisecond
+	et.sms.engine = et.engine
+	return et
+}
+
+func TestRechargeAccepted(t *testing.T) {
+	et := newEngineTest(t, inwiUSSD)
+	et.ussd.script(voucher1, ussdReply{text: "Recharge effectuee. Votre solde est de 25.00 DH"})
+
+	history, err := et.engine.Recharge(context.Background(), 7, Request{Amount: 20})
+	if err != nil {
+		t.Fatalf("Recharge: %v", err)
+	}
+	if got := et.ussd.sentCodes(); got != "*120# "+voucher1 {
+		t.Errorf("sent %q, want the menu then the code", got)
+	}
+	if history.Status != models.RechargeResultSuccess || history.Attempts != 1 || history.Method != models.RechargeMethodUSSD {
+		t.Errorf("history %s after %d attempt(s) by %s", history.Status, history.Attempts, history.Method)
+	}
+	if history.BalanceBefore.Float64 != 5 || !history.BalanceAfter.Valid || history.BalanceAfter.Float64 != 25 {
+		t.Errorf("balance %v before, %v after, want 5 and 25 from the answer", history.BalanceBefore, history.BalanceAfter)
+	}
+	if code := et.repo.code(1); code.Status != models.RechargeStatusUsed || code.UsedAt == nil || code.Attempts != 1 {
+		t.Errorf("voucher %s after %d attempt(s), want used", code.Status, code.Attempts)
+	}
+}
+
+func TestRechargeRejected(t *testing.T) {
+	sc := inwiUSSD
+	sc.Retries = 2
+	et := newEngineTest(t, sc)
+	et.ussd.script(voucher1, ussdReply{text: "Code invalide ou deja utilise"})
+
+	history, err := et.engine.Recharge(context.Background(), 7, Request{})
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("got %v, want ErrRejected", err)
+	}
+	// A rejected voucher is not entered again.
+	if got := et.ussd.sentCodes(); got != "*120# "+voucher1 {
+		t.Errorf("sent %q, want one attempt", got)
+	}
+	if history.Status != models.RechargeResultFailed || !history.ErrorMessage.Valid {
+		t.Errorf("history %s, error %v", history.Status, history.ErrorMessage)
+	}
+	if code := et.repo.code(1); code.Status != models.RechargeStatusFailed || code.Attempts != 1 {
+		t.Errorf("voucher %s after %d attempt(s), want failed", code.Status, code.Attempts)
+	}
+}
+
+func TestRechargeUnclearAfterEntryFailsVoucher(t *testing.T) {
+	et := newEngineTest(t, inwiUSSD)
+	et.ussd.script(voucher1, ussdReply{err: ussd.ErrNoReply})
+	et.balance.set(5) // not credited
+
+	_, err := et.engine.Recharge(context.Background(), 7, Request{})
+	if !errors.Is(err, ErrUnclear) {
+		t.Fatalf("got %v, want ErrUnclear", err)
+	}
+	// The operator may have used the code: it is not handed out again.
+	if code := et.repo.code(1); code.Status != models.RechargeStatusFailed || code.Attempts != 1 {
+		t.Errorf("voucher %s after %d attempt(s), want failed after 1", code.Status, code.Attempts)
+	}
+	if et.balance.reads == 0 {
+		t.Error("balance not read to see whether the voucher was credited")
+	}
+	et.engine.Recharge(context.Background(), 7, Request{})
+	if got := et.ussd.sentCodes(); got != "*120# "+voucher1+" *120# "+voucher2 {
+		t.Errorf("sent %q, want the next recharge on another voucher", got)
+	}
+}
+
+func TestRechargeCancelledAfterEntryFailsVoucher(t *testing.T) {
+	et := newEngineTest(t, inwiUSSD)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The caller gave up once the code was sent, as ussd.Service reports it.
+	et.ussd.script(voucher1, ussdReply{err: fmt.Errorf("%w: %w", ussd.ErrNoReply, ctx.Err())})
+
+	if _, err := et.engine.Recharge(ctx, 7, Request{}); !errors.Is(err, ErrUnclear) {
+		t.Fatalf("got %v, want ErrUnclear", err)
+	}
+	if code := et.repo.code(1); code.Status != models.RechargeStatusFailed || code.Attempts != 1 {
+		t.Errorf("voucher %s after %d attempt(s), want failed after 1", code.Status, code.Attempts)
+	}
+}
+
+func TestRechargeCreditedWithoutAnswer(t *testing.T) {
+	sc := inwiUSSD
+	sc.Retries = 1
+	sc.RetryDelay = time.Millisecond
+	et := newEngineTest(t, sc)
+	et.ussd.script(voucher1, ussdReply{err: ussd.ErrNoReply})
+	et.balance.set(16) // grew by more than half the voucher
+
+	history, err := et.engine.Recharge(context.Background(), 7, Request{})
+	if err != nil {
+		t.Fatalf("Recharge: %v", err)
+	}
+	// The balance shows the first attempt went through: no second one.
+	if got := et.ussd.sentCodes(); got != "*120# "+voucher1 {
+		t.Errorf("sent %q, want the code entered once", got)
+	}
+	if history.Status != models.RechargeResultSuccess || history.BalanceAfter.Float64 != 16 {
+		t.Errorf("history %s with balance after %v", history.Status, history.BalanceAfter)
+	}
+	if code := et.repo.code(1); code.Status != models.RechargeStatusUsed {
+		t.Errorf("voucher %s, want used", code.Status)
+	}
+}
+
+func TestRechargeFailureBeforeEntryKeepsVoucherReserved(t *testing.T) {
+	et := newEngineTest(t, inwiUSSD)
+	et.ussd.script("*120#", ussdReply{err: errors.New("modem busy")})
+
+	_, err := et.engine.Recharge(context.Background(), 7, Request{})
+	if !errors.Is(err, ErrUnclear) {
+		t.Fatalf("got %v, want ErrUnclear", err)
+	}
+	code := et.repo.code(1)
+	if code.Status != models.RechargeStatusReserved || code.Attempts != 0 || *code.SimCardID != 7 {
+		t.Fatalf("voucher %s for SIM %d after %d attempt(s), want still reserved to SIM 7", code.Status, *code.SimCardID, code.Attempts)
+	}
+
+	// Another SIM gets another voucher; SIM 7 resumes with its own.
+	et.ussd.script("*120#", ussdReply{text: "1 Recharger", menu: true})
+	et.ussd.script(voucher1, ussdReply{text: "Recharge effectuee"})
+	et.ussd.script(voucher2, ussdReply{text: "Recharge effectuee"})
+	et.balance.set(25)
+	if _, err := et.engine.Recharge(context.Background(), 8, Request{}); err != nil {
+		t.Fatalf("Recharge of SIM 8: %v", err)
+	}
+	if _, err := et.engine.Recharge(context.Background(), 7, Request{}); err != nil {
+		t.Fatalf("Recharge of SIM 7 again: %v", err)
+	}
+	if got := et.ussd.sentCodes(); got != "*120# *120# "+voucher2+" *120# "+voucher1 {
+		t.Errorf("sent %q, want SIM 8 on the second voucher and SIM 7 on its own", got)
+	}
+	if code := et.repo.code(1); code.Status != models.RechargeStatusUsed || *code.SimCardID != 7 {
+		t.Errorf("voucher 1 %s for SIM %d, want used by SIM 7", code.Status, *code.SimCardID)
+	}
+}
+
+func TestRechargeBySMS(t *testing.T) {
+	et := newEngineTest(t, Scenario{
+		Name:    "inwi",
+		SMS:     &SMSStep{To: "555", Text: "RECH {{.Code}}"},
+		Success: []string{"(?i)recharge effectu"},
+	})
+	et.sms.reply = "Votre recharge effectuee avec succes"
+	et.balance.set(25)
+
+	history, err := et.engine.Recharge(context.Background(), 7, Request{})
+	if err != nil {
+		t.Fatalf("Recharge: %v", err)
+	}
+	if len(et.sms.sent) != 1 || et.sms.sent[0].To != "555" || et.sms.sent[0].Text != "RECH "+voucher1 || et.sms.sent[0].SIMCardID != 7 {
+		t.Errorf("sent %+v", et.sms.sent)
+	}
+	if history.Method != models.RechargeMethodSMS || history.Status != models.RechargeResultSuccess || history.Response.String != et.sms.reply {
+		t.Errorf("history %s by %s, answer %q", history.Status, history.Method, history.Response.String)
+	}
+}
@@ -0,0 +1,468 @@
+package recharge
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+// sweepInterval is how often expired vouchers are swept and the stock of
+// each operator is checked.
+const sweepInterval = 15 * time.Minute
+
+var (
+	// ErrDuplicateVoucher is returned for a voucher the operator already has
+	// in the stock.
+	ErrDuplicateVoucher = errors.New("recharge: voucher already in stock")
+	// ErrBadVoucher is returned for a voucher without a code, operator or
+	// amount.
+	ErrBadVoucher = errors.New("recharge: incomplete voucher")
+	// ErrBadImport is returned for a voucher file that is not valid CSV.
+	ErrBadImport = errors.New("recharge: unreadable voucher file")
+)
+
+// importColumns maps the header names an import file may use to its
+// columns. A file without a header has the columns code, amount, operator
+// and expiry date, in that order; the last three may be left out.
+var importColumns = map[string]string{
+	"code":        "code",
+	"voucher":     "code",
+	"pin":         "code",
+	"amount":      "amount",
+	"value":       "amount",
+	"operator":    "operator",
+	"expiry_date": "expiry",
+	"expiry":      "expiry",
+	"expires":     "expiry",
+	"expires_at":  "expiry",
+}
+
+// expiryLayouts are the date formats accepted for an expiry date. A date
+// without a time expires at the end of that day.
+var expiryLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02", "02/01/2006"}
+
+// ImportOptions are the values of the columns an import file leaves out or
+// empty.
+type ImportOptions struct {
+	Operator   string
+	Amount     float64
+	ExpiryDate *time.Time
+	CreatedBy  int64
+}
+
+// ImportIssue is a line of an import file that was left out.
+type ImportIssue struct {
+	Line     int    `json:"line"`
+	Code     string `json:"code,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// ImportResult tells how an import went.
+type ImportResult struct {
+	Imported   int           `json:"imported"`
+	Duplicates []ImportIssue `json:"duplicates"` // already in the stock, or earlier in the file
+	Invalid    []ImportIssue `json:"invalid"`
+}
+
+// Inventory keeps the voucher stock: it imports vouchers, expires those
+// past their date and alerts when an operator runs low on them.
+type Inventory struct {
+	repo      repository.RechargeRepository
+	alertRepo repository.AlertRepository
+	operators []string // watched even before any of their vouchers are stocked
+	lowStock  int
+	logger    *logrus.Logger
+
+	mu   sync.Mutex
+	low  map[string]int // alert level by operator: 0 stocked, 1 low, 2 empty
+	kick chan struct{}
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewInventory creates an Inventory. The voucher operators of scenarios are
+// watched from the start; an operator with fewer than lowStock available
+// vouchers raises an alert, none when lowStock is 0.
+func NewInventory(repo repository.RechargeRepository, alertRepo repository.AlertRepository, scenarios *Scenarios, lowStock int, logger *logrus.Logger) *Inventory {
+	var operators []string
+	if scenarios != nil {
+		operators = scenarios.VoucherOperators()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Inventory{
+		repo:      repo,
+		alertRepo: alertRepo,
+		operators: operators,
+		lowStock:  lowStock,
+		logger:    logger,
+		low:       make(map[string]int),
+		kick:      make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start sweeps expired vouchers and checks the stock now, then every
+// sweepInterval and after each import, in the background.
+func (inv *Inventory) Start() {
+	inv.started = true
+	go func() {
+		defer close(inv.done)
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			if err := inv.Sweep(inv.ctx); err != nil && inv.ctx.Err() == nil {
+				inv.logger.WithError(err).Error("Voucher sweep failed")
+			}
+			select {
+			case <-ticker.C:
+			case <-inv.kick:
+			case <-inv.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background sweeps.
+func (inv *Inventory) Stop() {
+	inv.cancel()
+	if inv.started {
+		<-inv.done
+	}
+}
+
+// Sweep expires the vouchers past their date and raises or resolves the
+// low-stock alert of each operator.
+func (inv *Inventory) Sweep(ctx context.Context) error {
+	n, err := inv.repo.ExpireRechargeCodes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to expire vouchers: %w", err)
+	}
+	if n > 0 {
+		inv.logger.Infof("Expired %d voucher(s)", n)
+	}
+	stock, err := inv.Stock(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range stock {
+		inv.checkStock(ctx, s)
+	}
+	return nil
+}
+
+// Stock returns the voucher counts of each operator, including the watched
+// operators without any voucher.
+func (inv *Inventory) Stock(ctx context.Context) ([]*models.VoucherStock, error) {
+	stock, err := inv.repo.GetVoucherStock(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count vouchers: %w", err)
+	}
+	known := make(map[string]bool, len(stock))
+	for _, s := range stock {
+		known[s.Operator] = true
+	}
+	for _, op := range inv.operators {
+		if !known[op] {
+			stock = append(stock, &models.VoucherStock{Operator: op})
+		}
+	}
+	return stock, nil
+}
+
+// checkStock alerts when an operator's available vouchers fall below the
+// low-stock level, again when they run out, and resolves the alert once
+// restocked.
+func (inv *Inventory) checkStock(ctx context.Context, s *models.VoucherStock) {
+	if inv.lowStock <= 0 {
+		return
+	}
+	level := 0
+	switch {
+	case s.Available == 0:
+		level = 2
+	case s.Available < inv.lowStock:
+		level = 1
+	}
+	inv.mu.Lock()
+	was, known := inv.low[s.Operator]
+	inv.low[s.Operator] = level
+	inv.mu.Unlock()
+	if known && was == level {
+		return
+	}
+
+	logger := inv.logger.WithField("operator", s.Operator)
+	if level == 0 {
+		if err := inv.alertRepo.ResolveAlerts(ctx, models.AlertKindVoucherStockLow, models.AlertEntityOperator, s.Operator); err != nil {
+			logger.WithError(err).Error("Failed to resolve alert")
+		}
+		return
+	}
+
+	severity := models.AlertSeverityWarning
+	message := fmt.Sprintf("Only %d %s voucher(s) left, below %d", s.Available, s.Operator, inv.lowStock)
+	if level == 2 {
+		severity = models.AlertSeverityCritical
+		message = fmt.Sprintf("No %s voucher left", s.Operator)
+	}
+	logger.WithField("alert", models.AlertKindVoucherStockLow).Warn(message)
+	details, _ := json.Marshal(map[string]interface{}{
+		"available":        s.Available,
+		"available_amount": s.AvailableAmount,
+		"expiring_soon":    s.ExpiringSoon,
+		"threshold":        inv.lowStock,
+	})
+	alert := &models.Alert{
+		Kind:       models.AlertKindVoucherStockLow,
+		Severity:   severity,
+		EntityType: models.AlertEntityOperator,
+		EntityID:   s.Operator,
+		Message:    message,
+		Details:    details,
+	}
+	if err := inv.alertRepo.RaiseAlert(ctx, alert); err != nil {
+		logger.WithError(err).Error("Failed to raise alert")
+	}
+}
+
+// check asks the background loop to check the stock now.
+func (inv *Inventory) check() {
+	select {
+	case inv.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Add stocks a single voucher. It returns ErrDuplicateVoucher when the
+// operator already has the code.
+func (inv *Inventory) Add(ctx context.Context, code *models.RechargeCode) error {
+	Normalize(code)
+	if err := validate(code); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadVoucher, err)
+	}
+	code.Status = models.RechargeStatusAvailable
+	code.SimCardID = nil
+	duplicates, err := inv.repo.ImportRechargeCodes(ctx, []*models.RechargeCode{code})
+	if err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return ErrDuplicateVoucher
+	}
+	inv.check()
+	return nil
+}
+
+// Import stocks the vouchers of a CSV file, separated by commas, semicolons
+// or tabs, with or without a header line. Lines whose code the operator
+// already has in the stock, or that repeat an earlier line, are left out
+// and reported, as are lines without a code, operator or amount.
+func (inv *Inventory) Import(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.Comma = delimiter(data)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	res := &ImportResult{Duplicates: []ImportIssue{}, Invalid: []ImportIssue{}}
+	columns := []string{"code", "amount", "operator", "expiry"}
+	first := true
+	seen := make(map[string]int) // line of each operator and code
+	lines := make(map[*models.RechargeCode]int)
+	var codes []*models.RechargeCode
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadImport, err)
+		}
+		line, _ := cr.FieldPos(0)
+		if first {
+			first = false
+			if header, ok := parseHeader(record); ok {
+				columns = header
+				continue
+			}
+		}
+		if blank(record) {
+			continue
+		}
+
+		code, err := parseVoucher(record, columns, opts)
+		if err != nil {
+			res.Invalid = append(res.Invalid, ImportIssue{Line: line, Code: code.Code, Operator: code.Operator, Reason: err.Error()})
+			continue
+		}
+		key := code.Operator + "\x00" + code.Code
+		if prev, ok := seen[key]; ok {
+			res.Duplicates = append(res.Duplicates, ImportIssue{Line: line, Code: code.Code, Operator: code.Operator, Reason: fmt.Sprintf("same as line %d", prev)})
+			continue
+		}
+		seen[key] = line
+		lines[code] = line
+		codes = append(codes, code)
+	}
+	if len(codes) == 0 {
+		return res, nil
+	}
+
+	duplicates, err := inv.repo.ImportRechargeCodes(ctx, codes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import vouchers: %w", err)
+	}
+	for _, code := range duplicates {
+		res.Duplicates = append(res.Duplicates, ImportIssue{Line: lines[code], Code: code.Code, Operator: code.Operator, Reason: "already in stock"})
+	}
+	res.Imported = len(codes) - len(duplicates)
+	inv.logger.Infof("Imported %d voucher(s), %d duplicate(s), %d invalid", res.Imported, len(res.Duplicates), len(res.Invalid))
+	inv.check()
+	return res, nil
+}
+
+// Normalize puts a voucher in the form it is stored in: the code without
+// the spaces and dashes it is printed with, the operator lower-cased.
+func Normalize(code *models.RechargeCode) {
+	code.Code = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code.Code))
+	code.Operator = strings.ToLower(strings.TrimSpace(code.Operator))
+}
+
+// delimiter guesses the field separator from the first line of a file.
+func delimiter(data []byte) rune {
+	line := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line = data[:i]
+	}
+	best, count := ',', bytes.Count(line, []byte{','})
+	for _, d := range []rune{';', '\t'} {
+		if n := bytes.Count(line, []byte(string(d))); n > count {
+			best, count = d, n
+		}
+	}
+	return best
+}
+
+// parseHeader returns the columns named by a header line; ok is false when
+// the line names no code column and so holds a voucher.
+func parseHeader(record []string) (columns []string, ok bool) {
+	for _, name := range record {
+		col := importColumns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))]
+		if col == "code" {
+			ok = true
+		}
+		columns = append(columns, col)
+	}
+	return columns, ok
+}
+
+func blank(record []string) bool {
+	for _, f := range record {
+		if strings.TrimSpace(f) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// parseVoucher reads a voucher from a line, taking the values it lacks
+// from opts. The returned code carries what could be read even on error.
+func parseVoucher(record, columns []string, opts ImportOptions) (*models.RechargeCode, error) {
+	code := &models.RechargeCode{
+		Operator:   opts.Operator,
+		Amount:     opts.Amount,
+		ExpiryDate: opts.ExpiryDate,
+		Status:     models.RechargeStatusAvailable,
+		CreatedBy:  opts.CreatedBy,
+	}
+	var amount, expiry string
+	for i, f := range record {
+		if i >= len(columns) {
+			break
+		}
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		switch columns[i] {
+		case "code":
+			code.Code = f
+		case "operator":
+			code.Operator = f
+		case "amount":
+			amount = f
+		case "expiry":
+			expiry = f
+		}
+	}
+	Normalize(code)
+
+	if amount != "" {
+		v, err := strconv.ParseFloat(strings.Replace(amount, ",", ".", 1), 64)
+		if err != nil {
+			return code, fmt.Errorf("bad amount %q", amount)
+		}
+		code.Amount = v
+	}
+	if err := validate(code); err != nil {
+		return code, err
+	}
+	if expiry != "" {
+		t, err := ParseExpiry(expiry)
+		if err != nil {
+			return code, err
+		}
+		code.ExpiryDate = &t
+	}
+	return code, nil
+}
+
+func validate(code *models.RechargeCode) error {
+	switch {
+	case code.Code == "":
+		return fmt.Errorf("no code")
+	case code.Operator == "":
+		return fmt.Errorf("no operator")
+	case code.Amount <= 0:
+		return fmt.Errorf("no amount")
+	}
+	return nil
+}
+
+// ParseExpiry reads an expiry date. A date without a time expires at the
+// end of that day.
+func ParseExpiry(s string) (time.Time, error) {
+	for _, layout := range expiryLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err != nil {
+			continue
+		}
+		if !strings.Contains(layout, "15") {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad expiry date %q", s)
+}
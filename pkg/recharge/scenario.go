@@ -0,0 +1,235 @@
+package recharge
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes how a voucher is entered on an operator's SIM cards:
+// the USSD codes or the SMS to send, and how to tell from the operator's
+// answer whether the voucher was taken. Steps and texts are Go templates
+// over StepData, e.g. "*3*{{.Code}}#". An entry of the scenarios file:
+//
+//	name: inwi
+//	operators: [inwi]
+//	ussd: ["*120#", "3", "{{.Code}}"]
+//	success: ["(?i)recharg\\w* (effectu|r[eé]ussi)"]
+//	failure: ["(?i)code (invalide|incorrect|d[eé]j[aà] utilis)"]
+//	retries: 1
+//	retry_delay: 2m
+type Scenario struct {
+	Name            string        `yaml:"name"`
+	Operators       []string      `yaml:"operators"`        // matched case-insensitively against the SIM's operator name; none matches any operator
+	VoucherOperator string        `yaml:"voucher_operator"` // operator of its vouchers in the stock; the name when empty
+	USSD            []string      `yaml:"ussd"`             // sent in turn, each answering the menu the previous one opened
+	SMS             *SMSStep      `yaml:"sms"`              // or a message to the operator, whose reply is awaited
+	Success         []string      `yaml:"success"`          // patterns of an answer accepting the voucher
+	Failure         []string      `yaml:"failure"`          // patterns of an answer rejecting it; a rejected voucher is not tried again
+	Retries         int           `yaml:"retries"`          // further attempts when the answer is neither
+	RetryDelay      time.Duration `yaml:"retry_delay"`
+	ReplyTimeout    time.Duration `yaml:"reply_timeout"` // how long an SMS reply is awaited; 2 minutes when zero
+
+	steps         []*template.Template
+	smsText       *template.Template
+	success, fail []*regexp.Regexp
+}
+
+// SMSStep is a message sent to the operator.
+type SMSStep struct {
+	To   string `yaml:"to"`
+	Text string `yaml:"text"`
+}
+
+// StepData is what scenario templates are filled with.
+type StepData struct {
+	Code   string
+	Amount float64
+	MSISDN string
+	ICCID  string
+}
+
+// Scenarios picks the scenario for a SIM's operator.
+type Scenarios struct {
+	list []*Scenario
+}
+
+// LoadScenarios reads scenarios from a YAML file holding a list of
+// Scenario. Codes and menus differ between operators and change over time,
+// so none are built in.
+func LoadScenarios(path string) (*Scenarios, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recharge scenarios: %w", err)
+	}
+	var list []Scenario
+	if err := yaml.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse recharge scenarios %s: %w", path, err)
+	}
+	return NewScenarios(list)
+}
+
+// NewScenarios validates and compiles a list of scenarios.
+func NewScenarios(list []Scenario) (*Scenarios, error) {
+	s := &Scenarios{}
+	for i := range list {
+		sc := list[i]
+		if err := sc.compile(); err != nil {
+			return nil, fmt.Errorf("recharge scenario %q: %w", sc.Name, err)
+		}
+		s.list = append(s.list, &sc)
+	}
+	return s, nil
+}
+
+func (sc *Scenario) compile() error {
+	switch {
+	case len(sc.USSD) > 0 && sc.SMS != nil:
+		return fmt.Errorf("has both USSD steps and an SMS")
+	case len(sc.USSD) == 0 && sc.SMS == nil:
+		return fmt.Errorf("needs USSD steps or an SMS")
+	case sc.SMS != nil && (sc.SMS.To == "" || sc.SMS.Text == ""):
+		return fmt.Errorf("SMS needs a number and a text")
+	case len(sc.Success) == 0:
+		return fmt.Errorf("needs success patterns")
+	case sc.Retries < 0:
+		return fmt.Errorf("negative retries")
+	}
+	if sc.VoucherOperator == "" {
+		sc.VoucherOperator = sc.Name
+	}
+	if sc.ReplyTimeout <= 0 {
+		sc.ReplyTimeout = 2 * time.Minute
+	}
+
+	for i, step := range sc.USSD {
+		t, err := template.New(fmt.Sprintf("ussd[%d]", i)).Option("missingkey=error").Parse(step)
+		if err != nil {
+			return err
+		}
+		sc.steps = append(sc.steps, t)
+	}
+	if !sc.takesCode() {
+		return fmt.Errorf("no step uses {{.Code}}")
+	}
+	if sc.SMS != nil {
+		t, err := template.New("sms").Option("missingkey=error").Parse(sc.SMS.Text)
+		if err != nil {
+			return err
+		}
+		sc.smsText = t
+	}
+
+	var err error
+	if sc.success, err = compilePatterns(sc.Success); err != nil {
+		return err
+	}
+	sc.fail, err = compilePatterns(sc.Failure)
+	return err
+}
+
+// takesCode reports whether the voucher code is entered in some step.
+func (sc *Scenario) takesCode() bool {
+	if sc.SMS != nil {
+		return strings.Contains(sc.SMS.Text, ".Code")
+	}
+	for _, step := range sc.USSD {
+		if strings.Contains(step, ".Code") {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// render fills a step template.
+func render(t *template.Template, data StepData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// verdict is what an operator's answer says about a voucher.
+type verdict int
+
+const (
+	verdictUnclear verdict = iota
+	verdictAccepted
+	verdictRejected
+)
+
+// judge matches an answer against the failure patterns, then the success
+// patterns.
+func (sc *Scenario) judge(answer string) verdict {
+	for _, re := range sc.fail {
+		if re.MatchString(answer) {
+			return verdictRejected
+		}
+	}
+	for _, re := range sc.success {
+		if re.MatchString(answer) {
+			return verdictAccepted
+		}
+	}
+	return verdictUnclear
+}
+
+// Len returns the number of scenarios.
+func (s *Scenarios) Len() int {
+	return len(s.list)
+}
+
+// For returns the scenario of an operator: the first whose operator names
+// it contains, else the first without operator names, nil if none.
+func (s *Scenarios) For(operator string) *Scenario {
+	operator = strings.ToLower(operator)
+	var fallback *Scenario
+	for _, sc := range s.list {
+		if len(sc.Operators) == 0 {
+			if fallback == nil {
+				fallback = sc
+			}
+			continue
+		}
+		for _, name := range sc.Operators {
+			if operator != "" && strings.Contains(operator, strings.ToLower(name)) {
+				return sc
+			}
+		}
+	}
+	return fallback
+}
+
+// VoucherOperators returns the operators whose vouchers the scenarios use,
+// lower-cased, each once.
+func (s *Scenarios) VoucherOperators() []string {
+	var ops []string
+	seen := make(map[string]bool)
+	for _, sc := range s.list {
+		op := strings.ToLower(sc.VoucherOperator)
+		if !seen[op] {
+			seen[op] = true
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresAlertRepository implements AlertRepository using a PostgreSQL database.
+type postgresAlertRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewPostgresAlertRepository creates a new instance of postgresAlertRepository.
+func NewPostgresAlertRepository(db *pgxpool.Pool) AlertRepository {
+	return &postgresAlertRepository{db: db}
+}
+
+// RaiseAlert opens an alert, or refreshes the message, severity and details of
+// the open alert of the same kind on the same entity and counts it again.
+func (r *postgresAlertRepository) RaiseAlert(ctx context.Context, alert *models.Alert) error {
+	if alert.Severity == "" {
+		alert.Severity = models.AlertSeverityWarning
+	}
+	query := `
+		INSERT INTO alerts (kind, severity, entity_type, entity_id, message, details)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (kind, entity_type, entity_id) WHERE resolved_at IS NULL DO UPDATE SET
+			severity = EXCLUDED.severity,
+			message = EXCLUDED.message,
+			details = COALESCE(EXCLUDED.details, alerts.details),
+			count = alerts.count + 1,
+			updated_at = NOW()
+		RETURNING id, count, created_at, updated_at`
+
+	var details []byte
+	if len(alert.Details) > 0 {
+		details = alert.Details
+	}
+	err := r.db.QueryRow(ctx, query,
+		alert.Kind, alert.Severity, alert.EntityType, alert.EntityID, alert.Message, details,
+	).Scan(&alert.ID, &alert.Count, &alert.CreatedAt, &alert.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("postgresAlertRepository.RaiseAlert: %w", err)
+	}
+	return nil
+}
+
+// ResolveAlerts closes the open alert of a kind on an entity, if there is one.
+func (r *postgresAlertRepository) ResolveAlerts(ctx context.Context, kind, entityType, entityID string) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE alerts SET resolved_at = NOW(), updated_at = NOW()
+		WHERE kind = $1 AND entity_type = $2 AND entity_id = $3 AND resolved_at IS NULL`,
+		kind, entityType, entityID)
+	if err != nil {
+		return fmt.Errorf("postgresAlertRepository.ResolveAlerts: %w", err)
+	}
+	return nil
+}
+
+// ResolveAlertByID closes an alert.
+func (r *postgresAlertRepository) ResolveAlertByID(ctx context.Context, id int64) error {
+	commandTag, err := r.db.Exec(ctx, `
+		UPDATE alerts SET resolved_at = COALESCE(resolved_at, NOW()), updated_at = NOW()
+		WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("postgresAlertRepository.ResolveAlertByID: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListAlerts returns the most recently updated alerts, optionally only the
+// open ones.
+func (r *postgresAlertRepository) ListAlerts(ctx context.Context, openOnly bool, limit int) ([]models.Alert, error) {
+	query := `
+		SELECT id, kind, severity, entity_type, entity_id, message, details, count,
+		       created_at, updated_at, resolved_at
+		FROM alerts
+		WHERE NOT $1 OR resolved_at IS NULL
+		ORDER BY updated_at DESC
+		LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, openOnly, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgresAlertRepository.ListAlerts: %w", err)
+	}
+	defer rows.Close()
+
+	alerts := []models.Alert{}
+	for rows.Next() {
+		var a models.Alert
+		var details []byte
+		if err := rows.Scan(
+			&a.ID, &a.Kind, &a.Severity, &a.EntityType, &a.EntityID, &a.Message, &details, &a.Count,
+			&a.CreatedAt, &a.UpdatedAt, &a.ResolvedAt,
+		); err != nil {
+			return nil, fmt.Errorf("postgresAlertRepository.ListAlerts: scan: %w", err)
+		}
+		a.Details = details
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresAlertRepository.ListAlerts: %w", err)
+	}
+	return alerts, nil
+}
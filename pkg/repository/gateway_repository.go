@@ -27,9 +27,11 @@ func (r *PostgresGatewayRepository) CreateGateway(ctx context.Context, gateway *
 		INSERT INTO gateways (
 			id, name, description, location, ami_host, ami_port,
 			ami_user, ami_pass, status, enabled, last_seen, 
-			last_error, created_at, updated_at
+			last_error, created_at, updated_at,
+			sip_endpoint, sip_port, sip_transport, sip_weight, sip_priority, health_status
 		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+			$15, $16, $17, $18, $19, $20
 		)`
 
 	if gateway.ID == "" {
@@ -47,12 +49,25 @@ func (r *PostgresGatewayRepository) CreateGateway(ctx context.Context, gateway *
 	if gateway.AMIPort == "" {
 		gateway.AMIPort = "5038"
 	}
+	if gateway.SIPPort == 0 {
+		gateway.SIPPort = 5060
+	}
+	if gateway.SIPTransport == "" {
+		gateway.SIPTransport = "UDP"
+	}
+	if gateway.SIPWeight <= 0 {
+		gateway.SIPWeight = 1
+	}
+	if gateway.HealthStatus == "" {
+		gateway.HealthStatus = models.GatewayHealthUnknown
+	}
 
 	_, err := r.db.Exec(ctx, query,
 		gateway.ID, gateway.Name, gateway.Description, gateway.Location, 
 		gateway.AMIHost, gateway.AMIPort, gateway.AMIUser, gateway.AMIPass,
 		gateway.Status, gateway.Enabled, gateway.LastSeen, gateway.LastError,
 		gateway.CreatedAt, gateway.UpdatedAt,
+		gateway.SIPEndpoint, gateway.SIPPort, gateway.SIPTransport, gateway.SIPWeight, gateway.SIPPriority, gateway.HealthStatus,
 	)
 	if err != nil {
 		return fmt.Errorf("PostgresGatewayRepository.CreateGateway: failed to create gateway: %w", err)
@@ -66,7 +81,9 @@ func (r *PostgresGatewayRepository) GetGatewayByID(ctx context.Context, id strin
 		SELECT 
 			id, name, description, location, ami_host, ami_port,
 			ami_user, ami_pass, status, enabled, last_seen, 
-			last_error, created_at, updated_at
+			last_error, created_at, updated_at,
+			sip_endpoint, sip_port, sip_transport, sip_weight, sip_priority,
+			health_status, health_last_check, sip_latency_ms, uptime_percent
 		FROM gateways
 		WHERE id = $1`
 
@@ -75,6 +92,8 @@ func (r *PostgresGatewayRepository) GetGatewayByID(ctx context.Context, id strin
 		&gateway.ID, &gateway.Name, &gateway.Description, &gateway.Location, &gateway.AMIHost, &gateway.AMIPort,
 		&gateway.AMIUser, &gateway.AMIPass, &gateway.Status, &gateway.Enabled, &gateway.LastSeen, &gateway.LastError,
 		&gateway.CreatedAt, &gateway.UpdatedAt,
+		&gateway.SIPEndpoint, &gateway.SIPPort, &gateway.SIPTransport, &gateway.SIPWeight, &gateway.SIPPriority,
+		&gateway.HealthStatus, &gateway.HealthLastCheck, &gateway.SIPLatencyMs, &gateway.UptimePercent,
 	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -91,7 +110,9 @@ func (r *PostgresGatewayRepository) ListGateways(ctx context.Context) ([]*models
 		SELECT 
 			id, name, description, location, ami_host, ami_port,
 			ami_user, ami_pass, status, enabled, last_seen, 
-			last_error, created_at, updated_at
+			last_error, created_at, updated_at,
+			sip_endpoint, sip_port, sip_transport, sip_weight, sip_priority,
+			health_status, health_last_check, sip_latency_ms, uptime_percent
 		FROM gateways
 		ORDER BY name ASC`
 
@@ -108,6 +129,8 @@ func (r *PostgresGatewayRepository) ListGateways(ctx context.Context) ([]*models
 			&gateway.ID, &gateway.Name, &gateway.Description, &gateway.Location, &gateway.AMIHost, &gateway.AMIPort,
 			&gateway.AMIUser, &gateway.AMIPass, &gateway.Status, &gateway.Enabled, &gateway.LastSeen, &gateway.LastError,
 			&gateway.CreatedAt, &gateway.UpdatedAt,
+			&gateway.SIPEndpoint, &gateway.SIPPort, &gateway.SIPTransport, &gateway.SIPWeight, &gateway.SIPPriority,
+			&gateway.HealthStatus, &gateway.HealthLastCheck, &gateway.SIPLatencyMs, &gateway.UptimePercent,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("PostgresGatewayRepository.ListGateways: failed to scan gateway: %w", err)
@@ -128,7 +151,8 @@ func (r *PostgresGatewayRepository) UpdateGateway(ctx context.Context, gateway *
 		UPDATE gateways
 		SET name = $2, description = $3, location = $4, ami_host = $5, ami_port = $6,
 			ami_user = $7, ami_pass = $8, status = $9, enabled = $10, last_seen = $11, 
-			last_error = $12, updated_at = $13
+			last_error = $12, updated_at = $13,
+			sip_endpoint = $14, sip_port = $15, sip_transport = $16, sip_weight = $17, sip_priority = $18
 		WHERE id = $1`
 
 	gateway.UpdatedAt = time.Now()
@@ -137,6 +161,7 @@ func (r *PostgresGatewayRepository) UpdateGateway(ctx context.Context, gateway *
 		gateway.ID, gateway.Name, gateway.Description, gateway.Location, gateway.AMIHost, gateway.AMIPort,
 		gateway.AMIUser, gateway.AMIPass, gateway.Status, gateway.Enabled, gateway.LastSeen, gateway.LastError,
 		gateway.UpdatedAt,
+		gateway.SIPEndpoint, gateway.SIPPort, gateway.SIPTransport, gateway.SIPWeight, gateway.SIPPriority,
 	)
 	if err != nil {
 		return fmt.Errorf("PostgresGatewayRepository.UpdateGateway: failed to update gateway: %w", err)
@@ -171,6 +196,49 @@ func (r *PostgresGatewayRepository) UpdateGatewayHeartbeat(ctx context.Context,
 	return nil
 }
 
+// UpdateGatewayStatus records the live connection state of a gateway.
+// last_seen is refreshed whenever the gateway is reported online.
+func (r *PostgresGatewayRepository) UpdateGatewayStatus(ctx context.Context, id, status string, lastError *string) error {
+	query := `
+		UPDATE gateways
+		SET status = $2::varchar, last_error = $3, updated_at = $4,
+			last_seen = CASE WHEN $2::varchar = 'online' THEN $4 ELSE last_seen END
+		WHERE id = $1`
+
+	result, err := r.db.Exec(ctx, query, id, status, lastError, time.Now())
+	if err != nil {
+		return fmt.Errorf("PostgresGatewayRepository.UpdateGatewayStatus: failed to update status: %w", err)
+	}
+
+	rowsAffected := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// UpdateGatewaySIPHealth records what the SIP server's OPTIONS probes found
+// of a gateway. latencyMs is nil while it does not answer.
+func (r *PostgresGatewayRepository) UpdateGatewaySIPHealth(ctx context.Context, id, health string, latencyMs *int, uptimePercent float64, checkedAt time.Time) error {
+	query := `
+		UPDATE gateways
+		SET health_status = $2, sip_latency_ms = $3, uptime_percent = $4, health_last_check = $5
+		WHERE id = $1`
+
+	result, err := r.db.Exec(ctx, query, id, health, latencyMs, uptimePercent, checkedAt)
+	if err != nil {
+		return fmt.Errorf("PostgresGatewayRepository.UpdateGatewaySIPHealth: failed to update SIP health: %w", err)
+	}
+
+	rowsAffected := result.RowsAffected()
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
 // DeleteGateway deletes a gateway by its ID.
 func (r *PostgresGatewayRepository) DeleteGateway(ctx context.Context, id string) error {
 	query := `DELETE FROM gateways WHERE id = $1`
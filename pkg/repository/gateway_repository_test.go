@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+	"testing"
+)
+
+const gatewaysTable = `
+	CREATE TABLE gateways (
+		id UUID PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		status VARCHAR(50) NOT NULL DEFAULT 'offline',
+		last_seen TIMESTAMP WITH TIME ZONE,
+		last_error TEXT,
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`
+
+func TestUpdateGatewayStatus(t *testing.T) {
+	db := testDB(t, gatewaysTable)
+	ctx := context.Background()
+	repo := NewPostgresGatewayRepository(db)
+	const id = "6f1c2a3e-1d2b-4c5a-9e8f-0a1b2c3d4e5f"
+	if _, err := db.Exec(ctx, `INSERT INTO gateways (id, name) VALUES ($1, 'gw1')`, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.UpdateGatewayStatus(ctx, id, "online", nil); err != nil {
+		t.Fatalf("UpdateGatewayStatus(online): %v", err)
+	}
+	var status string
+	var seen bool
+	var lastError *string
+	row := db.QueryRow(ctx, `SELECT status, last_seen IS NOT NULL, last_error FROM gateways WHERE id = $1`, id)
+	if err := row.Scan(&status, &seen, &lastError); err != nil {
+		t.Fatal(err)
+	}
+	if status != "online" || !seen || lastError != nil {
+		t.Errorf("after online: status %q, last_seen set %v, last_error %v", status, seen, lastError)
+	}
+
+	msg := "connection refused"
+	if err := repo.UpdateGatewayStatus(ctx, id, "error", &msg); err != nil {
+		t.Fatalf("UpdateGatewayStatus(error): %v", err)
+	}
+	row = db.QueryRow(ctx, `SELECT status, last_seen IS NOT NULL, last_error FROM gateways WHERE id = $1`, id)
+	if err := row.Scan(&status, &seen, &lastError); err != nil {
+		t.Fatal(err)
+	}
+	if status != "error" || !seen || lastError == nil || *lastError != msg {
+		t.Errorf("after error: status %q, last_seen set %v, last_error %v", status, seen, lastError)
+	}
+
+	if err := repo.UpdateGatewayStatus(ctx, "00000000-0000-0000-0000-000000000000", "online", nil); err != ErrNotFound {
+		t.Errorf("unknown gateway: got %v, want ErrNotFound", err)
+	}
+}
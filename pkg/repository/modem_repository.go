@@ -2,7 +2,11 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"time"
+
 	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -21,15 +25,15 @@ func NewPostgresModemRepository(db *pgxpool.Pool) ModemRepository {
 func (r *postgresModemRepository) CreateModem(ctx context.Context, modem *models.Modem) (int, error) {
 	query := `
 		INSERT INTO modems (
-			device_path, imei, imsi, model, manufacturer, firmware_version, 
+			gateway_id, dongle_name, device_path, audio_path, usb_path, imei, imsi, model, manufacturer, firmware_version, 
 			signal_strength_dbm, network_operator_name, network_registration_status, 
 			status, last_seen_at
 		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15
 		) RETURNING id, created_at, updated_at` // Also return created_at and updated_at
 
 	err := r.db.QueryRow(ctx, query,
-		modem.DevicePath, modem.IMEI, modem.IMSI, modem.Model, modem.Manufacturer, modem.FirmwareVersion,
+		modem.GatewayID, modem.DongleName, modem.DevicePath, modem.AudioPath, modem.USBPath, modem.IMEI, modem.IMSI, modem.Model, modem.Manufacturer, modem.FirmwareVersion,
 		modem.SignalStrengthDBM, modem.NetworkOperatorName, modem.NetworkRegistrationStatus,
 		modem.Status, modem.LastSeenAt,
 	).Scan(&modem.ID, &modem.CreatedAt, &modem.UpdatedAt) // Scan the returned id, created_at, updated_at
@@ -43,9 +47,9 @@ func (r *postgresModemRepository) CreateModem(ctx context.Context, modem *models
 // GetAllModems retrieves all modem records from the database.
 func (r *postgresModemRepository) GetAllModems(ctx context.Context) ([]models.Modem, error) {
 	query := `
-		SELECT id, device_path, imei, imsi, model, manufacturer, firmware_version, 
+		SELECT id, gateway_id, dongle_name, device_path, audio_path, usb_path, imei, imsi, model, manufacturer, firmware_version, 
 		       signal_strength_dbm, network_operator_name, network_registration_status, 
-		       status, last_seen_at, created_at, updated_at 
+		       status, health_state, health_changed_at, last_seen_at, created_at, updated_at 
 		FROM modems ORDER BY id ASC`
 
 	rows, err := r.db.Query(ctx, query)
@@ -58,9 +62,9 @@ func (r *postgresModemRepository) GetAllModems(ctx context.Context) ([]models.Mo
 	for rows.Next() {
 		var m models.Modem
 		err := rows.Scan(
-			&m.ID, &m.DevicePath, &m.IMEI, &m.IMSI, &m.Model, &m.Manufacturer, &m.FirmwareVersion,
+			&m.ID, &m.GatewayID, &m.DongleName, &m.DevicePath, &m.AudioPath, &m.USBPath, &m.IMEI, &m.IMSI, &m.Model, &m.Manufacturer, &m.FirmwareVersion,
 			&m.SignalStrengthDBM, &m.NetworkOperatorName, &m.NetworkRegistrationStatus,
-			&m.Status, &m.LastSeenAt, &m.CreatedAt, &m.UpdatedAt,
+			&m.Status, &m.HealthState, &m.HealthChangedAt, &m.LastSeenAt, &m.CreatedAt, &m.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -78,23 +82,289 @@ func (r *postgresModemRepository) GetAllModems(ctx context.Context) ([]models.Mo
 // GetModemByID retrieves a single modem record from the database by its ID.
 func (r *postgresModemRepository) GetModemByID(ctx context.Context, id int) (*models.Modem, error) {
 	query := `
-		SELECT id, device_path, imei, imsi, model, manufacturer, firmware_version, 
+		SELECT id, gateway_id, dongle_name, device_path, audio_path, usb_path, imei, imsi, model, manufacturer, firmware_version, 
 		       signal_strength_dbm, network_operator_name, network_registration_status, 
-		       status, last_seen_at, created_at, updated_at 
+		       status, health_state, health_changed_at, last_seen_at, created_at, updated_at 
 		FROM modems 
 		WHERE id = $1`
 
 	var m models.Modem
 	err := r.db.QueryRow(ctx, query, id).Scan(
-		&m.ID, &m.DevicePath, &m.IMEI, &m.IMSI, &m.Model, &m.Manufacturer, &m.FirmwareVersion,
+		&m.ID, &m.GatewayID, &m.DongleName, &m.DevicePath, &m.AudioPath, &m.USBPath, &m.IMEI, &m.IMSI, &m.Model, &m.Manufacturer, &m.FirmwareVersion,
+		&m.SignalStrengthDBM, &m.NetworkOperatorName, &m.NetworkRegistrationStatus,
+		&m.Status, &m.HealthState, &m.HealthChangedAt, &m.LastSeenAt, &m.CreatedAt, &m.UpdatedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresModemRepository.GetModemByID: %w", err)
+	}
+	return &m, nil
+}
+
+// UpsertModemByIMEI inserts a modem reported by a gateway or refreshes the
+// existing row with the same IMEI. The IMSI and dongle name are taken away
+// from any other modem first, as a SIM or a dongle slot can move between
+// devices.
+func (r *postgresModemRepository) UpsertModemByIMEI(ctx context.Context, modem *models.Modem) error {
+	if modem.IMEI == nil || *modem.IMEI == "" {
+		return fmt.Errorf("postgresModemRepository.UpsertModemByIMEI: modem has no IMEI")
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("postgresModemRepository.UpsertModemByIMEI: begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if modem.IMSI != nil {
+		if _, err := tx.Exec(ctx, `UPDATE modems SET imsi = NULL WHERE imsi = $1 AND imei <> $2`, modem.IMSI, modem.IMEI); err != nil {
+			return fmt.Errorf("postgresModemRepository.UpsertModemByIMEI: release imsi: %w", err)
+		}
+	}
+	if modem.DongleName != nil {
+		if _, err := tx.Exec(ctx, `
+			UPDATE modems SET dongle_name = NULL
+			WHERE gateway_id IS NOT DISTINCT FROM $1 AND dongle_name = $2 AND imei <> $3`,
+			modem.GatewayID, modem.DongleName, modem.IMEI); err != nil {
+			return fmt.Errorf("postgresModemRepository.UpsertModemByIMEI: release dongle name: %w", err)
+		}
+	}
+
+	query := `
+		INSERT INTO modems (
+			gateway_id, dongle_name, device_path, audio_path, usb_path, imei, imsi, model, manufacturer, firmware_version, 
+			signal_strength_dbm, network_operator_name, network_registration_status, 
+			status, last_seen_at
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15
+		)
+		ON CONFLICT (imei) DO UPDATE SET
+			gateway_id = EXCLUDED.gateway_id,
+			dongle_name = EXCLUDED.dongle_name,
+			device_path = EXCLUDED.device_path,
+			audio_path = COALESCE(EXCLUDED.audio_path, modems.audio_path),
+			usb_path = COALESCE(EXCLUDED.usb_path, modems.usb_path),
+			imsi = EXCLUDED.imsi,
+			model = COALESCE(EXCLUDED.model, modems.model),
+			manufacturer = COALESCE(EXCLUDED.manufacturer, modems.manufacturer),
+			firmware_version = COALESCE(EXCLUDED.firmware_version, modems.firmware_version),
+			signal_strength_dbm = EXCLUDED.signal_strength_dbm,
+			network_operator_name = EXCLUDED.network_operator_name,
+			network_registration_status = EXCLUDED.network_registration_status,
+			status = EXCLUDED.status,
+			last_seen_at = EXCLUDED.last_seen_at
+		RETURNING id, created_at, updated_at`
+
+	err = tx.QueryRow(ctx, query,
+		modem.GatewayID, modem.DongleName, modem.DevicePath, modem.AudioPath, modem.USBPath, modem.IMEI, modem.IMSI, modem.Model, modem.Manufacturer, modem.FirmwareVersion,
+		modem.SignalStrengthDBM, modem.NetworkOperatorName, modem.NetworkRegistrationStatus,
+		modem.Status, modem.LastSeenAt,
+	).Scan(&modem.ID, &modem.CreatedAt, &modem.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("postgresModemRepository.UpsertModemByIMEI: upsert: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("postgresModemRepository.UpsertModemByIMEI: commit: %w", err)
+	}
+	return nil
+}
+
+// GetModemByDongleName retrieves the modem currently known under a chan_dongle
+// device name on a gateway. A nil gatewayID matches modems without a gateway.
+func (r *postgresModemRepository) GetModemByDongleName(ctx context.Context, gatewayID *string, dongleName string) (*models.Modem, error) {
+	query := `
+		SELECT id, gateway_id, dongle_name, device_path, audio_path, usb_path, imei, imsi, model, manufacturer, firmware_version, 
+		       signal_strength_dbm, network_operator_name, network_registration_status, 
+		       status, health_state, health_changed_at, last_seen_at, created_at, updated_at 
+		FROM modems 
+		WHERE gateway_id IS NOT DISTINCT FROM $1 AND dongle_name = $2`
+
+	var m models.Modem
+	err := r.db.QueryRow(ctx, query, gatewayID, dongleName).Scan(
+		&m.ID, &m.GatewayID, &m.DongleName, &m.DevicePath, &m.AudioPath, &m.USBPath, &m.IMEI, &m.IMSI, &m.Model, &m.Manufacturer, &m.FirmwareVersion,
 		&m.SignalStrengthDBM, &m.NetworkOperatorName, &m.NetworkRegistrationStatus,
-		&m.Status, &m.LastSeenAt, &m.CreatedAt, &m.UpdatedAt,
+		&m.Status, &m.HealthState, &m.HealthChangedAt, &m.LastSeenAt, &m.CreatedAt, &m.UpdatedAt,
 	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresModemRepository.GetModemByDongleName: %w", err)
+	}
+	return &m, nil
+}
+
+// UpdateModemStatus sets the status of a modem and marks it as seen at lastSeenAt.
+// An empty status only refreshes last_seen_at.
+func (r *postgresModemRepository) UpdateModemStatus(ctx context.Context, id int, status string, lastSeenAt time.Time) error {
+	query := `
+		UPDATE modems SET
+			status = COALESCE(NULLIF($2, ''), status),
+			last_seen_at = GREATEST(COALESCE(last_seen_at, $3), $3)
+		WHERE id = $1`
+
+	commandTag, err := r.db.Exec(ctx, query, id, status, lastSeenAt)
+	if err != nil {
+		return fmt.Errorf("postgresModemRepository.UpdateModemStatus: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateModemRadio stores the latest signal, registration and operator read
+// from a modem. Nil values leave the stored ones alone, except the signal,
+// which is cleared when it is no longer detectable.
+func (r *postgresModemRepository) UpdateModemRadio(ctx context.Context, id int, signalDBM *int, registration, operatorName *string, seenAt time.Time) error {
+	query := `
+		UPDATE modems SET
+			signal_strength_dbm = $2,
+			network_registration_status = COALESCE($3, network_registration_status),
+			network_operator_name = COALESCE($4, network_operator_name),
+			last_seen_at = GREATEST(COALESCE(last_seen_at, $5), $5)
+		WHERE id = $1`
 
+	commandTag, err := r.db.Exec(ctx, query, id, signalDBM, registration, operatorName, seenAt)
 	if err != nil {
-		// Consider using a more specific error check, e.g., for pgx.ErrNoRows
-		// and returning ErrNotFound from the repository package.
-		return nil, err 
+		return fmt.Errorf("postgresModemRepository.UpdateModemRadio: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateModemHealth sets the health state of a modem.
+func (r *postgresModemRepository) UpdateModemHealth(ctx context.Context, id int, state string, changedAt time.Time) error {
+	commandTag, err := r.db.Exec(ctx, `UPDATE modems SET health_state = $2, health_changed_at = $3 WHERE id = $1`, id, state, changedAt)
+	if err != nil {
+		return fmt.Errorf("postgresModemRepository.UpdateModemHealth: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RecordHealthTransition stores a health state change or recovery action.
+func (r *postgresModemRepository) RecordHealthTransition(ctx context.Context, t *models.ModemHealthTransition) error {
+	query := `
+		INSERT INTO modem_health_transitions (
+			modem_id, from_state, to_state, reason, action, action_error, created_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`
+
+	err := r.db.QueryRow(ctx, query,
+		t.ModemID, t.FromState, t.ToState, t.Reason, t.Action, t.ActionError, t.CreatedAt,
+	).Scan(&t.ID)
+	if err != nil {
+		return fmt.Errorf("postgresModemRepository.RecordHealthTransition: %w", err)
+	}
+	return nil
+}
+
+// GetHealthTransitions returns the most recent health transitions of a modem.
+func (r *postgresModemRepository) GetHealthTransitions(ctx context.Context, modemID int, limit int) ([]models.ModemHealthTransition, error) {
+	query := `
+		SELECT id, modem_id, from_state, to_state, reason, action, action_error, created_at
+		FROM modem_health_transitions
+		WHERE modem_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, modemID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgresModemRepository.GetHealthTransitions: %w", err)
+	}
+	defer rows.Close()
+
+	transitions := []models.ModemHealthTransition{}
+	for rows.Next() {
+		var t models.ModemHealthTransition
+		if err := rows.Scan(&t.ID, &t.ModemID, &t.FromState, &t.ToState, &t.Reason, &t.Action, &t.ActionError, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("postgresModemRepository.GetHealthTransitions: scan: %w", err)
+		}
+		transitions = append(transitions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresModemRepository.GetHealthTransitions: %w", err)
+	}
+	return transitions, nil
+}
+
+// GetModemByIMEI retrieves a modem by its IMEI.
+func (r *postgresModemRepository) GetModemByIMEI(ctx context.Context, imei string) (*models.Modem, error) {
+	query := `
+		SELECT id, gateway_id, dongle_name, device_path, audio_path, usb_path, imei, imsi, model, manufacturer, firmware_version, 
+		       signal_strength_dbm, network_operator_name, network_registration_status, 
+		       status, health_state, health_changed_at, last_seen_at, created_at, updated_at 
+		FROM modems 
+		WHERE imei = $1`
+
+	var m models.Modem
+	err := r.db.QueryRow(ctx, query, imei).Scan(
+		&m.ID, &m.GatewayID, &m.DongleName, &m.DevicePath, &m.AudioPath, &m.USBPath, &m.IMEI, &m.IMSI, &m.Model, &m.Manufacturer, &m.FirmwareVersion,
+		&m.SignalStrengthDBM, &m.NetworkOperatorName, &m.NetworkRegistrationStatus,
+		&m.Status, &m.HealthState, &m.HealthChangedAt, &m.LastSeenAt, &m.CreatedAt, &m.UpdatedAt,
+	)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresModemRepository.GetModemByIMEI: %w", err)
 	}
 	return &m, nil
 }
+
+// RecordModemMove stores that a modem turned up on another tty or USB port.
+func (r *postgresModemRepository) RecordModemMove(ctx context.Context, move *models.ModemDeviceMove) error {
+	query := `
+		INSERT INTO modem_device_moves (
+			modem_id, old_device_path, new_device_path, old_usb_path, new_usb_path, moved_at
+		) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	err := r.db.QueryRow(ctx, query,
+		move.ModemID, move.OldDevicePath, move.NewDevicePath, move.OldUSBPath, move.NewUSBPath, move.MovedAt,
+	).Scan(&move.ID)
+	if err != nil {
+		return fmt.Errorf("postgresModemRepository.RecordModemMove: %w", err)
+	}
+	return nil
+}
+
+// GetModemMoves returns the most recent moves of a modem, newest first.
+func (r *postgresModemRepository) GetModemMoves(ctx context.Context, modemID int, limit int) ([]models.ModemDeviceMove, error) {
+	query := `
+		SELECT id, modem_id, old_device_path, new_device_path, old_usb_path, new_usb_path, moved_at
+		FROM modem_device_moves
+		WHERE modem_id = $1
+		ORDER BY moved_at DESC
+		LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, modemID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgresModemRepository.GetModemMoves: %w", err)
+	}
+	defer rows.Close()
+
+	moves := []models.ModemDeviceMove{}
+	for rows.Next() {
+		var move models.ModemDeviceMove
+		if err := rows.Scan(
+			&move.ID, &move.ModemID, &move.OldDevicePath, &move.NewDevicePath, &move.OldUSBPath, &move.NewUSBPath, &move.MovedAt,
+		); err != nil {
+			return nil, fmt.Errorf("postgresModemRepository.GetModemMoves: scan: %w", err)
+		}
+		moves = append(moves, move)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresModemRepository.GetModemMoves: %w", err)
+	}
+	return moves, nil
+}
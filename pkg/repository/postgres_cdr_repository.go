@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"database/sql"
+	"time"
 
 	"github.com/e173-gateway/e173_go_gateway/pkg/models" // Corrected model import path
 	"github.com/google/uuid"
@@ -22,19 +23,30 @@ func NewPostgresCdrRepository(db *pgxpool.Pool) *PostgresCdrRepository {
 	return &PostgresCdrRepository{db: db}
 }
 
-// CreateCdr inserts a new Cdr into the database.
+// CreateCdr inserts a new Cdr into the database. Inserts are idempotent on the
+// gateway and Asterisk UniqueID: if the CDR is already stored nothing is
+// written and ErrDuplicate is returned.
 func (r *PostgresCdrRepository) CreateCdr(ctx context.Context, cdr *models.Cdr) error {
+	// The unique keys of migration 013: CDRs without a gateway are unique
+	// on the UniqueID alone.
+	conflict := "(gateway_id, asterisk_unique_id)"
+	if cdr.GatewayID == nil {
+		conflict = "(asterisk_unique_id) WHERE gateway_id IS NULL"
+	}
 	query := `
 		INSERT INTO call_detail_records (
 			asterisk_unique_id, source_number, destination_number,
 			call_start_time, call_answer_time, call_end_time,
 			duration_seconds, billable_duration_seconds, modem_id, sim_card_id,
 			call_direction, customer_id, total_cost, cost_per_minute,
-			is_spam, spam_reason, disposition, hangup_cause, recorded_audio_path
+			is_spam, spam_reason, disposition, hangup_cause, recorded_audio_path,
+			post_dial_delay_ms, gateway_id, disposition_category
 		) VALUES (
 			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 
-			$11, $12, $13, $14, $15, $16, $17, $18, $19
-		) RETURNING id`
+			$11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22
+		)
+		ON CONFLICT ` + conflict + ` DO NOTHING
+		RETURNING id`
 
 	var returnedID int64
 	err := r.db.QueryRow(ctx, query,
@@ -43,8 +55,12 @@ func (r *PostgresCdrRepository) CreateCdr(ctx context.Context, cdr *models.Cdr)
 		cdr.Duration, cdr.BillableSeconds, cdr.ModemID, cdr.SimCardID,
 		cdr.CallDirection, cdr.SipCustomerID, cdr.Cost, cdr.CustomerPrice,
 		cdr.IsSpam, cdr.SpamDetectionMethod, cdr.Disposition, cdr.Cause, nil,
+		cdr.PostDialDelayMs, cdr.GatewayID, cdr.DispositionCategory,
 	).Scan(&returnedID)
 
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("PostgresCdrRepository.CreateCdr: CDR %s already exists: %w", cdr.UniqueID, ErrDuplicate)
+	}
 	if err != nil {
 		return fmt.Errorf("PostgresCdrRepository.CreateCdr: failed to insert CDR: %w", err)
 	}
@@ -62,7 +78,8 @@ func (r *PostgresCdrRepository) UpdateCdr(ctx context.Context, cdr *models.Cdr)
 			call_start_time = $5, call_answer_time = $6, call_end_time = $7,
 			duration_seconds = $8, billable_duration_seconds = $9, modem_id = $10, sim_card_id = $11,
 			call_direction = $12, customer_id = $13, total_cost = $14, cost_per_minute = $15,
-			is_spam = $16, spam_reason = $17, disposition = $18, hangup_cause = $19
+			is_spam = $16, spam_reason = $17, disposition = $18, hangup_cause = $19,
+			post_dial_delay_ms = $20, gateway_id = $21, disposition_category = $22
 		WHERE id = $1`
 
 	_, err := r.db.Exec(ctx, query,
@@ -72,6 +89,7 @@ func (r *PostgresCdrRepository) UpdateCdr(ctx context.Context, cdr *models.Cdr)
 		cdr.Duration, cdr.BillableSeconds, cdr.ModemID, cdr.SimCardID,
 		cdr.CallDirection, cdr.SipCustomerID, cdr.Cost, cdr.CustomerPrice,
 		cdr.IsSpam, cdr.SpamDetectionMethod, cdr.Disposition, cdr.Cause,
+		cdr.PostDialDelayMs, cdr.GatewayID, cdr.DispositionCategory,
 	)
 
 	if err != nil {
@@ -95,16 +113,16 @@ func (r *PostgresCdrRepository) GetCdrByDatabaseID(ctx context.Context, id int64
 			call_start_time, call_answer_time, call_end_time,
 			duration_seconds, billable_duration_seconds, modem_id, sim_card_id,
 			call_direction, customer_id, total_cost, cost_per_minute,
-			is_spam, spam_reason, disposition, hangup_cause
+			is_spam, spam_reason, disposition, disposition_category, hangup_cause, post_dial_delay_ms, gateway_id
 		FROM call_detail_records
 		WHERE id = $1`
 
 	cdr := &models.Cdr{}
 	var dbID int64
 	var modemID, simCardID, customerID sql.NullInt64
-	var sourceNum, destNum, callDir, spamReason, disposition, hangupCause sql.NullString
+	var sourceNum, destNum, callDir, spamReason, disposition, dispositionCategory, hangupCause, gatewayID sql.NullString
 	var callAnswerTime sql.NullTime
-	var duration, billable sql.NullInt32
+	var duration, billable, postDialDelay sql.NullInt32
 	var totalCost, costPerMin sql.NullFloat64
 	var isSpam sql.NullBool
 
@@ -113,7 +131,7 @@ func (r *PostgresCdrRepository) GetCdrByDatabaseID(ctx context.Context, id int64
 		&cdr.StartTime, &callAnswerTime, &cdr.EndTime,
 		&duration, &billable, &modemID, &simCardID,
 		&callDir, &customerID, &totalCost, &costPerMin,
-		&isSpam, &spamReason, &disposition, &hangupCause,
+		&isSpam, &spamReason, &disposition, &dispositionCategory, &hangupCause, &postDialDelay, &gatewayID,
 	)
 
 	if err != nil {
@@ -144,6 +162,13 @@ func (r *PostgresCdrRepository) GetCdrByDatabaseID(ctx context.Context, id int64
 		b := int(billable.Int32)
 		cdr.BillableSeconds = &b
 	}
+	if postDialDelay.Valid {
+		p := int(postDialDelay.Int32)
+		cdr.PostDialDelayMs = &p
+	}
+	if gatewayID.Valid {
+		cdr.GatewayID = &gatewayID.String
+	}
 	if modemID.Valid {
 		m := int(modemID.Int64)
 		cdr.ModemID = &m
@@ -171,6 +196,9 @@ func (r *PostgresCdrRepository) GetCdrByDatabaseID(ctx context.Context, id int64
 	if disposition.Valid {
 		cdr.Disposition = &disposition.String
 	}
+	if dispositionCategory.Valid {
+		cdr.DispositionCategory = &dispositionCategory.String
+	}
 	if hangupCause.Valid {
 		cdr.Cause = &hangupCause.String
 	}
@@ -187,16 +215,16 @@ func (r *PostgresCdrRepository) GetCdrByAsteriskUniqueID(ctx context.Context, as
 			call_start_time, call_answer_time, call_end_time,
 			duration_seconds, billable_duration_seconds, modem_id, sim_card_id,
 			call_direction, customer_id, total_cost, cost_per_minute,
-			is_spam, spam_reason, disposition, hangup_cause
+			is_spam, spam_reason, disposition, disposition_category, hangup_cause, post_dial_delay_ms, gateway_id
 		FROM call_detail_records
 		WHERE asterisk_unique_id = $1`
 
 	cdr := &models.Cdr{}
 	var dbID int64
 	var modemID, simCardID, customerID sql.NullInt64
-	var sourceNum, destNum, callDir, spamReason, disposition, hangupCause sql.NullString
+	var sourceNum, destNum, callDir, spamReason, disposition, dispositionCategory, hangupCause, gatewayID sql.NullString
 	var callAnswerTime sql.NullTime
-	var duration, billable sql.NullInt32
+	var duration, billable, postDialDelay sql.NullInt32
 	var totalCost, costPerMin sql.NullFloat64
 	var isSpam sql.NullBool
 
@@ -205,7 +233,7 @@ func (r *PostgresCdrRepository) GetCdrByAsteriskUniqueID(ctx context.Context, as
 		&cdr.StartTime, &callAnswerTime, &cdr.EndTime,
 		&duration, &billable, &modemID, &simCardID,
 		&callDir, &customerID, &totalCost, &costPerMin,
-		&isSpam, &spamReason, &disposition, &hangupCause,
+		&isSpam, &spamReason, &disposition, &dispositionCategory, &hangupCause, &postDialDelay, &gatewayID,
 	)
 
 	if err != nil {
@@ -236,6 +264,13 @@ func (r *PostgresCdrRepository) GetCdrByAsteriskUniqueID(ctx context.Context, as
 		b := int(billable.Int32)
 		cdr.BillableSeconds = &b
 	}
+	if postDialDelay.Valid {
+		p := int(postDialDelay.Int32)
+		cdr.PostDialDelayMs = &p
+	}
+	if gatewayID.Valid {
+		cdr.GatewayID = &gatewayID.String
+	}
 	if modemID.Valid {
 		m := int(modemID.Int64)
 		cdr.ModemID = &m
@@ -263,6 +298,9 @@ func (r *PostgresCdrRepository) GetCdrByAsteriskUniqueID(ctx context.Context, as
 	if disposition.Valid {
 		cdr.Disposition = &disposition.String
 	}
+	if dispositionCategory.Valid {
+		cdr.DispositionCategory = &dispositionCategory.String
+	}
 	if hangupCause.Valid {
 		cdr.Cause = &hangupCause.String
 	}
@@ -278,7 +316,7 @@ func (r *PostgresCdrRepository) GetRecentCDRs(ctx context.Context, limit int) ([
 			call_start_time, call_answer_time, call_end_time,
 			duration_seconds, billable_duration_seconds, modem_id, sim_card_id,
 			call_direction, customer_id, total_cost, cost_per_minute,
-			is_spam, spam_reason, disposition, hangup_cause
+			is_spam, spam_reason, disposition, disposition_category, hangup_cause, post_dial_delay_ms, gateway_id
 		FROM call_detail_records
 		ORDER BY call_start_time DESC
 		LIMIT $1`
@@ -294,9 +332,9 @@ func (r *PostgresCdrRepository) GetRecentCDRs(ctx context.Context, limit int) ([
 		cdr := &models.Cdr{}
 		var dbID int64
 		var modemID, simCardID, customerID sql.NullInt64
-		var sourceNum, destNum, callDir, spamReason, disposition, hangupCause sql.NullString
+		var sourceNum, destNum, callDir, spamReason, disposition, dispositionCategory, hangupCause, gatewayID sql.NullString
 		var callAnswerTime sql.NullTime
-		var duration, billable sql.NullInt32
+		var duration, billable, postDialDelay sql.NullInt32
 		var totalCost, costPerMin sql.NullFloat64
 		var isSpam sql.NullBool
 
@@ -305,7 +343,7 @@ func (r *PostgresCdrRepository) GetRecentCDRs(ctx context.Context, limit int) ([
 			&cdr.StartTime, &callAnswerTime, &cdr.EndTime,
 			&duration, &billable, &modemID, &simCardID,
 			&callDir, &customerID, &totalCost, &costPerMin,
-			&isSpam, &spamReason, &disposition, &hangupCause,
+			&isSpam, &spamReason, &disposition, &dispositionCategory, &hangupCause, &postDialDelay, &gatewayID,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("PostgresCdrRepository.GetRecentCDRs: failed to scan CDR: %w", err)
@@ -332,6 +370,13 @@ func (r *PostgresCdrRepository) GetRecentCDRs(ctx context.Context, limit int) ([
 			b := int(billable.Int32)
 			cdr.BillableSeconds = &b
 		}
+		if postDialDelay.Valid {
+			p := int(postDialDelay.Int32)
+			cdr.PostDialDelayMs = &p
+		}
+		if gatewayID.Valid {
+			cdr.GatewayID = &gatewayID.String
+		}
 		if modemID.Valid {
 			m := int(modemID.Int64)
 			cdr.ModemID = &m
@@ -359,6 +404,9 @@ func (r *PostgresCdrRepository) GetRecentCDRs(ctx context.Context, limit int) ([
 		if disposition.Valid {
 			cdr.Disposition = &disposition.String
 		}
+		if dispositionCategory.Valid {
+			cdr.DispositionCategory = &dispositionCategory.String
+		}
 		if hangupCause.Valid {
 			cdr.Cause = &hangupCause.String
 		}
@@ -398,6 +446,37 @@ func (r *PostgresCdrRepository) GetCallStats(ctx context.Context) (int, int, int
 	return totalCalls, answeredCalls, missedCalls, nil
 }
 
+// GetDispositionCounts counts the CDRs of calls started since the given time
+// per disposition category. CDRs written before categories existed count as
+// failed.
+func (r *PostgresCdrRepository) GetDispositionCounts(ctx context.Context, since time.Time) (map[string]int, error) {
+	query := `
+		SELECT COALESCE(disposition_category, 'failed'), COUNT(*)
+		FROM call_detail_records
+		WHERE call_start_time >= $1
+		GROUP BY 1`
+
+	rows, err := r.db.Query(ctx, query, since)
+	if err != nil {
+		return nil, fmt.Errorf("PostgresCdrRepository.GetDispositionCounts: failed to query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var category string
+		var count int
+		if err := rows.Scan(&category, &count); err != nil {
+			return nil, fmt.Errorf("PostgresCdrRepository.GetDispositionCounts: failed to scan: %w", err)
+		}
+		counts[category] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("PostgresCdrRepository.GetDispositionCounts: row iteration error: %w", err)
+	}
+	return counts, nil
+}
+
 // GetSpamStats retrieves spam statistics from the database.
 func (r *PostgresCdrRepository) GetSpamStats(ctx context.Context) (int, int, error) {
 	var totalSpamCalls, blockedNumbers int
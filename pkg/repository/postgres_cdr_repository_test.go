@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+)
+
+// cdrTable is call_detail_records as the migrations leave it, without
+// foreign keys.
+const cdrTable = `
+	CREATE TABLE call_detail_records (
+		id BIGSERIAL PRIMARY KEY,
+		sim_card_id BIGINT,
+		modem_id BIGINT,
+		asterisk_unique_id VARCHAR(128) NOT NULL,
+		call_direction VARCHAR(10),
+		source_number VARCHAR(50),
+		destination_number VARCHAR(50),
+		call_start_time TIMESTAMPTZ,
+		call_answer_time TIMESTAMPTZ,
+		call_end_time TIMESTAMPTZ,
+		duration_seconds INTEGER,
+		billable_duration_seconds INTEGER,
+		disposition VARCHAR(50),
+		hangup_cause VARCHAR(100),
+		cost_per_minute DECIMAL(10, 4),
+		total_cost DECIMAL(10, 4),
+		customer_id BIGINT,
+		is_spam BOOLEAN DEFAULT FALSE,
+		spam_reason VARCHAR(255),
+		recorded_audio_path VARCHAR(255),
+		post_dial_delay_ms INTEGER,
+		gateway_id UUID,
+		disposition_category VARCHAR(30),
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+	)`
+
+func TestCreateCdrIsIdempotentPerGateway(t *testing.T) {
+	migration, err := os.ReadFile("../../migrations/013_add_cdr_unique_id_key.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := testDB(t, cdrTable, string(migration))
+	ctx := context.Background()
+	repo := NewPostgresCdrRepository(db)
+
+	gw1 := "6f1c1b2e-3d4a-4b5c-8d9e-0a1b2c3d4e5f"
+	gw2 := "7a2d2c3f-4e5b-4c6d-9e0f-1b2c3d4e5f60"
+	tests := []struct {
+		name    string
+		gateway *string
+		dup     bool
+	}{
+		{"first", &gw1, false},
+		{"replayed", &gw1, true},
+		{"same UniqueID on another gateway", &gw2, false},
+		{"without a gateway", nil, false},
+		{"replayed without a gateway", nil, true},
+	}
+	for _, tt := range tests {
+		err := repo.CreateCdr(ctx, &models.Cdr{UniqueID: "1710513000.42", GatewayID: tt.gateway})
+		if tt.dup && !errors.Is(err, ErrDuplicate) {
+			t.Errorf("%s: got %v, want ErrDuplicate", tt.name, err)
+		}
+		if !tt.dup && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	var n int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM call_detail_records`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("%d CDRs stored, want one per gateway and one without", n)
+	}
+}
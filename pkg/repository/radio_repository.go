@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresRadioRepository implements RadioRepository using a PostgreSQL database.
+type postgresRadioRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewPostgresRadioRepository creates a new instance of postgresRadioRepository.
+func NewPostgresRadioRepository(db *pgxpool.Pool) RadioRepository {
+	return &postgresRadioRepository{db: db}
+}
+
+// RecordReading stores one radio reading of a modem.
+func (r *postgresRadioRepository) RecordReading(ctx context.Context, reading *models.RadioReading) error {
+	query := `
+		INSERT INTO modem_radio_readings (
+			modem_id, sim_card_id, signal_dbm, registration, registered,
+			operator_name, mode, lac, cell_id, recorded_at
+		) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, $10)
+		RETURNING id`
+
+	err := r.db.QueryRow(ctx, query,
+		reading.ModemID, reading.SIMCardID, reading.SignalDBM, reading.Registration, reading.Registered,
+		reading.OperatorName, reading.Mode, reading.LAC, reading.CellID, reading.RecordedAt,
+	).Scan(&reading.ID)
+	if err != nil {
+		return fmt.Errorf("postgresRadioRepository.RecordReading: %w", err)
+	}
+	return nil
+}
+
+// GetReadings returns the readings of a modem since a point in time.
+func (r *postgresRadioRepository) GetReadings(ctx context.Context, modemID int, since time.Time, limit int) ([]models.RadioReading, error) {
+	query := `
+		SELECT id, modem_id, sim_card_id, signal_dbm, COALESCE(registration, ''), registered,
+		       operator_name, mode, lac, cell_id, recorded_at
+		FROM modem_radio_readings
+		WHERE modem_id = $1 AND recorded_at >= $2
+		ORDER BY recorded_at DESC
+		LIMIT $3`
+
+	rows, err := r.db.Query(ctx, query, modemID, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgresRadioRepository.GetReadings: %w", err)
+	}
+	defer rows.Close()
+
+	readings := []models.RadioReading{}
+	for rows.Next() {
+		var rr models.RadioReading
+		if err := rows.Scan(
+			&rr.ID, &rr.ModemID, &rr.SIMCardID, &rr.SignalDBM, &rr.Registration, &rr.Registered,
+			&rr.OperatorName, &rr.Mode, &rr.LAC, &rr.CellID, &rr.RecordedAt,
+		); err != nil {
+			return nil, fmt.Errorf("postgresRadioRepository.GetReadings: scan: %w", err)
+		}
+		readings = append(readings, rr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresRadioRepository.GetReadings: %w", err)
+	}
+	return readings, nil
+}
+
+// signalSeriesQuery averages the signal readings per modem and time bucket.
+// Buckets are aligned to the epoch, so series of different modems line up.
+const signalSeriesQuery = `
+	SELECT modem_id,
+	       to_timestamp(floor(extract(epoch FROM recorded_at)::float8 / $2::float8) * $2::float8) AS bucket,
+	       AVG(signal_dbm)::float8, MIN(signal_dbm), MAX(signal_dbm), COUNT(*)
+	FROM modem_radio_readings
+	WHERE recorded_at >= $1 AND signal_dbm IS NOT NULL %s
+	GROUP BY modem_id, bucket
+	ORDER BY modem_id, bucket`
+
+// GetSignalSeries returns the signal of a modem since a point in time,
+// summarised per bucket, oldest first.
+func (r *postgresRadioRepository) GetSignalSeries(ctx context.Context, modemID int, since time.Time, bucket time.Duration) ([]models.SignalPoint, error) {
+	trends, err := r.signalSeries(ctx, fmt.Sprintf(signalSeriesQuery, "AND modem_id = $3"), since, bucket, modemID)
+	if err != nil {
+		return nil, fmt.Errorf("postgresRadioRepository.GetSignalSeries: %w", err)
+	}
+	if points, ok := trends[modemID]; ok {
+		return points, nil
+	}
+	return []models.SignalPoint{}, nil
+}
+
+// GetSignalTrends returns the signal series of every modem with readings
+// since a point in time.
+func (r *postgresRadioRepository) GetSignalTrends(ctx context.Context, since time.Time, bucket time.Duration) (map[int][]models.SignalPoint, error) {
+	trends, err := r.signalSeries(ctx, fmt.Sprintf(signalSeriesQuery, ""), since, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("postgresRadioRepository.GetSignalTrends: %w", err)
+	}
+	return trends, nil
+}
+
+func (r *postgresRadioRepository) signalSeries(ctx context.Context, query string, since time.Time, bucket time.Duration, args ...interface{}) (map[int][]models.SignalPoint, error) {
+	seconds := int64(bucket / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	rows, err := r.db.Query(ctx, query, append([]interface{}{since, seconds}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trends := make(map[int][]models.SignalPoint)
+	for rows.Next() {
+		var modemID int
+		var p models.SignalPoint
+		if err := rows.Scan(&modemID, &p.At, &p.AvgDBM, &p.MinDBM, &p.MaxDBM, &p.Samples); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		trends[modemID] = append(trends[modemID], p)
+	}
+	return trends, rows.Err()
+}
+
+// DeleteReadingsBefore removes readings older than a point in time and
+// returns how many were deleted.
+func (r *postgresRadioRepository) DeleteReadingsBefore(ctx context.Context, before time.Time) (int64, error) {
+	commandTag, err := r.db.Exec(ctx, `DELETE FROM modem_radio_readings WHERE recorded_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("postgresRadioRepository.DeleteReadingsBefore: %w", err)
+	}
+	return commandTag.RowsAffected(), nil
+}
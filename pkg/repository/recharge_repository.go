@@ -31,7 +31,21 @@ type RechargeRepository interface {
 	
 	// Bulk operations
 	CreateBulkRechargeCodes(ctx context.Context, codes []*models.RechargeCode) error
-	GetSimCardsForAutoRecharge(ctx context.Context, threshold float64) ([]*models.SIMCard, error)
+	GetSimCardsForAutoRecharge(ctx context.Context, threshold float64) ([]*models.AutoRechargeSIM, error)
+
+	// Recharge engine operations
+	ReserveRechargeCode(ctx context.Context, simCardID int64, operator string, amount float64) (*models.RechargeCode, error)
+	FinishRecharge(ctx context.Context, code *models.RechargeCode, history *models.RechargeHistory) error
+	RedeemRechargeCode(ctx context.Context, code *models.RechargeCode, history *models.RechargeHistory) error
+
+	// Voucher inventory operations
+	ImportRechargeCodes(ctx context.Context, codes []*models.RechargeCode) ([]*models.RechargeCode, error) // returns the codes already in stock
+	ExpireRechargeCodes(ctx context.Context) (int64, error)
+	GetVoucherStock(ctx context.Context) ([]*models.VoucherStock, error)
+	CreateBatchWithItems(ctx context.Context, batch *models.RechargeBatch, simCardIDs []int64) error
+	ListBatchItems(ctx context.Context, batchID int64) ([]*models.RechargeBatchItem, error)
+	UpdateBatchItem(ctx context.Context, item *models.RechargeBatchItem) error
+	SkipBatchItems(ctx context.Context, batchID int64) (int64, error) // skips the items not started yet
 }
 
 type rechargeRepository struct {
@@ -76,10 +90,11 @@ func (r *rechargeRepository) GetRechargeCodeByID(ctx context.Context, id int64)
 	return &code, err
 }
 
-// GetRechargeCodeByCode retrieves a recharge code by code and operator
+// GetRechargeCodeByCode retrieves a recharge code by code and operator,
+// whatever the operator's case
 func (r *rechargeRepository) GetRechargeCodeByCode(ctx context.Context, code, operator string) (*models.RechargeCode, error) {
 	var rechargeCode models.RechargeCode
-	query := `SELECT * FROM recharge_codes WHERE code = $1 AND operator = $2`
+	query := `SELECT * FROM recharge_codes WHERE code = $1 AND LOWER(operator) = LOWER($2)`
 	
 	err := r.db.GetContext(ctx, &rechargeCode, query, code, operator)
 	if err == sql.ErrNoRows {
@@ -93,7 +108,7 @@ func (r *rechargeRepository) GetRechargeCodeByCode(ctx context.Context, code, op
 func (r *rechargeRepository) UpdateRechargeCode(ctx context.Context, code *models.RechargeCode) error {
 	query := `
 		UPDATE recharge_codes 
-		SET status = $2, used_at = $3, response_message = $4
+		SET status = $2, used_at = $3, response_message = $4, attempts = $5, sim_card_id = $6
 		WHERE id = $1`
 		
 	_, err := r.db.ExecContext(ctx, query,
@@ -101,6 +116,8 @@ func (r *rechargeRepository) UpdateRechargeCode(ctx context.Context, code *model
 		code.Status,
 		code.UsedAt,
 		code.ResponseMessage,
+		code.Attempts,
+		code.SimCardID,
 	)
 	
 	return err
@@ -134,13 +151,14 @@ func (r *rechargeRepository) ListRechargeCodes(ctx context.Context, simCardID in
 // CreateBatch creates a new recharge batch
 func (r *rechargeRepository) CreateBatch(ctx context.Context, batch *models.RechargeBatch) error {
 	query := `
-		INSERT INTO recharge_batches (name, description, total_codes, total_amount, status, created_by)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO recharge_batches (name, description, amount, total_codes, total_amount, status, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id, created_at, updated_at`
 		
 	err := r.db.QueryRowContext(ctx, query,
 		batch.Name,
 		batch.Description,
+		batch.Amount,
 		batch.TotalCodes,
 		batch.TotalAmount,
 		batch.Status,
@@ -167,7 +185,8 @@ func (r *rechargeRepository) GetBatchByID(ctx context.Context, id int64) (*model
 func (r *rechargeRepository) UpdateBatch(ctx context.Context, batch *models.RechargeBatch) error {
 	query := `
 		UPDATE recharge_batches 
-		SET status = $2, used_codes = $3, started_at = $4, completed_at = $5
+		SET status = $2, used_codes = $3, started_at = $4, completed_at = $5,
+		    failed_codes = $6, total_amount = $7
 		WHERE id = $1`
 		
 	_, err := r.db.ExecContext(ctx, query,
@@ -176,6 +195,8 @@ func (r *rechargeRepository) UpdateBatch(ctx context.Context, batch *models.Rech
 		batch.UsedCodes,
 		batch.StartedAt,
 		batch.CompletedAt,
+		batch.FailedCodes,
+		batch.TotalAmount,
 	)
 	
 	return err
@@ -204,9 +225,9 @@ func (r *rechargeRepository) CreateRechargeHistory(ctx context.Context, history
 		INSERT INTO recharge_history (
 			sim_card_id, recharge_code_id, batch_id, phone_number, 
 			amount, balance_before, balance_after, method, status, 
-			error_message, attempts, processed_by
+			error_message, attempts, scenario, response, processed_by
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 		RETURNING id, processed_at`
 		
 	err := r.db.QueryRowContext(ctx, query,
@@ -221,6 +242,8 @@ func (r *rechargeRepository) CreateRechargeHistory(ctx context.Context, history
 		history.Status,
 		history.ErrorMessage,
 		history.Attempts,
+		history.Scenario,
+		history.Response,
 		history.ProcessedBy,
 	).Scan(&history.ID, &history.ProcessedAt)
 	
@@ -276,17 +299,361 @@ func (r *rechargeRepository) CreateBulkRechargeCodes(ctx context.Context, codes
 	return tx.Commit()
 }
 
-// GetSimCardsForAutoRecharge retrieves SIM cards that need auto-recharge
-func (r *rechargeRepository) GetSimCardsForAutoRecharge(ctx context.Context, threshold float64) ([]*models.SIMCard, error) {
-	var sims []*models.SIMCard
+// GetSimCardsForAutoRecharge retrieves SIM cards that need auto-recharge.
+// threshold applies to SIM cards without a threshold of their own.
+func (r *rechargeRepository) GetSimCardsForAutoRecharge(ctx context.Context, threshold float64) ([]*models.AutoRechargeSIM, error) {
+	var sims []*models.AutoRechargeSIM
 	query := `
-		SELECT * FROM sim_cards 
+		SELECT id, balance,
+		       COALESCE(auto_recharge_threshold, $2) AS threshold,
+		       COALESCE(auto_recharge_amount, 0) AS amount
+		FROM sim_cards 
 		WHERE auto_recharge_enabled = true 
 		AND status = $1 
-		AND balance < auto_recharge_threshold
+		AND modem_id IS NOT NULL
+		AND balance IS NOT NULL
+		AND balance < COALESCE(auto_recharge_threshold, $2)
 		AND (last_recharge_at IS NULL OR last_recharge_at < NOW() - INTERVAL '1 hour')
 		ORDER BY balance ASC`
 	
-	err := r.db.SelectContext(ctx, &sims, query, "active")
+	err := r.db.SelectContext(ctx, &sims, query, models.SIMStatusActive, threshold)
 	return sims, err
-}
\ No newline at end of file
+}
+
+// ReserveRechargeCode binds an unused code of the operator to a SIM card. A
+// code the SIM already holds is handed back first, so an interrupted
+// recharge resumes with it. amount 0 takes a code of any amount, smallest
+// first; codes closest to expiry go first. Expired codes are never handed
+// out, not even to the SIM holding them. Concurrent reservations skip
+// each other's rows instead of waiting.
+func (r *rechargeRepository) ReserveRechargeCode(ctx context.Context, simCardID int64, operator string, amount float64) (*models.RechargeCode, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var code models.RechargeCode
+	query := `
+		SELECT * FROM recharge_codes
+		WHERE LOWER(operator) = LOWER($2)
+		AND ($3::numeric = 0 OR amount = $3::numeric)
+		AND (
+			(status = $4 AND sim_card_id = $1)
+			OR (status = $5 AND (sim_card_id IS NULL OR sim_card_id = $1))
+		)
+		AND (expiry_date IS NULL OR expiry_date > NOW())
+		ORDER BY status = $4 DESC, amount ASC, expiry_date ASC NULLS LAST, id ASC
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`
+	err = tx.GetContext(ctx, &code, query, simCardID, operator, amount, models.RechargeStatusReserved, models.RechargeStatusAvailable)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE recharge_codes
+		SET status = $2, sim_card_id = $3, reserved_at = COALESCE(reserved_at, NOW())
+		WHERE id = $1
+		RETURNING status, sim_card_id, reserved_at, updated_at`,
+		code.ID, models.RechargeStatusReserved, simCardID,
+	).Scan(&code.Status, &code.SimCardID, &code.ReservedAt, &code.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+// FinishRecharge stores the outcome of a recharge: the code's new status,
+// the history record and the SIM card's last recharge. A failed recharge
+// also counts as the last one, so a SIM the operator keeps refusing is not
+// retried every round.
+func (r *rechargeRepository) FinishRecharge(ctx context.Context, code *models.RechargeCode, history *models.RechargeHistory) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if code != nil {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE recharge_codes 
+			SET status = $2, used_at = $3, response_message = $4, attempts = $5
+			WHERE id = $1`,
+			code.ID, code.Status, code.UsedAt, code.ResponseMessage, code.Attempts)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO recharge_history (
+			sim_card_id, recharge_code_id, batch_id, phone_number, 
+			amount, balance_before, balance_after, method, status, 
+			error_message, attempts, scenario, response, processed_by
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id, processed_at`,
+		history.SimCardID, history.RechargeCodeID, history.BatchID, history.PhoneNumber,
+		history.Amount, history.BalanceBefore, history.BalanceAfter, history.Method, history.Status,
+		history.ErrorMessage, history.Attempts, history.Scenario, history.Response, history.ProcessedBy,
+	).Scan(&history.ID, &history.ProcessedAt)
+	if err != nil {
+		return err
+	}
+
+	recharged := 0.0
+	if history.Status == models.RechargeResultSuccess {
+		recharged = history.Amount
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sim_cards
+		SET last_recharge_at = NOW(), total_recharged = COALESCE(total_recharged, 0) + $2
+		WHERE id = $1`,
+		history.SimCardID, recharged)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RedeemRechargeCode records a recharge made by hand: it marks code used by
+// the history's SIM card, adds the history's amount to the card's balance
+// and stores the history, setting its balance before and after, in one
+// transaction. code may be nil for a credit without a voucher. A code that
+// is neither available nor reserved to the card fails with
+// ErrCodeUnavailable and changes nothing.
+func (r *rechargeRepository) RedeemRechargeCode(ctx context.Context, code *models.RechargeCode, history *models.RechargeHistory) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if code != nil {
+		// Claimed before the balance moves, so the engine or a batch
+		// cannot take the code meanwhile.
+		var usedAt sql.NullTime
+		err = tx.QueryRowContext(ctx, `
+			UPDATE recharge_codes
+			SET status = $2, sim_card_id = $3, used_at = NOW()
+			WHERE id = $1
+			AND (status = $4 OR (status = $5 AND sim_card_id = $3))
+			AND (expiry_date IS NULL OR expiry_date > NOW())
+			RETURNING amount, used_at`,
+			code.ID, models.RechargeStatusUsed, history.SimCardID, models.RechargeStatusAvailable, models.RechargeStatusReserved,
+		).Scan(&history.Amount, &usedAt)
+		if err == sql.ErrNoRows {
+			return ErrCodeUnavailable
+		}
+		if err != nil {
+			return err
+		}
+		code.Status = models.RechargeStatusUsed
+		code.SimCardID = &history.SimCardID
+		code.UsedAt = &usedAt.Time
+		code.Amount = history.Amount
+		history.RechargeCodeID = &code.ID
+	}
+
+	var before, after float64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE sim_cards
+		SET balance = COALESCE(balance, 0) + $2, last_recharge_at = NOW(),
+			total_recharged = COALESCE(total_recharged, 0) + $2
+		WHERE id = $1
+		RETURNING balance - $2, balance`,
+		history.SimCardID, history.Amount,
+	).Scan(&before, &after)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	history.BalanceBefore = sql.NullFloat64{Float64: before, Valid: true}
+	history.BalanceAfter = sql.NullFloat64{Float64: after, Valid: true}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO recharge_history (
+			sim_card_id, recharge_code_id, batch_id, phone_number, 
+			amount, balance_before, balance_after, method, status, 
+			error_message, attempts, scenario, response, processed_by
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id, processed_at`,
+		history.SimCardID, history.RechargeCodeID, history.BatchID, history.PhoneNumber,
+		history.Amount, history.BalanceBefore, history.BalanceAfter, history.Method, history.Status,
+		history.ErrorMessage, history.Attempts, history.Scenario, history.Response, history.ProcessedBy,
+	).Scan(&history.ID, &history.ProcessedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ImportRechargeCodes adds codes to the stock in one transaction. A code
+// the operator already has in the stock, in any case, is left out and
+// returned.
+func (r *rechargeRepository) ImportRechargeCodes(ctx context.Context, codes []*models.RechargeCode) ([]*models.RechargeCode, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO recharge_codes (sim_card_id, code, amount, operator, status, expiry_date, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT DO NOTHING
+		RETURNING id, created_at, updated_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var duplicates []*models.RechargeCode
+	for _, code := range codes {
+		err = stmt.QueryRowContext(ctx,
+			code.SimCardID,
+			code.Code,
+			code.Amount,
+			code.Operator,
+			code.Status,
+			code.ExpiryDate,
+			code.CreatedBy,
+		).Scan(&code.ID, &code.CreatedAt, &code.UpdatedAt)
+		if err == sql.ErrNoRows {
+			duplicates = append(duplicates, code)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return duplicates, tx.Commit()
+}
+
+// ExpireRechargeCodes marks expired the codes past their expiry date that
+// were never entered: available ones, and reserved ones still waiting for
+// their first attempt.
+func (r *rechargeRepository) ExpireRechargeCodes(ctx context.Context) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE recharge_codes
+		SET status = $1
+		WHERE (status = $2 OR (status = $3 AND attempts = 0))
+		AND expiry_date IS NOT NULL AND expiry_date <= NOW()`,
+		models.RechargeStatusExpired, models.RechargeStatusAvailable, models.RechargeStatusReserved)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetVoucherStock counts the codes of each operator by status. Operators
+// are lower-cased.
+func (r *rechargeRepository) GetVoucherStock(ctx context.Context) ([]*models.VoucherStock, error) {
+	var stock []*models.VoucherStock
+	query := `
+		SELECT LOWER(operator) AS operator,
+		       COUNT(*) FILTER (WHERE status = $1) AS available,
+		       COALESCE(SUM(amount) FILTER (WHERE status = $1), 0) AS available_amount,
+		       COUNT(*) FILTER (WHERE status = $1 AND expiry_date < NOW() + INTERVAL '7 days') AS expiring_soon,
+		       COUNT(*) FILTER (WHERE status = $2) AS reserved,
+		       COUNT(*) FILTER (WHERE status = $3) AS used,
+		       COUNT(*) FILTER (WHERE status = $4) AS failed,
+		       COUNT(*) FILTER (WHERE status = $5) AS expired
+		FROM recharge_codes
+		GROUP BY LOWER(operator)
+		ORDER BY LOWER(operator)`
+
+	err := r.db.SelectContext(ctx, &stock, query,
+		models.RechargeStatusAvailable,
+		models.RechargeStatusReserved,
+		models.RechargeStatusUsed,
+		models.RechargeStatusFailed,
+		models.RechargeStatusExpired,
+	)
+	return stock, err
+}
+
+// CreateBatchWithItems creates a batch with a pending item for each SIM
+// card.
+func (r *rechargeRepository) CreateBatchWithItems(ctx context.Context, batch *models.RechargeBatch, simCardIDs []int64) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO recharge_batches (name, description, amount, total_codes, total_amount, status, created_by, started_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, updated_at`,
+		batch.Name, batch.Description, batch.Amount, batch.TotalCodes, batch.TotalAmount,
+		batch.Status, batch.CreatedBy, batch.StartedAt,
+	).Scan(&batch.ID, &batch.CreatedAt, &batch.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO recharge_batch_items (batch_id, sim_card_id, status)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, id := range simCardIDs {
+		if _, err := stmt.ExecContext(ctx, batch.ID, id, models.BatchItemPending); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListBatchItems lists the items of a batch in the order they run
+func (r *rechargeRepository) ListBatchItems(ctx context.Context, batchID int64) ([]*models.RechargeBatchItem, error) {
+	var items []*models.RechargeBatchItem
+	query := `SELECT * FROM recharge_batch_items WHERE batch_id = $1 ORDER BY id`
+
+	err := r.db.SelectContext(ctx, &items, query, batchID)
+	return items, err
+}
+
+// UpdateBatchItem updates the status of a batch item
+func (r *rechargeRepository) UpdateBatchItem(ctx context.Context, item *models.RechargeBatchItem) error {
+	query := `
+		UPDATE recharge_batch_items
+		SET status = $2, recharge_history_id = $3, error_message = $4, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at`
+
+	return r.db.QueryRowContext(ctx, query,
+		item.ID,
+		item.Status,
+		item.RechargeHistoryID,
+		item.ErrorMessage,
+	).Scan(&item.UpdatedAt)
+}
+
+// SkipBatchItems marks skipped the items of a batch that have not started
+func (r *rechargeRepository) SkipBatchItems(ctx context.Context, batchID int64) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE recharge_batch_items
+		SET status = $2, updated_at = NOW()
+		WHERE batch_id = $1 AND status = $3`,
+		batchID, models.BatchItemSkipped, models.BatchItemPending)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
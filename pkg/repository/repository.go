@@ -2,7 +2,10 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/e173-gateway/e173_go_gateway/pkg/models" // Ensuring this import is correct for models.Cdr, models.Modem, models.SIMCard
 	"github.com/google/uuid"
@@ -11,11 +14,23 @@ import (
 // ErrNotFound is returned when a requested record is not found.
 var ErrNotFound = errors.New("repository: record not found")
 
+// ErrDuplicate is returned when a record with the same natural key already exists.
+var ErrDuplicate = errors.New("repository: duplicate record")
+
+// ErrNoSecretKey is returned when SIM PIN or PUK codes would be stored
+// without a key to encrypt them with.
+var ErrNoSecretKey = errors.New("repository: no SIM secret key to encrypt PIN codes with")
+
+// ErrCodeUnavailable is returned when a recharge code is used, expired or
+// held by another SIM card.
+var ErrCodeUnavailable = errors.New("repository: recharge code is not available")
+
 // CdrRepository defines the interface for interacting with CDR data.
 type CdrRepository interface {
-	CreateCdr(ctx context.Context, cdr *models.Cdr) error // Ensure models.Cdr is resolvable
+	CreateCdr(ctx context.Context, cdr *models.Cdr) error // Returns ErrDuplicate if a CDR with the same UniqueID exists
 	GetCdrByID(ctx context.Context, id uuid.UUID) (*models.Cdr, error) // Ensure models.Cdr is resolvable
 	GetRecentCDRs(ctx context.Context, limit int) ([]*models.Cdr, error) // Get recent CDRs for dashboard
+	GetDispositionCounts(ctx context.Context, since time.Time) (map[string]int, error) // CDRs per disposition category
 	// Potentially: GetCdrByAsteriskUniqueID(ctx context.Context, asteriskUniqueID string) (*models.Cdr, error)
 	// ListCdrs(ctx context.Context, // filters, pagination) ([]*models.Cdr, error)
 }
@@ -27,6 +42,8 @@ type GatewayRepository interface {
 	ListGateways(ctx context.Context) ([]*models.Gateway, error)
 	UpdateGateway(ctx context.Context, gateway *models.Gateway) error
 	UpdateGatewayHeartbeat(ctx context.Context, id string) error
+	UpdateGatewayStatus(ctx context.Context, id, status string, lastError *string) error
+	UpdateGatewaySIPHealth(ctx context.Context, id, health string, latencyMs *int, uptimePercent float64, checkedAt time.Time) error
 	DeleteGateway(ctx context.Context, id string) error
 	GetGatewayStats(ctx context.Context) (total, online, offline int, err error)
 }
@@ -36,6 +53,16 @@ type ModemRepository interface {
 	CreateModem(ctx context.Context, modem *models.Modem) (int, error)
 	GetAllModems(ctx context.Context) ([]models.Modem, error)
 	GetModemByID(ctx context.Context, id int) (*models.Modem, error) // Kept, will be implemented
+	GetModemByDongleName(ctx context.Context, gatewayID *string, dongleName string) (*models.Modem, error)
+	GetModemByIMEI(ctx context.Context, imei string) (*models.Modem, error)
+	UpsertModemByIMEI(ctx context.Context, modem *models.Modem) error
+	UpdateModemStatus(ctx context.Context, id int, status string, lastSeenAt time.Time) error
+	RecordModemMove(ctx context.Context, move *models.ModemDeviceMove) error
+	GetModemMoves(ctx context.Context, modemID int, limit int) ([]models.ModemDeviceMove, error) // newest first
+	UpdateModemRadio(ctx context.Context, id int, signalDBM *int, registration, operatorName *string, seenAt time.Time) error
+	UpdateModemHealth(ctx context.Context, id int, state string, changedAt time.Time) error
+	RecordHealthTransition(ctx context.Context, transition *models.ModemHealthTransition) error
+	GetHealthTransitions(ctx context.Context, modemID int, limit int) ([]models.ModemHealthTransition, error) // newest first
 	// UpdateModem(ctx context.Context, modem *models.Modem) error
 	// DeleteModem(ctx context.Context, id int) error
 }
@@ -45,10 +72,66 @@ type SIMCardRepository interface {
 	CreateSIMCard(ctx context.Context, sim *models.SIMCard) (int64, error)
 	GetSIMCardByID(ctx context.Context, id int64) (*models.SIMCard, error) // Changed id to int64
 	GetSIMCardByICCID(ctx context.Context, iccid string) (*models.SIMCard, error)
+	GetSIMCardByIMSI(ctx context.Context, imsi string) (*models.SIMCard, error)
+	GetSIMCardByModemID(ctx context.Context, modemID int64) (*models.SIMCard, error) // SIM currently in the modem
+	UpsertSIMCardFromModem(ctx context.Context, sim *models.SIMCard) error
 	GetAllSIMCards(ctx context.Context) ([]models.SIMCard, error)
 	UpdateSIMCard(ctx context.Context, sim *models.SIMCard) error
 	DeleteSIMCard(ctx context.Context, id int64) error
+	GetSIMCardPINs(ctx context.Context, id int64) (*models.SIMCard, error) // decrypted codes; only for unlocking
+	UpdateSIMCardPIN1(ctx context.Context, id int64, pin string) error
+	UpdateSIMCardStatus(ctx context.Context, id int64, status string) error
+	UpdateSIMCardCell(ctx context.Context, id int64, lac, cellID sql.NullString, btsHistory json.RawMessage) error
+	EncryptStoredPINs(ctx context.Context) (int, error) // encrypts codes stored before a key was configured
+	RecordPINAttempt(ctx context.Context, attempt *models.SIMPINAttempt) error
+	GetPINAttempts(ctx context.Context, simCardID int64, limit int) ([]models.SIMPINAttempt, error) // newest first
+	RecordBalance(ctx context.Context, reading *models.SIMBalanceReading) error // also sets the card's balance
+	GetBalanceHistory(ctx context.Context, simCardID int64, limit int) ([]models.SIMBalanceReading, error) // newest first
 	// Potentially more specific methods like:
 	// GetSIMCardsByStatus(ctx context.Context, status string) ([]models.SIMCard, error)
 	// GetSIMCardsByModemID(ctx context.Context, modemID int64) ([]models.SIMCard, error)
 }
+
+// AlertRepository stores alerts raised for operators.
+type AlertRepository interface {
+	RaiseAlert(ctx context.Context, alert *models.Alert) error // refreshes the open alert of the same kind and entity, if any
+	ResolveAlerts(ctx context.Context, kind, entityType, entityID string) error
+	ResolveAlertByID(ctx context.Context, id int64) error
+	ListAlerts(ctx context.Context, openOnly bool, limit int) ([]models.Alert, error)
+}
+
+// RadioRepository stores the signal and serving-cell readings of modems.
+type RadioRepository interface {
+	RecordReading(ctx context.Context, reading *models.RadioReading) error
+	GetReadings(ctx context.Context, modemID int, since time.Time, limit int) ([]models.RadioReading, error) // newest first
+	GetSignalSeries(ctx context.Context, modemID int, since time.Time, bucket time.Duration) ([]models.SignalPoint, error)
+	GetSignalTrends(ctx context.Context, since time.Time, bucket time.Duration) (map[int][]models.SignalPoint, error) // by modem ID
+	DeleteReadingsBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+// SMSRepository stores text messages and the parts of long inbound ones.
+type SMSRepository interface {
+	CreateMessage(ctx context.Context, msg *models.SMSMessage) error
+	GetMessageByID(ctx context.Context, id int64) (*models.SMSMessage, error)
+	ListMessages(ctx context.Context, filter models.SMSFilter) ([]models.SMSMessage, int, error) // newest first, with the total count
+	UpdateMessageStatus(ctx context.Context, id int64, status, errMsg string, at time.Time) error
+	SetMessageTask(ctx context.Context, id int64, taskID string, reference *int) error
+	FindByTask(ctx context.Context, modemID int, taskID string) (*models.SMSMessage, error)
+	FindAwaitingReport(ctx context.Context, modemID int, number string, reference *int) (*models.SMSMessage, error)
+	ListSenders(ctx context.Context, operator string) ([]models.SMSSender, error) // best first
+	AddPart(ctx context.Context, part *models.SMSPart) error
+	TakeParts(ctx context.Context, modemID int, sender string, concatRef, total int) ([]models.SMSPart, error) // nil until complete
+	TakeStaleParts(ctx context.Context, before time.Time) ([]models.SMSPart, error)
+}
+
+// USSDRepository stores USSD sessions and the requests and responses
+// exchanged in them.
+type USSDRepository interface {
+	CreateSession(ctx context.Context, session *models.USSDSession) error
+	GetSession(ctx context.Context, id int64) (*models.USSDSession, error)
+	UpdateSession(ctx context.Context, id int64, status string, at time.Time) error
+	ExpireOpenSessions(ctx context.Context, before time.Time) (int64, error)
+	CreateExchange(ctx context.Context, exchange *models.USSDExchange) error
+	CompleteExchange(ctx context.Context, exchange *models.USSDExchange) error
+	ListExchanges(ctx context.Context, simCardID int64, limit int) ([]models.USSDExchange, error) // newest first
+}
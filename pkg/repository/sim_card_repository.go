@@ -2,9 +2,13 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	// "errors" // ErrNotFound is now in repository.go
 	"github.com/e173-gateway/e173_go_gateway/pkg/models"
 	"github.com/e173-gateway/e173_go_gateway/pkg/logging"
+	"github.com/e173-gateway/e173_go_gateway/pkg/secrets"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -12,12 +16,53 @@ import (
 
 // postgresSIMCardRepository is the PostgreSQL implementation of SIMCardRepository.
 type postgresSIMCardRepository struct {
-	db *pgxpool.Pool
+	db  *pgxpool.Pool
+	box *secrets.Box // encrypts PIN and PUK codes; nil refuses to store them
 }
 
 // NewPostgresSIMCardRepository creates a new instance of postgresSIMCardRepository.
-func NewPostgresSIMCardRepository(db *pgxpool.Pool) SIMCardRepository {
-	return &postgresSIMCardRepository{db: db}
+// PIN and PUK codes are encrypted with box before they are written; with a nil
+// box, writing a card with codes fails with ErrNoSecretKey.
+func NewPostgresSIMCardRepository(db *pgxpool.Pool, box *secrets.Box) SIMCardRepository {
+	return &postgresSIMCardRepository{db: db, box: box}
+}
+
+// sealPINs returns the PIN1, PUK1, PIN2 and PUK2 of sim as they are stored.
+// Codes are never stored in plain text.
+func (r *postgresSIMCardRepository) sealPINs(sim *models.SIMCard) ([4]sql.NullString, error) {
+	codes := [4]sql.NullString{sim.PIN1, sim.PUK1, sim.PIN2, sim.PUK2}
+	for i, code := range codes {
+		if !code.Valid || code.String == "" || secrets.IsSealed(code.String) {
+			continue
+		}
+		if r.box == nil {
+			return codes, ErrNoSecretKey
+		}
+		sealed, err := r.box.Seal(code.String)
+		if err != nil {
+			return codes, err
+		}
+		codes[i].String = sealed
+	}
+	return codes, nil
+}
+
+// openPINs decrypts the PIN and PUK codes of a card read from the database.
+func (r *postgresSIMCardRepository) openPINs(sim *models.SIMCard) error {
+	for _, code := range []*sql.NullString{&sim.PIN1, &sim.PUK1, &sim.PIN2, &sim.PUK2} {
+		if !code.Valid || !secrets.IsSealed(code.String) {
+			continue
+		}
+		if r.box == nil {
+			return fmt.Errorf("SIM card %d has encrypted PIN codes but no SIM secret key is configured", sim.ID)
+		}
+		plain, err := r.box.Open(code.String)
+		if err != nil {
+			return fmt.Errorf("SIM card %d: %w", sim.ID, err)
+		}
+		code.String = plain
+	}
+	return nil
 }
 
 func (r *postgresSIMCardRepository) CreateSIMCard(ctx context.Context, sim *models.SIMCard) (int64, error) {
@@ -36,12 +81,18 @@ func (r *postgresSIMCardRepository) CreateSIMCard(ctx context.Context, sim *mode
 			$17, $18, $19, $20, $21, $22, $23, $24, $25, $26
 		) RETURNING id`
 
+	pins, err := r.sealPINs(sim)
+	if err != nil {
+		logger.WithError(err).Error("Error encrypting SIM card PIN codes")
+		return 0, err
+	}
+
 	var id int64
-	err := r.db.QueryRow(ctx, query,
+	err = r.db.QueryRow(ctx, query,
 		sim.ModemID, sim.ICCID, sim.IMSI, sim.MSISDN, sim.OperatorName, sim.NetworkCountryCode,
 		sim.Balance, sim.BalanceCurrency, sim.BalanceLastCheckedAt,
 		sim.DataAllowanceMB, sim.DataUsedMB, sim.Status,
-		sim.PIN1, sim.PUK1, sim.PIN2, sim.PUK2,
+		pins[0], pins[1], pins[2], pins[3],
 		sim.ActivationDate, sim.ExpiryDate, sim.RechargeHistory, sim.Notes,
 		sim.CellID, sim.LAC, sim.PSC, sim.RSCP, sim.ECIO, sim.BTSInfoHistory,
 	).Scan(&id)
@@ -61,7 +112,6 @@ func (r *postgresSIMCardRepository) GetSIMCardByID(ctx context.Context, id int64
 			id, modem_id, iccid, imsi, msisdn, operator_name, network_country_code,
 			balance, balance_currency, balance_last_checked_at,
 			data_allowance_mb, data_used_mb, status,
-			pin1, puk1, pin2, puk2,
 			activation_date, expiry_date, recharge_history, notes,
 			cell_id, lac, psc, rscp, ecio, bts_info_history,
 			created_at, updated_at
@@ -73,7 +123,6 @@ func (r *postgresSIMCardRepository) GetSIMCardByID(ctx context.Context, id int64
 		&sim.ID, &sim.ModemID, &sim.ICCID, &sim.IMSI, &sim.MSISDN, &sim.OperatorName, &sim.NetworkCountryCode,
 		&sim.Balance, &sim.BalanceCurrency, &sim.BalanceLastCheckedAt,
 		&sim.DataAllowanceMB, &sim.DataUsedMB, &sim.Status,
-		&sim.PIN1, &sim.PUK1, &sim.PIN2, &sim.PUK2,
 		&sim.ActivationDate, &sim.ExpiryDate, &sim.RechargeHistory, &sim.Notes,
 		&sim.CellID, &sim.LAC, &sim.PSC, &sim.RSCP, &sim.ECIO, &sim.BTSInfoHistory,
 		&sim.CreatedAt, &sim.UpdatedAt,
@@ -98,7 +147,6 @@ func (r *postgresSIMCardRepository) GetSIMCardByICCID(ctx context.Context, iccid
 			id, modem_id, iccid, imsi, msisdn, operator_name, network_country_code,
 			balance, balance_currency, balance_last_checked_at,
 			data_allowance_mb, data_used_mb, status,
-			pin1, puk1, pin2, puk2,
 			activation_date, expiry_date, recharge_history, notes,
 			cell_id, lac, psc, rscp, ecio, bts_info_history,
 			created_at, updated_at
@@ -110,7 +158,6 @@ func (r *postgresSIMCardRepository) GetSIMCardByICCID(ctx context.Context, iccid
 		&sim.ID, &sim.ModemID, &sim.ICCID, &sim.IMSI, &sim.MSISDN, &sim.OperatorName, &sim.NetworkCountryCode,
 		&sim.Balance, &sim.BalanceCurrency, &sim.BalanceLastCheckedAt,
 		&sim.DataAllowanceMB, &sim.DataUsedMB, &sim.Status,
-		&sim.PIN1, &sim.PUK1, &sim.PIN2, &sim.PUK2,
 		&sim.ActivationDate, &sim.ExpiryDate, &sim.RechargeHistory, &sim.Notes,
 		&sim.CellID, &sim.LAC, &sim.PSC, &sim.RSCP, &sim.ECIO, &sim.BTSInfoHistory,
 		&sim.CreatedAt, &sim.UpdatedAt,
@@ -135,7 +182,6 @@ func (r *postgresSIMCardRepository) GetAllSIMCards(ctx context.Context) ([]model
 			id, modem_id, iccid, imsi, msisdn, operator_name, network_country_code,
 			balance, balance_currency, balance_last_checked_at,
 			data_allowance_mb, data_used_mb, status,
-			pin1, puk1, pin2, puk2,
 			activation_date, expiry_date, recharge_history, notes,
 			cell_id, lac, psc, rscp, ecio, bts_info_history,
 			created_at, updated_at
@@ -156,7 +202,6 @@ func (r *postgresSIMCardRepository) GetAllSIMCards(ctx context.Context) ([]model
 			&sim.ID, &sim.ModemID, &sim.ICCID, &sim.IMSI, &sim.MSISDN, &sim.OperatorName, &sim.NetworkCountryCode,
 			&sim.Balance, &sim.BalanceCurrency, &sim.BalanceLastCheckedAt,
 			&sim.DataAllowanceMB, &sim.DataUsedMB, &sim.Status,
-			&sim.PIN1, &sim.PUK1, &sim.PIN2, &sim.PUK2,
 			&sim.ActivationDate, &sim.ExpiryDate, &sim.RechargeHistory, &sim.Notes,
 			&sim.CellID, &sim.LAC, &sim.PSC, &sim.RSCP, &sim.ECIO, &sim.BTSInfoHistory,
 			&sim.CreatedAt, &sim.UpdatedAt,
@@ -178,6 +223,8 @@ func (r *postgresSIMCardRepository) GetAllSIMCards(ctx context.Context) ([]model
 	return sims, nil
 }
 
+// UpdateSIMCard writes a card. PIN and PUK codes that are not set are kept
+// as stored.
 func (r *postgresSIMCardRepository) UpdateSIMCard(ctx context.Context, sim *models.SIMCard) error {
 	logger := logging.Logger.WithContext(ctx).WithField("sim_id", sim.ID)
 	query := `
@@ -194,10 +241,10 @@ func (r *postgresSIMCardRepository) UpdateSIMCard(ctx context.Context, sim *mode
 			data_allowance_mb = $10,
 			data_used_mb = $11,
 			status = $12,
-			pin1 = $13,
-			puk1 = $14,
-			pin2 = $15,
-			puk2 = $16,
+			pin1 = COALESCE($13, pin1),
+			puk1 = COALESCE($14, puk1),
+			pin2 = COALESCE($15, pin2),
+			puk2 = COALESCE($16, puk2),
 			activation_date = $17,
 			expiry_date = $18,
 			recharge_history = $19,
@@ -211,11 +258,17 @@ func (r *postgresSIMCardRepository) UpdateSIMCard(ctx context.Context, sim *mode
 			-- updated_at is handled by a trigger
 		WHERE id = $27`
 
+	pins, err := r.sealPINs(sim)
+	if err != nil {
+		logger.WithError(err).Error("Error encrypting SIM card PIN codes")
+		return err
+	}
+
 	commandTag, err := r.db.Exec(ctx, query,
 		sim.ModemID, sim.ICCID, sim.IMSI, sim.MSISDN, sim.OperatorName, sim.NetworkCountryCode,
 		sim.Balance, sim.BalanceCurrency, sim.BalanceLastCheckedAt,
 		sim.DataAllowanceMB, sim.DataUsedMB, sim.Status,
-		sim.PIN1, sim.PUK1, sim.PIN2, sim.PUK2,
+		pins[0], pins[1], pins[2], pins[3],
 		sim.ActivationDate, sim.ExpiryDate, sim.RechargeHistory, sim.Notes,
 		sim.CellID, sim.LAC, sim.PSC, sim.RSCP, sim.ECIO, sim.BTSInfoHistory,
 		sim.ID, // For the WHERE clause
@@ -253,3 +306,402 @@ func (r *postgresSIMCardRepository) DeleteSIMCard(ctx context.Context, id int64)
 	logger.Info("Successfully deleted SIM card")
 	return nil
 }
+
+func (r *postgresSIMCardRepository) GetSIMCardByIMSI(ctx context.Context, imsi string) (*models.SIMCard, error) {
+	logger := logging.Logger.WithContext(ctx)
+	query := `
+		SELECT
+			id, modem_id, iccid, imsi, msisdn, operator_name, network_country_code,
+			balance, balance_currency, balance_last_checked_at,
+			data_allowance_mb, data_used_mb, status,
+			activation_date, expiry_date, recharge_history, notes,
+			cell_id, lac, psc, rscp, ecio, bts_info_history,
+			created_at, updated_at
+		FROM sim_cards
+		WHERE imsi = $1`
+
+	sim := &models.SIMCard{}
+	err := r.db.QueryRow(ctx, query, imsi).Scan(
+		&sim.ID, &sim.ModemID, &sim.ICCID, &sim.IMSI, &sim.MSISDN, &sim.OperatorName, &sim.NetworkCountryCode,
+		&sim.Balance, &sim.BalanceCurrency, &sim.BalanceLastCheckedAt,
+		&sim.DataAllowanceMB, &sim.DataUsedMB, &sim.Status,
+		&sim.ActivationDate, &sim.ExpiryDate, &sim.RechargeHistory, &sim.Notes,
+		&sim.CellID, &sim.LAC, &sim.PSC, &sim.RSCP, &sim.ECIO, &sim.BTSInfoHistory,
+		&sim.CreatedAt, &sim.UpdatedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		logger.WithError(err).WithField("imsi", imsi).Error("Error getting SIM card by IMSI from database")
+		return nil, err
+	}
+	return sim, nil
+}
+
+// GetSIMCardByModemID retrieves the SIM card currently inserted in a modem.
+// When several cards still point at the modem the most recently updated wins.
+func (r *postgresSIMCardRepository) GetSIMCardByModemID(ctx context.Context, modemID int64) (*models.SIMCard, error) {
+	logger := logging.Logger.WithContext(ctx)
+	query := `
+		SELECT
+			id, modem_id, iccid, imsi, msisdn, operator_name, network_country_code,
+			balance, balance_currency, balance_last_checked_at,
+			data_allowance_mb, data_used_mb, status,
+			activation_date, expiry_date, recharge_history, notes,
+			cell_id, lac, psc, rscp, ecio, bts_info_history,
+			created_at, updated_at
+		FROM sim_cards
+		WHERE modem_id = $1
+		ORDER BY updated_at DESC
+		LIMIT 1`
+
+	sim := &models.SIMCard{}
+	err := r.db.QueryRow(ctx, query, modemID).Scan(
+		&sim.ID, &sim.ModemID, &sim.ICCID, &sim.IMSI, &sim.MSISDN, &sim.OperatorName, &sim.NetworkCountryCode,
+		&sim.Balance, &sim.BalanceCurrency, &sim.BalanceLastCheckedAt,
+		&sim.DataAllowanceMB, &sim.DataUsedMB, &sim.Status,
+		&sim.ActivationDate, &sim.ExpiryDate, &sim.RechargeHistory, &sim.Notes,
+		&sim.CellID, &sim.LAC, &sim.PSC, &sim.RSCP, &sim.ECIO, &sim.BTSInfoHistory,
+		&sim.CreatedAt, &sim.UpdatedAt,
+	)
+
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		logger.WithError(err).WithField("modem_id", modemID).Error("Error getting SIM card by modem ID from database")
+		return nil, err
+	}
+	return sim, nil
+}
+
+// UpsertSIMCardFromModem records what a modem reports about the SIM inserted in
+// it. The card is matched by ICCID, or by IMSI when the modem does not expose
+// the ICCID; only identity and network fields are written, so balances, PINs
+// and notes entered by hand are kept. A card only known by IMSI that is not in
+// the database yet cannot be created and yields ErrNotFound. On success sim.ID
+// and sim.ICCID are set.
+func (r *postgresSIMCardRepository) UpsertSIMCardFromModem(ctx context.Context, sim *models.SIMCard) error {
+	logger := logging.Logger.WithContext(ctx).WithField("iccid", sim.ICCID).WithField("imsi", sim.IMSI.String)
+	if sim.ICCID == "" && !sim.IMSI.Valid {
+		return ErrNotFound
+	}
+	if sim.Status == "" {
+		sim.Status = "active"
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// A phone number or a modem slot belongs to a single card at a time.
+	if sim.MSISDN.Valid {
+		if _, err := tx.Exec(ctx, `
+			UPDATE sim_cards SET msisdn = NULL
+			WHERE msisdn = $1 AND iccid <> $2 AND imsi IS DISTINCT FROM $3`,
+			sim.MSISDN, sim.ICCID, sim.IMSI); err != nil {
+			logger.WithError(err).Error("Error releasing MSISDN from other SIM cards")
+			return err
+		}
+	}
+
+	if sim.ICCID != "" {
+		query := `
+			INSERT INTO sim_cards (
+				modem_id, iccid, imsi, msisdn, operator_name, cell_id, lac, status
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8
+			)
+			ON CONFLICT (iccid) DO UPDATE SET
+				modem_id = EXCLUDED.modem_id,
+				imsi = COALESCE(EXCLUDED.imsi, sim_cards.imsi),
+				msisdn = COALESCE(EXCLUDED.msisdn, sim_cards.msisdn),
+				operator_name = COALESCE(EXCLUDED.operator_name, sim_cards.operator_name),
+				cell_id = COALESCE(EXCLUDED.cell_id, sim_cards.cell_id),
+				lac = COALESCE(EXCLUDED.lac, sim_cards.lac)
+			RETURNING id`
+		err = tx.QueryRow(ctx, query,
+			sim.ModemID, sim.ICCID, sim.IMSI, sim.MSISDN, sim.OperatorName, sim.CellID, sim.LAC, sim.Status,
+		).Scan(&sim.ID)
+	} else {
+		query := `
+			UPDATE sim_cards SET
+				modem_id = $1,
+				msisdn = COALESCE($3, msisdn),
+				operator_name = COALESCE($4, operator_name),
+				cell_id = COALESCE($5, cell_id),
+				lac = COALESCE($6, lac)
+			WHERE imsi = $2
+			RETURNING id, iccid`
+		err = tx.QueryRow(ctx, query,
+			sim.ModemID, sim.IMSI, sim.MSISDN, sim.OperatorName, sim.CellID, sim.LAC,
+		).Scan(&sim.ID, &sim.ICCID)
+	}
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return ErrNotFound
+		}
+		logger.WithError(err).Error("Error upserting SIM card from modem")
+		return err
+	}
+
+	if sim.ModemID.Valid {
+		if _, err := tx.Exec(ctx, `UPDATE sim_cards SET modem_id = NULL WHERE modem_id = $1 AND id <> $2`, sim.ModemID, sim.ID); err != nil {
+			logger.WithError(err).Error("Error detaching previous SIM card from modem")
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		logger.WithError(err).Error("Error committing SIM card upsert")
+		return err
+	}
+	logger.WithField("sim_id", sim.ID).Debug("Synchronised SIM card from modem")
+	return nil
+}
+
+// EncryptStoredPINs encrypts the PIN and PUK codes still stored in plain text,
+// as written before a SIM secret key was configured, and returns how many
+// cards were updated.
+func (r *postgresSIMCardRepository) EncryptStoredPINs(ctx context.Context) (int, error) {
+	if r.box == nil {
+		return 0, nil
+	}
+	rows, err := r.db.Query(ctx, `
+		SELECT id, pin1, puk1, pin2, puk2 FROM sim_cards
+		WHERE (pin1 <> '' AND pin1 NOT LIKE 'enc:%')
+		   OR (puk1 <> '' AND puk1 NOT LIKE 'enc:%')
+		   OR (pin2 <> '' AND pin2 NOT LIKE 'enc:%')
+		   OR (puk2 <> '' AND puk2 NOT LIKE 'enc:%')`)
+	if err != nil {
+		return 0, fmt.Errorf("postgresSIMCardRepository.EncryptStoredPINs: %w", err)
+	}
+	var plain []models.SIMCard
+	for rows.Next() {
+		var sim models.SIMCard
+		if err := rows.Scan(&sim.ID, &sim.PIN1, &sim.PUK1, &sim.PIN2, &sim.PUK2); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("postgresSIMCardRepository.EncryptStoredPINs: scan: %w", err)
+		}
+		plain = append(plain, sim)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("postgresSIMCardRepository.EncryptStoredPINs: %w", err)
+	}
+
+	for i := range plain {
+		pins, err := r.sealPINs(&plain[i])
+		if err != nil {
+			return i, fmt.Errorf("postgresSIMCardRepository.EncryptStoredPINs: %w", err)
+		}
+		if _, err := r.db.Exec(ctx, `UPDATE sim_cards SET pin1 = $2, puk1 = $3, pin2 = $4, puk2 = $5 WHERE id = $1`,
+			plain[i].ID, pins[0], pins[1], pins[2], pins[3]); err != nil {
+			return i, fmt.Errorf("postgresSIMCardRepository.EncryptStoredPINs: update %d: %w", plain[i].ID, err)
+		}
+	}
+	return len(plain), nil
+}
+
+// GetSIMCardPINs returns the ID and the decrypted PIN and PUK codes of a
+// card. The other lookups leave the codes out; this one is only for
+// unlocking the SIM.
+func (r *postgresSIMCardRepository) GetSIMCardPINs(ctx context.Context, id int64) (*models.SIMCard, error) {
+	sim := &models.SIMCard{ID: id}
+	err := r.db.QueryRow(ctx, `SELECT pin1, puk1, pin2, puk2 FROM sim_cards WHERE id = $1`, id).Scan(
+		&sim.PIN1, &sim.PUK1, &sim.PIN2, &sim.PUK2)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresSIMCardRepository.GetSIMCardPINs: %w", err)
+	}
+	if err := r.openPINs(sim); err != nil {
+		return nil, err
+	}
+	return sim, nil
+}
+
+// UpdateSIMCardPIN1 stores the PIN of a card, encrypted.
+func (r *postgresSIMCardRepository) UpdateSIMCardPIN1(ctx context.Context, id int64, pin string) error {
+	pins, err := r.sealPINs(&models.SIMCard{PIN1: sql.NullString{String: pin, Valid: pin != ""}})
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.UpdateSIMCardPIN1: %w", err)
+	}
+	commandTag, err := r.db.Exec(ctx, `UPDATE sim_cards SET pin1 = $2 WHERE id = $1`, id, pins[0])
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.UpdateSIMCardPIN1: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateSIMCardStatus sets the status of a card.
+func (r *postgresSIMCardRepository) UpdateSIMCardStatus(ctx context.Context, id int64, status string) error {
+	commandTag, err := r.db.Exec(ctx, `UPDATE sim_cards SET status = $2 WHERE id = $1`, id, status)
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.UpdateSIMCardStatus: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateSIMCardCell stores the serving cell of a card and its compacted BTS
+// history.
+func (r *postgresSIMCardRepository) UpdateSIMCardCell(ctx context.Context, id int64, lac, cellID sql.NullString, btsHistory json.RawMessage) error {
+	query := `
+		UPDATE sim_cards SET
+			lac = COALESCE($2, lac),
+			cell_id = COALESCE($3, cell_id),
+			bts_info_history = COALESCE($4, bts_info_history)
+		WHERE id = $1`
+
+	var history []byte
+	if len(btsHistory) > 0 {
+		history = btsHistory
+	}
+	commandTag, err := r.db.Exec(ctx, query, id, lac, cellID, history)
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.UpdateSIMCardCell: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RecordPINAttempt stores a PIN or PUK entered on a card.
+func (r *postgresSIMCardRepository) RecordPINAttempt(ctx context.Context, attempt *models.SIMPINAttempt) error {
+	query := `
+		INSERT INTO sim_pin_attempts (
+			sim_card_id, iccid, modem_id, code_type, source, success,
+			retries_before, retries_after, error, attempted_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id`
+
+	err := r.db.QueryRow(ctx, query,
+		attempt.SIMCardID, attempt.ICCID, attempt.ModemID, attempt.CodeType, attempt.Source, attempt.Success,
+		attempt.RetriesBefore, attempt.RetriesAfter, attempt.Error, attempt.AttemptedAt,
+	).Scan(&attempt.ID)
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.RecordPINAttempt: %w", err)
+	}
+	return nil
+}
+
+// GetPINAttempts returns the most recent PIN and PUK attempts on a card.
+func (r *postgresSIMCardRepository) GetPINAttempts(ctx context.Context, simCardID int64, limit int) ([]models.SIMPINAttempt, error) {
+	query := `
+		SELECT id, sim_card_id, iccid, modem_id, code_type, source, success,
+		       retries_before, retries_after, error, attempted_at
+		FROM sim_pin_attempts
+		WHERE sim_card_id = $1
+		ORDER BY attempted_at DESC
+		LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, simCardID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgresSIMCardRepository.GetPINAttempts: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []models.SIMPINAttempt{}
+	for rows.Next() {
+		var a models.SIMPINAttempt
+		if err := rows.Scan(
+			&a.ID, &a.SIMCardID, &a.ICCID, &a.ModemID, &a.CodeType, &a.Source, &a.Success,
+			&a.RetriesBefore, &a.RetriesAfter, &a.Error, &a.AttemptedAt,
+		); err != nil {
+			return nil, fmt.Errorf("postgresSIMCardRepository.GetPINAttempts: scan: %w", err)
+		}
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresSIMCardRepository.GetPINAttempts: %w", err)
+	}
+	return attempts, nil
+}
+
+// RecordBalance stores a balance read from a card and makes it the card's
+// current balance, unless a newer one was stored already.
+func (r *postgresSIMCardRepository) RecordBalance(ctx context.Context, reading *models.SIMBalanceReading) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.RecordBalance: begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	commandTag, err := tx.Exec(ctx, `
+		UPDATE sim_cards SET
+			balance = $2,
+			balance_currency = COALESCE($3, balance_currency),
+			balance_last_checked_at = $4
+		WHERE id = $1
+		AND (balance_last_checked_at IS NULL OR balance_last_checked_at <= $4)`,
+		reading.SIMCardID, reading.Balance, reading.Currency, reading.CheckedAt)
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.RecordBalance: update: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		var exists bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM sim_cards WHERE id = $1)`, reading.SIMCardID).Scan(&exists); err != nil {
+			return fmt.Errorf("postgresSIMCardRepository.RecordBalance: %w", err)
+		}
+		if !exists {
+			return ErrNotFound
+		}
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO sim_balance_history (sim_card_id, balance, currency, source, raw_text, expires_at, checked_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`,
+		reading.SIMCardID, reading.Balance, reading.Currency, reading.Source, reading.RawText, reading.ExpiresAt, reading.CheckedAt,
+	).Scan(&reading.ID)
+	if err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.RecordBalance: insert: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("postgresSIMCardRepository.RecordBalance: commit: %w", err)
+	}
+	return nil
+}
+
+// GetBalanceHistory returns the most recent balances read from a card.
+func (r *postgresSIMCardRepository) GetBalanceHistory(ctx context.Context, simCardID int64, limit int) ([]models.SIMBalanceReading, error) {
+	query := `
+		SELECT id, sim_card_id, balance, currency, source, raw_text, expires_at, checked_at
+		FROM sim_balance_history
+		WHERE sim_card_id = $1
+		ORDER BY checked_at DESC
+		LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, simCardID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgresSIMCardRepository.GetBalanceHistory: %w", err)
+	}
+	defer rows.Close()
+
+	readings := []models.SIMBalanceReading{}
+	for rows.Next() {
+		var b models.SIMBalanceReading
+		if err := rows.Scan(
+			&b.ID, &b.SIMCardID, &b.Balance, &b.Currency, &b.Source, &b.RawText, &b.ExpiresAt, &b.CheckedAt,
+		); err != nil {
+			return nil, fmt.Errorf("postgresSIMCardRepository.GetBalanceHistory: scan: %w", err)
+		}
+		readings = append(readings, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresSIMCardRepository.GetBalanceHistory: %w", err)
+	}
+	return readings, nil
+}
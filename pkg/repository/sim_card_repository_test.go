@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/secrets"
+)
+
+const simCardsTable = `
+	CREATE TABLE sim_cards (
+		id BIGSERIAL PRIMARY KEY,
+		modem_id INTEGER,
+		iccid VARCHAR(22) NOT NULL UNIQUE,
+		imsi VARCHAR(15),
+		msisdn VARCHAR(20),
+		operator_name VARCHAR(100),
+		network_country_code VARCHAR(10),
+		balance DECIMAL(10, 4),
+		balance_currency VARCHAR(10),
+		balance_last_checked_at TIMESTAMPTZ,
+		data_allowance_mb INTEGER,
+		data_used_mb INTEGER,
+		status VARCHAR(50) NOT NULL DEFAULT 'unknown',
+		pin1 TEXT,
+		puk1 TEXT,
+		pin2 TEXT,
+		puk2 TEXT,
+		activation_date DATE,
+		expiry_date DATE,
+		recharge_history JSONB,
+		notes TEXT,
+		cell_id VARCHAR(50),
+		lac VARCHAR(50),
+		psc VARCHAR(50),
+		rscp INTEGER,
+		ecio INTEGER,
+		bts_info_history JSONB,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+func TestSIMCardPINsOnlyReadForUnlocking(t *testing.T) {
+	db := testDB(t, simCardsTable)
+	ctx := context.Background()
+	box, err := secrets.NewBox([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresSIMCardRepository(db, box)
+
+	id, err := repo.CreateSIMCard(ctx, &models.SIMCard{
+		ICCID:  "8921201234567890123",
+		Status: models.SIMStatusActive,
+		PIN1:   sql.NullString{String: "1234", Valid: true},
+		PUK1:   sql.NullString{String: "12345678", Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("CreateSIMCard: %v", err)
+	}
+
+	sim, err := repo.GetSIMCardByID(ctx, id)
+	if err != nil {
+		t.Fatalf("GetSIMCardByID: %v", err)
+	}
+	if sim.PIN1.Valid || sim.PUK1.Valid {
+		t.Errorf("GetSIMCardByID read the codes: %+v %+v", sim.PIN1, sim.PUK1)
+	}
+	sims, err := repo.GetAllSIMCards(ctx)
+	if err != nil || len(sims) != 1 {
+		t.Fatalf("GetAllSIMCards: %d cards, %v", len(sims), err)
+	}
+	sims[0].PIN1 = sql.NullString{String: "1234", Valid: true}
+	out, err := json.Marshal(sims[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "1234") || strings.Contains(string(out), "pin1") {
+		t.Errorf("SIM card JSON shows its PIN: %s", out)
+	}
+
+	// Writing the card back without codes keeps them.
+	sim.Notes = sql.NullString{String: "rack 2", Valid: true}
+	if err := repo.UpdateSIMCard(ctx, sim); err != nil {
+		t.Fatalf("UpdateSIMCard: %v", err)
+	}
+	pins, err := repo.GetSIMCardPINs(ctx, id)
+	if err != nil {
+		t.Fatalf("GetSIMCardPINs: %v", err)
+	}
+	if pins.PIN1.String != "1234" || pins.PUK1.String != "12345678" || pins.PIN2.Valid {
+		t.Errorf("codes %+v %+v %+v, want PIN1 1234 and PUK1 12345678", pins.PIN1, pins.PUK1, pins.PIN2)
+	}
+
+	var stored string
+	if err := db.QueryRow(ctx, `SELECT pin1 FROM sim_cards WHERE id = $1`, id).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !secrets.IsSealed(stored) {
+		t.Errorf("PIN1 stored as %q, want it encrypted", stored)
+	}
+	if _, err := repo.GetSIMCardPINs(ctx, id+1); err != ErrNotFound {
+		t.Errorf("GetSIMCardPINs of a missing card: %v, want ErrNotFound", err)
+	}
+}
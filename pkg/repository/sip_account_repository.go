@@ -28,6 +28,10 @@ type SIPAccountRepository interface {
 	
 	// Registration
 	CreateRegistration(ctx context.Context, registration *models.SIPRegistration) error
+	RefreshRegistration(ctx context.Context, registration *models.SIPRegistration) error
+	UnregisterContact(ctx context.Context, accountID int64, contactURI string) error
+	ExpireRegistrations(ctx context.Context, now time.Time) (int64, error)
+	ListActiveRegistrations(ctx context.Context) ([]*models.SIPRegistration, error)
 	UpdateRegistrationStatus(ctx context.Context, accountID int64, ip string, registered bool) error
 	GetActiveRegistrations(ctx context.Context, accountID int64) ([]*models.SIPRegistration, error)
 	
@@ -398,16 +402,20 @@ func (r *sipAccountRepository) UpdateSIPAccountPermissions(ctx context.Context,
 func (r *sipAccountRepository) CreateRegistration(ctx context.Context, registration *models.SIPRegistration) error {
 	query := `
 		INSERT INTO sip_registrations (
-			sip_account_id, contact_uri, source_ip, source_port,
+			sip_account_id, contact_uri, source_ip, source_port, transport,
 			user_agent, expires_seconds, registered_at, expired_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id`
 
+	if registration.Transport == "" {
+		registration.Transport = models.TransportUDP
+	}
 	err := r.db.QueryRowContext(ctx, query,
 		registration.SIPAccountID,
 		registration.ContactURI,
 		registration.SourceIP,
 		registration.SourcePort,
+		registration.Transport,
 		registration.UserAgent,
 		registration.ExpiresSeconds,
 		registration.RegisteredAt,
@@ -431,6 +439,105 @@ func (r *sipAccountRepository) CreateRegistration(ctx context.Context, registrat
 	return err
 }
 
+func (r *sipAccountRepository) RefreshRegistration(ctx context.Context, registration *models.SIPRegistration) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if registration.Transport == "" {
+		registration.Transport = models.TransportUDP
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO sip_registrations (
+			sip_account_id, contact_uri, source_ip, source_port, transport,
+			user_agent, expires_seconds, registered_at, expired_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (sip_account_id, contact_uri) WHERE is_active DO UPDATE SET
+			source_ip = EXCLUDED.source_ip,
+			source_port = EXCLUDED.source_port,
+			transport = EXCLUDED.transport,
+			user_agent = EXCLUDED.user_agent,
+			expires_seconds = EXCLUDED.expires_seconds,
+			registered_at = EXCLUDED.registered_at,
+			expired_at = EXCLUDED.expired_at
+		RETURNING id`,
+		registration.SIPAccountID,
+		registration.ContactURI,
+		registration.SourceIP,
+		registration.SourcePort,
+		registration.Transport,
+		registration.UserAgent,
+		registration.ExpiresSeconds,
+		registration.RegisteredAt,
+		registration.ExpiredAt,
+	).Scan(&registration.ID)
+	if err != nil {
+		return fmt.Errorf("failed to refresh registration: %w", err)
+	}
+	registration.IsActive = true
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sip_accounts
+		SET last_registered_ip = $2, last_registered_at = $3
+		WHERE id = $1`,
+		registration.SIPAccountID,
+		registration.SourceIP,
+		registration.RegisteredAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update account registration: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (r *sipAccountRepository) UnregisterContact(ctx context.Context, accountID int64, contactURI string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE sip_registrations
+		SET is_active = false, unregistered_at = $3
+		WHERE sip_account_id = $1 AND contact_uri = $2 AND is_active = true`,
+		accountID, contactURI, time.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unregister contact: %w", err)
+	}
+	return nil
+}
+
+func (r *sipAccountRepository) ExpireRegistrations(ctx context.Context, now time.Time) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE sip_registrations
+		SET is_active = false, unregistered_at = expired_at
+		WHERE is_active = true AND expired_at <= $1`,
+		now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire registrations: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (r *sipAccountRepository) ListActiveRegistrations(ctx context.Context) ([]*models.SIPRegistration, error) {
+	var registrations []*models.SIPRegistration
+	query := `
+		SELECT 
+			id, sip_account_id, contact_uri, source_ip, source_port, transport,
+			user_agent, expires_seconds, registered_at, expired_at,
+			unregistered_at, is_active
+		FROM sip_registrations
+		WHERE is_active = true AND expired_at > $1
+		ORDER BY registered_at`
+
+	err := r.db.SelectContext(ctx, &registrations, query, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list active registrations: %w", err)
+	}
+
+	return registrations, nil
+}
+
 func (r *sipAccountRepository) UpdateRegistrationStatus(ctx context.Context, accountID int64, ip string, registered bool) error {
 	tx, err := r.db.BeginTxx(ctx, nil)
 	if err != nil {
@@ -480,7 +587,7 @@ func (r *sipAccountRepository) GetActiveRegistrations(ctx context.Context, accou
 	var registrations []*models.SIPRegistration
 	query := `
 		SELECT 
-			id, sip_account_id, contact_uri, source_ip, source_port,
+			id, sip_account_id, contact_uri, source_ip, source_port, transport,
 			user_agent, expires_seconds, registered_at, expired_at,
 			unregistered_at, is_active
 		FROM sip_registrations
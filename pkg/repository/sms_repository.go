@@ -0,0 +1,346 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresSMSRepository implements SMSRepository using a PostgreSQL database.
+type postgresSMSRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewPostgresSMSRepository creates a new instance of postgresSMSRepository.
+func NewPostgresSMSRepository(db *pgxpool.Pool) SMSRepository {
+	return &postgresSMSRepository{db: db}
+}
+
+const smsMessageColumns = `
+	id, direction, status, modem_id, sim_card_id, number, body, encoding, parts, missing_parts,
+	report_requested, task_id, reference, error, sent_at, delivered_at, created_at, updated_at`
+
+func scanSMSMessage(row pgx.Row, m *models.SMSMessage) error {
+	return row.Scan(
+		&m.ID, &m.Direction, &m.Status, &m.ModemID, &m.SIMCardID, &m.Number, &m.Body, &m.Encoding, &m.Parts, &m.MissingParts,
+		&m.ReportRequested, &m.TaskID, &m.Reference, &m.Error, &m.SentAt, &m.DeliveredAt, &m.CreatedAt, &m.UpdatedAt,
+	)
+}
+
+// CreateMessage stores a message. CreatedAt defaults to now.
+func (r *postgresSMSRepository) CreateMessage(ctx context.Context, m *models.SMSMessage) error {
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now()
+	}
+	query := `
+		INSERT INTO sms_messages (
+			direction, status, modem_id, sim_card_id, number, body, encoding, parts, missing_parts,
+			report_requested, task_id, reference, error, sent_at, delivered_at, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, NOW())
+		RETURNING id, updated_at`
+
+	err := r.db.QueryRow(ctx, query,
+		m.Direction, m.Status, m.ModemID, m.SIMCardID, m.Number, m.Body, m.Encoding, m.Parts, m.MissingParts,
+		m.ReportRequested, m.TaskID, m.Reference, m.Error, m.SentAt, m.DeliveredAt, m.CreatedAt,
+	).Scan(&m.ID, &m.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("postgresSMSRepository.CreateMessage: %w", err)
+	}
+	return nil
+}
+
+// GetMessageByID retrieves a message by its ID.
+func (r *postgresSMSRepository) GetMessageByID(ctx context.Context, id int64) (*models.SMSMessage, error) {
+	var m models.SMSMessage
+	err := scanSMSMessage(r.db.QueryRow(ctx, `SELECT `+smsMessageColumns+` FROM sms_messages WHERE id = $1`, id), &m)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresSMSRepository.GetMessageByID: %w", err)
+	}
+	return &m, nil
+}
+
+// ListMessages returns the messages matching filter, newest first, and how
+// many match in total.
+func (r *postgresSMSRepository) ListMessages(ctx context.Context, filter models.SMSFilter) ([]models.SMSMessage, int, error) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.Direction != "" {
+		add("direction = $%d", filter.Direction)
+	}
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if filter.ModemID != 0 {
+		add("modem_id = $%d", filter.ModemID)
+	}
+	if filter.SIMCardID != 0 {
+		add("sim_card_id = $%d", filter.SIMCardID)
+	}
+	if filter.Number != "" {
+		add("number ILIKE '%%' || $%d || '%%'", filter.Number)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	var total int
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM sms_messages`+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("postgresSMSRepository.ListMessages: count: %w", err)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	args = append(args, limit, filter.Offset)
+	query := fmt.Sprintf(`SELECT %s FROM sms_messages%s ORDER BY created_at DESC, id DESC LIMIT $%d OFFSET $%d`,
+		smsMessageColumns, where, len(args)-1, len(args))
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("postgresSMSRepository.ListMessages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []models.SMSMessage{}
+	for rows.Next() {
+		var m models.SMSMessage
+		if err := scanSMSMessage(rows, &m); err != nil {
+			return nil, 0, fmt.Errorf("postgresSMSRepository.ListMessages: scan: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("postgresSMSRepository.ListMessages: %w", err)
+	}
+	return messages, total, nil
+}
+
+// UpdateMessageStatus sets the status of a message. Moving to sent stamps
+// sent_at, moving to delivered or undeliverable stamps delivered_at; errMsg
+// replaces the error unless empty.
+func (r *postgresSMSRepository) UpdateMessageStatus(ctx context.Context, id int64, status, errMsg string, at time.Time) error {
+	query := `
+		UPDATE sms_messages SET
+			status = $2::varchar,
+			error = COALESCE(NULLIF($3, ''), error),
+			sent_at = CASE WHEN $2::varchar = 'sent' THEN $4 ELSE sent_at END,
+			delivered_at = CASE WHEN $2::varchar IN ('delivered', 'undeliverable') THEN $4 ELSE delivered_at END,
+			updated_at = NOW()
+		WHERE id = $1`
+
+	commandTag, err := r.db.Exec(ctx, query, id, status, errMsg, at)
+	if err != nil {
+		return fmt.Errorf("postgresSMSRepository.UpdateMessageStatus: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetMessageTask records chan_dongle's task ID, or the message reference,
+// of an outbound message.
+func (r *postgresSMSRepository) SetMessageTask(ctx context.Context, id int64, taskID string, reference *int) error {
+	query := `
+		UPDATE sms_messages SET
+			task_id = COALESCE(NULLIF($2, ''), task_id),
+			reference = COALESCE($3, reference),
+			updated_at = NOW()
+		WHERE id = $1`
+
+	commandTag, err := r.db.Exec(ctx, query, id, taskID, reference)
+	if err != nil {
+		return fmt.Errorf("postgresSMSRepository.SetMessageTask: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FindByTask returns the outbound message chan_dongle queued under taskID
+// on a modem.
+func (r *postgresSMSRepository) FindByTask(ctx context.Context, modemID int, taskID string) (*models.SMSMessage, error) {
+	query := `SELECT ` + smsMessageColumns + ` FROM sms_messages
+		WHERE modem_id = $1 AND task_id = $2 AND direction = 'outbound'
+		ORDER BY created_at DESC LIMIT 1`
+
+	var m models.SMSMessage
+	if err := scanSMSMessage(r.db.QueryRow(ctx, query, modemID, taskID), &m); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresSMSRepository.FindByTask: %w", err)
+	}
+	return &m, nil
+}
+
+// FindAwaitingReport returns the message a delivery report from a modem is
+// about: the one with the given reference if known, else the most recent
+// sent message to number still waiting for its report. Numbers are compared
+// on their last nine digits, as reports may carry them in another format.
+func (r *postgresSMSRepository) FindAwaitingReport(ctx context.Context, modemID int, number string, reference *int) (*models.SMSMessage, error) {
+	query := `SELECT ` + smsMessageColumns + ` FROM sms_messages
+		WHERE modem_id = $1 AND direction = 'outbound' AND status = 'sent' AND report_requested
+		  AND RIGHT(REGEXP_REPLACE(number, '\D', '', 'g'), 9) = RIGHT(REGEXP_REPLACE($2, '\D', '', 'g'), 9)
+		  AND ($3::INTEGER IS NULL OR reference IS NULL OR reference = $3)
+		ORDER BY (reference = $3) DESC NULLS LAST, sent_at DESC
+		LIMIT 1`
+
+	var m models.SMSMessage
+	if err := scanSMSMessage(r.db.QueryRow(ctx, query, modemID, number, reference), &m); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresSMSRepository.FindAwaitingReport: %w", err)
+	}
+	return &m, nil
+}
+
+// ListSenders returns the SIM cards that can send a message now, best
+// first: SIMs in working modems whose operator matches (any when operator
+// is empty), ready modems before busy or degraded ones, then the SIMs that
+// sent least in the last hour, then the strongest signal.
+func (r *postgresSMSRepository) ListSenders(ctx context.Context, operator string) ([]models.SMSSender, error) {
+	query := `
+		SELECT s.id, m.id, m.gateway_id, COALESCE(m.dongle_name, ''),
+		       COALESCE(s.operator_name, m.network_operator_name, ''), m.health_state, m.signal_strength_dbm,
+		       (SELECT COUNT(*) FROM sms_messages x
+		         WHERE x.sim_card_id = s.id AND x.direction = 'outbound'
+		           AND x.created_at > NOW() - INTERVAL '1 hour') AS sent_last_hour
+		FROM sim_cards s
+		JOIN modems m ON m.id = s.modem_id
+		WHERE m.status NOT IN ('offline', 'error')
+		  AND m.health_state NOT IN ('failed', 'quarantined')
+		  AND s.status NOT IN ('pin-required', 'puk-locked', 'blocked', 'inactive')
+		  AND ($1 = '' OR COALESCE(s.operator_name, m.network_operator_name, '') ILIKE '%' || $1 || '%')
+		ORDER BY CASE m.health_state WHEN 'ready' THEN 0 WHEN 'busy' THEN 1 ELSE 2 END,
+		         sent_last_hour, m.signal_strength_dbm DESC NULLS LAST, s.id`
+
+	rows, err := r.db.Query(ctx, query, operator)
+	if err != nil {
+		return nil, fmt.Errorf("postgresSMSRepository.ListSenders: %w", err)
+	}
+	defer rows.Close()
+
+	senders := []models.SMSSender{}
+	for rows.Next() {
+		var s models.SMSSender
+		if err := rows.Scan(&s.SIMCardID, &s.ModemID, &s.GatewayID, &s.DongleName, &s.OperatorName, &s.HealthState, &s.SignalDBM, &s.SentLastHour); err != nil {
+			return nil, fmt.Errorf("postgresSMSRepository.ListSenders: scan: %w", err)
+		}
+		senders = append(senders, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresSMSRepository.ListSenders: %w", err)
+	}
+	return senders, nil
+}
+
+// AddPart stores a part of a long inbound message. A part received twice is
+// kept once.
+func (r *postgresSMSRepository) AddPart(ctx context.Context, p *models.SMSPart) error {
+	query := `
+		INSERT INTO sms_message_parts (
+			modem_id, sim_card_id, sender, concat_ref, total, seq, body, encoding, received_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (modem_id, sender, concat_ref, total, seq) DO NOTHING`
+
+	_, err := r.db.Exec(ctx, query,
+		p.ModemID, p.SIMCardID, p.Sender, p.ConcatRef, p.Total, p.Seq, p.Body, p.Encoding, p.ReceivedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("postgresSMSRepository.AddPart: %w", err)
+	}
+	return nil
+}
+
+const smsPartColumns = `id, modem_id, sim_card_id, sender, concat_ref, total, seq, body, encoding, received_at`
+
+// TakeParts removes and returns, in order, the parts of a long message once
+// all of them have arrived. It returns nil while parts are missing.
+func (r *postgresSMSRepository) TakeParts(ctx context.Context, modemID int, sender string, concatRef, total int) ([]models.SMSPart, error) {
+	query := `
+		DELETE FROM sms_message_parts
+		WHERE modem_id = $1 AND sender = $2 AND concat_ref = $3 AND total = $4
+		  AND (SELECT COUNT(*) FROM sms_message_parts
+		        WHERE modem_id = $1 AND sender = $2 AND concat_ref = $3 AND total = $4) >= $4
+		RETURNING ` + smsPartColumns
+
+	parts, err := r.queryParts(ctx, query, modemID, sender, concatRef, total)
+	if err != nil {
+		return nil, fmt.Errorf("postgresSMSRepository.TakeParts: %w", err)
+	}
+	return parts, nil
+}
+
+// TakeStaleParts removes and returns the parts received before a time whose
+// messages never completed, ordered by message and part.
+func (r *postgresSMSRepository) TakeStaleParts(ctx context.Context, before time.Time) ([]models.SMSPart, error) {
+	query := `
+		DELETE FROM sms_message_parts p
+		WHERE EXISTS (
+			SELECT 1 FROM sms_message_parts q
+			WHERE q.modem_id = p.modem_id AND q.sender = p.sender AND q.concat_ref = p.concat_ref AND q.total = p.total
+			GROUP BY q.modem_id HAVING MAX(q.received_at) < $1
+		)
+		RETURNING ` + smsPartColumns
+
+	parts, err := r.queryParts(ctx, query, before)
+	if err != nil {
+		return nil, fmt.Errorf("postgresSMSRepository.TakeStaleParts: %w", err)
+	}
+	return parts, nil
+}
+
+func (r *postgresSMSRepository) queryParts(ctx context.Context, query string, args ...interface{}) ([]models.SMSPart, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []models.SMSPart
+	for rows.Next() {
+		var p models.SMSPart
+		if err := rows.Scan(&p.ID, &p.ModemID, &p.SIMCardID, &p.Sender, &p.ConcatRef, &p.Total, &p.Seq, &p.Body, &p.Encoding, &p.ReceivedAt); err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		a, b := parts[i], parts[j]
+		if a.ModemID != b.ModemID {
+			return a.ModemID < b.ModemID
+		}
+		if a.Sender != b.Sender {
+			return a.Sender < b.Sender
+		}
+		if a.ConcatRef != b.ConcatRef {
+			return a.ConcatRef < b.ConcatRef
+		}
+		if a.Total != b.Total {
+			return a.Total < b.Total
+		}
+		return a.Seq < b.Seq
+	})
+	return parts, nil
+}
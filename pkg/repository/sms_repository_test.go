@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const smsMessagesTable = `
+	CREATE TABLE sms_messages (
+		id BIGSERIAL PRIMARY KEY,
+		status VARCHAR(20) NOT NULL,
+		error TEXT,
+		sent_at TIMESTAMPTZ,
+		delivered_at TIMESTAMPTZ,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+func TestUpdateMessageStatus(t *testing.T) {
+	db := testDB(t, smsMessagesTable)
+	ctx := context.Background()
+	repo := NewPostgresSMSRepository(db)
+	var id int64
+	if err := db.QueryRow(ctx, `INSERT INTO sms_messages (status) VALUES ('queued') RETURNING id`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	sentAt := time.Date(2024, 3, 15, 14, 30, 0, 0, time.UTC)
+	deliveredAt := sentAt.Add(5 * time.Second)
+	tests := []struct {
+		status, errMsg string
+		at             time.Time
+		sent           *time.Time
+		delivered      *time.Time
+		wantErr        *string
+	}{
+		{"sent", "", sentAt, &sentAt, nil, nil},
+		{"failed", "no network", sentAt.Add(time.Second), &sentAt, nil, strPtr("no network")},
+		{"delivered", "", deliveredAt, &sentAt, &deliveredAt, strPtr("no network")},
+	}
+	for _, tt := range tests {
+		if err := repo.UpdateMessageStatus(ctx, id, tt.status, tt.errMsg, tt.at); err != nil {
+			t.Fatalf("UpdateMessageStatus(%s): %v", tt.status, err)
+		}
+		var status string
+		var sent, delivered *time.Time
+		var errMsg *string
+		row := db.QueryRow(ctx, `SELECT status, sent_at, delivered_at, error FROM sms_messages WHERE id = $1`, id)
+		if err := row.Scan(&status, &sent, &delivered, &errMsg); err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status || !sameTime(sent, tt.sent) || !sameTime(delivered, tt.delivered) || !sameString(errMsg, tt.wantErr) {
+			t.Errorf("after %s: status %q, sent_at %v, delivered_at %v, error %v", tt.status, status, sent, delivered, errMsg)
+		}
+	}
+
+	if err := repo.UpdateMessageStatus(ctx, id+1, "sent", "", sentAt); err != ErrNotFound {
+		t.Errorf("unknown message: got %v, want ErrNotFound", err)
+	}
+}
+
+func strPtr(s string) *string { return &s }
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func sameString(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresUSSDRepository implements USSDRepository using a PostgreSQL database.
+type postgresUSSDRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewPostgresUSSDRepository creates a new instance of postgresUSSDRepository.
+func NewPostgresUSSDRepository(db *pgxpool.Pool) USSDRepository {
+	return &postgresUSSDRepository{db: db}
+}
+
+// CreateSession stores a new session. StartedAt defaults to now.
+func (r *postgresUSSDRepository) CreateSession(ctx context.Context, s *models.USSDSession) error {
+	if s.StartedAt.IsZero() {
+		s.StartedAt = time.Now()
+	}
+	if s.LastActivityAt.IsZero() {
+		s.LastActivityAt = s.StartedAt
+	}
+	query := `
+		INSERT INTO ussd_sessions (sim_card_id, modem_id, operator_name, status, started_at, last_activity_at, ended_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`
+
+	err := r.db.QueryRow(ctx, query,
+		s.SIMCardID, s.ModemID, s.OperatorName, s.Status, s.StartedAt, s.LastActivityAt, s.EndedAt,
+	).Scan(&s.ID)
+	if err != nil {
+		return fmt.Errorf("postgresUSSDRepository.CreateSession: %w", err)
+	}
+	return nil
+}
+
+// GetSession retrieves a session by its ID.
+func (r *postgresUSSDRepository) GetSession(ctx context.Context, id int64) (*models.USSDSession, error) {
+	query := `
+		SELECT id, sim_card_id, modem_id, operator_name, status, started_at, last_activity_at, ended_at
+		FROM ussd_sessions WHERE id = $1`
+
+	var s models.USSDSession
+	err := r.db.QueryRow(ctx, query, id).Scan(
+		&s.ID, &s.SIMCardID, &s.ModemID, &s.OperatorName, &s.Status, &s.StartedAt, &s.LastActivityAt, &s.EndedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("postgresUSSDRepository.GetSession: %w", err)
+	}
+	return &s, nil
+}
+
+// UpdateSession sets the status of a session as of at. A status other than
+// open ends the session.
+func (r *postgresUSSDRepository) UpdateSession(ctx context.Context, id int64, status string, at time.Time) error {
+	query := `
+		UPDATE ussd_sessions
+		SET status = $2::varchar, last_activity_at = $3::timestamptz,
+		    ended_at = CASE WHEN $2::varchar = 'open' THEN NULL ELSE $3::timestamptz END
+		WHERE id = $1`
+
+	tag, err := r.db.Exec(ctx, query, id, status, at)
+	if err != nil {
+		return fmt.Errorf("postgresUSSDRepository.UpdateSession: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ExpireOpenSessions marks the sessions still open with no activity since
+// before as timed out, e.g. those left open by a restart. It returns how
+// many were expired.
+func (r *postgresUSSDRepository) ExpireOpenSessions(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		UPDATE ussd_sessions SET status = 'timeout', ended_at = NOW()
+		WHERE status = 'open' AND last_activity_at < $1`
+
+	tag, err := r.db.Exec(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("postgresUSSDRepository.ExpireOpenSessions: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// CreateExchange stores a request sent in a session. RequestedAt defaults
+// to now.
+func (r *postgresUSSDRepository) CreateExchange(ctx context.Context, e *models.USSDExchange) error {
+	if e.RequestedAt.IsZero() {
+		e.RequestedAt = time.Now()
+	}
+	query := `
+		INSERT INTO ussd_exchanges (session_id, sim_card_id, modem_id, request, task_id, requested_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+
+	err := r.db.QueryRow(ctx, query,
+		e.SessionID, e.SIMCardID, e.ModemID, e.Request, e.TaskID, e.RequestedAt,
+	).Scan(&e.ID)
+	if err != nil {
+		return fmt.Errorf("postgresUSSDRepository.CreateExchange: %w", err)
+	}
+	return nil
+}
+
+// CompleteExchange stores the outcome of a request: its task ID, the
+// response and what was parsed from it, or the error.
+func (r *postgresUSSDRepository) CompleteExchange(ctx context.Context, e *models.USSDExchange) error {
+	query := `
+		UPDATE ussd_exchanges
+		SET task_id = $2, response = $3, network_status = $4, parsed = $5, error = $6, responded_at = $7
+		WHERE id = $1`
+
+	var parsed interface{}
+	if len(e.Parsed) > 0 {
+		parsed = e.Parsed
+	}
+	tag, err := r.db.Exec(ctx, query,
+		e.ID, e.TaskID, e.Response, e.NetworkStatus, parsed, e.Error, e.RespondedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("postgresUSSDRepository.CompleteExchange: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListExchanges returns the latest exchanges of a SIM card, newest first.
+func (r *postgresUSSDRepository) ListExchanges(ctx context.Context, simCardID int64, limit int) ([]models.USSDExchange, error) {
+	query := `
+		SELECT id, session_id, sim_card_id, modem_id, request, task_id, response, network_status,
+		       parsed, error, requested_at, responded_at
+		FROM ussd_exchanges
+		WHERE sim_card_id = $1
+		ORDER BY requested_at DESC, id DESC
+		LIMIT $2`
+
+	rows, err := r.db.Query(ctx, query, simCardID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("postgresUSSDRepository.ListExchanges: %w", err)
+	}
+	defer rows.Close()
+
+	exchanges := []models.USSDExchange{}
+	for rows.Next() {
+		var e models.USSDExchange
+		var parsed []byte
+		if err := rows.Scan(
+			&e.ID, &e.SessionID, &e.SIMCardID, &e.ModemID, &e.Request, &e.TaskID, &e.Response, &e.NetworkStatus,
+			&parsed, &e.Error, &e.RequestedAt, &e.RespondedAt,
+		); err != nil {
+			return nil, fmt.Errorf("postgresUSSDRepository.ListExchanges: scan: %w", err)
+		}
+		e.Parsed = parsed
+		exchanges = append(exchanges, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgresUSSDRepository.ListExchanges: %w", err)
+	}
+	return exchanges, nil
+}
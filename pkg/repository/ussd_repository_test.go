@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const ussdSessionsTable = `
+	CREATE TABLE ussd_sessions (
+		id BIGSERIAL PRIMARY KEY,
+		status VARCHAR(20) NOT NULL DEFAULT 'open',
+		last_activity_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		ended_at TIMESTAMPTZ
+	)`
+
+func TestUpdateSession(t *testing.T) {
+	db := testDB(t, ussdSessionsTable)
+	ctx := context.Background()
+	repo := NewPostgresUSSDRepository(db)
+	var id int64
+	if err := db.QueryRow(ctx, `INSERT INTO ussd_sessions DEFAULT VALUES RETURNING id`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2024, 3, 15, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		status string
+		at     time.Time
+		ended  bool
+	}{
+		{"open", at, false},
+		{"closed", at.Add(10 * time.Second), true},
+	}
+	for _, tt := range tests {
+		if err := repo.UpdateSession(ctx, id, tt.status, tt.at); err != nil {
+			t.Fatalf("UpdateSession(%s): %v", tt.status, err)
+		}
+		var status string
+		var lastActivity time.Time
+		var ended *time.Time
+		row := db.QueryRow(ctx, `SELECT status, last_activity_at, ended_at FROM ussd_sessions WHERE id = $1`, id)
+		if err := row.Scan(&status, &lastActivity, &ended); err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status || !lastActivity.Equal(tt.at) || (ended != nil) != tt.ended || (ended != nil && !ended.Equal(tt.at)) {
+			t.Errorf("after %s: status %q, last_activity_at %v, ended_at %v", tt.status, status, lastActivity, ended)
+		}
+	}
+
+	if err := repo.UpdateSession(ctx, id+1, "closed", at); err != ErrNotFound {
+		t.Errorf("unknown session: got %v, want ErrNotFound", err)
+	}
+}
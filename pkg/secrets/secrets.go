@@ -0,0 +1,90 @@
+// Package secrets encrypts small values, such as SIM PIN and PUK codes, for
+// storage in the database.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks an encrypted value. The version allows changing the
+// scheme later while old values stay readable.
+const sealedPrefix = "enc:v1:"
+
+// ErrInvalidKey is returned for keys that are not 32 bytes of base64 or hex.
+var ErrInvalidKey = errors.New("secrets: key must be 32 bytes, base64 or hex encoded")
+
+// Box encrypts values with AES-256-GCM.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// ParseKey decodes a 32-byte key given as base64 or hex, as generated with
+// "openssl rand -base64 32".
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+// NewBox creates a Box from a 32-byte key.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// IsSealed reports whether s is an encrypted value.
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, sealedPrefix)
+}
+
+// Seal encrypts plaintext. Sealing the same value twice gives different
+// results.
+func (b *Box) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("secrets: %w", err)
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal. Values that were never sealed are
+// returned unchanged, so rows written before encryption was enabled stay
+// readable.
+func (b *Box) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", errors.New("secrets: malformed sealed value")
+	}
+	nonce, ciphertext := raw[:b.aead.NonceSize()], raw[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("secrets: cannot decrypt value; wrong key?")
+	}
+	return string(plaintext), nil
+}
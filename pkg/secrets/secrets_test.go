@@ -0,0 +1,111 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func testBox(t *testing.T, fill byte) *Box {
+	t.Helper()
+	box, err := NewBox(bytes.Repeat([]byte{fill}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box
+}
+
+func TestSealOpen(t *testing.T) {
+	box := testBox(t, 1)
+	for _, plain := range []string{"1234", "12345678", "", "0000"} {
+		sealed, err := box.Seal(plain)
+		if err != nil {
+			t.Fatalf("Seal(%q): %v", plain, err)
+		}
+		if !IsSealed(sealed) {
+			t.Errorf("Seal(%q) = %q, not marked sealed", plain, sealed)
+		}
+		if plain != "" && bytes.Contains([]byte(sealed), []byte(plain)) {
+			t.Errorf("Seal(%q) = %q contains the plain text", plain, sealed)
+		}
+		opened, err := box.Open(sealed)
+		if err != nil {
+			t.Fatalf("Open(Seal(%q)): %v", plain, err)
+		}
+		if opened != plain {
+			t.Errorf("Open(Seal(%q)) = %q", plain, opened)
+		}
+	}
+}
+
+func TestSealIsRandomised(t *testing.T) {
+	box := testBox(t, 1)
+	a, _ := box.Seal("1234")
+	b, _ := box.Seal("1234")
+	if a == b {
+		t.Errorf("sealing 1234 twice gave %q both times", a)
+	}
+}
+
+func TestOpenPlainText(t *testing.T) {
+	if got, err := testBox(t, 1).Open("1234"); err != nil || got != "1234" {
+		t.Errorf("Open(1234) = %q, %v; want it unchanged", got, err)
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	sealed, err := testBox(t, 1).Seal("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testBox(t, 2).Open(sealed); err == nil {
+		t.Error("opened with the wrong key")
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	box := testBox(t, 1)
+	sealed, err := box.Seal("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte(sealed)
+	last := len(raw) - 1
+	if raw[last] == 'A' {
+		raw[last] = 'B'
+	} else {
+		raw[last] = 'A'
+	}
+	for _, value := range []string{string(raw), sealedPrefix + "!!", sealedPrefix + "AAAA"} {
+		if _, err := box.Open(value); err == nil {
+			t.Errorf("Open(%q) succeeded", value)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	for _, s := range []string{
+		base64.StdEncoding.EncodeToString(key),
+		hex.EncodeToString(key),
+		" " + base64.StdEncoding.EncodeToString(key) + "\n",
+	} {
+		got, err := ParseKey(s)
+		if err != nil {
+			t.Errorf("ParseKey(%q): %v", s, err)
+			continue
+		}
+		if !bytes.Equal(got, key) {
+			t.Errorf("ParseKey(%q) = %x", s, got)
+		}
+	}
+	for _, s := range []string{"", "secret", base64.StdEncoding.EncodeToString(key[:16]), hex.EncodeToString(key[:31])} {
+		if _, err := ParseKey(s); err != ErrInvalidKey {
+			t.Errorf("ParseKey(%q) = %v, want ErrInvalidKey", s, err)
+		}
+	}
+	if _, err := NewBox(key[:16]); err != ErrInvalidKey {
+		t.Errorf("NewBox with a 16-byte key = %v, want ErrInvalidKey", err)
+	}
+}
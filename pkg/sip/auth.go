@@ -0,0 +1,250 @@
+package sip
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nonceTTL is how long a challenge's nonce is accepted; older ones are
+// answered with a stale challenge the UA retries without asking the user.
+const nonceTTL = 5 * time.Minute
+
+var (
+	// ErrNoCredentials is returned for a request without credentials for
+	// the realm.
+	ErrNoCredentials = errors.New("sip: no credentials")
+	// ErrStaleNonce is returned for credentials computed on an expired
+	// nonce.
+	ErrStaleNonce = errors.New("sip: stale nonce")
+	// ErrBadCredentials is returned for credentials that do not match.
+	ErrBadCredentials = errors.New("sip: bad credentials")
+)
+
+// DigestAuth challenges requests and checks their digest credentials (RFC
+// 2617 with MD5 and qop=auth, as RFC 3261 §22.4 uses it). Nonces are
+// signed timestamps, so none are kept between challenge and answer; only
+// the nonce counts used with each fresh nonce are, to refuse replays.
+type DigestAuth struct {
+	Realm  string
+	secret []byte
+
+	mu     sync.Mutex
+	used   map[string]map[uint32]bool // nonce counts seen, by nonce
+	pruned time.Time
+}
+
+// NewDigestAuth creates an authenticator for a realm.
+func NewDigestAuth(realm string) *DigestAuth {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &DigestAuth{Realm: realm, secret: secret, used: make(map[string]map[uint32]bool)}
+}
+
+// Challenge returns a WWW-Authenticate or Proxy-Authenticate value with a
+// new nonce. stale tells the UA its password was right but the nonce old.
+func (a *DigestAuth) Challenge(stale bool) string {
+	c := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=MD5, qop="auth"`, a.Realm, a.newNonce(time.Now()))
+	if stale {
+		c += ", stale=TRUE"
+	}
+	return c
+}
+
+func (a *DigestAuth) newNonce(t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 16)
+	return ts + a.sign(ts)
+}
+
+func (a *DigestAuth) sign(ts string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil)[:12])
+}
+
+// checkNonce reports whether a nonce is ours and whether it is still
+// fresh.
+func (a *DigestAuth) checkNonce(nonce string) (ours, fresh bool) {
+	issued, ok := a.nonceTime(nonce)
+	if !ok {
+		return false, false
+	}
+	return true, time.Since(issued) < nonceTTL
+}
+
+// nonceTime returns when one of our nonces was issued.
+func (a *DigestAuth) nonceTime(nonce string) (time.Time, bool) {
+	if len(nonce) <= 24 {
+		return time.Time{}, false
+	}
+	ts, sig := nonce[:len(nonce)-24], nonce[len(nonce)-24:]
+	if !hmac.Equal([]byte(sig), []byte(a.sign(ts))) {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
+
+// useCount records a nonce count used with a fresh nonce and reports
+// whether it is new. Counts of nonces gone stale are forgotten, since
+// those nonces are refused anyway.
+func (a *DigestAuth) useCount(nonce string, nc uint32) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now := time.Now(); now.Sub(a.pruned) >= nonceTTL {
+		for n := range a.used {
+			if issued, _ := a.nonceTime(n); now.Sub(issued) >= nonceTTL {
+				delete(a.used, n)
+			}
+		}
+		a.pruned = now
+	}
+	counts := a.used[nonce]
+	if counts == nil {
+		counts = make(map[uint32]bool)
+		a.used[nonce] = counts
+	}
+	if counts[nc] {
+		return false
+	}
+	counts[nc] = true
+	return true
+}
+
+// Credentials finds the credentials a request carries for the realm, in
+// Authorization or Proxy-Authorization.
+func (a *DigestAuth) Credentials(req *Message) (*Credentials, error) {
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		for _, f := range req.Header {
+			if f.Name != name {
+				continue
+			}
+			c, err := ParseCredentials(f.Value)
+			if err != nil {
+				return nil, err
+			}
+			if c.Realm == a.Realm {
+				return c, nil
+			}
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// Verify checks credentials against the password of their user for a
+// request's method and Request-URI. Credentials computed for another URI,
+// or whose nonce count was already used with their nonce, are refused.
+func (a *DigestAuth) Verify(c *Credentials, method, requestURI, password string) error {
+	if c.Algorithm != "" && !strings.EqualFold(c.Algorithm, "MD5") {
+		return fmt.Errorf("%w: algorithm %s", ErrBadCredentials, c.Algorithm)
+	}
+	if !strings.EqualFold(c.QOP, "auth") {
+		// Without qop there is no nonce count to stop replays.
+		return fmt.Errorf("%w: qop %q", ErrBadCredentials, c.QOP)
+	}
+	nc, err := strconv.ParseUint(c.NC, 16, 32)
+	if err != nil || len(c.NC) != 8 {
+		return fmt.Errorf("%w: nonce count %q", ErrBadCredentials, c.NC)
+	}
+	if c.URI != requestURI {
+		return fmt.Errorf("%w: computed for %s", ErrBadCredentials, c.URI)
+	}
+	ours, fresh := a.checkNonce(c.Nonce)
+	if !ours {
+		return fmt.Errorf("%w: unknown nonce", ErrBadCredentials)
+	}
+	want := digestResponse(c, method, password)
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(c.Response))) != 1 {
+		return ErrBadCredentials
+	}
+	if !fresh {
+		return ErrStaleNonce
+	}
+	if !a.useCount(c.Nonce, uint32(nc)) {
+		return fmt.Errorf("%w: nonce count %s used before", ErrBadCredentials, c.NC)
+	}
+	return nil
+}
+
+// digestResponse computes the response the credentials should carry.
+func digestResponse(c *Credentials, method, password string) string {
+	ha1 := md5Hex(c.Username + ":" + c.Realm + ":" + password)
+	ha2 := md5Hex(method + ":" + c.URI)
+	if c.QOP == "" {
+		return md5Hex(ha1 + ":" + c.Nonce + ":" + ha2)
+	}
+	return md5Hex(ha1 + ":" + c.Nonce + ":" + c.NC + ":" + c.CNonce + ":" + c.QOP + ":" + ha2)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Credentials are the parameters of a Digest Authorization value.
+type Credentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm string
+	CNonce    string
+	QOP       string
+	NC        string
+	Opaque    string
+}
+
+// ParseCredentials reads an Authorization or Proxy-Authorization value.
+func ParseCredentials(value string) (*Credentials, error) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(value), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrMalformed, scheme)
+	}
+	c := &Credentials{}
+	for _, part := range splitOutsideQuotes(rest, ',') {
+		name, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		v = unquote(strings.TrimSpace(v))
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "username":
+			c.Username = v
+		case "realm":
+			c.Realm = v
+		case "nonce":
+			c.Nonce = v
+		case "uri":
+			c.URI = v
+		case "response":
+			c.Response = v
+		case "algorithm":
+			c.Algorithm = v
+		case "cnonce":
+			c.CNonce = v
+		case "qop":
+			c.QOP = v
+		case "nc":
+			c.NC = v
+		case "opaque":
+			c.Opaque = v
+		}
+	}
+	if c.Username == "" || c.Nonce == "" || c.Response == "" {
+		return nil, fmt.Errorf("%w: incomplete credentials", ErrMalformed)
+	}
+	return c, nil
+}
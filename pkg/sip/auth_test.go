@@ -0,0 +1,121 @@
+package sip
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// answer returns the credentials a UA would send for a challenge's nonce.
+func answer(nonce, method, uri, password, nc string) *Credentials {
+	c := &Credentials{
+		Username:  "1001",
+		Realm:     "sip.example.com",
+		Nonce:     nonce,
+		URI:       uri,
+		Algorithm: "MD5",
+		CNonce:    "0a4f113b",
+		QOP:       "auth",
+		NC:        nc,
+	}
+	c.Response = digestResponse(c, method, password)
+	return c
+}
+
+func TestDigestVerify(t *testing.T) {
+	a := NewDigestAuth("sip.example.com")
+	const uri = "sip:sip.example.com"
+	fresh := a.newNonce(time.Now())
+	stale := a.newNonce(time.Now().Add(-nonceTTL - time.Second))
+	noQOP := answer(fresh, MethodRegister, uri, "secret", "")
+	noQOP.QOP, noQOP.CNonce = "", ""
+	noQOP.Response = digestResponse(noQOP, MethodRegister, "secret")
+
+	tests := []struct {
+		name  string
+		creds *Credentials
+		uri   string
+		want  error
+	}{
+		{"good", answer(fresh, MethodRegister, uri, "secret", "00000001"), uri, nil},
+		{"wrong password", answer(fresh, MethodRegister, uri, "guess", "00000002"), uri, ErrBadCredentials},
+		{"other method", answer(fresh, MethodInvite, uri, "secret", "00000003"), uri, ErrBadCredentials},
+		{"computed for another URI", answer(fresh, MethodRegister, "sip:other.example.com", "secret", "00000004"), uri, ErrBadCredentials},
+		{"unknown nonce", answer("1234567890abcdef1234567890abcdef", MethodRegister, uri, "secret", "00000001"), uri, ErrBadCredentials},
+		{"stale nonce", answer(stale, MethodRegister, uri, "secret", "00000001"), uri, ErrStaleNonce},
+		{"no qop", noQOP, uri, ErrBadCredentials},
+		{"bad nonce count", answer(fresh, MethodRegister, uri, "secret", "1"), uri, ErrBadCredentials},
+	}
+	for _, tt := range tests {
+		if err := a.Verify(tt.creds, MethodRegister, tt.uri, "secret"); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDigestVerifyRefusesReplays(t *testing.T) {
+	a := NewDigestAuth("sip.example.com")
+	const uri = "sip:0612345678@sip.example.com"
+	nonce := a.newNonce(time.Now())
+	for i, tt := range []struct {
+		nc   string
+		want error
+	}{
+		{"00000001", nil},
+		{"00000001", ErrBadCredentials}, // replayed
+		{"00000002", nil},
+		{"00000003", nil},
+		{"00000002", ErrBadCredentials},
+	} {
+		err := a.Verify(answer(nonce, MethodInvite, uri, "secret", tt.nc), MethodInvite, uri, "secret")
+		if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("request %d with nc %s: got %v, want %v", i+1, tt.nc, err, tt.want)
+		}
+	}
+
+	// Counts are kept per nonce.
+	other := a.newNonce(time.Now().Add(-time.Second))
+	if err := a.Verify(answer(other, MethodInvite, uri, "secret", "00000001"), MethodInvite, uri, "secret"); err != nil {
+		t.Errorf("nc 00000001 on another nonce: %v", err)
+	}
+}
+
+func TestDigestForgetsStaleNonces(t *testing.T) {
+	a := NewDigestAuth("sip.example.com")
+	old := a.newNonce(time.Now().Add(-nonceTTL))
+	a.used[old] = map[uint32]bool{1: true}
+	a.useCount(a.newNonce(time.Now()), 1)
+	if _, ok := a.used[old]; ok || len(a.used) != 1 {
+		t.Errorf("counts of %d nonces kept, want only the fresh one's", len(a.used))
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	c, err := ParseCredentials(`Digest username="1001", realm="sip.example.com", nonce="abc", uri="sip:sip.example.com", response="6629fae49393a05397450978507c4ef1", algorithm=MD5, cnonce="0a4f113b", qop=auth, nc=00000001, opaque="x,y"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Credentials{
+		Username:  "1001",
+		Realm:     "sip.example.com",
+		Nonce:     "abc",
+		URI:       "sip:sip.example.com",
+		Response:  "6629fae49393a05397450978507c4ef1",
+		Algorithm: "MD5",
+		CNonce:    "0a4f113b",
+		QOP:       "auth",
+		NC:        "00000001",
+		Opaque:    "x,y",
+	}
+	if *c != want {
+		t.Errorf("got %+v, want %+v", *c, want)
+	}
+	for _, value := range []string{
+		`Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==`,
+		`Digest realm="sip.example.com", nonce="abc"`,
+	} {
+		if _, err := ParseCredentials(value); !errors.Is(err, ErrMalformed) {
+			t.Errorf("ParseCredentials(%q): got %v, want ErrMalformed", value, err)
+		}
+	}
+}
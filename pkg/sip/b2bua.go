@@ -0,0 +1,565 @@
+package sip
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// failoverCodes are the final responses after which a call is tried on
+// the next gateway: the gateway, not the callee, could not take it.
+var failoverCodes = map[int]bool{
+	408: true, // no answer from the gateway, or a transport error
+	480: true, // no free channel
+	500: true,
+	502: true,
+	503: true,
+	504: true,
+}
+
+type legSide int
+
+const (
+	legA legSide = iota // towards the caller
+	legB                // towards the gateway
+)
+
+// leg is one side of a bridged call: a dialog and where its requests go.
+type leg struct {
+	call    *Call
+	side    legSide
+	dialog  *Dialog
+	network string
+	addr    string
+}
+
+// Call is a call the B2BUA bridges: leg A with the caller, whose INVITE it
+// answers as a UAS, and leg B with a gateway, to which it sends an INVITE
+// of its own as a UAC.
+type Call struct {
+	b      *B2BUA
+	invite *Message
+	tx     *ServerTransaction
+	dest   string
+
+	mu        sync.Mutex
+	gateway   *Gateway // the gateway being tried, then the one answering
+	a, bLeg   *leg
+	bInvite   *Message
+	bTx       *ClientTransaction
+	bAck      *Message
+	cancelled bool
+	ended     bool
+}
+
+// CallID returns the caller's Call-ID.
+func (c *Call) CallID() string { return c.invite.CallID() }
+
+// B2BUA forwards calls to gateways as a back-to-back user agent: each call
+// is two dialogs, and requests on one are sent anew on the other. Every
+// message it sends carries its own Contact, and session descriptions from
+// UAs behind NAT are fixed to reach them.
+type B2BUA struct {
+	tl     *TransactionLayer
+	logger *log.Logger
+
+	mu    sync.Mutex
+	legs  map[string]*leg // by dialog ID
+	calls map[*Call]bool
+}
+
+// NewB2BUA creates a B2BUA sending over a transaction layer. It takes the
+// layer's stray responses, to acknowledge retransmitted 2xx.
+func NewB2BUA(tl *TransactionLayer, logger *log.Logger) *B2BUA {
+	b := &B2BUA{
+		tl:     tl,
+		logger: logger,
+		legs:   make(map[string]*leg),
+		calls:  make(map[*Call]bool),
+	}
+	tl.OnStrayResponse(b.strayResponse)
+	return b
+}
+
+// ActiveCalls returns how many calls are ringing or up on a gateway.
+func (b *B2BUA) ActiveCalls(gatewayID string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for c := range b.calls {
+		c.mu.Lock()
+		if c.gateway != nil && c.gateway.ID == gatewayID {
+			n++
+		}
+		c.mu.Unlock()
+	}
+	return n
+}
+
+// Bridge forwards an INVITE to dest through the gateways in turn, until
+// one answers or fails for a reason another would too. Provisional and
+// final responses are relayed to the caller; a CANCEL from the caller
+// cancels the outbound INVITE. It returns once the call is answered or
+// has failed.
+func (b *B2BUA) Bridge(req *Message, tx *ServerTransaction, gateways []*Gateway, dest string) {
+	if mf := req.Header.Get("Max-Forwards"); mf != "" {
+		if n, err := strconv.Atoi(mf); err == nil && n <= 0 {
+			tx.Respond(NewResponse(req, 483, ""))
+			return
+		}
+	}
+	// The caller's dialog needs a Contact to reach it by.
+	if contacts, err := req.Contacts(); err != nil || len(contacts) != 1 || contacts[0].Wildcard {
+		tx.Respond(NewResponse(req, 400, "Bad Contact"))
+		return
+	}
+	if len(gateways) == 0 {
+		tx.Respond(NewResponse(req, 503, "No Gateway Available"))
+		return
+	}
+
+	c := &Call{b: b, invite: req, tx: tx, dest: dest}
+	b.mu.Lock()
+	b.calls[c] = true
+	b.mu.Unlock()
+
+	var last *Message
+	for i, gw := range gateways {
+		resp, answered := c.try(gw)
+		if answered {
+			return
+		}
+		last = resp
+		if c.isCancelled() || !failoverCodes[resp.StatusCode] {
+			break
+		}
+		if i < len(gateways)-1 {
+			b.logger.Printf("Gateway %s answered %d for call %s, trying the next one", gw.Name, resp.StatusCode, c.CallID())
+		}
+	}
+	b.forget(c)
+	if c.isCancelled() {
+		return // the layer has answered 487
+	}
+
+	b.logger.Printf("Call %s failed: %d %s", c.CallID(), last.StatusCode, last.Reason)
+	code := last.StatusCode
+	if code == 408 && len(gateways) > 1 {
+		code = 503 // every gateway failed, not just one timing out
+	}
+	resp := NewResponse(req, code, "")
+	if code == last.StatusCode {
+		resp.Reason = last.Reason
+	}
+	tx.Respond(resp)
+}
+
+// try sends the call to one gateway and relays its provisional responses.
+// It returns the final response and whether it answered the call.
+func (c *Call) try(gw *Gateway) (*Message, bool) {
+	b := c.b
+	network, addr := gw.Network(), gw.Address()
+	if b.tl.Transport(network) == nil {
+		b.logger.Printf("No %s transport to reach gateway %s", network, gw.Name)
+		return NewResponse(c.invite, 503, ""), false
+	}
+	inv := c.newOutboundInvite(gw, network, addr)
+	bTx, err := b.tl.Request(inv, network, addr)
+	if err != nil {
+		b.logger.Printf("Error sending INVITE to gateway %s: %v", gw.Name, err)
+		return NewResponse(inv, 503, ""), false
+	}
+	c.mu.Lock()
+	c.gateway, c.bInvite, c.bTx = gw, inv, bTx
+	c.mu.Unlock()
+	b.logger.Printf("Forwarding call %s to gateway %s (%s)", c.CallID(), gw.Name, addr)
+
+	cancelled := c.tx.Cancelled()
+	for {
+		select {
+		case resp, ok := <-bTx.Responses():
+			if !ok {
+				return NewResponse(inv, 408, ""), false
+			}
+			switch code := resp.StatusCode; {
+			case code == 100:
+			case code < 200:
+				if !c.isCancelled() {
+					c.relay(resp, legB, c.tx, c.invite)
+				}
+			case code < 300:
+				if err := c.answer(resp, network, addr); err != nil {
+					b.logger.Printf("Error answering call %s: %v", c.CallID(), err)
+					return NewResponse(inv, 500, ""), false
+				}
+				go c.absorb(bTx)
+				return resp, true
+			default:
+				return resp, false
+			}
+		case <-cancelled:
+			cancelled = nil
+			c.mu.Lock()
+			c.cancelled = true
+			c.mu.Unlock()
+			b.logger.Printf("Call %s cancelled by the caller", c.CallID())
+			if err := bTx.Cancel(); err != nil {
+				b.logger.Printf("Error cancelling call %s on gateway %s: %v", c.CallID(), gw.Name, err)
+			}
+		}
+	}
+}
+
+func (c *Call) isCancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled
+}
+
+// newOutboundInvite builds leg B's INVITE: the caller's identity and
+// session, to dest at the gateway.
+func (c *Call) newOutboundInvite(gw *Gateway, network, addr string) *Message {
+	target := &URI{Scheme: "sip", User: c.dest, Host: gw.SIPEndpoint, Port: gw.SIPPort}
+	if network != "UDP" {
+		target.Params.Set("transport", strings.ToLower(network))
+	}
+	from := &Address{URI: &URI{Scheme: "sip", Host: gw.SIPEndpoint}}
+	if caller, err := c.invite.From(); err == nil {
+		from = &Address{DisplayName: caller.DisplayName, URI: caller.URI.Clone()}
+	}
+	from.Params.Set("tag", NewTag())
+	to := &Address{URI: target.Clone()}
+
+	t := c.b.tl.Transport(network)
+	host, _ := c.b.tl.SentBy(t, addr)
+	inv := NewRequest(MethodInvite, target, from, to, NewCallID(host), 1)
+	if mf, err := strconv.Atoi(c.invite.Header.Get("Max-Forwards")); err == nil {
+		inv.Header.Set("Max-Forwards", strconv.Itoa(mf-1))
+	}
+	inv.Header.Add("Contact", (&Address{URI: c.b.tl.ContactURI(t, addr, "")}).String())
+	copyBody(inv, c.invite, hostOf(c.tx.Source().Addr))
+	return inv
+}
+
+// copyBody gives a message the body of another, with its media fixed for
+// a sender seen at seenHost.
+func copyBody(dst, src *Message, seenHost string) {
+	if len(src.Body) == 0 {
+		return
+	}
+	if ct := src.Header.Get("Content-Type"); ct != "" {
+		dst.Header.Set("Content-Type", ct)
+	}
+	dst.Body = fixSDP(src.Body, seenHost)
+}
+
+// relay answers req on a leg with a response received on the other one,
+// from side. It fails when req's transaction has its final response
+// already, as a cancelled INVITE has.
+func (c *Call) relay(resp *Message, from legSide, tx *ServerTransaction, req *Message) (*Message, error) {
+	out := NewResponse(req, resp.StatusCode, resp.Reason)
+	if resp.StatusCode > 100 && resp.StatusCode < 300 && req.Method == MethodInvite {
+		src := tx.Source()
+		out.Header.Add("Contact", (&Address{URI: c.b.tl.ContactURI(src.Transport, src.Addr, "")}).String())
+	}
+	copyBody(out, resp, c.seenHost(from))
+	return out, tx.Respond(out)
+}
+
+// seenHost returns the host a leg's peer sends from.
+func (c *Call) seenHost(side legSide) string {
+	if side == legA {
+		return hostOf(c.tx.Source().Addr)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bLeg != nil {
+		return hostOf(c.bLeg.addr)
+	}
+	if c.gateway != nil {
+		return c.gateway.SIPEndpoint
+	}
+	return ""
+}
+
+// answer sets up both dialogs on leg B's 2xx: leg B is acknowledged and
+// the caller gets a 200 of its own. A call cancelled meanwhile is hung up
+// on the gateway.
+func (c *Call) answer(resp *Message, network, addr string) error {
+	b := c.b
+	bd, err := NewUACDialog(c.bInvite, resp)
+	if err != nil {
+		return err
+	}
+	bLeg := &leg{call: c, side: legB, dialog: bd}
+	bLeg.network, bLeg.addr = nextHop(bd, network, addr)
+	ack := bd.NewAck(1)
+	if err := b.tl.Send(ack, bLeg.network, bLeg.addr); err != nil {
+		b.logger.Printf("Error sending ACK for call %s: %v", c.CallID(), err)
+	}
+
+	c.mu.Lock()
+	c.bLeg, c.bAck = bLeg, ack
+	cancelled := c.cancelled
+	c.mu.Unlock()
+	b.addLeg(bLeg)
+
+	if cancelled {
+		// The 2xx crossed the CANCEL: the caller has its 487.
+		c.hangup(legA)
+		return nil
+	}
+
+	out, err := c.relay(resp, legB, c.tx, c.invite)
+	if err != nil {
+		// The caller cancelled as the gateway answered.
+		c.hangup(legA)
+		return nil
+	}
+	ad, err := NewUASDialog(c.invite, out)
+	if err != nil {
+		c.hangup(legA)
+		return err
+	}
+	src := c.tx.Source()
+	aLeg := &leg{call: c, side: legA, dialog: ad, network: src.Transport.Network(), addr: src.Addr}
+	c.mu.Lock()
+	c.a = aLeg
+	c.mu.Unlock()
+	b.addLeg(aLeg)
+	b.logger.Printf("Call %s answered by gateway %s", c.CallID(), c.gateway.Name)
+
+	go func() {
+		<-c.tx.Done()
+		if c.tx.Err() == ErrNoAck {
+			b.logger.Printf("Caller never acknowledged call %s, hanging up", c.CallID())
+			c.hangup(-1)
+		}
+	}()
+	return nil
+}
+
+// nextHop returns where a dialog's requests go. Its next hop is reached
+// over the network the dialog was set up on unless it names a transport,
+// as a gateway's Contact over TCP often does not.
+func nextHop(d *Dialog, network, addr string) (string, string) {
+	hop := d.NextHop()
+	if hop == nil {
+		return network, addr
+	}
+	if _, ok := hop.Params.Get("transport"); ok || hop.Scheme == "sips" {
+		return hop.Transport(), hop.HostPort()
+	}
+	port := hop.Port
+	if port == 0 {
+		port = DefaultPort(network)
+	}
+	return network, joinHostPort(hop.Host, port)
+}
+
+// absorb acknowledges the 2xx leg B's INVITE transaction still delivers:
+// retransmissions get the ACK again, forked answers are hung up.
+func (c *Call) absorb(bTx *ClientTransaction) {
+	for resp := range bTx.Responses() {
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			continue
+		}
+		c.reack(resp)
+	}
+}
+
+// reack answers a 2xx of leg B's INVITE received again.
+func (c *Call) reack(resp *Message) {
+	b := c.b
+	c.mu.Lock()
+	bLeg, ack := c.bLeg, c.bAck
+	c.mu.Unlock()
+	to, err := resp.To()
+	if err != nil || bLeg == nil {
+		return
+	}
+	if to.Tag() == bLeg.dialog.RemoteTag {
+		b.tl.Transport(bLeg.network).Send(bLeg.addr, ack)
+		return
+	}
+	// Another branch answered too: it is acknowledged and hung up.
+	fork, err := NewUACDialog(c.bInvite, resp)
+	if err != nil {
+		return
+	}
+	network, addr := nextHop(fork, bLeg.network, bLeg.addr)
+	b.tl.Send(fork.NewAck(1), network, addr)
+	if _, err := b.tl.Request(fork.NewRequest(MethodBye), network, addr); err != nil {
+		b.logger.Printf("Error hanging up forked answer for call %s: %v", c.CallID(), err)
+	}
+}
+
+// strayResponse acknowledges a 2xx retransmitted after leg B's INVITE
+// transaction has ended.
+func (b *B2BUA) strayResponse(resp *Message, src Source) {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || resp.CSeqMethod() != MethodInvite {
+		return
+	}
+	from, err := resp.From()
+	if err != nil {
+		return
+	}
+	to, err := resp.To()
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	l := b.legs[dialogID(resp.CallID(), from.Tag(), to.Tag())]
+	b.mu.Unlock()
+	if l != nil && l.side == legB {
+		l.call.reack(resp)
+	}
+}
+
+// HandleInDialog takes a request in the dialog of a bridged call: BYE
+// hangs up both legs, other requests are sent on the other leg and their
+// response relayed back once it comes, without waiting for it. tx is nil
+// for an ACK, which is absorbed. It reports whether the request belonged
+// to a call.
+func (b *B2BUA) HandleInDialog(req *Message, tx *ServerTransaction) bool {
+	from, err := req.From()
+	if err != nil {
+		return false
+	}
+	to, err := req.To()
+	if err != nil || to.Tag() == "" {
+		return false
+	}
+	b.mu.Lock()
+	l := b.legs[dialogID(req.CallID(), to.Tag(), from.Tag())]
+	b.mu.Unlock()
+	if l == nil {
+		return false
+	}
+	c := l.call
+
+	if err := l.dialog.Receive(req); err != nil {
+		if tx != nil {
+			tx.Respond(NewResponse(req, 500, "Out Of Order"))
+		}
+		return true
+	}
+	if tx == nil {
+		return true
+	}
+	if req.Method == MethodBye {
+		tx.Respond(NewResponse(req, 200, ""))
+		b.logger.Printf("Call %s hung up by the %s", c.CallID(), l.side)
+		c.hangup(l.side)
+		return true
+	}
+
+	other := c.other(l.side)
+	if other == nil {
+		tx.Respond(NewResponse(req, 481, ""))
+		return true
+	}
+	out := other.dialog.NewRequest(req.Method)
+	if req.Method == MethodInvite || req.Method == MethodUpdate {
+		t := b.tl.Transport(other.network)
+		out.Header.Add("Contact", (&Address{URI: b.tl.ContactURI(t, other.addr, "")}).String())
+	}
+	copyBody(out, req, c.seenHost(l.side))
+	otx, err := b.tl.Request(out, other.network, other.addr)
+	if err != nil {
+		tx.Respond(NewResponse(req, 503, ""))
+		return true
+	}
+	go func() {
+		for resp := range otx.Responses() {
+			if resp.StatusCode < 200 {
+				continue
+			}
+			if resp.StatusCode < 300 && out.Method == MethodInvite {
+				other.dialog.Confirm(resp)
+				n, _, _ := out.CSeq()
+				b.tl.Send(other.dialog.NewAck(n), other.network, other.addr)
+			}
+			c.relay(resp, other.side, tx, req)
+			return
+		}
+		// The other leg's transaction ended without a final response
+		// reaching us; the request must not wait for its own to time out.
+		code := 408
+		if err := otx.Err(); err != nil && !errors.Is(err, ErrTimeout) {
+			code = 500
+		}
+		tx.Respond(NewResponse(req, code, ""))
+	}()
+	return true
+}
+
+// String names a leg's peer for logs.
+func (s legSide) String() string {
+	if s == legA {
+		return "caller"
+	}
+	return "gateway"
+}
+
+// other returns the leg facing the other way, nil if not set up.
+func (c *Call) other(side legSide) *leg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if side == legA {
+		return c.bLeg
+	}
+	return c.a
+}
+
+// hangup ends the call, sending BYE on the legs but the one it was hung
+// up from.
+func (c *Call) hangup(from legSide) {
+	b := c.b
+	c.mu.Lock()
+	if c.ended {
+		c.mu.Unlock()
+		return
+	}
+	c.ended = true
+	legs := []*leg{c.a, c.bLeg}
+	c.mu.Unlock()
+
+	for _, l := range legs {
+		if l == nil {
+			continue
+		}
+		b.removeLeg(l)
+		if l.side == from {
+			continue
+		}
+		bye := l.dialog.NewRequest(MethodBye)
+		if _, err := b.tl.Request(bye, l.network, l.addr); err != nil {
+			b.logger.Printf("Error sending BYE to the %s of call %s: %v", l.side, c.CallID(), err)
+		}
+	}
+	b.forget(c)
+}
+
+func (b *B2BUA) addLeg(l *leg) {
+	b.mu.Lock()
+	b.legs[l.dialog.ID()] = l
+	b.mu.Unlock()
+}
+
+func (b *B2BUA) removeLeg(l *leg) {
+	l.dialog.Terminate()
+	b.mu.Lock()
+	if b.legs[l.dialog.ID()] == l {
+		delete(b.legs, l.dialog.ID())
+	}
+	b.mu.Unlock()
+}
+
+func (b *B2BUA) forget(c *Call) {
+	b.mu.Lock()
+	delete(b.calls, c)
+	b.mu.Unlock()
+}
@@ -0,0 +1,278 @@
+package sip
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	callerAddr = "192.0.2.10:5060"
+	gw1Addr    = "192.0.2.20:5060"
+	gw2Addr    = "192.0.2.21:5060"
+)
+
+var (
+	gw1 = &Gateway{ID: "gw1", Name: "gw1", SIPEndpoint: "192.0.2.20", SIPPort: 5060, Transport: "tcp"}
+	gw2 = &Gateway{ID: "gw2", Name: "gw2", SIPEndpoint: "192.0.2.21", SIPPort: 5060, Transport: "tcp"}
+)
+
+// b2buaTest runs a B2BUA over a fake TCP transport, with a caller at
+// callerAddr and gateways answering from their addresses.
+type b2buaTest struct {
+	t         *testing.T
+	tl        *TransactionLayer
+	transport *fakeTransport
+	b         *B2BUA
+	invite    *Message      // the caller's INVITE
+	bridged   chan struct{} // closed when Bridge returns
+}
+
+// newB2BUATest starts a call from the caller through gateways.
+func newB2BUATest(t *testing.T, gateways ...*Gateway) *b2buaTest {
+	tl, transport := newTestLayer(true)
+	h := &b2buaTest{
+		t:         t,
+		tl:        tl,
+		transport: transport,
+		b:         NewB2BUA(tl, log.New(io.Discard, "", 0)),
+		bridged:   make(chan struct{}),
+	}
+	tl.OnRequest(func(req *Message, tx *ServerTransaction) {
+		if h.b.HandleInDialog(req, tx) || tx == nil {
+			return
+		}
+		go func() {
+			h.b.Bridge(req, tx, gateways, "0612345678")
+			close(h.bridged)
+		}()
+	})
+
+	inv, err := Parse(crlf(
+		"INVITE sip:0612345678@198.51.100.1 SIP/2.0",
+		"Via: SIP/2.0/TCP "+callerAddr+";branch="+BranchPrefix+"call",
+		"Max-Forwards: 70",
+		"From: <sip:alice@example.com>;tag=a1",
+		"To: <sip:0612345678@198.51.100.1>",
+		"Call-ID: call1@192.0.2.10",
+		"CSeq: 1 INVITE",
+		"Contact: <sip:alice@"+callerAddr+";transport=tcp>",
+		"",
+		"",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.invite = inv
+	h.fromCaller(inv)
+	return h
+}
+
+func (h *b2buaTest) fromCaller(req *Message) {
+	h.tl.Receive(req, Source{Transport: h.transport, Addr: callerAddr})
+}
+
+// respond answers a request the B2BUA sent to a gateway at addr, with To
+// tag g1; 2xx carry the gateway's Contact.
+func (h *b2buaTest) respond(req *Message, addr string, code int) *Message {
+	resp := NewResponse(req, code, "")
+	to, err := resp.To()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	to.Params.Set("tag", "g1")
+	resp.Header.Set("To", to.String())
+	if code >= 200 && code < 300 && req.Method == MethodInvite {
+		resp.Header.Add("Contact", "<sip:0612345678@"+addr+">")
+	}
+	h.tl.Receive(resp, Source{Transport: h.transport, Addr: addr})
+	return resp
+}
+
+// expect waits for the messages sent to addr to be want, by summary, and
+// returns them.
+func (h *b2buaTest) expect(addr string, want ...string) []*Message {
+	h.t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		sent := h.transport.sentTo(addr)
+		if len(sent) >= len(want) || time.Now().After(deadline) {
+			var got []string
+			for _, m := range sent {
+				got = append(got, summary(m))
+			}
+			if strings.Join(got, ", ") != strings.Join(want, ", ") {
+				h.t.Fatalf("sent to %s: %v, want %v", addr, got, want)
+			}
+			return sent
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// inDialog builds a request a peer sends in its dialog with the B2BUA;
+// from and to are its From and To, tags included.
+func inDialog(t *testing.T, method, callID, from, to, sentBy string, cseq int) *Message {
+	t.Helper()
+	m, err := Parse(crlf(
+		method+" sip:198.51.100.1:5060;transport=tcp SIP/2.0",
+		"Via: SIP/2.0/TCP "+sentBy+";branch="+BranchPrefix+NewTag(),
+		"Max-Forwards: 70",
+		"From: "+from,
+		"To: "+to,
+		"Call-ID: "+callID,
+		fmt.Sprintf("CSeq: %d %s", cseq, method),
+		"Contact: <sip:"+sentBy+";transport=tcp>",
+		"",
+		"",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// answered sets up a call answered by gw1. It returns the INVITE gw1 got,
+// its 200 and the 200 the caller got.
+func answered(t *testing.T) (h *b2buaTest, gwInvite, gwOK, callerOK *Message) {
+	h = newB2BUATest(t, gw1)
+	gwInvite = h.expect(gw1Addr, "INVITE")[0]
+	gwOK = h.respond(gwInvite, gw1Addr, 200)
+	callerOK = h.expect(callerAddr, "100 INVITE", "200 INVITE")[1]
+	h.expect(gw1Addr, "INVITE", "ACK")
+	h.fromCaller(inDialog(t, MethodAck, h.invite.CallID(), h.invite.Header.Get("From"), callerOK.Header.Get("To"), callerAddr, 1))
+	<-h.bridged
+	return h, gwInvite, gwOK, callerOK
+}
+
+func TestB2BUAFailsOverOn503(t *testing.T) {
+	h := newB2BUATest(t, gw1, gw2)
+	first := h.expect(gw1Addr, "INVITE")[0]
+	h.respond(first, gw1Addr, 503)
+	h.expect(gw1Addr, "INVITE", "ACK")
+
+	second := h.expect(gw2Addr, "INVITE")[0]
+	if second.CallID() == first.CallID() {
+		t.Error("the next gateway got the same Call-ID")
+	}
+	h.respond(second, gw2Addr, 180)
+	h.respond(second, gw2Addr, 200)
+	h.expect(gw2Addr, "INVITE", "ACK")
+	// The caller never hears of the 503.
+	h.expect(callerAddr, "100 INVITE", "180 INVITE", "200 INVITE")
+	<-h.bridged
+	if n := h.b.ActiveCalls("gw2"); n != 1 {
+		t.Errorf("%d calls on gw2, want 1", n)
+	}
+	if n := h.b.ActiveCalls("gw1"); n != 0 {
+		t.Errorf("%d calls on gw1, want 0", n)
+	}
+}
+
+func TestB2BUADoesNotFailOverOnBusy(t *testing.T) {
+	h := newB2BUATest(t, gw1, gw2)
+	h.respond(h.expect(gw1Addr, "INVITE")[0], gw1Addr, 486)
+	h.expect(callerAddr, "100 INVITE", "486 INVITE")
+	<-h.bridged
+	if sent := h.transport.sentTo(gw2Addr); len(sent) != 0 {
+		t.Errorf("the next gateway was tried after a 486")
+	}
+}
+
+func TestB2BUACancelCrossing200(t *testing.T) {
+	h := newB2BUATest(t, gw1)
+	inv := h.expect(gw1Addr, "INVITE")[0]
+	h.respond(inv, gw1Addr, 180)
+	h.expect(callerAddr, "100 INVITE", "180 INVITE")
+
+	cancel := h.invite.Clone()
+	cancel.Method = MethodCancel
+	cancel.Header.Set("CSeq", "1 CANCEL")
+	cancel.Header.Del("Contact")
+	h.fromCaller(cancel)
+	h.expect(callerAddr, "100 INVITE", "180 INVITE", "200 CANCEL", "487 INVITE")
+	h.expect(gw1Addr, "INVITE", "CANCEL")
+
+	// The gateway answered before it got the CANCEL: the call is
+	// acknowledged and hung up there, and the caller keeps its 487.
+	h.respond(inv, gw1Addr, 200)
+	h.expect(gw1Addr, "INVITE", "CANCEL", "ACK", "BYE")
+	<-h.bridged
+	h.expect(callerAddr, "100 INVITE", "180 INVITE", "200 CANCEL", "487 INVITE")
+	if n := h.b.ActiveCalls("gw1"); n != 0 {
+		t.Errorf("%d calls on gw1 after the CANCEL, want 0", n)
+	}
+}
+
+func TestB2BUAByeFromCaller(t *testing.T) {
+	h, _, _, callerOK := answered(t)
+	bye := inDialog(t, MethodBye, h.invite.CallID(), h.invite.Header.Get("From"), callerOK.Header.Get("To"), callerAddr, 2)
+	h.fromCaller(bye)
+	h.expect(callerAddr, "100 INVITE", "200 INVITE", "200 BYE")
+	h.expect(gw1Addr, "INVITE", "ACK", "BYE")
+	if n := h.b.ActiveCalls("gw1"); n != 0 {
+		t.Errorf("%d calls on gw1 after BYE, want 0", n)
+	}
+	// The call is gone: another BYE is not the B2BUA's.
+	if h.b.HandleInDialog(inDialog(t, MethodBye, h.invite.CallID(), h.invite.Header.Get("From"), callerOK.Header.Get("To"), callerAddr, 3), nil) {
+		t.Error("request in a hung up call taken")
+	}
+}
+
+func TestB2BUAByeFromGateway(t *testing.T) {
+	h, gwInvite, gwOK, _ := answered(t)
+	bye := inDialog(t, MethodBye, gwInvite.CallID(), gwOK.Header.Get("To"), gwInvite.Header.Get("From"), gw1Addr, 1)
+	h.tl.Receive(bye, Source{Transport: h.transport, Addr: gw1Addr})
+	h.expect(gw1Addr, "INVITE", "ACK", "200 BYE")
+	sent := h.expect(callerAddr, "100 INVITE", "200 INVITE", "BYE")
+	if got := sent[2].CallID(); got != h.invite.CallID() {
+		t.Errorf("BYE sent in call %s, want the caller's", got)
+	}
+	if n := h.b.ActiveCalls("gw1"); n != 0 {
+		t.Errorf("%d calls on gw1 after BYE, want 0", n)
+	}
+}
+
+func TestB2BUARelaysReInvite(t *testing.T) {
+	h, gwInvite, _, callerOK := answered(t)
+	reinvite := inDialog(t, MethodInvite, h.invite.CallID(), h.invite.Header.Get("From"), callerOK.Header.Get("To"), callerAddr, 2)
+	h.fromCaller(reinvite)
+
+	out := h.expect(gw1Addr, "INVITE", "ACK", "INVITE")[2]
+	if out.CallID() != gwInvite.CallID() {
+		t.Errorf("re-INVITE sent in call %s, want the gateway's", out.CallID())
+	}
+	if n, _, _ := out.CSeq(); n != 2 {
+		t.Errorf("re-INVITE CSeq %d, want 2", n)
+	}
+	h.respond(out, gw1Addr, 200)
+	acks := h.expect(gw1Addr, "INVITE", "ACK", "INVITE", "ACK")
+	if n, _, _ := acks[3].CSeq(); n != 2 {
+		t.Errorf("re-INVITE ACKed with CSeq %d, want 2", n)
+	}
+	sent := h.expect(callerAddr, "100 INVITE", "200 INVITE", "100 INVITE", "200 INVITE")
+	if n, _, _ := sent[3].CSeq(); n != 2 || sent[3].CallID() != h.invite.CallID() {
+		t.Errorf("re-INVITE answered as %s", sent[3].Summary())
+	}
+}
+
+func TestB2BUAAcksRetransmitted2xx(t *testing.T) {
+	h, _, gwOK, _ := answered(t)
+	h.tl.Receive(gwOK.Clone(), Source{Transport: h.transport, Addr: gw1Addr})
+	h.expect(gw1Addr, "INVITE", "ACK", "ACK")
+
+	// A 2xx from another branch is acknowledged and hung up.
+	fork := gwOK.Clone()
+	to, _ := fork.To()
+	to.Params.Set("tag", "g2")
+	fork.Header.Set("To", to.String())
+	h.tl.Receive(fork, Source{Transport: h.transport, Addr: gw1Addr})
+	h.expect(gw1Addr, "INVITE", "ACK", "ACK", "ACK", "BYE")
+
+	// Neither reaches the caller.
+	time.Sleep(10 * time.Millisecond)
+	h.expect(callerAddr, "100 INVITE", "200 INVITE")
+}
@@ -1,9 +1,10 @@
 package sip
 
 import (
+    "crypto/tls"
     "fmt"
     "log"
-    "net"
+    "strconv"
     "strings"
     
     "github.com/e173-gateway/e173_go_gateway/pkg/validation"
@@ -11,7 +12,15 @@ import (
 
 // BasicSIPServer handles SIP calls with custom routing logic
 type BasicSIPServer struct {
-    listener   net.PacketConn
+    transports []Transport
+    tcp        bool
+    tlsPort    int
+    tlsConfig  *tls.Config
+    tl         *TransactionLayer
+    dialogs    *Dialogs
+    registrar  *Registrar
+    trusted    map[string]bool // hosts that may place calls when there is no registrar
+    b2bua      *B2BUA
     port       int
     filterEng  *FilterEngine
     routingEng *RoutingEngine
@@ -19,10 +28,17 @@ type BasicSIPServer struct {
     logger     *log.Logger
 }
 
+// WhatsAppChecker tells whether a number looks like a real person's from
+// its WhatsApp presence; validation.PrivateWhatsAppValidator and
+// validation.PrivateWhatsAppValidatorDB both are.
+type WhatsAppChecker interface {
+    IsLikelyRealPerson(phoneNumber string) (bool, float64, error)
+}
+
 // FilterEngine processes calls through multiple validation layers
 type FilterEngine struct {
     blacklistSvc    *BlacklistService
-    whatsappAPI     *validation.PrivateWhatsAppValidator
+    whatsappAPI     WhatsAppChecker
     phoneValidator  *validation.GooglePhoneValidator
     historyAnalyzer *CallHistoryAnalyzer
     operatorDetector *OperatorPrefixDetector
@@ -32,8 +48,6 @@ type FilterEngine struct {
 type RoutingEngine struct {
     gatewayPool    *GatewayPool
     stickyRoutes   map[string]string
-    loadBalancer   *LoadBalancer
-    failoverMgr    *FailoverManager
 }
 
 // FilterResult contains the decision from filtering pipeline
@@ -51,7 +65,73 @@ type Gateway struct {
     Name        string `json:"name"`
     SIPEndpoint string `json:"sip_endpoint"`
     SIPPort     int    `json:"sip_port"`
-    IsHealthy   func() bool
+    Transport   string `json:"transport"` // UDP, TCP or TLS; UDP when empty
+    Weight      int    `json:"weight"`    // share of calls among gateways of its priority; 1 when unset
+    Priority    int    `json:"priority"`  // lower first; higher ones take calls when those are down
+}
+
+// Network returns the transport calls reach the gateway over
+func (g *Gateway) Network() string {
+    if g.Transport == "" {
+        return "UDP"
+    }
+    return strings.ToUpper(g.Transport)
+}
+
+// Address returns the gateway's SIP host:port
+func (g *Gateway) Address() string {
+    port := g.SIPPort
+    if port == 0 {
+        port = DefaultPort(g.Network())
+    }
+    return joinHostPort(g.SIPEndpoint, port)
+}
+
+// weight returns the gateway's weight, 1 when unset
+func (g *Gateway) weight() int {
+    if g.Weight <= 0 {
+        return 1
+    }
+    return g.Weight
+}
+
+// ParseGateways reads a comma-separated list of gateway host:port
+// addresses, as given on the command line; ";transport=tcp" or
+// ";transport=tls" after an address reaches it over that transport. Each
+// gateway gets the priority of its place in the list, so the first takes
+// the calls while it is up
+func ParseGateways(list string) ([]*Gateway, error) {
+    var gateways []*Gateway
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        addr, params, _ := strings.Cut(entry, ";")
+        transport := ""
+        if params != "" {
+            name, value, _ := strings.Cut(params, "=")
+            value = strings.ToUpper(strings.TrimSpace(value))
+            if !strings.EqualFold(strings.TrimSpace(name), "transport") || (value != "UDP" && value != "TCP" && value != "TLS") {
+                return nil, fmt.Errorf("bad gateway parameter %q", params)
+            }
+            transport = value
+        }
+        host, port, err := splitHostPort(addr)
+        if err != nil {
+            return nil, fmt.Errorf("bad gateway address %q: %w", addr, err)
+        }
+        n := len(gateways) + 1
+        gateways = append(gateways, &Gateway{
+            ID:          "gw-" + strconv.Itoa(n),
+            Name:        fmt.Sprintf("Gateway %d", n),
+            SIPEndpoint: host,
+            SIPPort:     port,
+            Transport:   transport,
+            Priority:    n - 1,
+        })
+    }
+    return gateways, nil
 }
 
 
@@ -69,18 +149,6 @@ type OperatorPrefixDetector struct {
     // TODO: Implement database-backed operator detection
 }
 
-type GatewayPool struct {
-    // TODO: Implement database-backed gateway management
-}
-
-type LoadBalancer struct {
-    // TODO: Implement intelligent load balancing
-}
-
-type FailoverManager struct {
-    // TODO: Implement failover logic
-}
-
 type VoiceAIService struct {
     // TODO: Implement AI voice agent integration
 }
@@ -92,67 +160,211 @@ func NewBasicSIPServer(port int, whatsappAPIKey string) *BasicSIPServer {
         filterEng:  NewFilterEngine(whatsappAPIKey),
         routingEng: NewRoutingEngine(),
         voiceAI:    NewVoiceAIService(),
+        dialogs:    NewDialogs(),
         logger:     log.New(log.Writer(), "[SIP] ", log.LstdFlags),
     }
 }
 
-// Start begins listening for SIP packets
+// SetTrustedHosts sets the addresses allowed to place calls when the
+// server has no registrar to authenticate callers; call it before Start
+func (s *BasicSIPServer) SetTrustedHosts(hosts []string) {
+    s.trusted = make(map[string]bool)
+    for _, host := range hosts {
+        if host = strings.TrimSpace(host); host != "" {
+            s.trusted[host] = true
+        }
+    }
+}
+
+// EnableTCP makes the server listen for TCP on its port as well as UDP;
+// call it before Start
+func (s *BasicSIPServer) EnableTCP() {
+    s.tcp = true
+}
+
+// EnableTLS makes the server listen for TLS on a port of its own, usually
+// 5061, and reach TLS gateways with the same configuration; call it before
+// Start
+func (s *BasicSIPServer) EnableTLS(port int, config *tls.Config) {
+    s.tlsPort = port
+    s.tlsConfig = config
+}
+
+// Start begins listening for SIP messages; it returns when the server stops
 func (s *BasicSIPServer) Start() error {
-    addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", s.port))
+    udp, err := ListenUDP(fmt.Sprintf(":%d", s.port), s.logger)
     if err != nil {
-        return fmt.Errorf("failed to resolve UDP address: %w", err)
+        return err
     }
+    s.transports = []Transport{udp}
 
-    conn, err := net.ListenUDP("udp", addr)
-    if err != nil {
-        return fmt.Errorf("failed to listen on UDP: %w", err)
+    if s.tcp {
+        tcp, err := ListenTCP(fmt.Sprintf(":%d", s.port), s.logger)
+        if err != nil {
+            s.closeTransports()
+            return err
+        }
+        s.transports = append(s.transports, tcp)
+    }
+    if s.tlsConfig != nil {
+        tlsTransport, err := ListenTLS(fmt.Sprintf(":%d", s.tlsPort), s.tlsConfig, s.logger)
+        if err != nil {
+            s.closeTransports()
+            return err
+        }
+        s.transports = append(s.transports, tlsTransport)
     }
 
-    s.listener = conn
-    s.logger.Printf("Starting SIP server on port %d", s.port)
+    s.tl = NewTransactionLayer(s.logger)
+    for _, t := range s.transports {
+        s.tl.AddTransport(t)
+    }
+    s.tl.OnRequest(s.handleRequest)
+    s.b2bua = NewB2BUA(s.tl, s.logger)
+    s.routingEng.gatewayPool.Start(s.tl, s.b2bua.ActiveCalls)
+    for _, t := range s.transports {
+        s.logger.Printf("Starting SIP server on %s %s", t.Network(), t.LocalAddr())
+    }
 
-    // Start handling packets
-    buffer := make([]byte, 4096)
-    for {
-        n, clientAddr, err := conn.ReadFromUDP(buffer)
-        if err != nil {
-            s.logger.Printf("Error reading UDP packet: %v", err)
-            continue
+    if s.registrar != nil {
+        s.registrar.Start()
+    }
+
+    // Stream transports serve in the background, UDP until Stop
+    for _, t := range s.transports[1:] {
+        go func(t Transport) {
+            if err := t.Serve(s.tl.Receive); err != nil {
+                s.logger.Printf("%s transport stopped: %v", t.Network(), err)
+            }
+        }(t)
+    }
+    return udp.Serve(s.tl.Receive)
+}
+
+// Stop closes the SIP transports
+func (s *BasicSIPServer) Stop() error {
+    if s.registrar != nil {
+        s.registrar.Stop()
+    }
+    s.routingEng.gatewayPool.Stop()
+    return s.closeTransports()
+}
+
+func (s *BasicSIPServer) closeTransports() error {
+    var firstErr error
+    for _, t := range s.transports {
+        if err := t.Close(); err != nil && firstErr == nil {
+            firstErr = err
         }
+    }
+    return firstErr
+}
+
+// SetRegistrar makes the server accept REGISTER and authenticate calls
+// from customers' SIP accounts; set it before Start
+func (s *BasicSIPServer) SetRegistrar(registrar *Registrar) {
+    s.registrar = registrar
+}
+
+// handleRequest dispatches a new request; tx is nil for the ACK of a 2xx
+func (s *BasicSIPServer) handleRequest(req *Message, tx *ServerTransaction) {
+    s.logger.Printf("Received %s", req.Summary())
 
-        // Process SIP message in goroutine
-        go s.handleSIPMessage(buffer[:n], clientAddr)
+    // Requests in a bridged call go to its other leg
+    if s.b2bua.HandleInDialog(req, tx) {
+        return
+    }
+
+    if tx == nil {
+        if dialog := s.dialogs.Match(req); dialog != nil {
+            dialog.Receive(req)
+        }
+        return
+    }
+
+    switch req.Method {
+    case MethodInvite:
+        if to, err := req.To(); err == nil && to.Tag() != "" {
+            s.handleReInvite(req, tx)
+            return
+        }
+        // Authenticating, filtering and bridging wait on the database and
+        // the gateways, so the INVITE is handled on its own and the caller's
+        // connection is read meanwhile, e.g. for a CANCEL
+        go s.handleInvite(req, tx)
+    case MethodBye:
+        s.handleBye(req, tx)
+    case MethodRegister:
+        if s.registrar == nil {
+            s.notImplemented(req, tx)
+            return
+        }
+        s.registrar.HandleRegister(req, tx)
+    case MethodOptions:
+        resp := NewResponse(req, 200, "")
+        resp.Header.Add("Allow", s.allowedMethods())
+        resp.Header.Add("Accept", "application/sdp")
+        tx.Respond(resp)
+    default:
+        s.notImplemented(req, tx)
     }
 }
 
-// handleSIPMessage processes incoming SIP messages
-func (s *BasicSIPServer) handleSIPMessage(data []byte, clientAddr *net.UDPAddr) {
-    message := string(data)
-    s.logger.Printf("Received SIP message from %s:\n%s", clientAddr, message)
+// notImplemented answers methods the server does not handle
+func (s *BasicSIPServer) notImplemented(req *Message, tx *ServerTransaction) {
+    s.logger.Printf("Unhandled SIP method: %s", req.Method)
+    resp := NewResponse(req, 501, "")
+    resp.Header.Add("Allow", s.allowedMethods())
+    tx.Respond(resp)
+}
 
-    // Parse basic SIP message
-    if strings.HasPrefix(message, "INVITE") {
-        s.handleInvite(message, clientAddr)
-    } else if strings.HasPrefix(message, "BYE") {
-        s.handleBye(message, clientAddr)
-    } else if strings.HasPrefix(message, "CANCEL") {
-        s.handleCancel(message, clientAddr)
-    } else {
-        s.logger.Printf("Unhandled SIP method: %s", strings.Split(message, " ")[0])
+// allowedMethods lists the methods the server handles, for Allow headers
+func (s *BasicSIPServer) allowedMethods() string {
+    if s.registrar != nil {
+        return "INVITE, ACK, CANCEL, BYE, OPTIONS, REGISTER"
     }
+    return "INVITE, ACK, CANCEL, BYE, OPTIONS"
 }
 
 // handleInvite processes INVITE requests
-func (s *BasicSIPServer) handleInvite(message string, clientAddr *net.UDPAddr) {
-    // Extract call information from SIP headers
-    caller := extractSIPHeader(message, "From:")
-    destination := extractSIPHeader(message, "To:")
-    callID := extractSIPHeader(message, "Call-ID:")
+func (s *BasicSIPServer) handleInvite(req *Message, tx *ServerTransaction) {
+    from, err := req.From()
+    if err != nil {
+        tx.Respond(NewResponse(req, 400, "Bad From"))
+        return
+    }
+    to, err := req.To()
+    if err != nil {
+        tx.Respond(NewResponse(req, 400, "Bad To"))
+        return
+    }
 
-    callerNumber := extractPhoneNumber(caller)
-    destNumber := extractPhoneNumber(destination)
+    // Without a registrar nobody can be authenticated, so only trusted hosts
+    // may place calls on the gateways' SIMs
+    if s.registrar == nil && !s.trusted[hostOf(tx.Source().Addr)] {
+        s.logger.Printf("Refusing INVITE from %s: not a trusted host and no registrar", tx.Source().Addr)
+        tx.Respond(NewResponse(req, 403, "Forbidden"))
+        return
+    }
 
-    s.logger.Printf("Processing INVITE: %s -> %s (Call-ID: %s)", callerNumber, destNumber, callID)
+    // Customers' calls must carry their SIP account's credentials
+    if s.registrar != nil && !s.registrar.Trusted(tx.Source()) {
+        account := s.registrar.Authenticate(req, tx)
+        if account == nil {
+            return
+        }
+        // The caller ID must be the account's, not another customer's
+        if !ownsUser(account, from.URI.User) {
+            s.logger.Printf("Refusing INVITE from %s with SIP account %s", from.URI.User, account.Username)
+            tx.Respond(NewResponse(req, 403, "Not Your Address"))
+            return
+        }
+        s.logger.Printf("INVITE authenticated for SIP account %s", account.Username)
+    }
+
+    callerNumber := from.URI.User
+    destNumber := to.URI.User
+    s.logger.Printf("Processing INVITE: %s -> %s (Call-ID: %s)", callerNumber, destNumber, req.CallID())
 
     // Apply filtering pipeline
     filterResult := s.filterEng.ProcessCall(callerNumber, destNumber)
@@ -160,21 +372,37 @@ func (s *BasicSIPServer) handleInvite(message string, clientAddr *net.UDPAddr) {
 
     if !filterResult.Allow {
         if filterResult.RouteToAI {
-            s.routeToAI(message, clientAddr, filterResult)
+            s.routeToAI(req, tx, filterResult)
         } else {
-            s.rejectCall(message, clientAddr, filterResult.Reason)
+            s.rejectCall(req, tx, filterResult.Reason)
         }
         return
     }
 
     // Route to appropriate gateway
-    gateway := s.routingEng.SelectGateway(destNumber, filterResult.Gateway)
-    if gateway == nil {
-        s.rejectCall(message, clientAddr, "No available gateways")
+    gateways := s.routingEng.SelectGateways(destNumber, filterResult.Gateway)
+    if len(gateways) == 0 {
+        s.rejectCall(req, tx, "No available gateways")
         return
     }
 
-    s.forwardToGateway(message, clientAddr, gateway)
+    s.forwardToGateway(req, tx, gateways, destNumber)
+}
+
+// handleReInvite refreshes an established call's target
+func (s *BasicSIPServer) handleReInvite(req *Message, tx *ServerTransaction) {
+    dialog := s.dialogs.Match(req)
+    if dialog == nil {
+        tx.Respond(NewResponse(req, 481, ""))
+        return
+    }
+    if err := dialog.Receive(req); err != nil {
+        tx.Respond(NewResponse(req, 500, "Out Of Order"))
+        return
+    }
+    resp := NewResponse(req, 200, "")
+    resp.Header.Add("Contact", s.contact(tx).String())
+    tx.Respond(resp)
 }
 
 // ProcessCall applies all filtering rules
@@ -246,94 +474,85 @@ func (f *FilterEngine) detectOperator(number string) string {
     return "Unknown"
 }
 
-// SelectGateway chooses the best gateway for a call
-func (r *RoutingEngine) SelectGateway(destination, preferred string) *Gateway {
-    // Simulate gateway selection
-    return &Gateway{
-        ID:          "gw-001",
-        Name:        "Gateway 1",
-        SIPEndpoint: "192.168.1.100",
-        SIPPort:     5060,
-        IsHealthy:   func() bool { return true },
+// SelectGateways returns the live gateways a call may go to, in the
+// order to try them: those named after the preferred operator first, each
+// in the order the gateway pool gives
+func (r *RoutingEngine) SelectGateways(destination, preferred string) []*Gateway {
+    var first, rest []*Gateway
+    for _, gw := range r.gatewayPool.Select() {
+        if preferred != "" && strings.Contains(strings.ToLower(gw.Name), strings.ToLower(preferred)) {
+            first = append(first, gw)
+        } else {
+            rest = append(rest, gw)
+        }
     }
+    return append(first, rest...)
+}
+
+// SetGateways sets the gateways calls are routed to besides those of the
+// gateway pool's table
+func (r *RoutingEngine) SetGateways(gateways []*Gateway) {
+    r.gatewayPool.SetGateways(gateways)
 }
 
 // routeToAI forwards spam calls to AI voice agents
-func (s *BasicSIPServer) routeToAI(message string, clientAddr *net.UDPAddr, result FilterResult) {
+func (s *BasicSIPServer) routeToAI(req *Message, tx *ServerTransaction, result FilterResult) {
     s.logger.Printf("Routing call to AI agent: %s", result.Reason)
-    
-    // Send 200 OK response
-    response := buildSIPResponse("200 OK", message)
-    s.sendSIPResponse(response, clientAddr)
-    
-    // TODO: Integrate with actual AI voice service
-}
 
-// forwardToGateway routes approved calls to Asterisk gateways
-func (s *BasicSIPServer) forwardToGateway(message string, clientAddr *net.UDPAddr, gateway *Gateway) {
-    s.logger.Printf("Forwarding call to gateway: %s", gateway.Name)
-    
-    // Send 100 Trying response
-    response := buildSIPResponse("100 Trying", message)
-    s.sendSIPResponse(response, clientAddr)
-    
-    // TODO: Forward to actual gateway
-}
+    if err := s.answer(req, tx); err != nil {
+        s.logger.Printf("Error answering call %s: %v", req.CallID(), err)
+        return
+    }
 
-// rejectCall sends rejection response
-func (s *BasicSIPServer) rejectCall(message string, clientAddr *net.UDPAddr, reason string) {
-    s.logger.Printf("Rejecting call: %s", reason)
-    
-    response := buildSIPResponse("403 Forbidden", message)
-    s.sendSIPResponse(response, clientAddr)
+    // TODO: Integrate with actual AI voice service
 }
 
-// sendSIPResponse sends a SIP response back to the client
-func (s *BasicSIPServer) sendSIPResponse(response string, clientAddr *net.UDPAddr) {
-    conn := s.listener.(*net.UDPConn)
-    _, err := conn.WriteToUDP([]byte(response), clientAddr)
+// answer accepts an INVITE with a 200 OK and keeps the dialog it sets up
+func (s *BasicSIPServer) answer(req *Message, tx *ServerTransaction) error {
+    resp := NewResponse(req, 200, "")
+    resp.Header.Add("Contact", s.contact(tx).String())
+    if err := tx.Respond(resp); err != nil {
+        return err
+    }
+
+    dialog, err := NewUASDialog(req, resp)
     if err != nil {
-        s.logger.Printf("Error sending SIP response: %v", err)
+        return err
     }
+    s.dialogs.Add(dialog)
+    return nil
 }
 
-// Helper functions
+// contact returns the Contact address the server puts in its responses
+func (s *BasicSIPServer) contact(tx *ServerTransaction) *Address {
+    src := tx.Source()
+    return &Address{URI: s.tl.ContactURI(src.Transport, src.Addr, "")}
+}
 
-func extractSIPHeader(message, header string) string {
-    lines := strings.Split(message, "\n")
-    for _, line := range lines {
-        if strings.HasPrefix(line, header) {
-            return strings.TrimSpace(line[len(header):])
-        }
-    }
-    return ""
+// forwardToGateway bridges approved calls to Asterisk gateways, failing
+// over from one to the next; it returns when the call is answered or has
+// failed
+func (s *BasicSIPServer) forwardToGateway(req *Message, tx *ServerTransaction, gateways []*Gateway, destNumber string) {
+    s.b2bua.Bridge(req, tx, gateways, destNumber)
 }
 
-func extractPhoneNumber(sipHeader string) string {
-    // Extract phone number from SIP header (simplified)
-    if idx := strings.Index(sipHeader, "sip:"); idx >= 0 {
-        start := idx + 4
-        if end := strings.Index(sipHeader[start:], "@"); end >= 0 {
-            return sipHeader[start : start+end]
-        }
-    }
-    return sipHeader
+// SetGateways sets Asterisk gateways calls are forwarded to besides those
+// of the gateways table, if any
+func (s *BasicSIPServer) SetGateways(gateways []*Gateway) {
+    s.routingEng.SetGateways(gateways)
 }
 
-func buildSIPResponse(status, originalMessage string) string {
-    callID := extractSIPHeader(originalMessage, "Call-ID:")
-    from := extractSIPHeader(originalMessage, "From:")
-    to := extractSIPHeader(originalMessage, "To:")
-    via := extractSIPHeader(originalMessage, "Via:")
-    
-    return fmt.Sprintf(`SIP/2.0 %s
-Via: %s
-From: %s
-To: %s
-Call-ID: %s
-Content-Length: 0
+// SetGatewayPool replaces the pool calls are routed through, e.g. with one
+// loading the gateways table; call it before SetGateways and Start
+func (s *BasicSIPServer) SetGatewayPool(pool *GatewayPool) {
+    s.routingEng.gatewayPool = pool
+}
 
-`, status, via, from, to, callID)
+// rejectCall sends rejection response
+func (s *BasicSIPServer) rejectCall(req *Message, tx *ServerTransaction, reason string) {
+    s.logger.Printf("Rejecting call: %s", reason)
+
+    tx.Respond(NewResponse(req, 403, ""))
 }
 
 // NewFilterEngine creates filter engine with real validation services
@@ -349,10 +568,8 @@ func NewFilterEngine(whatsappAPIKey string) *FilterEngine {
 
 func NewRoutingEngine() *RoutingEngine {
     return &RoutingEngine{
-        gatewayPool:   &GatewayPool{},
+        gatewayPool:   NewGatewayPool(nil, GatewayPoolConfig{}, log.New(log.Writer(), "[SIP] ", log.LstdFlags)),
         stickyRoutes:  make(map[string]string),
-        loadBalancer:  &LoadBalancer{},
-        failoverMgr:   &FailoverManager{},
     }
 }
 
@@ -360,14 +577,14 @@ func NewVoiceAIService() *VoiceAIService {
     return &VoiceAIService{}
 }
 
-func (s *BasicSIPServer) handleBye(message string, clientAddr *net.UDPAddr) {
-    s.logger.Printf("Call ended from %s", clientAddr)
-    response := buildSIPResponse("200 OK", message)
-    s.sendSIPResponse(response, clientAddr)
-}
-
-func (s *BasicSIPServer) handleCancel(message string, clientAddr *net.UDPAddr) {
-    s.logger.Printf("Call cancelled from %s", clientAddr)
-    response := buildSIPResponse("200 OK", message)
-    s.sendSIPResponse(response, clientAddr)
+// handleBye ends the call's dialog
+func (s *BasicSIPServer) handleBye(req *Message, tx *ServerTransaction) {
+    dialog := s.dialogs.Match(req)
+    if dialog == nil {
+        tx.Respond(NewResponse(req, 481, ""))
+        return
+    }
+    s.dialogs.Remove(dialog)
+    s.logger.Printf("Call ended from %s (Call-ID: %s)", tx.Source().Addr, req.CallID())
+    tx.Respond(NewResponse(req, 200, ""))
 }
@@ -0,0 +1,357 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DialogState is where a dialog stands (RFC 3261 §12).
+type DialogState int
+
+const (
+	DialogEarly DialogState = iota // set up by a provisional response
+	DialogConfirmed
+	DialogTerminated
+)
+
+func (s DialogState) String() string {
+	switch s {
+	case DialogEarly:
+		return "early"
+	case DialogConfirmed:
+		return "confirmed"
+	default:
+		return "terminated"
+	}
+}
+
+// ErrOutOfOrder is returned for an in-dialog request whose CSeq is lower
+// than a previous one's.
+var ErrOutOfOrder = errors.New("sip: request out of order in dialog")
+
+// Dialog is a peer-to-peer relationship set up by an INVITE and its
+// response: the Call-ID and tags identifying it, the remote target and
+// route set in-dialog requests go by, and the CSeq numbers on each side.
+type Dialog struct {
+	CallID       string
+	LocalTag     string
+	RemoteTag    string
+	Local        *Address // From of the requests we send
+	Remote       *Address // To of the requests we send
+	RemoteTarget *URI     // Request-URI of the requests we send
+	RouteSet     []*Address
+	Secure       bool
+
+	mu        sync.Mutex
+	localSeq  uint32
+	remoteSeq uint32 // 0 until a request is received
+	state     DialogState
+}
+
+// NewUASDialog creates the dialog a UAS sets up answering req with resp,
+// which carries the To-tag (RFC 3261 §12.1.1).
+func NewUASDialog(req, resp *Message) (*Dialog, error) {
+	from, err := req.From()
+	if err != nil {
+		return nil, err
+	}
+	to, err := resp.To()
+	if err != nil {
+		return nil, err
+	}
+	target, err := contactURI(req)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := recordRoutes(req)
+	if err != nil {
+		return nil, err
+	}
+	n, _, err := req.CSeq()
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialog{
+		CallID:       req.CallID(),
+		LocalTag:     to.Tag(),
+		RemoteTag:    from.Tag(),
+		Local:        to,
+		Remote:       from,
+		RemoteTarget: target,
+		RouteSet:     routes,
+		remoteSeq:    n,
+		state:        dialogState(resp),
+	}
+	if u, err := ParseURI(req.RequestURI); err == nil && u.Scheme == "sips" {
+		d.Secure = true
+	}
+	return d, nil
+}
+
+// NewUACDialog creates the dialog a UAC sets up from the response to its
+// req (RFC 3261 §12.1.2). The route set is the Record-Route in reverse.
+func NewUACDialog(req, resp *Message) (*Dialog, error) {
+	from, err := req.From()
+	if err != nil {
+		return nil, err
+	}
+	to, err := resp.To()
+	if err != nil {
+		return nil, err
+	}
+	if to.Tag() == "" {
+		return nil, fmt.Errorf("%w: response without To-tag", ErrMalformed)
+	}
+	target, err := contactURI(resp)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := recordRoutes(resp)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(routes)-1; i < j; i, j = i+1, j-1 {
+		routes[i], routes[j] = routes[j], routes[i]
+	}
+	n, _, err := req.CSeq()
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialog{
+		CallID:       req.CallID(),
+		LocalTag:     from.Tag(),
+		RemoteTag:    to.Tag(),
+		Local:        from,
+		Remote:       to,
+		RemoteTarget: target,
+		RouteSet:     routes,
+		localSeq:     n,
+		state:        dialogState(resp),
+	}
+	if u, err := ParseURI(req.RequestURI); err == nil && u.Scheme == "sips" {
+		d.Secure = true
+	}
+	return d, nil
+}
+
+func dialogState(resp *Message) DialogState {
+	if resp.StatusCode < 200 {
+		return DialogEarly
+	}
+	return DialogConfirmed
+}
+
+func contactURI(m *Message) (*URI, error) {
+	contacts, err := m.Contacts()
+	if err != nil {
+		return nil, err
+	}
+	if len(contacts) == 0 || contacts[0].Wildcard {
+		return nil, fmt.Errorf("%w: no Contact", ErrMalformed)
+	}
+	return contacts[0].URI, nil
+}
+
+func recordRoutes(m *Message) ([]*Address, error) {
+	var routes []*Address
+	for _, v := range m.Header.Values("Record-Route") {
+		a, err := ParseAddress(v)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, a)
+	}
+	return routes, nil
+}
+
+// ID returns the dialog's Call-ID and tags, as Dialogs keys it.
+func (d *Dialog) ID() string {
+	return dialogID(d.CallID, d.LocalTag, d.RemoteTag)
+}
+
+func dialogID(callID, localTag, remoteTag string) string {
+	return callID + "|" + localTag + "|" + remoteTag
+}
+
+// State returns where the dialog stands.
+func (d *Dialog) State() DialogState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// Confirm moves an early dialog to confirmed on a 2xx, taking the remote
+// target it carries.
+func (d *Dialog) Confirm(resp *Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state == DialogEarly && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		d.state = DialogConfirmed
+	}
+	if target, err := contactURI(resp); err == nil {
+		d.RemoteTarget = target
+	}
+}
+
+// Terminate ends the dialog.
+func (d *Dialog) Terminate() {
+	d.mu.Lock()
+	d.state = DialogTerminated
+	d.mu.Unlock()
+}
+
+// Receive checks an in-dialog request's CSeq and takes the remote target
+// of a target refresh (RFC 3261 §12.2.2). ACK and CANCEL reuse the CSeq
+// of the request they go with.
+func (d *Dialog) Receive(req *Message) error {
+	n, _, err := req.CSeq()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if req.Method != MethodAck && req.Method != MethodCancel {
+		if d.remoteSeq != 0 && n < d.remoteSeq {
+			return ErrOutOfOrder
+		}
+		d.remoteSeq = n
+	}
+	if req.Method == MethodInvite || req.Method == MethodUpdate {
+		if target, err := contactURI(req); err == nil {
+			d.RemoteTarget = target
+		}
+	}
+	return nil
+}
+
+// NewRequest builds an in-dialog request with the next local CSeq (RFC
+// 3261 §12.2.1.1). The transaction layer adds the Via; send it to the
+// address NextHop returns.
+func (d *Dialog) NewRequest(method string) *Message {
+	d.mu.Lock()
+	d.localSeq++
+	n := d.localSeq
+	d.mu.Unlock()
+	return d.newRequest(method, n)
+}
+
+// NewAck builds the ACK of the 2xx to the INVITE with CSeq number cseq.
+// It is a transaction of its own, sent again for each retransmitted 2xx.
+func (d *Dialog) NewAck(cseq uint32) *Message {
+	return d.newRequest(MethodAck, cseq)
+}
+
+func (d *Dialog) newRequest(method string, cseq uint32) *Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := &Message{Method: method}
+	routes := d.RouteSet
+	if len(routes) > 0 && !isLooseRouter(routes[0]) {
+		// Strict router: it gets the request as its Request-URI, the
+		// remote target going last in the route (RFC 3261 §12.2.1.1).
+		m.RequestURI = routes[0].URI.String()
+		for _, r := range routes[1:] {
+			m.Header.Add("Route", r.String())
+		}
+		m.Header.Add("Route", (&Address{URI: d.RemoteTarget}).String())
+	} else {
+		m.RequestURI = d.RemoteTarget.String()
+		for _, r := range routes {
+			m.Header.Add("Route", r.String())
+		}
+	}
+	m.Header.Add("Max-Forwards", "70")
+	m.Header.Add("From", d.Local.String())
+	m.Header.Add("To", d.Remote.String())
+	m.Header.Add("Call-ID", d.CallID)
+	m.Header.Add("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	return m
+}
+
+// NextHop returns the URI whose host, port and transport an in-dialog
+// request goes to: the first route, else the remote target.
+func (d *Dialog) NextHop() *URI {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.RouteSet) > 0 {
+		return d.RouteSet[0].URI
+	}
+	return d.RemoteTarget
+}
+
+func isLooseRouter(a *Address) bool {
+	_, ok := a.URI.Params.Get("lr")
+	return ok
+}
+
+// Dialogs keeps the dialogs of an element by ID.
+type Dialogs struct {
+	mu      sync.Mutex
+	dialogs map[string]*Dialog
+}
+
+// NewDialogs creates an empty store.
+func NewDialogs() *Dialogs {
+	return &Dialogs{dialogs: make(map[string]*Dialog)}
+}
+
+// Add stores a dialog, replacing one with the same ID.
+func (s *Dialogs) Add(d *Dialog) {
+	s.mu.Lock()
+	s.dialogs[d.ID()] = d
+	s.mu.Unlock()
+}
+
+// Get returns a dialog by Call-ID and tags, nil if none.
+func (s *Dialogs) Get(callID, localTag, remoteTag string) *Dialog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialogs[dialogID(callID, localTag, remoteTag)]
+}
+
+// Match returns the dialog a received request belongs to: its To-tag is
+// ours, its From-tag the peer's. It returns nil for a request outside any
+// dialog.
+func (s *Dialogs) Match(req *Message) *Dialog {
+	from, err := req.From()
+	if err != nil {
+		return nil
+	}
+	to, err := req.To()
+	if err != nil || to.Tag() == "" {
+		return nil
+	}
+	return s.Get(req.CallID(), to.Tag(), from.Tag())
+}
+
+// MatchResponse returns the dialog a received response belongs to: its
+// From-tag is ours, its To-tag the peer's.
+func (s *Dialogs) MatchResponse(resp *Message) *Dialog {
+	from, err := resp.From()
+	if err != nil {
+		return nil
+	}
+	to, err := resp.To()
+	if err != nil {
+		return nil
+	}
+	return s.Get(resp.CallID(), from.Tag(), to.Tag())
+}
+
+// Remove drops a dialog and marks it terminated.
+func (s *Dialogs) Remove(d *Dialog) {
+	d.Terminate()
+	s.mu.Lock()
+	if s.dialogs[d.ID()] == d {
+		delete(s.dialogs, d.ID())
+	}
+	s.mu.Unlock()
+}
+
+// Len returns how many dialogs there are.
+func (s *Dialogs) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.dialogs)
+}
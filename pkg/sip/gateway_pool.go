@@ -0,0 +1,580 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+)
+
+// uptimeWindow is the period a gateway's uptime percentage covers.
+const uptimeWindow = 24 * time.Hour
+
+// Load balancing strategies, for the gateways of one priority.
+const (
+	// StrategyWeighted spreads calls in proportion to the gateways'
+	// weights, in turn (smooth weighted round-robin).
+	StrategyWeighted = "weighted"
+	// StrategyLeastCalls sends a call to the gateway with the fewest
+	// active calls for its weight.
+	StrategyLeastCalls = "least-calls"
+	// StrategyPriority sends every call to the heaviest gateway while it
+	// is up, the next ones only taking over.
+	StrategyPriority = "priority"
+)
+
+// GatewayStore is what the pool needs of the gateways table;
+// repository.PostgresGatewayRepository has it. The pool only writes the
+// SIP health columns: a gateway's status is that of its AMI connection.
+type GatewayStore interface {
+	ListGateways(ctx context.Context) ([]*models.Gateway, error)
+	UpdateGatewaySIPHealth(ctx context.Context, id, health string, latencyMs *int, uptimePercent float64, checkedAt time.Time) error
+}
+
+// GatewayPoolConfig sets how gateways are probed and chosen. Zero values
+// take the defaults given.
+type GatewayPoolConfig struct {
+	ProbeInterval  time.Duration // between two OPTIONS to a gateway; 3s
+	ProbeTimeout   time.Duration // an OPTIONS unanswered for this long fails; 2s
+	DownAfter      int           // failed probes in a row marking a gateway down; 2
+	UpAfter        int           // answered probes in a row marking it up again; 3
+	ReloadInterval time.Duration // between reloads of the gateways table and saves of their health; 1m
+	Strategy       string        // StrategyWeighted by default
+}
+
+// GatewayPool keeps the gateways calls go to, from the gateways table and
+// any given on the command line, and probes each with SIP OPTIONS. A
+// gateway is down after DownAfter failed probes in a row and up again
+// after UpAfter answered ones, so one lost datagram does not move calls
+// and a flapping site does not get them back too soon. Calls go to the
+// gateways up, or not probed yet, of the lowest priority that has any;
+// those of a priority share them as the load balancer decides.
+type GatewayPool struct {
+	store    GatewayStore
+	cfg      GatewayPoolConfig
+	balancer *LoadBalancer
+	logger   *log.Logger
+
+	mu          sync.Mutex
+	tl          *TransactionLayer
+	activeCalls func(gatewayID string) int
+	static      []*Gateway
+	members     map[string]*poolMember
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// poolMember is a gateway of the pool and what its probes found.
+type poolMember struct {
+	gw        *Gateway
+	stored    bool // from the gateways table, where its health is saved
+	health    string
+	successes int // answered probes in a row
+	failures  int // failed probes in a row
+	latency   time.Duration
+	checkedAt time.Time
+	lastError string
+	probing   bool
+	uptime    uptime
+}
+
+// NewGatewayPool creates a pool. Without a store, it only has the
+// gateways given to SetGateways.
+func NewGatewayPool(store GatewayStore, cfg GatewayPoolConfig, logger *log.Logger) *GatewayPool {
+	if cfg.ProbeInterval <= 0 {
+		cfg.ProbeInterval = 3 * time.Second
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = 2 * time.Second
+	}
+	if cfg.DownAfter <= 0 {
+		cfg.DownAfter = 2
+	}
+	if cfg.UpAfter <= 0 {
+		cfg.UpAfter = 3
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = time.Minute
+	}
+	return &GatewayPool{
+		store:    store,
+		cfg:      cfg,
+		balancer: NewLoadBalancer(cfg.Strategy),
+		logger:   logger,
+		members:  make(map[string]*poolMember),
+	}
+}
+
+// SetGateways sets the gateways the pool has besides those of the table,
+// such as those given on the command line.
+func (p *GatewayPool) SetGateways(gateways []*Gateway) {
+	p.mu.Lock()
+	p.static = gateways
+	p.mu.Unlock()
+	p.reload()
+}
+
+// Start loads the gateways and probes them over a transaction layer.
+// activeCalls counts a gateway's calls for the least-calls strategy.
+func (p *GatewayPool) Start(tl *TransactionLayer, activeCalls func(gatewayID string) int) {
+	p.mu.Lock()
+	if p.stop != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.tl = tl
+	p.activeCalls = activeCalls
+	stop, done := make(chan struct{}), make(chan struct{})
+	p.stop, p.done = stop, done
+	p.mu.Unlock()
+
+	p.reload()
+	go p.run(stop, done)
+}
+
+// Stop stops probing and saves the gateways' health.
+func (p *GatewayPool) Stop() {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop = nil
+	p.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	p.saveHealth()
+}
+
+func (p *GatewayPool) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	probe := time.NewTicker(p.cfg.ProbeInterval)
+	defer probe.Stop()
+	reload := time.NewTicker(p.cfg.ReloadInterval)
+	defer reload.Stop()
+
+	p.probeAll()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-probe.C:
+			p.probeAll()
+		case <-reload.C:
+			p.saveHealth()
+			p.reload()
+		}
+	}
+}
+
+// reload rebuilds the members from the table and the static gateways,
+// keeping what is known of those still there.
+func (p *GatewayPool) reload() {
+	var stored []*models.Gateway
+	keepStored := false
+	if p.store != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var err error
+		stored, err = p.store.ListGateways(ctx)
+		cancel()
+		if err != nil {
+			p.logger.Printf("Error loading gateways: %v", err)
+			keepStored = true
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	members := make(map[string]*poolMember)
+	add := func(gw *Gateway, isStored bool) {
+		m := p.members[gw.ID]
+		if m == nil {
+			m = &poolMember{health: models.GatewayHealthUnknown}
+			p.logger.Printf("Gateway %s added to the pool at %s (%s)", gw.Name, gw.Address(), gw.Network())
+		} else if m.gw.Address() != gw.Address() || m.gw.Network() != gw.Network() {
+			// Another site: what was known no longer holds.
+			m = &poolMember{health: models.GatewayHealthUnknown}
+		}
+		m.gw, m.stored = gw, isStored
+		members[gw.ID] = m
+	}
+	for _, g := range stored {
+		if g.Enabled {
+			add(gatewayFromModel(g), true)
+		}
+	}
+	if keepStored {
+		for id, m := range p.members {
+			if m.stored {
+				members[id] = m
+			}
+		}
+	}
+	for _, gw := range p.static {
+		add(gw, false)
+	}
+	for id, m := range p.members {
+		if members[id] == nil {
+			p.logger.Printf("Gateway %s removed from the pool", m.gw.Name)
+		}
+	}
+	p.members = members
+}
+
+// gatewayFromModel returns the SIP side of a gateway of the table: its
+// Asterisk at the SIP endpoint, or at the AMI host when none is set.
+func gatewayFromModel(g *models.Gateway) *Gateway {
+	host := g.AMIHost
+	if g.SIPEndpoint != nil && *g.SIPEndpoint != "" {
+		host = *g.SIPEndpoint
+	}
+	return &Gateway{
+		ID:          g.ID,
+		Name:        g.Name,
+		SIPEndpoint: host,
+		SIPPort:     g.SIPPort,
+		Transport:   g.SIPTransport,
+		Weight:      g.SIPWeight,
+		Priority:    g.SIPPriority,
+	}
+}
+
+// probeAll probes the gateways not being probed already.
+func (p *GatewayPool) probeAll() {
+	p.mu.Lock()
+	var due []*poolMember
+	for _, m := range p.members {
+		if !m.probing {
+			m.probing = true
+			due = append(due, m)
+		}
+	}
+	p.mu.Unlock()
+	for _, m := range due {
+		go p.probe(m)
+	}
+}
+
+// probe sends a gateway an OPTIONS. Any final answer but 408 and 503
+// shows its SIP stack is up, whatever it thinks of the request.
+func (p *GatewayPool) probe(m *poolMember) {
+	p.mu.Lock()
+	gw, tl := m.gw, p.tl
+	p.mu.Unlock()
+
+	network, addr := gw.Network(), gw.Address()
+	started := time.Now()
+	ok, reason := false, ""
+	if t := tl.Transport(network); t == nil {
+		reason = fmt.Sprintf("no %s transport", network)
+	} else if tx, err := tl.Request(newProbe(tl, gw, t, addr), network, addr); err != nil {
+		reason = err.Error()
+	} else {
+		ok, reason = p.await(tx)
+	}
+	p.record(m, ok, time.Since(started), reason)
+}
+
+// await waits for the final response of a probe, giving up after the
+// probe timeout.
+func (p *GatewayPool) await(tx *ClientTransaction) (bool, string) {
+	timeout := time.NewTimer(p.cfg.ProbeTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case resp, open := <-tx.Responses():
+			if !open {
+				return false, "no answer to OPTIONS"
+			}
+			if resp.StatusCode < 200 {
+				continue
+			}
+			if resp.StatusCode == 408 || resp.StatusCode == 503 {
+				return false, fmt.Sprintf("OPTIONS answered %d %s", resp.StatusCode, resp.Reason)
+			}
+			return true, ""
+		case <-timeout.C:
+			// No use retransmitting it until timer F.
+			tx.terminate(ErrTimeout)
+			return false, fmt.Sprintf("no answer to OPTIONS within %s", p.cfg.ProbeTimeout)
+		}
+	}
+}
+
+// newProbe builds the OPTIONS probing a gateway.
+func newProbe(tl *TransactionLayer, gw *Gateway, t Transport, addr string) *Message {
+	target := &URI{Scheme: "sip", Host: gw.SIPEndpoint, Port: gw.SIPPort}
+	if t.Network() != "UDP" {
+		target.Params.Set("transport", strings.ToLower(t.Network()))
+	}
+	host, _ := tl.SentBy(t, addr)
+	from := &Address{URI: &URI{Scheme: "sip", User: "ping", Host: host}}
+	from.Params.Set("tag", NewTag())
+	req := NewRequest(MethodOptions, target, from, &Address{URI: target.Clone()}, NewCallID(host), 1)
+	req.Header.Add("Accept", "application/sdp")
+	return req
+}
+
+// record counts a probe's outcome, moving the gateway up or down when
+// enough probes in a row agree. A gateway not probed yet is up on its
+// first answer. Changes of stored gateways are saved at once.
+func (p *GatewayPool) record(m *poolMember, ok bool, rtt time.Duration, reason string) {
+	now := time.Now()
+	p.mu.Lock()
+	m.probing = false
+	m.checkedAt = now
+	from := m.health
+	if ok {
+		m.successes++
+		m.failures = 0
+		m.latency = rtt
+		m.lastError = ""
+		if m.health == models.GatewayHealthUnknown || (m.health == models.GatewayHealthDown && m.successes >= p.cfg.UpAfter) {
+			m.health = models.GatewayHealthUp
+		}
+	} else {
+		m.failures++
+		m.successes = 0
+		m.lastError = reason
+		if m.health != models.GatewayHealthDown && m.failures >= p.cfg.DownAfter {
+			m.health = models.GatewayHealthDown
+		}
+	}
+	health := m.health
+	if health == from {
+		p.mu.Unlock()
+		return
+	}
+	m.uptime.set(health == models.GatewayHealthUp, now)
+	gw, stored, lastError := m.gw, m.stored, m.lastError
+	p.mu.Unlock()
+
+	if health == models.GatewayHealthUp {
+		p.logger.Printf("Gateway %s is up (%s)", gw.Name, rtt.Round(time.Millisecond))
+	} else {
+		p.logger.Printf("Gateway %s is down: %s", gw.Name, lastError)
+	}
+	if stored {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		p.saveMember(ctx, m)
+		cancel()
+	}
+}
+
+// saveHealth saves the latency and uptime of every stored gateway.
+func (p *GatewayPool) saveHealth() {
+	p.mu.Lock()
+	var stored []*poolMember
+	for _, m := range p.members {
+		if m.stored && !m.checkedAt.IsZero() {
+			stored = append(stored, m)
+		}
+	}
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, m := range stored {
+		p.saveMember(ctx, m)
+	}
+}
+
+// saveMember saves a stored gateway's health, latency and uptime.
+func (p *GatewayPool) saveMember(ctx context.Context, m *poolMember) {
+	p.mu.Lock()
+	id, health, checkedAt := m.gw.ID, m.health, m.checkedAt
+	var latencyMs *int
+	if health == models.GatewayHealthUp {
+		ms := int(m.latency / time.Millisecond)
+		latencyMs = &ms
+	}
+	uptime := m.uptime.percent(time.Now())
+	p.mu.Unlock()
+
+	if err := p.store.UpdateGatewaySIPHealth(ctx, id, health, latencyMs, uptime, checkedAt); err != nil {
+		p.logger.Printf("Error saving SIP health of gateway %s: %v", id, err)
+	}
+}
+
+// Select returns the gateways a call may go to, in the order to try them:
+// by priority, those of a priority in the load balancer's order. Down
+// gateways are left out.
+func (p *GatewayPool) Select() []*Gateway {
+	p.mu.Lock()
+	var live []*Gateway
+	for _, m := range p.members {
+		if m.health != models.GatewayHealthDown {
+			live = append(live, m.gw)
+		}
+	}
+	activeCalls := p.activeCalls
+	p.mu.Unlock()
+
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].Priority != live[j].Priority {
+			return live[i].Priority < live[j].Priority
+		}
+		return live[i].ID < live[j].ID
+	})
+	var ordered []*Gateway
+	for start := 0; start < len(live); {
+		end := start + 1
+		for end < len(live) && live[end].Priority == live[start].Priority {
+			end++
+		}
+		ordered = append(ordered, p.balancer.Order(live[start:end], activeCalls)...)
+		start = end
+	}
+	return ordered
+}
+
+// Health returns what the probes found of a gateway: up, down or unknown,
+// its latency and its uptime percentage over the last 24 hours.
+func (p *GatewayPool) Health(gatewayID string) (string, time.Duration, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.members[gatewayID]
+	if m == nil {
+		return models.GatewayHealthUnknown, 0, 0
+	}
+	return m.health, m.latency, m.uptime.percent(time.Now())
+}
+
+// LoadBalancer orders the gateways of one priority for a call.
+type LoadBalancer struct {
+	strategy string
+
+	mu      sync.Mutex
+	current map[string]int // smooth weighted round-robin state, by gateway ID
+}
+
+// NewLoadBalancer creates a load balancer following a strategy,
+// StrategyWeighted when empty or unknown.
+func NewLoadBalancer(strategy string) *LoadBalancer {
+	switch strategy {
+	case StrategyWeighted, StrategyLeastCalls, StrategyPriority:
+	default:
+		strategy = StrategyWeighted
+	}
+	return &LoadBalancer{strategy: strategy, current: make(map[string]int)}
+}
+
+// Order returns gateways in the order a call tries them: the one the
+// strategy picks first, then the others by weight to fail over to.
+// activeCalls may be nil.
+func (lb *LoadBalancer) Order(gateways []*Gateway, activeCalls func(gatewayID string) int) []*Gateway {
+	ordered := append([]*Gateway(nil), gateways...)
+	byWeight := func(i, j int) bool {
+		if ordered[i].weight() != ordered[j].weight() {
+			return ordered[i].weight() > ordered[j].weight()
+		}
+		return ordered[i].ID < ordered[j].ID
+	}
+	switch {
+	case len(ordered) < 2:
+	case lb.strategy == StrategyLeastCalls && activeCalls != nil:
+		load := make(map[string]float64, len(ordered))
+		for _, gw := range ordered {
+			load[gw.ID] = float64(activeCalls(gw.ID)) / float64(gw.weight())
+		}
+		sort.SliceStable(ordered, func(i, j int) bool {
+			if load[ordered[i].ID] != load[ordered[j].ID] {
+				return load[ordered[i].ID] < load[ordered[j].ID]
+			}
+			return byWeight(i, j)
+		})
+	case lb.strategy == StrategyWeighted:
+		first := lb.pick(ordered)
+		sort.SliceStable(ordered, byWeight)
+		for i, gw := range ordered {
+			if gw == first {
+				copy(ordered[1:i+1], ordered[:i])
+				ordered[0] = first
+				break
+			}
+		}
+	default:
+		sort.SliceStable(ordered, byWeight)
+	}
+	return ordered
+}
+
+// pick chooses the next gateway by smooth weighted round-robin: each
+// gains its weight, the richest is chosen and pays the total.
+func (lb *LoadBalancer) pick(gateways []*Gateway) *Gateway {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	var best *Gateway
+	total := 0
+	for _, gw := range gateways {
+		lb.current[gw.ID] += gw.weight()
+		total += gw.weight()
+		if best == nil || lb.current[gw.ID] > lb.current[best.ID] {
+			best = gw
+		}
+	}
+	lb.current[best.ID] -= total
+	return best
+}
+
+// uptime measures the share of the uptime window a gateway was up, from
+// its changes between up and down.
+type uptime struct {
+	changes []uptimeChange // oldest first
+}
+
+type uptimeChange struct {
+	at time.Time
+	up bool
+}
+
+func (u *uptime) set(up bool, at time.Time) {
+	if n := len(u.changes); n > 0 && u.changes[n-1].up == up {
+		return
+	}
+	u.changes = append(u.changes, uptimeChange{at: at, up: up})
+}
+
+// percent returns the share of the window up to now the gateway was up,
+// counting from its first probe when that is more recent.
+func (u *uptime) percent(now time.Time) float64 {
+	start := now.Add(-uptimeWindow)
+	// Only the last change before the window matters.
+	for len(u.changes) > 1 && !u.changes[1].at.After(start) {
+		u.changes = u.changes[1:]
+	}
+	if len(u.changes) == 0 {
+		return 0
+	}
+	from := u.changes[0].at
+	if from.Before(start) {
+		from = start
+	}
+	total := now.Sub(from)
+	if total <= 0 {
+		if u.changes[len(u.changes)-1].up {
+			return 100
+		}
+		return 0
+	}
+	var up time.Duration
+	for i, c := range u.changes {
+		if !c.up {
+			continue
+		}
+		begin, end := c.at, now
+		if begin.Before(from) {
+			begin = from
+		}
+		if i+1 < len(u.changes) {
+			end = u.changes[i+1].at
+		}
+		up += end.Sub(begin)
+	}
+	return float64(up) / float64(total) * 100
+}
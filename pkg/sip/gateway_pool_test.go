@@ -0,0 +1,155 @@
+package sip
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+)
+
+// fakeGatewayStore records the SIP health saved for each gateway.
+type fakeGatewayStore struct {
+	mu       sync.Mutex
+	gateways []*models.Gateway
+	health   map[string][]string
+}
+
+func (s *fakeGatewayStore) ListGateways(ctx context.Context) ([]*models.Gateway, error) {
+	return s.gateways, nil
+}
+
+func (s *fakeGatewayStore) UpdateGatewaySIPHealth(ctx context.Context, id, health string, latencyMs *int, uptimePercent float64, checkedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.health == nil {
+		s.health = make(map[string][]string)
+	}
+	s.health[id] = append(s.health[id], health)
+	return nil
+}
+
+func TestGatewayHysteresis(t *testing.T) {
+	store := &fakeGatewayStore{gateways: []*models.Gateway{
+		{ID: "gw1", Name: "Casablanca", AMIHost: "192.0.2.20", SIPPort: 5060, Enabled: true},
+	}}
+	p := NewGatewayPool(store, GatewayPoolConfig{DownAfter: 2, UpAfter: 3}, log.New(io.Discard, "", 0))
+	p.reload()
+	m := p.members["gw1"]
+
+	steps := []struct {
+		ok   bool
+		want string
+	}{
+		{true, models.GatewayHealthUp}, // first answer
+		{false, models.GatewayHealthUp},
+		{false, models.GatewayHealthDown}, // DownAfter failures in a row
+		{true, models.GatewayHealthDown},
+		{true, models.GatewayHealthDown},
+		{false, models.GatewayHealthDown}, // starts the count over
+		{true, models.GatewayHealthDown},
+		{true, models.GatewayHealthDown},
+		{true, models.GatewayHealthUp}, // UpAfter answers in a row
+		{false, models.GatewayHealthUp},
+		{true, models.GatewayHealthUp},
+	}
+	for i, step := range steps {
+		p.record(m, step.ok, 20*time.Millisecond, "no answer to OPTIONS")
+		if health, _, _ := p.Health("gw1"); health != step.want {
+			t.Errorf("probe %d (ok %v): %s, want %s", i+1, step.ok, health, step.want)
+		}
+	}
+	if got := strings.Join(store.health["gw1"], " "); got != "up down up" {
+		t.Errorf("saved health %q, want each change once", got)
+	}
+	if _, latency, _ := p.Health("gw1"); latency != 20*time.Millisecond {
+		t.Errorf("latency %s, want 20ms", latency)
+	}
+}
+
+func TestGatewayPoolSelect(t *testing.T) {
+	p := NewGatewayPool(nil, GatewayPoolConfig{Strategy: StrategyPriority}, log.New(io.Discard, "", 0))
+	p.SetGateways([]*Gateway{
+		{ID: "a", Name: "a", SIPEndpoint: "192.0.2.1", Priority: 2},
+		{ID: "b", Name: "b", SIPEndpoint: "192.0.2.2", Priority: 1, Weight: 1},
+		{ID: "c", Name: "c", SIPEndpoint: "192.0.2.3", Priority: 1, Weight: 5},
+		{ID: "d", Name: "d", SIPEndpoint: "192.0.2.4", Priority: 1, Weight: 9},
+	})
+	// d goes down; the others are up or not probed yet.
+	p.record(p.members["d"], false, 0, "timeout")
+	p.record(p.members["d"], false, 0, "timeout")
+	p.record(p.members["b"], true, time.Millisecond, "")
+
+	var ids []string
+	for _, gw := range p.Select() {
+		ids = append(ids, gw.ID)
+	}
+	if got := strings.Join(ids, " "); got != "c b a" {
+		t.Errorf("selected %q, want the live priority 1 gateways by weight, then priority 2", got)
+	}
+}
+
+func TestWeightedLoadBalancer(t *testing.T) {
+	lb := NewLoadBalancer(StrategyWeighted)
+	a := &Gateway{ID: "a", Weight: 3}
+	b := &Gateway{ID: "b", Weight: 1}
+	c := &Gateway{ID: "c"} // weight 1 when unset
+
+	firsts := make(map[string]int)
+	var sequence []string
+	for i := 0; i < 10; i++ {
+		order := lb.Order([]*Gateway{a, b, c}, nil)
+		if len(order) != 3 {
+			t.Fatalf("order of %d gateways, want 3", len(order))
+		}
+		firsts[order[0].ID]++
+		if i < 5 {
+			sequence = append(sequence, order[0].ID)
+		}
+		// The others follow by weight, to fail over to.
+		if rest := order[1:]; rest[0].weight() < rest[1].weight() {
+			t.Errorf("failover order %s, %s not by weight", rest[0].ID, rest[1].ID)
+		}
+	}
+	if firsts["a"] != 6 || firsts["b"] != 2 || firsts["c"] != 2 {
+		t.Errorf("first picks %v over 10 calls, want a 6, b 2, c 2", firsts)
+	}
+	// Smooth: the heaviest is not picked every time in a row.
+	if got := strings.Join(sequence, " "); got != "a b a c a" {
+		t.Errorf("picked %q, want a b a c a", got)
+	}
+}
+
+func TestLeastCallsLoadBalancer(t *testing.T) {
+	lb := NewLoadBalancer(StrategyLeastCalls)
+	calls := map[string]int{"a": 4, "b": 1, "c": 3}
+	order := lb.Order([]*Gateway{
+		{ID: "a", Weight: 4}, // 1 call per weight
+		{ID: "b", Weight: 1}, // 1
+		{ID: "c", Weight: 1}, // 3
+	}, func(id string) int { return calls[id] })
+	var ids []string
+	for _, gw := range order {
+		ids = append(ids, gw.ID)
+	}
+	if got := strings.Join(ids, " "); got != "a b c" {
+		t.Errorf("ordered %q, want the least loaded first, ties to the heaviest", got)
+	}
+}
+
+func TestUptimePercent(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	var u uptime
+	u.set(true, now.Add(-30*time.Hour))
+	u.set(false, now.Add(-6*time.Hour))
+	u.set(false, now.Add(-5*time.Hour)) // no change
+	u.set(true, now.Add(-3*time.Hour))
+	// Up 18h of the window, down 3h, up 3h.
+	if got := u.percent(now); got != 87.5 {
+		t.Errorf("uptime %.2f%%, want 87.5%%", got)
+	}
+}
@@ -0,0 +1,584 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Version is the protocol of every start line.
+	Version = "SIP/2.0"
+	// BranchPrefix starts the branch of every Via header set by an RFC 3261
+	// element.
+	BranchPrefix = "z9hG4bK"
+	// maxMessageSize bounds a message read from the network.
+	maxMessageSize = 65535
+)
+
+// Methods
+const (
+	MethodInvite   = "INVITE"
+	MethodAck      = "ACK"
+	MethodBye      = "BYE"
+	MethodCancel   = "CANCEL"
+	MethodRegister = "REGISTER"
+	MethodOptions  = "OPTIONS"
+	MethodInfo     = "INFO"
+	MethodUpdate   = "UPDATE"
+	MethodPrack    = "PRACK"
+	MethodNotify   = "NOTIFY"
+	MethodRefer    = "REFER"
+	MethodMessage  = "MESSAGE"
+)
+
+// ErrMalformed is returned for a message that cannot be parsed.
+var ErrMalformed = errors.New("sip: malformed message")
+
+// compactNames are the single-letter header names of RFC 3261 §7.3.3 and
+// later extensions.
+var compactNames = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"d": "Request-Disposition",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"j": "Reject-Contact",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"n": "Identity-Info",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+	"y": "Identity",
+}
+
+// oddNames are header names whose canonical case is not that of words
+// joined by dashes.
+var oddNames = map[string]string{
+	"call-id":          "Call-ID",
+	"cseq":             "CSeq",
+	"www-authenticate": "WWW-Authenticate",
+	"mime-version":     "MIME-Version",
+	"rseq":             "RSeq",
+	"rack":             "RAck",
+	"sip-etag":         "SIP-ETag",
+	"sip-if-match":     "SIP-If-Match",
+	"content-id":       "Content-ID",
+}
+
+// listHeaders may carry several comma-separated values in one field.
+var listHeaders = map[string]bool{
+	"Via":             true,
+	"Route":           true,
+	"Record-Route":    true,
+	"Contact":         true,
+	"Path":            true,
+	"Service-Route":   true,
+	"Allow":           true,
+	"Supported":       true,
+	"Require":         true,
+	"Proxy-Require":   true,
+	"Unsupported":     true,
+	"Accept":          true,
+	"Accept-Encoding": true,
+	"Accept-Language": true,
+}
+
+// CanonicalName returns the canonical form of a header name, expanding
+// compact forms: "v" and "VIA" are both "Via".
+func CanonicalName(name string) string {
+	name = strings.TrimSpace(name)
+	lower := strings.ToLower(name)
+	if full, ok := compactNames[lower]; ok {
+		return full
+	}
+	if odd, ok := oddNames[lower]; ok {
+		return odd
+	}
+	b := []byte(lower)
+	upper := true
+	for i, c := range b {
+		if upper && c >= 'a' && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		}
+		upper = c == '-'
+	}
+	return string(b)
+}
+
+// HeaderField is one header line.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Header holds a message's header fields in order, under canonical names.
+type Header []HeaderField
+
+// Get returns the first value of a header, "" if absent.
+func (h Header) Get(name string) string {
+	name = CanonicalName(name)
+	for _, f := range h {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Has reports whether the header is present.
+func (h Header) Has(name string) bool {
+	name = CanonicalName(name)
+	for _, f := range h {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns every value of a header in order. Values a single field
+// lists comma-separated, as Via and Contact allow, are returned one by
+// one.
+func (h Header) Values(name string) []string {
+	name = CanonicalName(name)
+	var values []string
+	for _, f := range h {
+		if f.Name != name {
+			continue
+		}
+		if listHeaders[name] {
+			values = append(values, splitList(f.Value)...)
+		} else {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Add appends a header field.
+func (h *Header) Add(name, value string) {
+	*h = append(*h, HeaderField{Name: CanonicalName(name), Value: value})
+}
+
+// Set replaces every field of a header with one holding value, in place of
+// the first of them.
+func (h *Header) Set(name, value string) {
+	name = CanonicalName(name)
+	for i, f := range *h {
+		if f.Name == name {
+			(*h)[i].Value = value
+			h.delAfter(name, i+1)
+			return
+		}
+	}
+	h.Add(name, value)
+}
+
+// Prepend inserts a header field before the first one of the same name, or
+// at the top when there is none, as a proxy adds its Via.
+func (h *Header) Prepend(name, value string) {
+	name = CanonicalName(name)
+	at := 0
+	for i, f := range *h {
+		if f.Name == name {
+			at = i
+			break
+		}
+	}
+	*h = append(*h, HeaderField{})
+	copy((*h)[at+1:], (*h)[at:])
+	(*h)[at] = HeaderField{Name: name, Value: value}
+}
+
+// Del removes every field of a header.
+func (h *Header) Del(name string) {
+	h.delAfter(CanonicalName(name), 0)
+}
+
+func (h *Header) delAfter(name string, from int) {
+	out := (*h)[:from]
+	for _, f := range (*h)[from:] {
+		if f.Name != name {
+			out = append(out, f)
+		}
+	}
+	*h = out
+}
+
+// Clone returns a copy of the header.
+func (h Header) Clone() Header {
+	return append(Header(nil), h...)
+}
+
+// Message is a SIP request or response.
+type Message struct {
+	// Request line
+	Method     string
+	RequestURI string
+	// Status line
+	StatusCode int
+	Reason     string
+
+	Header Header
+	Body   []byte
+}
+
+// IsRequest reports whether the message is a request.
+func (m *Message) IsRequest() bool {
+	return m.Method != ""
+}
+
+// Clone returns a deep copy of the message.
+func (m *Message) Clone() *Message {
+	c := *m
+	c.Header = m.Header.Clone()
+	c.Body = append([]byte(nil), m.Body...)
+	return &c
+}
+
+// CallID returns the Call-ID.
+func (m *Message) CallID() string {
+	return m.Header.Get("Call-ID")
+}
+
+// CSeq returns the sequence number and method of the CSeq header.
+func (m *Message) CSeq() (uint32, string, error) {
+	fields := strings.Fields(m.Header.Get("CSeq"))
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("%w: bad CSeq %q", ErrMalformed, m.Header.Get("CSeq"))
+	}
+	n, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: bad CSeq %q", ErrMalformed, m.Header.Get("CSeq"))
+	}
+	return uint32(n), strings.ToUpper(fields[1]), nil
+}
+
+// CSeqMethod returns the method of the CSeq header, "" if unreadable.
+func (m *Message) CSeqMethod() string {
+	_, method, _ := m.CSeq()
+	return method
+}
+
+// From returns the From address.
+func (m *Message) From() (*Address, error) {
+	return ParseAddress(m.Header.Get("From"))
+}
+
+// To returns the To address.
+func (m *Message) To() (*Address, error) {
+	return ParseAddress(m.Header.Get("To"))
+}
+
+// TopVia returns the first Via.
+func (m *Message) TopVia() (*Via, error) {
+	values := m.Header.Values("Via")
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%w: no Via", ErrMalformed)
+	}
+	return ParseVia(values[0])
+}
+
+// SetTopVia replaces the first Via, leaving the others in place.
+func (m *Message) SetTopVia(v *Via) {
+	if i := m.firstVia(); i >= 0 {
+		m.Header[i].Value = v.String()
+		return
+	}
+	m.Header.Prepend("Via", v.String())
+}
+
+// PopVia removes the first Via, as a proxy does on a response.
+func (m *Message) PopVia() {
+	if i := m.firstVia(); i >= 0 {
+		m.Header = append(m.Header[:i], m.Header[i+1:]...)
+	}
+}
+
+// firstVia returns the index of the field holding the first Via, -1 if
+// none. Fields listing several Vias are split first, one value per field.
+func (m *Message) firstVia() int {
+	first := -1
+	var split Header
+	for i, f := range m.Header {
+		if f.Name != "Via" {
+			split = append(split, f)
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		for _, v := range splitList(f.Value) {
+			split = append(split, HeaderField{Name: "Via", Value: v})
+		}
+	}
+	m.Header = split
+	return first
+}
+
+// Contacts returns the Contact addresses. A "*" contact is returned as an
+// address with Wildcard set.
+func (m *Message) Contacts() ([]*Address, error) {
+	var contacts []*Address
+	for _, v := range m.Header.Values("Contact") {
+		a, err := ParseAddress(v)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, a)
+	}
+	return contacts, nil
+}
+
+// Bytes serializes the message with canonical header names. The
+// Content-Length is set from the body.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	if m.IsRequest() {
+		fmt.Fprintf(&b, "%s %s %s\r\n", m.Method, m.RequestURI, Version)
+	} else {
+		fmt.Fprintf(&b, "%s %d %s\r\n", Version, m.StatusCode, m.Reason)
+	}
+	for _, f := range m.Header {
+		if f.Name == "Content-Length" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", f.Name, f.Value)
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(m.Body))
+	b.Write(m.Body)
+	return b.Bytes()
+}
+
+func (m *Message) String() string {
+	return string(m.Bytes())
+}
+
+// Summary describes the message in one line for logs.
+func (m *Message) Summary() string {
+	if m.IsRequest() {
+		return fmt.Sprintf("%s %s (Call-ID: %s)", m.Method, m.RequestURI, m.CallID())
+	}
+	return fmt.Sprintf("%d %s for %s (Call-ID: %s)", m.StatusCode, m.Reason, m.CSeqMethod(), m.CallID())
+}
+
+// Parse reads a message whole, as it comes in a datagram: without a
+// Content-Length, the body is the rest of the data. Leading blank lines,
+// such as keepalives, are skipped.
+func Parse(data []byte) (*Message, error) {
+	data = bytes.TrimLeft(data, "\r\n")
+	head, body, ok := splitHead(data)
+	if !ok {
+		return nil, fmt.Errorf("%w: no end of header", ErrMalformed)
+	}
+	m, err := parseHead(head)
+	if err != nil {
+		return nil, err
+	}
+	if cl := m.Header.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(cl))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: bad Content-Length %q", ErrMalformed, cl)
+		}
+		if n > len(body) {
+			return nil, fmt.Errorf("%w: body shorter than its Content-Length", ErrMalformed)
+		}
+		body = body[:n]
+	}
+	m.Body = append([]byte(nil), body...)
+	return m, m.validate()
+}
+
+// splitHead splits a message at the empty line ending its header.
+func splitHead(data []byte) (head, body []byte, ok bool) {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return data[:i], data[i+4:], true
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		return data[:i], data[i+2:], true
+	}
+	return nil, nil, false
+}
+
+// parseHead reads the start line and header fields, unfolding continuation
+// lines and expanding compact names.
+func parseHead(head []byte) (*Message, error) {
+	lines := strings.Split(string(head), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	m := &Message{}
+	if err := m.parseStartLine(lines[0]); err != nil {
+		return nil, err
+	}
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(m.Header) == 0 {
+				return nil, fmt.Errorf("%w: continuation line before any header", ErrMalformed)
+			}
+			last := &m.Header[len(m.Header)-1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return nil, fmt.Errorf("%w: bad header line %q", ErrMalformed, line)
+		}
+		name := strings.TrimSpace(line[:colon])
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%w: bad header name %q", ErrMalformed, name)
+		}
+		m.Header.Add(name, strings.TrimSpace(line[colon+1:]))
+	}
+	return m, nil
+}
+
+func (m *Message) parseStartLine(line string) error {
+	if strings.HasPrefix(line, Version+" ") {
+		rest := line[len(Version)+1:]
+		code, reason, _ := strings.Cut(rest, " ")
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 100 || n > 699 {
+			return fmt.Errorf("%w: bad status line %q", ErrMalformed, line)
+		}
+		m.StatusCode = n
+		m.Reason = reason
+		return nil
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[2] != Version || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("%w: bad request line %q", ErrMalformed, line)
+	}
+	m.Method = strings.ToUpper(parts[0])
+	m.RequestURI = parts[1]
+	return nil
+}
+
+// validate checks the header fields every message needs (RFC 3261 §8.1.1).
+func (m *Message) validate() error {
+	for _, name := range []string{"Via", "From", "To", "Call-ID", "CSeq"} {
+		if !m.Header.Has(name) {
+			return fmt.Errorf("%w: no %s", ErrMalformed, name)
+		}
+	}
+	_, method, err := m.CSeq()
+	if err != nil {
+		return err
+	}
+	if m.IsRequest() && method != m.Method {
+		return fmt.Errorf("%w: CSeq method %s on a %s", ErrMalformed, method, m.Method)
+	}
+	if _, err := m.TopVia(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NewRequest builds a request outside of a dialog (RFC 3261 §8.1.1). The
+// transaction layer adds the Via.
+func NewRequest(method string, uri *URI, from, to *Address, callID string, cseq uint32) *Message {
+	m := &Message{Method: method, RequestURI: uri.String()}
+	m.Header.Add("Max-Forwards", "70")
+	m.Header.Add("From", from.String())
+	m.Header.Add("To", to.String())
+	m.Header.Add("Call-ID", callID)
+	m.Header.Add("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	return m
+}
+
+// NewResponse builds a response to a request (RFC 3261 §8.2.6): every Via
+// in order, From, To, Call-ID and CSeq are copied, and Record-Route for
+// responses that may set up a dialog. The server transaction adds the
+// To-tag. reason defaults to the standard phrase.
+func NewResponse(req *Message, code int, reason string) *Message {
+	if reason == "" {
+		reason = StatusText(code)
+	}
+	m := &Message{StatusCode: code, Reason: reason}
+	for _, f := range req.Header {
+		switch f.Name {
+		case "Via", "From", "To", "Call-ID", "CSeq", "Timestamp":
+			m.Header = append(m.Header, f)
+		case "Record-Route":
+			if code > 100 && code < 300 {
+				m.Header = append(m.Header, f)
+			}
+		}
+	}
+	return m
+}
+
+// StatusText returns the reason phrase of a status code.
+func StatusText(code int) string {
+	if text, ok := statusText[code]; ok {
+		return text
+	}
+	switch {
+	case code < 200:
+		return "Session Progress"
+	case code < 300:
+		return "OK"
+	case code < 400:
+		return "Redirection"
+	case code < 500:
+		return "Client Error"
+	case code < 600:
+		return "Server Error"
+	}
+	return "Global Failure"
+}
+
+var statusText = map[int]string{
+	100: "Trying",
+	180: "Ringing",
+	181: "Call Is Being Forwarded",
+	182: "Queued",
+	183: "Session Progress",
+	200: "OK",
+	202: "Accepted",
+	301: "Moved Permanently",
+	302: "Moved Temporarily",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	415: "Unsupported Media Type",
+	420: "Bad Extension",
+	423: "Interval Too Brief",
+	480: "Temporarily Unavailable",
+	481: "Call/Transaction Does Not Exist",
+	482: "Loop Detected",
+	483: "Too Many Hops",
+	484: "Address Incomplete",
+	486: "Busy Here",
+	487: "Request Terminated",
+	488: "Not Acceptable Here",
+	491: "Request Pending",
+	500: "Server Internal Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Server Time-out",
+	513: "Message Too Large",
+	600: "Busy Everywhere",
+	603: "Decline",
+	604: "Does Not Exist Anywhere",
+	606: "Not Acceptable",
+}
@@ -0,0 +1,193 @@
+package sip
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// crlf turns the lines of a test message into wire format.
+func crlf(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\r\n"))
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		method string
+		uri    string
+		code   int
+		header map[string]string
+		body   string
+	}{
+		{
+			name: "request",
+			data: crlf(
+				"INVITE sip:0612345678@gw.example.com SIP/2.0",
+				"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK776asdhds",
+				"Max-Forwards: 70",
+				"To: <sip:0612345678@gw.example.com>",
+				"From: Alice <sip:alice@example.com>;tag=1928301774",
+				"Call-ID: a84b4c76e66710@192.0.2.10",
+				"CSeq: 314159 INVITE",
+				"Content-Type: application/sdp",
+				"Content-Length: 4",
+				"",
+				"v=0\r\n",
+			),
+			method: MethodInvite,
+			uri:    "sip:0612345678@gw.example.com",
+			header: map[string]string{"Call-ID": "a84b4c76e66710@192.0.2.10", "Max-Forwards": "70"},
+			body:   "v=0\r",
+		},
+		{
+			name: "response",
+			data: crlf(
+				"SIP/2.0 486 Busy Here",
+				"Via: SIP/2.0/UDP 192.0.2.10:5060;branch=z9hG4bK776asdhds",
+				"To: <sip:0612345678@gw.example.com>;tag=a6c85cf",
+				"From: <sip:alice@example.com>;tag=1928301774",
+				"Call-ID: a84b4c76e66710@192.0.2.10",
+				"CSeq: 314159 INVITE",
+				"",
+				"",
+			),
+			code:   486,
+			header: map[string]string{"To": "<sip:0612345678@gw.example.com>;tag=a6c85cf"},
+		},
+		{
+			name: "compact names, folding and keepalive",
+			data: crlf(
+				"",
+				"",
+				"options sip:gw.example.com SIP/2.0",
+				"v: SIP/2.0/TCP 192.0.2.10;branch=z9hG4bKnashds8",
+				"f: <sip:alice@example.com>;tag=1",
+				"t: <sip:gw.example.com>",
+				"i: 1234@192.0.2.10",
+				"CSEQ: 1 OPTIONS",
+				"Subject: lunch",
+				"  tomorrow",
+				"",
+				"",
+			),
+			method: MethodOptions,
+			uri:    "sip:gw.example.com",
+			header: map[string]string{"Call-ID": "1234@192.0.2.10", "Subject": "lunch tomorrow", "Via": "SIP/2.0/TCP 192.0.2.10;branch=z9hG4bKnashds8"},
+		},
+		{
+			name: "bare LF, body without Content-Length",
+			data: []byte("MESSAGE sip:bob@example.com SIP/2.0\n" +
+				"Via: SIP/2.0/UDP 192.0.2.10;branch=z9hG4bK1\n" +
+				"From: <sip:alice@example.com>;tag=1\n" +
+				"To: <sip:bob@example.com>\n" +
+				"Call-ID: 1\n" +
+				"CSeq: 2 MESSAGE\n" +
+				"\n" +
+				"hello"),
+			method: MethodMessage,
+			uri:    "sip:bob@example.com",
+			body:   "hello",
+		},
+	}
+	for _, tt := range tests {
+		m, err := Parse(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if m.Method != tt.method || m.RequestURI != tt.uri || m.StatusCode != tt.code {
+			t.Errorf("%s: start line %q %q %d, want %q %q %d", tt.name, m.Method, m.RequestURI, m.StatusCode, tt.method, tt.uri, tt.code)
+		}
+		for name, want := range tt.header {
+			if got := m.Header.Get(name); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, want)
+			}
+		}
+		if string(m.Body) != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.name, m.Body, tt.body)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	header := []string{
+		"Via: SIP/2.0/UDP 192.0.2.10;branch=z9hG4bK1",
+		"From: <sip:alice@example.com>;tag=1",
+		"To: <sip:bob@example.com>",
+		"Call-ID: 1",
+		"CSeq: 1 OPTIONS",
+	}
+	message := func(start string, extra ...string) []byte {
+		lines := append([]string{start}, header...)
+		lines = append(lines, extra...)
+		return crlf(append(lines, "", "")...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no end of header", []byte("OPTIONS sip:bob@example.com SIP/2.0\r\nCall-ID: 1\r\n")},
+		{"bad request line", message("OPTIONS sip:bob@example.com")},
+		{"bad version", message("OPTIONS sip:bob@example.com SIP/3.0")},
+		{"bad status code", message("SIP/2.0 99 Odd")},
+		{"CSeq method mismatch", message("INVITE sip:bob@example.com SIP/2.0")},
+		{"body shorter than Content-Length", message("OPTIONS sip:bob@example.com SIP/2.0", "Content-Length: 10")},
+		{"bad Content-Length", message("OPTIONS sip:bob@example.com SIP/2.0", "Content-Length: -1")},
+		{"header without colon", message("OPTIONS sip:bob@example.com SIP/2.0", "Subject")},
+		{"continuation before any header", crlf("OPTIONS sip:bob@example.com SIP/2.0", " folded", "", "")},
+		{"no Call-ID", crlf("OPTIONS sip:bob@example.com SIP/2.0", header[0], header[1], header[2], header[4], "", "")},
+		{"bad CSeq", crlf("OPTIONS sip:bob@example.com SIP/2.0", header[0], header[1], header[2], header[3], "CSeq: one OPTIONS", "", "")},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: got %v, want ErrMalformed", tt.name, err)
+		}
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	tests := map[string]string{
+		"v":                "Via",
+		"VIA":              "Via",
+		"call-id":          "Call-ID",
+		"i":                "Call-ID",
+		"cseq":             "CSeq",
+		"www-authenticate": "WWW-Authenticate",
+		"content-type":     "Content-Type",
+		"x-custom-header":  "X-Custom-Header",
+	}
+	for in, want := range tests {
+		if got := CanonicalName(in); got != want {
+			t.Errorf("CanonicalName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	data := crlf(
+		"BYE sip:alice@192.0.2.10 SIP/2.0",
+		"Via: SIP/2.0/UDP 198.51.100.1:5060;branch=z9hG4bKa, SIP/2.0/UDP 192.0.2.1;branch=z9hG4bKb",
+		"From: <sip:bob@example.com>;tag=2",
+		"To: <sip:alice@example.com>;tag=1",
+		"Call-ID: 1",
+		"CSeq: 2 BYE",
+		"",
+		"",
+	)
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Parse(m.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := again.Header.Values("Via"), m.Header.Values("Via"); strings.Join(got, "|") != strings.Join(want, "|") || len(got) != 2 {
+		t.Errorf("Vias %q after a round trip, want %q", got, want)
+	}
+	if again.Header.Get("Content-Length") != "0" {
+		t.Errorf("Content-Length %q, want 0", again.Header.Get("Content-Length"))
+	}
+}
@@ -0,0 +1,523 @@
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+)
+
+// registrarSweep is how often expired bindings are dropped.
+const registrarSweep = 30 * time.Second
+
+// AccountStore is what the registrar needs of the SIP accounts and their
+// registrations; repository.SIPAccountRepository has it.
+type AccountStore interface {
+	GetSIPAccountByID(ctx context.Context, id int64) (*models.SIPAccount, error)
+	GetSIPAccountByUsername(ctx context.Context, username string) (*models.SIPAccount, error)
+	RefreshRegistration(ctx context.Context, registration *models.SIPRegistration) error
+	UnregisterContact(ctx context.Context, accountID int64, contactURI string) error
+	ExpireRegistrations(ctx context.Context, now time.Time) (int64, error)
+	ListActiveRegistrations(ctx context.Context) ([]*models.SIPRegistration, error)
+}
+
+// RegistrarConfig sets how registrations and authentication go.
+type RegistrarConfig struct {
+	Realm          string
+	DefaultExpires int      // seconds, for contacts that ask for none
+	MinExpires     int      // shorter requests get 423 Interval Too Brief
+	MaxExpires     int      // longer requests are shortened to this
+	TrustedHosts   []string // addresses whose INVITEs need no credentials, such as our gateways
+}
+
+// Binding is where an account's UA can be reached: the contact it
+// registered and the address the REGISTER came from, which is where a UA
+// behind NAT must be sent requests.
+type Binding struct {
+	AccountID int64
+	Username  string
+	Contact   *Address
+	Network   string // transport the UA registered over
+	Source    string // host:port the REGISTER came from
+	UserAgent string
+	CallID    string
+	CSeq      uint32
+	Expires   time.Time
+}
+
+// Registrar handles REGISTER for the SIP accounts (RFC 3261 §10) and
+// authenticates requests with their credentials. Bindings are kept in
+// memory and stored as registrations, from which they are restored on
+// start.
+type Registrar struct {
+	store  AccountStore
+	auth   *DigestAuth
+	cfg    RegistrarConfig
+	logger *log.Logger
+
+	mu       sync.Mutex
+	bindings map[string][]*Binding // by username
+	trusted  map[string]bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewRegistrar creates a registrar. Zero expiry settings default to an
+// hour, a minute and two hours.
+func NewRegistrar(store AccountStore, cfg RegistrarConfig, logger *log.Logger) *Registrar {
+	if cfg.Realm == "" {
+		cfg.Realm = "sip.e173gateway.com"
+	}
+	if cfg.DefaultExpires <= 0 {
+		cfg.DefaultExpires = 3600
+	}
+	if cfg.MinExpires <= 0 {
+		cfg.MinExpires = 60
+	}
+	if cfg.MaxExpires < cfg.DefaultExpires {
+		cfg.MaxExpires = 2 * cfg.DefaultExpires
+	}
+	trusted := make(map[string]bool)
+	for _, host := range cfg.TrustedHosts {
+		if host = strings.TrimSpace(host); host != "" {
+			trusted[host] = true
+		}
+	}
+	return &Registrar{
+		store:    store,
+		auth:     NewDigestAuth(cfg.Realm),
+		cfg:      cfg,
+		logger:   logger,
+		bindings: make(map[string][]*Binding),
+		trusted:  trusted,
+	}
+}
+
+// Start restores the stored bindings and expires them as time passes.
+func (r *Registrar) Start() {
+	r.mu.Lock()
+	if r.stop != nil {
+		r.mu.Unlock()
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	r.mu.Unlock()
+
+	r.restore()
+	go r.run()
+}
+
+// Stop stops expiring bindings.
+func (r *Registrar) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop = nil
+	r.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (r *Registrar) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(registrarSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.sweep()
+		}
+	}
+}
+
+// sweep drops the expired bindings and marks their registrations expired.
+func (r *Registrar) sweep() {
+	now := time.Now()
+	r.mu.Lock()
+	for user, bindings := range r.bindings {
+		live := bindings[:0]
+		for _, b := range bindings {
+			if b.Expires.After(now) {
+				live = append(live, b)
+			} else {
+				r.logger.Printf("Registration of %s at %s expired", user, b.Contact.URI)
+			}
+		}
+		if len(live) == 0 {
+			delete(r.bindings, user)
+		} else {
+			r.bindings[user] = live
+		}
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := r.store.ExpireRegistrations(ctx, now); err != nil {
+		r.logger.Printf("Error expiring registrations: %v", err)
+	}
+}
+
+// restore loads the registrations still active in the store.
+func (r *Registrar) restore() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	regs, err := r.store.ListActiveRegistrations(ctx)
+	if err != nil {
+		r.logger.Printf("Error loading registrations: %v", err)
+		return
+	}
+	usernames := make(map[int64]string)
+	restored := 0
+	for _, reg := range regs {
+		username, ok := usernames[reg.SIPAccountID]
+		if !ok {
+			account, err := r.store.GetSIPAccountByID(ctx, reg.SIPAccountID)
+			if err != nil {
+				r.logger.Printf("Error loading SIP account %d: %v", reg.SIPAccountID, err)
+				continue
+			}
+			username = account.Username
+			usernames[reg.SIPAccountID] = username
+		}
+		contact, err := ParseAddress(reg.ContactURI)
+		if err != nil {
+			continue
+		}
+		b := &Binding{
+			AccountID: reg.SIPAccountID,
+			Username:  username,
+			Contact:   contact,
+			Network:   reg.Transport,
+			Source:    net.JoinHostPort(reg.SourceIP, strconv.Itoa(reg.SourcePort)),
+			Expires:   reg.ExpiredAt,
+		}
+		if reg.UserAgent != nil {
+			b.UserAgent = *reg.UserAgent
+		}
+		r.mu.Lock()
+		r.bindings[username] = append(r.bindings[username], b)
+		r.mu.Unlock()
+		restored++
+	}
+	if restored > 0 {
+		r.logger.Printf("Restored %d registration(s)", restored)
+	}
+}
+
+// Lookup returns the live bindings of a username.
+func (r *Registrar) Lookup(username string) []*Binding {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var live []*Binding
+	for _, b := range r.bindings[username] {
+		if b.Expires.After(now) {
+			live = append(live, b)
+		}
+	}
+	return live
+}
+
+// Trusted reports whether a request comes from a trusted host, whose
+// calls need no credentials.
+func (r *Registrar) Trusted(src Source) bool {
+	return r.trusted[hostOf(src.Addr)]
+}
+
+// Authenticate checks the credentials of a request, answering it with a
+// challenge when it has none or stale ones, or with 403 when they are
+// wrong. REGISTER is challenged with 401, other requests with 407. It
+// returns the account, or nil when the request has been answered.
+func (r *Registrar) Authenticate(req *Message, tx *ServerTransaction) *models.SIPAccount {
+	code, header := 407, "Proxy-Authenticate"
+	if req.Method == MethodRegister {
+		code, header = 401, "WWW-Authenticate"
+	}
+	challenge := func(stale bool) {
+		resp := NewResponse(req, code, "")
+		resp.Header.Add(header, r.auth.Challenge(stale))
+		tx.Respond(resp)
+	}
+
+	creds, err := r.auth.Credentials(req)
+	if err != nil {
+		if !errors.Is(err, ErrNoCredentials) {
+			tx.Respond(NewResponse(req, 400, "Bad Credentials"))
+			return nil
+		}
+		challenge(false)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	account, err := r.store.GetSIPAccountByUsername(ctx, creds.Username)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			r.logger.Printf("Authentication failed for unknown user %q from %s", creds.Username, tx.Source().Addr)
+			tx.Respond(NewResponse(req, 403, ""))
+		} else {
+			r.logger.Printf("Error loading SIP account %q: %v", creds.Username, err)
+			tx.Respond(NewResponse(req, 500, ""))
+		}
+		return nil
+	}
+
+	switch err := r.auth.Verify(creds, req.Method, req.RequestURI, account.Password); {
+	case errors.Is(err, ErrStaleNonce):
+		challenge(true)
+		return nil
+	case err != nil:
+		r.logger.Printf("Authentication failed for %s from %s: %v", account.Username, tx.Source().Addr, err)
+		tx.Respond(NewResponse(req, 403, ""))
+		return nil
+	}
+	if !account.IsActive() {
+		r.logger.Printf("Refusing %s from %s account %s", req.Method, account.Status, account.Username)
+		tx.Respond(NewResponse(req, 403, "Account "+account.Status))
+		return nil
+	}
+	if network := tx.Source().Transport.Network(); !transportAllowed(account.Transport, network) {
+		r.logger.Printf("Refusing %s over %s from %s account %s", req.Method, network, account.Transport, account.Username)
+		tx.Respond(NewResponse(req, 403, "Use "+strings.ToUpper(account.Transport)))
+		return nil
+	}
+	return account
+}
+
+// ownsUser reports whether user, the user part of an address, is an
+// account's: its username or its extension.
+func ownsUser(account *models.SIPAccount, user string) bool {
+	return user == account.Username || (account.Extension != "" && user == account.Extension)
+}
+
+// transportAllowed reports whether an account may reach us, and so be
+// reached, over a network: a TLS account only over TLS, a TCP one over
+// TCP or TLS, a UDP one over any.
+func transportAllowed(accountTransport, network string) bool {
+	switch strings.ToUpper(accountTransport) {
+	case models.TransportTLS:
+		return network == "TLS"
+	case models.TransportTCP:
+		return network == "TCP" || network == "TLS"
+	}
+	return true
+}
+
+// HandleRegister authenticates a REGISTER and adds, refreshes or removes
+// the bindings it carries (RFC 3261 §10.3). The answer lists every binding
+// of the account with its remaining time.
+func (r *Registrar) HandleRegister(req *Message, tx *ServerTransaction) {
+	account := r.Authenticate(req, tx)
+	if account == nil {
+		return
+	}
+	to, err := req.To()
+	if err != nil {
+		tx.Respond(NewResponse(req, 400, "Bad To"))
+		return
+	}
+	if !ownsUser(account, to.URI.User) {
+		tx.Respond(NewResponse(req, 403, "Not Your Address"))
+		return
+	}
+	contacts, err := req.Contacts()
+	if err != nil {
+		tx.Respond(NewResponse(req, 400, "Bad Contact"))
+		return
+	}
+	cseq, _, _ := req.CSeq()
+	src := tx.Source()
+
+	headerExpires := r.cfg.DefaultExpires
+	if v := req.Header.Get("Expires"); v != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 {
+			tx.Respond(NewResponse(req, 400, "Bad Expires"))
+			return
+		}
+		headerExpires = n
+	}
+
+	// Remove every binding.
+	if len(contacts) > 0 && contacts[0].Wildcard {
+		if len(contacts) > 1 || headerExpires != 0 {
+			tx.Respond(NewResponse(req, 400, "Bad Wildcard"))
+			return
+		}
+		for _, b := range r.Lookup(account.Username) {
+			r.remove(account, b.Contact)
+		}
+		r.logger.Printf("Unregistered all contacts of %s", account.Username)
+		r.respond(req, tx, account)
+		return
+	}
+
+	type update struct {
+		contact *Address
+		expires int
+	}
+	var updates []update
+	for _, c := range contacts {
+		if c.Wildcard {
+			tx.Respond(NewResponse(req, 400, "Bad Wildcard"))
+			return
+		}
+		expires := headerExpires
+		if v, ok := c.Params.Get("expires"); ok {
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				expires = n
+			}
+		}
+		if expires > 0 && expires < r.cfg.MinExpires {
+			resp := NewResponse(req, 423, "")
+			resp.Header.Add("Min-Expires", strconv.Itoa(r.cfg.MinExpires))
+			tx.Respond(resp)
+			return
+		}
+		if expires > r.cfg.MaxExpires {
+			expires = r.cfg.MaxExpires
+		}
+		updates = append(updates, update{c, expires})
+	}
+
+	// A REGISTER older than the one a binding came from is out of order.
+	for _, u := range updates {
+		if b := r.binding(account.Username, u.contact.URI); b != nil && b.CallID == req.CallID() && cseq <= b.CSeq {
+			tx.Respond(NewResponse(req, 500, "Out Of Order"))
+			return
+		}
+	}
+
+	for _, u := range updates {
+		if u.expires == 0 {
+			r.remove(account, u.contact)
+			r.logger.Printf("Unregistered %s at %s", account.Username, u.contact.URI)
+			continue
+		}
+		contact := &Address{URI: u.contact.URI}
+		b := &Binding{
+			AccountID: account.ID,
+			Username:  account.Username,
+			Contact:   contact,
+			Network:   src.Transport.Network(),
+			Source:    src.Addr,
+			UserAgent: req.Header.Get("User-Agent"),
+			CallID:    req.CallID(),
+			CSeq:      cseq,
+			Expires:   time.Now().Add(time.Duration(u.expires) * time.Second),
+		}
+		if err := r.save(b, u.expires); err != nil {
+			r.logger.Printf("Error saving registration of %s: %v", account.Username, err)
+			tx.Respond(NewResponse(req, 500, ""))
+			return
+		}
+		r.logger.Printf("Registered %s at %s from %s for %ds", account.Username, contact.URI, src.Addr, u.expires)
+	}
+	r.respond(req, tx, account)
+}
+
+// respond answers a REGISTER with the account's bindings.
+func (r *Registrar) respond(req *Message, tx *ServerTransaction, account *models.SIPAccount) {
+	resp := NewResponse(req, 200, "")
+	now := time.Now()
+	for _, b := range r.Lookup(account.Username) {
+		c := b.Contact.Clone()
+		c.Params.Set("expires", strconv.Itoa(int(b.Expires.Sub(now).Seconds()+0.5)))
+		resp.Header.Add("Contact", c.String())
+	}
+	resp.Header.Add("Date", now.UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT"))
+	tx.Respond(resp)
+}
+
+// binding returns the binding of a username to a contact URI, nil if none.
+func (r *Registrar) binding(username string, uri *URI) *Binding {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := uri.String()
+	for _, b := range r.bindings[username] {
+		if b.Contact.URI.String() == key {
+			return b
+		}
+	}
+	return nil
+}
+
+// save stores a binding, replacing the one to the same contact.
+func (r *Registrar) save(b *Binding, expires int) error {
+	host, port, err := net.SplitHostPort(b.Source)
+	if err != nil {
+		return fmt.Errorf("bad source address %q: %w", b.Source, err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	now := time.Now()
+	reg := &models.SIPRegistration{
+		SIPAccountID:   b.AccountID,
+		ContactURI:     b.Contact.URI.String(),
+		SourceIP:       host,
+		SourcePort:     portNum,
+		Transport:      b.Network,
+		ExpiresSeconds: expires,
+		RegisteredAt:   now,
+		ExpiredAt:      b.Expires,
+		IsActive:       true,
+	}
+	if b.UserAgent != "" {
+		ua := b.UserAgent
+		reg.UserAgent = &ua
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.store.RefreshRegistration(ctx, reg); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bindings := r.bindings[b.Username]
+	for i, old := range bindings {
+		if old.Contact.URI.String() == reg.ContactURI {
+			bindings[i] = b
+			return nil
+		}
+	}
+	r.bindings[b.Username] = append(bindings, b)
+	return nil
+}
+
+// remove drops the binding of an account to a contact.
+func (r *Registrar) remove(account *models.SIPAccount, contact *Address) {
+	key := contact.URI.String()
+	r.mu.Lock()
+	bindings := r.bindings[account.Username]
+	for i, b := range bindings {
+		if b.Contact.URI.String() == key {
+			r.bindings[account.Username] = append(bindings[:i], bindings[i+1:]...)
+			break
+		}
+	}
+	if len(r.bindings[account.Username]) == 0 {
+		delete(r.bindings, account.Username)
+	}
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.store.UnregisterContact(ctx, account.ID, key); err != nil {
+		r.logger.Printf("Error unregistering %s at %s: %v", account.Username, key, err)
+	}
+}
@@ -0,0 +1,88 @@
+package sip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+)
+
+// fakeAccounts holds SIP accounts by username.
+type fakeAccounts struct {
+	AccountStore
+	accounts map[string]*models.SIPAccount
+}
+
+func (s *fakeAccounts) GetSIPAccountByUsername(ctx context.Context, username string) (*models.SIPAccount, error) {
+	if a, ok := s.accounts[username]; ok {
+		return a, nil
+	}
+	return nil, repository.ErrNotFound
+}
+
+func TestOwnsUser(t *testing.T) {
+	account := &models.SIPAccount{Username: "1001", Extension: "201"}
+	for user, want := range map[string]bool{"1001": true, "201": true, "1002": false, "": false} {
+		if got := ownsUser(account, user); got != want {
+			t.Errorf("ownsUser(%q) = %v, want %v", user, got, want)
+		}
+	}
+	if ownsUser(&models.SIPAccount{Username: "1001"}, "") {
+		t.Error("an account without extension owns the empty user")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	r := NewRegistrar(&fakeAccounts{accounts: map[string]*models.SIPAccount{
+		"1001": {ID: 1, Username: "1001", Password: "secret", Status: models.SIPAccountStatusActive},
+	}}, RegistrarConfig{Realm: "sip.example.com"}, log.New(io.Discard, "", 0))
+	tl, transport := newTestLayer(false)
+	src := Source{Transport: transport, Addr: "192.0.2.10:5060"}
+	nonce := r.auth.newNonce(time.Now())
+
+	// invite returns what an INVITE with credentials for uri, nc and
+	// password is answered with, "" when it is let through.
+	n := 0
+	invite := func(uri, nc, password string) string {
+		n++
+		req := testRequest(t, MethodInvite, "192.0.2.10:5060", fmt.Sprintf("%sauth%d", BranchPrefix, n), n)
+		if uri != "" {
+			c := answer(nonce, MethodInvite, uri, password, nc)
+			req.Header.Add("Proxy-Authorization", fmt.Sprintf(
+				`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=MD5, cnonce="%s", qop=auth, nc=%s`,
+				c.Username, c.Realm, c.Nonce, c.URI, c.Response, c.CNonce, c.NC))
+		}
+		var account *models.SIPAccount
+		tl.OnRequest(func(req *Message, tx *ServerTransaction) { account = r.Authenticate(req, tx) })
+		tl.Receive(req, src)
+		if account != nil {
+			return ""
+		}
+		sent := transport.summaries()
+		return strings.TrimSuffix(sent[len(sent)-1], " INVITE")
+	}
+
+	const uri = "sip:0612345678@gw.example.com" // testRequest's Request-URI
+	tests := []struct {
+		name, uri, nc, password string
+		want                    string
+	}{
+		{"no credentials", "", "", "", "407"},
+		{"good", uri, "00000001", "secret", ""},
+		{"replayed", uri, "00000001", "secret", "403"},
+		{"next count", uri, "00000002", "secret", ""},
+		{"for another URI", "sip:0699999999@gw.example.com", "00000003", "secret", "403"},
+		{"wrong password", uri, "00000004", "guess", "403"},
+	}
+	for _, tt := range tests {
+		if got := invite(tt.uri, tt.nc, tt.password); got != tt.want {
+			t.Errorf("%s: answered %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package sip
+
+import (
+	"net"
+	"strings"
+)
+
+// fixSDP points the media of a session description at the address its
+// sender was seen at when the description announces a private address, as
+// a UA behind NAT does. Its media is then sent where its own comes from.
+// Other descriptions are returned unchanged.
+func fixSDP(body []byte, seenHost string) []byte {
+	seen := net.ParseIP(seenHost)
+	if len(body) == 0 || seen == nil || isPrivate(seen) {
+		return body
+	}
+	family := "IP4"
+	if seen.To4() == nil {
+		family = "IP6"
+	}
+	lines := strings.SplitAfter(string(body), "\n")
+	changed := false
+	for i, line := range lines {
+		var prefix string
+		switch {
+		case strings.HasPrefix(line, "c="):
+			prefix = "c="
+		case strings.HasPrefix(line, "o="):
+			prefix = "o="
+		default:
+			continue
+		}
+		content := strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(content[len(prefix):])
+		// c=IN IP4 addr, o=user id version IN IP4 addr
+		if len(fields) < 3 {
+			continue
+		}
+		addr := net.ParseIP(fields[len(fields)-1])
+		if addr == nil || !isPrivate(addr) {
+			continue
+		}
+		fields[len(fields)-2] = family
+		fields[len(fields)-1] = seen.String()
+		lines[i] = prefix + strings.Join(fields, " ") + line[len(content):]
+		changed = true
+	}
+	if !changed {
+		return body
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
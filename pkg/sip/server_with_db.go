@@ -27,6 +27,7 @@ func NewBasicSIPServerWithDB(port int, whatsappAPIKey string, dbPool *pgxpool.Po
         filterEng:  filterEng,
         routingEng: NewRoutingEngine(),
         voiceAI:    NewVoiceAIService(),
+        dialogs:    NewDialogs(),
         logger:     log.New(log.Writer(), "[SIP] ", log.LstdFlags),
     }
 }
\ No newline at end of file
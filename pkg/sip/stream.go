@@ -0,0 +1,425 @@
+package sip
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// keepaliveInterval is how often connections we opened are pinged
+	// with a double CRLF (RFC 5626 §4.4.1).
+	keepaliveInterval = 30 * time.Second
+	// idleTimeout closes connections nothing has been read from for
+	// that long. They are opened again when needed.
+	idleTimeout = 10 * time.Minute
+	dialTimeout = 10 * time.Second
+	// writeTimeout bounds a write to a peer that stopped reading.
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	ping = []byte("\r\n\r\n")
+	pong = []byte("\r\n")
+)
+
+// TLSOptions are the files a TLS transport is set up from.
+type TLSOptions struct {
+	CertFile string // our certificate chain, PEM
+	KeyFile  string // its private key, PEM
+	// CAFile holds the CAs peers' certificates are checked against, PEM.
+	// The system's are used when empty.
+	CAFile string
+	// VerifyClients requires clients to present a certificate signed by
+	// one of the CAs of CAFile: mutual TLS.
+	VerifyClients bool
+}
+
+// LoadTLSConfig builds the configuration of a TLS transport, which both
+// accepts connections and opens them to gateways, presenting the same
+// certificate.
+func LoadTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in TLS CA file %s", opts.CAFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+	if opts.VerifyClients {
+		if opts.CAFile == "" {
+			return nil, errors.New("verifying TLS clients needs a CA file")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// StreamTransport carries messages over TCP or TLS connections, framed by
+// their Content-Length (RFC 3261 §18.3). A connection, accepted or
+// opened, is used for every message to its peer until it closes, so
+// requests reach UAs behind NAT over the connection they registered on.
+type StreamTransport struct {
+	network   string
+	listener  net.Listener
+	tlsConfig *tls.Config
+	logger    *log.Logger
+
+	mu      sync.Mutex
+	handler Handler
+	conns   map[string]*streamConn // by peer host:port
+	closed  bool
+}
+
+// ListenTCP opens a TCP transport on a host:port address.
+func ListenTCP(addr string, logger *log.Logger) (*StreamTransport, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on TCP: %w", err)
+	}
+	return newStreamTransport("TCP", l, nil, logger), nil
+}
+
+// ListenTLS opens a TLS transport on a host:port address.
+func ListenTLS(addr string, config *tls.Config, logger *log.Logger) (*StreamTransport, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on TLS: %w", err)
+	}
+	return newStreamTransport("TLS", tls.NewListener(l, config), config, logger), nil
+}
+
+func newStreamTransport(network string, l net.Listener, config *tls.Config, logger *log.Logger) *StreamTransport {
+	return &StreamTransport{
+		network:   network,
+		listener:  l,
+		tlsConfig: config,
+		logger:    logger,
+		conns:     make(map[string]*streamConn),
+	}
+}
+
+// Network returns "TCP" or "TLS".
+func (t *StreamTransport) Network() string { return t.network }
+
+// Reliable returns true: the connection delivers messages.
+func (t *StreamTransport) Reliable() bool { return true }
+
+// LocalAddr returns the address the transport listens on.
+func (t *StreamTransport) LocalAddr() net.Addr { return t.listener.Addr() }
+
+// Serve accepts connections until Close, reading messages from each.
+func (t *StreamTransport) Serve(handler Handler) error {
+	t.mu.Lock()
+	t.handler = handler
+	t.mu.Unlock()
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			t.logger.Printf("Error accepting %s connection: %v", t.network, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		c := t.add(conn)
+		if c == nil {
+			conn.Close()
+			return nil
+		}
+		go c.serve()
+	}
+}
+
+// Send sends a message to addr over the connection to it, opening one
+// when there is none. A message that cannot be written on a connection
+// is sent again over a new one, in case the old one had died.
+func (t *StreamTransport) Send(addr string, msg *Message) error {
+	data := msg.Bytes()
+	c, err := t.conn(addr)
+	if err != nil {
+		return err
+	}
+	if err := c.write(data); err == nil {
+		return nil
+	}
+	if c, err = t.conn(addr); err != nil {
+		return err
+	}
+	return c.write(data)
+}
+
+// Close stops Serve and closes every connection.
+func (t *StreamTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	conns := make([]*streamConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	err := t.listener.Close()
+	for _, c := range conns {
+		c.close()
+	}
+	return err
+}
+
+// conn returns the connection to addr, opening it if needed.
+func (t *StreamTransport) conn(addr string) (*streamConn, error) {
+	t.mu.Lock()
+	c := t.conns[addr]
+	t.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		config := t.tlsConfig.Clone()
+		config.ServerName = hostOf(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s over %s: %w", addr, t.network, err)
+	}
+
+	t.mu.Lock()
+	if other := t.conns[addr]; other != nil {
+		// Another message opened one meanwhile.
+		t.mu.Unlock()
+		conn.Close()
+		return other, nil
+	}
+	t.mu.Unlock()
+	c = t.add(conn, addr)
+	if c == nil {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	go c.serve()
+	go c.keepalive()
+	return c, nil
+}
+
+// add registers a connection under its peer's address and the addresses
+// it was opened to. It returns nil once the transport is closed.
+func (t *StreamTransport) add(conn net.Conn, aliases ...string) *streamConn {
+	c := &streamConn{
+		t:    t,
+		conn: conn,
+		peer: conn.RemoteAddr().String(),
+		keys: append([]string{conn.RemoteAddr().String()}, aliases...),
+		done: make(chan struct{}),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	for _, key := range c.keys {
+		t.conns[key] = c
+	}
+	return c
+}
+
+func (t *StreamTransport) remove(c *streamConn) {
+	t.mu.Lock()
+	for _, key := range c.keys {
+		if t.conns[key] == c {
+			delete(t.conns, key)
+		}
+	}
+	t.mu.Unlock()
+}
+
+// streamConn is one connection of a stream transport.
+type streamConn struct {
+	t    *StreamTransport
+	conn net.Conn
+	peer string   // host:port messages come from
+	keys []string // addresses it is found under
+
+	wmu sync.Mutex
+
+	mu           sync.Mutex
+	awaitingPong bool // a ping went unanswered by any data so far
+	pongs        bool // the peer answers pings
+	closeOnce    sync.Once
+	done         chan struct{}
+}
+
+// serve reads messages until the connection closes, handling each before
+// reading the next. Blank lines between messages are keepalives: a double
+// CRLF is a ping, answered by a CRLF pong.
+func (c *streamConn) serve() {
+	defer c.close()
+	r := bufio.NewReaderSize(c.conn, 8192)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.t.logger.Printf("Closing %s connection with %s: %v", c.t.network, c.peer, err)
+			}
+			return
+		}
+		c.heard()
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// Waits for the next bytes, which may come in another segment:
+			// a CRLF ends a ping, anything else follows a pong.
+			if next, err := r.Peek(2); err == nil && string(next) == "\r\n" {
+				r.Discard(2)
+				c.write(pong)
+				continue
+			}
+			c.ponged()
+			continue
+		}
+		data, err := readStreamMessage(r, line)
+		if err != nil {
+			// Framing is lost: nothing after can be read.
+			c.t.logger.Printf("Closing %s connection with %s: %v", c.t.network, c.peer, err)
+			return
+		}
+		msg, err := Parse(data)
+		if err != nil {
+			c.t.logger.Printf("Dropping message from %s: %v", c.peer, err)
+			continue
+		}
+		c.t.mu.Lock()
+		handler := c.t.handler
+		c.t.mu.Unlock()
+		if handler != nil {
+			// One at a time, so messages are handled in the order they
+			// were sent, e.g. a CANCEL after the INVITE it cancels.
+			handler(msg, Source{Transport: c.t, Addr: c.peer})
+		}
+	}
+}
+
+// readStreamMessage reads the rest of a message whose start line has been
+// read: the header up to its blank line, then the body of the length its
+// Content-Length gives, none when absent.
+func readStreamMessage(r *bufio.Reader, start []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(start)
+	length := 0
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, fmt.Errorf("%w: header line too long", ErrMalformed)
+			}
+			return nil, err
+		}
+		buf.Write(line)
+		if buf.Len() > maxMessageSize {
+			return nil, fmt.Errorf("%w: header too long", ErrMalformed)
+		}
+		text := string(bytes.TrimRight(line, "\r\n"))
+		if text == "" {
+			break
+		}
+		if name, value, ok := strings.Cut(text, ":"); ok && CanonicalName(name) == "Content-Length" {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || length < 0 || length > maxMessageSize {
+				return nil, fmt.Errorf("%w: bad Content-Length %q", ErrMalformed, value)
+			}
+		}
+	}
+	head := buf.Len()
+	buf.Grow(length)
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes()[:head+length], nil
+}
+
+// keepalive pings a connection we opened until it closes, closing it when
+// a peer that answers pings stops answering.
+func (c *streamConn) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		dead := c.awaitingPong && c.pongs
+		c.awaitingPong = true
+		c.mu.Unlock()
+		if dead {
+			c.t.logger.Printf("%s connection with %s stopped answering keepalives", c.t.network, c.peer)
+			c.close()
+			return
+		}
+		if err := c.write(ping); err != nil {
+			return
+		}
+	}
+}
+
+// heard notes that the peer sent something, so it is alive.
+func (c *streamConn) heard() {
+	c.mu.Lock()
+	c.awaitingPong = false
+	c.mu.Unlock()
+}
+
+func (c *streamConn) ponged() {
+	c.mu.Lock()
+	c.pongs = true
+	c.mu.Unlock()
+}
+
+// write writes data whole, closing the connection on error.
+func (c *streamConn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(data); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *streamConn) close() {
+	c.closeOnce.Do(func() {
+		c.t.remove(c)
+		c.conn.Close()
+		close(c.done)
+	})
+}
@@ -0,0 +1,212 @@
+package sip
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+)
+
+// serveTCP serves a TCP transport on the loopback with handler and
+// returns a connection to it.
+func serveTCP(t *testing.T, handler Handler) net.Conn {
+	t.Helper()
+	tr, err := ListenTCP("127.0.0.1:0", log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	go tr.Serve(handler)
+	conn, err := net.Dial("tcp", tr.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestStreamHandlesMessagesInOrder(t *testing.T) {
+	cseqs := make(chan uint32, 50)
+	conn := serveTCP(t, func(msg *Message, src Source) {
+		n, _, _ := msg.CSeq()
+		if n == 1 {
+			// Later messages wait for this one.
+			time.Sleep(50 * time.Millisecond)
+		}
+		cseqs <- n
+	})
+
+	var b strings.Builder
+	for i := 1; i <= 20; i++ {
+		b.WriteString(fmt.Sprintf("OPTIONS sip:gw.example.com SIP/2.0\r\n"+
+			"Via: SIP/2.0/TCP 127.0.0.1;branch=z9hG4bK%d\r\n"+
+			"From: <sip:alice@example.com>;tag=1\r\n"+
+			"To: <sip:gw.example.com>\r\n"+
+			"Call-ID: order\r\n"+
+			"CSeq: %d OPTIONS\r\n"+
+			"Content-Length: 0\r\n\r\n", i, i))
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	for want := uint32(1); want <= 20; want++ {
+		select {
+		case n := <-cseqs:
+			if n != want {
+				t.Fatalf("handled CSeq %d, want %d", n, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("CSeq %d never handled", want)
+		}
+	}
+}
+
+func TestStreamAnswersSplitPing(t *testing.T) {
+	conn := serveTCP(t, func(msg *Message, src Source) {})
+
+	// The two CRLFs of a ping in separate segments.
+	conn.Write([]byte("\r\n"))
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte("\r\n"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 8)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no pong: %v", err)
+	}
+	if string(buf[:n]) != "\r\n" {
+		t.Errorf("answered %q, want a CRLF pong", buf[:n])
+	}
+}
+
+func TestStreamPongBeforeMessage(t *testing.T) {
+	got := make(chan *Message, 1)
+	conn := serveTCP(t, func(msg *Message, src Source) { got <- msg })
+
+	// A pong, then a message: no ping answered, the message handled.
+	conn.Write([]byte("\r\nOPTIONS sip:gw.example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP 127.0.0.1;branch=z9hG4bKpong\r\n" +
+		"From: <sip:alice@example.com>;tag=1\r\n" +
+		"To: <sip:gw.example.com>\r\n" +
+		"Call-ID: pong\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	select {
+	case msg := <-got:
+		if msg.CallID() != "pong" {
+			t.Errorf("handled %s", msg.Summary())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message after the pong not handled")
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := conn.Read(make([]byte, 8)); n != 0 {
+		t.Errorf("%d bytes answered to a pong", n)
+	}
+}
+
+// blockingAccounts holds up account lookups until release is closed, then
+// finds no account.
+type blockingAccounts struct {
+	AccountStore
+	looking chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingAccounts) GetSIPAccountByUsername(ctx context.Context, username string) (*models.SIPAccount, error) {
+	s.looking <- struct{}{}
+	<-s.release
+	return nil, repository.ErrNotFound
+}
+
+// readFinal reads the messages sent on a stream connection up to the
+// next final response.
+func readFinal(t *testing.T, conn net.Conn, r *bufio.Reader) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			t.Fatalf("no response: %v", err)
+		}
+		data, err := readStreamMessage(r, line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.StatusCode >= 200 {
+			return msg
+		}
+	}
+}
+
+func TestStreamReadsWhileInviteIsHandled(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	store := &blockingAccounts{looking: make(chan struct{}, 1), release: make(chan struct{})}
+	tr, err := ListenTCP("127.0.0.1:0", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	s := NewBasicSIPServer(0, "")
+	s.logger = logger
+	s.tl = NewTransactionLayer(logger)
+	s.tl.AddTransport(tr)
+	s.tl.OnRequest(s.handleRequest)
+	s.b2bua = NewB2BUA(s.tl, logger)
+	s.registrar = NewRegistrar(store, RegistrarConfig{Realm: "sip.example.com"}, logger)
+	go tr.Serve(s.tl.Receive)
+
+	conn, err := net.Dial("tcp", tr.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+
+	const uri = "sip:0612345678@gw.example.com"
+	c := answer(s.registrar.auth.newNonce(time.Now()), MethodInvite, uri, "secret", "00000001")
+	conn.Write([]byte("INVITE " + uri + " SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP 127.0.0.1;branch=z9hG4bKinvite\r\n" +
+		"From: <sip:1001@gw.example.com>;tag=1\r\n" +
+		"To: <sip:0612345678@gw.example.com>\r\n" +
+		"Call-ID: slow\r\n" +
+		"CSeq: 1 INVITE\r\n" +
+		fmt.Sprintf(`Proxy-Authorization: Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=MD5, cnonce="%s", qop=auth, nc=%s`,
+			c.Username, c.Realm, c.Nonce, c.URI, c.Response, c.CNonce, c.NC) + "\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	select {
+	case <-store.looking:
+	case <-time.After(5 * time.Second):
+		t.Fatal("INVITE never authenticated")
+	}
+
+	// The INVITE's account lookup is still waiting.
+	conn.Write([]byte("OPTIONS sip:gw.example.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/TCP 127.0.0.1;branch=z9hG4bKoptions\r\n" +
+		"From: <sip:1001@gw.example.com>;tag=2\r\n" +
+		"To: <sip:gw.example.com>\r\n" +
+		"Call-ID: ping\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 || resp.CallID() != "ping" {
+		t.Fatalf("answered %s while the INVITE was handled, want the OPTIONS' 200", resp.Summary())
+	}
+
+	close(store.release)
+	if resp := readFinal(t, conn, r); resp.StatusCode != 403 || resp.CallID() != "slow" {
+		t.Errorf("answered %s, want the INVITE's 403", resp.Summary())
+	}
+}
@@ -0,0 +1,857 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timer values of RFC 3261 §17.
+const (
+	T1 = 500 * time.Millisecond // round-trip time estimate
+	T2 = 4 * time.Second        // longest retransmit interval of non-INVITE requests and INVITE responses
+	T4 = 5 * time.Second        // longest time a message stays in the network
+
+	timerB = 64 * T1          // also F, H, J, L and M
+	timerD = 32 * time.Second // INVITE client waiting for retransmitted responses
+)
+
+var (
+	// ErrTimeout is returned when a transaction got no answer in time.
+	ErrTimeout = errors.New("sip: transaction timed out")
+	// ErrNoAck is returned when a 2xx to an INVITE was never acknowledged.
+	ErrNoAck = errors.New("sip: no ACK for the 2xx response")
+	// ErrTerminated is returned for a transaction that can send no more.
+	ErrTerminated = errors.New("sip: transaction terminated")
+	// ErrNoTransport is returned for a destination on a transport the
+	// layer does not have.
+	ErrNoTransport = errors.New("sip: no such transport")
+)
+
+type txState int
+
+const (
+	txCalling txState = iota // INVITE client before any response
+	txTrying                 // non-INVITE before any response
+	txProceeding
+	txCompleted
+	txConfirmed
+	txAccepted // INVITE answered with a 2xx (RFC 6026)
+	txTerminated
+)
+
+// RequestHandler receives new requests with their server transaction. An
+// ACK to a 2xx, which has none, comes with a nil transaction; CANCEL is
+// answered by the layer and not passed on.
+type RequestHandler func(req *Message, tx *ServerTransaction)
+
+// ResponseHandler receives the responses matching no client transaction,
+// such as a retransmitted 2xx to an INVITE whose transaction has ended.
+type ResponseHandler func(resp *Message, src Source)
+
+// TransactionLayer matches requests and responses to transactions and
+// retransmits them over unreliable transports (RFC 3261 §17).
+type TransactionLayer struct {
+	logger *log.Logger
+
+	mu         sync.Mutex
+	transports map[string]Transport
+	host       string
+	servers    map[string]*ServerTransaction
+	clients    map[string]*ClientTransaction
+	accepted   map[string]*ServerTransaction // INVITEs answered with a 2xx, by Call-ID, CSeq and From tag, until ACKed
+	onRequest  RequestHandler
+	onStray    ResponseHandler
+}
+
+// NewTransactionLayer creates a transaction layer without transports.
+func NewTransactionLayer(logger *log.Logger) *TransactionLayer {
+	return &TransactionLayer{
+		logger:     logger,
+		transports: make(map[string]Transport),
+		servers:    make(map[string]*ServerTransaction),
+		clients:    make(map[string]*ClientTransaction),
+		accepted:   make(map[string]*ServerTransaction),
+	}
+}
+
+// AddTransport adds a transport for requests sent over its network.
+// Messages it reads are passed to Receive by whoever serves it.
+func (tl *TransactionLayer) AddTransport(t Transport) {
+	tl.mu.Lock()
+	tl.transports[t.Network()] = t
+	tl.mu.Unlock()
+}
+
+// Transport returns the transport of a network, nil if none.
+func (tl *TransactionLayer) Transport(network string) Transport {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return tl.transports[strings.ToUpper(network)]
+}
+
+// SetHost sets the host put in Via and Contact headers, e.g. the public
+// address of a gateway behind NAT. The address a transport reaches a peer
+// from is used when empty.
+func (tl *TransactionLayer) SetHost(host string) {
+	tl.mu.Lock()
+	tl.host = host
+	tl.mu.Unlock()
+}
+
+// OnRequest sets the handler of new requests.
+func (tl *TransactionLayer) OnRequest(fn RequestHandler) {
+	tl.mu.Lock()
+	tl.onRequest = fn
+	tl.mu.Unlock()
+}
+
+// OnStrayResponse sets the handler of responses matching no transaction.
+func (tl *TransactionLayer) OnStrayResponse(fn ResponseHandler) {
+	tl.mu.Lock()
+	tl.onStray = fn
+	tl.mu.Unlock()
+}
+
+// SentBy returns the host and port the layer puts in headers for messages
+// sent over a transport to addr.
+func (tl *TransactionLayer) SentBy(t Transport, addr string) (string, int) {
+	tl.mu.Lock()
+	host := tl.host
+	tl.mu.Unlock()
+
+	var port int
+	if h, p, err := net.SplitHostPort(t.LocalAddr().String()); err == nil {
+		port, _ = strconv.Atoi(p)
+		if host == "" {
+			if ip := net.ParseIP(h); ip != nil && !ip.IsUnspecified() {
+				host = h
+			}
+		}
+	}
+	if host == "" {
+		host = outboundIP(addr)
+	}
+	return host, port
+}
+
+// ContactURI returns a URI reaching user at this element over a transport,
+// as seen from addr.
+func (tl *TransactionLayer) ContactURI(t Transport, addr, user string) *URI {
+	host, port := tl.SentBy(t, addr)
+	u := &URI{Scheme: "sip", User: user, Host: host, Port: port}
+	if t.Network() != "UDP" {
+		u.Params.Set("transport", strings.ToLower(t.Network()))
+	}
+	return u
+}
+
+// outboundIP returns the local address the system routes to addr from.
+func outboundIP(addr string) string {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return hostOf(conn.LocalAddr().String())
+}
+
+// Receive passes a message read by a transport to its transaction, or
+// starts a new server transaction for a new request.
+func (tl *TransactionLayer) Receive(msg *Message, src Source) {
+	if !msg.IsRequest() {
+		tl.receiveResponse(msg, src)
+		return
+	}
+	via, err := msg.TopVia()
+	if err != nil {
+		tl.logger.Printf("Dropping request from %s: %v", src.Addr, err)
+		return
+	}
+	stampVia(msg, via, src)
+
+	key := serverKey(msg, via)
+	tl.mu.Lock()
+	tx, found := tl.servers[key]
+	if !found && msg.Method != MethodAck {
+		// Looked up and added under one lock, so a retransmission read
+		// while the original is being handled cannot start a second
+		// transaction.
+		tx = tl.newServerTransaction(key, msg, src)
+	}
+	onRequest := tl.onRequest
+	tl.mu.Unlock()
+	if found {
+		tx.receive(msg)
+		return
+	}
+
+	switch msg.Method {
+	case MethodAck:
+		// The ACK of a 2xx: a transaction of its own, for the dialog.
+		n, _, _ := msg.CSeq()
+		tl.mu.Lock()
+		atx := tl.accepted[ackKey(msg, n)]
+		tl.mu.Unlock()
+		if atx != nil {
+			atx.acked()
+		}
+		if onRequest != nil {
+			onRequest(msg, nil)
+		}
+		return
+	case MethodCancel:
+		tl.receiveCancel(tx, via)
+		return
+	}
+
+	if msg.Method == MethodInvite {
+		tx.Respond(NewResponse(msg, 100, ""))
+	}
+	if onRequest == nil {
+		tx.Respond(NewResponse(msg, 503, ""))
+		return
+	}
+	onRequest(msg, tx)
+}
+
+// receiveCancel answers a CANCEL in its new transaction and ends the INVITE
+// it cancels with a 487 (RFC 3261 §9.2).
+func (tl *TransactionLayer) receiveCancel(cancelTx *ServerTransaction, via *Via) {
+	req := cancelTx.Request
+	inviteKey := serverKeyFor(req, via, MethodInvite)
+	tl.mu.Lock()
+	invite := tl.servers[inviteKey]
+	tl.mu.Unlock()
+	if invite == nil {
+		cancelTx.Respond(NewResponse(req, 481, ""))
+		return
+	}
+	cancelTx.Respond(NewResponse(req, 200, ""))
+	invite.cancel()
+}
+
+func (tl *TransactionLayer) receiveResponse(resp *Message, src Source) {
+	via, err := resp.TopVia()
+	if err != nil {
+		tl.logger.Printf("Dropping response from %s: %v", src.Addr, err)
+		return
+	}
+	tl.mu.Lock()
+	tx := tl.clients[clientKey(via.Branch(), resp.CSeqMethod())]
+	onStray := tl.onStray
+	tl.mu.Unlock()
+	if tx != nil {
+		tx.receive(resp)
+		return
+	}
+	if onStray != nil {
+		onStray(resp, src)
+	}
+}
+
+// stampVia records in the top Via the address a request came from (RFC
+// 3261 §18.2.1, RFC 3581), so responses find their way back through NAT.
+func stampVia(req *Message, via *Via, src Source) {
+	host, port, err := net.SplitHostPort(src.Addr)
+	if err != nil {
+		return
+	}
+	changed := false
+	if rport, ok := via.Params.Get("rport"); ok && rport == "" {
+		via.Params.Set("rport", port)
+		via.Params.Set("received", host)
+		changed = true
+	} else if via.Host != host {
+		via.Params.Set("received", host)
+		changed = true
+	}
+	if changed {
+		req.SetTopVia(via)
+	}
+}
+
+// serverKey identifies the server transaction of a request. An ACK
+// belongs to its INVITE's transaction.
+func serverKey(req *Message, via *Via) string {
+	method := req.Method
+	if method == MethodAck {
+		method = MethodInvite
+	}
+	return serverKeyFor(req, via, method)
+}
+
+func serverKeyFor(req *Message, via *Via, method string) string {
+	if branch := via.Branch(); strings.HasPrefix(branch, BranchPrefix) {
+		return branch + "|" + via.SentBy() + "|" + method
+	}
+	// RFC 2543 peers: no unique branch.
+	n, _, _ := req.CSeq()
+	fromTag := ""
+	if from, err := req.From(); err == nil {
+		fromTag = from.Tag()
+	}
+	return fmt.Sprintf("%s|%s|%s|%d|%s|%s", req.CallID(), fromTag, via.SentBy(), n, req.RequestURI, method)
+}
+
+func clientKey(branch, method string) string {
+	if method == MethodAck {
+		method = MethodInvite
+	}
+	return branch + "|" + method
+}
+
+// ackKey matches the ACK of a 2xx, which has a branch of its own, to the
+// INVITE it acknowledges.
+func ackKey(msg *Message, cseq uint32) string {
+	fromTag := ""
+	if from, err := msg.From(); err == nil {
+		fromTag = from.Tag()
+	}
+	return fmt.Sprintf("%s|%d|%s", msg.CallID(), cseq, fromTag)
+}
+
+// ServerTransaction answers one request. INVITE transactions retransmit
+// their final response over unreliable transports until it is ACKed.
+type ServerTransaction struct {
+	tl      *TransactionLayer
+	key     string
+	Request *Message
+	src     Source
+	invite  bool
+	toTag   string
+
+	mu           sync.Mutex
+	state        txState
+	last         *Message
+	interval     time.Duration
+	retx         *time.Timer
+	timeout      *time.Timer
+	cancelled    chan struct{}
+	done         chan struct{}
+	err          error
+	wasCancelled bool
+}
+
+// newServerTransaction starts the transaction of a request and adds it to
+// the layer. Called with tl.mu held.
+func (tl *TransactionLayer) newServerTransaction(key string, req *Message, src Source) *ServerTransaction {
+	tx := &ServerTransaction{
+		tl:        tl,
+		key:       key,
+		Request:   req,
+		src:       src,
+		invite:    req.Method == MethodInvite,
+		toTag:     NewTag(),
+		state:     txProceeding,
+		cancelled: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if !tx.invite {
+		tx.state = txTrying
+	}
+	if to, err := req.To(); err == nil && to.Tag() != "" {
+		tx.toTag = to.Tag() // in a dialog already
+	}
+	tl.servers[key] = tx
+	return tx
+}
+
+// Source returns where the request came from.
+func (tx *ServerTransaction) Source() Source { return tx.src }
+
+// ToTag returns the tag the transaction's responses put in To.
+func (tx *ServerTransaction) ToTag() string { return tx.toTag }
+
+// Cancelled is closed when a CANCEL ended the INVITE; the layer has
+// answered it with a 487.
+func (tx *ServerTransaction) Cancelled() <-chan struct{} { return tx.cancelled }
+
+// Done is closed when the transaction terminates.
+func (tx *ServerTransaction) Done() <-chan struct{} { return tx.done }
+
+// Err returns why the transaction ended badly: ErrNoAck when a final
+// response to an INVITE was never acknowledged.
+func (tx *ServerTransaction) Err() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.err
+}
+
+// Respond sends a response to the request. Responses other than 100 get
+// the transaction's To-tag.
+func (tx *ServerTransaction) Respond(resp *Message) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.state != txTrying && tx.state != txProceeding {
+		return ErrTerminated
+	}
+	if resp.StatusCode > 100 {
+		if to, err := resp.To(); err == nil && to.Tag() == "" {
+			to.Params.Set("tag", tx.toTag)
+			resp.Header.Set("To", to.String())
+		}
+	}
+	tx.last = resp
+	if err := tx.send(resp); err != nil {
+		tx.tl.logger.Printf("Failed to send %s to %s: %v", resp.Summary(), tx.src.Addr, err)
+	}
+
+	unreliable := !tx.src.Transport.Reliable()
+	switch {
+	case resp.StatusCode < 200:
+		tx.state = txProceeding
+	case tx.invite && resp.StatusCode < 300:
+		// The 2xx is retransmitted until ACKed (RFC 3261 §13.3.1.4); the
+		// ACK comes in a transaction of its own.
+		tx.state = txAccepted
+		n, _, _ := tx.Request.CSeq()
+		tx.tl.mu.Lock()
+		tx.tl.accepted[ackKey(tx.Request, n)] = tx
+		tx.tl.mu.Unlock()
+		if unreliable {
+			tx.interval = T1
+			tx.retx = time.AfterFunc(tx.interval, tx.retransmit)
+		}
+		tx.timeout = time.AfterFunc(timerB, func() { tx.terminate(ErrNoAck) })
+	case tx.invite:
+		tx.state = txCompleted
+		if unreliable {
+			tx.interval = T1
+			tx.retx = time.AfterFunc(tx.interval, tx.retransmit)
+		}
+		tx.timeout = time.AfterFunc(timerB, func() { tx.terminate(ErrNoAck) })
+	default:
+		tx.state = txCompleted
+		wait := time.Duration(0)
+		if unreliable {
+			wait = timerB
+		}
+		tx.timeout = time.AfterFunc(wait, func() { tx.terminate(nil) })
+	}
+	return nil
+}
+
+// send sends a response where RFC 3261 §18.2.2 says: back over the
+// connection of a reliable transport, else to the top Via's address.
+func (tx *ServerTransaction) send(resp *Message) error {
+	addr := tx.src.Addr
+	if !tx.src.Transport.Reliable() {
+		if via, err := tx.Request.TopVia(); err == nil {
+			addr = via.ResponseAddr()
+		}
+	}
+	return tx.src.Transport.Send(addr, resp)
+}
+
+// retransmit resends the final response (timer G), doubling the interval
+// up to T2.
+func (tx *ServerTransaction) retransmit() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.state != txCompleted && tx.state != txAccepted {
+		return
+	}
+	tx.send(tx.last)
+	tx.interval *= 2
+	if tx.interval > T2 {
+		tx.interval = T2
+	}
+	tx.retx = time.AfterFunc(tx.interval, tx.retransmit)
+}
+
+// receive handles a retransmitted request or the ACK of a non-2xx.
+func (tx *ServerTransaction) receive(req *Message) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if req.Method == MethodAck {
+		if tx.state == txCompleted {
+			tx.state = txConfirmed
+			stopTimer(tx.retx)
+			stopTimer(tx.timeout)
+			wait := T4
+			if tx.src.Transport.Reliable() {
+				wait = 0
+			}
+			tx.timeout = time.AfterFunc(wait, func() { tx.terminate(nil) })
+		}
+		return
+	}
+	if tx.last != nil && (tx.state == txProceeding || tx.state == txCompleted) {
+		tx.send(tx.last)
+	}
+}
+
+// acked stops the retransmission of a 2xx once its ACK is in. The
+// transaction lives on until timer L to absorb retransmitted INVITEs.
+func (tx *ServerTransaction) acked() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.state != txAccepted {
+		return
+	}
+	tx.state = txConfirmed
+	stopTimer(tx.retx)
+	stopTimer(tx.timeout)
+	tx.timeout = time.AfterFunc(timerB, func() { tx.terminate(nil) })
+}
+
+// cancel answers a cancelled INVITE with a 487 unless it has its final
+// response.
+func (tx *ServerTransaction) cancel() {
+	tx.mu.Lock()
+	if tx.state != txProceeding || tx.wasCancelled {
+		tx.mu.Unlock()
+		return
+	}
+	tx.wasCancelled = true
+	close(tx.cancelled)
+	tx.mu.Unlock()
+	tx.Respond(NewResponse(tx.Request, 487, ""))
+}
+
+func (tx *ServerTransaction) terminate(err error) {
+	tx.mu.Lock()
+	if tx.state == txTerminated {
+		tx.mu.Unlock()
+		return
+	}
+	if tx.state == txConfirmed {
+		err = nil
+	}
+	tx.state = txTerminated
+	tx.err = err
+	stopTimer(tx.retx)
+	stopTimer(tx.timeout)
+	tx.mu.Unlock()
+
+	tx.tl.mu.Lock()
+	delete(tx.tl.servers, tx.key)
+	if tx.invite {
+		n, _, _ := tx.Request.CSeq()
+		if tx.tl.accepted[ackKey(tx.Request, n)] == tx {
+			delete(tx.tl.accepted, ackKey(tx.Request, n))
+		}
+	}
+	tx.tl.mu.Unlock()
+	if err != nil {
+		tx.tl.logger.Printf("Server transaction %s ended: %v", tx.Request.Summary(), err)
+	}
+	close(tx.done)
+}
+
+// Request sends a request in a new client transaction over a network
+// ("UDP", "TCP", "TLS") to a host:port address. A Via with a new branch is
+// put on top of the request.
+func (tl *TransactionLayer) Request(req *Message, network, addr string) (*ClientTransaction, error) {
+	t := tl.Transport(network)
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoTransport, network)
+	}
+	host, port := tl.SentBy(t, addr)
+	via := &Via{Transport: t.Network(), Host: host, Port: port}
+	via.Params.Set("branch", NewBranch())
+	via.Params.Set("rport", "")
+	req.Header.Prepend("Via", via.String())
+	return tl.start(req, t, addr)
+}
+
+// Send sends a request outside any transaction, as the ACK of a 2xx is
+// (RFC 3261 §13.2.2.4), putting a Via with a new branch on top. Sending
+// the same message again retransmits it as is.
+func (tl *TransactionLayer) Send(req *Message, network, addr string) error {
+	t := tl.Transport(network)
+	if t == nil {
+		return fmt.Errorf("%w: %s", ErrNoTransport, network)
+	}
+	if _, err := req.TopVia(); err != nil {
+		host, port := tl.SentBy(t, addr)
+		via := &Via{Transport: t.Network(), Host: host, Port: port}
+		via.Params.Set("branch", NewBranch())
+		via.Params.Set("rport", "")
+		req.Header.Prepend("Via", via.String())
+	}
+	return t.Send(addr, req)
+}
+
+// start runs a client transaction for a request whose top Via is set.
+func (tl *TransactionLayer) start(req *Message, t Transport, addr string) (*ClientTransaction, error) {
+	via, err := req.TopVia()
+	if err != nil {
+		return nil, err
+	}
+	tx := &ClientTransaction{
+		tl:        tl,
+		key:       clientKey(via.Branch(), req.Method),
+		Request:   req,
+		transport: t,
+		addr:      addr,
+		invite:    req.Method == MethodInvite,
+		responses: make(chan *Message, 32),
+		done:      make(chan struct{}),
+	}
+	tx.state = txTrying
+	if tx.invite {
+		tx.state = txCalling
+	}
+	tl.mu.Lock()
+	tl.clients[tx.key] = tx
+	tl.mu.Unlock()
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if err := t.Send(addr, req); err != nil {
+		// A transport error counts as a 503 (RFC 3261 §8.1.3.1).
+		tx.deliver(NewResponse(req, 503, "Service Unavailable"))
+		tx.terminateLocked(err)
+		return tx, nil
+	}
+	if !t.Reliable() {
+		tx.interval = T1
+		tx.retx = time.AfterFunc(tx.interval, tx.retransmit)
+	}
+	tx.timeout = time.AfterFunc(timerB, tx.timedOut)
+	return tx, nil
+}
+
+// ClientTransaction sends one request and collects its responses. Over
+// unreliable transports the request is retransmitted until answered.
+type ClientTransaction struct {
+	tl        *TransactionLayer
+	key       string
+	Request   *Message
+	transport Transport
+	addr      string
+	invite    bool
+
+	mu            sync.Mutex
+	state         txState
+	interval      time.Duration
+	retx          *time.Timer
+	timeout       *time.Timer
+	responses     chan *Message
+	cancelPending bool
+	done          chan struct{}
+	err           error
+}
+
+// Responses delivers the provisional and final responses, then every 2xx
+// to an INVITE, forked or retransmitted, until the transaction ends. A
+// timeout comes as a 408, a transport error as a 503. The channel is
+// closed when the transaction terminates.
+func (tx *ClientTransaction) Responses() <-chan *Message { return tx.responses }
+
+// Done is closed when the transaction terminates.
+func (tx *ClientTransaction) Done() <-chan struct{} { return tx.done }
+
+// Err returns ErrTimeout, or the transport error, of a transaction that
+// got no response.
+func (tx *ClientTransaction) Err() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.err
+}
+
+// Destination returns the network and address the request went to.
+func (tx *ClientTransaction) Destination() (string, string) {
+	return tx.transport.Network(), tx.addr
+}
+
+// Cancel cancels an INVITE (RFC 3261 §9.1): a CANCEL is sent once a
+// provisional response came, at once if one has. It does nothing once a
+// final response came.
+func (tx *ClientTransaction) Cancel() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if !tx.invite {
+		return fmt.Errorf("sip: only an INVITE can be cancelled")
+	}
+	switch tx.state {
+	case txCalling:
+		tx.cancelPending = true
+		return nil
+	case txProceeding:
+		return tx.sendCancel()
+	}
+	return ErrTerminated
+}
+
+func (tx *ClientTransaction) sendCancel() error {
+	tx.cancelPending = false
+	_, err := tx.tl.start(NewCancel(tx.Request), tx.transport, tx.addr)
+	return err
+}
+
+func (tx *ClientTransaction) retransmit() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch {
+	case tx.state == txCalling, tx.state == txTrying:
+	case tx.state == txProceeding && !tx.invite:
+	default:
+		return
+	}
+	if err := tx.transport.Send(tx.addr, tx.Request); err != nil {
+		tx.tl.logger.Printf("Failed to retransmit %s: %v", tx.Request.Summary(), err)
+	}
+	tx.interval *= 2
+	if !tx.invite && (tx.interval > T2 || tx.state == txProceeding) {
+		tx.interval = T2
+	}
+	tx.retx = time.AfterFunc(tx.interval, tx.retransmit)
+}
+
+// timedOut ends a transaction without final response (timers B and F).
+func (tx *ClientTransaction) timedOut() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.state != txCalling && tx.state != txTrying && tx.state != txProceeding {
+		return
+	}
+	tx.deliver(NewResponse(tx.Request, 408, ""))
+	tx.terminateLocked(ErrTimeout)
+}
+
+func (tx *ClientTransaction) receive(resp *Message) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	code := resp.StatusCode
+	switch tx.state {
+	case txCalling, txTrying, txProceeding:
+		if code < 200 {
+			if tx.state != txProceeding {
+				tx.state = txProceeding
+				if tx.invite {
+					stopTimer(tx.retx)
+				}
+			}
+			tx.deliver(resp)
+			if tx.cancelPending {
+				if err := tx.sendCancel(); err != nil {
+					tx.tl.logger.Printf("Failed to cancel %s: %v", tx.Request.Summary(), err)
+				}
+			}
+			return
+		}
+		stopTimer(tx.retx)
+		stopTimer(tx.timeout)
+		tx.deliver(resp)
+		unreliable := !tx.transport.Reliable()
+		switch {
+		case tx.invite && code < 300:
+			// Timer M: forked and retransmitted 2xx go to the caller.
+			tx.state = txAccepted
+			tx.timeout = time.AfterFunc(timerB, func() { tx.terminate(nil) })
+		case tx.invite:
+			tx.state = txCompleted
+			tx.sendAck(resp)
+			wait := time.Duration(0)
+			if unreliable {
+				wait = timerD
+			}
+			tx.timeout = time.AfterFunc(wait, func() { tx.terminate(nil) })
+		default:
+			tx.state = txCompleted
+			wait := time.Duration(0)
+			if unreliable {
+				wait = T4
+			}
+			tx.timeout = time.AfterFunc(wait, func() { tx.terminate(nil) })
+		}
+	case txAccepted:
+		if code >= 200 && code < 300 {
+			tx.deliver(resp)
+		}
+	case txCompleted:
+		if tx.invite && code >= 300 {
+			tx.sendAck(resp)
+		}
+	}
+}
+
+// sendAck acknowledges a non-2xx final response to the INVITE.
+func (tx *ClientTransaction) sendAck(resp *Message) {
+	if err := tx.transport.Send(tx.addr, newAck(tx.Request, resp)); err != nil {
+		tx.tl.logger.Printf("Failed to send ACK for %s: %v", resp.Summary(), err)
+	}
+}
+
+func (tx *ClientTransaction) deliver(resp *Message) {
+	select {
+	case tx.responses <- resp:
+	default:
+		tx.tl.logger.Printf("Dropping %s: nobody reads the transaction's responses", resp.Summary())
+	}
+}
+
+func (tx *ClientTransaction) terminate(err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.terminateLocked(err)
+}
+
+func (tx *ClientTransaction) terminateLocked(err error) {
+	if tx.state == txTerminated {
+		return
+	}
+	tx.state = txTerminated
+	tx.err = err
+	stopTimer(tx.retx)
+	stopTimer(tx.timeout)
+	tx.tl.mu.Lock()
+	if tx.tl.clients[tx.key] == tx {
+		delete(tx.tl.clients, tx.key)
+	}
+	tx.tl.mu.Unlock()
+	close(tx.responses)
+	close(tx.done)
+}
+
+// NewCancel builds the CANCEL of an INVITE (RFC 3261 §9.1): same
+// Request-URI, Call-ID, From, To, CSeq number, Route and top Via.
+func NewCancel(invite *Message) *Message {
+	m := &Message{Method: MethodCancel, RequestURI: invite.RequestURI}
+	if vias := invite.Header.Values("Via"); len(vias) > 0 {
+		m.Header.Add("Via", vias[0])
+	}
+	m.Header.Add("Max-Forwards", "70")
+	m.Header.Add("From", invite.Header.Get("From"))
+	m.Header.Add("To", invite.Header.Get("To"))
+	m.Header.Add("Call-ID", invite.CallID())
+	n, _, _ := invite.CSeq()
+	m.Header.Add("CSeq", fmt.Sprintf("%d %s", n, MethodCancel))
+	for _, route := range invite.Header.Values("Route") {
+		m.Header.Add("Route", route)
+	}
+	return m
+}
+
+// newAck builds the ACK of a non-2xx final response to an INVITE (RFC 3261
+// §17.1.1.3): in the INVITE's transaction, with the response's To.
+func newAck(invite, resp *Message) *Message {
+	m := &Message{Method: MethodAck, RequestURI: invite.RequestURI}
+	if vias := invite.Header.Values("Via"); len(vias) > 0 {
+		m.Header.Add("Via", vias[0])
+	}
+	m.Header.Add("Max-Forwards", "70")
+	m.Header.Add("From", invite.Header.Get("From"))
+	m.Header.Add("To", resp.Header.Get("To"))
+	m.Header.Add("Call-ID", invite.CallID())
+	n, _, _ := invite.CSeq()
+	m.Header.Add("CSeq", fmt.Sprintf("%d %s", n, MethodAck))
+	for _, route := range invite.Header.Values("Route") {
+		m.Header.Add("Route", route)
+	}
+	return m
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
@@ -0,0 +1,372 @@
+package sip
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport records the messages sent over it.
+type fakeTransport struct {
+	network  string
+	reliable bool
+
+	mu   sync.Mutex
+	sent []*Message
+	to   []string // where each message was sent
+}
+
+func (t *fakeTransport) Network() string { return t.network }
+func (t *fakeTransport) Reliable() bool  { return t.reliable }
+func (t *fakeTransport) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 5060}
+}
+func (t *fakeTransport) Serve(handler Handler) error { return nil }
+func (t *fakeTransport) Close() error                { return nil }
+
+func (t *fakeTransport) Send(addr string, msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, msg.Clone())
+	t.to = append(t.to, addr)
+	return nil
+}
+
+// summaries returns the start lines of the messages sent so far, as
+// "INVITE" for requests and "200 INVITE" for responses.
+func (t *fakeTransport) summaries() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []string
+	for _, m := range t.sent {
+		out = append(out, summary(m))
+	}
+	return out
+}
+
+// sentTo returns the messages sent to addr so far.
+func (t *fakeTransport) sentTo(addr string) []*Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []*Message
+	for i, m := range t.sent {
+		if t.to[i] == addr {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func summary(m *Message) string {
+	if m.IsRequest() {
+		return m.Method
+	}
+	return fmt.Sprintf("%d %s", m.StatusCode, m.CSeqMethod())
+}
+
+func newTestLayer(reliable bool) (*TransactionLayer, *fakeTransport) {
+	tl := NewTransactionLayer(log.New(io.Discard, "", 0))
+	t := &fakeTransport{network: "UDP", reliable: reliable}
+	if reliable {
+		t.network = "TCP"
+	}
+	tl.AddTransport(t)
+	return tl, t
+}
+
+// testRequest parses a request from 192.0.2.10 in call "call1". sentBy and
+// branch go in its Via, cseq is the number of its CSeq.
+func testRequest(t *testing.T, method, sentBy, branch string, cseq int) *Message {
+	t.Helper()
+	m, err := Parse(crlf(
+		method+" sip:0612345678@gw.example.com SIP/2.0",
+		"Via: SIP/2.0/UDP "+sentBy+";branch="+branch,
+		"From: <sip:alice@example.com>;tag=a1",
+		"To: <sip:0612345678@gw.example.com>",
+		"Call-ID: call1@192.0.2.10",
+		fmt.Sprintf("CSeq: %d %s", cseq, method),
+		"",
+		"",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// requestRecorder collects the requests a layer passes on.
+type requestRecorder struct {
+	mu       sync.Mutex
+	requests []*Message
+	txs      []*ServerTransaction
+	respond  int // status every new transaction is answered with, none if 0
+}
+
+func (r *requestRecorder) handle(req *Message, tx *ServerTransaction) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req)
+	r.txs = append(r.txs, tx)
+	code := r.respond
+	r.mu.Unlock()
+	if tx != nil && code != 0 {
+		tx.Respond(NewResponse(req, code, ""))
+	}
+}
+
+func (r *requestRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func TestServerTransactionMatching(t *testing.T) {
+	const branch = BranchPrefix + "abc"
+	tests := []struct {
+		name          string
+		first, second func(t *testing.T) *Message
+		passedOn      int // requests passed to the handler
+	}{
+		{
+			name:     "retransmission",
+			first:    func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", branch, 1) },
+			second:   func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", branch, 1) },
+			passedOn: 1,
+		},
+		{
+			name:     "new branch",
+			first:    func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", branch, 1) },
+			second:   func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", branch+"2", 2) },
+			passedOn: 2,
+		},
+		{
+			name:     "same branch from another sender",
+			first:    func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", branch, 1) },
+			second:   func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.11:5060", branch, 1) },
+			passedOn: 2,
+		},
+		{
+			name:     "ACK of a non-2xx joins the INVITE",
+			first:    func(t *testing.T) *Message { return testRequest(t, MethodInvite, "192.0.2.10:5060", branch, 1) },
+			second:   func(t *testing.T) *Message { return testRequest(t, MethodAck, "192.0.2.10:5060", branch, 1) },
+			passedOn: 1,
+		},
+		{
+			name:     "ACK of a 2xx has a branch of its own",
+			first:    func(t *testing.T) *Message { return testRequest(t, MethodInvite, "192.0.2.10:5060", branch, 1) },
+			second:   func(t *testing.T) *Message { return testRequest(t, MethodAck, "192.0.2.10:5060", branch+"ack", 1) },
+			passedOn: 2,
+		},
+		{
+			name:     "RFC 2543 retransmission",
+			first:    func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", "old1", 1) },
+			second:   func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", "old1", 1) },
+			passedOn: 1,
+		},
+		{
+			name:     "RFC 2543 new CSeq",
+			first:    func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", "old1", 1) },
+			second:   func(t *testing.T) *Message { return testRequest(t, MethodOptions, "192.0.2.10:5060", "old1", 2) },
+			passedOn: 2,
+		},
+	}
+	for _, tt := range tests {
+		tl, transport := newTestLayer(false)
+		rec := &requestRecorder{}
+		tl.OnRequest(rec.handle)
+		src := Source{Transport: transport, Addr: "192.0.2.10:5060"}
+		tl.Receive(tt.first(t), src)
+		tl.Receive(tt.second(t), src)
+		if got := rec.count(); got != tt.passedOn {
+			t.Errorf("%s: %d requests passed on, want %d", tt.name, got, tt.passedOn)
+		}
+	}
+}
+
+func TestRetransmittedRequestGetsLastResponse(t *testing.T) {
+	tl, transport := newTestLayer(false)
+	tl.OnRequest((&requestRecorder{respond: 200}).handle)
+	src := Source{Transport: transport, Addr: "192.0.2.10:5060"}
+	for i := 0; i < 3; i++ {
+		tl.Receive(testRequest(t, MethodOptions, "192.0.2.10:5060", BranchPrefix+"r", 1), src)
+	}
+	if got := transport.summaries(); fmt.Sprint(got) != "[200 OPTIONS 200 OPTIONS 200 OPTIONS]" {
+		t.Errorf("sent %v, want the 200 once per copy of the request", got)
+	}
+}
+
+func TestConcurrentRetransmissionsStartOneTransaction(t *testing.T) {
+	tl, transport := newTestLayer(false)
+	rec := &requestRecorder{}
+	tl.OnRequest(rec.handle)
+	src := Source{Transport: transport, Addr: "192.0.2.10:5060"}
+
+	// Transports hand every message to a goroutine of its own, so copies
+	// of a request arrive at once.
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		req := testRequest(t, MethodInvite, "192.0.2.10:5060", BranchPrefix+"c", 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			tl.Receive(req, src)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if got := rec.count(); got != 1 {
+		t.Errorf("%d transactions started for one INVITE, want 1", got)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tl, transport := newTestLayer(true)
+	rec := &requestRecorder{}
+	tl.OnRequest(rec.handle)
+	src := Source{Transport: transport, Addr: "192.0.2.10:5060"}
+
+	tl.Receive(testRequest(t, MethodInvite, "192.0.2.10:5060", BranchPrefix+"i", 1), src)
+	tl.Receive(testRequest(t, MethodCancel, "192.0.2.10:5060", BranchPrefix+"i", 1), src)
+	if rec.count() != 1 {
+		t.Fatalf("%d requests passed on, want only the INVITE", rec.count())
+	}
+	select {
+	case <-rec.txs[0].Cancelled():
+	default:
+		t.Error("INVITE transaction not cancelled")
+	}
+	if got := transport.summaries(); fmt.Sprint(got) != "[100 INVITE 200 CANCEL 487 INVITE]" {
+		t.Errorf("sent %v", got)
+	}
+
+	// A CANCEL matching no INVITE.
+	tl.Receive(testRequest(t, MethodCancel, "192.0.2.10:5060", BranchPrefix+"none", 2), src)
+	if got := transport.summaries(); got[len(got)-1] != "481 CANCEL" {
+		t.Errorf("unmatched CANCEL answered with %s, want 481", got[len(got)-1])
+	}
+}
+
+func TestServerRetransmits2xxUntilAcked(t *testing.T) {
+	tl, transport := newTestLayer(false)
+	rec := &requestRecorder{respond: 200}
+	tl.OnRequest(rec.handle)
+	src := Source{Transport: transport, Addr: "192.0.2.10:5060"}
+
+	tl.Receive(testRequest(t, MethodInvite, "192.0.2.10:5060", BranchPrefix+"i", 1), src)
+	// Timer G fires after T1, then 2*T1 later.
+	time.Sleep(T1 + T1/2)
+	if got := fmt.Sprint(transport.summaries()); got != "[100 INVITE 200 INVITE 200 INVITE]" {
+		t.Fatalf("sent %s before the ACK, want the 200 retransmitted once", got)
+	}
+
+	ack := testRequest(t, MethodAck, "192.0.2.10:5060", BranchPrefix+"ack", 1)
+	tl.Receive(ack, src)
+	if rec.count() != 2 || rec.txs[1] != nil {
+		t.Errorf("ACK of the 2xx not passed on without a transaction")
+	}
+	time.Sleep(2 * T1)
+	if got := len(transport.summaries()); got != 3 {
+		t.Errorf("%d messages sent after the ACK, want no more retransmissions", got-3)
+	}
+}
+
+func TestServerReliableTransportDoesNotRetransmit(t *testing.T) {
+	tl, transport := newTestLayer(true)
+	tl.OnRequest((&requestRecorder{respond: 486}).handle)
+	src := Source{Transport: transport, Addr: "192.0.2.10:5060"}
+	tl.Receive(testRequest(t, MethodInvite, "192.0.2.10:5060", BranchPrefix+"i", 1), src)
+	time.Sleep(T1 + T1/2)
+	if got := fmt.Sprint(transport.summaries()); got != "[100 INVITE 486 INVITE]" {
+		t.Errorf("sent %s over TCP, want no retransmission", got)
+	}
+}
+
+// respondTo builds a response to the request a client transaction sent.
+func respondTo(t *testing.T, transport *fakeTransport, code int) *Message {
+	t.Helper()
+	transport.mu.Lock()
+	req := transport.sent[0]
+	transport.mu.Unlock()
+	resp := NewResponse(req, code, "")
+	if to, err := resp.To(); err == nil {
+		to.Params.Set("tag", "b1")
+		resp.Header.Set("To", to.String())
+	}
+	return resp
+}
+
+func TestClientTransactionRetransmitsOverUDP(t *testing.T) {
+	tl, transport := newTestLayer(false)
+	from, _ := ParseAddress("<sip:gw@198.51.100.1>;tag=g1")
+	to, _ := ParseAddress("<sip:192.0.2.20>")
+	uri, _ := ParseURI("sip:192.0.2.20")
+	tx, err := tl.Request(NewRequest(MethodOptions, uri, from, to, "call2", 1), "UDP", "192.0.2.20:5060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Timer E: after T1, then 2*T1 later.
+	time.Sleep(T1 + T1/2)
+	if got := fmt.Sprint(transport.summaries()); got != "[OPTIONS OPTIONS]" {
+		t.Fatalf("sent %s, want the request retransmitted once", got)
+	}
+
+	src := Source{Transport: transport, Addr: "192.0.2.20:5060"}
+	stray := make(chan *Message, 1)
+	tl.OnStrayResponse(func(resp *Message, src Source) { stray <- resp })
+	other := respondTo(t, transport, 200)
+	via, _ := other.TopVia()
+	via.Params.Set("branch", BranchPrefix+"other")
+	other.SetTopVia(via)
+	tl.Receive(other, src)
+	select {
+	case <-stray:
+	default:
+		t.Error("response of another branch not passed on as stray")
+	}
+
+	tl.Receive(respondTo(t, transport, 200), src)
+	select {
+	case resp := <-tx.Responses():
+		if resp.StatusCode != 200 {
+			t.Errorf("got %d, want 200", resp.StatusCode)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("response not delivered")
+	}
+	time.Sleep(2 * T1)
+	if got := len(transport.summaries()); got != 2 {
+		t.Errorf("%d retransmissions after the response, want none", got-2)
+	}
+}
+
+func TestClientInviteAcksNon2xx(t *testing.T) {
+	tl, transport := newTestLayer(false)
+	from, _ := ParseAddress("<sip:gw@198.51.100.1>;tag=g1")
+	to, _ := ParseAddress("<sip:0612345678@192.0.2.20>")
+	uri, _ := ParseURI("sip:0612345678@192.0.2.20")
+	tx, err := tl.Request(NewRequest(MethodInvite, uri, from, to, "call3", 1), "UDP", "192.0.2.20:5060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := Source{Transport: transport, Addr: "192.0.2.20:5060"}
+	busy := respondTo(t, transport, 486)
+	tl.Receive(busy, src)
+	tl.Receive(busy.Clone(), src) // retransmitted: ACKed again, not delivered again
+
+	if resp := <-tx.Responses(); resp.StatusCode != 486 {
+		t.Errorf("delivered %d, want 486", resp.StatusCode)
+	}
+	select {
+	case resp := <-tx.Responses():
+		t.Errorf("%d delivered twice", resp.StatusCode)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := fmt.Sprint(transport.summaries()); got != "[INVITE ACK ACK]" {
+		t.Errorf("sent %s, want the INVITE and an ACK per 486", got)
+	}
+}
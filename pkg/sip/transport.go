@@ -0,0 +1,108 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// Transport carries messages over one protocol.
+type Transport interface {
+	// Network returns the transport's name as in Via: UDP, TCP or TLS.
+	Network() string
+	// Reliable reports whether the transport delivers messages by itself,
+	// so transactions need not retransmit them.
+	Reliable() bool
+	// LocalAddr returns the address the transport listens on.
+	LocalAddr() net.Addr
+	// Serve reads messages until the transport is closed, passing each to
+	// handler: UDP in a goroutine of its own, stream transports one after
+	// another for each connection, so handler must not wait long.
+	Serve(handler Handler) error
+	// Send sends a message to a host:port address.
+	Send(addr string, msg *Message) error
+	Close() error
+}
+
+// Handler receives the messages a transport reads.
+type Handler func(msg *Message, src Source)
+
+// Source is where a message came from; responses go back the same way.
+type Source struct {
+	Transport Transport
+	Addr      string // host:port of the peer
+}
+
+// UDPTransport carries messages in UDP datagrams.
+type UDPTransport struct {
+	conn   *net.UDPConn
+	logger *log.Logger
+}
+
+// ListenUDP opens a UDP transport on a host:port address.
+func ListenUDP(addr string, logger *log.Logger) (*UDPTransport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP: %w", err)
+	}
+	return &UDPTransport{conn: conn, logger: logger}, nil
+}
+
+// Network returns "UDP".
+func (t *UDPTransport) Network() string { return "UDP" }
+
+// Reliable returns false: UDP loses datagrams.
+func (t *UDPTransport) Reliable() bool { return false }
+
+// LocalAddr returns the address the transport listens on.
+func (t *UDPTransport) LocalAddr() net.Addr { return t.conn.LocalAddr() }
+
+// Serve reads datagrams until Close. Each message gets a copy of its
+// datagram, so the read buffer is free for the next one while it is
+// handled.
+func (t *UDPTransport) Serve(handler Handler) error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			t.logger.Printf("Error reading UDP packet: %v", err)
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue // keepalive
+		}
+		go func() {
+			msg, err := Parse(data)
+			if err != nil {
+				t.logger.Printf("Dropping message from %s: %v", addr, err)
+				return
+			}
+			handler(msg, Source{Transport: t, Addr: addr.String()})
+		}()
+	}
+}
+
+// Send sends a message in one datagram.
+func (t *UDPTransport) Send(addr string, msg *Message) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteToUDP(msg.Bytes(), udpAddr)
+	return err
+}
+
+// Close stops Serve.
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
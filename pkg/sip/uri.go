@@ -0,0 +1,473 @@
+package sip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Param is a ;name=value parameter. A flag such as lr has no value.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Params are parameters in order. Names compare case-insensitively.
+type Params []Param
+
+// Get returns a parameter's value and whether it is present.
+func (p Params) Get(name string) (string, bool) {
+	for _, param := range p {
+		if strings.EqualFold(param.Name, name) {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets a parameter, appending it when absent.
+func (p *Params) Set(name, value string) {
+	for i, param := range *p {
+		if strings.EqualFold(param.Name, name) {
+			(*p)[i].Value = value
+			return
+		}
+	}
+	*p = append(*p, Param{Name: name, Value: value})
+}
+
+// Del removes a parameter.
+func (p *Params) Del(name string) {
+	out := (*p)[:0]
+	for _, param := range *p {
+		if !strings.EqualFold(param.Name, name) {
+			out = append(out, param)
+		}
+	}
+	*p = out
+}
+
+func (p Params) String() string {
+	var b strings.Builder
+	for _, param := range p {
+		b.WriteByte(';')
+		b.WriteString(param.Name)
+		if param.Value != "" {
+			b.WriteByte('=')
+			b.WriteString(param.Value)
+		}
+	}
+	return b.String()
+}
+
+// parseParams reads ";a=b;c" parameters; s starts after the first ';'.
+func parseParams(s string) Params {
+	var params Params
+	for _, part := range splitOutsideQuotes(s, ';') {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		params = append(params, Param{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	return params
+}
+
+// URI is a SIP, SIPS or tel URI: sip:user:password@host:port;params?headers.
+type URI struct {
+	Scheme   string
+	User     string
+	Password string
+	Host     string
+	Port     int // 0 when absent
+	Params   Params
+	Headers  string // after the '?', kept as is
+}
+
+// ParseURI reads a URI.
+func ParseURI(s string) (*URI, error) {
+	s = strings.TrimSpace(s)
+	scheme, rest, ok := strings.Cut(s, ":")
+	if !ok || scheme == "" {
+		return nil, fmt.Errorf("%w: bad URI %q", ErrMalformed, s)
+	}
+	u := &URI{Scheme: strings.ToLower(scheme)}
+	if u.Scheme == "tel" {
+		number, params, _ := strings.Cut(rest, ";")
+		u.User = number
+		u.Params = parseParams(params)
+		return u, nil
+	}
+	if u.Scheme != "sip" && u.Scheme != "sips" {
+		return nil, fmt.Errorf("%w: unsupported URI scheme %q", ErrMalformed, scheme)
+	}
+
+	rest, u.Headers, _ = strings.Cut(rest, "?")
+	if at := strings.LastIndexByte(rest, '@'); at >= 0 {
+		userinfo := rest[:at]
+		rest = rest[at+1:]
+		u.User, u.Password, _ = strings.Cut(userinfo, ":")
+	}
+	hostport, params, _ := strings.Cut(rest, ";")
+	u.Params = parseParams(params)
+	host, port, err := splitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad URI %q", ErrMalformed, s)
+	}
+	u.Host, u.Port = host, port
+	return u, nil
+}
+
+func (u *URI) String() string {
+	var b strings.Builder
+	b.WriteString(u.Scheme)
+	b.WriteByte(':')
+	if u.Scheme == "tel" {
+		b.WriteString(u.User)
+		b.WriteString(u.Params.String())
+		return b.String()
+	}
+	if u.User != "" {
+		b.WriteString(u.User)
+		if u.Password != "" {
+			b.WriteByte(':')
+			b.WriteString(u.Password)
+		}
+		b.WriteByte('@')
+	}
+	b.WriteString(joinHostPort(u.Host, u.Port))
+	b.WriteString(u.Params.String())
+	if u.Headers != "" {
+		b.WriteByte('?')
+		b.WriteString(u.Headers)
+	}
+	return b.String()
+}
+
+// Clone returns a copy of the URI.
+func (u *URI) Clone() *URI {
+	c := *u
+	c.Params = append(Params(nil), u.Params...)
+	return &c
+}
+
+// Transport returns the transport the URI asks for: the transport
+// parameter upper-cased, TLS for a SIPS URI, else UDP.
+func (u *URI) Transport() string {
+	if t, ok := u.Params.Get("transport"); ok && t != "" {
+		return strings.ToUpper(t)
+	}
+	if u.Scheme == "sips" {
+		return "TLS"
+	}
+	return "UDP"
+}
+
+// HostPort returns host:port, with the default port of the scheme when the
+// URI has none.
+func (u *URI) HostPort() string {
+	port := u.Port
+	if port == 0 {
+		port = DefaultPort(u.Transport())
+	}
+	return joinHostPort(u.Host, port)
+}
+
+// DefaultPort returns the port of a transport when none is given.
+func DefaultPort(transport string) int {
+	if strings.EqualFold(transport, "TLS") {
+		return 5061
+	}
+	return 5060
+}
+
+// Address is a name-addr or addr-spec with its header parameters, as in
+// From, To, Contact and Route.
+type Address struct {
+	DisplayName string
+	URI         *URI
+	Params      Params
+	Wildcard    bool // a "*" Contact
+}
+
+// ParseAddress reads an address: `"Bob" <sip:bob@host>;tag=1`,
+// `<sip:bob@host>` or `sip:bob@host;tag=1`. In the last form, parameters
+// belong to the header, not the URI.
+func ParseAddress(s string) (*Address, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return &Address{Wildcard: true}, nil
+	}
+	a := &Address{}
+	var uri, params string
+	if lt := indexOutsideQuotes(s, '<'); lt >= 0 {
+		gt := strings.IndexByte(s[lt:], '>')
+		if gt < 0 {
+			return nil, fmt.Errorf("%w: bad address %q", ErrMalformed, s)
+		}
+		a.DisplayName = unquote(strings.TrimSpace(s[:lt]))
+		uri = s[lt+1 : lt+gt]
+		params = strings.TrimSpace(s[lt+gt+1:])
+		params = strings.TrimPrefix(params, ";")
+	} else {
+		uri, params, _ = strings.Cut(s, ";")
+	}
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	a.URI = u
+	a.Params = parseParams(params)
+	return a, nil
+}
+
+func (a *Address) String() string {
+	if a.Wildcard {
+		return "*"
+	}
+	var b strings.Builder
+	if a.DisplayName != "" {
+		b.WriteString(strconv.Quote(a.DisplayName))
+		b.WriteByte(' ')
+	}
+	b.WriteByte('<')
+	b.WriteString(a.URI.String())
+	b.WriteByte('>')
+	b.WriteString(a.Params.String())
+	return b.String()
+}
+
+// Clone returns a copy of the address.
+func (a *Address) Clone() *Address {
+	c := *a
+	if a.URI != nil {
+		c.URI = a.URI.Clone()
+	}
+	c.Params = append(Params(nil), a.Params...)
+	return &c
+}
+
+// Tag returns the tag parameter.
+func (a *Address) Tag() string {
+	tag, _ := a.Params.Get("tag")
+	return tag
+}
+
+// Via is a Via header value.
+type Via struct {
+	Transport string // UDP, TCP, TLS...
+	Host      string
+	Port      int // 0 when absent
+	Params    Params
+}
+
+// ParseVia reads a Via value: "SIP/2.0/UDP host:port;branch=z9hG4bK...".
+func ParseVia(s string) (*Via, error) {
+	s = strings.TrimSpace(s)
+	proto, rest, ok := strings.Cut(s, " ")
+	parts := strings.Split(proto, "/")
+	if !ok || len(parts) != 3 || !strings.EqualFold(parts[0]+"/"+parts[1], Version) {
+		return nil, fmt.Errorf("%w: bad Via %q", ErrMalformed, s)
+	}
+	v := &Via{Transport: strings.ToUpper(parts[2])}
+	hostport, params, _ := strings.Cut(strings.TrimSpace(rest), ";")
+	host, port, err := splitHostPort(strings.TrimSpace(hostport))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad Via %q", ErrMalformed, s)
+	}
+	v.Host, v.Port = host, port
+	v.Params = parseParams(params)
+	return v, nil
+}
+
+func (v *Via) String() string {
+	return fmt.Sprintf("%s/%s %s%s", Version, v.Transport, joinHostPort(v.Host, v.Port), v.Params.String())
+}
+
+// Branch returns the branch parameter.
+func (v *Via) Branch() string {
+	branch, _ := v.Params.Get("branch")
+	return branch
+}
+
+// SentBy returns host:port, with the transport's default port when the Via
+// has none.
+func (v *Via) SentBy() string {
+	port := v.Port
+	if port == 0 {
+		port = DefaultPort(v.Transport)
+	}
+	return joinHostPort(v.Host, port)
+}
+
+// ResponseAddr returns where responses to a request arriving with this Via
+// go (RFC 3261 §18.2.2, RFC 3581): the received address if set, at the
+// rport if set, else the sent-by port.
+func (v *Via) ResponseAddr() string {
+	host := v.Host
+	if received, ok := v.Params.Get("received"); ok && received != "" {
+		host = received
+	}
+	port := v.Port
+	if rport, ok := v.Params.Get("rport"); ok && rport != "" {
+		if n, err := strconv.Atoi(rport); err == nil {
+			port = n
+		}
+	}
+	if port == 0 {
+		port = DefaultPort(v.Transport)
+	}
+	return joinHostPort(host, port)
+}
+
+// splitHostPort splits "host", "host:port", "[v6]" or "[v6]:port".
+func splitHostPort(s string) (string, int, error) {
+	if s == "" {
+		return "", 0, fmt.Errorf("empty host")
+	}
+	if strings.HasPrefix(s, "[") {
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return "", 0, fmt.Errorf("bad host %q", s)
+		}
+		host := s[1:end]
+		rest := s[end+1:]
+		if rest == "" {
+			return host, 0, nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", 0, fmt.Errorf("bad host %q", s)
+		}
+		port, err := strconv.Atoi(rest[1:])
+		if err != nil || port <= 0 || port > 65535 {
+			return "", 0, fmt.Errorf("bad port in %q", s)
+		}
+		return host, port, nil
+	}
+	host, portStr, ok := strings.Cut(s, ":")
+	if !ok {
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 || host == "" {
+		return "", 0, fmt.Errorf("bad port in %q", s)
+	}
+	return host, port, nil
+}
+
+// joinHostPort writes host[:port], bracketing IPv6 addresses.
+func joinHostPort(host string, port int) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port == 0 {
+		return host
+	}
+	return host + ":" + strconv.Itoa(port)
+}
+
+// splitList splits a header value listing several values on the commas
+// outside quotes and angle brackets.
+func splitList(s string) []string {
+	var values []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '<':
+			depth++
+		case c == '>':
+			depth--
+		case c == ',' && depth == 0:
+			if v := strings.TrimSpace(s[start:i]); v != "" {
+				values = append(values, v)
+			}
+			start = i + 1
+		}
+	}
+	if v := strings.TrimSpace(s[start:]); v != "" {
+		values = append(values, v)
+	}
+	return values
+}
+
+// splitOutsideQuotes splits s on sep where it is not quoted.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func indexOutsideQuotes(s string, c byte) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == c && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// NewBranch returns a new Via branch.
+func NewBranch() string {
+	return BranchPrefix + randomHex(8)
+}
+
+// NewTag returns a new From or To tag.
+func NewTag() string {
+	return randomHex(6)
+}
+
+// NewCallID returns a new Call-ID at host.
+func NewCallID(host string) string {
+	return randomHex(12) + "@" + host
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hostOf returns the host of a host:port address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
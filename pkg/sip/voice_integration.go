@@ -2,9 +2,6 @@ package sip
 
 import (
     "context"
-    "fmt"
-    "log"
-    "net"
     "time"
     
     "github.com/e173-gateway/e173_go_gateway/pkg/voice"
@@ -52,14 +49,22 @@ func NewVoiceEnabledSIPServer(port int, whatsappAPIKey string, dbPool *pgxpool.P
 }
 
 // handleInviteWithVoice processes INVITE with voice recognition
-func (s *VoiceEnabledSIPServer) handleInviteWithVoice(message string, clientAddr *net.UDPAddr) {
+func (s *VoiceEnabledSIPServer) handleInviteWithVoice(req *Message, tx *ServerTransaction) {
     // First, do standard processing
-    caller := extractSIPHeader(message, "From:")
-    destination := extractSIPHeader(message, "To:")
-    callID := extractSIPHeader(message, "Call-ID:")
+    from, err := req.From()
+    if err != nil {
+        tx.Respond(NewResponse(req, 400, "Bad From"))
+        return
+    }
+    to, err := req.To()
+    if err != nil {
+        tx.Respond(NewResponse(req, 400, "Bad To"))
+        return
+    }
+    callID := req.CallID()
     
-    callerNumber := extractPhoneNumber(caller)
-    destNumber := extractPhoneNumber(destination)
+    callerNumber := from.URI.User
+    destNumber := to.URI.User
     
     s.logger.Printf("Processing INVITE with voice recognition: %s -> %s (Call-ID: %s)", 
         callerNumber, destNumber, callID)
@@ -87,23 +92,23 @@ func (s *VoiceEnabledSIPServer) handleInviteWithVoice(message string, clientAddr
     
     // If already detected as spam, route to AI immediately
     if filterResult.RouteToAI {
-        s.routeToAIWithVoice(message, clientAddr, filterResult, callID)
+        s.routeToAIWithVoice(req, tx, filterResult, callID)
         return
     }
     
     // Continue with standard processing
     if !filterResult.Allow {
-        s.rejectCall(message, clientAddr, filterResult.Reason)
+        s.rejectCall(req, tx, filterResult.Reason)
         return
     }
     
-    gateway := s.routingEng.SelectGateway(destNumber, filterResult.Gateway)
-    if gateway == nil {
-        s.rejectCall(message, clientAddr, "No available gateways")
+    gateways := s.routingEng.SelectGateways(destNumber, filterResult.Gateway)
+    if len(gateways) == 0 {
+        s.rejectCall(req, tx, "No available gateways")
         return
     }
     
-    s.forwardToGateway(message, clientAddr, gateway)
+    s.forwardToGateway(req, tx, gateways, destNumber)
 }
 
 // analyzeCallVoice performs real-time voice analysis
@@ -135,14 +140,16 @@ func (s *VoiceEnabledSIPServer) analyzeCallVoice(callID string, audioStream *voi
 }
 
 // routeToAIWithVoice routes spam calls to AI agents with voice handling
-func (s *VoiceEnabledSIPServer) routeToAIWithVoice(message string, clientAddr *net.UDPAddr, 
+func (s *VoiceEnabledSIPServer) routeToAIWithVoice(req *Message, tx *ServerTransaction, 
     result FilterResult, callID string) {
     
     s.logger.Printf("Routing call %s to AI agent with voice handling", callID)
     
     // Send 200 OK to accept the call
-    response := buildSIPResponse("200 OK", message)
-    s.sendSIPResponse(response, clientAddr)
+    if err := s.answer(req, tx); err != nil {
+        s.logger.Printf("Error answering call %s: %v", callID, err)
+        return
+    }
     
     // Get initial transcript if available
     initialTranscript := "Automated call detected"
@@ -0,0 +1,217 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// inboxInterval is how often the modems' message stores are read.
+	inboxInterval = 30 * time.Second
+	// atTimeout bounds one visit to a modem's AT port.
+	atTimeout = 2 * time.Minute
+)
+
+// ErrNoTransport is returned for a sender that can be reached neither on
+// its AT port nor through chan_dongle.
+var ErrNoTransport = errors.New("sms: modem cannot be reached")
+
+// portMu keeps this package to one AT session at a time; a port opened
+// twice garbles both conversations.
+var portMu sync.Mutex
+
+// ATTransport sends messages on the AT port of modems that chan_dongle
+// does not hold, in PDU mode so that long messages are concatenated and
+// delivery reports can be requested. Modems held by chan_dongle are handed
+// to fallback.
+type ATTransport struct {
+	modemRepo repository.ModemRepository
+	lockDir   string
+	fallback  Transport
+	logger    *logrus.Logger
+}
+
+// NewATTransport creates an ATTransport. lockDir is where serial port lock
+// files are kept ("" for /var/lock); fallback may be nil.
+func NewATTransport(modemRepo repository.ModemRepository, lockDir string, fallback Transport, logger *logrus.Logger) *ATTransport {
+	return &ATTransport{modemRepo: modemRepo, lockDir: lockDir, fallback: fallback, logger: logger}
+}
+
+// SendSMS sends a message from sender's modem and returns the message
+// reference of its last part, which delivery reports refer to.
+func (t *ATTransport) SendSMS(ctx context.Context, sender models.SMSSender, number, text string, statusReport bool) (string, *int, error) {
+	m, err := t.modemRepo.GetModemByID(ctx, sender.ModemID)
+	if err != nil {
+		return "", nil, err
+	}
+	if locked, _ := modem.PortLocked(t.lockDir, m.DevicePath); m.DevicePath == "" || locked {
+		if t.fallback == nil {
+			return "", nil, ErrNoTransport
+		}
+		return t.fallback.SendSMS(ctx, sender, number, text, statusReport)
+	}
+
+	portMu.Lock()
+	defer portMu.Unlock()
+	dev, err := modem.Open(ctx, m.DevicePath, modem.Options{Logger: t.logger.WithField("modem_id", m.ID)})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open modem %d: %w", m.ID, err)
+	}
+	defer dev.Close()
+	if err := dev.Init(ctx); err != nil {
+		return "", nil, fmt.Errorf("failed to initialise modem %d: %w", m.ID, err)
+	}
+	refs, err := dev.SendSMSPDU(ctx, number, text, statusReport)
+	if err != nil {
+		return "", nil, err
+	}
+	ref := refs[len(refs)-1]
+	return "", &ref, nil
+}
+
+// Inbox reads the messages stored on the modems attached to this host that
+// chan_dongle does not hold, hands them to the Service and deletes them
+// from the SIM. Messages arrive as PDUs, so the parts of long messages are
+// joined and delivery reports are matched to the messages they report on.
+type Inbox struct {
+	discovery *modem.Discovery
+	service   *Service
+	lockDir   string
+	logger    *logrus.Logger
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewInbox creates an Inbox for the modems found by discovery.
+func NewInbox(discovery *modem.Discovery, service *Service, lockDir string, logger *logrus.Logger) *Inbox {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Inbox{
+		discovery: discovery,
+		service:   service,
+		lockDir:   lockDir,
+		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start reads the modems' messages in the background.
+func (b *Inbox) Start() {
+	b.started = true
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(inboxInterval)
+		defer ticker.Stop()
+		for {
+			b.Poll(b.ctx)
+			select {
+			case <-ticker.C:
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reading and waits for a read in progress to finish.
+func (b *Inbox) Stop() {
+	b.cancel()
+	if b.started {
+		<-b.done
+	}
+}
+
+// Poll reads the messages of every attached modem once.
+func (b *Inbox) Poll(ctx context.Context) {
+	for _, a := range b.discovery.Attached() {
+		if ctx.Err() != nil {
+			return
+		}
+		if locked, _ := modem.PortLocked(b.lockDir, a.DataPort); locked {
+			continue
+		}
+		if err := b.read(ctx, a); err != nil {
+			b.logger.WithError(err).WithField("modem_id", a.ModemID).Warn("Failed to read SMS from modem")
+		}
+	}
+}
+
+// read takes the stored messages of one modem. A message is deleted from
+// the SIM once stored, or when it cannot be decoded at all.
+func (b *Inbox) read(ctx context.Context, a modem.AttachedModem) error {
+	ctx, cancel := context.WithTimeout(ctx, atTimeout)
+	defer cancel()
+
+	portMu.Lock()
+	defer portMu.Unlock()
+	logger := b.logger.WithField("modem_id", a.ModemID)
+	dev, err := modem.Open(ctx, a.DataPort, modem.Options{Logger: logger})
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	if err := dev.Init(ctx); err != nil {
+		return err
+	}
+	stored, err := dev.ListSMSPDU(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, raw := range stored {
+		pdu, err := modem.DecodePDU(raw.PDU)
+		if err != nil {
+			logger.WithError(err).Warnf("Dropping undecodable SMS at index %d", raw.Index)
+		} else if err := b.handle(ctx, a.ModemID, pdu); err != nil {
+			logger.WithError(err).Errorf("Failed to store SMS at index %d", raw.Index)
+			continue
+		}
+		if err := dev.DeleteSMS(ctx, raw.Index); err != nil {
+			logger.WithError(err).Warnf("Failed to delete SMS at index %d", raw.Index)
+		}
+	}
+	return nil
+}
+
+// handle passes a decoded message on to the Service. A report for a
+// message the gateway does not know about is not an error.
+func (b *Inbox) handle(ctx context.Context, modemID int, pdu *modem.SMSPDU) error {
+	if pdu.Type == modem.PDUStatusReport {
+		ref := pdu.Reference
+		err := b.service.HandleReport(ctx, DeliveryReport{
+			ModemID:   modemID,
+			Number:    pdu.Number,
+			Reference: &ref,
+			Delivered: pdu.Delivered(),
+			Pending:   pdu.Pending(),
+			Detail:    "status " + strconv.Itoa(pdu.Status),
+			At:        pdu.DischargeTime,
+		})
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	_, err := b.service.Receive(ctx, Inbound{
+		ModemID:    modemID,
+		From:       pdu.Number,
+		Text:       pdu.Text,
+		Encoding:   pdu.Encoding,
+		Concat:     pdu.Concat,
+		ReceivedAt: pdu.Time,
+	})
+	return err
+}
@@ -0,0 +1,436 @@
+// Package sms stores the text messages the gateway's SIM cards receive and
+// sends messages through them.
+package sms
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/modem"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// partTimeout is how long the parts of a long message wait for the rest
+	// before what arrived is stored as an incomplete message.
+	partTimeout = 30 * time.Minute
+	// flushInterval is how often incomplete messages are looked for.
+	flushInterval = time.Minute
+	// maxParts caps the length of an outbound message.
+	maxParts = 10
+)
+
+var (
+	// ErrNoSender is returned when no SIM card can send a message.
+	ErrNoSender = errors.New("sms: no SIM card available to send from")
+	// ErrInvalidMessage is returned for messages that cannot be sent as
+	// given.
+	ErrInvalidMessage = errors.New("sms: invalid message")
+)
+
+// Transport hands outbound messages to a modem.
+type Transport interface {
+	// SendSMS sends or queues text to number from a SIM card. It returns the
+	// ID status events will refer to the message by, if any, and the
+	// message reference, if known.
+	SendSMS(ctx context.Context, sender models.SMSSender, number, text string, statusReport bool) (taskID string, reference *int, err error)
+}
+
+// SendRequest is a message to send.
+type SendRequest struct {
+	To           string `json:"to" binding:"required"`
+	Text         string `json:"text" binding:"required"`
+	Operator     string `json:"operator"`      // send from a SIM of this operator
+	SIMCardID    int64  `json:"sim_card_id"`   // send from this SIM card
+	StatusReport bool   `json:"status_report"` // ask for a delivery report
+}
+
+// Inbound is a received message, or a part of a long one.
+type Inbound struct {
+	ModemID    int
+	SIMCardID  int64 // 0 to look up the SIM in the modem
+	From       string
+	Text       string
+	Encoding   string
+	Concat     *modem.Concat // nil for a whole message
+	ReceivedAt time.Time
+}
+
+// DeliveryReport is a delivery report for a sent message.
+type DeliveryReport struct {
+	ModemID   int
+	Number    string // recipient of the reported message
+	Reference *int   // TP-MR of the reported message, if known
+	Delivered bool
+	Pending   bool   // the service centre is still trying
+	Detail    string // status as reported
+	At        time.Time
+}
+
+// ReceiveFunc is called with every complete inbound message.
+type ReceiveFunc func(ctx context.Context, msg *models.SMSMessage)
+
+// Service stores inbound messages, joining the parts of long ones, and
+// sends messages from the SIM cards best placed to send them, following
+// them until they are delivered.
+type Service struct {
+	repo      repository.SMSRepository
+	simRepo   repository.SIMCardRepository
+	transport Transport
+	logger    *logrus.Logger
+	onReceive []ReceiveFunc
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewService creates a Service sending through transport.
+func NewService(repo repository.SMSRepository, simRepo repository.SIMCardRepository, transport Transport, logger *logrus.Logger) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Service{
+		repo:      repo,
+		simRepo:   simRepo,
+		transport: transport,
+		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// OnReceive registers fn to be called with every complete inbound message,
+// e.g. to pick up balance notices. Call before Start.
+func (s *Service) OnReceive(fn ReceiveFunc) {
+	s.onReceive = append(s.onReceive, fn)
+}
+
+// Start stores long messages whose parts stopped arriving, in the
+// background.
+func (s *Service) Start() {
+	s.started = true
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.flushParts(s.ctx)
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background work and waits for it to finish.
+func (s *Service) Stop() {
+	s.cancel()
+	if s.started {
+		<-s.done
+	}
+}
+
+// Send picks a SIM card for a message, stores the message and hands it to
+// the transport. The message is returned even when sending failed; it is
+// then stored as failed.
+func (s *Service) Send(ctx context.Context, req SendRequest) (*models.SMSMessage, error) {
+	to := normalizeNumber(req.To)
+	if !validNumber(to) {
+		return nil, fmt.Errorf("%w: bad number %q", ErrInvalidMessage, req.To)
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		return nil, fmt.Errorf("%w: empty text", ErrInvalidMessage)
+	}
+	encoding, parts := modem.SplitSMS(req.Text)
+	if len(parts) > maxParts {
+		return nil, fmt.Errorf("%w: text needs %d parts, at most %d are sent", ErrInvalidMessage, len(parts), maxParts)
+	}
+
+	sender, err := s.pickSender(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &models.SMSMessage{
+		Direction:       models.SMSDirectionOutbound,
+		Status:          models.SMSStatusQueued,
+		ModemID:         sql.NullInt64{Int64: int64(sender.ModemID), Valid: true},
+		SIMCardID:       sql.NullInt64{Int64: sender.SIMCardID, Valid: true},
+		Number:          to,
+		Body:            req.Text,
+		Encoding:        encoding,
+		Parts:           len(parts),
+		ReportRequested: req.StatusReport,
+	}
+	if err := s.repo.CreateMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+	logger := s.logger.WithFields(logrus.Fields{"sms_id": msg.ID, "sim_card_id": sender.SIMCardID, "modem_id": sender.ModemID})
+
+	taskID, ref, err := s.transport.SendSMS(ctx, *sender, to, req.Text, req.StatusReport)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send SMS")
+		msg.Status = models.SMSStatusFailed
+		msg.Error = sql.NullString{String: err.Error(), Valid: true}
+		if uerr := s.repo.UpdateMessageStatus(ctx, msg.ID, models.SMSStatusFailed, err.Error(), time.Now()); uerr != nil {
+			logger.WithError(uerr).Error("Failed to mark SMS failed")
+		}
+		return msg, err
+	}
+	if taskID != "" || ref != nil {
+		if err := s.repo.SetMessageTask(ctx, msg.ID, taskID, ref); err != nil {
+			logger.WithError(err).Error("Failed to store SMS task ID")
+		}
+		msg.TaskID = sql.NullString{String: taskID, Valid: taskID != ""}
+		if ref != nil {
+			msg.Reference = sql.NullInt32{Int32: int32(*ref), Valid: true}
+		}
+	}
+	if taskID == "" {
+		// Sent synchronously; no status event will follow.
+		now := time.Now()
+		if err := s.repo.UpdateMessageStatus(ctx, msg.ID, models.SMSStatusSent, "", now); err != nil {
+			logger.WithError(err).Error("Failed to mark SMS sent")
+		}
+		msg.Status = models.SMSStatusSent
+		msg.SentAt = sql.NullTime{Time: now, Valid: true}
+	}
+	logger.Infof("SMS to %s handed to the modem (%d part(s), %s)", to, len(parts), encoding)
+	return msg, nil
+}
+
+// pickSender returns the SIM card a message is sent from.
+func (s *Service) pickSender(ctx context.Context, req SendRequest) (*models.SMSSender, error) {
+	senders, err := s.repo.ListSenders(ctx, req.Operator)
+	if err != nil {
+		return nil, err
+	}
+	for i := range senders {
+		if req.SIMCardID == 0 || senders[i].SIMCardID == req.SIMCardID {
+			return &senders[i], nil
+		}
+	}
+	if req.SIMCardID != 0 {
+		return nil, fmt.Errorf("%w: SIM card %d is not available", ErrNoSender, req.SIMCardID)
+	}
+	if req.Operator != "" {
+		return nil, fmt.Errorf("%w for operator %q", ErrNoSender, req.Operator)
+	}
+	return nil, ErrNoSender
+}
+
+// Receive stores an inbound message. A part of a long message is held
+// until all parts have arrived; Receive then stores the joined message and
+// returns it, and returns nil for the parts before.
+func (s *Service) Receive(ctx context.Context, in Inbound) (*models.SMSMessage, error) {
+	if in.ReceivedAt.IsZero() {
+		in.ReceivedAt = time.Now()
+	}
+	if in.Encoding == "" {
+		in.Encoding = modem.EncodingGSM7
+	}
+	simID := s.simFor(ctx, in)
+
+	msg := &models.SMSMessage{
+		Direction: models.SMSDirectionInbound,
+		Status:    models.SMSStatusReceived,
+		ModemID:   sql.NullInt64{Int64: int64(in.ModemID), Valid: in.ModemID != 0},
+		SIMCardID: simID,
+		Number:    in.From,
+		Body:      in.Text,
+		Encoding:  in.Encoding,
+		Parts:     1,
+		CreatedAt: in.ReceivedAt,
+	}
+
+	if in.Concat != nil && in.Concat.Total > 1 && in.ModemID != 0 {
+		part := &models.SMSPart{
+			ModemID:    in.ModemID,
+			SIMCardID:  simID,
+			Sender:     in.From,
+			ConcatRef:  in.Concat.Ref,
+			Total:      in.Concat.Total,
+			Seq:        in.Concat.Seq,
+			Body:       in.Text,
+			Encoding:   in.Encoding,
+			ReceivedAt: in.ReceivedAt,
+		}
+		if err := s.repo.AddPart(ctx, part); err != nil {
+			return nil, err
+		}
+		parts, err := s.repo.TakeParts(ctx, in.ModemID, in.From, in.Concat.Ref, in.Concat.Total)
+		if err != nil {
+			return nil, err
+		}
+		if parts == nil {
+			return nil, nil
+		}
+		joinParts(msg, parts)
+	}
+
+	if err := s.repo.CreateMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+	s.received(ctx, msg)
+	return msg, nil
+}
+
+// simFor returns the SIM card an inbound message arrived on.
+func (s *Service) simFor(ctx context.Context, in Inbound) sql.NullInt64 {
+	if in.SIMCardID != 0 {
+		return sql.NullInt64{Int64: in.SIMCardID, Valid: true}
+	}
+	if in.ModemID == 0 || s.simRepo == nil {
+		return sql.NullInt64{}
+	}
+	sim, err := s.simRepo.GetSIMCardByModemID(ctx, int64(in.ModemID))
+	if err != nil {
+		if !errors.Is(err, repository.ErrNotFound) {
+			s.logger.WithError(err).WithField("modem_id", in.ModemID).Warn("Failed to look up SIM of inbound SMS")
+		}
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: sim.ID, Valid: true}
+}
+
+// joinParts fills a message from the parts of a long message, in order.
+// Parts that never arrived are counted in MissingParts.
+func joinParts(msg *models.SMSMessage, parts []models.SMSPart) {
+	var sb strings.Builder
+	for _, p := range parts {
+		sb.WriteString(p.Body)
+	}
+	first := parts[0]
+	msg.Body = sb.String()
+	msg.Parts = first.Total
+	msg.MissingParts = first.Total - len(parts)
+	msg.Encoding = first.Encoding
+	msg.CreatedAt = first.ReceivedAt
+	if msg.MissingParts < 0 {
+		msg.MissingParts = 0
+	}
+}
+
+// received logs a stored inbound message and notifies the handlers.
+func (s *Service) received(ctx context.Context, msg *models.SMSMessage) {
+	s.logger.WithFields(logrus.Fields{"sms_id": msg.ID, "modem_id": msg.ModemID.Int64, "from": msg.Number}).
+		Infof("SMS received (%d part(s))", msg.Parts)
+	for _, fn := range s.onReceive {
+		fn(ctx, msg)
+	}
+}
+
+// flushParts stores the long messages whose remaining parts stopped
+// arriving, with what did arrive.
+func (s *Service) flushParts(ctx context.Context) {
+	parts, err := s.repo.TakeStaleParts(ctx, time.Now().Add(-partTimeout))
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to collect incomplete SMS")
+		return
+	}
+	for len(parts) > 0 {
+		n := 1
+		for n < len(parts) && sameMessage(parts[0], parts[n]) {
+			n++
+		}
+		group := parts[:n]
+		parts = parts[n:]
+
+		first := group[0]
+		msg := &models.SMSMessage{
+			Direction: models.SMSDirectionInbound,
+			Status:    models.SMSStatusReceived,
+			ModemID:   sql.NullInt64{Int64: int64(first.ModemID), Valid: true},
+			SIMCardID: first.SIMCardID,
+			Number:    first.Sender,
+		}
+		joinParts(msg, group)
+		if err := s.repo.CreateMessage(ctx, msg); err != nil {
+			s.logger.WithError(err).WithField("from", first.Sender).Error("Failed to store incomplete SMS")
+			continue
+		}
+		s.logger.WithField("sms_id", msg.ID).Warnf("Stored SMS from %s with %d of %d parts missing", msg.Number, msg.MissingParts, msg.Parts)
+		s.received(ctx, msg)
+	}
+}
+
+func sameMessage(a, b models.SMSPart) bool {
+	return a.ModemID == b.ModemID && a.Sender == b.Sender && a.ConcatRef == b.ConcatRef && a.Total == b.Total
+}
+
+// SendStatus records whether the modem managed to send a queued message.
+func (s *Service) SendStatus(ctx context.Context, modemID int, taskID string, sent bool, detail string, at time.Time) error {
+	msg, err := s.repo.FindByTask(ctx, modemID, taskID)
+	if err != nil {
+		return err
+	}
+	status, errMsg := models.SMSStatusSent, ""
+	if !sent {
+		status, errMsg = models.SMSStatusFailed, detail
+	}
+	if err := s.repo.UpdateMessageStatus(ctx, msg.ID, status, errMsg, at); err != nil {
+		return err
+	}
+	s.logger.WithFields(logrus.Fields{"sms_id": msg.ID, "modem_id": modemID}).Infof("SMS to %s %s", msg.Number, status)
+	return nil
+}
+
+// HandleReport records a delivery report. Reports saying the service
+// centre is still trying are ignored.
+func (s *Service) HandleReport(ctx context.Context, report DeliveryReport) error {
+	if report.Pending {
+		return nil
+	}
+	msg, err := s.repo.FindAwaitingReport(ctx, report.ModemID, report.Number, report.Reference)
+	if err != nil {
+		return err
+	}
+	status, errMsg := models.SMSStatusDelivered, ""
+	if !report.Delivered {
+		status, errMsg = models.SMSStatusUndeliverable, "delivery failed: "+report.Detail
+	}
+	if report.At.IsZero() {
+		report.At = time.Now()
+	}
+	if err := s.repo.UpdateMessageStatus(ctx, msg.ID, status, errMsg, report.At); err != nil {
+		return err
+	}
+	s.logger.WithFields(logrus.Fields{"sms_id": msg.ID, "modem_id": report.ModemID}).Infof("SMS to %s %s", msg.Number, status)
+	return nil
+}
+
+// normalizeNumber strips the spaces, dashes and brackets people type into
+// phone numbers.
+func normalizeNumber(number string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')', '.':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(number))
+}
+
+// validNumber reports whether number is digits with an optional leading
+// plus.
+func validNumber(number string) bool {
+	digits := strings.TrimPrefix(number, "+")
+	if len(digits) < 3 || len(digits) > 20 {
+		return false
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,472 @@
+// Package ussd sends USSD codes on the gateway's SIM cards, follows the
+// menus they open and reads balances, expiry dates and bundles from the
+// responses.
+package ussd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+	"github.com/e173-gateway/e173_go_gateway/pkg/repository"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// replyTimeout is how long the network gets to answer a request.
+	replyTimeout = 30 * time.Second
+	// sessionTimeout is how long a menu waits for the next choice; networks
+	// drop idle menus after about this long.
+	sessionTimeout = 2 * time.Minute
+	// expireInterval is how often idle sessions are looked for.
+	expireInterval = 15 * time.Second
+	// maxCodeLength is the longest USSD string (3GPP TS 23.038).
+	maxCodeLength = 182
+)
+
+// Network status of a response (+CUSD <m>).
+const (
+	StatusUnknown      = -1
+	StatusDone         = 0 // no further action
+	StatusMenu         = 1 // the network waits for a reply
+	StatusTerminated   = 2 // ended by the network
+	StatusNotSupported = 4
+	StatusTimeout      = 5
+)
+
+var (
+	// ErrNoModem is returned for a SIM card that is not in a modem.
+	ErrNoModem = errors.New("ussd: SIM card is not in a modem")
+	// ErrBusy is returned while a request on the same modem awaits its
+	// response.
+	ErrBusy = errors.New("ussd: modem is waiting for another USSD response")
+	// ErrNoReply is returned when the network did not answer in time, or
+	// the caller stopped waiting once the request was sent: either way the
+	// network may have acted on it.
+	ErrNoReply = errors.New("ussd: no response from the network")
+	// ErrSessionClosed is returned when continuing a session that is no
+	// longer open.
+	ErrSessionClosed = errors.New("ussd: session is not open")
+	// ErrInvalidCode is returned for a code that cannot be sent.
+	ErrInvalidCode = errors.New("ussd: invalid code")
+	// ErrNotSent is returned when the modem could not send the request.
+	ErrNotSent = errors.New("ussd: request not sent")
+)
+
+// Transport sends USSD requests on a modem. Responses arrive later through
+// Service.HandleReply.
+type Transport interface {
+	SendUSSD(ctx context.Context, m *models.Modem, code string) (taskID string, err error)
+}
+
+// Reply is a USSD response from the network.
+type Reply struct {
+	Status int // StatusUnknown when the transport does not say
+	Text   string
+}
+
+// Request is a code to send, or a choice in an open menu.
+type Request struct {
+	Code      string `json:"code" binding:"required"`
+	SessionID int64  `json:"session_id"` // continue this session; 0 to continue the open one if the code is a menu choice
+}
+
+// Result is the outcome of a request.
+type Result struct {
+	Session  *models.USSDSession  `json:"session"`
+	Exchange *models.USSDExchange `json:"exchange"`
+	Parsed   *models.USSDParsed   `json:"parsed,omitempty"`
+	MenuOpen bool                 `json:"menu_open"` // the network waits for a choice
+}
+
+// pendingReply is a request waiting for its response.
+type pendingReply struct {
+	replies chan Reply
+	failed  chan string
+}
+
+// Service sends USSD requests, one at a time per modem, keeps the session
+// of each SIM card's open menu and logs every exchange with its SIM card.
+type Service struct {
+	repo      repository.USSDRepository
+	simRepo   repository.SIMCardRepository
+	modemRepo repository.ModemRepository
+	transport Transport
+	templates *Templates
+	logger    *logrus.Logger
+
+	mu       sync.Mutex
+	sessions map[int64]*models.USSDSession // open sessions by SIM card ID
+	pending  map[int]*pendingReply         // by modem ID
+
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewService creates a Service. templates may be nil for the built-in ones.
+func NewService(repo repository.USSDRepository, simRepo repository.SIMCardRepository, modemRepo repository.ModemRepository, transport Transport, templates *Templates, logger *logrus.Logger) *Service {
+	if templates == nil {
+		templates = DefaultTemplates()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Service{
+		repo:      repo,
+		simRepo:   simRepo,
+		modemRepo: modemRepo,
+		transport: transport,
+		templates: templates,
+		logger:    logger,
+		sessions:  make(map[int64]*models.USSDSession),
+		pending:   make(map[int]*pendingReply),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+}
+
+// Templates returns the operator templates responses are parsed with.
+func (s *Service) Templates() *Templates {
+	return s.templates
+}
+
+// Start closes the sessions a previous run left open, then times out idle
+// sessions in the background.
+func (s *Service) Start() {
+	if n, err := s.repo.ExpireOpenSessions(s.ctx, time.Now()); err != nil {
+		s.logger.WithError(err).Warn("Failed to expire stale USSD sessions")
+	} else if n > 0 {
+		s.logger.Infof("Expired %d USSD session(s) left open", n)
+	}
+
+	s.started = true
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.expireSessions(now)
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background work and waits for it to finish.
+func (s *Service) Stop() {
+	s.cancel()
+	if s.started {
+		<-s.done
+	}
+}
+
+// Send sends a request on a SIM card and waits for the network's response.
+// A menu choice continues the SIM's open session; a service code such as
+// "*580#" starts a new one. On ErrNoReply and ErrNotSent the Result is
+// returned too, recording the failed exchange.
+func (s *Service) Send(ctx context.Context, simID int64, req Request) (*Result, error) {
+	code := strings.TrimSpace(req.Code)
+	if !validCode(code) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCode, req.Code)
+	}
+	sim, err := s.simRepo.GetSIMCardByID(ctx, simID)
+	if err != nil {
+		return nil, err
+	}
+	if !sim.ModemID.Valid {
+		return nil, ErrNoModem
+	}
+	m, err := s.modemRepo.GetModemByID(ctx, int(sim.ModemID.Int64))
+	if err != nil {
+		return nil, err
+	}
+	operator := sim.OperatorName.String
+	if operator == "" && m.NetworkOperatorName != nil {
+		operator = *m.NetworkOperatorName
+	}
+
+	pending, session, err := s.begin(ctx, sim.ID, m.ID, operator, code, req.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.finish(m.ID)
+
+	logger := s.logger.WithFields(logrus.Fields{"sim_card_id": sim.ID, "modem_id": m.ID, "ussd_session_id": session.ID})
+	exchange := &models.USSDExchange{
+		SessionID: session.ID,
+		SIMCardID: sim.ID,
+		ModemID:   sql.NullInt64{Int64: int64(m.ID), Valid: true},
+		Request:   code,
+	}
+	if err := s.repo.CreateExchange(ctx, exchange); err != nil {
+		s.endSession(session, models.USSDSessionFailed)
+		return nil, err
+	}
+	result := &Result{Exchange: exchange}
+	// The session is shared with the background expiry; hand out a copy.
+	defer func() { result.Session = s.snapshot(session) }()
+
+	taskID, err := s.transport.SendUSSD(ctx, m, code)
+	exchange.TaskID = sql.NullString{String: taskID, Valid: taskID != ""}
+	if err != nil {
+		logger.WithError(err).Warnf("Failed to send USSD %s", code)
+		s.failExchange(exchange, session, models.USSDSessionFailed, err.Error())
+		return result, fmt.Errorf("%w: %v", ErrNotSent, err)
+	}
+	logger.Infof("USSD %s sent", code)
+
+	timer := time.NewTimer(replyTimeout)
+	defer timer.Stop()
+	var reply Reply
+	select {
+	case reply = <-pending.replies:
+	case detail := <-pending.failed:
+		logger.Warnf("USSD %s not sent: %s", code, detail)
+		s.failExchange(exchange, session, models.USSDSessionFailed, detail)
+		return result, fmt.Errorf("%w: %s", ErrNotSent, detail)
+	case <-timer.C:
+		logger.Warnf("No response to USSD %s", code)
+		s.failExchange(exchange, session, models.USSDSessionTimeout, ErrNoReply.Error())
+		return result, ErrNoReply
+	case <-ctx.Done():
+		s.failExchange(exchange, session, models.USSDSessionTimeout, ctx.Err().Error())
+		return result, fmt.Errorf("%w: %w", ErrNoReply, ctx.Err())
+	}
+
+	status := reply.Status
+	if status == StatusUnknown {
+		status = StatusDone
+		if looksLikeMenu(reply.Text) {
+			status = StatusMenu
+		}
+	}
+	parsed := s.templates.For(operator).Parse(reply.Text)
+	now := time.Now()
+	exchange.Response = sql.NullString{String: reply.Text, Valid: true}
+	exchange.NetworkStatus = sql.NullInt32{Int32: int32(status), Valid: true}
+	exchange.RespondedAt = sql.NullTime{Time: now, Valid: true}
+	if !parsed.Empty() {
+		exchange.Parsed, _ = json.Marshal(parsed)
+		result.Parsed = &parsed
+	}
+	if err := s.repo.CompleteExchange(context.Background(), exchange); err != nil {
+		logger.WithError(err).Error("Failed to store USSD response")
+	}
+
+	result.MenuOpen = status == StatusMenu
+	switch status {
+	case StatusMenu:
+		s.touchSession(session, now)
+	case StatusDone, StatusTerminated:
+		s.endSession(session, models.USSDSessionClosed)
+	case StatusTimeout:
+		s.endSession(session, models.USSDSessionTimeout)
+	default:
+		s.endSession(session, models.USSDSessionFailed)
+	}
+	logger.Infof("USSD %s answered (status %d): %q", code, status, reply.Text)
+	return result, nil
+}
+
+// begin reserves a modem for a request and returns the session it belongs
+// to, creating one when the request does not continue the open menu.
+func (s *Service) begin(ctx context.Context, simID int64, modemID int, operator, code string, sessionID int64) (*pendingReply, *models.USSDSession, error) {
+	s.mu.Lock()
+	if _, busy := s.pending[modemID]; busy {
+		s.mu.Unlock()
+		return nil, nil, ErrBusy
+	}
+	open := s.sessions[simID]
+	if sessionID != 0 && (open == nil || open.ID != sessionID) {
+		s.mu.Unlock()
+		return nil, nil, ErrSessionClosed
+	}
+	pending := &pendingReply{replies: make(chan Reply, 1), failed: make(chan string, 1)}
+	s.pending[modemID] = pending
+	s.mu.Unlock()
+
+	if open != nil && (sessionID != 0 || !isServiceCode(code)) {
+		return pending, open, nil
+	}
+	if open != nil {
+		// A new code ends the menu the SIM was in.
+		s.endSession(open, models.USSDSessionClosed)
+	}
+	session := &models.USSDSession{
+		SIMCardID:    simID,
+		ModemID:      sql.NullInt64{Int64: int64(modemID), Valid: true},
+		OperatorName: sql.NullString{String: operator, Valid: operator != ""},
+		Status:       models.USSDSessionOpen,
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		s.finish(modemID)
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	s.sessions[simID] = session
+	s.mu.Unlock()
+	return pending, session, nil
+}
+
+// finish releases a modem reserved by begin.
+func (s *Service) finish(modemID int) {
+	s.mu.Lock()
+	delete(s.pending, modemID)
+	s.mu.Unlock()
+}
+
+// HandleReply delivers a response that arrived on a modem to the request
+// waiting for it. Responses nobody waits for, such as network pushes or
+// duplicates, are logged and dropped.
+func (s *Service) HandleReply(modemID int, reply Reply) {
+	s.mu.Lock()
+	pending := s.pending[modemID]
+	s.mu.Unlock()
+	if pending != nil {
+		select {
+		case pending.replies <- reply:
+			return
+		default:
+		}
+	}
+	s.logger.WithField("modem_id", modemID).Debugf("Dropping unsolicited USSD response: %q", reply.Text)
+}
+
+// HandleSendFailure fails the request waiting on a modem, for transports
+// that report a failed send after accepting the request.
+func (s *Service) HandleSendFailure(modemID int, detail string) {
+	s.mu.Lock()
+	pending := s.pending[modemID]
+	s.mu.Unlock()
+	if pending != nil {
+		select {
+		case pending.failed <- detail:
+		default:
+		}
+	}
+}
+
+// failExchange records a request that got no response and ends its
+// session.
+func (s *Service) failExchange(exchange *models.USSDExchange, session *models.USSDSession, sessionStatus, errMsg string) {
+	exchange.Error = sql.NullString{String: errMsg, Valid: true}
+	if err := s.repo.CompleteExchange(context.Background(), exchange); err != nil {
+		s.logger.WithError(err).WithField("sim_card_id", exchange.SIMCardID).Error("Failed to store USSD error")
+	}
+	s.endSession(session, sessionStatus)
+}
+
+// touchSession keeps a session open for the next choice.
+func (s *Service) touchSession(session *models.USSDSession, at time.Time) {
+	s.mu.Lock()
+	session.LastActivityAt = at
+	s.mu.Unlock()
+	if err := s.repo.UpdateSession(context.Background(), session.ID, models.USSDSessionOpen, at); err != nil {
+		s.logger.WithError(err).WithField("ussd_session_id", session.ID).Error("Failed to update USSD session")
+	}
+}
+
+// endSession closes a session with the given status.
+func (s *Service) endSession(session *models.USSDSession, status string) {
+	now := time.Now()
+	s.mu.Lock()
+	if s.sessions[session.SIMCardID] == session {
+		delete(s.sessions, session.SIMCardID)
+	}
+	session.Status = status
+	session.LastActivityAt = now
+	session.EndedAt = sql.NullTime{Time: now, Valid: true}
+	s.mu.Unlock()
+	if err := s.repo.UpdateSession(context.Background(), session.ID, status, now); err != nil {
+		s.logger.WithError(err).WithField("ussd_session_id", session.ID).Error("Failed to close USSD session")
+	}
+}
+
+// expireSessions times out the menus nobody answered.
+func (s *Service) expireSessions(now time.Time) {
+	s.mu.Lock()
+	var stale []*models.USSDSession
+	for _, session := range s.sessions {
+		_, busy := s.pending[int(session.ModemID.Int64)]
+		if !busy && now.Sub(session.LastActivityAt) > sessionTimeout {
+			stale = append(stale, session)
+		}
+	}
+	s.mu.Unlock()
+	for _, session := range stale {
+		s.logger.WithFields(logrus.Fields{"sim_card_id": session.SIMCardID, "ussd_session_id": session.ID}).Info("USSD session timed out")
+		s.endSession(session, models.USSDSessionTimeout)
+	}
+}
+
+// OpenSession returns the open session of a SIM card, nil if none.
+func (s *Service) OpenSession(simID int64) *models.USSDSession {
+	s.mu.Lock()
+	session := s.sessions[simID]
+	s.mu.Unlock()
+	if session == nil {
+		return nil
+	}
+	return s.snapshot(session)
+}
+
+// snapshot returns a copy of a session.
+func (s *Service) snapshot(session *models.USSDSession) *models.USSDSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *session
+	return &copied
+}
+
+// CloseSession ends the open session of a SIM card. The network drops the
+// menu on its own once no choice arrives.
+func (s *Service) CloseSession(simID int64) error {
+	s.mu.Lock()
+	session := s.sessions[simID]
+	s.mu.Unlock()
+	if session == nil {
+		return ErrSessionClosed
+	}
+	s.endSession(session, models.USSDSessionClosed)
+	return nil
+}
+
+// validCode reports whether a code can be sent: printable, without the
+// quotes and line breaks that would break the AT command or AMI action.
+func validCode(code string) bool {
+	if code == "" || len(code) > maxCodeLength {
+		return false
+	}
+	for _, r := range code {
+		if r < ' ' || r == '"' || r == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// isServiceCode reports whether a code starts a new dialogue, like "*580#"
+// or "#100#", rather than answering a menu.
+func isServiceCode(code string) bool {
+	return (strings.HasPrefix(code, "*") || strings.HasPrefix(code, "#")) && strings.HasSuffix(code, "#")
+}
+
+// menuOption matches a numbered menu line such as "1. Solde" or "2) Pass".
+var menuOption = regexp.MustCompile(`(?m)^\s*\d{1,2}\s*[.):-]`)
+
+// looksLikeMenu guesses whether a response whose status is unknown offers
+// choices.
+func looksLikeMenu(text string) bool {
+	return len(menuOption.FindAllStringIndex(text, 3)) >= 2
+}
@@ -0,0 +1,222 @@
+package ussd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/e173-gateway/e173_go_gateway/pkg/models"
+)
+
+// Template reads values from the USSD responses of one operator. Each
+// pattern is a regular expression with named groups: "amount" and
+// optionally "currency" for the balance, "date" for the expiry and "amount"
+// and "unit" for the bundle remaining.
+type Template struct {
+	Name        string   `json:"name"`
+	Operators   []string `json:"operators"` // matched case-insensitively against the SIM's operator name
+	Balance     string   `json:"balance,omitempty"`
+	Expiry      string   `json:"expiry,omitempty"`
+	DateLayouts []string `json:"date_layouts,omitempty"` // Go layouts of the expiry date, with "/" separators
+	Bundle      string   `json:"bundle,omitempty"`
+	Currency    string   `json:"currency,omitempty"` // assumed when the response names none
+
+	balance, expiry, bundle *regexp.Regexp
+}
+
+// Patterns shared by the Moroccan operators, whose responses are mostly in
+// French: "Votre solde est de 12,50 DH valable jusqu'au 15/11/2026",
+// "Il vous reste 1,5 Go".
+const (
+	frBalance = `(?i)(?:solde|balance|cr[eé]dit)[^0-9]{0,40}?(?P<amount>\d+(?:[.,]\d+)?)\s*(?P<currency>dhs?|mad|dirhams?)?`
+	frExpiry  = `(?i)(?:valable|valid|validit[eé]|expir\w*|fin)[^0-9]{0,40}?(?P<date>\d{1,2}[/.-]\d{1,2}[/.-]\d{2,4})`
+	frBundle  = `(?i)(?:reste|restant|internet|data|pass)[^0-9]{0,40}?(?P<amount>\d+(?:[.,]\d+)?)\s*(?P<unit>[gmk][ob])\b`
+)
+
+var frDateLayouts = []string{"2/1/2006", "2/1/06"}
+
+// DefaultTemplates returns the built-in templates for Maroc Telecom, Orange
+// and Inwi, and a generic one for other operators.
+func DefaultTemplates() *Templates {
+	t, err := newTemplates([]Template{
+		{Name: "maroc-telecom", Operators: []string{"maroc telecom", "iam", "itissalat"}, Balance: frBalance, Expiry: frExpiry, DateLayouts: frDateLayouts, Bundle: frBundle, Currency: "MAD"},
+		{Name: "orange", Operators: []string{"orange", "meditel", "medi telecom"}, Balance: frBalance, Expiry: frExpiry, DateLayouts: frDateLayouts, Bundle: frBundle, Currency: "MAD"},
+		{Name: "inwi", Operators: []string{"inwi", "wana"}, Balance: frBalance, Expiry: frExpiry, DateLayouts: frDateLayouts, Bundle: frBundle, Currency: "MAD"},
+		{Name: "generic", Balance: frBalance, Expiry: frExpiry, DateLayouts: frDateLayouts, Bundle: frBundle},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Templates picks the template for a SIM's operator.
+type Templates struct {
+	list []*Template
+}
+
+// LoadTemplates reads templates from a JSON file holding an array of
+// Template. A template named like a built-in one replaces it; others are
+// added, ahead of the generic template.
+func LoadTemplates(path string) (*Templates, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read USSD templates: %w", err)
+	}
+	var custom []Template
+	if err := json.Unmarshal(b, &custom); err != nil {
+		return nil, fmt.Errorf("failed to parse USSD templates %s: %w", path, err)
+	}
+
+	var list []Template
+	for _, def := range DefaultTemplates().list {
+		list = append(list, *def)
+	}
+	for _, c := range custom {
+		replaced := false
+		for i := range list {
+			if strings.EqualFold(list[i].Name, c.Name) {
+				list[i], replaced = c, true
+			}
+		}
+		if !replaced {
+			// Before the generic template, which matches any operator.
+			list = append(list[:len(list)-1], c, list[len(list)-1])
+		}
+	}
+	return newTemplates(list)
+}
+
+func newTemplates(list []Template) (*Templates, error) {
+	t := &Templates{}
+	for i := range list {
+		tpl := list[i]
+		var err error
+		if tpl.balance, err = compile(tpl.Balance); err == nil {
+			if tpl.expiry, err = compile(tpl.Expiry); err == nil {
+				tpl.bundle, err = compile(tpl.Bundle)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("USSD template %q: %w", tpl.Name, err)
+		}
+		if len(tpl.DateLayouts) == 0 {
+			tpl.DateLayouts = frDateLayouts
+		}
+		t.list = append(t.list, &tpl)
+	}
+	return t, nil
+}
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// For returns the template of an operator: the first whose operator names
+// it contains, else the first without operator names.
+func (t *Templates) For(operator string) *Template {
+	operator = strings.ToLower(operator)
+	var fallback *Template
+	for _, tpl := range t.list {
+		if len(tpl.Operators) == 0 {
+			if fallback == nil {
+				fallback = tpl
+			}
+			continue
+		}
+		for _, name := range tpl.Operators {
+			if operator != "" && strings.Contains(operator, strings.ToLower(name)) {
+				return tpl
+			}
+		}
+	}
+	if fallback == nil {
+		fallback = &Template{Name: "none"}
+	}
+	return fallback
+}
+
+// Parse reads the balance, expiry date and bundle remaining from a
+// response.
+func (t *Template) Parse(text string) models.USSDParsed {
+	p := models.USSDParsed{Template: t.Name}
+	if g := match(t.balance, text); g != nil {
+		if amount, ok := parseAmount(g["amount"]); ok {
+			p.Balance = &amount
+			p.Currency = normalizeCurrency(g["currency"], t.Currency)
+		}
+	}
+	if g := match(t.expiry, text); g != nil {
+		if date, ok := parseDate(g["date"], t.DateLayouts); ok {
+			p.ExpiresAt = &date
+		}
+	}
+	if g := match(t.bundle, text); g != nil {
+		if amount, ok := parseAmount(g["amount"]); ok {
+			unit := strings.ToUpper(g["unit"][:1])
+			p.BundleRemaining = strings.TrimSpace(g["amount"] + " " + g["unit"])
+			mb := amount
+			switch unit {
+			case "G":
+				mb = amount * 1024
+			case "K":
+				mb = amount / 1024
+			}
+			p.BundleMB = &mb
+		}
+	}
+	return p
+}
+
+// match returns the named groups of the first match of re in text, nil if
+// none.
+func match(re *regexp.Regexp, text string) map[string]string {
+	if re == nil {
+		return nil
+	}
+	m := re.FindStringSubmatch(text)
+	if m == nil {
+		return nil
+	}
+	groups := make(map[string]string, len(m))
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			groups[name] = m[i]
+		}
+	}
+	return groups
+}
+
+// parseAmount parses an amount written with a decimal point or comma.
+func parseAmount(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	return v, err == nil
+}
+
+// parseDate parses a day-first date with "/", "-" or "." separators.
+func parseDate(s string, layouts []string) (time.Time, bool) {
+	s = strings.NewReplacer("-", "/", ".", "/").Replace(s)
+	for _, layout := range layouts {
+		if d, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return d, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func normalizeCurrency(found, fallback string) string {
+	switch strings.ToLower(found) {
+	case "dh", "dhs", "mad", "dirham", "dirhams":
+		return "MAD"
+	case "":
+		return fallback
+	}
+	return strings.ToUpper(found)
+}
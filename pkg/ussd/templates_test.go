@@ -0,0 +1,183 @@
+package ussd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDefaultTemplatesParse(t *testing.T) {
+	tests := []struct {
+		name, operator, text string
+		template             string
+		balance              float64 // 0 when the reply has none
+		currency             string
+		expires              string // 2006-01-02, "" when the reply has none
+		bundle               string
+		bundleMB             float64
+	}{
+		{
+			name:     "maroc telecom balance",
+			operator: "IAM",
+			text:     "Votre solde est de 23,45 DH. Valable jusqu'au 15/11/2026. Merci.",
+			template: "maroc-telecom", balance: 23.45, currency: "MAD", expires: "2026-11-15",
+		},
+		{
+			name:     "maroc telecom balance with point and no space",
+			operator: "Maroc Telecom",
+			text:     "Solde: 10.00DH, validite: 31/12/2026",
+			template: "maroc-telecom", balance: 10, currency: "MAD", expires: "2026-12-31",
+		},
+		{
+			name:     "maroc telecom internet",
+			operator: "IAM",
+			text:     "Il vous reste 1,5 Go valable jusqu'au 20/11/2026",
+			template: "maroc-telecom", expires: "2026-11-20", bundle: "1,5 Go", bundleMB: 1536,
+		},
+		{
+			name:     "orange credit",
+			operator: "Orange MA",
+			text:     "Cher client, votre credit est de 7,20 DHS valable jusqu'au 05-12-2026",
+			template: "orange", balance: 7.2, currency: "MAD", expires: "2026-12-05",
+		},
+		{
+			name:     "orange pass",
+			operator: "Orange MA",
+			text:     "Pass Internet: il vous reste 750 Mo",
+			template: "orange", bundle: "750 Mo", bundleMB: 750,
+		},
+		{
+			name:     "inwi balance in MAD",
+			operator: "INWI",
+			text:     "Votre solde principal: 15,00 MAD. Date d'expiration: 01.01.27",
+			template: "inwi", balance: 15, currency: "MAD", expires: "2027-01-01",
+		},
+		{
+			name:     "inwi data in Ko",
+			operator: "inwi",
+			text:     "Data: 512 Ko restants",
+			template: "inwi", bundle: "512 Ko", bundleMB: 0.5,
+		},
+		{
+			name:     "inwi without currency",
+			operator: "inwi",
+			text:     "Votre solde est de 3,5",
+			template: "inwi", balance: 3.5, currency: "MAD",
+		},
+		{
+			name:     "unknown operator",
+			operator: "Lebara",
+			text:     "Your balance is 4,75 and is valid until 02/03/2027",
+			template: "generic", balance: 4.75, expires: "2027-03-02",
+		},
+		{
+			name:     "nothing to read",
+			operator: "IAM",
+			text:     "Service momentanement indisponible",
+			template: "maroc-telecom",
+		},
+	}
+
+	templates := DefaultTemplates()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl := templates.For(tt.operator)
+			p := tpl.Parse(tt.text)
+			if p.Template != tt.template {
+				t.Errorf("Template = %q, want %q", p.Template, tt.template)
+			}
+			switch {
+			case tt.balance == 0 && p.Balance != nil:
+				t.Errorf("Balance = %v, want none", *p.Balance)
+			case tt.balance != 0 && (p.Balance == nil || *p.Balance != tt.balance):
+				t.Errorf("Balance = %v, want %v", p.Balance, tt.balance)
+			case p.Currency != tt.currency && tt.balance != 0:
+				t.Errorf("Currency = %q, want %q", p.Currency, tt.currency)
+			}
+			var expires string
+			if p.ExpiresAt != nil {
+				expires = p.ExpiresAt.Format("2006-01-02")
+			}
+			if expires != tt.expires {
+				t.Errorf("ExpiresAt = %q, want %q", expires, tt.expires)
+			}
+			if p.BundleRemaining != tt.bundle {
+				t.Errorf("BundleRemaining = %q, want %q", p.BundleRemaining, tt.bundle)
+			}
+			switch {
+			case tt.bundle == "" && p.BundleMB != nil:
+				t.Errorf("BundleMB = %v, want none", *p.BundleMB)
+			case tt.bundle != "" && (p.BundleMB == nil || *p.BundleMB != tt.bundleMB):
+				t.Errorf("BundleMB = %v, want %v", p.BundleMB, tt.bundleMB)
+			}
+			if p.Empty() != (tt.balance == 0 && tt.expires == "" && tt.bundle == "") {
+				t.Errorf("Empty() = %v", p.Empty())
+			}
+		})
+	}
+}
+
+func TestParseExpiryIsLocalMidnight(t *testing.T) {
+	p := DefaultTemplates().For("IAM").Parse("Solde 5 DH valable jusqu'au 15/11/2026")
+	want := time.Date(2026, time.November, 15, 0, 0, 0, 0, time.Local)
+	if p.ExpiresAt == nil || !p.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", p.ExpiresAt, want)
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ussd_templates.json")
+	err := os.WriteFile(path, []byte(`[
+		{"name": "lebara", "operators": ["lebara"], "balance": "(?i)credit:\\s*(?P<amount>\\d+(?:[.,]\\d+)?)", "currency": "EUR"},
+		{"name": "INWI", "operators": ["inwi"], "balance": "(?i)reste\\s*(?P<amount>\\d+)\\s*(?P<currency>dh)"}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := LoadTemplates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tpl := range templates.list {
+		names = append(names, tpl.Name)
+	}
+	want := []string{"maroc-telecom", "orange", "INWI", "lebara", "generic"}
+	if len(names) != len(want) {
+		t.Fatalf("templates = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("templates = %v, want %v", names, want)
+		}
+	}
+
+	// The added template is picked before the generic one.
+	p := templates.For("Lebara").Parse("Credit: 2,50")
+	if p.Template != "lebara" || p.Balance == nil || *p.Balance != 2.5 || p.Currency != "EUR" {
+		t.Errorf("Lebara parsed %+v, want 2.5 EUR with lebara", p)
+	}
+	// The replaced one reads its own pattern only.
+	p = templates.For("inwi").Parse("Il vous reste 20 DH")
+	if p.Template != "INWI" || p.Balance == nil || *p.Balance != 20 || p.Currency != "MAD" {
+		t.Errorf("inwi parsed %+v, want 20 MAD with INWI", p)
+	}
+	if p = templates.For("inwi").Parse("Il vous reste 1 Go"); !p.Empty() {
+		t.Errorf("replaced inwi template read %+v", p)
+	}
+	if tpl := templates.For("Some Operator"); tpl.Name != "generic" {
+		t.Errorf("For(unknown) = %q, want generic", tpl.Name)
+	}
+}
+
+func TestLoadTemplatesBadPattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ussd_templates.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "bad", "balance": "(?P<amount>"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTemplates(path); err == nil {
+		t.Error("LoadTemplates accepted a template with a bad pattern")
+	}
+}
@@ -1,3 +1,8 @@
+//go:build libphonenumber
+
+// Built only with -tags libphonenumber, on a host with the library and
+// cpp/libphonenumber_wrapper installed; see libphonenumber_stub.go.
+
 package validation
 
 // #cgo CFLAGS: -I./cpp
@@ -0,0 +1,38 @@
+//go:build !libphonenumber
+
+package validation
+
+import "errors"
+
+// errNoLibPhoneNumber is returned by NewLibPhoneNumberValidator in builds
+// without the libphonenumber tag, so that packages importing validation
+// do not need the C++ library to link.
+var errNoLibPhoneNumber = errors.New("libphonenumber support not built in; build with -tags libphonenumber")
+
+// LibPhoneNumberValidator uses Google's official libphonenumber C++ library
+type LibPhoneNumberValidator struct{}
+
+// NewLibPhoneNumberValidator always fails without the libphonenumber tag.
+func NewLibPhoneNumberValidator() (*LibPhoneNumberValidator, error) {
+	return nil, errNoLibPhoneNumber
+}
+
+// ValidatePhoneNumber validates and parses a phone number
+func (l *LibPhoneNumberValidator) ValidatePhoneNumber(phoneNumber string, defaultRegion ...string) (*PhoneNumberInfo, error) {
+	return nil, errNoLibPhoneNumber
+}
+
+// IsValid implements PhoneNumberValidator interface
+func (l *LibPhoneNumberValidator) IsValid(phoneNumber string) bool {
+	return false
+}
+
+// IsValidMobile checks if a number is a valid mobile number
+func (l *LibPhoneNumberValidator) IsValidMobile(phoneNumber string) bool {
+	return false
+}
+
+// FormatInternational formats a number in international format
+func (l *LibPhoneNumberValidator) FormatInternational(phoneNumber string) string {
+	return phoneNumber
+}
@@ -55,9 +55,6 @@ func NewWhisperProvider(apiKey string) *WhisperProvider {
 
 // TranscribeAudio converts audio to text using Whisper
 func (w *WhisperProvider) TranscribeAudio(ctx context.Context, audio io.Reader) (*Transcript, error) {
-    // Create multipart form data
-    var requestBody bytes.Buffer
-    
     // For now, we'll create a simple JSON request
     // In production, this would be multipart/form-data with the audio file
     audioData, err := io.ReadAll(audio)